@@ -2,18 +2,24 @@ package api
 
 import (
 	"fmt"
+	"time"
 )
 
 // AgentCheck represents a check known to the agent
 type AgentCheck struct {
-	Node        string
-	CheckID     string
-	Name        string
-	Status      string
-	Notes       string
-	Output      string
-	ServiceID   string
-	ServiceName string
+	Node          string
+	CheckID       string
+	Name          string
+	Status        string
+	Notes         string
+	Output        string
+	ServiceID     string
+	ServiceName   string
+	Informational bool
+
+	// External defines a check to be run by the external checker pool.
+	// It's only used when registering checks through the catalog.
+	External *ExternalCheck
 }
 
 // AgentService represents a service known to the agent
@@ -23,6 +29,44 @@ type AgentService struct {
 	Tags    []string
 	Port    int
 	Address string
+
+	// CacheMaxAge is how long, in seconds, query results for the service
+	// may be cached. Zero means no hint is given.
+	CacheMaxAge int
+
+	// DNSTTL is the TTL, in seconds, for DNS answers about the service.
+	// Zero means the agent's configured TTL is used.
+	DNSTTL int
+
+	// Weights are the instance's DNS SRV weights, if any were given.
+	Weights *AgentWeights
+
+	// Meta is key/value metadata describing the service.
+	Meta map[string]string
+
+	// TaggedAddresses holds other named addresses for the service, such
+	// as "wan".
+	TaggedAddresses map[string]string
+
+	// Source is what registered the service. An external registrator
+	// should set it to "external" when writing to the catalog.
+	// RegisteredAt is filled in by the catalog with the time it first
+	// saw the instance, and ExpiresAt with when it will be removed, if
+	// ever.
+	Source       string
+	RegisteredAt time.Time
+	ExpiresAt    time.Time
+
+	// Draining is set when the instance is draining, which keeps it out
+	// of health queries and DNS while it stays in the catalog.
+	Draining bool
+}
+
+// AgentWeights are the DNS SRV weights of a service instance, depending on
+// the state of its health checks.
+type AgentWeights struct {
+	Passing int
+	Warning int
 }
 
 // AgentMember represents a cluster member known to the agent
@@ -49,6 +93,28 @@ type AgentServiceRegistration struct {
 	Address string   `json:",omitempty"`
 	Check   *AgentServiceCheck
 	Checks  AgentServiceChecks
+
+	// CacheMaxAge is how long, in seconds, query results for the service
+	// may be cached.
+	CacheMaxAge int `json:",omitempty"`
+
+	// DNSTTL is the TTL, in seconds, for DNS answers about the service.
+	DNSTTL int `json:",omitempty"`
+
+	// Weights are the instance's DNS SRV weights when its checks are
+	// passing, and when any of them is warning.
+	Weights *AgentWeights `json:",omitempty"`
+
+	// Meta is key/value metadata describing the service.
+	Meta map[string]string `json:",omitempty"`
+}
+
+// AgentCheckUpdate is used to update the status of a TTL check as
+// part of a batch. Status is one of "passing", "warning", or "critical".
+type AgentCheckUpdate struct {
+	CheckID string
+	Status  string
+	Output  string
 }
 
 // AgentCheckRegistration is used to register a new check
@@ -70,6 +136,36 @@ type AgentServiceCheck struct {
 	HTTP     string `json:",omitempty"`
 	TCP      string `json:",omitempty"`
 	Status   string `json:",omitempty"`
+
+	// Informational checks never affect the health of the service.
+	Informational bool `json:",omitempty"`
+
+	// Method, Header, Body and SuccessCodes customize HTTP checks.
+	Method       string              `json:",omitempty"`
+	Header       map[string][]string `json:",omitempty"`
+	Body         string              `json:",omitempty"`
+	SuccessCodes []string            `json:",omitempty"`
+
+	// TLS makes a TCP check complete a TLS handshake. TLSCertExpiry is a
+	// duration such as "720h".
+	TLS           bool   `json:",omitempty"`
+	TLSServerName string `json:",omitempty"`
+	TLSSkipVerify bool   `json:",omitempty"`
+	TLSCertExpiry string `json:",omitempty"`
+
+	// Interval checks only report a new status once they have returned
+	// it this many times in a row.
+	SuccessBeforePassing   int `json:",omitempty"`
+	FailuresBeforeCritical int `json:",omitempty"`
+
+	// DeregisterCriticalServiceAfter is a duration such as "90m". The
+	// service is deregistered once the check has been critical this long.
+	DeregisterCriticalServiceAfter string `json:",omitempty"`
+
+	// MaxOutputSize, RunAsUser and Chroot constrain script checks.
+	MaxOutputSize int    `json:",omitempty"`
+	RunAsUser     string `json:",omitempty"`
+	Chroot        string `json:",omitempty"`
 }
 type AgentServiceChecks []*AgentServiceCheck
 
@@ -229,6 +325,19 @@ func (a *Agent) UpdateTTL(checkID, note, status string) error {
 	return nil
 }
 
+// UpdateTTLs is used to update the status of many TTL checks at once.
+// The agent syncs them to the servers in a single batch.
+func (a *Agent) UpdateTTLs(updates []*AgentCheckUpdate) error {
+	r := a.c.newRequest("PUT", "/v1/agent/check/batch")
+	r.obj = updates
+	_, resp, err := requireOK(a.c.doRequest(r))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
 // CheckRegister is used to register a new check with
 // the local agent
 func (a *Agent) CheckRegister(check *AgentCheckRegistration) error {
@@ -313,6 +313,43 @@ func TestAgent_Checks(t *testing.T) {
 	}
 }
 
+func TestAgent_UpdateTTLs(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	agent := c.Agent()
+
+	for _, name := range []string{"foo", "bar"} {
+		reg := &AgentCheckRegistration{
+			Name: name,
+		}
+		reg.TTL = "15s"
+		if err := agent.CheckRegister(reg); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	updates := []*AgentCheckUpdate{
+		{CheckID: "foo", Status: "passing", Output: "ok"},
+		{CheckID: "bar", Status: "warning"},
+	}
+	if err := agent.UpdateTTLs(updates); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	checks, err := agent.Checks()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if chk := checks["foo"]; chk == nil || chk.Status != "passing" || chk.Output != "ok" {
+		t.Fatalf("bad: %v", chk)
+	}
+	if chk := checks["bar"]; chk == nil || chk.Status != "warning" {
+		t.Fatalf("bad: %v", chk)
+	}
+}
+
 func TestAgent_CheckStartPassing(t *testing.T) {
 	t.Parallel()
 	c, s := makeClient(t)
@@ -37,6 +37,11 @@ type QueryOptions struct {
 	// until the timeout or the next index is reached
 	WaitIndex uint64
 
+	// WaitHash is used with WaitIndex on KV listings so a blocking query
+	// only returns once the listed contents differ from the ones with
+	// this hash, rather than on any change to the index.
+	WaitHash string
+
 	// WaitTime is used to bound the duration of a wait.
 	// Defaults to that of the Config, but can be overridden.
 	WaitTime time.Duration
@@ -50,6 +55,25 @@ type QueryOptions struct {
 	// that node. Setting this to "_agent" will use the agent's node
 	// for the sort.
 	Near string
+
+	// NodeMeta is used to filter results to nodes with the given
+	// metadata key/value pairs.
+	NodeMeta map[string]string
+
+	// Filter is an expression evaluated on the servers to select which
+	// results to return, such as `Service.Service == redis`. It's only
+	// supported by the catalog node and service listings and the health
+	// service endpoints.
+	Filter string
+
+	// Coordinates asks for each node's network coordinate to be included
+	// in the results. It's only supported by the health service endpoint.
+	Coordinates bool
+
+	// ConsistencyToken is taken from the WriteMeta of an earlier KV write.
+	// The read is then only served once that write is visible, even if
+	// AllowStale is set.
+	ConsistencyToken string
 }
 
 // WriteOptions are used to parameterize a write
@@ -78,12 +102,25 @@ type QueryMeta struct {
 
 	// How long did the request take
 	RequestTime time.Duration
+
+	// Datacenter that served the request
+	Datacenter string
+
+	// LastContentHash is the hash of the contents returned by a KV
+	// listing. This can be used as a WaitHash to perform a blocking
+	// query that ignores writes which don't change the contents.
+	LastContentHash string
 }
 
 // WriteMeta is used to return meta data about a write
 type WriteMeta struct {
 	// How long did the request take
 	RequestTime time.Duration
+
+	// ConsistencyToken is returned by KV writes. It can be given as the
+	// ConsistencyToken of a later query to be sure of reading the write.
+	// It's only meaningful in the datacenter the write was made in.
+	ConsistencyToken string
 }
 
 // HttpBasicAuth is used to authenticate http client with HTTP Basic Authentication
@@ -250,6 +287,9 @@ func (r *request) setQueryOptions(q *QueryOptions) {
 	if q.WaitIndex != 0 {
 		r.params.Set("index", strconv.FormatUint(q.WaitIndex, 10))
 	}
+	if q.WaitHash != "" {
+		r.params.Set("hash", q.WaitHash)
+	}
 	if q.WaitTime != 0 {
 		r.params.Set("wait", durToMsec(q.WaitTime))
 	}
@@ -259,6 +299,18 @@ func (r *request) setQueryOptions(q *QueryOptions) {
 	if q.Near != "" {
 		r.params.Set("near", q.Near)
 	}
+	for key, value := range q.NodeMeta {
+		r.params.Add("node-meta", key+":"+value)
+	}
+	if q.Filter != "" {
+		r.params.Set("filter", q.Filter)
+	}
+	if q.Coordinates {
+		r.params.Set("coordinates", "")
+	}
+	if q.ConsistencyToken != "" {
+		r.params.Set("consistency-token", q.ConsistencyToken)
+	}
 }
 
 // durToMsec converts a duration to a millisecond specified string
@@ -416,6 +468,12 @@ func parseQueryMeta(resp *http.Response, q *QueryMeta) error {
 	default:
 		q.KnownLeader = false
 	}
+
+	// Parse the X-Consul-Datacenter
+	q.Datacenter = header.Get("X-Consul-Datacenter")
+
+	// Parse the X-Consul-Content-Hash
+	q.LastContentHash = header.Get("X-Consul-Content-Hash")
 	return nil
 }
 
@@ -1,18 +1,51 @@
 package api
 
+import (
+	"time"
+)
+
 type Node struct {
-	Node    string
-	Address string
+	Node            string
+	Address         string
+	TaggedAddresses map[string]string
+	Meta            map[string]string
 }
 
 type CatalogService struct {
-	Node           string
-	Address        string
-	ServiceID      string
-	ServiceName    string
-	ServiceAddress string
-	ServiceTags    []string
-	ServicePort    int
+	Node            string
+	Address         string
+	TaggedAddresses map[string]string
+	NodeMeta        map[string]string
+	ServiceID       string
+	ServiceName     string
+	ServiceAddress  string
+	ServiceTags     []string
+	ServicePort     int
+
+	// ServiceCacheMaxAge is how long, in seconds, results for this service
+	// may be cached. Zero means no hint was given.
+	ServiceCacheMaxAge     int
+	ServiceMeta            map[string]string
+	ServiceTaggedAddresses map[string]string
+
+	// ServiceDNSTTL is the TTL, in seconds, for DNS answers about this
+	// service. Zero means the agent's configured TTL is used.
+	ServiceDNSTTL int
+
+	// ServiceWeights are the instance's DNS SRV weights, if any were given.
+	ServiceWeights *AgentWeights
+
+	// ServiceSource is what registered the service: "agent", "catalog",
+	// or "external". ServiceRegisteredAt is when the catalog first saw
+	// this instance, and ServiceExpiresAt is when it will be removed if
+	// it was registered with an ExpiresAfter.
+	ServiceSource       string
+	ServiceRegisteredAt time.Time
+	ServiceExpiresAt    time.Time
+
+	// ServiceDraining is set when the instance is draining. Draining
+	// instances are left out of health queries and DNS.
+	ServiceDraining bool
 }
 
 type CatalogNode struct {
@@ -20,12 +53,27 @@ type CatalogNode struct {
 	Services map[string]*AgentService
 }
 
+// CatalogDump holds every node, service instance, and health check in a
+// datacenter, all read at the index returned in the QueryMeta.
+type CatalogDump struct {
+	Nodes    []*Node
+	Services []*CatalogService
+	Checks   []*HealthCheck
+}
+
 type CatalogRegistration struct {
-	Node       string
-	Address    string
-	Datacenter string
-	Service    *AgentService
-	Check      *AgentCheck
+	Node            string
+	Address         string
+	TaggedAddresses map[string]string
+	Datacenter      string
+	NodeMeta        map[string]string
+	Service         *AgentService
+	Check           *AgentCheck
+
+	// ExpiresAfter is an optional duration, such as "90s", after which
+	// the service is removed unless it's registered again. It's meant
+	// for external services with no agent to keep them in sync.
+	ExpiresAfter string
 }
 
 type CatalogDeregistration struct {
@@ -36,6 +84,15 @@ type CatalogDeregistration struct {
 	CheckID    string
 }
 
+// CatalogDrain marks a service instance as draining, or puts it back into
+// service when Draining is false.
+type CatalogDrain struct {
+	Datacenter string
+	Node       string
+	ServiceID  string
+	Draining   bool
+}
+
 // Catalog can be used to query the Catalog endpoints
 type Catalog struct {
 	c *Client
@@ -78,6 +135,24 @@ func (c *Catalog) Deregister(dereg *CatalogDeregistration, q *WriteOptions) (*Wr
 	return wm, nil
 }
 
+// Drain is used to mark a service instance as draining, or to put it back
+// into service
+func (c *Catalog) Drain(drain *CatalogDrain, q *WriteOptions) (*WriteMeta, error) {
+	r := c.c.newRequest("PUT", "/v1/catalog/drain")
+	r.setWriteOptions(q)
+	r.obj = drain
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{}
+	wm.RequestTime = rtt
+
+	return wm, nil
+}
+
 // Datacenters is used to query for all the known datacenters
 func (c *Catalog) Datacenters() ([]string, error) {
 	r := c.c.newRequest("GET", "/v1/catalog/datacenters")
@@ -115,6 +190,28 @@ func (c *Catalog) Nodes(q *QueryOptions) ([]*Node, *QueryMeta, error) {
 	return out, qm, nil
 }
 
+// Dump is used to fetch every node, service instance, and health check in
+// one consistent read
+func (c *Catalog) Dump(q *QueryOptions) (*CatalogDump, *QueryMeta, error) {
+	r := c.c.newRequest("GET", "/v1/catalog/dump")
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out CatalogDump
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
+
 // Services is used to query for all known services
 func (c *Catalog) Services(q *QueryOptions) (map[string][]string, *QueryMeta, error) {
 	r := c.c.newRequest("GET", "/v1/catalog/services")
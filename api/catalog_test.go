@@ -57,6 +57,33 @@ func TestCatalog_Nodes(t *testing.T) {
 	})
 }
 
+func TestCatalog_Dump(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	catalog := c.Catalog()
+
+	testutil.WaitForResult(func() (bool, error) {
+		dump, meta, err := catalog.Dump(nil)
+		if err != nil {
+			return false, err
+		}
+
+		if meta.LastIndex == 0 {
+			return false, fmt.Errorf("Bad: %v", meta)
+		}
+
+		if len(dump.Nodes) == 0 || len(dump.Services) == 0 || len(dump.Checks) == 0 {
+			return false, fmt.Errorf("Bad: %v", dump)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %s", err)
+	})
+}
+
 func TestCatalog_Services(t *testing.T) {
 	t.Parallel()
 	c, s := makeClient(t)
@@ -197,6 +224,25 @@ func TestCatalog_Registration(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	})
 
+	// Drain the service
+	drain := &CatalogDrain{
+		Datacenter: "dc1",
+		Node:       "foobar",
+		ServiceID:  "redis1",
+		Draining:   true,
+	}
+	if _, err := catalog.Drain(drain, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	services, _, err := catalog.Service("redis", "", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(services) != 1 || !services[0].ServiceDraining {
+		t.Fatalf("bad: %v", services)
+	}
+
 	// Test catalog deregistration of the previously registered service
 	dereg := &CatalogDeregistration{
 		Datacenter: "dc1",
@@ -2,18 +2,52 @@ package api
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/hashicorp/serf/coordinate"
 )
 
 // HealthCheck is used to represent a single check
 type HealthCheck struct {
+	Node          string
+	CheckID       string
+	Name          string
+	Status        string
+	Notes         string
+	Output        string
+	ServiceID     string
+	ServiceName   string
+	Informational bool
+
+	// Suppressed is set when the check's status changed to warning or
+	// critical while a maintenance window covering it was in effect.
+	Suppressed bool
+
+	// External is set for checks of external services, which are run by
+	// the agents in the external checker pool.
+	External *ExternalCheck
+}
+
+// ExternalCheck defines an HTTP or TCP check of an external service.
+// Checker is the node the leader assigned to run it.
+type ExternalCheck struct {
+	HTTP     string
+	TCP      string
+	Interval time.Duration
+	Timeout  time.Duration
+	Checker  string
+}
+
+// CheckTransition records a health check changing status, with the
+// output it had at the time and the Raft index of the change
+type CheckTransition struct {
 	Node        string
 	CheckID     string
-	Name        string
-	Status      string
-	Notes       string
-	Output      string
 	ServiceID   string
 	ServiceName string
+	Status      string
+	Output      string
+	Index       uint64
 }
 
 // ServiceEntry is used for the health service endpoint
@@ -21,6 +55,27 @@ type ServiceEntry struct {
 	Node    *Node
 	Service *AgentService
 	Checks  []*HealthCheck
+
+	// Coord is only set when QueryOptions.Coordinates is.
+	Coord *coordinate.Coordinate
+}
+
+// ServiceSummary counts the instances of a service in each health state
+type ServiceSummary struct {
+	Tags      []string
+	Instances int
+	Passing   int
+	Warning   int
+	Critical  int
+}
+
+// NodeLiveness is the gossip view of a node's liveness, with no
+// catalog data
+type NodeLiveness struct {
+	Node     string
+	Address  string
+	Status   string
+	LastSeen time.Time
 }
 
 // Health can be used to query the Health endpoints
@@ -54,6 +109,28 @@ func (h *Health) Node(node string, q *QueryOptions) ([]*HealthCheck, *QueryMeta,
 	return out, qm, nil
 }
 
+// CheckHistory is used to return the recent transitions of a check,
+// oldest first
+func (h *Health) CheckHistory(node, checkID string, q *QueryOptions) ([]*CheckTransition, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/history/"+node+"/"+checkID)
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*CheckTransition
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
 // Checks is used to return the checks associated with a service
 func (h *Health) Checks(service string, q *QueryOptions) ([]*HealthCheck, *QueryMeta, error) {
 	r := h.c.newRequest("GET", "/v1/health/checks/"+service)
@@ -104,6 +181,31 @@ func (h *Health) Service(service, tag string, passingOnly bool, q *QueryOptions)
 	return out, qm, nil
 }
 
+// Summary is used to count the instances of each service in each health
+// state, optionally only for the services whose names start with a prefix.
+func (h *Health) Summary(prefix string, q *QueryOptions) (map[string]*ServiceSummary, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/summary")
+	r.setQueryOptions(q)
+	if prefix != "" {
+		r.params.Set("prefix", prefix)
+	}
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out map[string]*ServiceSummary
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
 // State is used to retrieve all the checks in a given state.
 // The wildcard "any" state can also be used for all checks.
 func (h *Health) State(state string, q *QueryOptions) ([]*HealthCheck, *QueryMeta, error) {
@@ -134,3 +236,29 @@ func (h *Health) State(state string, q *QueryOptions) ([]*HealthCheck, *QueryMet
 	}
 	return out, qm, nil
 }
+
+// Liveness is used to query the gossip liveness of the given nodes,
+// without reading the catalog. If no nodes are given, all known nodes
+// are returned.
+func (h *Health) Liveness(nodes []string, q *QueryOptions) ([]*NodeLiveness, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/liveness")
+	r.setQueryOptions(q)
+	for _, node := range nodes {
+		r.params.Add("node", node)
+	}
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*NodeLiveness
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
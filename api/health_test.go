@@ -123,3 +123,31 @@ func TestHealth_State(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	})
 }
+
+func TestHealth_Liveness(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	agent := c.Agent()
+	health := c.Health()
+
+	info, err := agent.Self()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	name := info["Config"]["NodeName"].(string)
+
+	testutil.WaitForResult(func() (bool, error) {
+		nodes, _, err := health.Liveness([]string{name}, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(nodes) != 1 || nodes[0].Node != name || nodes[0].Status != "alive" {
+			return false, fmt.Errorf("bad: %v", nodes)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %s", err)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KVPair is used to represent a single K/V entry
@@ -18,6 +19,15 @@ type KVPair struct {
 	Flags       uint64
 	Value       []byte
 	Session     string
+
+	// ExpiresAt is when the key will be deleted, if it was written with
+	// a TTL.
+	ExpiresAt time.Time
+
+	// TTL is an optional duration, such as "30s", after which the key is
+	// deleted unless it has been written again. It's only used by writes;
+	// writing without one clears any earlier expiration.
+	TTL string `json:"-"`
 }
 
 // KVPairs is a list of KVPair objects
@@ -127,6 +137,9 @@ func (k *KV) Put(p *KVPair, q *WriteOptions) (*WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	if p.TTL != "" {
+		params["ttl"] = p.TTL
+	}
 	_, wm, err := k.put(p.Key, params, p.Value, q)
 	return wm, err
 }
@@ -139,6 +152,9 @@ func (k *KV) CAS(p *KVPair, q *WriteOptions) (bool, *WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	if p.TTL != "" {
+		params["ttl"] = p.TTL
+	}
 	params["cas"] = strconv.FormatUint(p.ModifyIndex, 10)
 	return k.put(p.Key, params, p.Value, q)
 }
@@ -151,6 +167,9 @@ func (k *KV) Acquire(p *KVPair, q *WriteOptions) (bool, *WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	if p.TTL != "" {
+		params["ttl"] = p.TTL
+	}
 	params["acquire"] = p.Session
 	return k.put(p.Key, params, p.Value, q)
 }
@@ -163,10 +182,39 @@ func (k *KV) Release(p *KVPair, q *WriteOptions) (bool, *WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	if p.TTL != "" {
+		params["ttl"] = p.TTL
+	}
 	params["release"] = p.Session
 	return k.put(p.Key, params, p.Value, q)
 }
 
+// Append is used to atomically add the Value to the end of the
+// key's current value, creating the key if needed. The Key, Value
+// and TTL are respected, and the key keeps its flags.
+func (k *KV) Append(p *KVPair, q *WriteOptions) (*WriteMeta, error) {
+	params := make(map[string]string, 2)
+	if p.TTL != "" {
+		params["ttl"] = p.TTL
+	}
+	params["append"] = ""
+	_, wm, err := k.put(p.Key, params, p.Value, q)
+	return wm, err
+}
+
+// Patch is used to atomically apply the Value as a JSON merge patch
+// (RFC 7386) to the key's current value, which must be JSON. The
+// Key, Value and TTL are respected, and the key keeps its flags.
+func (k *KV) Patch(p *KVPair, q *WriteOptions) (*WriteMeta, error) {
+	params := make(map[string]string, 2)
+	if p.TTL != "" {
+		params["ttl"] = p.TTL
+	}
+	params["patch"] = ""
+	_, wm, err := k.put(p.Key, params, p.Value, q)
+	return wm, err
+}
+
 func (k *KV) put(key string, params map[string]string, body []byte, q *WriteOptions) (bool, *WriteMeta, error) {
 	if len(key) > 0 && key[0] == '/' {
 		return false, nil, fmt.Errorf("Invalid key. Key must not begin with a '/': %s", key)
@@ -186,6 +234,7 @@ func (k *KV) put(key string, params map[string]string, body []byte, q *WriteOpti
 
 	qm := &WriteMeta{}
 	qm.RequestTime = rtt
+	qm.ConsistencyToken = resp.Header.Get("X-Consul-Consistency-Token")
 
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, resp.Body); err != nil {
@@ -230,6 +279,7 @@ func (k *KV) deleteInternal(key string, params map[string]string, q *WriteOption
 
 	qm := &WriteMeta{}
 	qm.RequestTime = rtt
+	qm.ConsistencyToken = resp.Header.Get("X-Consul-Consistency-Token")
 
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, resp.Body); err != nil {
@@ -238,3 +288,100 @@ func (k *KV) deleteInternal(key string, params map[string]string, q *WriteOption
 	res := strings.Contains(string(buf.Bytes()), "true")
 	return res, qm, nil
 }
+
+// KVOp is a verb used in a KV transaction
+type KVOp string
+
+const (
+	KVSet       KVOp = "set"
+	KVDelete         = "delete"
+	KVDeleteCAS      = "delete-cas"
+	KVCAS            = "cas"
+	KVLock           = "lock"
+	KVUnlock         = "unlock"
+	KVGet            = "get"
+)
+
+// KVTxnOp is a single operation in a KV transaction. Index is the
+// ModifyIndex used by the cas, delete-cas and get verbs. A get fails the
+// transaction if the key doesn't exist, or if Index is set and the key has
+// been modified since then.
+type KVTxnOp struct {
+	Verb    KVOp
+	Key     string
+	Value   []byte
+	Flags   uint64
+	Index   uint64
+	Session string
+}
+
+// KVTxnOps is a list of KV transaction operations
+type KVTxnOps []*KVTxnOp
+
+// TxnError says why the operation at OpIndex caused a transaction to be
+// rolled back
+type TxnError struct {
+	OpIndex int
+	What    string
+}
+
+// TxnErrors is a list of transaction errors
+type TxnErrors []*TxnError
+
+// KVTxnResponse is the result of a KV transaction. If it was applied,
+// Results has the entry as it stands after each operation, which is nil
+// for deletes. Writes don't return the value. Otherwise Errors says why it
+// was rolled back.
+type KVTxnResponse struct {
+	Results []*KVPair
+	Errors  TxnErrors
+}
+
+// Txn is used to apply several KV operations atomically. Either all of the
+// operations are applied, or none are. The bool is true if the transaction
+// was applied.
+func (k *KV) Txn(txn KVTxnOps, q *WriteOptions) (bool, *KVTxnResponse, *WriteMeta, error) {
+	type txnOp struct {
+		KV *KVTxnOp
+	}
+	ops := make([]*txnOp, 0, len(txn))
+	for _, op := range txn {
+		ops = append(ops, &txnOp{KV: op})
+	}
+
+	r := k.c.newRequest("PUT", "/v1/txn")
+	r.setWriteOptions(q)
+	r.obj = ops
+	rtt, resp, err := k.c.doRequest(r)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &WriteMeta{}
+	qm.RequestTime = rtt
+
+	// A conflict means the transaction was rolled back, and the body
+	// says why.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		var buf bytes.Buffer
+		io.Copy(&buf, resp.Body)
+		return false, nil, nil, fmt.Errorf("Unexpected response code: %d (%s)", resp.StatusCode, buf.Bytes())
+	}
+
+	var out struct {
+		Results []struct {
+			KV *KVPair
+		}
+		Errors TxnErrors
+	}
+	if err := decodeBody(resp, &out); err != nil {
+		return false, nil, nil, err
+	}
+
+	txnResp := &KVTxnResponse{Errors: out.Errors}
+	for _, result := range out.Results {
+		txnResp.Results = append(txnResp.Results, result.KV)
+	}
+	return resp.StatusCode == http.StatusOK, txnResp, qm, nil
+}
@@ -445,3 +445,156 @@ func TestClient_AcquireRelease(t *testing.T) {
 		t.Fatalf("unexpected value: %#v", meta)
 	}
 }
+
+func TestClient_AppendPatch(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	kv := c.KV()
+
+	// Append creates the key, then adds to it
+	key := testKey()
+	for _, line := range []string{"one\n", "two\n"} {
+		if _, err := kv.Append(&KVPair{Key: key, Value: []byte(line)}, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	pair, _, err := kv.Get(key, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || string(pair.Value) != "one\ntwo\n" {
+		t.Fatalf("bad: %#v", pair)
+	}
+
+	// Patch merges into a JSON value
+	key = testKey()
+	p := &KVPair{Key: key, Flags: 42, Value: []byte(`{"a": 1, "b": {"c": 2}}`)}
+	if _, err := kv.Put(p, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	p.Value = []byte(`{"a": null, "b": {"d": 3}}`)
+	if _, err := kv.Patch(p, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pair, _, err = kv.Get(key, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || string(pair.Value) != `{"b":{"c":2,"d":3}}` || pair.Flags != 42 {
+		t.Fatalf("bad: %#v", pair)
+	}
+
+	// Bad patches are rejected
+	p.Value = []byte("nope")
+	if _, err := kv.Patch(p, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestClient_ConsistencyToken(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	kv := c.KV()
+
+	key := testKey()
+	wm, err := kv.Put(&KVPair{Key: key, Value: []byte("test")}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if wm.ConsistencyToken == "" {
+		t.Fatalf("missing token")
+	}
+
+	// A stale read with the token sees the write
+	q := &QueryOptions{AllowStale: true, ConsistencyToken: wm.ConsistencyToken}
+	pair, _, err := kv.Get(key, q)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || string(pair.Value) != "test" {
+		t.Fatalf("bad: %#v", pair)
+	}
+
+	// Deletes hand back a newer token
+	dm, err := kv.Delete(key, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dm.ConsistencyToken == "" || dm.ConsistencyToken == wm.ConsistencyToken {
+		t.Fatalf("bad: %v", dm.ConsistencyToken)
+	}
+	q.ConsistencyToken = dm.ConsistencyToken
+	pair, _, err = kv.Get(key, q)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair != nil {
+		t.Fatalf("bad: %#v", pair)
+	}
+}
+
+func TestClient_Txn(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	kv := c.KV()
+
+	// Set two keys at once, one only if it doesn't exist yet
+	key1, key2 := testKey(), testKey()
+	txn := KVTxnOps{
+		&KVTxnOp{
+			Verb:  KVSet,
+			Key:   key1,
+			Value: []byte("test"),
+		},
+		&KVTxnOp{
+			Verb:  KVCAS,
+			Key:   key2,
+			Value: []byte("test"),
+		},
+	}
+	ok, ret, _, err := kv.Txn(txn, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	} else if !ok {
+		t.Fatalf("transaction failure: %v", ret.Errors)
+	}
+	if len(ret.Results) != 2 || ret.Results[0].Key != key1 || ret.Results[1].Key != key2 {
+		t.Fatalf("bad: %v", ret)
+	}
+
+	// Both keys should be there
+	for _, key := range []string{key1, key2} {
+		pair, _, err := kv.Get(key, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if pair == nil || !bytes.Equal(pair.Value, []byte("test")) {
+			t.Fatalf("unexpected value: %#v", pair)
+		}
+	}
+
+	// Doing it again rolls back, since the second key exists
+	txn[0].Value = []byte("changed")
+	ok, ret, _, err = kv.Txn(txn, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	} else if ok {
+		t.Fatalf("transaction should have failed")
+	}
+	if len(ret.Errors) != 1 || ret.Errors[0].OpIndex != 1 {
+		t.Fatalf("bad: %v", ret.Errors)
+	}
+	pair, _, err := kv.Get(key1, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || !bytes.Equal(pair.Value, []byte("test")) {
+		t.Fatalf("unexpected value: %#v", pair)
+	}
+}
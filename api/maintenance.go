@@ -0,0 +1,111 @@
+package api
+
+import (
+	"time"
+)
+
+// MaintenanceWindow is a scheduled period of maintenance for a node, a
+// service, or a service on one node. Checks keep running during a window,
+// but their status changes are marked as suppressed.
+type MaintenanceWindow struct {
+	CreateIndex          uint64
+	ModifyIndex          uint64
+	ID                   string
+	Node                 string
+	ServiceName          string
+	Start                time.Time
+	End                  time.Time
+	Recurrence           time.Duration
+	Reason               string
+	ExcludeFromDiscovery bool
+	InEffect             bool
+}
+
+// Maintenance can be used to query the maintenance window endpoints
+type Maintenance struct {
+	c *Client
+}
+
+// Maintenance returns a handle to the maintenance window endpoints
+func (c *Client) Maintenance() *Maintenance {
+	return &Maintenance{c}
+}
+
+// Set is used to create or update a maintenance window. A window without an
+// ID is created and given one.
+func (m *Maintenance) Set(window *MaintenanceWindow, q *WriteOptions) (string, *WriteMeta, error) {
+	r := m.c.newRequest("PUT", "/v1/maintenance/window")
+	r.setWriteOptions(q)
+	r.obj = window
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	var out struct{ ID string }
+	if err := decodeBody(resp, &out); err != nil {
+		return "", nil, err
+	}
+	return out.ID, wm, nil
+}
+
+// Delete is used to remove a maintenance window
+func (m *Maintenance) Delete(id string, q *WriteOptions) (*WriteMeta, error) {
+	r := m.c.newRequest("DELETE", "/v1/maintenance/window/"+id)
+	r.setWriteOptions(q)
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	return wm, nil
+}
+
+// Info is used to look up a maintenance window
+func (m *Maintenance) Info(id string, q *QueryOptions) (*MaintenanceWindow, *QueryMeta, error) {
+	r := m.c.newRequest("GET", "/v1/maintenance/window/"+id)
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var entries []*MaintenanceWindow
+	if err := decodeBody(resp, &entries); err != nil {
+		return nil, nil, err
+	}
+	if len(entries) > 0 {
+		return entries[0], qm, nil
+	}
+	return nil, qm, nil
+}
+
+// List is used to get all the maintenance windows
+func (m *Maintenance) List(q *QueryOptions) ([]*MaintenanceWindow, *QueryMeta, error) {
+	r := m.c.newRequest("GET", "/v1/maintenance/windows")
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var entries []*MaintenanceWindow
+	if err := decodeBody(resp, &entries); err != nil {
+		return nil, nil, err
+	}
+	return entries, qm, nil
+}
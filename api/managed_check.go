@@ -0,0 +1,113 @@
+package api
+
+import (
+	"time"
+)
+
+// ManagedCheck is a check definition kept by the servers and run by every
+// agent it matches. A check with a ServiceName is added to each instance of
+// that service, and one without is added to the node. NodeMeta limits the
+// check to the nodes whose metadata has all of the given pairs.
+type ManagedCheck struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	ID          string
+	Name        string
+	Notes       string
+	ServiceName string
+	NodeMeta    map[string]string
+	Script      string
+	HTTP        string
+	TCP         string
+	Interval    time.Duration
+	Timeout     time.Duration
+}
+
+// ManagedChecks can be used to query the managed check endpoints
+type ManagedChecks struct {
+	c *Client
+}
+
+// ManagedChecks returns a handle to the managed check endpoints
+func (c *Client) ManagedChecks() *ManagedChecks {
+	return &ManagedChecks{c}
+}
+
+// Set is used to create or update a managed check. A check without an
+// ID is created and given one.
+func (m *ManagedChecks) Set(check *ManagedCheck, q *WriteOptions) (string, *WriteMeta, error) {
+	r := m.c.newRequest("PUT", "/v1/managed-check")
+	r.setWriteOptions(q)
+	r.obj = check
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	var out struct{ ID string }
+	if err := decodeBody(resp, &out); err != nil {
+		return "", nil, err
+	}
+	return out.ID, wm, nil
+}
+
+// Delete is used to remove a managed check
+func (m *ManagedChecks) Delete(id string, q *WriteOptions) (*WriteMeta, error) {
+	r := m.c.newRequest("DELETE", "/v1/managed-check/"+id)
+	r.setWriteOptions(q)
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	return wm, nil
+}
+
+// Info is used to look up a managed check
+func (m *ManagedChecks) Info(id string, q *QueryOptions) (*ManagedCheck, *QueryMeta, error) {
+	r := m.c.newRequest("GET", "/v1/managed-check/"+id)
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var entries []*ManagedCheck
+	if err := decodeBody(resp, &entries); err != nil {
+		return nil, nil, err
+	}
+	if len(entries) > 0 {
+		return entries[0], qm, nil
+	}
+	return nil, qm, nil
+}
+
+// List is used to get all the managed checks
+func (m *ManagedChecks) List(q *QueryOptions) ([]*ManagedCheck, *QueryMeta, error) {
+	r := m.c.newRequest("GET", "/v1/managed-checks")
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(m.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var entries []*ManagedCheck
+	if err := decodeBody(resp, &entries); err != nil {
+		return nil, nil, err
+	}
+	return entries, qm, nil
+}
@@ -1,5 +1,26 @@
 package api
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ServerReadiness reports whether a server is caught up and healthy enough
+// to service requests. Status names the first condition that failed, or
+// is "ready".
+type ServerReadiness struct {
+	Ready        bool
+	Status       string
+	KnownLeader  bool
+	LastContact  time.Duration
+	CommitIndex  uint64
+	AppliedIndex uint64
+	SerfHealthy  bool
+	ACLCacheWarm bool
+}
+
 // Status can be used to query the Status endpoints
 type Status struct {
 	c *Client
@@ -41,3 +62,26 @@ func (s *Status) Peers() ([]string, error) {
 	}
 	return peers, nil
 }
+
+// Ready is used to query the readiness of the agent's server. A server that
+// isn't ready is not an error; check the Ready field of the result.
+func (s *Status) Ready() (*ServerReadiness, error) {
+	r := s.c.newRequest("GET", "/v1/status/ready")
+	_, resp, err := s.c.doRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 503 {
+		var buf bytes.Buffer
+		io.Copy(&buf, resp.Body)
+		return nil, fmt.Errorf("Unexpected response code: %d (%s)", resp.StatusCode, buf.Bytes())
+	}
+
+	var out ServerReadiness
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
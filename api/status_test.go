@@ -1,7 +1,10 @@
 package api
 
 import (
+	"fmt"
 	"testing"
+
+	"github.com/hashicorp/consul/testutil"
 )
 
 func TestStatusLeader(t *testing.T) {
@@ -35,3 +38,24 @@ func TestStatusPeers(t *testing.T) {
 		t.Fatalf("Expected peers ")
 	}
 }
+
+func TestStatusReady(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	status := c.Status()
+
+	testutil.WaitForResult(func() (bool, error) {
+		ready, err := status.Ready()
+		if err != nil {
+			return false, err
+		}
+		if !ready.Ready {
+			return false, fmt.Errorf("not ready: %s", ready.Status)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,6 +26,9 @@ const (
 	// Path to save agent service definitions
 	servicesDir = "services"
 
+	// Path to save the generated node ID
+	nodeIDFile = "node-id"
+
 	// Path to save local agent checks
 	checksDir     = "checks"
 	checkStateDir = "checks/state"
@@ -33,6 +37,9 @@ const (
 	serviceMaintCheckPrefix = "_service_maintenance"
 	nodeMaintCheckID        = "_node_maintenance"
 
+	// The prefix of the IDs of the checks managed by the servers
+	managedCheckPrefix = "_managed_check"
+
 	// Default reasons for node/service maintenance mode
 	defaultNodeMaintReason = "Maintenance mode is enabled for this node, " +
 		"but no reason was provided. This is a default message."
@@ -86,9 +93,27 @@ type Agent struct {
 	// checkDockers maps the check ID to an associated Docker Exec based check
 	checkDockers map[string]*CheckDocker
 
+	// checkReapAfter maps the check ID to a timeout after which we should
+	// reap its associated service
+	checkReapAfter map[string]time.Duration
+
 	// checkLock protects updates to the check* maps
 	checkLock sync.Mutex
 
+	// managedChecks maps the IDs of the managed checks we've registered
+	// to the index they were last changed at. It's only used by the
+	// managed check sync.
+	managedChecks map[string]uint64
+
+	// skippedManagedChecks maps the IDs of the managed script checks we've
+	// refused to run to the index we last warned about them at, so the
+	// warning isn't repeated on every sync.
+	skippedManagedChecks map[string]uint64
+
+	// externalChecks holds the external checks we've been assigned, keyed
+	// by node and check ID. It's only used by runExternalChecks.
+	externalChecks map[string]*externalCheck
+
 	// eventCh is used to receive user events
 	eventCh chan serf.UserEvent
 
@@ -146,22 +171,45 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 		config.AdvertiseAddrWan = config.AdvertiseAddr
 	}
 
+	// Tag the node with its advertise addresses, unless they're given
+	tagged := map[string]string{
+		structs.TaggedAddressLAN: config.AdvertiseAddr,
+		structs.TaggedAddressWAN: config.AdvertiseAddrWan,
+	}
+	for name, addr := range config.TaggedAddresses {
+		tagged[name] = addr
+	}
+	config.TaggedAddresses = tagged
+
+	// Load or generate the node ID
+	if err := setupNodeID(config); err != nil {
+		return nil, err
+	}
+
 	agent := &Agent{
-		config:        config,
-		logger:        log.New(logOutput, "", log.LstdFlags),
-		logOutput:     logOutput,
-		checkMonitors: make(map[string]*CheckMonitor),
-		checkTTLs:     make(map[string]*CheckTTL),
-		checkHTTPs:    make(map[string]*CheckHTTP),
-		checkTCPs:     make(map[string]*CheckTCP),
-		checkDockers:  make(map[string]*CheckDocker),
-		eventCh:       make(chan serf.UserEvent, 1024),
-		eventBuf:      make([]*UserEvent, 256),
-		shutdownCh:    make(chan struct{}),
+		config:               config,
+		logger:               log.New(logOutput, "", log.LstdFlags),
+		logOutput:            logOutput,
+		checkMonitors:        make(map[string]*CheckMonitor),
+		checkTTLs:            make(map[string]*CheckTTL),
+		checkHTTPs:           make(map[string]*CheckHTTP),
+		checkTCPs:            make(map[string]*CheckTCP),
+		checkDockers:         make(map[string]*CheckDocker),
+		checkReapAfter:       make(map[string]time.Duration),
+		managedChecks:        make(map[string]uint64),
+		skippedManagedChecks: make(map[string]uint64),
+		externalChecks:       make(map[string]*externalCheck),
+		eventCh:              make(chan serf.UserEvent, 1024),
+		eventBuf:             make([]*UserEvent, 256),
+		shutdownCh:           make(chan struct{}),
 	}
 
 	// Initialize the local state
 	agent.state.Init(config, agent.logger)
+	if len(config.CheckWebhooks) != 0 {
+		agent.state.webhooks = newCheckWebhookNotifier(config.CheckWebhooks, agent.logger)
+		go agent.state.webhooks.Run(agent.shutdownCh)
+	}
 
 	// Setup either the client or the server
 	var err error
@@ -196,6 +244,19 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 	// Start handling events
 	go agent.handleEvents()
 
+	// Start watching for critical services to deregister.
+	go agent.reapServices()
+
+	// Start running the checks the servers manage for us.
+	if config.EnableManagedChecks {
+		go agent.syncManagedChecks()
+	}
+
+	// Run the external checks the leader assigns us.
+	if config.ExternalChecker {
+		go agent.runExternalChecks()
+	}
+
 	// Start sending network coordinate to the server.
 	if !config.DisableCoordinates {
 		go agent.sendCoordinate()
@@ -210,6 +271,36 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 	return agent, nil
 }
 
+// setupNodeID fills in the node ID if it isn't configured. The first time
+// the agent starts it generates a random ID, which is kept in the data dir
+// so the node has the same ID across restarts and name changes.
+func setupNodeID(config *Config) error {
+	if config.NodeID != "" {
+		return nil
+	}
+
+	file := filepath.Join(config.DataDir, nodeIDFile)
+	buf, err := ioutil.ReadFile(file)
+	if err == nil {
+		if id := strings.TrimSpace(string(buf)); id != "" {
+			config.NodeID = id
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed reading node ID file %q: %s", file, err)
+	}
+
+	id := generateUUID()
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return fmt.Errorf("failed creating data dir %q: %s", config.DataDir, err)
+	}
+	if err := ioutil.WriteFile(file, []byte(id), 0600); err != nil {
+		return fmt.Errorf("failed writing file %q: %s", file, err)
+	}
+	config.NodeID = id
+	return nil
+}
+
 // consulConfig is used to return a consul configuration
 func (a *Agent) consulConfig() *consul.Config {
 	// Start with the provided config or default config
@@ -305,6 +396,60 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.SessionTTLMinRaw != "" {
 		base.SessionTTLMin = a.config.SessionTTLMin
 	}
+	if a.config.ReapLockGracePeriodRaw != "" {
+		base.ReapLockGracePeriod = a.config.ReapLockGracePeriod
+	}
+	if a.config.TombstoneTTLRaw != "" {
+		base.TombstoneTTL = a.config.TombstoneTTL
+	}
+	if a.config.TombstoneTTLGranularityRaw != "" {
+		base.TombstoneTTLGranularity = a.config.TombstoneTTLGranularity
+	}
+	if a.config.KVSRecycleRetentionRaw != "" {
+		base.KVSRecycleRetention = a.config.KVSRecycleRetention
+	}
+	if a.config.KVSMaxValueSize != 0 {
+		base.KVSMaxValueSize = a.config.KVSMaxValueSize
+	}
+	if a.config.KVSCompressThreshold != 0 {
+		base.KVSCompressThreshold = a.config.KVSCompressThreshold
+	}
+	if len(a.config.KVSEncryptionKey) != 0 {
+		base.KVSEncryptionKey = a.config.KVSEncryptionKey
+		base.KVSEncryptPrefixes = a.config.KVSEncryptPrefixes
+	}
+	if a.config.FollowerConsistentReads {
+		base.FollowerConsistentReads = true
+	}
+	if a.config.RejectDuplicateServiceIDs {
+		base.RejectDuplicateServiceIDs = true
+	}
+	if a.config.AdaptiveCoordinateUpdates {
+		base.AdaptiveCoordinateUpdates = true
+	}
+	if a.config.ExternalChecker {
+		base.ExternalChecker = true
+	}
+	if len(a.config.KVSQuotas) != 0 {
+		base.KVSQuotas = make(map[string]structs.KVSQuota)
+		for prefix, quota := range a.config.KVSQuotas {
+			base.KVSQuotas[prefix] = structs.KVSQuota{
+				MaxBytes: quota.MaxBytes,
+				MaxKeys:  quota.MaxKeys,
+			}
+		}
+	}
+	if len(a.config.KVSEvents) != 0 {
+		base.KVSEvents = make(map[string]string)
+		for prefix, name := range a.config.KVSEvents {
+			base.KVSEvents[prefix] = name
+		}
+	}
+	base.CapacityThresholds = structs.CapacityThresholds{
+		ServiceInstances: a.config.CapacityThresholds.ServiceInstances,
+		Services:         a.config.CapacityThresholds.Services,
+		KVSKeys:          a.config.CapacityThresholds.KVSKeys,
+	}
 
 	// Format the build string
 	revision := a.config.Revision
@@ -322,6 +467,7 @@ func (a *Agent) consulConfig() *consul.Config {
 	base.CertFile = a.config.CertFile
 	base.KeyFile = a.config.KeyFile
 	base.ServerName = a.config.ServerName
+	base.TLSBootstrap = a.config.TLSBootstrap
 	base.Domain = a.config.Domain
 
 	// Setup the ServerUp callback
@@ -624,12 +770,195 @@ func (a *Agent) sendCoordinate() {
 	}
 }
 
+// reapServicesInternal does a single pass, looking for services to reap.
+func (a *Agent) reapServicesInternal() {
+	reaped := make(map[string]struct{})
+	for checkID, check := range a.state.CriticalChecks() {
+		// There's nothing to do if there's no service.
+		if check.Check.ServiceID == "" {
+			continue
+		}
+
+		// There might be multiple checks for one service, so
+		// we don't need to reap multiple times.
+		serviceID := check.Check.ServiceID
+		if _, ok := reaped[serviceID]; ok {
+			continue
+		}
+
+		// See if there's a timeout.
+		a.checkLock.Lock()
+		timeout, ok := a.checkReapAfter[checkID]
+		a.checkLock.Unlock()
+
+		// Reap, if necessary. We keep track of which service
+		// this is so that we won't try to remove it again.
+		if ok && check.CriticalFor > timeout {
+			reaped[serviceID] = struct{}{}
+			if err := a.RemoveService(serviceID, true); err != nil {
+				a.logger.Printf("[ERR] agent: failed to deregister service %q: %v",
+					serviceID, err)
+				continue
+			}
+			a.logger.Printf("[INFO] agent: Check %q for service %q has been critical for too long; deregistered service",
+				checkID, serviceID)
+		}
+	}
+}
+
+// reapServices is a long running goroutine that looks for checks that have
+// been critical too long and deregisters their associated services.
+func (a *Agent) reapServices() {
+	for {
+		select {
+		case <-time.After(a.config.CheckReapInterval):
+			a.reapServicesInternal()
+
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+// managedCheckID returns the local ID of a managed check, which is specific
+// to the service instance it's attached to, if there is one.
+func managedCheckID(checkID, serviceID string) string {
+	if serviceID == "" {
+		return fmt.Sprintf("%s:%s", managedCheckPrefix, checkID)
+	}
+	return fmt.Sprintf("%s:%s:%s", managedCheckPrefix, checkID, serviceID)
+}
+
+// updateManagedChecks brings the local checks in line with the managed
+// checks that apply to this node. Checks with a service are added to each
+// local instance of it. Only new or changed checks are re-registered, so
+// the others keep their status.
+func (a *Agent) updateManagedChecks(checks structs.ManagedChecks) {
+	services := a.state.Services()
+	registered := a.state.Checks()
+
+	wanted := make(map[string]struct{})
+	add := func(mc *structs.ManagedCheck, service *structs.NodeService) {
+		check := &structs.HealthCheck{
+			Node:   a.config.NodeName,
+			Name:   mc.Name,
+			Notes:  mc.Notes,
+			Status: structs.HealthCritical,
+		}
+		if service != nil {
+			check.ServiceID = service.ID
+			check.ServiceName = service.Service
+		}
+		check.CheckID = managedCheckID(mc.ID, check.ServiceID)
+		wanted[check.CheckID] = struct{}{}
+
+		// Leave the check alone if it hasn't changed.
+		if index, ok := a.managedChecks[check.CheckID]; ok && index == mc.ModifyIndex {
+			if _, ok := registered[check.CheckID]; ok {
+				return
+			}
+		}
+
+		chkType := &CheckType{
+			Script:   mc.Script,
+			HTTP:     mc.HTTP,
+			TCP:      mc.TCP,
+			Interval: mc.Interval,
+			Timeout:  mc.Timeout,
+		}
+		if err := a.AddCheck(check, chkType, false, a.config.ACLToken); err != nil {
+			a.logger.Printf("[ERR] agent: failed to register managed check %q: %v", check.CheckID, err)
+			return
+		}
+		a.managedChecks[check.CheckID] = mc.ModifyIndex
+		a.logger.Printf("[DEBUG] agent: registered managed check %q", check.CheckID)
+	}
+	for _, mc := range checks {
+		// Script checks run whatever command the servers give us, so they
+		// need their own opt-in.
+		if mc.Script != "" && !a.config.EnableManagedScriptChecks {
+			if index, ok := a.skippedManagedChecks[mc.ID]; !ok || index != mc.ModifyIndex {
+				a.logger.Printf("[WARN] agent: not running managed check %q since managed script checks are disabled", mc.ID)
+				a.skippedManagedChecks[mc.ID] = mc.ModifyIndex
+			}
+			continue
+		}
+		if mc.ServiceName == "" {
+			add(mc, nil)
+			continue
+		}
+		for _, service := range services {
+			if service.Service == mc.ServiceName {
+				add(mc, service)
+			}
+		}
+	}
+
+	// Remove the checks that no longer apply.
+	for checkID := range a.managedChecks {
+		if _, ok := wanted[checkID]; ok {
+			continue
+		}
+		if err := a.RemoveCheck(checkID, false); err != nil {
+			a.logger.Printf("[ERR] agent: failed to deregister managed check %q: %v", checkID, err)
+			continue
+		}
+		delete(a.managedChecks, checkID)
+		a.logger.Printf("[DEBUG] agent: deregistered managed check %q", checkID)
+	}
+}
+
+// syncManagedChecks is a long running goroutine that watches the servers
+// for the managed checks that apply to this node and keeps them registered.
+// The watch times out every ManagedCheckInterval, so checks for services
+// registered since the last change are picked up too.
+func (a *Agent) syncManagedChecks() {
+	var index uint64
+	for {
+		args := structs.NodeSpecificRequest{
+			Datacenter: a.config.Datacenter,
+			Node:       a.config.NodeName,
+			QueryOptions: structs.QueryOptions{
+				Token:         a.config.ACLToken,
+				MinQueryIndex: index,
+				MaxQueryTime:  a.config.ManagedCheckInterval,
+			},
+		}
+		var out structs.IndexedManagedChecks
+		err := a.RPC("ManagedCheck.ForNode", &args, &out)
+		if err != nil {
+			a.logger.Printf("[WARN] agent: failed to get managed checks: %v", err)
+		} else {
+			a.updateManagedChecks(out.Checks)
+		}
+
+		// Back off after errors, and when there's no index to block on.
+		if err != nil || out.Index == 0 {
+			index = 0
+			select {
+			case <-time.After(a.config.ManagedCheckInterval):
+			case <-a.shutdownCh:
+				return
+			}
+			continue
+		}
+		index = out.Index
+
+		select {
+		case <-a.shutdownCh:
+			return
+		default:
+		}
+	}
+}
+
 // persistService saves a service definition to a JSON file in the data dir
 func (a *Agent) persistService(service *structs.NodeService) error {
 	svcPath := filepath.Join(a.config.DataDir, servicesDir, stringHash(service.ID))
 	wrapped := persistedService{
-		Token:   a.state.ServiceToken(service.ID),
-		Service: service,
+		Token:    a.state.ServiceToken(service.ID),
+		Priority: a.state.ServicePriority(service.ID),
+		Service:  service,
 	}
 	encoded, err := json.Marshal(wrapped)
 	if err != nil {
@@ -754,13 +1083,14 @@ func (a *Agent) AddService(service *structs.NodeService, chkTypes CheckTypes, pe
 			checkID += fmt.Sprintf(":%d", i+1)
 		}
 		check := &structs.HealthCheck{
-			Node:        a.config.NodeName,
-			CheckID:     checkID,
-			Name:        fmt.Sprintf("Service '%s' check", service.Service),
-			Status:      structs.HealthCritical,
-			Notes:       chkType.Notes,
-			ServiceID:   service.ID,
-			ServiceName: service.Service,
+			Node:          a.config.NodeName,
+			CheckID:       checkID,
+			Name:          fmt.Sprintf("Service '%s' check", service.Service),
+			Status:        structs.HealthCritical,
+			Notes:         chkType.Notes,
+			ServiceID:     service.ID,
+			ServiceName:   service.Service,
+			Informational: chkType.Informational,
 		}
 		if chkType.Status != "" {
 			check.Status = chkType.Status
@@ -836,6 +1166,13 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 
 	// Check if already registered
 	if chkType != nil {
+		// Interval checks report through their thresholds, if any.
+		var notify CheckNotifier = &a.state
+		if chkType.SuccessBeforePassing > 1 || chkType.FailuresBeforeCritical > 1 {
+			notify = newCheckThreshold(&a.state, check.CheckID, chkType.SuccessBeforePassing,
+				chkType.FailuresBeforeCritical, a.logger)
+		}
+
 		if chkType.IsTTL() {
 			if existing, ok := a.checkTTLs[check.CheckID]; ok {
 				existing.Stop()
@@ -858,6 +1195,11 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			a.checkTTLs[check.CheckID] = ttl
 
 		} else if chkType.IsHTTP() {
+			successCodes, err := ParseStatusRanges(chkType.SuccessCodes)
+			if err != nil {
+				return fmt.Errorf("Check '%s' has invalid success codes: %v", check.CheckID, err)
+			}
+
 			if existing, ok := a.checkHTTPs[check.CheckID]; ok {
 				existing.Stop()
 			}
@@ -868,12 +1210,16 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			}
 
 			http := &CheckHTTP{
-				Notify:   &a.state,
-				CheckID:  check.CheckID,
-				HTTP:     chkType.HTTP,
-				Interval: chkType.Interval,
-				Timeout:  chkType.Timeout,
-				Logger:   a.logger,
+				Notify:       notify,
+				CheckID:      check.CheckID,
+				HTTP:         chkType.HTTP,
+				Method:       chkType.Method,
+				Header:       chkType.Header,
+				Body:         chkType.Body,
+				SuccessCodes: successCodes,
+				Interval:     chkType.Interval,
+				Timeout:      chkType.Timeout,
+				Logger:       a.logger,
 			}
 			http.Start()
 			a.checkHTTPs[check.CheckID] = http
@@ -889,12 +1235,16 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			}
 
 			tcp := &CheckTCP{
-				Notify:   &a.state,
-				CheckID:  check.CheckID,
-				TCP:      chkType.TCP,
-				Interval: chkType.Interval,
-				Timeout:  chkType.Timeout,
-				Logger:   a.logger,
+				Notify:        notify,
+				CheckID:       check.CheckID,
+				TCP:           chkType.TCP,
+				Interval:      chkType.Interval,
+				Timeout:       chkType.Timeout,
+				Logger:        a.logger,
+				TLS:           chkType.TLS,
+				TLSServerName: chkType.TLSServerName,
+				TLSSkipVerify: chkType.TLSSkipVerify,
+				TLSCertExpiry: chkType.TLSCertExpiry,
 			}
 			tcp.Start()
 			a.checkTCPs[check.CheckID] = tcp
@@ -910,7 +1260,7 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			}
 
 			dockerCheck := &CheckDocker{
-				Notify:            &a.state,
+				Notify:            notify,
 				CheckID:           check.CheckID,
 				DockerContainerId: chkType.DockerContainerId,
 				Shell:             chkType.Shell,
@@ -934,17 +1284,33 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			}
 
 			monitor := &CheckMonitor{
-				Notify:   &a.state,
-				CheckID:  check.CheckID,
-				Script:   chkType.Script,
-				Interval: chkType.Interval,
-				Logger:   a.logger,
+				Notify:        notify,
+				CheckID:       check.CheckID,
+				Script:        chkType.Script,
+				Interval:      chkType.Interval,
+				Timeout:       chkType.Timeout,
+				MaxOutputSize: chkType.MaxOutputSize,
+				RunAsUser:     chkType.RunAsUser,
+				Chroot:        chkType.Chroot,
+				Logger:        a.logger,
 			}
 			monitor.Start()
 			a.checkMonitors[check.CheckID] = monitor
 		} else {
 			return fmt.Errorf("Check type is not valid")
 		}
+
+		if chkType.DeregisterCriticalServiceAfter > 0 {
+			timeout := chkType.DeregisterCriticalServiceAfter
+			if timeout < MinReapAfter {
+				a.logger.Println(fmt.Sprintf("[WARN] agent: check '%s' has deregister interval below minimum of %v",
+					check.CheckID, MinReapAfter))
+				timeout = MinReapAfter
+			}
+			a.checkReapAfter[check.CheckID] = timeout
+		} else {
+			delete(a.checkReapAfter, check.CheckID)
+		}
 	}
 
 	// Add to the local state for anti-entropy
@@ -989,6 +1355,7 @@ func (a *Agent) RemoveCheck(checkID string, persist bool) error {
 		check.Stop()
 		delete(a.checkTTLs, checkID)
 	}
+	delete(a.checkReapAfter, checkID)
 	if persist {
 		if err := a.purgeCheck(checkID); err != nil {
 			return err
@@ -1023,6 +1390,36 @@ func (a *Agent) UpdateCheck(checkID, status, output string) error {
 	return nil
 }
 
+// CheckUpdate is a status update for a single TTL check, used when
+// updating many checks at once.
+type CheckUpdate struct {
+	CheckID string
+	Status  string
+	Output  string
+}
+
+// UpdateChecks is used to update the status of many TTL checks at once.
+// All of the checks are verified before any of them are updated.
+func (a *Agent) UpdateChecks(updates []CheckUpdate) error {
+	a.checkLock.Lock()
+	defer a.checkLock.Unlock()
+
+	for _, update := range updates {
+		if _, ok := a.checkTTLs[update.CheckID]; !ok {
+			return fmt.Errorf("CheckID %q does not have associated TTL", update.CheckID)
+		}
+	}
+
+	for _, update := range updates {
+		check := a.checkTTLs[update.CheckID]
+		check.SetStatus(update.Status, update.Output)
+		if err := a.persistCheckState(check, update.Status, update.Output); err != nil {
+			return fmt.Errorf("failed persisting state for check %q: %s", update.CheckID, err)
+		}
+	}
+	return nil
+}
+
 // persistCheckState is used to record the check status into the data dir.
 // This allows the state to be restored on a later agent start. Currently
 // only useful for TTL based checks.
@@ -1181,6 +1578,7 @@ func (a *Agent) loadServices(conf *Config) error {
 	for _, service := range conf.Services {
 		ns := service.NodeService()
 		chkTypes := service.CheckTypes()
+		a.state.SetServicePriority(ns.ID, service.SyncPriority)
 		if err := a.AddService(ns, chkTypes, false, service.Token); err != nil {
 			return fmt.Errorf("Failed to register service '%s': %v", service.ID, err)
 		}
@@ -1236,6 +1634,7 @@ func (a *Agent) loadServices(conf *Config) error {
 		} else {
 			a.logger.Printf("[DEBUG] agent: restored service definition %q from %q",
 				serviceID, file)
+			a.state.SetServicePriority(serviceID, p.Priority)
 			if err := a.AddService(p.Service, nil, false, p.Token); err != nil {
 				return fmt.Errorf("failed adding service %q: %s", serviceID, err)
 			}
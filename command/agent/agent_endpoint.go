@@ -165,6 +165,35 @@ func (s *HTTPServer) AgentCheckFail(resp http.ResponseWriter, req *http.Request)
 	return nil, nil
 }
 
+func (s *HTTPServer) AgentCheckBatch(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Only PUT supported
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	var updates []CheckUpdate
+	if err := decodeBody(req, &updates, nil); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+
+	for _, update := range updates {
+		if !structs.ValidStatus(update.Status) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Bad status for check %q", update.CheckID)))
+			return nil, nil
+		}
+	}
+
+	if err := s.agent.UpdateChecks(updates); err != nil {
+		return nil, err
+	}
+	s.syncChanges()
+	return nil, nil
+}
+
 func (s *HTTPServer) AgentRegisterService(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var args ServiceDefinition
 	// Fixup the type decode of TTL or Interval if a check if provided
@@ -229,7 +258,8 @@ func (s *HTTPServer) AgentRegisterService(resp http.ResponseWriter, req *http.Re
 	var token string
 	s.parseToken(req, &token)
 
-	// Add the check
+	// Add the service
+	s.agent.state.SetServicePriority(ns.ID, args.SyncPriority)
 	if err := s.agent.AddService(ns, chkTypes, true, token); err != nil {
 		return nil, err
 	}
@@ -515,6 +515,59 @@ func TestHTTPAgentFailCheck(t *testing.T) {
 	}
 }
 
+func TestHTTPAgentCheckBatch(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	for _, id := range []string{"a", "b"} {
+		chk := &structs.HealthCheck{Name: id, CheckID: id}
+		chkType := &CheckType{TTL: 15 * time.Second}
+		if err := srv.agent.AddCheck(chk, chkType, false, ""); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Update both checks
+	req, err := http.NewRequest("PUT", "/v1/agent/check/batch", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.Body = encodeReq([]CheckUpdate{
+		{CheckID: "a", Status: structs.HealthPassing, Output: "ok"},
+		{CheckID: "b", Status: structs.HealthWarning},
+	})
+	obj, err := srv.AgentCheckBatch(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if obj != nil {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	checks := srv.agent.state.Checks()
+	if checks["a"].Status != structs.HealthPassing || checks["a"].Output != "ok" {
+		t.Fatalf("bad: %v", checks["a"])
+	}
+	if checks["b"].Status != structs.HealthWarning {
+		t.Fatalf("bad: %v", checks["b"])
+	}
+
+	// An unknown check fails the whole batch
+	req, _ = http.NewRequest("PUT", "/v1/agent/check/batch", nil)
+	req.Body = encodeReq([]CheckUpdate{
+		{CheckID: "a", Status: structs.HealthCritical},
+		{CheckID: "nope", Status: structs.HealthCritical},
+	})
+	if _, err := srv.AgentCheckBatch(nil, req); err == nil {
+		t.Fatalf("should fail")
+	}
+	if checks := srv.agent.state.Checks(); checks["a"].Status != structs.HealthPassing {
+		t.Fatalf("bad: %v", checks["a"])
+	}
+}
+
 func TestHTTPAgentRegisterService(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
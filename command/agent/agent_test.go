@@ -128,6 +128,45 @@ func TestAgentStartStop(t *testing.T) {
 	}
 }
 
+func TestAgent_setupNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A configured ID is left alone.
+	config := nextConfig()
+	config.DataDir = dir
+	config.NodeID = "a1b2c3"
+	if err := setupNodeID(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if config.NodeID != "a1b2c3" {
+		t.Fatalf("bad: %q", config.NodeID)
+	}
+
+	// Otherwise one is generated and kept in the data dir.
+	config.NodeID = ""
+	if err := setupNodeID(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := config.NodeID
+	if len(id) != 36 {
+		t.Fatalf("bad: %q", id)
+	}
+
+	// It's the same after a restart, even under a new name.
+	config = nextConfig()
+	config.DataDir = dir
+	if err := setupNodeID(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if config.NodeID != id {
+		t.Fatalf("bad: %q", config.NodeID)
+	}
+}
+
 func TestAgent_RPCPing(t *testing.T) {
 	dir, agent := makeAgent(t, nextConfig())
 	defer os.RemoveAll(dir)
@@ -538,6 +577,172 @@ func TestAgent_AddCheck_RestoreState(t *testing.T) {
 	}
 }
 
+func TestAgent_reapServices(t *testing.T) {
+	dir, agent := makeAgent(t, nextConfig())
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	srv := &structs.NodeService{
+		ID:      "redis",
+		Service: "redis",
+		Port:    8000,
+	}
+	chkTypes := CheckTypes{
+		&CheckType{
+			TTL:                            time.Minute,
+			DeregisterCriticalServiceAfter: 10 * time.Millisecond,
+		},
+	}
+	if err := agent.AddService(srv, chkTypes, false, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The timeout is held to the minimum.
+	agent.checkLock.Lock()
+	timeout := agent.checkReapAfter["service:redis"]
+	agent.checkLock.Unlock()
+	if timeout != MinReapAfter {
+		t.Fatalf("bad: %v", timeout)
+	}
+
+	// The check starts out critical, but not for long enough.
+	agent.reapServicesInternal()
+	if _, ok := agent.state.Services()["redis"]; !ok {
+		t.Fatalf("should have redis service")
+	}
+
+	// Passing checks are never reaped.
+	agent.checkLock.Lock()
+	agent.checkReapAfter["service:redis"] = 10 * time.Millisecond
+	agent.checkLock.Unlock()
+	agent.state.UpdateCheck("service:redis", structs.HealthPassing, "")
+	time.Sleep(20 * time.Millisecond)
+	agent.reapServicesInternal()
+	if _, ok := agent.state.Services()["redis"]; !ok {
+		t.Fatalf("should have redis service")
+	}
+
+	// Once critical for longer than the timeout, the service and its
+	// check are removed.
+	agent.state.UpdateCheck("service:redis", structs.HealthCritical, "")
+	time.Sleep(20 * time.Millisecond)
+	agent.reapServicesInternal()
+	if _, ok := agent.state.Services()["redis"]; ok {
+		t.Fatalf("should have removed redis service")
+	}
+	if _, ok := agent.state.Checks()["service:redis"]; ok {
+		t.Fatalf("should have removed redis check")
+	}
+	agent.checkLock.Lock()
+	_, ok := agent.checkReapAfter["service:redis"]
+	agent.checkLock.Unlock()
+	if ok {
+		t.Fatalf("should have removed reap timeout")
+	}
+}
+
+func TestAgent_updateManagedChecks(t *testing.T) {
+	dir, agent := makeAgent(t, nextConfig())
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	for _, id := range []string{"redis1", "redis2"} {
+		srv := &structs.NodeService{
+			ID:      id,
+			Service: "redis",
+			Port:    8000,
+		}
+		if err := agent.AddService(srv, nil, false, ""); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	checks := structs.ManagedChecks{
+		&structs.ManagedCheck{
+			ID:       "disk",
+			Name:     "disk space",
+			TCP:      "localhost:22",
+			Interval: time.Minute,
+			RaftIndex: structs.RaftIndex{
+				ModifyIndex: 1,
+			},
+		},
+		&structs.ManagedCheck{
+			ID:          "ping",
+			Name:        "redis ping",
+			ServiceName: "redis",
+			TCP:         "localhost:6379",
+			Interval:    time.Minute,
+			RaftIndex: structs.RaftIndex{
+				ModifyIndex: 2,
+			},
+		},
+	}
+	agent.updateManagedChecks(checks)
+
+	// The node check is added once, and the service check once per
+	// instance.
+	registered := agent.state.Checks()
+	for _, id := range []string{"_managed_check:disk", "_managed_check:ping:redis1", "_managed_check:ping:redis2"} {
+		if _, ok := registered[id]; !ok {
+			t.Fatalf("missing check %q: %v", id, registered)
+		}
+	}
+	if chk := registered["_managed_check:ping:redis1"]; chk.ServiceID != "redis1" || chk.Name != "redis ping" {
+		t.Fatalf("bad: %#v", chk)
+	}
+
+	// Unchanged checks keep their status.
+	agent.state.UpdateCheck("_managed_check:disk", structs.HealthPassing, "")
+	agent.updateManagedChecks(checks)
+	if chk := agent.state.Checks()["_managed_check:disk"]; chk.Status != structs.HealthPassing {
+		t.Fatalf("bad: %#v", chk)
+	}
+
+	// Checks that are no longer managed are removed.
+	agent.updateManagedChecks(checks[1:])
+	registered = agent.state.Checks()
+	if _, ok := registered["_managed_check:disk"]; ok {
+		t.Fatalf("should have removed disk check")
+	}
+	if _, ok := registered["_managed_check:ping:redis2"]; !ok {
+		t.Fatalf("should have kept ping check")
+	}
+	if _, ok := agent.checkTCPs["_managed_check:disk"]; ok {
+		t.Fatalf("should have stopped disk check")
+	}
+}
+
+func TestAgent_updateManagedChecks_Script(t *testing.T) {
+	dir, agent := makeAgent(t, nextConfig())
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	checks := structs.ManagedChecks{
+		&structs.ManagedCheck{
+			ID:       "disk",
+			Name:     "disk space",
+			Script:   "/usr/local/bin/check_disk",
+			Interval: time.Minute,
+			RaftIndex: structs.RaftIndex{
+				ModifyIndex: 1,
+			},
+		},
+	}
+
+	// Script checks aren't run without their own opt-in.
+	agent.updateManagedChecks(checks)
+	if _, ok := agent.state.Checks()["_managed_check:disk"]; ok {
+		t.Fatalf("should not have registered script check")
+	}
+
+	agent.config.EnableManagedScriptChecks = true
+	agent.updateManagedChecks(checks)
+	if _, ok := agent.state.Checks()["_managed_check:disk"]; !ok {
+		t.Fatalf("should have registered script check")
+	}
+}
+
 func TestAgent_RemoveCheck(t *testing.T) {
 	dir, agent := makeAgent(t, nextConfig())
 	defer os.RemoveAll(dir)
@@ -769,6 +974,7 @@ func TestAgent_persistedService_compat(t *testing.T) {
 	if !ok {
 		t.Fatalf("missing service")
 	}
+	svc.Source = structs.ServiceSourceAgent
 	if !reflect.DeepEqual(result, svc) {
 		t.Fatalf("bad: %#v", result)
 	}
@@ -5,11 +5,12 @@ import (
 	"github.com/hashicorp/consul/consul/structs"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func (s *HTTPServer) CatalogRegister(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var args structs.RegisterRequest
-	if err := decodeBody(req, &args, nil); err != nil {
+	if err := decodeBody(req, &args, FixupExternalChecks); err != nil {
 		resp.WriteHeader(400)
 		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
 		return nil, nil
@@ -20,6 +21,15 @@ func (s *HTTPServer) CatalogRegister(resp http.ResponseWriter, req *http.Request
 		args.Datacenter = s.agent.config.Datacenter
 	}
 
+	// Return the node's resulting services and checks if asked
+	if _, ok := req.URL.Query()["echo"]; ok {
+		var out structs.RegisterResponse
+		if err := s.agent.RPC("Catalog.RegisterEcho", &args, &out); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
 	// Forward to the servers
 	var out struct{}
 	if err := s.agent.RPC("Catalog.Register", &args, &out); err != nil {
@@ -28,6 +38,68 @@ func (s *HTTPServer) CatalogRegister(resp http.ResponseWriter, req *http.Request
 	return true, nil
 }
 
+// FixupExternalChecks is used to handle parsing the JSON body of a
+// registration, turning the interval and timeout of any external check
+// definitions from duration strings into their Go types.
+func FixupExternalChecks(raw interface{}) error {
+	rawMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for k, v := range rawMap {
+		switch strings.ToLower(k) {
+		case "check":
+			if err := fixupExternalCheck(v); err != nil {
+				return err
+			}
+		case "checks":
+			checks, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, check := range checks {
+				if err := fixupExternalCheck(check); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// fixupExternalCheck parses the durations in the external check definition
+// of a single check, if it has one.
+func fixupExternalCheck(raw interface{}) error {
+	check, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for k, v := range check {
+		if strings.ToLower(k) != "external" {
+			continue
+		}
+		external, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range external {
+			vStr, ok := v.(string)
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(k) {
+			case "interval", "timeout":
+				dur, err := time.ParseDuration(vStr)
+				if err != nil {
+					return err
+				}
+				external[k] = dur
+			}
+		}
+	}
+	return nil
+}
+
 func (s *HTTPServer) CatalogDeregister(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var args structs.DeregisterRequest
 	if err := decodeBody(req, &args, nil); err != nil {
@@ -49,6 +121,27 @@ func (s *HTTPServer) CatalogDeregister(resp http.ResponseWriter, req *http.Reque
 	return true, nil
 }
 
+func (s *HTTPServer) CatalogDrain(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	var args structs.ServiceDrainRequest
+	if err := decodeBody(req, &args, nil); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+
+	// Setup the default DC if not provided
+	if args.Datacenter == "" {
+		args.Datacenter = s.agent.config.Datacenter
+	}
+
+	// Forward to the servers
+	var out struct{}
+	if err := s.agent.RPC("Catalog.Drain", &args, &out); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
 func (s *HTTPServer) CatalogDatacenters(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var out []string
 	if err := s.agent.RPC("Catalog.ListDatacenters", struct{}{}, &out); err != nil {
@@ -57,6 +150,14 @@ func (s *HTTPServer) CatalogDatacenters(resp http.ResponseWriter, req *http.Requ
 	return out, nil
 }
 
+func (s *HTTPServer) CatalogDatacenterInfo(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	var out []structs.DatacenterInfo
+	if err := s.agent.RPC("Catalog.DatacenterInfo", struct{}{}, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (s *HTTPServer) CatalogNodes(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	// Setup the request
 	args := structs.DCSpecificRequest{}
@@ -64,15 +165,43 @@ func (s *HTTPServer) CatalogNodes(resp http.ResponseWriter, req *http.Request) (
 	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
 		return nil, nil
 	}
+	if done := parseMetaFilter(resp, req, &args.NodeMetaFilters); done {
+		return nil, nil
+	}
+	args.Filter = req.URL.Query().Get("filter")
 
 	var out structs.IndexedNodes
 	defer setMeta(resp, &out.QueryMeta)
 	if err := s.agent.RPC("Catalog.ListNodes", &args, &out); err != nil {
 		return nil, err
 	}
+	s.agent.translateAddresses(args.Datacenter, out.Nodes)
 	return out.Nodes, nil
 }
 
+func (s *HTTPServer) CatalogDump(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default DC
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedCatalogDump
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Catalog.Dump", &args, &out); err != nil {
+		return nil, err
+	}
+	if out.Dump == nil {
+		out.Dump = &structs.CatalogDump{}
+	}
+	s.agent.translateAddresses(args.Datacenter, out.Dump.Nodes)
+	s.agent.translateAddresses(args.Datacenter, out.Dump.Services)
+	return struct {
+		Index uint64
+		*structs.CatalogDump
+	}{out.Index, out.Dump}, nil
+}
+
 func (s *HTTPServer) CatalogServices(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	// Set default DC
 	args := structs.DCSpecificRequest{}
@@ -80,11 +209,18 @@ func (s *HTTPServer) CatalogServices(resp http.ResponseWriter, req *http.Request
 		return nil, nil
 	}
 
+	if _, ok := req.URL.Query()["summary"]; ok {
+		args.Summaries = true
+	}
+
 	var out structs.IndexedServices
 	defer setMeta(resp, &out.QueryMeta)
 	if err := s.agent.RPC("Catalog.ListServices", &args, &out); err != nil {
 		return nil, err
 	}
+	if args.Summaries {
+		return out.Summaries, nil
+	}
 	return out.Services, nil
 }
 
@@ -95,6 +231,10 @@ func (s *HTTPServer) CatalogServiceNodes(resp http.ResponseWriter, req *http.Req
 	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
 		return nil, nil
 	}
+	if done := parseMetaFilter(resp, req, &args.NodeMetaFilters); done {
+		return nil, nil
+	}
+	args.Filter = req.URL.Query().Get("filter")
 
 	// Check for a tag
 	params := req.URL.Query()
@@ -117,9 +257,64 @@ func (s *HTTPServer) CatalogServiceNodes(resp http.ResponseWriter, req *http.Req
 	if err := s.agent.RPC("Catalog.ServiceNodes", &args, &out); err != nil {
 		return nil, err
 	}
+	s.agent.translateAddresses(args.Datacenter, out.ServiceNodes)
+
+	hints := make([]int, 0, len(out.ServiceNodes))
+	for _, sn := range out.ServiceNodes {
+		hints = append(hints, sn.ServiceCacheMaxAge)
+	}
+	setCacheMaxAge(resp, hints)
 	return out.ServiceNodes, nil
 }
 
+func (s *HTTPServer) CatalogServiceNodesMultiDC(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default DC
+	args := structs.MultiDCServiceRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	if done := parseMetaFilter(resp, req, &args.NodeMetaFilters); done {
+		return nil, nil
+	}
+	params := req.URL.Query()
+	args.Filter = params.Get("filter")
+
+	// Pull out the datacenters to query, if any were given
+	args.Datacenters = params["datacenter"]
+
+	// Check for a tag
+	if _, ok := params["tag"]; ok {
+		args.ServiceTag = params.Get("tag")
+		args.TagFilter = true
+	}
+
+	// Pull out the service name
+	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/catalog/service-multi-dc/")
+	if args.ServiceName == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing service name"))
+		return nil, nil
+	}
+
+	// Make the RPC request
+	var out structs.IndexedMultiDCServiceNodes
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Catalog.ServiceNodesMultiDC", &args, &out); err != nil {
+		return nil, err
+	}
+
+	// Each node's addresses depend on the datacenter it came from
+	for _, sn := range out.ServiceNodes {
+		nodes := structs.ServiceNodes{&sn.ServiceNode}
+		s.agent.translateAddresses(sn.Datacenter, nodes)
+		sn.ServiceNode = *nodes[0]
+	}
+	return struct {
+		ServiceNodes []*structs.DatacenterServiceNode
+		Datacenters  []*structs.DatacenterQueryResult
+	}{out.ServiceNodes, out.Datacenters}, nil
+}
+
 func (s *HTTPServer) CatalogNodeServices(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	// Set default Datacenter
 	args := structs.NodeSpecificRequest{}
@@ -141,5 +336,6 @@ func (s *HTTPServer) CatalogNodeServices(resp http.ResponseWriter, req *http.Req
 	if err := s.agent.RPC("Catalog.NodeServices", &args, &out); err != nil {
 		return nil, err
 	}
+	s.agent.translateAddresses(args.Datacenter, out.NodeServices)
 	return out.NodeServices, nil
 }
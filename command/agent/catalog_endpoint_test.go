@@ -1,10 +1,12 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -54,6 +56,63 @@ func TestCatalogRegister(t *testing.T) {
 	}
 }
 
+func TestCatalogRegister_ExternalCheck(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Durations in external check definitions can be given as strings
+	body := `{
+		"Node": "foo",
+		"Address": "127.0.0.1",
+		"Check": {
+			"Name": "web alive",
+			"External": {"HTTP": "http://127.0.0.1:8080/health", "Interval": "10s", "Timeout": "1s"}
+		}
+	}`
+	req, err := http.NewRequest("PUT", "/v1/catalog/register", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := srv.CatalogRegister(nil, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	var out structs.IndexedHealthChecks
+	if err := srv.agent.RPC("Health.NodeChecks", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.HealthChecks) != 1 {
+		t.Fatalf("bad: %v", out.HealthChecks)
+	}
+	external := out.HealthChecks[0].External
+	if external == nil || external.HTTP != "http://127.0.0.1:8080/health" ||
+		external.Interval != 10*time.Second || external.Timeout != time.Second {
+		t.Fatalf("bad: %v", external)
+	}
+
+	// Bad durations are rejected
+	body = `{"Node": "foo", "Address": "127.0.0.1", "Checks": [{"Name": "x", "External": {"Interval": "often"}}]}`
+	req, err = http.NewRequest("PUT", "/v1/catalog/register", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.CatalogRegister(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %d", resp.Code)
+	}
+}
+
 func TestCatalogDeregister(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -83,6 +142,62 @@ func TestCatalogDeregister(t *testing.T) {
 	}
 }
 
+func TestCatalogDrain(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register a service
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "api",
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Drain it
+	req, err := http.NewRequest("PUT", "/v1/catalog/drain", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.Body = encodeReq(&structs.ServiceDrainRequest{
+		Node:      "foo",
+		ServiceID: "api",
+		Draining:  true,
+	})
+	obj, err := srv.CatalogDrain(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res := obj.(bool); res != true {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// The catalog shows it as draining
+	req, err = http.NewRequest("GET", "/v1/catalog/service/api", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err = srv.CatalogServiceNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	nodes := obj.(structs.ServiceNodes)
+	if len(nodes) != 1 || !nodes[0].ServiceDraining {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestCatalogDatacenters(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -105,6 +220,31 @@ func TestCatalogDatacenters(t *testing.T) {
 	})
 }
 
+func TestCatalogDatacenterInfo(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForResult(func() (bool, error) {
+		obj, err := srv.CatalogDatacenterInfo(nil, nil)
+		if err != nil {
+			return false, err
+		}
+
+		infos := obj.([]structs.DatacenterInfo)
+		if len(infos) != 1 {
+			return false, fmt.Errorf("missing dc: %v", infos)
+		}
+		if infos[0].Datacenter != srv.agent.config.Datacenter || infos[0].Servers != 1 {
+			return false, fmt.Errorf("bad: %#v", infos[0])
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("bad: %v", err)
+	})
+}
+
 func TestCatalogNodes(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -145,6 +285,123 @@ func TestCatalogNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogDump(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register a node with a service and check
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "api",
+		},
+		Check: &structs.HealthCheck{
+			Name:      "api alive",
+			Status:    structs.HealthPassing,
+			ServiceID: "api",
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/catalog/dump?dc=dc1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.CatalogDump(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify an index is set
+	assertIndex(t, resp)
+
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var dump struct {
+		Index    uint64
+		Nodes    structs.Nodes
+		Services structs.ServiceNodes
+		Checks   structs.HealthChecks
+	}
+	if err := json.Unmarshal(buf, &dump); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dump.Index == 0 || len(dump.Nodes) != 2 {
+		t.Fatalf("bad: %s", buf)
+	}
+
+	// The agent's own node has the consul service and serf check, too.
+	var found bool
+	for _, sn := range dump.Services {
+		if sn.Node == "foo" && sn.ServiceName == "api" && sn.Address == "127.0.0.1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %s", buf)
+	}
+	found = false
+	for _, check := range dump.Checks {
+		if check.Node == "foo" && check.ServiceID == "api" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %s", buf)
+	}
+}
+
+func TestCatalogNodes_MetaFilter(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register a node with metadata
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		NodeMeta:   map[string]string{"rack": "r1"},
+	}
+
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/catalog/nodes?node-meta=rack:r1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	obj, err := srv.CatalogNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the node with the metadata should come back
+	nodes := obj.(structs.Nodes)
+	if len(nodes) != 1 || nodes[0].Node != "foo" || nodes[0].Meta["rack"] != "r1" {
+		t.Fatalf("bad: %v", obj)
+	}
+}
+
 func TestCatalogNodes_Blocking(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -343,6 +600,54 @@ func TestCatalogServices(t *testing.T) {
 	}
 }
 
+func TestCatalogServices_Summary(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register node
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "api",
+			Tags:    []string{"v1"},
+		},
+	}
+
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/catalog/services?dc=dc1&summary", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	obj, err := srv.CatalogServices(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	assertIndex(t, resp)
+
+	summaries := obj.(structs.ServiceSummaries)
+	if len(summaries) != 2 {
+		t.Fatalf("bad: %v", obj)
+	}
+	api := summaries["api"]
+	if api == nil || api.Instances != 1 || api.Passing != 1 ||
+		len(api.Tags) != 1 || api.Tags[0] != "v1" {
+		t.Fatalf("bad: %#v", api)
+	}
+}
+
 func TestCatalogServiceNodes(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -384,6 +689,58 @@ func TestCatalogServiceNodes(t *testing.T) {
 	if len(nodes) != 1 {
 		t.Fatalf("bad: %v", obj)
 	}
+
+	// No hint was given, so there should be no header
+	if cc := resp.Header().Get("Cache-Control"); cc != "" {
+		t.Fatalf("bad: %q", cc)
+	}
+}
+
+func TestCatalogServiceNodes_CacheMaxAge(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register two instances with different hints
+	for i, maxAge := range []int{30, 10} {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("node%d", i),
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service:     "api",
+				CacheMaxAge: maxAge,
+			},
+		}
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/v1/catalog/service/api", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	obj, err := srv.CatalogServiceNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The shortest hint should win
+	if cc := resp.Header().Get("Cache-Control"); cc != "max-age=10" {
+		t.Fatalf("bad: %q", cc)
+	}
+
+	nodes := obj.(structs.ServiceNodes)
+	if len(nodes) != 2 || nodes[0].ServiceCacheMaxAge == 0 || nodes[1].ServiceCacheMaxAge == 0 {
+		t.Fatalf("bad: %v", obj)
+	}
 }
 
 func TestCatalogServiceNodes_DistanceSort(t *testing.T) {
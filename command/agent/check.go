@@ -1,13 +1,17 @@
 package agent
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,6 +32,19 @@ const (
 	// from being captured
 	CheckBufSize = 4 * 1024 // 4KB
 
+	// DefaultScriptTimeout is how long a script check may run, unless
+	// it has its own timeout, before it is killed and marked critical.
+	DefaultScriptTimeout = 30 * time.Second
+
+	// scriptKillWait is how long a timed out script check gets to exit
+	// once it's been killed. A process that left the group can keep the
+	// output open, so the check moves on rather than wait for it.
+	scriptKillWait = time.Second
+
+	// MinReapAfter is the shortest time a check can be critical before
+	// its service is deregistered.
+	MinReapAfter = time.Minute
+
 	// Use this user agent when doing requests for
 	// HTTP health checks.
 	HttpUserAgent = "Consul Health Check"
@@ -53,6 +70,47 @@ type CheckType struct {
 	Status string
 
 	Notes string
+
+	// Informational checks are registered and run as usual, but their
+	// status is never used to filter the node or service out of
+	// health-aware queries such as DNS.
+	Informational bool
+
+	// Method, Header and Body customize the request made by an HTTP
+	// check, which is a plain GET by default. SuccessCodes lists the
+	// status codes, or ranges of them such as "200-299", that count as
+	// passing in place of the usual 2xx.
+	Method       string
+	Header       map[string][]string
+	Body         string
+	SuccessCodes []string
+
+	// TLS makes a TCP check complete a TLS handshake after connecting.
+	// TLSServerName is sent for SNI and verified against the certificate,
+	// defaulting to the host being checked. The check is a warning once
+	// the certificate is within TLSCertExpiry of expiring.
+	TLS           bool
+	TLSServerName string
+	TLSSkipVerify bool
+	TLSCertExpiry time.Duration
+
+	// SuccessBeforePassing and FailuresBeforeCritical damp flapping
+	// interval checks: a new status is only reported once the check has
+	// returned it that many times in a row.
+	SuccessBeforePassing   int
+	FailuresBeforeCritical int
+
+	// DeregisterCriticalServiceAfter, if set, deregisters the check's
+	// service once the check has been critical for this long.
+	DeregisterCriticalServiceAfter time.Duration
+
+	// MaxOutputSize limits how much of a script check's output is kept,
+	// defaulting to CheckBufSize. RunAsUser and Chroot run the script as
+	// another user, given by name or ID, or inside another root directory.
+	// Both need the agent to be running as root.
+	MaxOutputSize int
+	RunAsUser     string
+	Chroot        string
 }
 type CheckTypes []*CheckType
 
@@ -92,15 +150,72 @@ type CheckNotifier interface {
 	UpdateCheck(checkID, status, output string)
 }
 
+// checkThreshold sits between a check and its notifier, holding back a
+// change of status until the check has returned it enough times in a row.
+// Warning and critical results both count as failures.
+type checkThreshold struct {
+	Notify                 CheckNotifier
+	CheckID                string
+	SuccessBeforePassing   int
+	FailuresBeforeCritical int
+	Logger                 *log.Logger
+
+	successCounter  int
+	failuresCounter int
+	l               sync.Mutex
+}
+
+func newCheckThreshold(notify CheckNotifier, checkID string, successBefore, failuresBefore int, logger *log.Logger) *checkThreshold {
+	return &checkThreshold{
+		Notify:                 notify,
+		CheckID:                checkID,
+		SuccessBeforePassing:   successBefore,
+		FailuresBeforeCritical: failuresBefore,
+		Logger:                 logger,
+	}
+}
+
+// UpdateCheck counts the result, and passes it on once the threshold for its
+// status has been reached.
+func (c *checkThreshold) UpdateCheck(checkID, status, output string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if status == structs.HealthPassing {
+		c.successCounter++
+		c.failuresCounter = 0
+		if c.successCounter < c.SuccessBeforePassing {
+			c.Logger.Printf("[DEBUG] agent: check '%v' was passing, but not reporting it until %d successes in a row (%d so far)",
+				c.CheckID, c.SuccessBeforePassing, c.successCounter)
+			return
+		}
+	} else {
+		c.failuresCounter++
+		c.successCounter = 0
+		if c.failuresCounter < c.FailuresBeforeCritical {
+			c.Logger.Printf("[DEBUG] agent: check '%v' was %s, but not reporting it until %d failures in a row (%d so far)",
+				c.CheckID, status, c.FailuresBeforeCritical, c.failuresCounter)
+			return
+		}
+	}
+	c.Notify.UpdateCheck(checkID, status, output)
+}
+
 // CheckMonitor is used to periodically invoke a script to
 // determine the health of a given check. It is compatible with
 // nagios plugins and expects the output in the same format.
+// Scripts run in their own process group, which is killed
+// if they run for longer than the Timeout.
 type CheckMonitor struct {
-	Notify   CheckNotifier
-	CheckID  string
-	Script   string
-	Interval time.Duration
-	Logger   *log.Logger
+	Notify        CheckNotifier
+	CheckID       string
+	Script        string
+	Interval      time.Duration
+	Timeout       time.Duration
+	MaxOutputSize int
+	RunAsUser     string
+	Chroot        string
+	Logger        *log.Logger
 
 	stop     bool
 	stopCh   chan struct{}
@@ -153,9 +268,18 @@ func (c *CheckMonitor) check() {
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
 		return
 	}
+	if err := setSysProcAttr(cmd, c.RunAsUser, c.Chroot); err != nil {
+		c.Logger.Printf("[ERR] agent: failed to setup invoke '%s': %s", c.Script, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
 
 	// Collect the output
-	output, _ := circbuf.NewBuffer(CheckBufSize)
+	bufSize := c.MaxOutputSize
+	if bufSize <= 0 {
+		bufSize = CheckBufSize
+	}
+	output, _ := circbuf.NewBuffer(int64(bufSize))
 	cmd.Stdout = output
 	cmd.Stderr = output
 
@@ -166,16 +290,33 @@ func (c *CheckMonitor) check() {
 		return
 	}
 
-	// Wait for the check to complete
-	errCh := make(chan error, 2)
-	go func() {
-		errCh <- cmd.Wait()
-	}()
+	// Wait for the check to complete, killing it and anything it
+	// started if it takes too long. We wait a little for the kill to
+	// take effect, so runs don't normally overlap, but not forever.
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+	waitCh := make(chan error, 1)
 	go func() {
-		time.Sleep(30 * time.Second)
-		errCh <- fmt.Errorf("Timed out running check '%s'", c.Script)
+		waitCh <- cmd.Wait()
 	}()
-	err = <-errCh
+	select {
+	case err = <-waitCh:
+	case <-time.After(timeout):
+		if err := killProcessGroup(cmd); err != nil {
+			c.Logger.Printf("[ERR] agent: failed to kill check '%v': %s", c.CheckID, err)
+		}
+		select {
+		case <-waitCh:
+		case <-time.After(scriptKillWait):
+			c.Logger.Printf("[WARN] agent: check '%v' is still running after being killed", c.CheckID)
+		}
+		msg := fmt.Sprintf("Timed out (%s) running check '%s'", timeout, c.Script)
+		c.Logger.Printf("[WARN] agent: Check '%v': %s", c.CheckID, msg)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, msg)
+		return
+	}
 
 	// Get the output, add a message about truncation
 	outputStr := string(output.Bytes())
@@ -300,12 +441,16 @@ type persistedCheckState struct {
 // The check is critical if the response code is anything else
 // or if the request returns an error
 type CheckHTTP struct {
-	Notify   CheckNotifier
-	CheckID  string
-	HTTP     string
-	Interval time.Duration
-	Timeout  time.Duration
-	Logger   *log.Logger
+	Notify       CheckNotifier
+	CheckID      string
+	HTTP         string
+	Method       string
+	Header       map[string][]string
+	Body         string
+	SuccessCodes []StatusRange
+	Interval     time.Duration
+	Timeout      time.Duration
+	Logger       *log.Logger
 
 	httpClient *http.Client
 	stop       bool
@@ -375,14 +520,33 @@ func (c *CheckHTTP) run() {
 
 // check is invoked periodically to perform the HTTP check
 func (c *CheckHTTP) check() {
-	req, err := http.NewRequest("GET", c.HTTP, nil)
+	method := c.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	var reqBody io.Reader
+	if c.Body != "" {
+		reqBody = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequest(method, c.HTTP, reqBody)
 	if err != nil {
 		c.Logger.Printf("[WARN] agent: http request failed '%s': %s", c.HTTP, err)
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
 		return
 	}
 
-	req.Header.Set("User-Agent", HttpUserAgent)
+	for name, values := range c.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", HttpUserAgent)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -398,10 +562,10 @@ func (c *CheckHTTP) check() {
 		c.Logger.Printf("[WARN] agent: check '%v': Get error while reading body: %s", c.CheckID, err)
 		body = []byte{}
 	}
-	result := fmt.Sprintf("HTTP GET %s: %s Output: %s", c.HTTP, resp.Status, body)
+	result := fmt.Sprintf("HTTP %s %s: %s Output: %s", method, c.HTTP, resp.Status, body)
 
-	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-		// PASSING (2xx)
+	if c.passing(resp.StatusCode) {
+		// PASSING (2xx, or one of the configured success codes)
 		c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, result)
 
@@ -419,6 +583,50 @@ func (c *CheckHTTP) check() {
 	}
 }
 
+// passing reports whether the given response status counts as passing.
+func (c *CheckHTTP) passing(code int) bool {
+	if len(c.SuccessCodes) == 0 {
+		return code >= 200 && code <= 299
+	}
+	for _, r := range c.SuccessCodes {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// ParseStatusRanges parses a list of HTTP status codes, each either a single
+// code such as "204" or an inclusive range such as "200-299".
+func ParseStatusRanges(codes []string) ([]StatusRange, error) {
+	var ranges []StatusRange
+	for _, code := range codes {
+		lo, hi := code, code
+		if i := strings.Index(code, "-"); i != -1 {
+			lo, hi = code[:i], code[i+1:]
+		}
+		min, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q", code)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q", code)
+		}
+		if min < 100 || max > 599 || min > max {
+			return nil, fmt.Errorf("invalid status code range %q", code)
+		}
+		ranges = append(ranges, StatusRange{min, max})
+	}
+	return ranges, nil
+}
+
 // CheckTCP is used to periodically make an TCP/UDP connection to
 // determine the health of a given check.
 // The check is passing if the connection succeeds
@@ -431,6 +639,12 @@ type CheckTCP struct {
 	Timeout  time.Duration
 	Logger   *log.Logger
 
+	// TLS settings, used when TLS is set. See CheckType.
+	TLS           bool
+	TLSServerName string
+	TLSSkipVerify bool
+	TLSCertExpiry time.Duration
+
 	dialer   *net.Dialer
 	stop     bool
 	stopCh   chan struct{}
@@ -497,11 +711,63 @@ func (c *CheckTCP) check() {
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
 		return
 	}
-	conn.Close()
+	defer conn.Close()
+
+	if c.TLS {
+		c.checkTLS(conn)
+		return
+	}
 	c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
 	c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, fmt.Sprintf("TCP connect %s: Success", c.TCP))
 }
 
+// checkTLS completes a TLS handshake over the given connection, and checks
+// how long the certificate presented has left before it expires.
+func (c *CheckTCP) checkTLS(conn net.Conn) {
+	serverName := c.TLSServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(c.TCP)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: c.TLSSkipVerify,
+	})
+	if c.dialer.Timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(c.dialer.Timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		c.Logger.Printf("[WARN] agent: TLS handshake failed '%s': %s", c.TCP, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+
+	// Find the soonest expiry in the chain the server sent.
+	var expires time.Time
+	for _, cert := range tlsConn.ConnectionState().PeerCertificates {
+		if expires.IsZero() || cert.NotAfter.Before(expires) {
+			expires = cert.NotAfter
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case !expires.IsZero() && !now.Before(expires):
+		c.Logger.Printf("[WARN] agent: check '%v' is now critical", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical,
+			fmt.Sprintf("TLS handshake %s: Certificate expired at %s", c.TCP, expires))
+
+	case !expires.IsZero() && c.TLSCertExpiry > 0 && expires.Sub(now) < c.TLSCertExpiry:
+		c.Logger.Printf("[WARN] agent: check '%v' is now warning", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthWarning,
+			fmt.Sprintf("TLS handshake %s: Certificate expires at %s", c.TCP, expires))
+
+	default:
+		c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing,
+			fmt.Sprintf("TLS handshake %s: Success, certificate expires at %s", c.TCP, expires))
+	}
+}
+
 // A custom interface since go-dockerclient doesn't have one
 // We will use this interface in our test to inject a fake client
 type DockerClient interface {
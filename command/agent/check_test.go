@@ -3,12 +3,15 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,6 +33,44 @@ func (m *MockNotify) UpdateCheck(id, status, output string) {
 	m.output[id] = output
 }
 
+func TestCheckThreshold(t *testing.T) {
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	threshold := newCheckThreshold(mock, "foo", 2, 3, logger)
+
+	// A single failure isn't reported.
+	threshold.UpdateCheck("foo", structs.HealthCritical, "bad")
+	threshold.UpdateCheck("foo", structs.HealthWarning, "bad")
+	if mock.updates["foo"] != 0 {
+		t.Fatalf("bad: %v", mock.updates)
+	}
+
+	// The third failure in a row is.
+	threshold.UpdateCheck("foo", structs.HealthCritical, "bad")
+	if mock.updates["foo"] != 1 || mock.state["foo"] != structs.HealthCritical {
+		t.Fatalf("bad: %v %v", mock.updates, mock.state)
+	}
+
+	// A success in between resets the failures.
+	threshold.UpdateCheck("foo", structs.HealthPassing, "ok")
+	threshold.UpdateCheck("foo", structs.HealthCritical, "bad")
+	threshold.UpdateCheck("foo", structs.HealthPassing, "ok")
+	if mock.updates["foo"] != 1 || mock.state["foo"] != structs.HealthCritical {
+		t.Fatalf("bad: %v %v", mock.updates, mock.state)
+	}
+
+	// The second success in a row is reported, as is every one after it.
+	threshold.UpdateCheck("foo", structs.HealthPassing, "ok")
+	threshold.UpdateCheck("foo", structs.HealthPassing, "ok")
+	if mock.updates["foo"] != 3 || mock.state["foo"] != structs.HealthPassing {
+		t.Fatalf("bad: %v %v", mock.updates, mock.state)
+	}
+}
+
 func expectStatus(t *testing.T, script, status string) {
 	mock := &MockNotify{
 		state:   make(map[string]string),
@@ -130,6 +171,106 @@ func TestCheckMonitor_LimitOutput(t *testing.T) {
 	}
 }
 
+func TestCheckMonitor_MaxOutputSize(t *testing.T) {
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	check := &CheckMonitor{
+		Notify:        mock,
+		CheckID:       "foo",
+		Script:        "od -N 81920 /dev/urandom",
+		Interval:      25 * time.Millisecond,
+		MaxOutputSize: 100,
+		Logger:        log.New(os.Stderr, "", log.LstdFlags),
+	}
+	check.Start()
+	defer check.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Allow for extra bytes for the truncation message
+	if len(mock.output["foo"]) > 100+100 {
+		t.Fatalf("output size is too long")
+	}
+}
+
+func TestCheckMonitor_Timeout(t *testing.T) {
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+
+	// The background sleep holds the output open, so the check can only
+	// finish if the whole process group is killed.
+	check := &CheckMonitor{
+		Notify:   mock,
+		CheckID:  "foo",
+		Script:   "sleep 10 & sleep 10",
+		Interval: 10 * time.Millisecond,
+		Timeout:  100 * time.Millisecond,
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+	}
+	check.Start()
+	defer check.Stop()
+
+	testutil.WaitForResult(func() (bool, error) {
+		if mock.updates["foo"] < 2 {
+			return false, fmt.Errorf("should have 2 updates %v", mock.updates)
+		}
+		if mock.state["foo"] != structs.HealthCritical {
+			return false, fmt.Errorf("should be critical %v", mock.state)
+		}
+		if !strings.Contains(mock.output["foo"], "Timed out") {
+			return false, fmt.Errorf("bad output %v", mock.output)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %s", err)
+	})
+}
+
+func TestCheckMonitor_Timeout_Escaped(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid not found")
+	}
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+
+	// The background sleep leaves the process group, so killing the group
+	// doesn't close the output. The check should still be marked critical.
+	check := &CheckMonitor{
+		Notify:   mock,
+		CheckID:  "foo",
+		Script:   "setsid sleep 10 & sleep 10",
+		Interval: 10 * time.Millisecond,
+		Timeout:  100 * time.Millisecond,
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+	}
+	check.Start()
+	defer check.Stop()
+
+	testutil.WaitForResult(func() (bool, error) {
+		if mock.updates["foo"] < 1 {
+			return false, fmt.Errorf("should have an update %v", mock.updates)
+		}
+		if mock.state["foo"] != structs.HealthCritical {
+			return false, fmt.Errorf("should be critical %v", mock.state)
+		}
+		if !strings.Contains(mock.output["foo"], "Timed out") {
+			return false, fmt.Errorf("bad output %v", mock.output)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %s", err)
+	})
+}
+
 func TestCheckTTL(t *testing.T) {
 	mock := &MockNotify{
 		state:   make(map[string]string),
@@ -265,6 +406,95 @@ func TestCheckHTTPWarning(t *testing.T) {
 	server.Close()
 }
 
+func TestCheckHTTP_Request(t *testing.T) {
+	type request struct {
+		method, host, auth, agent, body string
+	}
+	reqCh := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		select {
+		case reqCh <- request{r.Method, r.Host, r.Header.Get("Authorization"), r.UserAgent(), string(body)}:
+		default:
+		}
+	}))
+	defer server.Close()
+
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	check := &CheckHTTP{
+		Notify:  mock,
+		CheckID: "foo",
+		HTTP:    server.URL,
+		Method:  "POST",
+		Header: map[string][]string{
+			"Authorization": []string{"Bearer secret"},
+			"Host":          []string{"web.example.com"},
+		},
+		Body:     `{"ping":true}`,
+		Interval: 10 * time.Millisecond,
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+	}
+	check.Start()
+	defer check.Stop()
+
+	select {
+	case req := <-reqCh:
+		expected := request{"POST", "web.example.com", "Bearer secret", HttpUserAgent, `{"ping":true}`}
+		if req != expected {
+			t.Fatalf("bad: %#v", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no request made")
+	}
+}
+
+func TestCheckHTTP_SuccessCodes(t *testing.T) {
+	ranges, err := ParseStatusRanges([]string{"200-299", "401"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &CheckHTTP{SuccessCodes: ranges}
+
+	for code, expected := range map[int]bool{
+		200: true,
+		299: true,
+		401: true,
+		300: false,
+		403: false,
+	} {
+		if actual := check.passing(code); actual != expected {
+			t.Fatalf("code %d: expected %v, got %v", code, expected, actual)
+		}
+	}
+
+	// Without success codes only 2xx passes.
+	check = &CheckHTTP{}
+	if !check.passing(204) || check.passing(401) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := ParseStatusRanges([]string{"204", "300-399"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []StatusRange{{204, 204}, {300, 399}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Fatalf("bad: %#v", ranges)
+	}
+
+	for _, bad := range []string{"", "abc", "2xx", "299-200", "600", "99"} {
+		if _, err := ParseStatusRanges([]string{bad}); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
 func mockSlowHTTPServer(responseCode int, sleep time.Duration) *httptest.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -397,6 +627,67 @@ func TestCheckTCPPassing(t *testing.T) {
 	tcpServer.Close()
 }
 
+func TestCheckTCP_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tlsStatus := func(check *CheckTCP) string {
+		mock := &MockNotify{
+			state:   make(map[string]string),
+			updates: make(map[string]int),
+			output:  make(map[string]string),
+		}
+		check.Notify = mock
+		check.CheckID = "foo"
+		check.TCP = server.Listener.Addr().String()
+		check.TLS = true
+		check.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		check.dialer = &net.Dialer{Timeout: time.Second}
+		check.check()
+		return mock.state["foo"]
+	}
+
+	// The test server's certificate isn't trusted.
+	if status := tlsStatus(&CheckTCP{}); status != structs.HealthCritical {
+		t.Fatalf("bad: %v", status)
+	}
+
+	if status := tlsStatus(&CheckTCP{TLSSkipVerify: true}); status != structs.HealthPassing {
+		t.Fatalf("bad: %v", status)
+	}
+
+	// Warn well ahead of the test certificate's expiry.
+	check := &CheckTCP{
+		TLSSkipVerify: true,
+		TLSServerName: "example.com",
+		TLSCertExpiry: 200 * 365 * 24 * time.Hour,
+	}
+	if status := tlsStatus(check); status != structs.HealthWarning {
+		t.Fatalf("bad: %v", status)
+	}
+
+	// A plain TCP server can't complete the handshake.
+	tcpServer := mockTCPServer(`tcp`)
+	defer tcpServer.Close()
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	plain := &CheckTCP{
+		Notify:  mock,
+		CheckID: "foo",
+		TCP:     tcpServer.Addr().String(),
+		TLS:     true,
+		Logger:  log.New(os.Stderr, "", log.LstdFlags),
+		dialer:  &net.Dialer{Timeout: 100 * time.Millisecond},
+	}
+	plain.check()
+	if mock.state["foo"] != structs.HealthCritical {
+		t.Fatalf("bad: %v", mock.state)
+	}
+}
+
 // A fake docker client to test happy path scenario
 type fakeDockerClientWithNoErrors struct {
 }
@@ -0,0 +1,47 @@
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setSysProcAttr starts a script check in its own process group, so it can
+// be killed along with anything it started, running as the given user and
+// inside the given root directory, if set.
+func setSysProcAttr(cmd *exec.Cmd, runAsUser, chroot string) error {
+	attr := &syscall.SysProcAttr{
+		Setpgid: true,
+		Chroot:  chroot,
+	}
+	if runAsUser != "" {
+		u, err := user.Lookup(runAsUser)
+		if err != nil {
+			// Try looking up the user by ID
+			if u, err = user.LookupId(runAsUser); err != nil {
+				return fmt.Errorf("invalid user specified: %v", runAsUser)
+			}
+		}
+		uid, err := strconv.Atoi(u.Uid)
+		if err != nil {
+			return fmt.Errorf("invalid uid for user %v: %v", runAsUser, u.Uid)
+		}
+		gid, err := strconv.Atoi(u.Gid)
+		if err != nil {
+			return fmt.Errorf("invalid gid for user %v: %v", runAsUser, u.Gid)
+		}
+		attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// killProcessGroup kills a started script check and every process in its
+// process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	// checkWebhookTimeout is how long we wait for a webhook to respond
+	checkWebhookTimeout = 10 * time.Second
+
+	// checkWebhookQueueSize is how many status changes can be waiting to
+	// be sent before new ones are dropped.
+	checkWebhookQueueSize = 256
+)
+
+// checkStatusChange is the JSON body POSTed to check webhooks.
+type checkStatusChange struct {
+	Node           string
+	CheckID        string
+	Name           string
+	ServiceID      string
+	ServiceName    string
+	Status         string
+	PreviousStatus string
+	Output         string
+	Time           time.Time
+}
+
+// matches returns true if the hook wants to hear about the change.
+func (h *CheckWebhook) matches(change *checkStatusChange) bool {
+	if len(h.Services) != 0 && !strContains(h.Services, change.ServiceName) {
+		return false
+	}
+	if len(h.Statuses) != 0 && !strContains(h.Statuses, change.Status) {
+		return false
+	}
+	return true
+}
+
+// checkWebhookNotifier sends check status changes to the configured
+// webhooks. Changes are queued and sent in order by a single goroutine, so
+// a slow webhook never holds up the checks.
+type checkWebhookNotifier struct {
+	hooks    []*CheckWebhook
+	client   *http.Client
+	logger   *log.Logger
+	changeCh chan *checkStatusChange
+}
+
+// newCheckWebhookNotifier returns a notifier for the given hooks. Run must
+// be called to start sending.
+func newCheckWebhookNotifier(hooks []*CheckWebhook, logger *log.Logger) *checkWebhookNotifier {
+	client := cleanhttp.DefaultClient()
+	client.Timeout = checkWebhookTimeout
+	return &checkWebhookNotifier{
+		hooks:    hooks,
+		client:   client,
+		logger:   logger,
+		changeCh: make(chan *checkStatusChange, checkWebhookQueueSize),
+	}
+}
+
+// Notify queues a check's change from the previous status. It never blocks,
+// dropping the change if the queue is full.
+func (n *checkWebhookNotifier) Notify(check *structs.HealthCheck, previous string) {
+	change := &checkStatusChange{
+		Node:           check.Node,
+		CheckID:        check.CheckID,
+		Name:           check.Name,
+		ServiceID:      check.ServiceID,
+		ServiceName:    check.ServiceName,
+		Status:         check.Status,
+		PreviousStatus: previous,
+		Output:         check.Output,
+		Time:           time.Now().UTC(),
+	}
+	select {
+	case n.changeCh <- change:
+	default:
+		n.logger.Printf("[WARN] agent: check webhook queue is full, dropping change of check '%s' to %s",
+			check.CheckID, check.Status)
+	}
+}
+
+// Run is a long running routine that sends the queued changes until the
+// shutdown channel is closed.
+func (n *checkWebhookNotifier) Run(shutdownCh <-chan struct{}) {
+	for {
+		select {
+		case change := <-n.changeCh:
+			for _, hook := range n.hooks {
+				if !hook.matches(change) {
+					continue
+				}
+				if err := n.send(hook.URL, change); err != nil {
+					n.logger.Printf("[WARN] agent: failed to send change of check '%s' to webhook %s: %v",
+						change.CheckID, hook.URL, err)
+				}
+			}
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// send POSTs a single change to a webhook.
+func (n *checkWebhookNotifier) send(url string, change *checkStatusChange) error {
+	buf, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestCheckWebhook_matches(t *testing.T) {
+	change := &checkStatusChange{
+		ServiceName: "web",
+		Status:      structs.HealthCritical,
+	}
+	cases := []struct {
+		hook    CheckWebhook
+		matches bool
+	}{
+		{CheckWebhook{}, true},
+		{CheckWebhook{Services: []string{"db", "web"}}, true},
+		{CheckWebhook{Services: []string{"db"}}, false},
+		{CheckWebhook{Statuses: []string{structs.HealthCritical}}, true},
+		{CheckWebhook{Statuses: []string{structs.HealthWarning}}, false},
+		{CheckWebhook{Services: []string{"web"}, Statuses: []string{structs.HealthWarning}}, false},
+	}
+	for i, c := range cases {
+		if c.hook.matches(change) != c.matches {
+			t.Fatalf("case %d: expected %v", i, c.matches)
+		}
+	}
+}
+
+func TestAgent_CheckWebhooks(t *testing.T) {
+	changeCh := make(chan *checkStatusChange, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change checkStatusChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("err: %v", err)
+		}
+		changeCh <- &change
+	}))
+	defer server.Close()
+
+	config := nextConfig()
+	config.CheckWebhooks = []*CheckWebhook{
+		&CheckWebhook{
+			URL:      server.URL,
+			Statuses: []string{structs.HealthCritical},
+		},
+	}
+	dir, agent := makeAgent(t, config)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    config.NodeName,
+		CheckID: "mem",
+		Name:    "memory util",
+		Status:  structs.HealthCritical,
+	}
+	chk := &CheckType{TTL: time.Minute}
+	if err := agent.AddCheck(health, chk, false, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Going to passing is filtered out, but going back to critical is sent.
+	if err := agent.UpdateCheck("mem", structs.HealthPassing, "ok"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := agent.UpdateCheck("mem", structs.HealthCritical, "out of memory"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case change := <-changeCh:
+		if change.CheckID != "mem" || change.Node != config.NodeName ||
+			change.Status != structs.HealthCritical ||
+			change.PreviousStatus != structs.HealthPassing ||
+			change.Output != "out of memory" {
+			t.Fatalf("bad: %#v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not called")
+	}
+
+	select {
+	case change := <-changeCh:
+		t.Fatalf("unexpected change: %#v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
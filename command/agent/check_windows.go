@@ -0,0 +1,23 @@
+// +build windows
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// setSysProcAttr is a no-op on Windows, which doesn't support running
+// script checks as another user or inside another root directory.
+func setSysProcAttr(cmd *exec.Cmd, runAsUser, chroot string) error {
+	if runAsUser != "" || chroot != "" {
+		return fmt.Errorf("RunAsUser and Chroot are not supported on Windows")
+	}
+	return nil
+}
+
+// killProcessGroup kills a started script check. Since process groups are
+// not available on Windows, only the script's own process is killed.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -222,6 +222,20 @@ func (c *Command) readConfig() *Config {
 		return nil
 	}
 
+	// TLS bootstrapping relies on gossip encryption to keep certificates
+	// away from non-members.
+	if config.TLSBootstrap {
+		if !config.Server {
+			c.Ui.Error("TLS bootstrap cannot be enabled when server mode is not enabled")
+			return nil
+		}
+		keyfileLAN := filepath.Join(config.DataDir, serfLANKeyring)
+		if _, err := os.Stat(keyfileLAN); config.EncryptKey == "" && err != nil {
+			c.Ui.Error("TLS bootstrap requires gossip encryption to be enabled")
+			return nil
+		}
+	}
+
 	// Compile all the watches
 	for _, params := range config.Watches {
 		// Parse the watches, excluding the handler
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/consul"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/watch"
 	"github.com/mitchellh/mapstructure"
 )
@@ -137,6 +138,10 @@ type Config struct {
 	// Node name is the name we use to advertise. Defaults to hostname.
 	NodeName string `mapstructure:"node_name"`
 
+	// NodeID is the node's stable ID, which stays the same if the node
+	// name changes. Defaults to a random ID kept in the data directory.
+	NodeID string `mapstructure:"node_id"`
+
 	// ClientAddr is used to control the address we bind to for
 	// client services (DNS, HTTP, HTTPS, RPC)
 	ClientAddr string `mapstructure:"client_addr"`
@@ -158,6 +163,11 @@ type Config struct {
 	// Serf WAN IP. If not specified, the general advertise address is used.
 	AdvertiseAddrWan string `mapstructure:"advertise_addr_wan"`
 
+	// TaggedAddresses are named addresses for this node, such as "public"
+	// or "ipv6", registered in the catalog. The "lan" and "wan" addresses
+	// default to the advertise addresses.
+	TaggedAddresses map[string]string `mapstructure:"tagged_addresses"`
+
 	// Port configurations
 	Ports PortConfig
 
@@ -224,6 +234,11 @@ type Config struct {
 	// provide matches the certificate
 	ServerName string `mapstructure:"server_name"`
 
+	// TLSBootstrap has the servers issue their own TLS certificates, with
+	// the bootstrap server acting as the certificate authority. The files
+	// are used for any of CAFile, CertFile, and KeyFile that aren't set.
+	TLSBootstrap bool `mapstructure:"tls_bootstrap"`
+
 	// StartJoin is a list of addresses to attempt to join when the
 	// agent starts. If Serf is unable to communicate with any of these
 	// addresses, then the agent will error and exit.
@@ -335,6 +350,21 @@ type Config struct {
 	// feature. This is for security to prevent unknown scripts from running.
 	DisableRemoteExec bool `mapstructure:"disable_remote_exec"`
 
+	// EnableManagedChecks lets the agent run the checks that are managed
+	// centrally by the servers. It's off by default, since the checks are
+	// defined remotely.
+	EnableManagedChecks bool `mapstructure:"enable_managed_checks"`
+
+	// EnableManagedScriptChecks also lets the agent run managed checks
+	// that invoke a script. This is separate from EnableManagedChecks since
+	// it allows anyone who can change the managed checks to run commands
+	// on the agent.
+	EnableManagedScriptChecks bool `mapstructure:"enable_managed_script_checks"`
+
+	// ExternalChecker volunteers the agent to run the checks of external
+	// services, which are assigned across all such agents by the leader.
+	ExternalChecker bool `mapstructure:"external_checker"`
+
 	// DisableUpdateCheck is used to turn off the automatic update and
 	// security bulletin checking.
 	DisableUpdateCheck bool `mapstructure:"disable_update_check"`
@@ -387,6 +417,15 @@ type Config struct {
 	// faster.
 	SyncCoordinateIntervalMin time.Duration `mapstructure:"-" json:"-"`
 
+	// CheckReapInterval controls the interval on which we will look for
+	// failed checks and reap their associated services, if so configured.
+	CheckReapInterval time.Duration `mapstructure:"-" json:"-"`
+
+	// ManagedCheckInterval is the longest we will wait between syncs of
+	// the managed checks. Changes to the checks are picked up right away,
+	// but new local services are only matched up on the next sync.
+	ManagedCheckInterval time.Duration `mapstructure:"-" json:"-"`
+
 	// Checks holds the provided check definitions
 	Checks []*CheckDefinition `mapstructure:"-" json:"-"`
 
@@ -414,6 +453,101 @@ type Config struct {
 	// Minimum Session TTL
 	SessionTTLMin    time.Duration `mapstructure:"-"`
 	SessionTTLMinRaw string        `mapstructure:"session_ttl_min"`
+
+	// ReapLockGracePeriod is how long the leader waits before reaping a
+	// failed node whose sessions still hold locks.
+	ReapLockGracePeriod    time.Duration `mapstructure:"-"`
+	ReapLockGracePeriodRaw string        `mapstructure:"reap_lock_grace_period"`
+
+	// TombstoneTTL is how long KV tombstones are kept, and
+	// TombstoneTTLGranularity how finely their expirations are batched.
+	// Both can also be changed at runtime with Operator.TombstoneGC.
+	TombstoneTTL               time.Duration `mapstructure:"-"`
+	TombstoneTTLRaw            string        `mapstructure:"tombstone_ttl"`
+	TombstoneTTLGranularity    time.Duration `mapstructure:"-"`
+	TombstoneTTLGranularityRaw string        `mapstructure:"tombstone_ttl_granularity"`
+
+	// KVSRecycleRetention is how long deleted KV trees are kept in the
+	// recycle bin. Zero disables the recycle bin.
+	KVSRecycleRetention    time.Duration `mapstructure:"-"`
+	KVSRecycleRetentionRaw string        `mapstructure:"kvs_recycle_retention"`
+
+	// KVSMaxValueSize is the largest KV value, in bytes, that can be
+	// written. Values over 512KB are split across several Raft entries.
+	KVSMaxValueSize int `mapstructure:"kvs_max_value_size"`
+
+	// KVSCompressThreshold is the size, in bytes, above which KV values
+	// are stored compressed. Zero disables compression.
+	KVSCompressThreshold int `mapstructure:"kvs_compress_threshold"`
+
+	// KVSEncryptionKey is used to encrypt the values of keys under
+	// KVSEncryptPrefixes before they are stored. It's given as base64.
+	KVSEncryptionKey    []byte `mapstructure:"-" json:"-"`
+	KVSEncryptionKeyRaw string `mapstructure:"kvs_encryption_key" json:"-"`
+
+	// KVSEncryptPrefixes are the KV prefixes whose values are encrypted
+	KVSEncryptPrefixes []string `mapstructure:"kvs_encrypt_prefixes"`
+
+	// KVSQuotas limit what can be written under each top-level KV prefix,
+	// keyed by the prefix. The quota under "*" applies to every prefix
+	// without its own.
+	KVSQuotas map[string]KVSQuota `mapstructure:"kvs_quotas"`
+
+	// KVSEvents maps KV prefixes to the name of a user event that is
+	// fired for every write under them. Only used by servers.
+	KVSEvents map[string]string `mapstructure:"kvs_events"`
+
+	// FollowerConsistentReads lets servers answer consistent reads locally
+	// once they have caught up to the leader's read index, instead of
+	// forwarding them to the leader.
+	FollowerConsistentReads bool `mapstructure:"follower_consistent_reads"`
+
+	// RejectDuplicateServiceIDs makes servers refuse catalog registrations
+	// whose service ID is already registered on a different node.
+	RejectDuplicateServiceIDs bool `mapstructure:"reject_duplicate_service_ids"`
+
+	// AdaptiveCoordinateUpdates scales how servers batch coordinate
+	// updates with the size of the cluster.
+	AdaptiveCoordinateUpdates bool `mapstructure:"adaptive_coordinate_updates"`
+
+	// CapacityThresholds are the state store sizes past which the leader
+	// warns that the datacenter is getting large.
+	CapacityThresholds CapacityThresholds `mapstructure:"capacity_thresholds"`
+
+	// CheckWebhooks are URLs the agent POSTs to when one of its checks
+	// changes status.
+	CheckWebhooks []*CheckWebhook `mapstructure:"check_webhooks"`
+}
+
+// CheckWebhook is a URL to notify of check status changes. Services and
+// Statuses limit which changes are sent; when empty, all of them are.
+type CheckWebhook struct {
+	URL      string   `mapstructure:"url"`
+	Services []string `mapstructure:"services"`
+	Statuses []string `mapstructure:"statuses"`
+}
+
+// CapacityThresholds holds the sizes at which servers start warning about
+// state store growth. Zero disables a threshold.
+type CapacityThresholds struct {
+	// ServiceInstances is the most instances any one service should have
+	ServiceInstances int `mapstructure:"service_instances"`
+
+	// Services is the most distinct services the datacenter should have
+	Services int `mapstructure:"services"`
+
+	// KVSKeys is the most keys the KV store should hold
+	KVSKeys int `mapstructure:"kv_keys"`
+}
+
+// KVSQuota limits what can be stored under one top-level KV prefix. Zero
+// means no limit.
+type KVSQuota struct {
+	// MaxBytes is the most bytes of keys and values the prefix can hold
+	MaxBytes int `mapstructure:"max_bytes"`
+
+	// MaxKeys is the most keys the prefix can hold
+	MaxKeys int `mapstructure:"max_keys"`
 }
 
 // UnixSocketPermissions contains information about a unix socket, and
@@ -490,6 +624,10 @@ func DefaultConfig() *Config {
 		SyncCoordinateRateTarget:  64.0, // updates / second
 		SyncCoordinateIntervalMin: 15 * time.Second,
 
+		CheckReapInterval:    30 * time.Second,
+		ManagedCheckInterval: time.Minute,
+		KVSMaxValueSize:      maxKVSize,
+
 		ACLTTL:           30 * time.Second,
 		ACLDownPolicy:    "extend-cache",
 		ACLDefaultPolicy: "allow",
@@ -678,6 +816,88 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.SessionTTLMin = dur
 	}
 
+	if raw := result.ReapLockGracePeriodRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Reap lock grace period invalid: %v", err)
+		}
+		result.ReapLockGracePeriod = dur
+	}
+
+	if raw := result.TombstoneTTLRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Tombstone TTL invalid: %v", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("Tombstone TTL must be positive")
+		}
+		result.TombstoneTTL = dur
+	}
+
+	if raw := result.TombstoneTTLGranularityRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Tombstone TTL granularity invalid: %v", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("Tombstone TTL granularity must be positive")
+		}
+		result.TombstoneTTLGranularity = dur
+	}
+
+	if raw := result.KVSRecycleRetentionRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("KVS recycle retention invalid: %v", err)
+		}
+		result.KVSRecycleRetention = dur
+	}
+
+	if result.KVSMaxValueSize < 0 {
+		return nil, fmt.Errorf("KVS max value size can't be negative")
+	}
+
+	if result.KVSCompressThreshold < 0 {
+		return nil, fmt.Errorf("KVS compress threshold can't be negative")
+	}
+
+	for prefix, quota := range result.KVSQuotas {
+		if quota.MaxBytes < 0 || quota.MaxKeys < 0 {
+			return nil, fmt.Errorf("KVS quota for '%s' can't be negative", prefix)
+		}
+	}
+
+	for prefix, name := range result.KVSEvents {
+		if name == "" {
+			return nil, fmt.Errorf("KVS event for '%s' is missing a name", prefix)
+		}
+	}
+
+	if raw := result.KVSEncryptionKeyRaw; raw != "" {
+		key, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("KVS encryption key invalid: %v", err)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("KVS encryption key must be 16, 24, or 32 bytes")
+		}
+		result.KVSEncryptionKey = key
+	}
+
+	for i, hook := range result.CheckWebhooks {
+		if hook.URL == "" {
+			return nil, fmt.Errorf("CheckWebhooks[%d] is missing a URL", i)
+		}
+		for _, status := range hook.Statuses {
+			if !structs.ValidStatus(status) {
+				return nil, fmt.Errorf("CheckWebhooks[%d] has invalid status %q", i, status)
+			}
+		}
+	}
+
 	if result.AdvertiseAddrs.SerfLanRaw != "" {
 		addr, err := net.ResolveTCPAddr("tcp", result.AdvertiseAddrs.SerfLanRaw)
 		if err != nil {
@@ -754,7 +974,7 @@ AFTER_FIX:
 }
 
 func FixupCheckType(raw interface{}) error {
-	var ttlKey, intervalKey, timeoutKey string
+	var ttlKey, intervalKey, timeoutKey, certExpiryKey, reapAfterKey string
 
 	// Handle decoding of time durations
 	rawMap, ok := raw.(map[string]interface{})
@@ -776,6 +996,39 @@ func FixupCheckType(raw interface{}) error {
 		case "docker_container_id":
 			rawMap["DockerContainerId"] = v
 			delete(rawMap, "docker_container_id")
+		case "success_codes":
+			rawMap["SuccessCodes"] = v
+			delete(rawMap, "success_codes")
+		case "tls_server_name":
+			rawMap["TLSServerName"] = v
+			delete(rawMap, "tls_server_name")
+		case "tls_skip_verify":
+			rawMap["TLSSkipVerify"] = v
+			delete(rawMap, "tls_skip_verify")
+		case "success_before_passing":
+			rawMap["SuccessBeforePassing"] = v
+			delete(rawMap, "success_before_passing")
+		case "failures_before_critical":
+			rawMap["FailuresBeforeCritical"] = v
+			delete(rawMap, "failures_before_critical")
+		case "max_output_size":
+			rawMap["MaxOutputSize"] = v
+			delete(rawMap, "max_output_size")
+		case "run_as_user":
+			rawMap["RunAsUser"] = v
+			delete(rawMap, "run_as_user")
+		case "deregistercriticalserviceafter":
+			reapAfterKey = k
+		case "deregister_critical_service_after":
+			rawMap["DeregisterCriticalServiceAfter"] = v
+			delete(rawMap, "deregister_critical_service_after")
+			reapAfterKey = "DeregisterCriticalServiceAfter"
+		case "tlscertexpiry":
+			certExpiryKey = k
+		case "tls_cert_expiry":
+			rawMap["TLSCertExpiry"] = v
+			delete(rawMap, "tls_cert_expiry")
+			certExpiryKey = "TLSCertExpiry"
 		}
 	}
 
@@ -812,6 +1065,28 @@ func FixupCheckType(raw interface{}) error {
 		}
 	}
 
+	if certExpiry, ok := rawMap[certExpiryKey]; ok {
+		certExpiryS, ok := certExpiry.(string)
+		if ok {
+			if dur, err := time.ParseDuration(certExpiryS); err != nil {
+				return err
+			} else {
+				rawMap[certExpiryKey] = dur
+			}
+		}
+	}
+
+	if reapAfter, ok := rawMap[reapAfterKey]; ok {
+		reapAfterS, ok := reapAfter.(string)
+		if ok {
+			if dur, err := time.ParseDuration(reapAfterS); err != nil {
+				return err
+			} else {
+				rawMap[reapAfterKey] = dur
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -874,6 +1149,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.NodeName != "" {
 		result.NodeName = b.NodeName
 	}
+	if b.NodeID != "" {
+		result.NodeID = b.NodeID
+	}
 	if b.ClientAddr != "" {
 		result.ClientAddr = b.ClientAddr
 	}
@@ -886,6 +1164,14 @@ func MergeConfig(a, b *Config) *Config {
 	if b.AdvertiseAddrWan != "" {
 		result.AdvertiseAddrWan = b.AdvertiseAddrWan
 	}
+	if len(b.TaggedAddresses) != 0 {
+		if result.TaggedAddresses == nil {
+			result.TaggedAddresses = make(map[string]string)
+		}
+		for name, addr := range b.TaggedAddresses {
+			result.TaggedAddresses[name] = addr
+		}
+	}
 	if b.AdvertiseAddrs.SerfLan != nil {
 		result.AdvertiseAddrs.SerfLan = b.AdvertiseAddrs.SerfLan
 		result.AdvertiseAddrs.SerfLanRaw = b.AdvertiseAddrs.SerfLanRaw
@@ -940,6 +1226,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.ServerName != "" {
 		result.ServerName = b.ServerName
 	}
+	if b.TLSBootstrap {
+		result.TLSBootstrap = true
+	}
 	if b.Checks != nil {
 		result.Checks = append(result.Checks, b.Checks...)
 	}
@@ -1057,9 +1346,21 @@ func MergeConfig(a, b *Config) *Config {
 	if len(b.WatchPlans) != 0 {
 		result.WatchPlans = append(result.WatchPlans, b.WatchPlans...)
 	}
+	if len(b.CheckWebhooks) != 0 {
+		result.CheckWebhooks = append(result.CheckWebhooks, b.CheckWebhooks...)
+	}
 	if b.DisableRemoteExec {
 		result.DisableRemoteExec = true
 	}
+	if b.EnableManagedChecks {
+		result.EnableManagedChecks = true
+	}
+	if b.EnableManagedScriptChecks {
+		result.EnableManagedScriptChecks = true
+	}
+	if b.ExternalChecker {
+		result.ExternalChecker = true
+	}
 	if b.DisableUpdateCheck {
 		result.DisableUpdateCheck = true
 	}
@@ -1097,6 +1398,69 @@ func MergeConfig(a, b *Config) *Config {
 		result.SessionTTLMin = b.SessionTTLMin
 		result.SessionTTLMinRaw = b.SessionTTLMinRaw
 	}
+	if b.ReapLockGracePeriodRaw != "" {
+		result.ReapLockGracePeriod = b.ReapLockGracePeriod
+		result.ReapLockGracePeriodRaw = b.ReapLockGracePeriodRaw
+	}
+	if b.TombstoneTTLRaw != "" {
+		result.TombstoneTTL = b.TombstoneTTL
+		result.TombstoneTTLRaw = b.TombstoneTTLRaw
+	}
+	if b.TombstoneTTLGranularityRaw != "" {
+		result.TombstoneTTLGranularity = b.TombstoneTTLGranularity
+		result.TombstoneTTLGranularityRaw = b.TombstoneTTLGranularityRaw
+	}
+	if b.KVSRecycleRetentionRaw != "" {
+		result.KVSRecycleRetention = b.KVSRecycleRetention
+		result.KVSRecycleRetentionRaw = b.KVSRecycleRetentionRaw
+	}
+	if b.KVSMaxValueSize != 0 {
+		result.KVSMaxValueSize = b.KVSMaxValueSize
+	}
+	if b.KVSCompressThreshold != 0 {
+		result.KVSCompressThreshold = b.KVSCompressThreshold
+	}
+	if b.KVSEncryptionKeyRaw != "" {
+		result.KVSEncryptionKey = b.KVSEncryptionKey
+		result.KVSEncryptionKeyRaw = b.KVSEncryptionKeyRaw
+	}
+	if len(b.KVSEncryptPrefixes) != 0 {
+		result.KVSEncryptPrefixes = b.KVSEncryptPrefixes
+	}
+	if len(b.KVSQuotas) != 0 {
+		if result.KVSQuotas == nil {
+			result.KVSQuotas = make(map[string]KVSQuota)
+		}
+		for prefix, quota := range b.KVSQuotas {
+			result.KVSQuotas[prefix] = quota
+		}
+	}
+	if len(b.KVSEvents) != 0 {
+		if result.KVSEvents == nil {
+			result.KVSEvents = make(map[string]string)
+		}
+		for prefix, name := range b.KVSEvents {
+			result.KVSEvents[prefix] = name
+		}
+	}
+	if b.FollowerConsistentReads {
+		result.FollowerConsistentReads = true
+	}
+	if b.RejectDuplicateServiceIDs {
+		result.RejectDuplicateServiceIDs = true
+	}
+	if b.AdaptiveCoordinateUpdates {
+		result.AdaptiveCoordinateUpdates = true
+	}
+	if b.CapacityThresholds.ServiceInstances != 0 {
+		result.CapacityThresholds.ServiceInstances = b.CapacityThresholds.ServiceInstances
+	}
+	if b.CapacityThresholds.Services != 0 {
+		result.CapacityThresholds.Services = b.CapacityThresholds.Services
+	}
+	if b.CapacityThresholds.KVSKeys != 0 {
+		result.CapacityThresholds.KVSKeys = b.CapacityThresholds.KVSKeys
+	}
 	if len(b.HTTPAPIResponseHeaders) != 0 {
 		if result.HTTPAPIResponseHeaders == nil {
 			result.HTTPAPIResponseHeaders = make(map[string]string)
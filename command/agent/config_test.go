@@ -58,7 +58,7 @@ func TestDecodeConfig(t *testing.T) {
 	}
 
 	// Without a protocol
-	input = `{"node_name": "foo", "datacenter": "dc2"}`
+	input = `{"node_name": "foo", "node_id": "a1b2", "datacenter": "dc2"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
 	if err != nil {
 		t.Fatalf("err: %s", err)
@@ -68,6 +68,10 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	if config.NodeID != "a1b2" {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	if config.Datacenter != "dc2" {
 		t.Fatalf("bad: %#v", config)
 	}
@@ -212,6 +216,16 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// Tagged addresses
+	input = `{"tagged_addresses": {"public": "198.18.0.5", "ipv6": "2001:db8::5"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if config.TaggedAddresses["public"] != "198.18.0.5" || config.TaggedAddresses["ipv6"] != "2001:db8::5" {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Advertise addresses for serflan
 	input = `{"advertise_addrs": {"serf_lan": "127.0.0.5:1234"}}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -323,6 +337,17 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// TLS bootstrap
+	input = `{"tls_bootstrap": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.TLSBootstrap {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Start join
 	input = `{"start_join": ["1.1.1.1", "2.2.2.2"]}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -615,6 +640,28 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// managed checks
+	input = `{"enable_managed_checks": true, "enable_managed_script_checks": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.EnableManagedChecks || !config.EnableManagedScriptChecks {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// external checker
+	input = `{"external_checker": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.ExternalChecker {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// stats(d|ite) exec
 	input = `{"statsite_addr": "127.0.0.1:7250", "statsd_addr": "127.0.0.1:7251"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -755,6 +802,177 @@ func TestDecodeConfig(t *testing.T) {
 	if config.SessionTTLMin != 5*time.Second {
 		t.Fatalf("bad: %s %#v", config.SessionTTLMin.String(), config)
 	}
+
+	// ReapLockGracePeriod
+	input = `{"reap_lock_grace_period": "10m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.ReapLockGracePeriod != 10*time.Minute {
+		t.Fatalf("bad: %s %#v", config.ReapLockGracePeriod.String(), config)
+	}
+
+	// TombstoneTTL
+	input = `{"tombstone_ttl": "1h", "tombstone_ttl_granularity": "1m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.TombstoneTTL != time.Hour || config.TombstoneTTLGranularity != time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"tombstone_ttl": "0s"}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// KVSRecycleRetention
+	input = `{"kvs_recycle_retention": "24h"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVSRecycleRetention != 24*time.Hour {
+		t.Fatalf("bad: %s %#v", config.KVSRecycleRetention.String(), config)
+	}
+
+	// KVSMaxValueSize
+	input = `{"kvs_max_value_size": 8388608}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVSMaxValueSize != 8*1024*1024 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"kvs_max_value_size": -1}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// KVSCompressThreshold
+	input = `{"kvs_compress_threshold": 4096}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVSCompressThreshold != 4096 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"kvs_compress_threshold": -1}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// KVSQuotas
+	input = `{"kvs_quotas": {"*": {"max_keys": 1000}, "team-a": {"max_bytes": 1048576, "max_keys": 5000}}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVSQuotas["*"].MaxKeys != 1000 ||
+		config.KVSQuotas["team-a"].MaxBytes != 1024*1024 ||
+		config.KVSQuotas["team-a"].MaxKeys != 5000 {
+		t.Fatalf("bad: %#v", config.KVSQuotas)
+	}
+
+	input = `{"kvs_quotas": {"team-a": {"max_keys": -1}}}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// KVSEvents
+	input = `{"kvs_events": {"config/": "config-changed"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVSEvents["config/"] != "config-changed" {
+		t.Fatalf("bad: %#v", config.KVSEvents)
+	}
+
+	input = `{"kvs_events": {"config/": ""}}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should have failed")
+	}
+
+	// KV encryption
+	input = `{"kvs_encryption_key": "MDEyMzQ1Njc4OWFiY2RlZg==", "kvs_encrypt_prefixes": ["secret/"]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(config.KVSEncryptionKey) != "0123456789abcdef" {
+		t.Fatalf("bad: %#v", config)
+	}
+	if len(config.KVSEncryptPrefixes) != 1 || config.KVSEncryptPrefixes[0] != "secret/" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Keys must be a valid AES key size
+	input = `{"kvs_encryption_key": "c2hvcnQ="}`
+	_, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err == nil || !strings.Contains(err.Error(), "16, 24, or 32 bytes") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// FollowerConsistentReads
+	input = `{"follower_consistent_reads": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.FollowerConsistentReads {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RejectDuplicateServiceIDs
+	input = `{"reject_duplicate_service_ids": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.RejectDuplicateServiceIDs {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// AdaptiveCoordinateUpdates
+	input = `{"adaptive_coordinate_updates": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.AdaptiveCoordinateUpdates {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// CapacityThresholds
+	input = `{"capacity_thresholds": {"service_instances": 500, "services": 100, "kv_keys": 10000}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.CapacityThresholds.ServiceInstances != 500 ||
+		config.CapacityThresholds.Services != 100 ||
+		config.CapacityThresholds.KVSKeys != 10000 {
+		t.Fatalf("bad: %#v", config.CapacityThresholds)
+	}
 }
 
 func TestDecodeConfig_invalidKeys(t *testing.T) {
@@ -1116,6 +1334,122 @@ func TestDecodeConfig_Check(t *testing.T) {
 	}
 }
 
+func TestDecodeConfig_HTTPCheck(t *testing.T) {
+	input := `{"check": {"id": "chk1", "name": "web", "http": "http://localhost:8080/health", "interval": "10s",
+		"method": "POST", "header": {"Authorization": ["Bearer secret"]}, "body": "ping",
+		"success_codes": ["200-299", "401"]}}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(config.Checks) != 1 {
+		t.Fatalf("missing check")
+	}
+
+	chk := config.Checks[0]
+	if chk.Method != "POST" || chk.Body != "ping" {
+		t.Fatalf("bad: %v", chk)
+	}
+	if !reflect.DeepEqual(chk.Header, map[string][]string{"Authorization": []string{"Bearer secret"}}) {
+		t.Fatalf("bad: %v", chk.Header)
+	}
+	if !reflect.DeepEqual(chk.SuccessCodes, []string{"200-299", "401"}) {
+		t.Fatalf("bad: %v", chk.SuccessCodes)
+	}
+}
+
+func TestDecodeConfig_TLSCheck(t *testing.T) {
+	input := `{"check": {"id": "chk1", "name": "web", "tcp": "localhost:443", "interval": "10s",
+		"tls": true, "tls_server_name": "web.example.com", "tls_skip_verify": true,
+		"tls_cert_expiry": "720h"}}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(config.Checks) != 1 {
+		t.Fatalf("missing check")
+	}
+
+	chk := config.Checks[0]
+	if !chk.TLS || chk.TLSServerName != "web.example.com" || !chk.TLSSkipVerify {
+		t.Fatalf("bad: %v", chk)
+	}
+	if chk.TLSCertExpiry != 720*time.Hour {
+		t.Fatalf("bad: %v", chk)
+	}
+}
+
+func TestDecodeConfig_CheckThresholds(t *testing.T) {
+	input := `{"check": {"id": "chk1", "name": "web", "tcp": "localhost:80", "interval": "10s",
+		"success_before_passing": 2, "failures_before_critical": 3}}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(config.Checks) != 1 {
+		t.Fatalf("missing check")
+	}
+
+	chk := config.Checks[0]
+	if chk.SuccessBeforePassing != 2 || chk.FailuresBeforeCritical != 3 {
+		t.Fatalf("bad: %v", chk)
+	}
+}
+
+func TestDecodeConfig_CheckScriptLimits(t *testing.T) {
+	input := `{"check": {"id": "chk1", "name": "disk", "script": "check_disk", "interval": "10s",
+		"timeout": "5s", "max_output_size": 1024, "run_as_user": "nobody", "chroot": "/var/empty"}}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(config.Checks) != 1 {
+		t.Fatalf("missing check")
+	}
+
+	chk := config.Checks[0]
+	if chk.Timeout != 5*time.Second || chk.MaxOutputSize != 1024 ||
+		chk.RunAsUser != "nobody" || chk.Chroot != "/var/empty" {
+		t.Fatalf("bad: %v", chk)
+	}
+}
+
+func TestDecodeConfig_CheckWebhooks(t *testing.T) {
+	input := `{"check_webhooks": [{"url": "http://localhost:8080/alert", "services": ["web"],
+		"statuses": ["warning", "critical"]}]}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []*CheckWebhook{
+		&CheckWebhook{
+			URL:      "http://localhost:8080/alert",
+			Services: []string{"web"},
+			Statuses: []string{"warning", "critical"},
+		},
+	}
+	if !reflect.DeepEqual(config.CheckWebhooks, expected) {
+		t.Fatalf("bad: %#v", config.CheckWebhooks)
+	}
+
+	// A URL is required
+	input = `{"check_webhooks": [{"services": ["web"]}]}`
+	if _, err := DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Statuses must be valid
+	input = `{"check_webhooks": [{"url": "http://localhost:8080/alert", "statuses": ["down"]}]}`
+	if _, err := DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestMergeConfig(t *testing.T) {
 	a := &Config{
 		Bootstrap:              false,
@@ -1155,10 +1489,12 @@ func TestMergeConfig(t *testing.T) {
 		Domain:           "other",
 		LogLevel:         "info",
 		NodeName:         "baz",
+		NodeID:           "c3d4",
 		ClientAddr:       "127.0.0.2",
 		BindAddr:         "127.0.0.2",
 		AdvertiseAddr:    "127.0.0.2",
 		AdvertiseAddrWan: "127.0.0.2",
+		TaggedAddresses:  map[string]string{"public": "198.18.0.2"},
 		Ports: PortConfig{
 			DNS:     1,
 			HTTP:    2,
@@ -1183,6 +1519,7 @@ func TestMergeConfig(t *testing.T) {
 		CAFile:                 "test/ca.pem",
 		CertFile:               "test/cert.pem",
 		KeyFile:                "test/key.pem",
+		TLSBootstrap:           true,
 		Checks:                 []*CheckDefinition{nil},
 		Services:               []*ServiceDefinition{nil},
 		StartJoin:              []string{"1.1.1.1"},
@@ -1212,7 +1549,16 @@ func TestMergeConfig(t *testing.T) {
 				"handler": "foobar",
 			},
 		},
+		CheckWebhooks: []*CheckWebhook{
+			&CheckWebhook{
+				URL:      "http://localhost:8080/alert",
+				Statuses: []string{"critical"},
+			},
+		},
 		DisableRemoteExec:         true,
+		EnableManagedChecks:       true,
+		EnableManagedScriptChecks: true,
+		ExternalChecker:           true,
 		StatsiteAddr:              "127.0.0.1:7250",
 		StatsitePrefix:            "stats_prefix",
 		StatsdAddr:                "127.0.0.1:7251",
@@ -1228,12 +1574,39 @@ func TestMergeConfig(t *testing.T) {
 				Perms: "0700",
 			},
 		},
-		AtlasInfrastructure: "hashicorp/prod",
-		AtlasToken:          "123456789",
-		AtlasACLToken:       "abcdefgh",
-		AtlasJoin:           true,
-		SessionTTLMinRaw:    "1000s",
-		SessionTTLMin:       1000 * time.Second,
+		AtlasInfrastructure:       "hashicorp/prod",
+		AtlasToken:                "123456789",
+		AtlasACLToken:             "abcdefgh",
+		AtlasJoin:                 true,
+		SessionTTLMinRaw:          "1000s",
+		SessionTTLMin:             1000 * time.Second,
+		ReapLockGracePeriodRaw:    "15m",
+		ReapLockGracePeriod:       15 * time.Minute,
+		KVSRecycleRetentionRaw:    "48h",
+		KVSRecycleRetention:       48 * time.Hour,
+		KVSMaxValueSize:           8 * 1024 * 1024,
+		KVSCompressThreshold:      4096,
+		KVSEncryptionKeyRaw:       "MDEyMzQ1Njc4OWFiY2RlZg==",
+		KVSEncryptionKey:          []byte("0123456789abcdef"),
+		KVSEncryptPrefixes:        []string{"secret/"},
+		FollowerConsistentReads:   true,
+		RejectDuplicateServiceIDs: true,
+		AdaptiveCoordinateUpdates: true,
+		CapacityThresholds: CapacityThresholds{
+			ServiceInstances: 500,
+			Services:         100,
+			KVSKeys:          10000,
+		},
+		KVSQuotas: map[string]KVSQuota{
+			"team-a": KVSQuota{MaxBytes: 1024 * 1024, MaxKeys: 5000},
+		},
+		KVSEvents: map[string]string{
+			"config/": "config-changed",
+		},
+		TombstoneTTLRaw:            "1h",
+		TombstoneTTL:               time.Hour,
+		TombstoneTTLGranularityRaw: "1m",
+		TombstoneTTLGranularity:    time.Minute,
 		AdvertiseAddrs: AdvertiseAddrsConfig{
 			SerfLan:    &net.TCPAddr{},
 			SerfLanRaw: "127.0.0.5:1231",
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/consul/watch"
+	"github.com/hashicorp/logutils"
+)
+
+// ConfigValidation holds the outcome of checking a candidate configuration.
+// Errors would stop the agent from starting with it. Warnings are settings
+// that would load, but are probably mistakes or need a restart to apply.
+type ConfigValidation struct {
+	Errors   []string
+	Warnings []string
+}
+
+func (v *ConfigValidation) errorf(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+func (v *ConfigValidation) warnf(format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, fmt.Sprintf(format, args...))
+}
+
+// ValidateConfig checks a candidate JSON configuration file against this
+// agent without applying it. The file is merged over the defaults, the same
+// way the agent reads its own configuration, and then checked on its own
+// and against the configuration the agent is running with.
+func (a *Agent) ValidateConfig(raw []byte) *ConfigValidation {
+	v := &ConfigValidation{}
+	decoded, err := DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		v.errorf("Failed to parse config: %v", err)
+		return v
+	}
+	config := MergeConfig(DefaultConfig(), decoded)
+
+	validateConfig(v, config)
+	validateConfigChange(v, a.config, config)
+	return v
+}
+
+// validateConfig checks a configuration on its own, catching the problems
+// that would stop an agent from starting with it.
+func validateConfig(v *ConfigValidation, config *Config) {
+	if config.DataDir == "" {
+		v.errorf("data_dir must be provided")
+	}
+	if !validDatacenter.MatchString(config.Datacenter) {
+		v.errorf("datacenter must be alpha-numeric with underscores and hypens only")
+	}
+	if config.EncryptKey != "" {
+		if _, err := config.EncryptBytes(); err != nil {
+			v.errorf("Invalid encryption key: %v", err)
+		}
+	}
+
+	levels := LevelFilter()
+	if !ValidateLevelFilter(logutils.LogLevel(strings.ToUpper(config.LogLevel)), levels) {
+		v.errorf("Invalid log level: %s. Valid log levels are: %v", config.LogLevel, levels.Levels)
+	}
+
+	// Server-only settings.
+	if config.Bootstrap && !config.Server {
+		v.errorf("Bootstrap mode cannot be enabled when server mode is not enabled")
+	}
+	if config.BootstrapExpect != 0 && !config.Server {
+		v.errorf("Expect mode cannot be enabled when server mode is not enabled")
+	}
+	if config.BootstrapExpect != 0 && config.Bootstrap {
+		v.errorf("Bootstrap cannot be provided with an expected server count")
+	}
+	if config.TLSBootstrap && !config.Server {
+		v.errorf("TLS bootstrap cannot be enabled when server mode is not enabled")
+	}
+
+	// ACLs.
+	switch config.ACLDefaultPolicy {
+	case "allow", "deny":
+	default:
+		v.errorf("Unsupported default ACL policy: %s", config.ACLDefaultPolicy)
+	}
+	switch config.ACLDownPolicy {
+	case "allow", "deny", "extend-cache":
+	default:
+		v.errorf("Unsupported down ACL policy: %s", config.ACLDownPolicy)
+	}
+	if config.ACLMasterToken != "" && config.ACLDatacenter != config.Datacenter {
+		v.warnf("acl_master_token is only used by servers in the ACL datacenter %q, not %q",
+			config.ACLDatacenter, config.Datacenter)
+	}
+	if config.ACLDatacenter == "" && config.ACLDefaultPolicy == "deny" {
+		v.warnf("acl_default_policy has no effect without an acl_datacenter")
+	}
+
+	// TLS files must be readable, and the certificate must match its key.
+	for name, path := range map[string]string{
+		"ca_file":   config.CAFile,
+		"cert_file": config.CertFile,
+		"key_file":  config.KeyFile,
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(path); err != nil {
+			v.errorf("Can't read %s: %v", name, err)
+		}
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		v.errorf("cert_file and key_file must be provided together")
+	} else if config.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			v.errorf("Failed to load cert/key pair: %v", err)
+		}
+	}
+	if (config.VerifyIncoming || config.VerifyOutgoing) && config.CAFile == "" && !config.TLSBootstrap {
+		v.errorf("verify_incoming and verify_outgoing require a ca_file")
+	}
+	if config.VerifyIncoming && config.CertFile == "" && !config.TLSBootstrap {
+		v.errorf("verify_incoming requires a cert_file and key_file")
+	}
+
+	// Watches, services, and checks.
+	for _, params := range config.Watches {
+		wp, err := watch.ParseExempt(params, []string{"handler"})
+		if err != nil {
+			v.errorf("Failed to parse watch (%#v): %v", params, err)
+			continue
+		}
+		if err := verifyWatchHandler(wp.Exempt["handler"]); err != nil {
+			v.errorf("Failed to setup watch handler (%#v): %v", params, err)
+		}
+	}
+	for _, service := range config.Services {
+		if service.Name == "" {
+			v.errorf("Service name missing")
+		}
+		for _, chkType := range service.Checks {
+			if !chkType.Valid() {
+				v.errorf("Check type for service %q is not valid", service.Name)
+			}
+			if _, err := ParseStatusRanges(chkType.SuccessCodes); err != nil {
+				v.errorf("Check type for service %q has invalid success codes: %v", service.Name, err)
+			}
+		}
+	}
+	for _, check := range config.Checks {
+		if !check.CheckType.Valid() {
+			v.errorf("Check %q is not valid", check.Name)
+		}
+		if _, err := ParseStatusRanges(check.SuccessCodes); err != nil {
+			v.errorf("Check %q has invalid success codes: %v", check.Name, err)
+		}
+	}
+}
+
+// validateConfigChange warns about settings in a candidate configuration
+// that differ from the running one in ways a reload won't pick up.
+func validateConfigChange(v *ConfigValidation, current, config *Config) {
+	if config.Server != current.Server {
+		v.warnf("Changing server mode needs a restart")
+	}
+	if !strings.EqualFold(config.Datacenter, current.Datacenter) {
+		v.warnf("Changing the datacenter from %q to %q needs a restart", current.Datacenter, config.Datacenter)
+	}
+	if config.NodeName != "" && config.NodeName != current.NodeName {
+		v.warnf("Changing the node name from %q to %q needs a restart", current.NodeName, config.NodeName)
+	}
+	if config.DataDir != current.DataDir {
+		v.warnf("Changing the data directory needs a restart")
+	}
+	if config.ACLDatacenter != current.ACLDatacenter {
+		v.warnf("Changing the ACL datacenter from %q to %q needs a restart",
+			current.ACLDatacenter, config.ACLDatacenter)
+	}
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAgent_ValidateConfig(t *testing.T) {
+	current := DefaultConfig()
+	current.DataDir = "/tmp/consul"
+	current.NodeName = "node1"
+	agent := &Agent{config: current}
+
+	// A config matching the running one is clean.
+	v := agent.ValidateConfig([]byte(`{"data_dir": "/tmp/consul", "node_name": "node1"}`))
+	if len(v.Errors) != 0 || len(v.Warnings) != 0 {
+		t.Fatalf("bad: %#v", v)
+	}
+
+	// Bad JSON is reported rather than failing the call.
+	v = agent.ValidateConfig([]byte(`{"data_dir": `))
+	if len(v.Errors) != 1 || !strings.Contains(v.Errors[0], "Failed to parse config") {
+		t.Fatalf("bad: %#v", v)
+	}
+
+	cases := []struct {
+		config  string
+		problem string
+		warning bool
+	}{
+		{`{}`, "data_dir must be provided", false},
+		{`{"data_dir": "/tmp/consul", "datacenter": "dc 1"}`, "datacenter must be", false},
+		{`{"data_dir": "/tmp/consul", "bootstrap": true}`, "Bootstrap mode cannot be enabled", false},
+		{`{"data_dir": "/tmp/consul", "log_level": "loud"}`, "Invalid log level", false},
+		{`{"data_dir": "/tmp/consul", "acl_down_policy": "maybe"}`, "Unsupported down ACL policy", false},
+		{`{"data_dir": "/tmp/consul", "cert_file": "/nope/cert.pem"}`, "Can't read cert_file", false},
+		{`{"data_dir": "/tmp/consul", "verify_outgoing": true}`, "require a ca_file", false},
+		{`{"data_dir": "/tmp/consul", "service": {"name": "web", "check": {"interval": "10s"}}}`,
+			`Check type for service "web" is not valid`, false},
+		{`{"data_dir": "/tmp/consul", "acl_datacenter": "dc2", "acl_master_token": "root"}`,
+			`only used by servers in the ACL datacenter "dc2"`, true},
+		{`{"data_dir": "/tmp/consul", "server": true}`, "Changing server mode needs a restart", true},
+		{`{"data_dir": "/tmp/consul", "node_name": "node2"}`, "Changing the node name", true},
+	}
+	for _, c := range cases {
+		v := agent.ValidateConfig([]byte(c.config))
+		problems := v.Errors
+		if c.warning {
+			problems = v.Warnings
+		}
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem, c.problem) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("%s: expected %q, got %#v", c.config, c.problem, v)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"strings"
 	"sync"
@@ -161,6 +160,41 @@ START:
 	return addr.String(), nil
 }
 
+// arpaToAddr returns the IP address named by a reverse lookup, or nil if
+// the name isn't a complete in-addr.arpa or ip6.arpa name.
+func arpaToAddr(qName string) net.IP {
+	qName = strings.TrimSuffix(strings.ToLower(dns.Fqdn(qName)), ".")
+	switch {
+	case strings.HasSuffix(qName, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(qName, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+
+	case strings.HasSuffix(qName, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(qName, ".ip6.arpa"), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		var addr []byte
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			addr = append(addr, labels[i][0])
+			if i > 0 && i%4 == 0 {
+				addr = append(addr, ':')
+			}
+		}
+		return net.ParseIP(string(addr))
+	}
+	return nil
+}
+
 // handlePtr is used to handle "reverse" DNS queries
 func (d *DNSServer) handlePtr(resp dns.ResponseWriter, req *dns.Msg) {
 	q := req.Question[0]
@@ -183,31 +217,41 @@ func (d *DNSServer) handlePtr(resp dns.ResponseWriter, req *dns.Msg) {
 
 	datacenter := d.agent.config.Datacenter
 
-	// Get the QName without the domain suffix
-	qName := strings.ToLower(dns.Fqdn(req.Question[0].Name))
-
-	args := structs.DCSpecificRequest{
-		Datacenter: datacenter,
-		QueryOptions: structs.QueryOptions{
-			Token:      d.agent.config.ACLToken,
-			AllowStale: d.config.AllowStale,
-		},
-	}
-	var out structs.IndexedNodes
+	// Look up what's registered at the address being asked about
+	if addr := arpaToAddr(req.Question[0].Name); addr != nil {
+		args := structs.AddressSpecificRequest{
+			Datacenter: datacenter,
+			Address:    addr.String(),
+			QueryOptions: structs.QueryOptions{
+				Token:      d.agent.config.ACLToken,
+				AllowStale: d.config.AllowStale,
+			},
+		}
+		var out structs.IndexedAddressNodes
+		if err := d.agent.RPC("Catalog.NodeByAddress", &args, &out); err != nil {
+			d.logger.Printf("[ERR] dns: rpc error: %v", err)
+		}
 
-	// TODO: Replace ListNodes with an internal RPC that can do the filter
-	// server side to avoid transferring the entire node list.
-	if err := d.agent.RPC("Catalog.ListNodes", &args, &out); err == nil {
 		for _, n := range out.Nodes {
-			arpa, _ := dns.ReverseAddr(n.Address)
-			if arpa == qName {
-				ptr := &dns.PTR{
-					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
-					Ptr: fmt.Sprintf("%s.node.%s.%s", n.Node, datacenter, d.domain),
-				}
-				m.Answer = append(m.Answer, ptr)
-				break
+			ptr := &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
+				Ptr: fmt.Sprintf("%s.node.%s.%s", n.Node, datacenter, d.domain),
+			}
+			m.Answer = append(m.Answer, ptr)
+		}
+
+		// Services with their own address are named by the service
+		seen := make(map[string]struct{})
+		for _, sn := range out.Services {
+			if _, ok := seen[sn.ServiceName]; ok {
+				continue
+			}
+			seen[sn.ServiceName] = struct{}{}
+			ptr := &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
+				Ptr: fmt.Sprintf("%s.service.%s.%s", sn.ServiceName, datacenter, d.domain),
 			}
+			m.Answer = append(m.Answer, ptr)
 		}
 	}
 
@@ -390,8 +434,9 @@ RPC:
 	}
 
 	// Add the node record
-	records := d.formatNodeRecord(out.NodeServices.Node, out.NodeServices.Node.Address,
-		req.Question[0].Name, qType, d.config.NodeTTL)
+	n := out.NodeServices.Node
+	addr := d.agent.translateAddress(datacenter, n.Address, n.TaggedAddresses)
+	records := d.formatNodeRecord(n, addr, req.Question[0].Name, qType, d.config.NodeTTL)
 	if records != nil {
 		resp.Answer = append(resp.Answer, records...)
 	}
@@ -468,6 +513,7 @@ func (d *DNSServer) serviceLookup(network, datacenter, service, tag string, req,
 		ServiceName: service,
 		ServiceTag:  tag,
 		TagFilter:   tag != "",
+		Shuffle:     true,
 		QueryOptions: structs.QueryOptions{
 			Token:      d.agent.config.ACLToken,
 			AllowStale: d.config.AllowStale,
@@ -500,6 +546,7 @@ RPC:
 
 	// Filter out any service nodes due to health checks
 	out.Nodes = d.filterServiceNodes(out.Nodes)
+	d.agent.translateAddresses(datacenter, out.Nodes)
 
 	// If we have no nodes, return not found!
 	if len(out.Nodes) == 0 {
@@ -507,9 +554,7 @@ RPC:
 		resp.SetRcode(req, dns.RcodeNameError)
 		return
 	}
-
-	// Perform a random shuffle
-	shuffleServiceNodes(out.Nodes)
+	ttl = serviceDNSTTL(out.Nodes, ttl)
 
 	// Add various responses depending on the request
 	qType := req.Question[0].Qtype
@@ -536,34 +581,53 @@ RPC:
 	}
 }
 
+// serviceDNSTTL returns the TTL to use for answers about the given service
+// instances. If every instance was registered with a DNS TTL, the shortest
+// one wins, since all the records in a set should share a TTL. Otherwise
+// the configured TTL is used.
+func serviceDNSTTL(nodes structs.CheckServiceNodes, configured time.Duration) time.Duration {
+	var shortest int
+	for _, node := range nodes {
+		ttl := node.Service.DNSTTL
+		if ttl <= 0 {
+			return configured
+		}
+		if shortest == 0 || ttl < shortest {
+			shortest = ttl
+		}
+	}
+	if shortest == 0 {
+		return configured
+	}
+	return time.Duration(shortest) * time.Second
+}
+
 // filterServiceNodes is used to filter out nodes that are failing
-// health checks to prevent routing to unhealthy nodes
+// health checks to prevent routing to unhealthy nodes. The order the
+// servers returned is kept, since it is already shuffled and possibly
+// sorted by distance.
 func (d *DNSServer) filterServiceNodes(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
-	n := len(nodes)
+	n := 0
 OUTER:
-	for i := 0; i < n; i++ {
-		node := nodes[i]
+	for _, node := range nodes {
 		for _, check := range node.Checks {
+			if check.Informational {
+				continue
+			}
 			if check.Status == structs.HealthCritical ||
 				(d.config.OnlyPassing && check.Status != structs.HealthPassing) {
 				d.logger.Printf("[WARN] dns: node '%s' failing health check '%s: %s', dropping from service '%s'",
 					node.Node.Node, check.CheckID, check.Name, node.Service.Service)
-				nodes[i], nodes[n-1] = nodes[n-1], structs.CheckServiceNode{}
-				n--
-				i--
 				continue OUTER
 			}
 		}
+		nodes[n] = node
+		n++
 	}
-	return nodes[:n]
-}
-
-// shuffleServiceNodes does an in-place random shuffle using the Fisher-Yates algorithm
-func shuffleServiceNodes(nodes structs.CheckServiceNodes) {
-	for i := len(nodes) - 1; i > 0; i-- {
-		j := rand.Int31() % int32(i+1)
-		nodes[i], nodes[j] = nodes[j], nodes[i]
+	for i := n; i < len(nodes); i++ {
+		nodes[i] = structs.CheckServiceNode{}
 	}
+	return nodes[:n]
 }
 
 // serviceNodeRecords is used to add the node records for a service lookup
@@ -613,7 +677,7 @@ func (d *DNSServer) serviceSRVRecords(dc string, nodes structs.CheckServiceNodes
 				Ttl:    uint32(ttl / time.Second),
 			},
 			Priority: 1,
-			Weight:   1,
+			Weight:   srvWeight(node),
 			Port:     uint16(node.Service.Port),
 			Target:   fmt.Sprintf("%s.node.%s.%s", node.Node.Node, dc, d.domain),
 		}
@@ -633,6 +697,21 @@ func (d *DNSServer) serviceSRVRecords(dc string, nodes structs.CheckServiceNodes
 	}
 }
 
+// srvWeight returns the SRV weight for a service instance. Instances with a
+// warning check get their warning weight, so they can be given less traffic.
+func srvWeight(node structs.CheckServiceNode) uint16 {
+	weights := structs.DefaultWeights
+	if node.Service.Weights != nil {
+		weights = *node.Service.Weights
+	}
+	for _, check := range node.Checks {
+		if !check.Informational && check.Status == structs.HealthWarning {
+			return uint16(weights.Warning)
+		}
+	}
+	return uint16(weights.Passing)
+}
+
 // handleRecurse is used to handle recursive DNS queries
 func (d *DNSServer) handleRecurse(resp dns.ResponseWriter, req *dns.Msg) {
 	q := req.Question[0]
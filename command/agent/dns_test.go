@@ -2,6 +2,7 @@ package agent
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"strings"
@@ -499,6 +500,78 @@ func TestDNS_ReverseLookup_IPV6(t *testing.T) {
 	}
 }
 
+func TestDNS_ReverseLookup_Service(t *testing.T) {
+	dir, srv := makeDNSServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register a service with its own address
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Address: "127.0.0.3",
+			Port:    12345,
+		},
+	}
+
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("3.0.0.127.in-addr.arpa.", dns.TypePTR)
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(in.Answer) != 1 {
+		t.Fatalf("Bad: %#v", in)
+	}
+
+	ptrRec, ok := in.Answer[0].(*dns.PTR)
+	if !ok {
+		t.Fatalf("Bad: %#v", in.Answer[0])
+	}
+	if ptrRec.Ptr != "db.service.dc1.consul." {
+		t.Fatalf("Bad: %#v", ptrRec)
+	}
+}
+
+func TestDNS_arpaToAddr(t *testing.T) {
+	cases := map[string]string{
+		"2.0.0.127.in-addr.arpa.": "127.0.0.2",
+		"2.0.0.127.IN-ADDR.ARPA":  "127.0.0.2",
+		"2.4.2.4.2.4.2.4.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.":         "::4242:4242",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "2001:db8::1",
+		"0.0.127.in-addr.arpa.":   "",
+		"x.0.0.127.in-addr.arpa.": "",
+		"42.ip6.arpa.":            "",
+		"foo.node.consul.":        "",
+	}
+	for name, expected := range cases {
+		addr := arpaToAddr(name)
+		if expected == "" {
+			if addr != nil {
+				t.Fatalf("%s: bad: %v", name, addr)
+			}
+			continue
+		}
+		if addr == nil || addr.String() != expected {
+			t.Fatalf("%s: bad: %v", name, addr)
+		}
+	}
+}
+
 func TestDNS_ServiceLookup(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
@@ -1781,6 +1854,121 @@ func TestDNS_ServiceLookup_TTL(t *testing.T) {
 	}
 }
 
+func TestDNS_ServiceLookup_Weights(t *testing.T) {
+	dir, srv := makeDNSServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	register := func(node, addr, status string, weights *structs.Weights) {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    addr,
+			Service: &structs.NodeService{
+				Service: "db",
+				Port:    12345,
+				Weights: weights,
+			},
+			Check: &structs.HealthCheck{
+				CheckID:   "db",
+				Name:      "db",
+				ServiceID: "db",
+				Status:    status,
+			},
+		}
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register("foo", "127.0.0.1", structs.HealthPassing, &structs.Weights{Passing: 10, Warning: 1})
+	register("bar", "127.0.0.2", structs.HealthWarning, &structs.Weights{Passing: 10, Warning: 1})
+	register("baz", "127.0.0.3", structs.HealthWarning, nil)
+
+	m := new(dns.Msg)
+	m.SetQuestion("db.service.consul.", dns.TypeSRV)
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(in.Answer) != 3 {
+		t.Fatalf("Bad: %#v", in)
+	}
+
+	expected := map[string]uint16{
+		"foo.node.dc1.consul.": 10,
+		"bar.node.dc1.consul.": 1,
+		"baz.node.dc1.consul.": 1,
+	}
+	for _, rr := range in.Answer {
+		srvRec, ok := rr.(*dns.SRV)
+		if !ok {
+			t.Fatalf("Bad: %#v", rr)
+		}
+		if srvRec.Weight != expected[srvRec.Target] {
+			t.Fatalf("Bad: %#v", srvRec)
+		}
+	}
+}
+
+func TestDNS_ServiceLookup_RegisteredTTL(t *testing.T) {
+	confFn := func(c *DNSConfig) {
+		c.ServiceTTL = map[string]time.Duration{
+			"*": 5 * time.Second,
+		}
+	}
+	dir, srv := makeDNSServerConfig(t, nil, confFn)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Every instance of db has a TTL, but only one instance of api does.
+	register := func(node, addr, service string, ttl int) {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    addr,
+			Service: &structs.NodeService{
+				Service: service,
+				Port:    12345,
+				DNSTTL:  ttl,
+			},
+		}
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register("foo", "127.0.0.1", "db", 30)
+	register("bar", "127.0.0.2", "db", 20)
+	register("foo", "127.0.0.1", "api", 30)
+	register("bar", "127.0.0.2", "api", 0)
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	for service, expected := range map[string]uint32{"db": 20, "api": 5} {
+		m := new(dns.Msg)
+		m.SetQuestion(service+".service.consul.", dns.TypeSRV)
+		in, _, err := c.Exchange(m, addr.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(in.Answer) != 2 || len(in.Extra) != 2 {
+			t.Fatalf("Bad: %#v", in)
+		}
+		for _, rr := range append(in.Answer, in.Extra...) {
+			if rr.Header().Ttl != expected {
+				t.Fatalf("Bad: %s %#v", service, rr)
+			}
+		}
+	}
+}
+
 func TestDNS_ServiceLookup_SRV_RFC(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
@@ -1915,6 +2103,34 @@ func TestDNS_ServiceLookup_SRV_RFC_TCP_Default(t *testing.T) {
 	}
 }
 
+func TestDNS_FilterServiceNodes_KeepsOrder(t *testing.T) {
+	d := &DNSServer{
+		config: &DNSConfig{},
+		logger: log.New(os.Stderr, "", log.LstdFlags),
+	}
+
+	check := func(status string) structs.HealthChecks {
+		return structs.HealthChecks{&structs.HealthCheck{CheckID: "db", Status: status}}
+	}
+	nodes := structs.CheckServiceNodes{
+		{Node: &structs.Node{Node: "a"}, Service: &structs.NodeService{Service: "db"}, Checks: check(structs.HealthPassing)},
+		{Node: &structs.Node{Node: "b"}, Service: &structs.NodeService{Service: "db"}, Checks: check(structs.HealthCritical)},
+		{Node: &structs.Node{Node: "c"}, Service: &structs.NodeService{Service: "db"}, Checks: check(structs.HealthWarning)},
+		{Node: &structs.Node{Node: "d"}, Service: &structs.NodeService{Service: "db"}, Checks: check(structs.HealthPassing)},
+	}
+
+	// The servers already shuffled or sorted the nodes, so the
+	// survivors must come back in the same relative order.
+	out := d.filterServiceNodes(nodes)
+	var names []string
+	for _, node := range out {
+		names = append(names, node.Node.Node)
+	}
+	if got := strings.Join(names, ","); got != "a,c,d" {
+		t.Fatalf("bad: %s", got)
+	}
+}
+
 func TestDNS_ServiceLookup_FilterACL(t *testing.T) {
 	confFn := func(c *Config) {
 		c.ACLMasterToken = "root"
@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// externalCheckRetryInterval is how long we wait after failing to get
+	// our external checks before trying again.
+	externalCheckRetryInterval = 10 * time.Second
+)
+
+// externalCheck is an external check this agent has been assigned, along
+// with a way to stop it.
+type externalCheck struct {
+	def  structs.ExternalCheck
+	stop func()
+}
+
+// externalCheckNotifier reports the results of an external check to the
+// servers. A result is only sent when the status changes, or when the
+// output changes and CheckUpdateInterval has passed since the last one was
+// sent, to keep the number of Raft writes down.
+type externalCheckNotifier struct {
+	agent    *Agent
+	node     string
+	checkID  string
+	status   string
+	output   string
+	lastSent time.Time
+}
+
+// UpdateCheck is called by the check runner with each result. The check ID
+// it's given is ignored, since it's only unique per node.
+func (n *externalCheckNotifier) UpdateCheck(_, status, output string) {
+	if status == n.status &&
+		(output == n.output || time.Since(n.lastSent) < n.agent.config.CheckUpdateInterval) {
+		return
+	}
+
+	args := structs.ExternalCheckUpdateRequest{
+		Datacenter:   n.agent.config.Datacenter,
+		Node:         n.node,
+		CheckID:      n.checkID,
+		Checker:      n.agent.config.NodeName,
+		Status:       status,
+		Output:       output,
+		WriteRequest: structs.WriteRequest{Token: n.agent.config.ACLToken},
+	}
+	var out struct{}
+	if err := n.agent.RPC("Health.UpdateExternalCheck", &args, &out); err != nil {
+		n.agent.logger.Printf("[WARN] agent: failed to update external check '%s' on node '%s': %v",
+			n.checkID, n.node, err)
+		return
+	}
+	n.status, n.output, n.lastSent = status, output, time.Now()
+}
+
+// externalCheckKey returns the key of an external check, which is only
+// unique together with its node.
+func externalCheckKey(check *structs.HealthCheck) string {
+	return fmt.Sprintf("%s/%s", check.Node, check.CheckID)
+}
+
+// startExternalCheck starts running an external check.
+func (a *Agent) startExternalCheck(check *structs.HealthCheck) *externalCheck {
+	def := *check.External
+	notify := &externalCheckNotifier{
+		agent:   a,
+		node:    check.Node,
+		checkID: check.CheckID,
+	}
+
+	interval := def.Interval
+	if interval < MinInterval {
+		a.logger.Printf("[WARN] agent: external check '%s' on node '%s' has interval below minimum of %v",
+			check.CheckID, check.Node, MinInterval)
+		interval = MinInterval
+	}
+
+	if def.HTTP != "" {
+		http := &CheckHTTP{
+			Notify:   notify,
+			CheckID:  check.CheckID,
+			HTTP:     def.HTTP,
+			Interval: interval,
+			Timeout:  def.Timeout,
+			Logger:   a.logger,
+		}
+		http.Start()
+		return &externalCheck{def: def, stop: http.Stop}
+	}
+
+	tcp := &CheckTCP{
+		Notify:   notify,
+		CheckID:  check.CheckID,
+		TCP:      def.TCP,
+		Interval: interval,
+		Timeout:  def.Timeout,
+		Logger:   a.logger,
+	}
+	tcp.Start()
+	return &externalCheck{def: def, stop: tcp.Stop}
+}
+
+// updateExternalChecks brings the running external checks in line with the
+// ones assigned to this agent. Checks whose definition hasn't changed are
+// left running.
+func (a *Agent) updateExternalChecks(checks structs.HealthChecks) {
+	wanted := make(map[string]struct{})
+	for _, check := range checks {
+		if check.External == nil {
+			continue
+		}
+		key := externalCheckKey(check)
+		wanted[key] = struct{}{}
+
+		if existing, ok := a.externalChecks[key]; ok {
+			if existing.def == *check.External {
+				continue
+			}
+			existing.stop()
+		}
+		a.externalChecks[key] = a.startExternalCheck(check)
+		a.logger.Printf("[DEBUG] agent: started external check '%s' on node '%s'",
+			check.CheckID, check.Node)
+	}
+
+	// Stop the checks that are no longer ours.
+	for key, check := range a.externalChecks {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		check.stop()
+		delete(a.externalChecks, key)
+		a.logger.Printf("[DEBUG] agent: stopped external check '%s'", key)
+	}
+}
+
+// runExternalChecks is a long running goroutine that watches the servers
+// for the external checks assigned to this agent and runs them.
+func (a *Agent) runExternalChecks() {
+	var index uint64
+	for {
+		args := structs.NodeSpecificRequest{
+			Datacenter: a.config.Datacenter,
+			Node:       a.config.NodeName,
+			QueryOptions: structs.QueryOptions{
+				Token:         a.config.ACLToken,
+				MinQueryIndex: index,
+			},
+		}
+		var out structs.IndexedHealthChecks
+		err := a.RPC("Health.ExternalChecks", &args, &out)
+		if err != nil {
+			a.logger.Printf("[WARN] agent: failed to get external checks: %v", err)
+		} else {
+			a.updateExternalChecks(out.HealthChecks)
+		}
+
+		// Back off after errors, and when there's no index to block on.
+		if err != nil || out.Index == 0 {
+			index = 0
+			select {
+			case <-time.After(externalCheckRetryInterval):
+			case <-a.shutdownCh:
+				a.updateExternalChecks(nil)
+				return
+			}
+			continue
+		}
+		index = out.Index
+
+		select {
+		case <-a.shutdownCh:
+			a.updateExternalChecks(nil)
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestAgent_updateExternalChecks(t *testing.T) {
+	dir, agent := makeAgent(t, nextConfig())
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	checks := structs.HealthChecks{
+		&structs.HealthCheck{
+			Node:    "foo",
+			CheckID: "web",
+			External: &structs.ExternalCheck{
+				HTTP:     "http://127.0.0.1:8080",
+				Interval: time.Minute,
+			},
+		},
+		&structs.HealthCheck{
+			Node:    "bar",
+			CheckID: "web",
+			External: &structs.ExternalCheck{
+				TCP:      "127.0.0.1:8080",
+				Interval: time.Minute,
+			},
+		},
+	}
+	agent.updateExternalChecks(checks)
+	if len(agent.externalChecks) != 2 {
+		t.Fatalf("bad: %v", agent.externalChecks)
+	}
+	foo := agent.externalChecks["foo/web"]
+	if foo == nil || foo.def.HTTP != "http://127.0.0.1:8080" {
+		t.Fatalf("bad: %v", foo)
+	}
+
+	// Unchanged checks keep running, and changed ones are restarted.
+	checks[1].External = &structs.ExternalCheck{
+		TCP:      "127.0.0.1:8081",
+		Interval: time.Minute,
+	}
+	agent.updateExternalChecks(checks)
+	if agent.externalChecks["foo/web"] != foo {
+		t.Fatalf("should have kept foo check")
+	}
+	if bar := agent.externalChecks["bar/web"]; bar.def.TCP != "127.0.0.1:8081" {
+		t.Fatalf("bad: %v", bar)
+	}
+
+	// Checks that are no longer assigned are stopped.
+	agent.updateExternalChecks(checks[1:])
+	if _, ok := agent.externalChecks["foo/web"]; ok || len(agent.externalChecks) != 1 {
+		t.Fatalf("bad: %v", agent.externalChecks)
+	}
+
+	agent.updateExternalChecks(nil)
+	if len(agent.externalChecks) != 0 {
+		t.Fatalf("bad: %v", agent.externalChecks)
+	}
+}
+
+func TestAgent_runExternalChecks(t *testing.T) {
+	config := nextConfig()
+	config.ExternalChecker = true
+	config.ConsulConfig.ReconcileInterval = 100 * time.Millisecond
+	dir, agent := makeAgent(t, config)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	testutil.WaitForLeader(t, agent.RPC, "dc1")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	// Register an external service with an external check.
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web",
+			Service: "web",
+			Source:  structs.ServiceSourceExternal,
+		},
+		Check: &structs.HealthCheck{
+			Name:      "web alive",
+			ServiceID: "web",
+			External: &structs.ExternalCheck{
+				HTTP:     server.URL,
+				Interval: time.Second,
+			},
+		},
+	}
+	var out struct{}
+	if err := agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// We're the only checker, so the check should be run here and its
+	// result written to the catalog.
+	testutil.WaitForResult(func() (bool, error) {
+		req := structs.NodeSpecificRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+		}
+		var checks structs.IndexedHealthChecks
+		if err := agent.RPC("Health.NodeChecks", &req, &checks); err != nil {
+			return false, err
+		}
+		if len(checks.HealthChecks) != 1 {
+			return false, nil
+		}
+		check := checks.HealthChecks[0]
+		return check.Status == structs.HealthPassing && check.External.Checker == config.NodeName, nil
+	}, func(err error) {
+		t.Fatalf("check not run: %v", err)
+	})
+}
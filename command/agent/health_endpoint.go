@@ -14,13 +14,24 @@ func (s *HTTPServer) HealthChecksInState(resp http.ResponseWriter, req *http.Req
 		return nil, nil
 	}
 
-	// Pull out the service name
+	// Pull out the state, or a comma separated set of states
 	args.State = strings.TrimPrefix(req.URL.Path, "/v1/health/state/")
 	if args.State == "" {
 		resp.WriteHeader(400)
 		resp.Write([]byte("Missing check state"))
 		return nil, nil
 	}
+	if strings.Contains(args.State, ",") {
+		args.States = strings.Split(args.State, ",")
+	}
+
+	// Narrow it down to a service, and maybe a tag
+	params := req.URL.Query()
+	args.ServiceName = params.Get("service")
+	if _, ok := params["tag"]; ok {
+		args.ServiceTag = params.Get("tag")
+		args.TagFilter = true
+	}
 
 	// Make the RPC request
 	var out structs.IndexedHealthChecks
@@ -55,6 +66,55 @@ func (s *HTTPServer) HealthNodeChecks(resp http.ResponseWriter, req *http.Reques
 	return out.HealthChecks, nil
 }
 
+func (s *HTTPServer) HealthCheckHistory(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default DC
+	args := structs.CheckHistoryRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Pull out the node name and check ID
+	path := strings.TrimPrefix(req.URL.Path, "/v1/health/history/")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing node name or check ID"))
+		return nil, nil
+	}
+	args.Node, args.CheckID = parts[0], parts[1]
+
+	// Make the RPC request
+	var out structs.IndexedCheckHistory
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Health.CheckHistory", &args, &out); err != nil {
+		return nil, err
+	}
+	if out.History == nil {
+		out.History = make(structs.CheckTransitions, 0)
+	}
+	return out.History, nil
+}
+
+func (s *HTTPServer) HealthServiceSummary(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default DC
+	args := structs.ServiceSummaryRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	args.Prefix = req.URL.Query().Get("prefix")
+
+	// Make the RPC request
+	var out structs.IndexedServiceSummaries
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Health.ServiceSummary", &args, &out); err != nil {
+		return nil, err
+	}
+	if out.Summaries == nil {
+		out.Summaries = make(structs.ServiceSummaries)
+	}
+	return out.Summaries, nil
+}
+
 func (s *HTTPServer) HealthServiceChecks(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	// Set default DC
 	args := structs.ServiceSpecificRequest{}
@@ -62,6 +122,7 @@ func (s *HTTPServer) HealthServiceChecks(resp http.ResponseWriter, req *http.Req
 	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
 		return nil, nil
 	}
+	args.Filter = req.URL.Query().Get("filter")
 
 	// Pull out the service name
 	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/health/checks/")
@@ -94,6 +155,13 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 		args.ServiceTag = params.Get("tag")
 		args.TagFilter = true
 	}
+	args.Filter = params.Get("filter")
+	if _, ok := params["deltas"]; ok {
+		args.Deltas = true
+	}
+	if _, ok := params["coordinates"]; ok {
+		args.Coordinates = true
+	}
 
 	// Pull out the service name
 	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/health/service/")
@@ -109,21 +177,82 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 	if err := s.agent.RPC("Health.ServiceNodes", &args, &out); err != nil {
 		return nil, err
 	}
+	_, passing := params["passing"]
+	if args.Deltas {
+		return s.healthServiceDeltas(args.Datacenter, &out, passing), nil
+	}
+	s.agent.translateAddresses(args.Datacenter, out.Nodes)
 
 	// Filter to only passing if specified
-	if _, ok := params["passing"]; ok {
+	if passing {
 		out.Nodes = filterNonPassing(out.Nodes)
 	}
+
+	hints := make([]int, 0, len(out.Nodes))
+	for _, node := range out.Nodes {
+		hints = append(hints, node.Service.CacheMaxAge)
+	}
+	setCacheMaxAge(resp, hints)
+	return out.Nodes, nil
+}
+
+// healthServiceDeltas prepares the reply to a service health query that
+// asked for deltas. Instances that are filtered out for not passing are
+// reported as removals, since they've left the passing set.
+func (s *HTTPServer) healthServiceDeltas(dc string, out *structs.IndexedCheckServiceNodes, passing bool) interface{} {
+	deltas := make(structs.ServiceEvents, 0, len(out.Deltas))
+	for _, event := range out.Deltas {
+		if event.Instance != nil {
+			instances := structs.CheckServiceNodes{*event.Instance}
+			if passing && len(filterNonPassing(instances)) == 0 {
+				if out.Reset {
+					continue
+				}
+				event.Op, event.Instance = structs.ServiceEventRemove, nil
+			} else {
+				s.agent.translateAddresses(dc, instances)
+				event.Instance = &instances[0]
+			}
+		}
+		deltas = append(deltas, event)
+	}
+
+	return struct {
+		Deltas structs.ServiceEvents
+		Reset  bool
+	}{deltas, out.Reset}
+}
+
+func (s *HTTPServer) HealthNodeLiveness(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default DC
+	args := structs.NodeLivenessRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Pull out the nodes, if any were given
+	args.Nodes = req.URL.Query()["node"]
+
+	// Make the RPC request
+	var out structs.IndexedNodeLiveness
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Health.NodeLiveness", &args, &out); err != nil {
+		return nil, err
+	}
 	return out.Nodes, nil
 }
 
-// filterNonPassing is used to filter out any nodes that have check that are not passing
+// filterNonPassing is used to filter out any nodes that have check that are not passing.
+// Informational checks are ignored since they never affect the health of a node.
 func filterNonPassing(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
 	n := len(nodes)
 OUTER:
 	for i := 0; i < n; i++ {
 		node := nodes[i]
 		for _, check := range node.Checks {
+			if check.Informational {
+				continue
+			}
 			if check.Status != structs.HealthPassing {
 				nodes[i], nodes[n-1] = nodes[n-1], structs.CheckServiceNode{}
 				n--
@@ -41,6 +41,62 @@ func TestHealthChecksInState(t *testing.T) {
 	})
 }
 
+func TestHealthChecksInState_Filters(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	for node, status := range map[string]string{
+		"foo": structs.HealthWarning,
+		"bar": structs.HealthCritical,
+		"baz": structs.HealthPassing,
+	} {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Tags:    []string{"master"},
+			},
+			Check: &structs.HealthCheck{
+				Name:      "db connect",
+				Status:    status,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/v1/health/state/warning,critical?service=db&tag=master", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthChecksInState(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+
+	checks := obj.(structs.HealthChecks)
+	if len(checks) != 2 {
+		t.Fatalf("bad: %v", checks)
+	}
+	for _, check := range checks {
+		if check.Node == "baz" {
+			t.Fatalf("bad: %v", check)
+		}
+	}
+}
+
 func TestHealthChecksInState_DistanceSort(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -150,6 +206,150 @@ func TestHealthNodeChecks(t *testing.T) {
 	}
 }
 
+func TestHealthCheckHistory(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET",
+		fmt.Sprintf("/v1/health/history/%s/serfHealth?dc=dc1", srv.agent.config.NodeName), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthCheckHistory(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+
+	// The server's serf check went passing when it joined
+	history := obj.(structs.CheckTransitions)
+	if len(history) == 0 || history[len(history)-1].Status != structs.HealthPassing {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	// A check with no history returns an empty list
+	req, err = http.NewRequest("GET",
+		fmt.Sprintf("/v1/health/history/%s/nope?dc=dc1", srv.agent.config.NodeName), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	obj, err = srv.HealthCheckHistory(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if history := obj.(structs.CheckTransitions); history == nil || len(history) != 0 {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	// The check ID is required
+	req, err = http.NewRequest("GET",
+		fmt.Sprintf("/v1/health/history/%s", srv.agent.config.NodeName), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.HealthCheckHistory(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
+
+func TestHealthServiceSummary(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "bar",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web",
+			Service: "web",
+		},
+		Check: &structs.HealthCheck{
+			Node:      "bar",
+			Name:      "web check",
+			Status:    structs.HealthCritical,
+			ServiceID: "web",
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/health/summary?dc=dc1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthServiceSummary(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+
+	summaries := obj.(structs.ServiceSummaries)
+	web := summaries["web"]
+	if web == nil || web.Instances != 1 || web.Critical != 1 {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	// A prefix that matches nothing returns an empty map
+	req, err = http.NewRequest("GET", "/v1/health/summary?dc=dc1&prefix=nope", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	obj, err = srv.HealthServiceSummary(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if summaries := obj.(structs.ServiceSummaries); summaries == nil || len(summaries) != 0 {
+		t.Fatalf("bad: %v", obj)
+	}
+}
+
+func TestHealthNodeLiveness(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET",
+		fmt.Sprintf("/v1/health/liveness?node=%s&node=nope", srv.agent.config.NodeName), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthNodeLiveness(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should only be the agent itself
+	nodes := obj.(structs.NodeLivenesses)
+	if len(nodes) != 1 || nodes[0].Status != "alive" {
+		t.Fatalf("bad: %v", obj)
+	}
+}
+
 func TestHealthServiceChecks(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -394,6 +594,55 @@ func TestHealthServiceNodes_DistanceSort(t *testing.T) {
 	}
 }
 
+func TestHealthServiceNodes_Coordinates(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "test",
+			Service: "test",
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Send an update for the node and wait for it to get applied.
+	arg := structs.CoordinateUpdateRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Coord:      coordinate.NewCoordinate(coordinate.DefaultConfig()),
+	}
+	if err := srv.agent.RPC("Coordinate.Update", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", "/v1/health/service/test?coordinates", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthServiceNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	nodes := obj.(structs.CheckServiceNodes)
+	if len(nodes) != 1 || nodes[0].Coord == nil {
+		t.Fatalf("bad: %v", obj)
+	}
+}
+
 func TestHealthServiceNodes_PassingFilter(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -475,3 +724,30 @@ func TestFilterNonPassing(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestFilterNonPassing_Informational(t *testing.T) {
+	nodes := structs.CheckServiceNodes{
+		structs.CheckServiceNode{
+			Checks: structs.HealthChecks{
+				&structs.HealthCheck{
+					Status: structs.HealthPassing,
+				},
+				&structs.HealthCheck{
+					Status:        structs.HealthCritical,
+					Informational: true,
+				},
+			},
+		},
+		structs.CheckServiceNode{
+			Checks: structs.HealthChecks{
+				&structs.HealthCheck{
+					Status: structs.HealthCritical,
+				},
+			},
+		},
+	}
+	out := filterNonPassing(nodes)
+	if len(out) != 1 || !reflect.DeepEqual(out[0], nodes[0]) {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -197,13 +197,18 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 
 	s.mux.HandleFunc("/v1/status/leader", s.wrap(s.StatusLeader))
 	s.mux.HandleFunc("/v1/status/peers", s.wrap(s.StatusPeers))
+	s.mux.HandleFunc("/v1/status/ready", s.wrap(s.StatusReady))
 
 	s.mux.HandleFunc("/v1/catalog/register", s.wrap(s.CatalogRegister))
 	s.mux.HandleFunc("/v1/catalog/deregister", s.wrap(s.CatalogDeregister))
+	s.mux.HandleFunc("/v1/catalog/drain", s.wrap(s.CatalogDrain))
 	s.mux.HandleFunc("/v1/catalog/datacenters", s.wrap(s.CatalogDatacenters))
+	s.mux.HandleFunc("/v1/catalog/datacenter-info", s.wrap(s.CatalogDatacenterInfo))
+	s.mux.HandleFunc("/v1/catalog/dump", s.wrap(s.CatalogDump))
 	s.mux.HandleFunc("/v1/catalog/nodes", s.wrap(s.CatalogNodes))
 	s.mux.HandleFunc("/v1/catalog/services", s.wrap(s.CatalogServices))
 	s.mux.HandleFunc("/v1/catalog/service/", s.wrap(s.CatalogServiceNodes))
+	s.mux.HandleFunc("/v1/catalog/service-multi-dc/", s.wrap(s.CatalogServiceNodesMultiDC))
 	s.mux.HandleFunc("/v1/catalog/node/", s.wrap(s.CatalogNodeServices))
 
 	if !s.agent.config.DisableCoordinates {
@@ -216,8 +221,11 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 
 	s.mux.HandleFunc("/v1/health/node/", s.wrap(s.HealthNodeChecks))
 	s.mux.HandleFunc("/v1/health/checks/", s.wrap(s.HealthServiceChecks))
+	s.mux.HandleFunc("/v1/health/history/", s.wrap(s.HealthCheckHistory))
 	s.mux.HandleFunc("/v1/health/state/", s.wrap(s.HealthChecksInState))
 	s.mux.HandleFunc("/v1/health/service/", s.wrap(s.HealthServiceNodes))
+	s.mux.HandleFunc("/v1/health/summary", s.wrap(s.HealthServiceSummary))
+	s.mux.HandleFunc("/v1/health/liveness", s.wrap(s.HealthNodeLiveness))
 
 	s.mux.HandleFunc("/v1/agent/self", s.wrap(s.AgentSelf))
 	s.mux.HandleFunc("/v1/agent/maintenance", s.wrap(s.AgentNodeMaintenance))
@@ -232,6 +240,7 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/agent/check/pass/", s.wrap(s.AgentCheckPass))
 	s.mux.HandleFunc("/v1/agent/check/warn/", s.wrap(s.AgentCheckWarn))
 	s.mux.HandleFunc("/v1/agent/check/fail/", s.wrap(s.AgentCheckFail))
+	s.mux.HandleFunc("/v1/agent/check/batch", s.wrap(s.AgentCheckBatch))
 
 	s.mux.HandleFunc("/v1/agent/service/register", s.wrap(s.AgentRegisterService))
 	s.mux.HandleFunc("/v1/agent/service/deregister/", s.wrap(s.AgentDeregisterService))
@@ -241,6 +250,11 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/event/list", s.wrap(s.EventList))
 
 	s.mux.HandleFunc("/v1/kv/", s.wrap(s.KVSEndpoint))
+	s.mux.HandleFunc("/v1/kv-recycle/list", s.wrap(s.KVSRecycledList))
+	s.mux.HandleFunc("/v1/kv-recycle/restore/", s.wrap(s.KVSRecycledRestore))
+	s.mux.HandleFunc("/v1/kv-fence/", s.wrap(s.KVSVerifyFence))
+	s.mux.HandleFunc("/v1/kv-stream/", s.wrap(s.KVSStream))
+	s.mux.HandleFunc("/v1/txn", s.wrap(s.Txn))
 
 	s.mux.HandleFunc("/v1/session/create", s.wrap(s.SessionCreate))
 	s.mux.HandleFunc("/v1/session/destroy/", s.wrap(s.SessionDestroy))
@@ -249,6 +263,14 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/session/node/", s.wrap(s.SessionsForNode))
 	s.mux.HandleFunc("/v1/session/list", s.wrap(s.SessionList))
 
+	s.mux.HandleFunc("/v1/maintenance/window", s.wrap(s.MaintenanceWindow))
+	s.mux.HandleFunc("/v1/maintenance/window/", s.wrap(s.MaintenanceWindow))
+	s.mux.HandleFunc("/v1/maintenance/windows", s.wrap(s.MaintenanceWindowList))
+
+	s.mux.HandleFunc("/v1/managed-check", s.wrap(s.ManagedCheck))
+	s.mux.HandleFunc("/v1/managed-check/", s.wrap(s.ManagedCheck))
+	s.mux.HandleFunc("/v1/managed-checks", s.wrap(s.ManagedCheckList))
+
 	if s.agent.config.ACLDatacenter != "" {
 		s.mux.HandleFunc("/v1/acl/create", s.wrap(s.ACLCreate))
 		s.mux.HandleFunc("/v1/acl/update", s.wrap(s.ACLUpdate))
@@ -322,6 +344,8 @@ func (s *HTTPServer) wrap(handler func(resp http.ResponseWriter, req *http.Reque
 			errMsg := err.Error()
 			if strings.Contains(errMsg, "Permission denied") || strings.Contains(errMsg, "ACL not found") {
 				code = 403
+			} else if structs.IsValidationError(err) {
+				code = 400
 			}
 			resp.WriteHeader(code)
 			resp.Write([]byte(err.Error()))
@@ -405,11 +429,58 @@ func setLastContact(resp http.ResponseWriter, last time.Duration) {
 	resp.Header().Set("X-Consul-LastContact", strconv.FormatUint(lastMsec, 10))
 }
 
+// setDatacenter is used to set the datacenter header
+func setDatacenter(resp http.ResponseWriter, dc string) {
+	if dc != "" {
+		resp.Header().Set("X-Consul-Datacenter", dc)
+	}
+}
+
+// consistencyTokenPrefix starts every consistency token. Clients treat the
+// tokens as opaque, so the prefix lets the format change later.
+const consistencyTokenPrefix = "c1-"
+
+// setConsistencyToken is used to set the consistency token header for a
+// write applied at the given index. Nothing is set if nothing was written.
+func setConsistencyToken(resp http.ResponseWriter, index uint64) {
+	if index > 0 {
+		resp.Header().Set("X-Consul-Consistency-Token",
+			consistencyTokenPrefix+strconv.FormatUint(index, 16))
+	}
+}
+
+// parseConsistencyToken returns the index in a consistency token
+func parseConsistencyToken(token string) (uint64, error) {
+	if !strings.HasPrefix(token, consistencyTokenPrefix) {
+		return 0, fmt.Errorf("unknown token format")
+	}
+	return strconv.ParseUint(strings.TrimPrefix(token, consistencyTokenPrefix), 16, 64)
+}
+
 // setMeta is used to set the query response meta data
 func setMeta(resp http.ResponseWriter, m *structs.QueryMeta) {
 	setIndex(resp, m.Index)
 	setLastContact(resp, m.LastContact)
 	setKnownLeader(resp, m.KnownLeader)
+	setDatacenter(resp, m.Datacenter)
+}
+
+// setCacheMaxAge is used to set a Cache-Control header from the cache
+// hints of the services being returned. The shortest hint wins, and no
+// header is set if any of the services didn't give one.
+func setCacheMaxAge(resp http.ResponseWriter, hints []int) {
+	if len(hints) == 0 {
+		return
+	}
+	maxAge := hints[0]
+	for _, hint := range hints[1:] {
+		if hint < maxAge {
+			maxAge = hint
+		}
+	}
+	if maxAge > 0 {
+		resp.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
 }
 
 // setHeaders is used to set canonical response header fields
@@ -444,8 +515,8 @@ func parseWait(resp http.ResponseWriter, req *http.Request, b *structs.QueryOpti
 	return false
 }
 
-// parseConsistency is used to parse the ?stale and ?consistent query params.
-// Returns true on error
+// parseConsistency is used to parse the ?stale, ?consistent and
+// ?consistency-token query params. Returns true on error
 func parseConsistency(resp http.ResponseWriter, req *http.Request, b *structs.QueryOptions) bool {
 	query := req.URL.Query()
 	if _, ok := query["stale"]; ok {
@@ -459,6 +530,15 @@ func parseConsistency(resp http.ResponseWriter, req *http.Request, b *structs.Qu
 		resp.Write([]byte("Cannot specify ?stale with ?consistent, conflicting semantics."))
 		return true
 	}
+	if token := query.Get("consistency-token"); token != "" {
+		index, err := parseConsistencyToken(token)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid consistency token"))
+			return true
+		}
+		b.ConsistencyIndex = index
+	}
 	return false
 }
 
@@ -507,6 +587,24 @@ func (s *HTTPServer) parseSource(req *http.Request, source *structs.QuerySource)
 	}
 }
 
+// parseMetaFilter is used to parse the ?node-meta=key:value query parameter,
+// which may be given more than once, into a set of node metadata filters.
+func parseMetaFilter(resp http.ResponseWriter, req *http.Request, filters *map[string]string) bool {
+	for _, filter := range req.URL.Query()["node-meta"] {
+		parts := strings.SplitN(filter, ":", 2)
+		if len(parts) != 2 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid node-meta filter %q, must be key:value", filter)))
+			return true
+		}
+		if *filters == nil {
+			*filters = make(map[string]string)
+		}
+		(*filters)[parts[0]] = parts[1]
+	}
+	return false
+}
+
 // parse is a convenience method for endpoints that need
 // to use both parseWait and parseDC.
 func (s *HTTPServer) parse(resp http.ResponseWriter, req *http.Request, dc *string, b *structs.QueryOptions) bool {
@@ -12,6 +12,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -205,6 +206,7 @@ func TestSetMeta(t *testing.T) {
 		Index:       1000,
 		KnownLeader: true,
 		LastContact: 123456 * time.Microsecond,
+		Datacenter:  "dc1",
 	}
 	resp := httptest.NewRecorder()
 	setMeta(resp, &meta)
@@ -220,6 +222,10 @@ func TestSetMeta(t *testing.T) {
 	if header != "123" {
 		t.Fatalf("Bad: %v", header)
 	}
+	header = resp.Header().Get("X-Consul-Datacenter")
+	if header != "dc1" {
+		t.Fatalf("Bad: %v", header)
+	}
 }
 
 func TestHTTPAPIResponseHeaders(t *testing.T) {
@@ -301,6 +307,31 @@ func TestHTTP_wrap_obfuscateLog(t *testing.T) {
 	}
 }
 
+func TestHTTP_wrap_validationError(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/v1/catalog/register", nil)
+
+	handler := func(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+		var verr structs.ValidationErrors
+		verr.Add("Node", "must be provided")
+		return nil, verr
+	}
+	srv.wrap(handler)(resp, req)
+
+	// Bad requests should be reported as such
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+	if body := resp.Body.String(); body != "Invalid request: Node: must be provided" {
+		t.Fatalf("bad: %s", body)
+	}
+}
+
 func TestPrettyPrint(t *testing.T) {
 	testPrettyPrint("pretty=1", t)
 }
@@ -394,6 +425,50 @@ func TestParseSource(t *testing.T) {
 	}
 }
 
+func TestParseMetaFilter(t *testing.T) {
+	resp := httptest.NewRecorder()
+	var filters map[string]string
+
+	// No filters leaves the map alone
+	req, err := http.NewRequest("GET", "/v1/catalog/nodes", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseMetaFilter(resp, req, &filters); d {
+		t.Fatalf("unexpected done")
+	}
+	if filters != nil {
+		t.Fatalf("bad: %v", filters)
+	}
+
+	// Each filter is split on its first colon
+	req, err = http.NewRequest("GET",
+		"/v1/catalog/nodes?node-meta=rack:r1&node-meta=url:http://foo", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseMetaFilter(resp, req, &filters); d {
+		t.Fatalf("unexpected done")
+	}
+	expected := map[string]string{"rack": "r1", "url": "http://foo"}
+	if !reflect.DeepEqual(filters, expected) {
+		t.Fatalf("bad: %v", filters)
+	}
+
+	// A filter without a value is rejected
+	filters = nil
+	req, err = http.NewRequest("GET", "/v1/catalog/nodes?node-meta=rack", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseMetaFilter(resp, req, &filters); !d {
+		t.Fatalf("expected done")
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %v", resp.Code)
+	}
+}
+
 func TestParseWait(t *testing.T) {
 	resp := httptest.NewRecorder()
 	var b structs.QueryOptions
@@ -513,6 +588,49 @@ func TestParseConsistency_Invalid(t *testing.T) {
 	}
 }
 
+func TestParseConsistency_Token(t *testing.T) {
+	resp := httptest.NewRecorder()
+	setConsistencyToken(resp, 42)
+	token := resp.Header().Get("X-Consul-Consistency-Token")
+	if token == "" {
+		t.Fatalf("missing token")
+	}
+
+	var b structs.QueryOptions
+	req, err := http.NewRequest("GET",
+		"/v1/kv/foo?stale&consistency-token="+token, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseConsistency(resp, req, &b); d {
+		t.Fatalf("unexpected done")
+	}
+	if !b.AllowStale || b.ConsistencyIndex != 42 {
+		t.Fatalf("Bad: %v", b)
+	}
+
+	// Bad tokens are rejected
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest("GET",
+		"/v1/kv/foo?consistency-token=42", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseConsistency(resp, req, &b); !d {
+		t.Fatalf("expected done")
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %v", resp.Code)
+	}
+
+	// Nothing is set when nothing was written
+	resp = httptest.NewRecorder()
+	setConsistencyToken(resp, 0)
+	if token := resp.Header().Get("X-Consul-Consistency-Token"); token != "" {
+		t.Fatalf("bad: %v", token)
+	}
+}
+
 // Test ACL token is resolved in correct order
 func TestACLResolution(t *testing.T) {
 	var token string
@@ -2,9 +2,11 @@ package agent
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -14,7 +16,8 @@ import (
 const (
 	// maxKVSize is used to limit the maximum payload length
 	// of a KV entry. If it exceeds this amount, the client is
-	// likely abusing the KV store.
+	// likely abusing the KV store. It's the default for
+	// kvs_max_value_size, and always applies to transactions.
 	maxKVSize = 512 * 1024
 )
 
@@ -60,6 +63,7 @@ func (s *HTTPServer) KVSGet(resp http.ResponseWriter, req *http.Request, args *s
 	params := req.URL.Query()
 	if _, ok := params["recurse"]; ok {
 		method = "KVS.List"
+		args.Hash = params.Get("hash")
 	} else if missingKey(resp, args) {
 		return nil, nil
 	}
@@ -70,6 +74,7 @@ func (s *HTTPServer) KVSGet(resp http.ResponseWriter, req *http.Request, args *s
 		return nil, err
 	}
 	setMeta(resp, &out.QueryMeta)
+	setContentHash(resp, out.Hash)
 
 	// Check if we get a not found
 	if len(out.Entries) == 0 {
@@ -107,8 +112,24 @@ func (s *HTTPServer) KVSGetKeys(resp http.ResponseWriter, req *http.Request, arg
 		Datacenter:   args.Datacenter,
 		Prefix:       args.Key,
 		Seperator:    sep,
+		Cursor:       params.Get("cursor"),
+		Hash:         params.Get("hash"),
 		QueryOptions: args.QueryOptions,
 	}
+	if _, ok := params["depth"]; ok {
+		depth, err := strconv.ParseUint(params.Get("depth"), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		listArgs.Depth = int(depth)
+	}
+	if _, ok := params["limit"]; ok {
+		limit, err := strconv.ParseUint(params.Get("limit"), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		listArgs.Limit = int(limit)
+	}
 
 	// Make the RPC
 	var out structs.IndexedKeyList
@@ -116,10 +137,15 @@ func (s *HTTPServer) KVSGetKeys(resp http.ResponseWriter, req *http.Request, arg
 		return nil, err
 	}
 	setMeta(resp, &out.QueryMeta)
+	setContentHash(resp, out.Hash)
+	if out.NextCursor != "" {
+		resp.Header().Set("X-Consul-Next-Cursor", out.NextCursor)
+	}
 
-	// Check if we get a not found. We do not generate
-	// not found for the root, but just provide the empty list
-	if len(out.Keys) == 0 && listArgs.Prefix != "" {
+	// Check if we get a not found. We do not generate not found for
+	// the root, or for a page past the end, but just provide the
+	// empty list
+	if len(out.Keys) == 0 && listArgs.Prefix != "" && listArgs.Cursor == "" {
 		resp.WriteHeader(404)
 		return nil, nil
 	}
@@ -136,7 +162,7 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 	if missingKey(resp, args) {
 		return nil, nil
 	}
-	if conflictingFlags(resp, req, "cas", "acquire", "release") {
+	if conflictingFlags(resp, req, "cas", "acquire", "release", "append", "patch") {
 		return nil, nil
 	}
 	applyReq := structs.KVSRequest{
@@ -160,6 +186,9 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 		applyReq.DirEnt.Flags = flagVal
 	}
 
+	// Check for a TTL, which the servers validate
+	applyReq.TTL = params.Get("ttl")
+
 	// Check for cas value
 	if _, ok := params["cas"]; ok {
 		casVal, err := strconv.ParseUint(params.Get("cas"), 10, 64)
@@ -182,10 +211,19 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 		applyReq.Op = structs.KVSUnlock
 	}
 
+	// Check for an append or patch of the current value
+	if _, ok := params["append"]; ok {
+		applyReq.Op = structs.KVSAppend
+	}
+	if _, ok := params["patch"]; ok {
+		applyReq.Op = structs.KVSPatch
+	}
+
 	// Check the content-length
-	if req.ContentLength > maxKVSize {
+	limit := s.agent.config.KVSMaxValueSize
+	if req.ContentLength > int64(limit) {
 		resp.WriteHeader(413)
-		resp.Write([]byte(fmt.Sprintf("Value exceeds %d byte limit", maxKVSize)))
+		resp.Write([]byte(fmt.Sprintf("Value exceeds %d byte limit", limit)))
 		return nil, nil
 	}
 
@@ -196,17 +234,30 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 	}
 	applyReq.DirEnt.Value = buf.Bytes()
 
+	// Return the resulting entry if asked, rather than just the result
+	if _, ok := params["echo"]; ok {
+		var out structs.KVSApplyResponse
+		if err := s.agent.RPC("KVS.ApplyEcho", &applyReq, &out); err != nil {
+			return nil, err
+		}
+		setConsistencyToken(resp, out.Index)
+		setFence(resp, out.Fence)
+		return out, nil
+	}
+
 	// Make the RPC
-	var out bool
-	if err := s.agent.RPC("KVS.Apply", &applyReq, &out); err != nil {
+	var out structs.KVSApplyResponse
+	if err := s.kvsApply(&applyReq, &out); err != nil {
 		return nil, err
 	}
+	setConsistencyToken(resp, out.Index)
+	setFence(resp, out.Fence)
 
 	// Only use the out value if this was a CAS
 	if applyReq.Op == structs.KVSSet {
 		return true, nil
 	} else {
-		return out, nil
+		return out.Result, nil
 	}
 }
 
@@ -243,19 +294,226 @@ func (s *HTTPServer) KVSDelete(resp http.ResponseWriter, req *http.Request, args
 	}
 
 	// Make the RPC
-	var out bool
-	if err := s.agent.RPC("KVS.Apply", &applyReq, &out); err != nil {
+	var out structs.KVSApplyResponse
+	if err := s.kvsApply(&applyReq, &out); err != nil {
 		return nil, err
 	}
+	setConsistencyToken(resp, out.Index)
+	setFence(resp, out.Fence)
 
 	// Only use the out value if this was a CAS
 	if applyReq.Op == structs.KVSDeleteCAS {
-		return out, nil
+		return out.Result, nil
 	} else {
 		return true, nil
 	}
 }
 
+// kvsApply makes a KV write, getting back its index and fence as well.
+// Servers that don't support that are sent a plain KVS.Apply instead, so
+// agents can be upgraded before their servers.
+func (s *HTTPServer) kvsApply(args *structs.KVSRequest, out *structs.KVSApplyResponse) error {
+	if err := s.agent.RPC("KVS.ApplyIndex", args, out); err != nil {
+		if !strings.Contains(err.Error(), "can't find method") {
+			return err
+		}
+		return s.agent.RPC("KVS.Apply", args, &out.Result)
+	}
+	return nil
+}
+
+// KVSRecycledList returns the trees in the KV recycle bin
+func (s *HTTPServer) KVSRecycledList(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedKVSRecycledTrees
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("KVS.ListRecycled", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Trees, nil
+}
+
+// KVSRecycledRestore puts a tree from the KV recycle bin back
+func (s *HTTPServer) KVSRecycledRestore(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Mandate a PUT request
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.KVSRecycleRequest{
+		Op: structs.KVSRecycleRestore,
+	}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	// Pull out the tree id
+	args.ID = strings.TrimPrefix(req.URL.Path, "/v1/kv-recycle/restore/")
+	if args.ID == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing recycled tree ID"))
+		return nil, nil
+	}
+
+	var out struct{}
+	if err := s.agent.RPC("KVS.Restore", &args, &out); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// KVSStream streams the changes under a prefix as server-sent events. Each
+// event carries the changes since the last one, with the change feed
+// sequence number as its ID so a client can pick up where it left off by
+// sending it back as Last-Event-ID. The stream ends when the client goes
+// away, which is noticed between blocking queries.
+func (s *HTTPServer) KVSStream(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.KVSSubscribeRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	args.Prefix = strings.TrimPrefix(req.URL.Path, "/v1/kv-stream/")
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		since, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid Last-Event-ID: %v", err)))
+			return nil, nil
+		}
+		args.Since = since
+	}
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("Streaming not supported")
+	}
+	var closeCh <-chan bool
+	if notifier, ok := resp.(http.CloseNotifier); ok {
+		closeCh = notifier.CloseNotify()
+	}
+
+	started := false
+	for {
+		var out structs.IndexedKVSEvents
+		if err := s.agent.RPC("KVS.Subscribe", &args, &out); err != nil {
+			// Once the stream has started the status can't change, so
+			// the client just sees it end and reconnects.
+			if !started {
+				return nil, err
+			}
+			s.logger.Printf("[ERR] http: KV stream for '%s' failed: %v", args.Prefix, err)
+			return nil, nil
+		}
+
+		if !started {
+			resp.Header().Set("Content-Type", "text/event-stream")
+			resp.Header().Set("Cache-Control", "no-cache")
+			resp.WriteHeader(200)
+			started = true
+		}
+		if out.Reset || len(out.Events) > 0 {
+			buf, err := json.Marshal(struct {
+				Events structs.KVSEvents
+				Reset  bool
+			}{out.Events, out.Reset})
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(resp, "id: %d\ndata: %s\n\n", out.LastSeq, buf)
+		}
+		flusher.Flush()
+
+		args.Since, args.MinQueryIndex = out.LastSeq, out.Index
+		select {
+		case <-closeCh:
+			return nil, nil
+		case <-s.agent.shutdownCh:
+			return nil, nil
+		default:
+		}
+	}
+}
+
+// KVSVerifyFence checks whether a lock's fence token is still current
+func (s *HTTPServer) KVSVerifyFence(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.KVSFenceRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Pull out the key
+	args.Fence.Key = strings.TrimPrefix(req.URL.Path, "/v1/kv-fence/")
+	if args.Fence.Key == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing key name"))
+		return nil, nil
+	}
+
+	// Pull out the rest of the token
+	params := req.URL.Query()
+	args.Fence.Session = params.Get("session")
+	if args.Fence.Session == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing session"))
+		return nil, nil
+	}
+	var err error
+	if args.Fence.CreateIndex, err = strconv.ParseUint(params.Get("create-index"), 10, 64); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Invalid create-index: %v", err)))
+		return nil, nil
+	}
+	if args.Fence.LockIndex, err = strconv.ParseUint(params.Get("lock-index"), 10, 64); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Invalid lock-index: %v", err)))
+		return nil, nil
+	}
+	if args.Fence.SessionIndex, err = strconv.ParseUint(params.Get("session-index"), 10, 64); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Invalid session-index: %v", err)))
+		return nil, nil
+	}
+
+	var out structs.KVSFenceResponse
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("KVS.VerifyFence", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// setFence sets the fence token for a lock that was just acquired, encoded
+// as the query parameters used to check it at /v1/kv-fence/.
+func setFence(resp http.ResponseWriter, fence *structs.FenceToken) {
+	if fence == nil {
+		return
+	}
+	params := url.Values{}
+	params.Set("create-index", strconv.FormatUint(fence.CreateIndex, 10))
+	params.Set("lock-index", strconv.FormatUint(fence.LockIndex, 10))
+	params.Set("session", fence.Session)
+	params.Set("session-index", strconv.FormatUint(fence.SessionIndex, 10))
+	resp.Header().Set("X-Consul-Fence", params.Encode())
+}
+
+// setContentHash sets the hash of a listing's contents, which can be passed
+// back with the hash parameter to only wake a blocking query when the
+// contents change.
+func setContentHash(resp http.ResponseWriter, hash string) {
+	if hash != "" {
+		resp.Header().Set("X-Consul-Content-Hash", hash)
+	}
+}
+
 // missingKey checks if the key is missing
 func missingKey(resp http.ResponseWriter, args *structs.KeyRequest) bool {
 	if args.Key == "" {
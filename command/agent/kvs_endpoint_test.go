@@ -1,12 +1,15 @@
 package agent
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/consul/consul/structs"
@@ -421,6 +424,45 @@ func TestKVSEndpoint_ListKeys(t *testing.T) {
 			t.Fatalf("should work")
 		}
 
+		expect := []string{"bar", "baz", "foo/", "zip"}
+		if !reflect.DeepEqual(res, expect) {
+			t.Fatalf("bad: %v", res)
+		}
+		if resp.Header().Get("X-Consul-Content-Hash") == "" {
+			t.Fatalf("missing content hash")
+		}
+	}
+
+	{
+		// Page through the keys
+		var res []string
+		cursor := ""
+		for {
+			req, err := http.NewRequest("GET", "/v1/kv/?keys&separator=/&limit=3&cursor="+cursor, nil)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			resp := httptest.NewRecorder()
+			obj, err := srv.KVSEndpoint(resp, req)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if resp.Code != 200 {
+				t.Fatalf("bad code: %d", resp.Code)
+			}
+			page := obj.([]string)
+			if len(page) > 3 {
+				t.Fatalf("bad: %v", page)
+			}
+			res = append(res, page...)
+
+			cursor = resp.Header().Get("X-Consul-Next-Cursor")
+			if cursor == "" {
+				break
+			}
+		}
+
 		expect := []string{"bar", "baz", "foo/", "zip"}
 		if !reflect.DeepEqual(res, expect) {
 			t.Fatalf("bad: %v", res)
@@ -498,6 +540,161 @@ func TestKVSEndpoint_AcquireRelease(t *testing.T) {
 	})
 }
 
+func TestKVSEndpoint_VerifyFence(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		// Acquire the lock, echoing back the fence token
+		id := makeTestSession(t, srv)
+		req, err := http.NewRequest("PUT",
+			"/v1/kv/test?echo&acquire="+id, bytes.NewReader(nil))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		resp := httptest.NewRecorder()
+		obj, err := srv.KVSEndpoint(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		fence := obj.(structs.KVSApplyResponse).Fence
+		if fence == nil || fence.Session != id || fence.LockIndex != 1 {
+			t.Fatalf("bad: %#v", obj)
+		}
+
+		// Check the token, which is also sent as a header
+		url := "/v1/kv-fence/test?" + resp.Header().Get("X-Consul-Fence")
+		expected := fmt.Sprintf("/v1/kv-fence/test?create-index=%d&lock-index=%d&session=%s&session-index=%d",
+			fence.CreateIndex, fence.LockIndex, fence.Session, fence.SessionIndex)
+		if url != expected {
+			t.Fatalf("bad: %s", url)
+		}
+		req, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.KVSVerifyFence(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		if out := obj.(structs.KVSFenceResponse); !out.Valid {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		// A token from an older holding isn't valid
+		url = fmt.Sprintf("/v1/kv-fence/test?create-index=%d&lock-index=%d&session=%s&session-index=%d",
+			fence.CreateIndex, fence.LockIndex-1, fence.Session, fence.SessionIndex)
+		req, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.KVSVerifyFence(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out := obj.(structs.KVSFenceResponse); out.Valid {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		// An ordinary acquire also sends the token as a header
+		req, err = http.NewRequest("PUT", "/v1/kv/other?acquire="+id, bytes.NewReader(nil))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.KVSEndpoint(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res := obj.(bool); !res {
+			t.Fatalf("should work")
+		}
+		if header := resp.Header().Get("X-Consul-Fence"); !strings.Contains(header, "session="+id) {
+			t.Fatalf("bad: %q", header)
+		}
+	})
+}
+
+func TestKVSEndpoint_Stream(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		for _, key := range []string{"app/a", "other"} {
+			req, err := http.NewRequest("PUT", "/v1/kv/"+key, bytes.NewBufferString("test"))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			resp := httptest.NewRecorder()
+			if _, err := srv.KVSEndpoint(resp, req); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+
+		server := httptest.NewServer(srv.mux)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/v1/kv-stream/app/?wait=50ms")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("bad: %s", ct)
+		}
+
+		// The first event has the whole prefix
+		r := bufio.NewReader(resp.Body)
+		readEvent := func() (string, string) {
+			var id, data string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case line == "":
+					return id, data
+				case strings.HasPrefix(line, "id: "):
+					id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "data: "):
+					data = strings.TrimPrefix(line, "data: ")
+				}
+			}
+		}
+		id, data := readEvent()
+		if id == "" {
+			t.Fatalf("missing id")
+		}
+		var event struct {
+			Events structs.KVSEvents
+			Reset  bool
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !event.Reset || len(event.Events) != 1 || event.Events[0].Key != "app/a" {
+			t.Fatalf("bad: %s", data)
+		}
+
+		// Then just the changes
+		req, err := http.NewRequest("DELETE", "/v1/kv/app/a", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := srv.KVSEndpoint(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_, data = readEvent()
+		event.Events, event.Reset = nil, false
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if event.Reset || len(event.Events) != 1 || event.Events[0].Op != structs.ChangeFeedDelete {
+			t.Fatalf("bad: %s", data)
+		}
+	})
+}
+
 func TestKVSEndpoint_GET_Raw(t *testing.T) {
 	httpTest(t, func(srv *HTTPServer) {
 		buf := bytes.NewBuffer([]byte("test"))
@@ -532,6 +729,53 @@ func TestKVSEndpoint_GET_Raw(t *testing.T) {
 	})
 }
 
+func TestKVSEndpoint_PUT_Large(t *testing.T) {
+	httpTestWithConfig(t, func(srv *HTTPServer) {
+		// Values over 512KB are accepted up to the configured limit
+		value := bytes.Repeat([]byte("a"), 600*1024)
+		req, err := http.NewRequest("PUT", "/v1/kv/test", bytes.NewReader(value))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.KVSEndpoint(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res := obj.(bool); !res {
+			t.Fatalf("should work")
+		}
+
+		req, err = http.NewRequest("GET", "/v1/kv/test?raw", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.KVSEndpoint(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(resp.Body.Bytes(), value) {
+			t.Fatalf("bad: %d bytes", resp.Body.Len())
+		}
+
+		// Larger ones are turned away
+		value = bytes.Repeat([]byte("a"), 1024*1024+1)
+		req, err = http.NewRequest("PUT", "/v1/kv/test", bytes.NewReader(value))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.KVSEndpoint(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 413 {
+			t.Fatalf("expected 413, got %d", resp.Code)
+		}
+	}, func(c *Config) {
+		c.KVSMaxValueSize = 1024 * 1024
+	})
+}
+
 func TestKVSEndpoint_PUT_ConflictingFlags(t *testing.T) {
 	httpTest(t, func(srv *HTTPServer) {
 		req, err := http.NewRequest("PUT", "/v1/kv/test?cas=0&acquire=xxx", nil)
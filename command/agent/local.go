@@ -3,6 +3,8 @@ package agent
 import (
 	"fmt"
 	"log"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -45,18 +47,35 @@ type localState struct {
 	iface consul.Interface
 
 	// Services tracks the local services
-	services      map[string]*structs.NodeService
-	serviceStatus map[string]syncStatus
-	serviceTokens map[string]string
+	services          map[string]*structs.NodeService
+	serviceStatus     map[string]syncStatus
+	serviceTokens     map[string]string
+	servicePriorities map[string]int
 
 	// Checks tracks the local checks
 	checks      map[string]*structs.HealthCheck
 	checkStatus map[string]syncStatus
 	checkTokens map[string]string
 
+	// checkCriticalTime tracks when each critical check went critical
+	checkCriticalTime map[string]time.Time
+
 	// Used to track checks that are being deferred
 	deferCheck map[string]*time.Timer
 
+	// nodeInfoInSync tracks whether the node's tagged addresses match
+	// the catalog, since a node with no services or checks still needs
+	// to push them.
+	nodeInfoInSync bool
+
+	// remoteNode, remoteServices, and remoteChecks hold the catalog's
+	// view of this node. They're kept up to date by fetching only what
+	// changed after remoteIndex on each sync.
+	remoteIndex    uint64
+	remoteNode     *structs.Node
+	remoteServices map[string]*structs.NodeService
+	remoteChecks   map[string]*structs.HealthCheck
+
 	// consulCh is used to inform of a change to the known
 	// consul nodes. This may be used to retry a sync run
 	consulCh chan struct{}
@@ -64,6 +83,10 @@ type localState struct {
 	// triggerCh is used to inform of a change to local state
 	// that requires anti-entropy with the server
 	triggerCh chan struct{}
+
+	// webhooks is told about check status changes, if any check
+	// webhooks are configured
+	webhooks *checkWebhookNotifier
 }
 
 // Init is used to initialize the local state
@@ -73,9 +96,11 @@ func (l *localState) Init(config *Config, logger *log.Logger) {
 	l.services = make(map[string]*structs.NodeService)
 	l.serviceStatus = make(map[string]syncStatus)
 	l.serviceTokens = make(map[string]string)
+	l.servicePriorities = make(map[string]int)
 	l.checks = make(map[string]*structs.HealthCheck)
 	l.checkStatus = make(map[string]syncStatus)
 	l.checkTokens = make(map[string]string)
+	l.checkCriticalTime = make(map[string]time.Time)
 	l.deferCheck = make(map[string]*time.Timer)
 	l.consulCh = make(chan struct{}, 1)
 	l.triggerCh = make(chan struct{}, 1)
@@ -142,6 +167,27 @@ func (l *localState) serviceToken(id string) string {
 	return token
 }
 
+// ServicePriority returns the sync priority of the given service ID.
+func (l *localState) ServicePriority(id string) int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.servicePriorities[id]
+}
+
+// SetServicePriority sets the sync priority of a service. Services with
+// a higher priority are synced first, which matters when there is a large
+// backlog to work through, such as after a partition heals.
+func (l *localState) SetServicePriority(id string, priority int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if priority == 0 {
+		delete(l.servicePriorities, id)
+	} else {
+		l.servicePriorities[id] = priority
+	}
+}
+
 // AddService is used to add a service entry to the local state.
 // This entry is persistent and the agent will make a best effort to
 // ensure it is registered
@@ -150,6 +196,7 @@ func (l *localState) AddService(service *structs.NodeService, token string) {
 	if service.ID == "" && service.Service != "" {
 		service.ID = service.Service
 	}
+	service.Source = structs.ServiceSourceAgent
 
 	l.Lock()
 	defer l.Unlock()
@@ -168,6 +215,7 @@ func (l *localState) RemoveService(serviceID string) {
 
 	delete(l.services, serviceID)
 	delete(l.serviceTokens, serviceID)
+	delete(l.servicePriorities, serviceID)
 	l.serviceStatus[serviceID] = syncStatus{remoteDelete: true}
 	l.changeMade()
 }
@@ -215,6 +263,10 @@ func (l *localState) AddCheck(check *structs.HealthCheck, token string) {
 	l.checks[check.CheckID] = check
 	l.checkStatus[check.CheckID] = syncStatus{}
 	l.checkTokens[check.CheckID] = token
+	delete(l.checkCriticalTime, check.CheckID)
+	if check.Status == structs.HealthCritical {
+		l.checkCriticalTime[check.CheckID] = time.Now()
+	}
 	l.changeMade()
 }
 
@@ -226,6 +278,7 @@ func (l *localState) RemoveCheck(checkID string) {
 
 	delete(l.checks, checkID)
 	delete(l.checkTokens, checkID)
+	delete(l.checkCriticalTime, checkID)
 	l.checkStatus[checkID] = syncStatus{remoteDelete: true}
 	l.changeMade()
 }
@@ -240,6 +293,15 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 		return
 	}
 
+	// Track how long the check has been critical
+	if status == structs.HealthCritical {
+		if _, ok := l.checkCriticalTime[checkID]; !ok {
+			l.checkCriticalTime[checkID] = time.Now()
+		}
+	} else {
+		delete(l.checkCriticalTime, checkID)
+	}
+
 	// Do nothing if update is idempotent
 	if check.Status == status && check.Output == output {
 		return
@@ -268,10 +330,15 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 	}
 
 	// Update status and mark out of sync
+	previous := check.Status
 	check.Status = status
 	check.Output = output
 	l.checkStatus[checkID] = syncStatus{inSync: false}
 	l.changeMade()
+
+	if l.webhooks != nil && previous != status {
+		l.webhooks.Notify(check, previous)
+	}
 }
 
 // Checks returns the locally registered checks that the
@@ -287,6 +354,30 @@ func (l *localState) Checks() map[string]*structs.HealthCheck {
 	return checks
 }
 
+// CriticalCheck is used to return the duration a check has been critical,
+// along with the check itself.
+type CriticalCheck struct {
+	CriticalFor time.Duration
+	Check       *structs.HealthCheck
+}
+
+// CriticalChecks returns the locally registered checks that are currently
+// critical, and how long they have been critical for.
+func (l *localState) CriticalChecks() map[string]CriticalCheck {
+	l.RLock()
+	defer l.RUnlock()
+
+	checks := make(map[string]CriticalCheck)
+	now := time.Now()
+	for checkID, criticalTime := range l.checkCriticalTime {
+		checks[checkID] = CriticalCheck{
+			CriticalFor: now.Sub(criticalTime),
+			Check:       l.checks[checkID],
+		}
+	}
+	return checks
+}
+
 // antiEntropy is a long running method used to perform anti-entropy
 // between local and remote state.
 func (l *localState) antiEntropy(shutdownCh chan struct{}) {
@@ -342,28 +433,20 @@ SYNC:
 // setSyncState does a read of the server state, and updates
 // the local syncStatus as appropriate
 func (l *localState) setSyncState() error {
-	req := structs.NodeSpecificRequest{
-		Datacenter:   l.config.Datacenter,
-		Node:         l.config.NodeName,
-		QueryOptions: structs.QueryOptions{Token: l.config.ACLToken},
-	}
-	var out1 structs.IndexedNodeServices
-	var out2 structs.IndexedHealthChecks
-	if e := l.iface.RPC("Catalog.NodeServices", &req, &out1); e != nil {
-		return e
-	}
-	if err := l.iface.RPC("Health.NodeChecks", &req, &out2); err != nil {
+	if err := l.updateRemoteState(); err != nil {
 		return err
 	}
-	checks := out2.HealthChecks
 
 	l.Lock()
 	defer l.Unlock()
 
-	services := make(map[string]*structs.NodeService)
-	if out1.NodeServices != nil {
-		services = out1.NodeServices.Services
-	}
+	services := l.remoteServices
+	checks := l.remoteChecks
+
+	// Check the node's own info
+	l.nodeInfoInSync = l.remoteNode != nil &&
+		l.remoteNode.ID == l.config.NodeID &&
+		reflect.DeepEqual(l.remoteNode.TaggedAddresses, l.config.TaggedAddresses)
 
 	for id, _ := range l.services {
 		// If the local service doesn't exist remotely, then sync it
@@ -384,26 +467,22 @@ func (l *localState) setSyncState() error {
 		if existing.EnableTagOverride {
 			existing.Tags = service.Tags
 		}
+		// Draining is set through the catalog, so keep whatever the
+		// servers have rather than putting the instance back into service.
+		existing.Draining = service.Draining
 		equal := existing.IsSame(service)
 		l.serviceStatus[id] = syncStatus{inSync: equal}
 	}
 
-	// Index the remote health checks to improve efficiency
-	checkIndex := make(map[string]*structs.HealthCheck, len(checks))
-	for _, check := range checks {
-		checkIndex[check.CheckID] = check
-	}
-
 	// Sync any check which doesn't exist on the remote side
 	for id, _ := range l.checks {
-		if _, ok := checkIndex[id]; !ok {
+		if _, ok := checks[id]; !ok {
 			l.checkStatus[id] = syncStatus{inSync: false}
 		}
 	}
 
-	for _, check := range checks {
+	for id, check := range checks {
 		// If we don't have the check locally, deregister it
-		id := check.CheckID
 		existing, ok := l.checks[id]
 		if !ok {
 			// The Serf check is created automatically, and does not
@@ -423,8 +502,10 @@ func (l *localState) setSyncState() error {
 			eCopy := new(structs.HealthCheck)
 			*eCopy = *existing
 			eCopy.Output = ""
-			check.Output = ""
-			equal = eCopy.IsSame(check)
+			cCopy := new(structs.HealthCheck)
+			*cCopy = *check
+			cCopy.Output = ""
+			equal = eCopy.IsSame(cCopy)
 		}
 
 		// Update the status
@@ -433,14 +514,103 @@ func (l *localState) setSyncState() error {
 	return nil
 }
 
+// updateRemoteState brings the cached catalog view of this node up to
+// date, fetching only what changed since the last sync. Servers that don't
+// support that get asked for everything instead.
+func (l *localState) updateRemoteState() error {
+	req := structs.NodeDeltaRequest{
+		Datacenter:   l.config.Datacenter,
+		Node:         l.config.NodeName,
+		Since:        l.remoteIndex,
+		QueryOptions: structs.QueryOptions{Token: l.config.ACLToken},
+	}
+	var out structs.IndexedNodeDelta
+	if err := l.iface.RPC("Catalog.NodeDelta", &req, &out); err != nil {
+		if !strings.Contains(err.Error(), "can't find method") {
+			return err
+		}
+		return l.fetchRemoteState()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	delta := out.NodeDelta
+	if delta.Reset || l.remoteServices == nil {
+		l.remoteServices = make(map[string]*structs.NodeService)
+		l.remoteChecks = make(map[string]*structs.HealthCheck)
+	}
+	l.remoteNode = delta.Node
+	for _, service := range delta.Services {
+		l.remoteServices[service.ID] = service
+	}
+	for _, id := range delta.DeletedServices {
+		delete(l.remoteServices, id)
+	}
+	for _, check := range delta.Checks {
+		l.remoteChecks[check.CheckID] = check
+	}
+	for _, id := range delta.DeletedChecks {
+		delete(l.remoteChecks, id)
+	}
+	l.remoteIndex = out.Index
+	return nil
+}
+
+// fetchRemoteState reads everything registered on this node from the
+// catalog, replacing the cached view of it.
+func (l *localState) fetchRemoteState() error {
+	req := structs.NodeSpecificRequest{
+		Datacenter:   l.config.Datacenter,
+		Node:         l.config.NodeName,
+		QueryOptions: structs.QueryOptions{Token: l.config.ACLToken},
+	}
+	var out1 structs.IndexedNodeServices
+	var out2 structs.IndexedHealthChecks
+	if e := l.iface.RPC("Catalog.NodeServices", &req, &out1); e != nil {
+		return e
+	}
+	if err := l.iface.RPC("Health.NodeChecks", &req, &out2); err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.remoteNode = nil
+	l.remoteServices = make(map[string]*structs.NodeService)
+	if out1.NodeServices != nil {
+		l.remoteNode = out1.NodeServices.Node
+		for id, service := range out1.NodeServices.Services {
+			l.remoteServices[id] = service
+		}
+	}
+	l.remoteChecks = make(map[string]*structs.HealthCheck)
+	for _, check := range out2.HealthChecks {
+		l.remoteChecks[check.CheckID] = check
+	}
+	l.remoteIndex = 0
+	return nil
+}
+
 // syncChanges is used to scan the status our local services and checks
 // and update any that are out of sync with the server
 func (l *localState) syncChanges() error {
 	l.Lock()
 	defer l.Unlock()
 
-	// Sync the services
-	for id, status := range l.serviceStatus {
+	// Sync the node's addresses before anything else
+	if !l.nodeInfoInSync {
+		if err := l.syncNodeInfo(); err != nil {
+			return err
+		}
+	} else {
+		l.logger.Printf("[DEBUG] agent: Node info in sync")
+	}
+
+	// Sync the services, highest priority first
+	for _, id := range l.servicesByPriority() {
+		status := l.serviceStatus[id]
 		if status.remoteDelete {
 			if err := l.deleteService(id); err != nil {
 				return err
@@ -454,7 +624,8 @@ func (l *localState) syncChanges() error {
 		}
 	}
 
-	// Sync the checks
+	// Sync the checks, batching up the out of sync ones
+	var pending []string
 	for id, status := range l.checkStatus {
 		if status.remoteDelete {
 			if err := l.deleteCheck(id); err != nil {
@@ -466,17 +637,95 @@ func (l *localState) syncChanges() error {
 				timer.Stop()
 				delete(l.deferCheck, id)
 			}
+			pending = append(pending, id)
+		} else {
+			l.logger.Printf("[DEBUG] agent: Check '%s' in sync", id)
+		}
+	}
+	return l.syncChecks(pending)
+}
+
+// syncChecks is used to sync a set of checks to the server. Checks that
+// share a token are sent in one batch, and if a batch fails we fall back
+// to syncing its checks one by one so each failure is handled on its own.
+func (l *localState) syncChecks(ids []string) error {
+	byToken := make(map[string][]string)
+	for _, id := range ids {
+		token := l.checkToken(id)
+		byToken[token] = append(byToken[token], id)
+	}
 
+	for token, batch := range byToken {
+		if len(batch) > 1 && l.syncCheckBatch(token, batch) == nil {
+			continue
+		}
+		for _, id := range batch {
 			if err := l.syncCheck(id); err != nil {
 				return err
 			}
-		} else {
-			l.logger.Printf("[DEBUG] agent: Check '%s' in sync", id)
 		}
 	}
 	return nil
 }
 
+// syncCheckBatch is used to sync a batch of checks to the server in a
+// single Catalog.UpdateChecks call
+func (l *localState) syncCheckBatch(token string, ids []string) error {
+	req := structs.ChecksUpdateRequest{
+		Datacenter:   l.config.Datacenter,
+		Node:         l.config.NodeName,
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	for _, id := range ids {
+		req.Checks = append(req.Checks, l.checks[id])
+	}
+
+	var out struct{}
+	if err := l.iface.RPC("Catalog.UpdateChecks", &req, &out); err != nil {
+		l.logger.Printf("[DEBUG] agent: Batch check sync failed, syncing one by one: %v", err)
+		return err
+	}
+	for _, id := range ids {
+		l.checkStatus[id] = syncStatus{inSync: true}
+	}
+	l.logger.Printf("[INFO] agent: Synced %d checks", len(ids))
+	return nil
+}
+
+// servicesByPriority returns the IDs of the services we track the sync
+// status of, ordered by descending sync priority. Ties are broken by ID
+// so the order is stable.
+func (l *localState) servicesByPriority() []string {
+	ids := make([]string, 0, len(l.serviceStatus))
+	for id := range l.serviceStatus {
+		ids = append(ids, id)
+	}
+	sort.Sort(&servicePrioritySorter{ids, l.servicePriorities})
+	return ids
+}
+
+// servicePrioritySorter sorts service IDs by descending priority
+type servicePrioritySorter struct {
+	ids        []string
+	priorities map[string]int
+}
+
+func (s *servicePrioritySorter) Len() int {
+	return len(s.ids)
+}
+
+func (s *servicePrioritySorter) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+}
+
+func (s *servicePrioritySorter) Less(i, j int) bool {
+	pi, pj := s.priorities[s.ids[i]], s.priorities[s.ids[j]]
+	if pi != pj {
+		return pi > pj
+	}
+	return s.ids[i] < s.ids[j]
+}
+
 // deleteService is used to delete a service from the server
 func (l *localState) deleteService(id string) error {
 	if id == "" {
@@ -519,14 +768,40 @@ func (l *localState) deleteCheck(id string) error {
 	return err
 }
 
+// syncNodeInfo is used to sync the node's addresses to the server
+func (l *localState) syncNodeInfo() error {
+	req := structs.RegisterRequest{
+		Datacenter:      l.config.Datacenter,
+		ID:              l.config.NodeID,
+		Node:            l.config.NodeName,
+		Address:         l.config.AdvertiseAddr,
+		TaggedAddresses: l.config.TaggedAddresses,
+		WriteRequest:    structs.WriteRequest{Token: l.config.ACLToken},
+	}
+	var out struct{}
+	err := l.iface.RPC("Catalog.Register", &req, &out)
+	if err == nil {
+		l.nodeInfoInSync = true
+		l.logger.Printf("[INFO] agent: Synced node info")
+	} else if strings.Contains(err.Error(), permissionDenied) {
+		l.nodeInfoInSync = true
+		l.logger.Printf("[WARN] agent: Node info update blocked by ACLs")
+		return nil
+	}
+	return err
+}
+
 // syncService is used to sync a service to the server
 func (l *localState) syncService(id string) error {
 	req := structs.RegisterRequest{
-		Datacenter:   l.config.Datacenter,
-		Node:         l.config.NodeName,
-		Address:      l.config.AdvertiseAddr,
-		Service:      l.services[id],
-		WriteRequest: structs.WriteRequest{Token: l.serviceToken(id)},
+		Datacenter:      l.config.Datacenter,
+		ID:              l.config.NodeID,
+		Node:            l.config.NodeName,
+		Address:         l.config.AdvertiseAddr,
+		TaggedAddresses: l.config.TaggedAddresses,
+		Service:         l.services[id],
+		SkipNodeUpdate:  l.nodeInfoInSync,
+		WriteRequest:    structs.WriteRequest{Token: l.serviceToken(id)},
 	}
 
 	// If the service has associated checks that are out of sync,
@@ -579,12 +854,15 @@ func (l *localState) syncCheck(id string) error {
 	}
 
 	req := structs.RegisterRequest{
-		Datacenter:   l.config.Datacenter,
-		Node:         l.config.NodeName,
-		Address:      l.config.AdvertiseAddr,
-		Service:      service,
-		Check:        l.checks[id],
-		WriteRequest: structs.WriteRequest{Token: l.checkToken(id)},
+		Datacenter:      l.config.Datacenter,
+		ID:              l.config.NodeID,
+		Node:            l.config.NodeName,
+		Address:         l.config.AdvertiseAddr,
+		TaggedAddresses: l.config.TaggedAddresses,
+		Service:         service,
+		Check:           l.checks[id],
+		SkipNodeUpdate:  l.nodeInfoInSync,
+		WriteRequest:    structs.WriteRequest{Token: l.checkToken(id)},
 	}
 	var out struct{}
 	err := l.iface.RPC("Catalog.Register", &req, &out)
@@ -128,6 +128,10 @@ func TestAgentAntiEntropy_Services(t *testing.T) {
 	// All the services should match
 	for id, serv := range services.NodeServices.Services {
 		serv.CreateIndex, serv.ModifyIndex = 0, 0
+		if serv.RegisteredAt.IsZero() {
+			t.Fatalf("missing registration time: %v", serv)
+		}
+		serv.RegisteredAt = time.Time{}
 		switch id {
 		case "mysql":
 			if !reflect.DeepEqual(serv, srv1) {
@@ -267,6 +271,58 @@ func TestAgentAntiEntropy_EnableTagOverride(t *testing.T) {
 	}
 }
 
+func TestAgentAntiEntropy_Draining(t *testing.T) {
+	conf := nextConfig()
+	dir, agent := makeAgent(t, conf)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	testutil.WaitForLeader(t, agent.RPC, "dc1")
+
+	srv := &structs.NodeService{
+		ID:      "api",
+		Service: "api",
+		Port:    6100,
+	}
+	agent.state.AddService(srv, "")
+
+	// The catalog has the service draining, with a stale port.
+	remote := *srv
+	remote.Port = 7100
+	remote.Draining = true
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       agent.config.NodeName,
+		Address:    "127.0.0.1",
+		Service:    &remote,
+	}
+	var out struct{}
+	if err := agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Trigger anti-entropy run and wait
+	agent.StartSync()
+	time.Sleep(200 * time.Millisecond)
+
+	// The port is fixed, but the service is still draining.
+	req := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       agent.config.NodeName,
+	}
+	var services structs.IndexedNodeServices
+	if err := agent.RPC("Catalog.NodeServices", &req, &services); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv := services.NodeServices.Services["api"]
+	if serv == nil || serv.Port != 6100 || !serv.Draining {
+		t.Fatalf("bad: %v", serv)
+	}
+	if status := agent.state.serviceStatus["api"]; !status.inSync {
+		t.Fatalf("should be in sync: %v", status)
+	}
+}
+
 func TestAgentAntiEntropy_Services_WithChecks(t *testing.T) {
 	conf := nextConfig()
 	dir, agent := makeAgent(t, conf)
@@ -464,6 +520,10 @@ func TestAgentAntiEntropy_Services_ACLDeny(t *testing.T) {
 	// All the services should match
 	for id, serv := range services.NodeServices.Services {
 		serv.CreateIndex, serv.ModifyIndex = 0, 0
+		if serv.RegisteredAt.IsZero() {
+			t.Fatalf("missing registration time: %v", serv)
+		}
+		serv.RegisteredAt = time.Time{}
 		switch id {
 		case "mysql":
 			t.Fatalf("should not be permitted")
@@ -708,6 +768,112 @@ func TestAgentAntiEntropy_Check_DeferSync(t *testing.T) {
 	})
 }
 
+func TestAgentAntiEntropy_NodeInfo(t *testing.T) {
+	conf := nextConfig()
+	conf.TaggedAddresses = map[string]string{"public": "198.18.0.1"}
+	dir, agent := makeAgent(t, conf)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	testutil.WaitForLeader(t, agent.RPC, "dc1")
+
+	// Trigger anti-entropy run and wait
+	agent.StartSync()
+	time.Sleep(200 * time.Millisecond)
+
+	// The node should have its tagged addresses, even with no services
+	req := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       agent.config.NodeName,
+	}
+	var services structs.IndexedNodeServices
+	if err := agent.RPC("Catalog.NodeServices", &req, &services); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]string{
+		"lan":    agent.config.AdvertiseAddr,
+		"wan":    agent.config.AdvertiseAddrWan,
+		"public": "198.18.0.1",
+	}
+	if services.NodeServices == nil ||
+		!reflect.DeepEqual(services.NodeServices.Node.TaggedAddresses, expected) {
+		t.Fatalf("bad: %v", services.NodeServices)
+	}
+	if !agent.state.nodeInfoInSync {
+		t.Fatalf("should be in sync")
+	}
+}
+
+func TestAgentAntiEntropy_RemoteDelta(t *testing.T) {
+	conf := nextConfig()
+	dir, agent := makeAgent(t, conf)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	testutil.WaitForLeader(t, agent.RPC, "dc1")
+
+	// The first pass reads everything and pushes the local service.
+	srv := &structs.NodeService{
+		ID:      "mysql",
+		Service: "mysql",
+		Port:    5000,
+	}
+	agent.state.AddService(srv, "")
+	if err := agent.state.setSyncState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := agent.state.syncChanges(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	index := agent.state.remoteIndex
+	if index == 0 {
+		t.Fatalf("bad index")
+	}
+
+	// Register a service behind the agent's back.
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       agent.config.NodeName,
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "rogue",
+			Service: "rogue",
+		},
+	}
+	var out struct{}
+	if err := agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The next pass picks up the changes on top of what it had.
+	if err := agent.state.setSyncState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if agent.state.remoteIndex <= index {
+		t.Fatalf("bad index: %d", agent.state.remoteIndex)
+	}
+	if _, ok := agent.state.remoteServices["mysql"]; !ok {
+		t.Fatalf("bad: %v", agent.state.remoteServices)
+	}
+	if !agent.state.serviceStatus["mysql"].inSync {
+		t.Fatalf("mysql should be in sync")
+	}
+	if !agent.state.serviceStatus["rogue"].remoteDelete {
+		t.Fatalf("rogue should be deleted")
+	}
+
+	// Removing it shows up as a delete.
+	if err := agent.state.syncChanges(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := agent.state.setSyncState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := agent.state.remoteServices["rogue"]; ok {
+		t.Fatalf("bad: %v", agent.state.remoteServices)
+	}
+}
+
 func TestAgentAntiEntropy_deleteService_fails(t *testing.T) {
 	l := new(localState)
 	if err := l.deleteService(""); err == nil {
@@ -746,6 +912,30 @@ func TestAgent_serviceTokens(t *testing.T) {
 	}
 }
 
+func TestAgent_servicePriorities(t *testing.T) {
+	config := nextConfig()
+	l := new(localState)
+	l.Init(config, nil)
+
+	for _, id := range []string{"web", "db", "cache", "api"} {
+		l.AddService(&structs.NodeService{ID: id, Service: id}, "")
+	}
+	l.SetServicePriority("db", 10)
+	l.SetServicePriority("api", 5)
+
+	// Higher priorities come first, ties are sorted by ID
+	expected := []string{"db", "api", "cache", "web"}
+	if ids := l.servicesByPriority(); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("bad: %v", ids)
+	}
+
+	// Removing the service clears its priority
+	l.RemoveService("db")
+	if p := l.ServicePriority("db"); p != 0 {
+		t.Fatalf("bad: %d", p)
+	}
+}
+
 func TestAgent_checkTokens(t *testing.T) {
 	config := nextConfig()
 	config.ACLToken = "default"
@@ -770,6 +960,64 @@ func TestAgent_checkTokens(t *testing.T) {
 	}
 }
 
+func TestAgent_checkCriticalTime(t *testing.T) {
+	config := nextConfig()
+	l := new(localState)
+	l.Init(config, nil)
+
+	// Add a passing check and make sure it's not critical.
+	checkID := "redis:1"
+	chk := &structs.HealthCheck{
+		Node:      "node",
+		CheckID:   checkID,
+		Name:      "redis:1",
+		ServiceID: "redis",
+		Status:    structs.HealthPassing,
+	}
+	l.AddCheck(chk, "")
+	if checks := l.CriticalChecks(); len(checks) > 0 {
+		t.Fatalf("should not have any critical checks")
+	}
+
+	// Set it to warning and make sure that doesn't show up as critical.
+	l.UpdateCheck(checkID, structs.HealthWarning, "")
+	if checks := l.CriticalChecks(); len(checks) > 0 {
+		t.Fatalf("should not have any critical checks")
+	}
+
+	// Fail the check and make sure the time looks reasonable.
+	l.UpdateCheck(checkID, structs.HealthCritical, "")
+	if crit, ok := l.CriticalChecks()[checkID]; !ok {
+		t.Fatalf("should have a critical check")
+	} else if crit.CriticalFor > time.Millisecond {
+		t.Fatalf("bad: %#v", crit)
+	}
+
+	// Wait a while, then fail it again and make sure the time keeps track
+	// of the initial failure, and doesn't reset here.
+	time.Sleep(10 * time.Millisecond)
+	l.UpdateCheck(chk.CheckID, structs.HealthCritical, "")
+	if crit, ok := l.CriticalChecks()[checkID]; !ok {
+		t.Fatalf("should have a critical check")
+	} else if crit.CriticalFor < 5*time.Millisecond ||
+		crit.CriticalFor > 15*time.Millisecond {
+		t.Fatalf("bad: %#v", crit)
+	}
+
+	// Set it passing again.
+	l.UpdateCheck(checkID, structs.HealthPassing, "")
+	if checks := l.CriticalChecks(); len(checks) > 0 {
+		t.Fatalf("should not have any critical checks")
+	}
+
+	// Removing a critical check clears it too.
+	l.UpdateCheck(checkID, structs.HealthCritical, "")
+	l.RemoveCheck(checkID)
+	if checks := l.CriticalChecks(); len(checks) > 0 {
+		t.Fatalf("should not have any critical checks")
+	}
+}
+
 func TestAgent_nestedPauseResume(t *testing.T) {
 	l := new(localState)
 	if l.isPaused() != false {
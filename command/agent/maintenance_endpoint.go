@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// maintenanceWindowResponse is used to wrap the maintenance window ID
+type maintenanceWindowResponse struct {
+	ID string
+}
+
+// MaintenanceWindow is used to create, update, read or delete a single
+// maintenance window
+func (s *HTTPServer) MaintenanceWindow(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/maintenance/window")
+	id = strings.TrimPrefix(id, "/")
+
+	switch req.Method {
+	case "PUT":
+		return s.maintenanceWindowSet(resp, req, id)
+	case "GET":
+		return s.maintenanceWindowGet(resp, req, id)
+	case "DELETE":
+		return s.maintenanceWindowDelete(resp, req, id)
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+func (s *HTTPServer) maintenanceWindowSet(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.MaintenanceWindowRequest{
+		Op: structs.MaintenanceWindowSet,
+	}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	if err := decodeBody(req, &args.Window, FixupMaintenanceWindow); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+	if id != "" {
+		args.Window.ID = id
+	}
+
+	var out string
+	if err := s.agent.RPC("Maintenance.Apply", &args, &out); err != nil {
+		return nil, err
+	}
+	return maintenanceWindowResponse{out}, nil
+}
+
+func (s *HTTPServer) maintenanceWindowGet(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.MaintenanceWindowSpecificRequest{
+		WindowID: id,
+	}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	if args.WindowID == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing maintenance window ID"))
+		return nil, nil
+	}
+
+	var out structs.IndexedMaintenanceWindows
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Maintenance.Get", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Windows, nil
+}
+
+func (s *HTTPServer) maintenanceWindowDelete(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.MaintenanceWindowRequest{
+		Op: structs.MaintenanceWindowDelete,
+	}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	args.Window.ID = id
+	if args.Window.ID == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing maintenance window ID"))
+		return nil, nil
+	}
+
+	var out string
+	if err := s.agent.RPC("Maintenance.Apply", &args, &out); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// MaintenanceWindowList is used to list all the maintenance windows
+func (s *HTTPServer) MaintenanceWindowList(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedMaintenanceWindows
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Maintenance.List", &args, &out); err != nil {
+		return nil, err
+	}
+
+	// Use empty list instead of nil
+	if out.Windows == nil {
+		out.Windows = make(structs.MaintenanceWindows, 0)
+	}
+	return out.Windows, nil
+}
+
+// FixupMaintenanceWindow is used to handle parsing the JSON body of a
+// maintenance window, turning the RFC 3339 start and end times and the
+// recurrence duration string into their Go types.
+func FixupMaintenanceWindow(raw interface{}) error {
+	rawMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for k, v := range rawMap {
+		vStr, ok := v.(string)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "start", "end":
+			t, err := time.Parse(time.RFC3339, vStr)
+			if err != nil {
+				return err
+			}
+			rawMap[k] = t
+		case "recurrence":
+			dur, err := time.ParseDuration(vStr)
+			if err != nil {
+				return err
+			}
+			rawMap[k] = dur
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestMaintenanceWindow_CRUD(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		body := bytes.NewBuffer(nil)
+		enc := json.NewEncoder(body)
+		raw := map[string]interface{}{
+			"Node":       srv.agent.config.NodeName,
+			"Start":      "2016-01-01T02:00:00Z",
+			"End":        "2016-01-01T03:00:00Z",
+			"Recurrence": "24h",
+			"Reason":     "kernel upgrade",
+		}
+		enc.Encode(raw)
+
+		req, err := http.NewRequest("PUT", "/v1/maintenance/window", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.MaintenanceWindow(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		id := obj.(maintenanceWindowResponse).ID
+		if id == "" {
+			t.Fatalf("bad: %v", obj)
+		}
+
+		// Read it back
+		req, err = http.NewRequest("GET", "/v1/maintenance/window/"+id, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.MaintenanceWindow(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		windows := obj.(structs.MaintenanceWindows)
+		if len(windows) != 1 {
+			t.Fatalf("bad: %v", windows)
+		}
+		w := windows[0]
+		start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+		if w.ID != id || !w.Start.Equal(start) || !w.End.Equal(start.Add(time.Hour)) ||
+			w.Recurrence != 24*time.Hour || w.Reason != "kernel upgrade" {
+			t.Fatalf("bad: %v", w)
+		}
+
+		// List them all
+		req, err = http.NewRequest("GET", "/v1/maintenance/windows", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.MaintenanceWindowList(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		if windows := obj.(structs.MaintenanceWindows); len(windows) != 1 {
+			t.Fatalf("bad: %v", windows)
+		}
+
+		// Delete it
+		req, err = http.NewRequest("DELETE", "/v1/maintenance/window/"+id, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.MaintenanceWindow(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The list is empty, not nil
+		req, err = http.NewRequest("GET", "/v1/maintenance/windows", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.MaintenanceWindowList(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if windows := obj.(structs.MaintenanceWindows); windows == nil || len(windows) != 0 {
+			t.Fatalf("bad: %v", windows)
+		}
+	})
+}
+
+func TestMaintenanceWindow_BadRequest(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		// Bad recurrence
+		body := bytes.NewBufferString(`{"Node": "foo", "Recurrence": "daily"}`)
+		req, err := http.NewRequest("PUT", "/v1/maintenance/window", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		if _, err := srv.MaintenanceWindow(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad code: %d", resp.Code)
+		}
+
+		// Missing ID
+		req, err = http.NewRequest("DELETE", "/v1/maintenance/window", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.MaintenanceWindow(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad code: %d", resp.Code)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// managedCheckResponse is used to wrap the managed check ID
+type managedCheckResponse struct {
+	ID string
+}
+
+// ManagedCheck is used to create, update, read or delete a single
+// managed check
+func (s *HTTPServer) ManagedCheck(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/managed-check")
+	id = strings.TrimPrefix(id, "/")
+
+	switch req.Method {
+	case "PUT":
+		return s.managedCheckSet(resp, req, id)
+	case "GET":
+		return s.managedCheckGet(resp, req, id)
+	case "DELETE":
+		return s.managedCheckDelete(resp, req, id)
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+func (s *HTTPServer) managedCheckSet(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.ManagedCheckRequest{
+		Op: structs.ManagedCheckSet,
+	}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	if err := decodeBody(req, &args.Check, FixupCheckType); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+	if id != "" {
+		args.Check.ID = id
+	}
+
+	var out string
+	if err := s.agent.RPC("ManagedCheck.Apply", &args, &out); err != nil {
+		return nil, err
+	}
+	return managedCheckResponse{out}, nil
+}
+
+func (s *HTTPServer) managedCheckGet(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.ManagedCheckSpecificRequest{
+		CheckID: id,
+	}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	if args.CheckID == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing managed check ID"))
+		return nil, nil
+	}
+
+	var out structs.IndexedManagedChecks
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("ManagedCheck.Get", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Checks, nil
+}
+
+func (s *HTTPServer) managedCheckDelete(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.ManagedCheckRequest{
+		Op: structs.ManagedCheckDelete,
+	}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	args.Check.ID = id
+	if args.Check.ID == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing managed check ID"))
+		return nil, nil
+	}
+
+	var out string
+	if err := s.agent.RPC("ManagedCheck.Apply", &args, &out); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// ManagedCheckList is used to list all the managed checks
+func (s *HTTPServer) ManagedCheckList(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedManagedChecks
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("ManagedCheck.List", &args, &out); err != nil {
+		return nil, err
+	}
+
+	// Use empty list instead of nil
+	if out.Checks == nil {
+		out.Checks = make(structs.ManagedChecks, 0)
+	}
+	return out.Checks, nil
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestManagedCheck_CRUD(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		body := bytes.NewBuffer(nil)
+		enc := json.NewEncoder(body)
+		raw := map[string]interface{}{
+			"Name":     "disk space",
+			"NodeMeta": map[string]string{"rack": "r1"},
+			"Script":   "/usr/local/bin/check_disk",
+			"Interval": "30s",
+			"Timeout":  "5s",
+		}
+		enc.Encode(raw)
+
+		req, err := http.NewRequest("PUT", "/v1/managed-check", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.ManagedCheck(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		id := obj.(managedCheckResponse).ID
+		if id == "" {
+			t.Fatalf("bad: %v", obj)
+		}
+
+		// Read it back
+		req, err = http.NewRequest("GET", "/v1/managed-check/"+id, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.ManagedCheck(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		checks := obj.(structs.ManagedChecks)
+		if len(checks) != 1 {
+			t.Fatalf("bad: %v", checks)
+		}
+		c := checks[0]
+		if c.ID != id || c.Name != "disk space" || c.NodeMeta["rack"] != "r1" ||
+			c.Interval != 30*time.Second || c.Timeout != 5*time.Second {
+			t.Fatalf("bad: %v", c)
+		}
+
+		// List them all
+		req, err = http.NewRequest("GET", "/v1/managed-checks", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.ManagedCheckList(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		if checks := obj.(structs.ManagedChecks); len(checks) != 1 {
+			t.Fatalf("bad: %v", checks)
+		}
+
+		// Delete it
+		req, err = http.NewRequest("DELETE", "/v1/managed-check/"+id, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.ManagedCheck(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The list is empty, not nil
+		req, err = http.NewRequest("GET", "/v1/managed-checks", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.ManagedCheckList(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if checks := obj.(structs.ManagedChecks); checks == nil || len(checks) != 0 {
+			t.Fatalf("bad: %v", checks)
+		}
+	})
+}
+
+func TestManagedCheck_BadRequest(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		// Bad interval
+		body := bytes.NewBufferString(`{"Name": "disk space", "TCP": "localhost:22", "Interval": "often"}`)
+		req, err := http.NewRequest("PUT", "/v1/managed-check", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		if _, err := srv.ManagedCheck(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad code: %d", resp.Code)
+		}
+
+		// Nothing to run
+		body = bytes.NewBufferString(`{"Name": "disk space", "Interval": "30s"}`)
+		req, err = http.NewRequest("PUT", "/v1/managed-check", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.ManagedCheck(resp, req); !structs.IsValidationError(err) {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Missing ID
+		req, err = http.NewRequest("DELETE", "/v1/managed-check", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.ManagedCheck(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad code: %d", resp.Code)
+		}
+	})
+}
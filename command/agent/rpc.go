@@ -57,6 +57,8 @@ const (
 	useKeyCommand     = "use-key"
 	removeKeyCommand  = "remove-key"
 	listKeysCommand   = "list-keys"
+
+	validateConfigCommand = "validate-config"
 )
 
 const (
@@ -141,6 +143,10 @@ type keyringResponse struct {
 	Info     []KeyringInfo
 }
 
+type validateConfigRequest struct {
+	Config []byte
+}
+
 type membersResponse struct {
 	Members []Member
 }
@@ -410,6 +416,9 @@ func (i *AgentRPC) handleRequest(client *rpcClient, reqHeader *requestHeader) er
 	case installKeyCommand, useKeyCommand, removeKeyCommand, listKeysCommand:
 		return i.handleKeyring(client, seq, command, token)
 
+	case validateConfigCommand:
+		return i.handleValidateConfig(client, seq)
+
 	default:
 		respHeader := responseHeader{Seq: seq, Error: unsupportedCommand}
 		client.Send(&respHeader, nil)
@@ -620,6 +629,21 @@ func (i *AgentRPC) handleReload(client *rpcClient, seq uint64) error {
 	return client.Send(&resp, nil)
 }
 
+// handleValidateConfig checks a candidate config file without applying it
+func (i *AgentRPC) handleValidateConfig(client *rpcClient, seq uint64) error {
+	var req validateConfigRequest
+	if err := client.dec.Decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+	resp := i.agent.ValidateConfig(req.Config)
+	return client.Send(&header, resp)
+}
+
 func (i *AgentRPC) handleKeyring(client *rpcClient, seq uint64, cmd, token string) error {
 	var req keyringRequest
 	var queryResp *structs.KeyringResponses
@@ -265,6 +265,22 @@ func (c *RPCClient) Reload() error {
 	return c.genericRPC(&header, nil, nil)
 }
 
+// ValidateConfig is used to check a candidate JSON config file against
+// the agent without applying it
+func (c *RPCClient) ValidateConfig(config []byte) (*ConfigValidation, error) {
+	header := requestHeader{
+		Command: validateConfigCommand,
+		Seq:     c.getSeq(),
+	}
+	req := validateConfigRequest{
+		Config: config,
+	}
+	var resp ConfigValidation
+
+	err := c.genericRPC(&header, &req, &resp)
+	return &resp, err
+}
+
 type monitorHandler struct {
 	client *RPCClient
 	closed bool
@@ -248,6 +248,22 @@ func TestRPCClientStats(t *testing.T) {
 	}
 }
 
+func TestRPCClientValidateConfig(t *testing.T) {
+	p1 := testRPCClient(t)
+	defer p1.Close()
+
+	v, err := p1.client.ValidateConfig([]byte(`{"server": true, "bootstrap_expect": 3, "bootstrap": true}`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(v.Errors) != 2 || !strings.Contains(v.Errors[1], "expected server count") {
+		t.Fatalf("bad: %#v", v)
+	}
+	if len(v.Warnings) == 0 {
+		t.Fatalf("bad: %#v", v)
+	}
+}
+
 func TestRPCClientLeave(t *testing.T) {
 	p1 := testRPCClient(t)
 	defer p1.Close()
@@ -2,6 +2,8 @@ package agent
 
 import (
 	"net/http"
+
+	"github.com/hashicorp/consul/consul/structs"
 )
 
 func (s *HTTPServer) StatusLeader(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
@@ -19,3 +21,23 @@ func (s *HTTPServer) StatusPeers(resp http.ResponseWriter, req *http.Request) (i
 	}
 	return out, nil
 }
+
+// StatusReady reports the readiness of the local server. It returns a 503
+// when the server isn't ready so load balancers can use it directly.
+func (s *HTTPServer) StatusReady(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Client agents would just report on whichever server answered.
+	if s.agent.server == nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Readiness is only available on servers"))
+		return nil, nil
+	}
+
+	var out structs.ServerReadiness
+	if err := s.agent.RPC("Status.Readiness", struct{}{}, &out); err != nil {
+		return nil, err
+	}
+	if !out.Ready {
+		resp.WriteHeader(503)
+	}
+	return out, nil
+}
@@ -1,7 +1,10 @@
 package agent
 
 import (
+	"fmt"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
+	"net/http/httptest"
 	"os"
 	"testing"
 )
@@ -40,3 +43,30 @@ func TestStatusPeers(t *testing.T) {
 		t.Fatalf("bad peers: %v", peers)
 	}
 }
+
+func TestStatusReady(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	testutil.WaitForResult(func() (bool, error) {
+		resp := httptest.NewRecorder()
+		obj, err := srv.StatusReady(resp, nil)
+		if err != nil {
+			return false, err
+		}
+		out := obj.(structs.ServerReadiness)
+		if !out.Ready || out.Status != structs.ReadinessReady {
+			return false, fmt.Errorf("not ready: %#v", out)
+		}
+		if resp.Code != 200 {
+			return false, fmt.Errorf("bad code: %d", resp.Code)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
@@ -15,6 +15,12 @@ type ServiceDefinition struct {
 	Checks            CheckTypes
 	Token             string
 	EnableTagOverride bool
+	SyncPriority      int
+	CacheMaxAge       int
+	DNSTTL            int
+	Weights           *structs.Weights
+	Meta              map[string]string
+	TaggedAddresses   map[string]string
 }
 
 func (s *ServiceDefinition) NodeService() *structs.NodeService {
@@ -25,6 +31,11 @@ func (s *ServiceDefinition) NodeService() *structs.NodeService {
 		Address:           s.Address,
 		Port:              s.Port,
 		EnableTagOverride: s.EnableTagOverride,
+		CacheMaxAge:       s.CacheMaxAge,
+		DNSTTL:            s.DNSTTL,
+		Weights:           s.Weights,
+		Meta:              s.Meta,
+		TaggedAddresses:   s.TaggedAddresses,
 	}
 	if ns.ID == "" && ns.Service != "" {
 		ns.ID = ns.Service
@@ -55,12 +66,13 @@ type CheckDefinition struct {
 
 func (c *CheckDefinition) HealthCheck(node string) *structs.HealthCheck {
 	health := &structs.HealthCheck{
-		Node:      node,
-		CheckID:   c.ID,
-		Name:      c.Name,
-		Status:    structs.HealthCritical,
-		Notes:     c.Notes,
-		ServiceID: c.ServiceID,
+		Node:          node,
+		CheckID:       c.ID,
+		Name:          c.Name,
+		Status:        structs.HealthCritical,
+		Notes:         c.Notes,
+		ServiceID:     c.ServiceID,
+		Informational: c.Informational,
 	}
 	if c.Status != "" {
 		health.Status = c.Status
@@ -74,6 +86,7 @@ func (c *CheckDefinition) HealthCheck(node string) *structs.HealthCheck {
 // persistedService is used to wrap a service definition and bundle it
 // with an ACL token so we can restore both at a later agent start.
 type persistedService struct {
-	Token   string
-	Service *structs.NodeService
+	Token    string
+	Priority int
+	Service  *structs.NodeService
 }
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// translateAddress returns the address to hand out for a node or service in
+// the given datacenter. Results from a remote datacenter use the "wan" tagged
+// address when there is one, since the LAN address usually can't be reached
+// from here.
+func (a *Agent) translateAddress(dc, addr string, tagged map[string]string) string {
+	if dc != a.config.Datacenter {
+		if wan := tagged[structs.TaggedAddressWAN]; wan != "" {
+			return wan
+		}
+	}
+	return addr
+}
+
+// translateAddresses rewrites the addresses in the results of a query against
+// the given datacenter. Nodes and services are copied before they are changed,
+// since a server agent's results may point into its state store.
+func (a *Agent) translateAddresses(dc string, subj interface{}) {
+	if dc == a.config.Datacenter {
+		return
+	}
+
+	switch v := subj.(type) {
+	case structs.Nodes:
+		for i, n := range v {
+			node := *n
+			node.Address = a.translateAddress(dc, n.Address, n.TaggedAddresses)
+			v[i] = &node
+		}
+
+	case structs.ServiceNodes:
+		for i, sn := range v {
+			service := *sn
+			service.Address = a.translateAddress(dc, sn.Address, sn.TaggedAddresses)
+			service.ServiceAddress = a.translateAddress(dc, sn.ServiceAddress, sn.ServiceTaggedAddresses)
+			v[i] = &service
+		}
+
+	case *structs.NodeServices:
+		if v == nil {
+			return
+		}
+		if v.Node != nil {
+			node := *v.Node
+			node.Address = a.translateAddress(dc, v.Node.Address, v.Node.TaggedAddresses)
+			v.Node = &node
+		}
+		services := make(map[string]*structs.NodeService, len(v.Services))
+		for id, ns := range v.Services {
+			service := *ns
+			service.Address = a.translateAddress(dc, ns.Address, ns.TaggedAddresses)
+			services[id] = &service
+		}
+		v.Services = services
+
+	case structs.CheckServiceNodes:
+		for i := range v {
+			if v[i].Node != nil {
+				node := *v[i].Node
+				node.Address = a.translateAddress(dc, node.Address, node.TaggedAddresses)
+				v[i].Node = &node
+			}
+			if v[i].Service != nil {
+				service := *v[i].Service
+				service.Address = a.translateAddress(dc, service.Address, service.TaggedAddresses)
+				v[i].Service = &service
+			}
+		}
+	}
+}
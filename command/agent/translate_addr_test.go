@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestAgent_translateAddresses(t *testing.T) {
+	agent := &Agent{config: &Config{Datacenter: "dc1"}}
+
+	node := &structs.Node{
+		Node:            "foo",
+		Address:         "10.0.0.1",
+		TaggedAddresses: map[string]string{"lan": "10.0.0.1", "wan": "198.18.0.1"},
+	}
+	service := &structs.NodeService{
+		ID:              "web",
+		Service:         "web",
+		Address:         "10.0.0.2",
+		TaggedAddresses: map[string]string{"wan": "198.18.0.2"},
+	}
+	plain := &structs.NodeService{
+		ID:      "db",
+		Service: "db",
+	}
+
+	// Local results are left alone.
+	nodes := structs.CheckServiceNodes{
+		{Node: node, Service: service},
+		{Node: node, Service: plain},
+	}
+	agent.translateAddresses("dc1", nodes)
+	if nodes[0].Node.Address != "10.0.0.1" || nodes[0].Service.Address != "10.0.0.2" {
+		t.Fatalf("bad: %#v", nodes[0])
+	}
+
+	// Remote results get the WAN addresses, without touching the originals.
+	agent.translateAddresses("dc2", nodes)
+	if nodes[0].Node.Address != "198.18.0.1" || nodes[0].Service.Address != "198.18.0.2" {
+		t.Fatalf("bad: %#v", nodes[0])
+	}
+	if nodes[1].Node.Address != "198.18.0.1" || nodes[1].Service.Address != "" {
+		t.Fatalf("bad: %#v", nodes[1])
+	}
+	if node.Address != "10.0.0.1" || service.Address != "10.0.0.2" {
+		t.Fatalf("originals changed: %#v %#v", node, service)
+	}
+
+	serviceNodes := structs.ServiceNodes{
+		service.ToServiceNode("foo", "10.0.0.1"),
+	}
+	serviceNodes[0].TaggedAddresses = node.TaggedAddresses
+	agent.translateAddresses("dc2", serviceNodes)
+	if serviceNodes[0].Address != "198.18.0.1" || serviceNodes[0].ServiceAddress != "198.18.0.2" {
+		t.Fatalf("bad: %#v", serviceNodes[0])
+	}
+
+	// Nodes without a WAN address keep their own.
+	lanOnly := structs.Nodes{
+		&structs.Node{Node: "bar", Address: "10.0.0.3"},
+	}
+	agent.translateAddresses("dc2", lanOnly)
+	if lanOnly[0].Address != "10.0.0.3" {
+		t.Fatalf("bad: %#v", lanOnly[0])
+	}
+}
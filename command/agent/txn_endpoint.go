@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// maxTxnOps is used to limit the number of operations in a single
+	// transaction, since they all go into a single Raft entry.
+	maxTxnOps = 64
+)
+
+// txnKVOp is the HTTP form of a KV operation in a transaction. Index is
+// the ModifyIndex used by the cas, delete-cas and get verbs, and Value is
+// base64 encoded.
+type txnKVOp struct {
+	Verb    structs.KVSOp
+	Key     string
+	Value   []byte
+	Flags   uint64
+	Index   uint64
+	Session string
+}
+
+// txnOp is the HTTP form of a single operation in a transaction.
+type txnOp struct {
+	KV *txnKVOp
+}
+
+// convertOps turns the HTTP form of the operations into the RPC one,
+// writing out an error and returning false if they aren't valid.
+func convertOps(resp http.ResponseWriter, ops []*txnOp) (structs.TxnOps, bool) {
+	if len(ops) > maxTxnOps {
+		resp.WriteHeader(413)
+		resp.Write([]byte(fmt.Sprintf("Transaction contains too many operations (%d > %d)", len(ops), maxTxnOps)))
+		return nil, false
+	}
+
+	var out structs.TxnOps
+	for i, op := range ops {
+		if op == nil || op.KV == nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Operation %d has no KV operation", i)))
+			return nil, false
+		}
+		if len(op.KV.Value) > maxKVSize {
+			resp.WriteHeader(413)
+			resp.Write([]byte(fmt.Sprintf("Value for key %q exceeds %d byte limit", op.KV.Key, maxKVSize)))
+			return nil, false
+		}
+		out = append(out, &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: op.KV.Verb,
+				DirEnt: structs.DirEntry{
+					Key:     op.KV.Key,
+					Value:   op.KV.Value,
+					Flags:   op.KV.Flags,
+					Session: op.KV.Session,
+					RaftIndex: structs.RaftIndex{
+						ModifyIndex: op.KV.Index,
+					},
+				},
+			},
+		})
+	}
+	return out, true
+}
+
+// Txn handles requests to apply several operations atomically. A 409 is
+// returned along with the errors if the transaction is rolled back.
+func (s *HTTPServer) Txn(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.TxnRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	var ops []*txnOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Failed to parse body: %v", err)))
+		return nil, nil
+	}
+	var ok bool
+	if args.Ops, ok = convertOps(resp, ops); !ok {
+		return nil, nil
+	}
+
+	var out structs.TxnResponse
+	if err := s.agent.RPC("Txn.Apply", &args, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Errors) > 0 {
+		resp.WriteHeader(409)
+	} else {
+		setIndex(resp, out.Index)
+	}
+	return out, nil
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestTxnEndpoint_Bad_JSON(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		buf := bytes.NewBuffer([]byte("{"))
+		req, err := http.NewRequest("PUT", "/v1/txn", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		if _, err := srv.Txn(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("expected 400, got %d", resp.Code)
+		}
+	})
+}
+
+func TestTxnEndpoint_Bad_Size(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		var ops []string
+		for i := 0; i < maxTxnOps+1; i++ {
+			ops = append(ops, fmt.Sprintf(`{"KV": {"Verb": "set", "Key": "key%d"}}`, i))
+		}
+		buf := bytes.NewBuffer([]byte("[" + strings.Join(ops, ",") + "]"))
+		req, err := http.NewRequest("PUT", "/v1/txn", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		if _, err := srv.Txn(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 413 {
+			t.Fatalf("expected 413, got %d", resp.Code)
+		}
+	})
+}
+
+func TestTxnEndpoint_KV(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		// "dGVzdA==" is "test"
+		buf := bytes.NewBuffer([]byte(`
+[
+    {
+        "KV": {
+            "Verb": "set",
+            "Key": "key",
+            "Value": "dGVzdA==",
+            "Flags": 23
+        }
+    },
+    {
+        "KV": {
+            "Verb": "cas",
+            "Key": "other",
+            "Value": "dGVzdA==",
+            "Index": 0
+        }
+    }
+]
+`))
+		req, err := http.NewRequest("PUT", "/v1/txn", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.Txn(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 200 {
+			t.Fatalf("expected 200, got %d", resp.Code)
+		}
+		assertIndex(t, resp)
+		out := obj.(structs.TxnResponse)
+		if len(out.Errors) != 0 || len(out.Results) != 2 {
+			t.Fatalf("bad: %#v", out)
+		}
+		if kv := out.Results[0].KV; kv.Key != "key" || kv.Flags != 23 {
+			t.Fatalf("bad: %v", kv)
+		}
+
+		// Read both keys back, checking one of them hasn't changed
+		// since the first transaction.
+		buf = bytes.NewBuffer([]byte(fmt.Sprintf(`
+[
+    {"KV": {"Verb": "get", "Key": "key", "Index": %d}},
+    {"KV": {"Verb": "get", "Key": "other"}}
+]
+`, out.Index)))
+		req, err = http.NewRequest("PUT", "/v1/txn", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.Txn(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 200 {
+			t.Fatalf("expected 200, got %d", resp.Code)
+		}
+		out = obj.(structs.TxnResponse)
+		if len(out.Results) != 2 ||
+			string(out.Results[0].KV.Value) != "test" ||
+			string(out.Results[1].KV.Value) != "test" {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		// Repeating the CAS conflicts.
+		buf = bytes.NewBuffer([]byte(`
+[
+    {"KV": {"Verb": "delete", "Key": "key"}},
+    {"KV": {"Verb": "cas", "Key": "other", "Value": "dGVzdA==", "Index": 0}}
+]
+`))
+		req, err = http.NewRequest("PUT", "/v1/txn", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.Txn(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 409 {
+			t.Fatalf("expected 409, got %d", resp.Code)
+		}
+		out = obj.(structs.TxnResponse)
+		if len(out.Results) != 0 || len(out.Errors) != 1 || out.Errors[0].OpIndex != 1 {
+			t.Fatalf("bad: %#v", out)
+		}
+	})
+}
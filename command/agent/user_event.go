@@ -9,39 +9,15 @@ import (
 
 const (
 	// userEventMaxVersion is the maximum protocol version we understand
-	userEventMaxVersion = 1
+	userEventMaxVersion = structs.UserEventVersion
 
 	// remoteExecName is the event name for a remote exec command
 	remoteExecName = "_rexec"
 )
 
-// UserEventParam is used to parameterize a user event
-type UserEvent struct {
-	// ID of the user event. Automatically generated.
-	ID string
-
-	// Name of the event
-	Name string `codec:"n"`
-
-	// Optional payload
-	Payload []byte `codec:"p,omitempty"`
-
-	// NodeFilter is a regular expression to filter on nodes
-	NodeFilter string `codec:"nf,omitempty"`
-
-	// ServiceFilter is a regular expression to filter on services
-	ServiceFilter string `codec:"sf,omitempty"`
-
-	// TagFilter is a regular expression to filter on tags of a service,
-	// must be provided with ServiceFilter
-	TagFilter string `codec:"tf,omitempty"`
-
-	// Version of the user event. Automatically generated.
-	Version int `codec:"v"`
-
-	// LTime is the lamport time. Automatically generated.
-	LTime uint64 `codec:"-"`
-}
+// UserEvent is used to parameterize a user event. It has the same
+// format as the servers use, so it can be converted to encode it.
+type UserEvent structs.UserEvent
 
 // validateUserEventParams is used to sanity check the inputs
 func validateUserEventParams(params *UserEvent) error {
@@ -80,7 +56,7 @@ func (a *Agent) UserEvent(dc, token string, params *UserEvent) error {
 	// Format message
 	params.ID = generateUUID()
 	params.Version = userEventMaxVersion
-	payload, err := encodeMsgPack(&params)
+	payload, err := structs.EncodeUserEvent((*structs.UserEvent)(params))
 	if err != nil {
 		return fmt.Errorf("UserEvent encoding failed: %v", err)
 	}
@@ -108,7 +84,7 @@ func (a *Agent) handleEvents() {
 		case e := <-a.eventCh:
 			// Decode the event
 			msg := new(UserEvent)
-			if err := decodeMsgPack(e.Payload, msg); err != nil {
+			if err := structs.DecodeUserEvent(e.Payload, (*structs.UserEvent)(msg)); err != nil {
 				a.logger.Printf("[ERR] agent: Failed to decode event: %v", err)
 				continue
 			}
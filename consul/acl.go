@@ -87,13 +87,24 @@ func (s *Server) resolveToken(id string) (acl.ACL, error) {
 	}
 
 	// Check if we are the ACL datacenter and the leader, use the
-	// authoritative cache
+	// authoritative cache. Otherwise use our non-authoritative cache.
+	var policy acl.ACL
+	var err error
 	if s.config.Datacenter == authDC && s.IsLeader() {
-		return s.aclAuthCache.GetACL(id)
+		policy, err = s.aclAuthCache.GetACL(id)
+	} else {
+		policy, err = s.aclCache.lookupACL(id, authDC)
+	}
+	if err != nil || policy == nil || s.config.AuthorizationHook == nil {
+		return policy, err
 	}
 
-	// Use our non-authoritative cache
-	return s.aclCache.lookupACL(id, authDC)
+	// Pass each decision on to the authorization hook
+	return &hookedACL{
+		token:  id,
+		parent: policy,
+		hook:   s.config.AuthorizationHook,
+	}, nil
 }
 
 // rpcFn is used to make an RPC call to the client or server.
@@ -281,6 +292,53 @@ func (f *aclFilter) filterHealthChecks(checks *structs.HealthChecks) {
 	*checks = hc
 }
 
+// filterCheckTransitions is used to filter a check's history based on ACLs.
+func (f *aclFilter) filterCheckTransitions(history *structs.CheckTransitions) {
+	h := *history
+	for i := 0; i < len(h); i++ {
+		t := h[i]
+		if f.filterService(t.ServiceName) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping check transition %q from result due to ACLs", t.CheckID)
+		h = append(h[:i], h[i+1:]...)
+		i--
+	}
+	*history = h
+}
+
+// filterMaintenanceWindows is used to filter maintenance windows based on
+// ACLs. Windows scoped to a service are only shown to those who can read it.
+func (f *aclFilter) filterMaintenanceWindows(windows *structs.MaintenanceWindows) {
+	w := *windows
+	for i := 0; i < len(w); i++ {
+		window := w[i]
+		if f.filterService(window.ServiceName) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping maintenance window %q from result due to ACLs", window.ID)
+		w = append(w[:i], w[i+1:]...)
+		i--
+	}
+	*windows = w
+}
+
+// filterManagedChecks is used to filter managed checks based on ACLs.
+// Checks attached to a service are only shown to those who can read it.
+func (f *aclFilter) filterManagedChecks(checks *structs.ManagedChecks) {
+	c := *checks
+	for i := 0; i < len(c); i++ {
+		check := c[i]
+		if f.filterService(check.ServiceName) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping managed check %q from result due to ACLs", check.ID)
+		c = append(c[:i], c[i+1:]...)
+		i--
+	}
+	*checks = c
+}
+
 // filterServices is used to filter a set of services based on ACLs.
 func (f *aclFilter) filterServices(services structs.Services) {
 	for svc, _ := range services {
@@ -292,6 +350,17 @@ func (f *aclFilter) filterServices(services structs.Services) {
 	}
 }
 
+// filterServiceSummaries is used to filter service summaries based on ACLs.
+func (f *aclFilter) filterServiceSummaries(summaries structs.ServiceSummaries) {
+	for svc := range summaries {
+		if f.filterService(svc) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", svc)
+		delete(summaries, svc)
+	}
+}
+
 // filterServiceNodes is used to filter a set of nodes for a given service
 // based on the configured ACL rules.
 func (f *aclFilter) filterServiceNodes(nodes *structs.ServiceNodes) {
@@ -319,6 +388,23 @@ func (f *aclFilter) filterNodeServices(services *structs.NodeServices) {
 	}
 }
 
+// filterNodeDelta is used to filter the changed services and checks on a
+// node based on ACLs.
+func (f *aclFilter) filterNodeDelta(delta *structs.NodeDelta) {
+	services := delta.Services
+	for i := 0; i < len(services); i++ {
+		service := services[i]
+		if f.filterService(service.Service) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", service.ID)
+		services = append(services[:i], services[i+1:]...)
+		i--
+	}
+	delta.Services = services
+	f.filterHealthChecks(&delta.Checks)
+}
+
 // filterCheckServiceNodes is used to filter nodes based on ACL rules.
 func (f *aclFilter) filterCheckServiceNodes(nodes *structs.CheckServiceNodes) {
 	csn := *nodes
@@ -388,12 +474,31 @@ func (s *Server) filterACL(token string, subj interface{}) error {
 	case *structs.IndexedHealthChecks:
 		filt.filterHealthChecks(&v.HealthChecks)
 
+	case *structs.IndexedCheckHistory:
+		filt.filterCheckTransitions(&v.History)
+
 	case *structs.IndexedServices:
 		filt.filterServices(v.Services)
+		for svc := range v.Summaries {
+			if _, ok := v.Services[svc]; !ok {
+				delete(v.Summaries, svc)
+			}
+		}
+
+	case *structs.IndexedServiceSummaries:
+		filt.filterServiceSummaries(v.Summaries)
 
 	case *structs.IndexedServiceNodes:
 		filt.filterServiceNodes(&v.ServiceNodes)
 
+	case *structs.IndexedAddressNodes:
+		filt.filterServiceNodes(&v.Services)
+
+	case *structs.IndexedNodeDelta:
+		if v.NodeDelta != nil {
+			filt.filterNodeDelta(v.NodeDelta)
+		}
+
 	case *structs.IndexedNodeServices:
 		if v.NodeServices != nil {
 			filt.filterNodeServices(v.NodeServices)
@@ -405,6 +510,24 @@ func (s *Server) filterACL(token string, subj interface{}) error {
 	case *structs.IndexedNodeDump:
 		filt.filterNodeDump(&v.Dump)
 
+	case *structs.IndexedMaintenanceWindows:
+		filt.filterMaintenanceWindows(&v.Windows)
+
+	case *structs.IndexedManagedChecks:
+		filt.filterManagedChecks(&v.Checks)
+
+	case *structs.IndexedCatalogDump:
+		if v.Dump != nil {
+			filt.filterServiceNodes(&v.Dump.Services)
+			filt.filterHealthChecks(&v.Dump.Checks)
+		}
+
+	case *structs.RegisterResponse:
+		if v.NodeServices != nil {
+			filt.filterNodeServices(v.NodeServices)
+		}
+		filt.filterHealthChecks(&v.HealthChecks)
+
 	default:
 		panic(fmt.Errorf("Unhandled type passed to ACL filter: %#v", subj))
 	}
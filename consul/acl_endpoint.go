@@ -123,7 +123,7 @@ func (a *ACL) Get(args *structs.ACLSpecificRequest,
 	state := a.srv.fsm.State()
 	return a.srv.blockingRPC(&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("ACLGet"),
+		queryWatch(state, "ACLGet"),
 		func() error {
 			index, acl, err := state.ACLGet(args.ACL)
 			if err != nil {
@@ -198,7 +198,7 @@ func (a *ACL) List(args *structs.DCSpecificRequest,
 	state := a.srv.fsm.State()
 	return a.srv.blockingRPC(&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("ACLList"),
+		queryWatch(state, "ACLList"),
 		func() error {
 			index, acls, err := state.ACLList()
 			if err != nil {
@@ -0,0 +1,104 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/acl"
+)
+
+// AuthorizationRequest describes a single ACL decision made while serving
+// an RPC.
+type AuthorizationRequest struct {
+	// Token is the ACL token the request was made with. The anonymous
+	// token is used for requests that didn't give one.
+	Token string
+
+	// Resource is the kind of resource being checked: "key", "service",
+	// "event", "keyring", or "acl".
+	Resource string
+
+	// Name is the key, service, or event being checked. It's empty for
+	// resources that aren't named.
+	Name string
+
+	// Access is the kind of access being checked: "read", "write", or
+	// "write-prefix" for keys; "list" or "modify" for ACLs.
+	Access string
+
+	// Allowed is the verdict the ACL policy came to.
+	Allowed bool
+}
+
+// AuthorizationHook can be set on the server config to see every ACL
+// decision the server makes. It runs after the token's policy has been
+// evaluated and can deny requests the policy allowed, so embedders can
+// layer their own authorization or logging over Consul's ACLs without
+// changing each endpoint. It can't grant requests the policy denied.
+//
+// The hook is only consulted when ACLs are enabled, and is called inline
+// with request handling so it should not block.
+type AuthorizationHook interface {
+	Authorize(req *AuthorizationRequest) bool
+}
+
+// hookedACL wraps a resolved ACL so that each decision is passed on to
+// the configured AuthorizationHook.
+type hookedACL struct {
+	token  string
+	parent acl.ACL
+	hook   AuthorizationHook
+}
+
+// authorize runs the hook for a decision made by the parent policy.
+func (h *hookedACL) authorize(resource, name, access string, allowed bool) bool {
+	req := &AuthorizationRequest{
+		Token:    h.token,
+		Resource: resource,
+		Name:     name,
+		Access:   access,
+		Allowed:  allowed,
+	}
+	return h.hook.Authorize(req) && allowed
+}
+
+func (h *hookedACL) KeyRead(key string) bool {
+	return h.authorize("key", key, "read", h.parent.KeyRead(key))
+}
+
+func (h *hookedACL) KeyWrite(key string) bool {
+	return h.authorize("key", key, "write", h.parent.KeyWrite(key))
+}
+
+func (h *hookedACL) KeyWritePrefix(prefix string) bool {
+	return h.authorize("key", prefix, "write-prefix", h.parent.KeyWritePrefix(prefix))
+}
+
+func (h *hookedACL) ServiceRead(name string) bool {
+	return h.authorize("service", name, "read", h.parent.ServiceRead(name))
+}
+
+func (h *hookedACL) ServiceWrite(name string) bool {
+	return h.authorize("service", name, "write", h.parent.ServiceWrite(name))
+}
+
+func (h *hookedACL) EventRead(name string) bool {
+	return h.authorize("event", name, "read", h.parent.EventRead(name))
+}
+
+func (h *hookedACL) EventWrite(name string) bool {
+	return h.authorize("event", name, "write", h.parent.EventWrite(name))
+}
+
+func (h *hookedACL) KeyringRead() bool {
+	return h.authorize("keyring", "", "read", h.parent.KeyringRead())
+}
+
+func (h *hookedACL) KeyringWrite() bool {
+	return h.authorize("keyring", "", "write", h.parent.KeyringWrite())
+}
+
+func (h *hookedACL) ACLList() bool {
+	return h.authorize("acl", "", "list", h.parent.ACLList())
+}
+
+func (h *hookedACL) ACLModify() bool {
+	return h.authorize("acl", "", "modify", h.parent.ACLModify())
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/hashicorp/consul/acl"
@@ -200,6 +203,90 @@ func TestACL_Authority_Management(t *testing.T) {
 	}
 }
 
+// testAuthorizationHook records the decisions it sees, and denies access to
+// the "foo/secret" key.
+type testAuthorizationHook struct {
+	l    sync.Mutex
+	seen []AuthorizationRequest
+}
+
+func (h *testAuthorizationHook) Authorize(req *AuthorizationRequest) bool {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.seen = append(h.seen, *req)
+	return req.Name != "foo/secret"
+}
+
+func TestACL_AuthorizationHook(t *testing.T) {
+	hook := &testAuthorizationHook{}
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1" // Enable ACLs!
+		c.ACLMasterToken = "root"
+		c.AuthorizationHook = hook
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create a new token
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	acl, err := s1.resolveToken(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The hook sees the policy's verdict, and can only take access away.
+	hook.seen = nil
+	if !acl.KeyRead("foo/test") {
+		t.Fatalf("unexpected failed read")
+	}
+	if acl.KeyRead("foo/secret") {
+		t.Fatalf("unexpected read")
+	}
+	if acl.KeyWrite("bar") {
+		t.Fatalf("unexpected write")
+	}
+	expected := []AuthorizationRequest{
+		{Token: id, Resource: "key", Name: "foo/test", Access: "read", Allowed: true},
+		{Token: id, Resource: "key", Name: "foo/secret", Access: "read", Allowed: true},
+		{Token: id, Resource: "key", Name: "bar", Access: "write", Allowed: false},
+	}
+	if !reflect.DeepEqual(hook.seen, expected) {
+		t.Fatalf("bad: %#v", hook.seen)
+	}
+
+	// Endpoints enforce the hook's verdict.
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo/secret",
+			Value: []byte("hello"),
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var out bool
+	err = s1.RPC("KVS.Apply", &kv, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestACL_NonAuthority_NotFound(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
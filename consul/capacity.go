@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// capacityStatus compares the usage of the local state store against the
+// configured capacity thresholds.
+func (s *Server) capacityStatus() (uint64, *structs.CapacityStatus, error) {
+	index, usage, err := s.fsm.State().CapacityUsage()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	status := &structs.CapacityStatus{
+		Thresholds: s.config.CapacityThresholds,
+		Usage:      *usage,
+	}
+	limits := status.Thresholds
+	for _, num := range usage.ServiceInstances {
+		if limits.ServiceInstances > 0 && num > limits.ServiceInstances {
+			status.Exceeded = append(status.Exceeded, structs.CapacityServiceInstances)
+			break
+		}
+	}
+	if limits.Services > 0 && usage.Services > limits.Services {
+		status.Exceeded = append(status.Exceeded, structs.CapacityServices)
+	}
+	if limits.KVSKeys > 0 && usage.KVSKeys > limits.KVSKeys {
+		status.Exceeded = append(status.Exceeded, structs.CapacityKVSKeys)
+	}
+	return index, status, nil
+}
+
+// checkCapacity is invoked by the leader to emit capacity telemetry and warn
+// about any thresholds that have been crossed. We do this outside the leader
+// loop to avoid blocking.
+func (s *Server) checkCapacity() {
+	limits := s.config.CapacityThresholds
+	if limits.ServiceInstances == 0 && limits.Services == 0 && limits.KVSKeys == 0 {
+		return
+	}
+	defer metrics.MeasureSince([]string{"consul", "leader", "checkCapacity"}, time.Now())
+
+	_, status, err := s.capacityStatus()
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to check capacity: %v", err)
+		return
+	}
+
+	// Find the biggest service, since that's the one the threshold
+	// applies to.
+	var largest string
+	for service, num := range status.Usage.ServiceInstances {
+		if num > status.Usage.ServiceInstances[largest] {
+			largest = service
+		}
+	}
+	usage := status.Usage
+	metrics.SetGauge([]string{"consul", "capacity", "services"}, float32(usage.Services))
+	metrics.SetGauge([]string{"consul", "capacity", "service_instances"},
+		float32(usage.ServiceInstances[largest]))
+	metrics.SetGauge([]string{"consul", "capacity", "kv_keys"}, float32(usage.KVSKeys))
+
+	for _, exceeded := range status.Exceeded {
+		metrics.IncrCounter([]string{"consul", "capacity", "exceeded", exceeded}, 1)
+		switch exceeded {
+		case structs.CapacityServiceInstances:
+			s.logger.Printf("[WARN] consul: service '%s' has %d instances, over the threshold of %d",
+				largest, usage.ServiceInstances[largest], limits.ServiceInstances)
+		case structs.CapacityServices:
+			s.logger.Printf("[WARN] consul: %d services are registered, over the threshold of %d",
+				usage.Services, limits.Services)
+		case structs.CapacityKVSKeys:
+			s.logger.Printf("[WARN] consul: %d keys are stored, over the threshold of %d",
+				usage.KVSKeys, limits.KVSKeys)
+		}
+	}
+}
@@ -2,13 +2,22 @@ package consul
 
 import (
 	"fmt"
+	"math"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
+// validMetaKey is used to check the keys of node and service metadata. Keys can't have
+// colons since the HTTP API uses one to split filter keys from values.
+var validMetaKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 // Catalog endpoint is used to manipulate the service catalog
 type Catalog struct {
 	srv *Server
@@ -21,11 +30,192 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 	}
 	defer metrics.MeasureSince([]string{"consul", "catalog", "register"}, time.Now())
 
-	// Verify the args
-	if args.Node == "" || args.Address == "" {
-		return fmt.Errorf("Must provide node and address")
+	_, err := c.register(args)
+	return err
+}
+
+// RegisterEcho is like Register but also returns the node's services and
+// checks as they stand after the write, saving clients a read to learn
+// their new indexes.
+func (c *Catalog) RegisterEcho(args *structs.RegisterRequest, reply *structs.RegisterResponse) error {
+	if done, err := c.srv.forward("Catalog.RegisterEcho", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "register"}, time.Now())
+
+	index, err := c.register(args)
+	if err != nil {
+		return err
 	}
+	reply.Index = index
 
+	// We are the leader, so our FSM has already applied the write.
+	state := c.srv.fsm.State()
+	_, services, err := state.NodeServices(args.Node)
+	if err != nil {
+		return err
+	}
+	_, checks, err := state.NodeChecks(args.Node)
+	if err != nil {
+		return err
+	}
+	reply.NodeServices = services
+	reply.HealthChecks = checks
+	return c.srv.filterACL(args.Token, reply)
+}
+
+// register verifies and applies a registration, returning the Raft index
+// it was applied at.
+func (c *Catalog) register(args *structs.RegisterRequest) (uint64, error) {
+	// Verify the args, collecting every problem
+	var verr structs.ValidationErrors
+	validateRegistration(&verr, "", args)
+	if err := c.checkDuplicateServiceID(&verr, "", args, make(map[string]string)); err != nil {
+		return 0, err
+	}
+	if err := verr.ErrorOrNil(); err != nil {
+		return 0, err
+	}
+
+	// Apply the ACL policy if any
+	// The 'consul' service is excluded since it is managed
+	// automatically internally.
+	if args.Service != nil && args.Service.Service != ConsulServiceName {
+		acl, err := c.srv.resolveToken(args.Token)
+		if err != nil {
+			return 0, err
+		}
+		if err := c.checkRegistrationACL(acl, args); err != nil {
+			return 0, err
+		}
+	}
+	prepareRegistrationService(args, c.srv.config.Clock.Now())
+	prepareRegistrationChecks(args)
+	if err := c.keepExternalCheckers(args); err != nil {
+		return 0, err
+	}
+
+	_, index, err := c.srv.raftApplyIndex(structs.RegisterRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: Register failed: %v", err)
+		return 0, err
+	}
+
+	return index, nil
+}
+
+// BatchRegister applies many registrations in a single Raft entry. Every
+// registration is verified before any are applied, and they either all
+// take effect or none do.
+func (c *Catalog) BatchRegister(args *structs.BatchRegisterRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.BatchRegister", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "batch_register"}, time.Now())
+
+	// Verify the args, collecting every problem
+	var verr structs.ValidationErrors
+	if len(args.Registrations) == 0 {
+		verr.Add("Registrations", "must be provided")
+	}
+	claimed := make(map[string]string)
+	for i, reg := range args.Registrations {
+		if reg == nil {
+			verr.Add(fmt.Sprintf("Registrations[%d]", i), "must not be empty")
+			continue
+		}
+		prefix := fmt.Sprintf("Registrations[%d].", i)
+		validateRegistration(&verr, prefix, reg)
+		if err := c.checkDuplicateServiceID(&verr, prefix, reg, claimed); err != nil {
+			return err
+		}
+	}
+	if err := verr.ErrorOrNil(); err != nil {
+		return err
+	}
+
+	// The whole batch is written with the caller's token
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	now := c.srv.config.Clock.Now()
+	for _, reg := range args.Registrations {
+		if reg.Service != nil && reg.Service.Service != ConsulServiceName {
+			if err := c.checkRegistrationACL(acl, reg); err != nil {
+				return err
+			}
+		}
+		prepareRegistrationService(reg, now)
+		prepareRegistrationChecks(reg)
+		if err := c.keepExternalCheckers(reg); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.srv.raftApply(structs.BatchRegisterRequestType, args); err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: BatchRegister failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// checkDuplicateServiceID adds a validation error if duplicate service IDs
+// are being rejected and the registration's service ID is already
+// registered on a different node. The claimed map holds the IDs taken by
+// earlier registrations in the same batch, keyed by lower cased ID. The
+// "consul" service is registered on every server, so it's never checked.
+func (c *Catalog) checkDuplicateServiceID(verr *structs.ValidationErrors, prefix string,
+	args *structs.RegisterRequest, claimed map[string]string) error {
+	if !c.srv.config.RejectDuplicateServiceIDs || args.Service == nil ||
+		args.Service.ID == "" || args.Service.Service == ConsulServiceName {
+		return nil
+	}
+
+	id := strings.ToLower(args.Service.ID)
+	if node, ok := claimed[id]; ok && !strings.EqualFold(node, args.Node) {
+		verr.Add(prefix+"Service.ID", "%q is already registered on node %q", args.Service.ID, node)
+		return nil
+	}
+	claimed[id] = args.Node
+
+	// A node that's being renamed still has its services under its old
+	// name, which doesn't count as a clash.
+	state := c.srv.fsm.State()
+	var oldName string
+	if args.ID != "" {
+		_, node, err := state.GetNodeID(args.ID)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			oldName = node.Node
+		}
+	}
+
+	_, existing, err := state.ServiceIDNodes(args.Service.ID)
+	if err != nil {
+		return err
+	}
+	for _, sn := range existing {
+		if !strings.EqualFold(sn.Node, args.Node) && !strings.EqualFold(sn.Node, oldName) {
+			verr.Add(prefix+"Service.ID", "%q is already registered on node %q", args.Service.ID, sn.Node)
+			break
+		}
+	}
+	return nil
+}
+
+// validateRegistration checks a registration, adding any problems to verr
+// with their fields named after prefix. Missing service IDs are defaulted
+// to the service name along the way.
+func validateRegistration(verr *structs.ValidationErrors, prefix string, args *structs.RegisterRequest) {
+	if args.Node == "" {
+		verr.Add(prefix+"Node", "must be provided")
+	}
+	if args.Address == "" {
+		verr.Add(prefix+"Address", "must be provided")
+	}
 	if args.Service != nil {
 		// If no service id, but service name, use default
 		if args.Service.ID == "" && args.Service.Service != "" {
@@ -34,24 +224,94 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 
 		// Verify ServiceName provided if ID
 		if args.Service.ID != "" && args.Service.Service == "" {
-			return fmt.Errorf("Must provide service name with ID")
+			verr.Add(prefix+"Service.Service", "must be provided with Service.ID")
 		}
-
-		// Apply the ACL policy if any
-		// The 'consul' service is excluded since it is managed
-		// automatically internally.
-		if args.Service.Service != ConsulServiceName {
-			acl, err := c.srv.resolveToken(args.Token)
-			if err != nil {
-				return err
-			} else if acl != nil && !acl.ServiceWrite(args.Service.Service) {
-				c.srv.logger.Printf("[WARN] consul.catalog: Register of service '%s' on '%s' denied due to ACLs",
-					args.Service.Service, args.Node)
-				return permissionDeniedErr
+		if args.Service.CacheMaxAge < 0 {
+			verr.Add(prefix+"Service.CacheMaxAge", "must not be negative")
+		}
+		if args.Service.DNSTTL < 0 {
+			verr.Add(prefix+"Service.DNSTTL", "must not be negative")
+		}
+		if w := args.Service.Weights; w != nil {
+			if w.Passing < 1 || w.Passing > math.MaxUint16 {
+				verr.Add(prefix+"Service.Weights.Passing", fmt.Sprintf("must be between 1 and %d", math.MaxUint16))
+			}
+			if w.Warning < 0 || w.Warning > math.MaxUint16 {
+				verr.Add(prefix+"Service.Weights.Warning", fmt.Sprintf("must be between 0 and %d", math.MaxUint16))
 			}
 		}
+		validateMeta(verr, prefix+"Service.Meta", args.Service.Meta)
+		validateMeta(verr, prefix+"Service.TaggedAddresses", args.Service.TaggedAddresses)
+		switch args.Service.Source {
+		case "", structs.ServiceSourceAgent, structs.ServiceSourceCatalog, structs.ServiceSourceExternal:
+		default:
+			verr.Add(prefix+"Service.Source", "must be %q, %q, or %q", structs.ServiceSourceAgent,
+				structs.ServiceSourceCatalog, structs.ServiceSourceExternal)
+		}
+	}
+	validateMeta(verr, prefix+"NodeMeta", args.NodeMeta)
+	validateMeta(verr, prefix+"TaggedAddresses", args.TaggedAddresses)
+	if args.Check != nil {
+		validateExternalCheck(verr, prefix+"Check.External", args.Check.External)
+	}
+	for i, check := range args.Checks {
+		if check != nil {
+			validateExternalCheck(verr, fmt.Sprintf("%sChecks[%d].External", prefix, i), check.External)
+		}
+	}
+
+	// Only services can expire, and agents keep theirs up to date.
+	if args.ExpiresAfter != "" {
+		if args.Service == nil {
+			verr.Add(prefix+"ExpiresAfter", "requires a Service")
+		} else if args.Service.Source == structs.ServiceSourceAgent {
+			verr.Add(prefix+"ExpiresAfter", "can't be used for a service synced by an agent")
+		}
+		ttl, err := time.ParseDuration(args.ExpiresAfter)
+		if err != nil {
+			verr.Add(prefix+"ExpiresAfter", "'%s' is not a valid duration: %v", args.ExpiresAfter, err)
+		} else if ttl <= 0 {
+			verr.Add(prefix+"ExpiresAfter", "'%s' must be positive", args.ExpiresAfter)
+		}
+	}
+}
+
+// checkRegistrationACL makes sure the given ACL may write the service
+// being registered.
+func (c *Catalog) checkRegistrationACL(acl acl.ACL, args *structs.RegisterRequest) error {
+	if acl != nil && !acl.ServiceWrite(args.Service.Service) {
+		c.srv.logger.Printf("[WARN] consul.catalog: Register of service '%s' on '%s' denied due to ACLs",
+			args.Service.Service, args.Node)
+		return permissionDeniedErr
+	}
+	return nil
+}
+
+// prepareRegistrationService stamps the service being registered with the
+// time it was seen, which the state store only keeps for new instances, and
+// with when it expires, if it does. Its source defaults to the catalog API.
+func prepareRegistrationService(args *structs.RegisterRequest, now time.Time) {
+	if args.Service == nil {
+		return
+	}
+
+	// Work on a copy, since an in-memory call from our own agent would
+	// otherwise change its local state.
+	svc := *args.Service
+	svc.RegisteredAt = now
+	svc.ExpiresAt = time.Time{}
+	if ttl, err := time.ParseDuration(args.ExpiresAfter); err == nil {
+		svc.ExpiresAt = now.Add(ttl)
+	}
+	if svc.Source == "" {
+		svc.Source = structs.ServiceSourceCatalog
 	}
+	args.Service = &svc
+}
 
+// prepareRegistrationChecks folds the single Check into Checks and fills
+// in defaulted check fields.
+func prepareRegistrationChecks(args *structs.RegisterRequest) {
 	if args.Check != nil {
 		args.Checks = append(args.Checks, args.Check)
 		args.Check = nil
@@ -64,13 +324,163 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 			check.Node = args.Node
 		}
 	}
+}
+
+// validateExternalCheck checks the definition of an external check, if
+// there is one.
+func validateExternalCheck(verr *structs.ValidationErrors, name string, external *structs.ExternalCheck) {
+	if external == nil {
+		return
+	}
+	if (external.HTTP == "") == (external.TCP == "") {
+		verr.Add(name, "must have exactly one of HTTP or TCP")
+	}
+	if external.Interval <= 0 {
+		verr.Add(name+".Interval", "must be positive")
+	}
+	if external.Timeout < 0 {
+		verr.Add(name+".Timeout", "must not be negative")
+	}
+}
+
+// keepExternalCheckers carries the checker assigned to existing external
+// checks over to their new registration, so registering an external
+// service again doesn't leave its checks unassigned until the leader's
+// next pass. Checks are copied before they're changed.
+func (c *Catalog) keepExternalCheckers(args *structs.RegisterRequest) error {
+	state := c.srv.fsm.State()
+	for i, check := range args.Checks {
+		if check.External == nil || check.External.Checker != "" {
+			continue
+		}
+		_, existing, err := state.NodeChecks(check.Node)
+		if err != nil {
+			return err
+		}
+		for _, e := range existing {
+			if e.CheckID != check.CheckID || e.External == nil {
+				continue
+			}
+			hc := *check
+			external := *check.External
+			external.Checker = e.External.Checker
+			hc.External = &external
+			args.Checks[i] = &hc
+			break
+		}
+	}
+	return nil
+}
+
+// validateMeta checks the metadata or tagged addresses being registered for
+// a node or service against the limits on their size and the characters
+// allowed in their keys.
+func validateMeta(verr *structs.ValidationErrors, name string, meta map[string]string) {
+	if len(meta) > structs.MetaMaxKeyPairs {
+		verr.Add(name, "must not have more than %d pairs", structs.MetaMaxKeyPairs)
+	}
+
+	// Go over the keys in order so the errors come out the same each time.
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field := fmt.Sprintf("%s[%q]", name, key)
+		if !validMetaKey.MatchString(key) {
+			verr.Add(field, "key must only contain letters, numbers, '-', and '_'")
+		}
+		if len(key) > structs.MetaKeyMaxLength {
+			verr.Add(field, "key must not be longer than %d characters", structs.MetaKeyMaxLength)
+		}
+		value := meta[key]
+		if value == "" {
+			verr.Add(field, "value must be provided")
+		}
+		if len(value) > structs.MetaValueMaxLength {
+			verr.Add(field, "value must not be longer than %d characters", structs.MetaValueMaxLength)
+		}
+	}
+}
+
+// UpdateChecks is used to write many of a node's checks in one Raft
+// entry, such as when an agent syncs a batch of TTL check updates. The
+// node must already be registered, and so must the service of any check
+// tied to one.
+func (c *Catalog) UpdateChecks(args *structs.ChecksUpdateRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.UpdateChecks", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "update_checks"}, time.Now())
+
+	// Verify the args, collecting every problem
+	var verr structs.ValidationErrors
+	if args.Node == "" {
+		verr.Add("Node", "must be provided")
+	}
+	if len(args.Checks) == 0 {
+		verr.Add("Checks", "must be provided")
+	}
+	for i, check := range args.Checks {
+		if check.CheckID == "" {
+			verr.Add(fmt.Sprintf("Checks[%d].CheckID", i), "must be provided")
+		}
+		if !structs.ValidStatus(check.Status) {
+			verr.Add(fmt.Sprintf("Checks[%d].Status", i), "'%s' is not a valid status", check.Status)
+		}
+	}
+	if err := verr.ErrorOrNil(); err != nil {
+		return err
+	}
 
-	_, err := c.srv.raftApply(structs.RegisterRequestType, args)
+	// Look up the node and its services
+	state := c.srv.fsm.State()
+	_, node, err := state.GetNode(args.Node)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("Unknown node %q", args.Node)
+	}
+	_, services, err := state.NodeServices(args.Node)
+	if err != nil {
+		return err
+	}
+
+	acl, err := c.srv.resolveToken(args.Token)
 	if err != nil {
-		c.srv.logger.Printf("[ERR] consul.catalog: Register failed: %v", err)
 		return err
 	}
+	for _, check := range args.Checks {
+		check.Node = args.Node
+		if check.ServiceID == "" {
+			continue
+		}
+
+		// Apply the ACL policy of the check's service
+		svc, ok := services.Services[check.ServiceID]
+		if !ok {
+			return fmt.Errorf("Unknown service %q for check %q", check.ServiceID, check.CheckID)
+		}
+		if acl != nil && svc.Service != ConsulServiceName && !acl.ServiceWrite(svc.Service) {
+			c.srv.logger.Printf("[WARN] consul.catalog: Update of check '%s' on '%s' denied due to ACLs",
+				check.CheckID, args.Node)
+			return permissionDeniedErr
+		}
+	}
 
+	// Apply as a regular registration so the FSM needs no new type
+	req := structs.RegisterRequest{
+		Datacenter: args.Datacenter,
+		Node:       node.Node,
+		Address:    node.Address,
+		Checks:     args.Checks,
+	}
+	if _, err := c.srv.raftApply(structs.RegisterRequestType, &req); err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: UpdateChecks failed: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -94,6 +504,50 @@ func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) e
 	return nil
 }
 
+// Drain marks a service instance as draining, or puts it back into service.
+// Draining instances stay in the catalog but are left out of health queries
+// and DNS, so traffic can be moved off them before they're deregistered.
+func (c *Catalog) Drain(args *structs.ServiceDrainRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.Drain", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "drain"}, time.Now())
+
+	// Verify the args
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+	if args.ServiceID == "" {
+		return fmt.Errorf("Must provide service ID")
+	}
+
+	// Draining takes write access to the service
+	state := c.srv.fsm.State()
+	_, services, err := state.NodeServices(args.Node)
+	if err != nil {
+		return err
+	}
+	if services == nil || services.Services[args.ServiceID] == nil {
+		return fmt.Errorf("Unknown service '%s' on node '%s'", args.ServiceID, args.Node)
+	}
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.ServiceWrite(services.Services[args.ServiceID].Service) {
+		c.srv.logger.Printf("[WARN] consul.catalog: Drain of service '%s' on '%s' denied due to ACLs",
+			args.ServiceID, args.Node)
+		return permissionDeniedErr
+	}
+
+	_, err = c.srv.raftApply(structs.ServiceDrainRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: Drain failed: %v", err)
+		return err
+	}
+	return nil
+}
+
 // ListDatacenters is used to query for the list of known datacenters
 func (c *Catalog) ListDatacenters(args *struct{}, reply *[]string) error {
 	c.srv.remoteLock.RLock()
@@ -118,6 +572,67 @@ func (c *Catalog) ListDatacenters(args *struct{}, reply *[]string) error {
 	return nil
 }
 
+// DatacenterInfo is used to describe each of the known datacenters, with
+// the number of servers, their protocol versions, their WAN coordinates and
+// the estimated RTT to them. The datacenters are in the same order as
+// ListDatacenters returns them.
+func (c *Catalog) DatacenterInfo(args *struct{}, reply *[]structs.DatacenterInfo) error {
+	// Copy out the servers, so we don't hold the lock while we work out
+	// the distances below.
+	c.srv.remoteLock.RLock()
+	var dcs []string
+	servers := make(map[string][]*serverParts, len(c.srv.remoteConsuls))
+	for dc, parts := range c.srv.remoteConsuls {
+		dcs = append(dcs, dc)
+		servers[dc] = append([]*serverParts(nil), parts...)
+	}
+	c.srv.remoteLock.RUnlock()
+
+	sort.Strings(dcs)
+	if err := c.srv.sortDatacentersByDistance(dcs); err != nil {
+		return err
+	}
+
+	serfer := serverSerfer{c.srv}
+	maps := c.srv.getDatacenterMaps(dcs)
+	infos := make([]structs.DatacenterInfo, 0, len(dcs))
+	for i, dc := range dcs {
+		info := structs.DatacenterInfo{
+			Datacenter:  dc,
+			Servers:     len(servers[dc]),
+			Coordinates: maps[i].Coordinates,
+		}
+		for _, part := range servers[dc] {
+			if info.ProtocolMin == 0 || part.Version < info.ProtocolMin {
+				info.ProtocolMin = part.Version
+			}
+			if part.Version > info.ProtocolMax {
+				info.ProtocolMax = part.Version
+			}
+		}
+
+		// Strip the datacenter suffix from the server names.
+		suffix := fmt.Sprintf(".%s", dc)
+		for _, coord := range info.Coordinates {
+			coord.Node = strings.TrimSuffix(coord.Node, suffix)
+		}
+
+		if !c.srv.config.DisableCoordinates {
+			rtt, err := getDatacenterDistance(&serfer, dc)
+			if err != nil {
+				return err
+			}
+			if !math.IsInf(rtt, 0) {
+				info.RTT = time.Duration(rtt * float64(time.Second))
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	*reply = infos
+	return nil
+}
+
 // ListNodes is used to query the nodes in a DC
 func (c *Catalog) ListNodes(args *structs.DCSpecificRequest, reply *structs.IndexedNodes) error {
 	if done, err := c.srv.forward("Catalog.ListNodes", args, args, reply); done {
@@ -129,18 +644,45 @@ func (c *Catalog) ListNodes(args *structs.DCSpecificRequest, reply *structs.Inde
 	return c.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("Nodes"),
+		queryWatch(state, "Nodes"),
 		func() error {
-			index, nodes, err := state.Nodes()
+			index, nodes, err := state.NodesByMeta(args.NodeMetaFilters)
 			if err != nil {
 				return err
 			}
+			if err := filterBySelector(args.Filter, &nodes); err != nil {
+				return err
+			}
 
 			reply.Index, reply.Nodes = index, nodes
 			return c.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes)
 		})
 }
 
+// Dump returns every node, service instance, and health check in a DC, all
+// read at the same index. It saves tools that mirror the catalog from
+// stitching together many list calls made at different indexes.
+func (c *Catalog) Dump(args *structs.DCSpecificRequest, reply *structs.IndexedCatalogDump) error {
+	if done, err := c.srv.forward("Catalog.Dump", args, args, reply); done {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "CatalogDump"),
+		func() error {
+			index, dump, err := state.CatalogDump()
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Dump = index, dump
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
+
 // ListServices is used to query the services in a DC
 func (c *Catalog) ListServices(args *structs.DCSpecificRequest, reply *structs.IndexedServices) error {
 	if done, err := c.srv.forward("Catalog.ListServices", args, args, reply); done {
@@ -149,17 +691,38 @@ func (c *Catalog) ListServices(args *structs.DCSpecificRequest, reply *structs.I
 
 	// Get the list of services and their tags.
 	state := c.srv.fsm.State()
+	if !args.Summaries {
+		return c.srv.blockingRPC(
+			&args.QueryOptions,
+			&reply.QueryMeta,
+			queryWatch(state, "Services"),
+			func() error {
+				index, services, err := state.Services()
+				if err != nil {
+					return err
+				}
+
+				reply.Index, reply.Services = index, services
+				return c.srv.filterACL(args.Token, reply)
+			})
+	}
+
+	// Summaries also depend on the checks, so they need a wider watch.
 	return c.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("Services"),
+		queryWatch(state, "ServiceSummaries"),
 		func() error {
-			index, services, err := state.Services()
+			index, summaries, err := state.ServiceSummaries()
 			if err != nil {
 				return err
 			}
 
-			reply.Index, reply.Services = index, services
+			services := make(structs.Services, len(summaries))
+			for name, summary := range summaries {
+				services[name] = summary.Tags
+			}
+			reply.Index, reply.Services, reply.Summaries = index, services, summaries
 			return c.srv.filterACL(args.Token, reply)
 		})
 }
@@ -180,7 +743,7 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 	err := c.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("ServiceNodes"),
+		queryWatch(state, "ServiceNodes"),
 		func() error {
 			var index uint64
 			var services structs.ServiceNodes
@@ -193,6 +756,18 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 			if err != nil {
 				return err
 			}
+			if len(args.NodeMetaFilters) > 0 {
+				var filtered structs.ServiceNodes
+				for _, service := range services {
+					if structs.SatisfiesMetaFilters(service.NodeMeta, args.NodeMetaFilters) {
+						filtered = append(filtered, service)
+					}
+				}
+				services = filtered
+			}
+			if err := filterBySelector(args.Filter, &services); err != nil {
+				return err
+			}
 			reply.Index, reply.ServiceNodes = index, services
 			if err := c.srv.filterACL(args.Token, reply); err != nil {
 				return err
@@ -213,6 +788,190 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 	return err
 }
 
+// Subscribe is used to follow the instances of a service. Rather than the
+// whole list, each reply carries only the instances that were added,
+// updated, or removed since the sequence number the subscriber last saw.
+// Blocking subscribers only wake up when the service changes.
+func (c *Catalog) Subscribe(args *structs.ServiceSubscribeRequest, reply *structs.IndexedServiceEvents) error {
+	if done, err := c.srv.forward("Catalog.Subscribe", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.ServiceName == "" {
+		return fmt.Errorf("Must provide service name")
+	}
+
+	// The events hold the full instances, so the token needs to be able
+	// to read the service.
+	if acl, err := c.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ServiceRead(args.ServiceName) {
+		return permissionDeniedErr
+	}
+
+	// Get the events
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ServiceEvents"),
+		func() error {
+			index, events, err := state.ServiceEvents(args.ServiceName, args.Since)
+			if err != nil {
+				return err
+			}
+
+			// Changes to other services move the index along, so hold it
+			// back to keep blocking until there is something to send.
+			if !events.Reset && len(events.Events) == 0 && args.MinQueryIndex > 0 {
+				index = args.MinQueryIndex
+			}
+
+			reply.Index = index
+			reply.Events, reply.LastSeq, reply.Reset = events.Events, events.LastSeq, events.Reset
+			return nil
+		})
+}
+
+// ServiceNodesMultiDC runs a ServiceNodes query against several datacenters
+// in parallel and merges the results, noting which datacenter each node
+// came from. A datacenter that can't be queried is reported in the results
+// instead of failing the whole query. Blocking isn't supported, since the
+// datacenters' indexes can't be compared.
+func (c *Catalog) ServiceNodesMultiDC(args *structs.MultiDCServiceRequest, reply *structs.IndexedMultiDCServiceNodes) error {
+	if done, err := c.srv.forward("Catalog.ServiceNodesMultiDC", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "service_nodes_multi_dc"}, time.Now())
+
+	// Verify the arguments
+	if args.ServiceName == "" {
+		return fmt.Errorf("Must provide service name")
+	}
+
+	// Default to every datacenter, nearest first
+	dcs := args.Datacenters
+	if len(dcs) == 0 {
+		if err := c.ListDatacenters(&struct{}{}, &dcs); err != nil {
+			return err
+		}
+	}
+
+	// Query each datacenter in parallel. Going through RPC lets the local
+	// datacenter be handled in memory and the rest be forwarded.
+	results := make([]structs.IndexedServiceNodes, len(dcs))
+	errs := make([]error, len(dcs))
+	var wg sync.WaitGroup
+	for i, dc := range dcs {
+		wg.Add(1)
+		go func(i int, dc string) {
+			defer wg.Done()
+			req := structs.ServiceSpecificRequest{
+				Datacenter:      dc,
+				NodeMetaFilters: args.NodeMetaFilters,
+				ServiceName:     args.ServiceName,
+				ServiceTag:      args.ServiceTag,
+				TagFilter:       args.TagFilter,
+				Filter:          args.Filter,
+				QueryOptions: structs.QueryOptions{
+					Token:             args.Token,
+					AllowStale:        args.AllowStale,
+					RequireConsistent: args.RequireConsistent,
+				},
+			}
+			errs[i] = c.srv.RPC("Catalog.ServiceNodes", &req, &results[i])
+		}(i, dc)
+	}
+	wg.Wait()
+
+	// Merge the results in datacenter order
+	reply.KnownLeader = true
+	for i, dc := range dcs {
+		result := &structs.DatacenterQueryResult{Datacenter: dc}
+		reply.Datacenters = append(reply.Datacenters, result)
+		if errs[i] != nil {
+			c.srv.logger.Printf("[WARN] consul.catalog: ServiceNodesMultiDC failed for datacenter '%s': %v", dc, errs[i])
+			result.Error = errs[i].Error()
+			reply.KnownLeader = false
+			continue
+		}
+
+		result.Index = results[i].Index
+		result.KnownLeader = results[i].KnownLeader
+		if !result.KnownLeader {
+			reply.KnownLeader = false
+		}
+		if results[i].LastContact > reply.LastContact {
+			reply.LastContact = results[i].LastContact
+		}
+		for _, sn := range results[i].ServiceNodes {
+			reply.ServiceNodes = append(reply.ServiceNodes, &structs.DatacenterServiceNode{
+				Datacenter:  dc,
+				ServiceNode: *sn,
+			})
+		}
+	}
+	return nil
+}
+
+// NodeDelta returns the services and checks registered on a node that
+// changed after the given index. Agents use it to keep their view of the
+// catalog in sync without reading every registration on each pass.
+func (c *Catalog) NodeDelta(args *structs.NodeDeltaRequest, reply *structs.IndexedNodeDelta) error {
+	if done, err := c.srv.forward("Catalog.NodeDelta", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// Get the changes
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "NodeChanges"),
+		func() error {
+			index, delta, err := state.NodeChangesSinceIndex(args.Node, args.Since)
+			if err != nil {
+				return err
+			}
+			reply.Index, reply.NodeDelta = index, delta
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
+
+// NodeByAddress returns the nodes registered with the given address, and
+// any service instances that advertise it as their service address.
+func (c *Catalog) NodeByAddress(args *structs.AddressSpecificRequest, reply *structs.IndexedAddressNodes) error {
+	if done, err := c.srv.forward("Catalog.NodeByAddress", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Address == "" {
+		return fmt.Errorf("Must provide address")
+	}
+
+	// Get the nodes and services
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "AddressNodes"),
+		func() error {
+			index, nodes, services, err := state.AddressNodes(args.Address)
+			if err != nil {
+				return err
+			}
+			reply.Index, reply.Nodes, reply.Services = index, nodes, services
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
+
 // NodeServices returns all the services registered as part of a node
 func (c *Catalog) NodeServices(args *structs.NodeSpecificRequest, reply *structs.IndexedNodeServices) error {
 	if done, err := c.srv.forward("Catalog.NodeServices", args, args, reply); done {
@@ -229,7 +988,7 @@ func (c *Catalog) NodeServices(args *structs.NodeSpecificRequest, reply *structs
 	return c.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("NodeServices"),
+		queryWatch(state, "NodeServices"),
 		func() error {
 			index, services, err := state.NodeServices(args.Node)
 			if err != nil {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/rpc"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -45,6 +46,241 @@ func TestCatalogRegister(t *testing.T) {
 	})
 }
 
+func TestCatalogRegisterEcho(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Tags:    []string{"master"},
+			Port:    8000,
+		},
+		Check: &structs.HealthCheck{
+			Name:      "db-check",
+			ServiceID: "db",
+		},
+	}
+	var out structs.RegisterResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.RegisterEcho", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index == 0 || out.NodeServices == nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	svc, ok := out.NodeServices.Services["db"]
+	if !ok || svc.Port != 8000 || svc.ModifyIndex != out.Index {
+		t.Fatalf("bad: %#v", out.NodeServices)
+	}
+	if len(out.HealthChecks) != 1 || out.HealthChecks[0].CheckID != "db-check" ||
+		out.HealthChecks[0].ModifyIndex != out.Index {
+		t.Fatalf("bad: %#v", out.HealthChecks)
+	}
+}
+
+func TestCatalogRegister_Validation(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Every problem should be reported at once
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Service: &structs.NodeService{
+			ID:          "db",
+			CacheMaxAge: -1,
+			DNSTTL:      -1,
+			Weights:     &structs.Weights{Passing: 0, Warning: -1},
+			Source:      "nope",
+		},
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected := "Invalid request: Node: must be provided; Address: must be provided; " +
+		"Service.Service: must be provided with Service.ID; " +
+		"Service.CacheMaxAge: must not be negative; " +
+		"Service.DNSTTL: must not be negative; " +
+		"Service.Weights.Passing: must be between 1 and 65535; " +
+		"Service.Weights.Warning: must be between 0 and 65535; " +
+		`Service.Source: must be "agent", "catalog", or "external"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Node metadata is checked too
+	arg = structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		NodeMeta: map[string]string{
+			"rack":     "",
+			"bad:key":  "value",
+			"too-long": strings.Repeat("a", structs.MetaValueMaxLength+1),
+		},
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected = "Invalid request: " +
+		`NodeMeta["bad:key"]: key must only contain letters, numbers, '-', and '_'; ` +
+		`NodeMeta["rack"]: value must be provided; ` +
+		`NodeMeta["too-long"]: value must not be longer than 512 characters`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So is service metadata
+	arg = structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Meta: map[string]string{
+				"version": "",
+				strings.Repeat("k", structs.MetaKeyMaxLength+1): "value",
+			},
+		},
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected = "Invalid request: " +
+		fmt.Sprintf("Service.Meta[%q]: key must not be longer than 128 characters; ", strings.Repeat("k", structs.MetaKeyMaxLength+1)) +
+		`Service.Meta["version"]: value must be provided`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Expiring registrations need an external service and a valid TTL
+	arg = structs.RegisterRequest{
+		Datacenter:   "dc1",
+		Node:         "foo",
+		Address:      "127.0.0.1",
+		ExpiresAfter: "nope",
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected = "Invalid request: ExpiresAfter: requires a Service; " +
+		`ExpiresAfter: 'nope' is not a valid duration: time: invalid duration nope`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg.Service = &structs.NodeService{
+		Service: "db",
+		Source:  structs.ServiceSourceAgent,
+	}
+	arg.ExpiresAfter = "-10s"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected = "Invalid request: " +
+		"ExpiresAfter: can't be used for a service synced by an agent; " +
+		"ExpiresAfter: '-10s' must be positive"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+
+	// External check definitions need one thing to check, and an interval
+	arg = structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			Name:     "web",
+			External: &structs.ExternalCheck{},
+		},
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{
+				Name: "api",
+				External: &structs.ExternalCheck{
+					HTTP:     "http://127.0.0.1:8080",
+					TCP:      "127.0.0.1:8080",
+					Interval: 10 * time.Second,
+					Timeout:  -1,
+				},
+			},
+		},
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected = "Invalid request: " +
+		"Check.External: must have exactly one of HTTP or TCP; " +
+		"Check.External.Interval: must be positive; " +
+		"Checks[0].External: must have exactly one of HTTP or TCP; " +
+		"Checks[0].External.Timeout: must not be negative"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogRegister_RejectDuplicateServiceIDs(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RejectDuplicateServiceIDs = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web-1",
+			Service: "web",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Registering it again on the same node is fine.
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Another node can't take the ID.
+	arg.Node, arg.Address = "bar", "127.0.0.2"
+	arg.Service.ID = "WEB-1"
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	expected := `Invalid request: Service.ID: "WEB-1" is already registered on node "foo"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nor can two nodes in the same batch.
+	batch := structs.BatchRegisterRequest{
+		Datacenter: "dc1",
+		Registrations: []*structs.RegisterRequest{
+			&structs.RegisterRequest{
+				Node:    "bar",
+				Address: "127.0.0.2",
+				Service: &structs.NodeService{ID: "db-1", Service: "db"},
+			},
+			&structs.RegisterRequest{
+				Node:    "baz",
+				Address: "127.0.0.3",
+				Service: &structs.NodeService{ID: "db-1", Service: "db"},
+			},
+		},
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.BatchRegister", &batch, &out)
+	expected = `Invalid request: Registrations[1].Service.ID: "db-1" is already registered on node "bar"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogRegister_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -100,6 +336,161 @@ func TestCatalogRegister_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestCatalogBatchRegister(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.BatchRegisterRequest{
+		Datacenter: "dc1",
+	}
+	for i := 0; i < 100; i++ {
+		arg.Registrations = append(arg.Registrations, &structs.RegisterRequest{
+			Node:    fmt.Sprintf("node%d", i),
+			Address: fmt.Sprintf("10.0.0.%d", i),
+			Service: &structs.NodeService{
+				Service: "external",
+				Port:    8000,
+			},
+			Check: &structs.HealthCheck{
+				Name:      "external check",
+				Status:    structs.HealthPassing,
+				ServiceID: "external",
+			},
+		})
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.BatchRegister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Everything should land at one index
+	state := s1.fsm.State()
+	idx, nodes, err := state.CheckServiceNodes("external")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 100 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	for _, node := range nodes {
+		if node.Service.CreateIndex != idx || len(node.Checks) != 1 ||
+			node.Checks[0].CheckID != "external check" {
+			t.Fatalf("bad: %v", node)
+		}
+	}
+}
+
+func TestCatalogBatchRegister_Invalid(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	var out struct{}
+	arg := structs.BatchRegisterRequest{
+		Datacenter: "dc1",
+	}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.BatchRegister", &arg, &out)
+	if err == nil || err.Error() != "Invalid request: Registrations: must be provided" {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Problems are reported against each registration, and nothing is
+	// applied
+	arg.Registrations = []*structs.RegisterRequest{
+		&structs.RegisterRequest{
+			Node:    "foo",
+			Address: "127.0.0.1",
+		},
+		&structs.RegisterRequest{
+			Node: "bar",
+			Service: &structs.NodeService{
+				ID: "db",
+			},
+		},
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.BatchRegister", &arg, &out)
+	expected := "Invalid request: Registrations[1].Address: must be provided; " +
+		"Registrations[1].Service.Service: must be provided with Service.ID"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err := s1.fsm.State().GetNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != nil {
+		t.Fatalf("bad: %v", node)
+	}
+}
+
+func TestCatalogBatchRegister_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create the ACL
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testRegisterRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := out
+
+	// One denied service fails the whole batch
+	argR := structs.BatchRegisterRequest{
+		Datacenter: "dc1",
+		Registrations: []*structs.RegisterRequest{
+			&structs.RegisterRequest{
+				Node:    "foo",
+				Address: "127.0.0.1",
+				Service: &structs.NodeService{Service: "foo"},
+			},
+			&structs.RegisterRequest{
+				Node:    "bar",
+				Address: "127.0.0.2",
+				Service: &structs.NodeService{Service: "db"},
+			},
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var outR struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.BatchRegister", &argR, &outR)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	argR.Registrations[1].Service.Service = "foo"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.BatchRegister", &argR, &outR); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogRegister_ForwardLeader(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -183,6 +574,83 @@ func TestCatalogRegister_ForwardDC(t *testing.T) {
 	}
 }
 
+func TestCatalogUpdateChecks(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a node with a service and two checks
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+		},
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{CheckID: "a", Name: "a", Status: structs.HealthCritical, ServiceID: "db"},
+			&structs.HealthCheck{CheckID: "b", Name: "b", Status: structs.HealthCritical},
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Update both checks in one go
+	update := structs.ChecksUpdateRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{CheckID: "a", Name: "a", Status: structs.HealthPassing, ServiceID: "db"},
+			&structs.HealthCheck{CheckID: "b", Name: "b", Status: structs.HealthWarning, Output: "slow"},
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.UpdateChecks", &update, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state := s1.fsm.State()
+	_, checks, err := state.NodeChecks("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 2 {
+		t.Fatalf("bad: %v", checks)
+	}
+	for _, check := range checks {
+		switch check.CheckID {
+		case "a":
+			if check.Status != structs.HealthPassing {
+				t.Fatalf("bad: %v", check)
+			}
+		case "b":
+			if check.Status != structs.HealthWarning || check.Output != "slow" {
+				t.Fatalf("bad: %v", check)
+			}
+		}
+	}
+
+	// Checks for unknown services are rejected
+	update.Checks[0].ServiceID = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.UpdateChecks", &update, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown service") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So are unknown nodes
+	update.Node = "bar"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.UpdateChecks", &update, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown node") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogDeregister(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -208,6 +676,89 @@ func TestCatalogDeregister(t *testing.T) {
 	}
 }
 
+func TestCatalogDrain(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Draining an unknown instance fails.
+	drain := structs.ServiceDrainRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "nope",
+		Draining:   true,
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Drain", &drain, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown service") {
+		t.Fatalf("err: %v", err)
+	}
+
+	drain.ServiceID = "db"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Drain", &drain, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The catalog still has both instances.
+	catReq := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var catOut structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &catReq, &catOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(catOut.ServiceNodes) != 2 {
+		t.Fatalf("bad: %v", catOut.ServiceNodes)
+	}
+	for _, sn := range catOut.ServiceNodes {
+		if sn.ServiceDraining != (sn.Node == "foo") {
+			t.Fatalf("bad: %#v", sn)
+		}
+	}
+
+	// Health queries leave out the draining one.
+	var healthOut structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &catReq, &healthOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(healthOut.Nodes) != 1 || healthOut.Nodes[0].Node.Node != "bar" {
+		t.Fatalf("bad: %v", healthOut.Nodes)
+	}
+
+	// Put it back into service.
+	drain.Draining = false
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Drain", &drain, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &catReq, &healthOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(healthOut.Nodes) != 2 {
+		t.Fatalf("bad: %v", healthOut.Nodes)
+	}
+}
+
 func TestCatalogListDatacenters(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -296,6 +847,50 @@ func TestCatalogListDatacenters_DistanceSort(t *testing.T) {
 	}
 }
 
+func TestCatalogDatacenterInfo(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	var out []structs.DatacenterInfo
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.DatacenterInfo", struct{}{}, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The local DC comes first, and is zero distance away.
+	if len(out) != 2 || out[0].Datacenter != "dc1" || out[1].Datacenter != "dc2" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out[0].RTT != 0 {
+		t.Fatalf("bad: %#v", out[0])
+	}
+	vsn := int(s1.config.ProtocolVersion)
+	for _, info := range out {
+		if info.Servers != 1 || info.ProtocolMin != vsn || info.ProtocolMax != vsn {
+			t.Fatalf("bad: %#v", info)
+		}
+		for _, coord := range info.Coordinates {
+			if strings.Contains(coord.Node, ".") {
+				t.Fatalf("bad: %#v", coord)
+			}
+		}
+	}
+}
+
 func TestCatalogListNodes(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -338,6 +933,95 @@ func TestCatalogListNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogListNodes_MetaFilter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a node with some metadata
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		NodeMeta:   map[string]string{"rack": "r1", "class": "ssd"},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the matching node should come back
+	args := structs.DCSpecificRequest{
+		Datacenter:      "dc1",
+		NodeMetaFilters: map[string]string{"rack": "r1"},
+	}
+	var nodes structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0].Node != "foo" ||
+		!reflect.DeepEqual(nodes.Nodes[0].Meta, arg.NodeMeta) {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Every filter has to match
+	args.NodeMetaFilters["class"] = "hdd"
+	nodes = structs.IndexedNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestCatalogListNodes_Filter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"rack": node + "-rack"},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the matching node should come back
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		Filter:     "Meta.rack == bar-rack",
+	}
+	var nodes structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0].Node != "bar" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// A bad filter is rejected
+	args.Filter = "Rack == bar-rack"
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes)
+	if err == nil || err.Error() != `Invalid request: Filter: unknown field "Rack"` {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogListNodes_StaleRaad(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -504,6 +1188,73 @@ func TestCatalogListNodes_ConsistentRead(t *testing.T) {
 	}
 }
 
+func TestCatalogListNodes_FollowerConsistentRead(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.FollowerConsistentReads = true
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	codec := rpcClient(t, s2)
+	defer codec.Close()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+	if s2.IsLeader() {
+		t.Fatalf("s2 should be a follower")
+	}
+
+	// Register through the leader and read it right back from the
+	// follower, which must not miss the write.
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var regOut struct{}
+	if err := s1.RPC("Catalog.Register", &reg, &regOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{RequireConsistent: true},
+	}
+	var out structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	found := false
+	for _, n := range out.Nodes {
+		if n.Node == "foo" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("failed to find foo")
+	}
+
+	// The query ran on the follower rather than being forwarded.
+	if out.QueryMeta.LastContact == 0 {
+		t.Fatalf("should have a last contact time")
+	}
+	if !out.QueryMeta.KnownLeader {
+		t.Fatalf("should have known leader")
+	}
+}
+
 func TestCatalogListNodes_DistanceSort(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -665,6 +1416,57 @@ func TestCatalogListServices(t *testing.T) {
 	}
 }
 
+func TestCatalogListServices_Summaries(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Add a service with a failing check
+	if err := s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.State().EnsureCheck(3, &structs.HealthCheck{Node: "foo", CheckID: "db", ServiceID: "db", Status: structs.HealthCritical}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Summaries are left out unless they're asked for.
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedServices
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Services) != 2 || out.Summaries != nil {
+		t.Fatalf("bad: %v", out)
+	}
+
+	args.Summaries = true
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Services) != 2 || len(out.Summaries) != 2 {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(out.Services["db"]) != 1 || out.Services["db"][0] != "primary" {
+		t.Fatalf("bad: %v", out)
+	}
+	db := out.Summaries["db"]
+	if db == nil || db.Instances != 1 || db.Critical != 1 || db.Passing != 0 {
+		t.Fatalf("bad: %#v", db)
+	}
+	if consul := out.Summaries["consul"]; consul == nil || consul.Instances != 1 || consul.Passing != 1 {
+		t.Fatalf("bad: %#v", consul)
+	}
+}
+
 func TestCatalogListServices_Blocking(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -801,52 +1603,198 @@ func TestCatalogListServices_Stale(t *testing.T) {
 	}
 }
 
-func TestCatalogListServiceNodes(t *testing.T) {
+func TestCatalogListServiceNodes(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	args := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+		ServiceTag:  "slave",
+		TagFilter:   false,
+	}
+	var out structs.IndexedServiceNodes
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out)
+	if err == nil || err.Error() != "No cluster leader" {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Just add a node
+	if err := s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(out.ServiceNodes) != 1 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Try with a filter
+	args.TagFilter = true
+	out = structs.IndexedServiceNodes{}
+
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.ServiceNodes) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestCatalogListServiceNodes_MetaFilter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register the same service on two nodes in different racks
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"rack": node + "-rack"},
+			Service: &structs.NodeService{
+				Service: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the instance in the matching rack should come back
+	args := structs.ServiceSpecificRequest{
+		Datacenter:      "dc1",
+		ServiceName:     "db",
+		NodeMetaFilters: map[string]string{"rack": "bar-rack"},
+	}
+	var out structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.ServiceNodes) != 1 || out.ServiceNodes[0].Node != "bar" ||
+		out.ServiceNodes[0].NodeMeta["rack"] != "bar-rack" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestCatalogListServiceNodes_SourceAndRegisteredAt(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	start := time.Now()
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Source:  structs.ServiceSourceExternal,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out2 structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out2.ServiceNodes) != 1 ||
+		out2.ServiceNodes[0].ServiceSource != structs.ServiceSourceExternal ||
+		out2.ServiceNodes[0].ServiceRegisteredAt.Before(start) {
+		t.Fatalf("bad: %v", out2)
+	}
+	registered := out2.ServiceNodes[0].ServiceRegisteredAt
+
+	// Registering again updates the source but keeps the original time,
+	// and the source defaults to the catalog.
+	time.Sleep(10 * time.Millisecond)
+	arg.Service.Source = ""
+	arg.Service.Port = 8000
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out3 structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &args, &out3); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out3.Nodes) != 1 || out3.Nodes[0].Service.Port != 8000 ||
+		out3.Nodes[0].Service.Source != structs.ServiceSourceCatalog ||
+		!out3.Nodes[0].Service.RegisteredAt.Equal(registered) {
+		t.Fatalf("bad: %v", out3)
+	}
+}
+
+func TestCatalogListServiceNodes_ServiceMeta(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 	codec := rpcClient(t, s1)
 	defer codec.Close()
 
-	args := structs.ServiceSpecificRequest{
-		Datacenter:  "dc1",
-		ServiceName: "db",
-		ServiceTag:  "slave",
-		TagFilter:   false,
-	}
-	var out structs.IndexedServiceNodes
-	err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out)
-	if err == nil || err.Error() != "No cluster leader" {
-		t.Fatalf("err: %v", err)
-	}
-
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	// Just add a node
-	if err := s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Meta:    map[string]string{"version": "1.2.3", "team": "storage"},
+		},
 	}
-	if err := s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000}); err != nil {
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+	args := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out2 structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out2); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-
-	if len(out.ServiceNodes) != 1 {
-		t.Fatalf("bad: %v", out)
+	if len(out2.ServiceNodes) != 1 ||
+		!reflect.DeepEqual(out2.ServiceNodes[0].ServiceMeta, arg.Service.Meta) {
+		t.Fatalf("bad: %v", out2)
 	}
 
-	// Try with a filter
-	args.TagFilter = true
-	out = structs.IndexedServiceNodes{}
-
-	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+	var out3 structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &args, &out3); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if len(out.ServiceNodes) != 0 {
-		t.Fatalf("bad: %v", out)
+	if len(out3.Nodes) != 1 ||
+		!reflect.DeepEqual(out3.Nodes[0].Service.Meta, arg.Service.Meta) {
+		t.Fatalf("bad: %v", out3)
 	}
 }
 
@@ -937,6 +1885,178 @@ func TestCatalogListServiceNodes_DistanceSort(t *testing.T) {
 	}
 }
 
+func TestCatalogSubscribe(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register an instance.
+	if err := s1.fsm.State().EnsureNode(100, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.State().EnsureService(101, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 5000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first request gets the full list.
+	args := structs.ServiceSubscribeRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out structs.IndexedServiceEvents
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Subscribe", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Reset || len(out.Events) != 1 || out.Events[0].Op != structs.ServiceEventAdd ||
+		out.Events[0].Instance.Service.Port != 5000 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Setup a blocking subscription
+	args.Since = out.LastSeq
+	args.MinQueryIndex = out.Index
+	args.MaxQueryTime = time.Second
+
+	// Async change another service, and then this one. Only the second
+	// change should wake the subscriber.
+	idx := out.Index
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := s1.fsm.State().EnsureService(idx+1, "foo", &structs.NodeService{ID: "web", Service: "web", Port: 80}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := s1.fsm.State().EnsureService(idx+2, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 5001}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}()
+
+	out = structs.IndexedServiceEvents{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Subscribe", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should block at least 200ms
+	if time.Now().Sub(start) < 200*time.Millisecond {
+		t.Fatalf("too fast")
+	}
+	if out.Index != idx+2 || out.Reset || len(out.Events) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if e := out.Events[0]; e.Op != structs.ServiceEventUpdate || e.Instance.Service.Port != 5001 {
+		t.Fatalf("bad: %#v", e)
+	}
+}
+
+func TestCatalogSubscribe_Denied(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The anonymous token can't read the service.
+	args := structs.ServiceSubscribeRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out structs.IndexedServiceEvents
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Subscribe", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can.
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Subscribe", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogServiceNodesMultiDC(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Register the service in both datacenters
+	for i, srv := range []*Server{s1, s2} {
+		node := fmt.Sprintf("node%d", i+1)
+		if err := srv.fsm.State().EnsureNode(100, &structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := srv.fsm.State().EnsureService(101, node, &structs.NodeService{ID: "db", Service: "db", Port: 5000}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Every datacenter is queried by default
+	args := structs.MultiDCServiceRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out structs.IndexedMultiDCServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodesMultiDC", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.ServiceNodes) != 2 ||
+		out.ServiceNodes[0].Datacenter != "dc1" || out.ServiceNodes[0].Node != "node1" ||
+		out.ServiceNodes[1].Datacenter != "dc2" || out.ServiceNodes[1].Node != "node2" {
+		t.Fatalf("bad: %v", out.ServiceNodes)
+	}
+	if len(out.Datacenters) != 2 || out.Datacenters[0].Index != 101 ||
+		out.Datacenters[1].Index != 101 || !out.KnownLeader {
+		t.Fatalf("bad: %v", out.Datacenters)
+	}
+
+	// An unknown datacenter is reported without failing the rest
+	args.Datacenters = []string{"dc2", "dc3"}
+	out = structs.IndexedMultiDCServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodesMultiDC", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.ServiceNodes) != 1 || out.ServiceNodes[0].Datacenter != "dc2" {
+		t.Fatalf("bad: %v", out.ServiceNodes)
+	}
+	if len(out.Datacenters) != 2 || out.Datacenters[0].Error != "" ||
+		out.Datacenters[1].Datacenter != "dc3" || out.Datacenters[1].Error == "" || out.KnownLeader {
+		t.Fatalf("bad: %v", out.Datacenters)
+	}
+
+	// A service name is required
+	args.ServiceName = ""
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodesMultiDC", &args, &out)
+	if err == nil || err.Error() != "Must provide service name" {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogNodeServices(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -986,6 +2106,126 @@ func TestCatalogNodeServices(t *testing.T) {
 	}
 }
 
+func TestCatalogNodeDelta(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	args := structs.NodeDeltaRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedNodeDelta
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.NodeDelta", &args, &out)
+	if err == nil || err.Error() != "Must provide node" {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Register a node with a service.
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Port:    8000,
+		},
+	}
+	var ignored struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &reg, &ignored); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first read gets everything.
+	args.Node = "foo"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.NodeDelta", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	delta := out.NodeDelta
+	if !delta.Reset || delta.Node == nil || delta.Node.Address != "127.0.0.1" ||
+		len(delta.Services) != 1 || delta.Services[0].ID != "db" {
+		t.Fatalf("bad: %#v", delta)
+	}
+
+	// Later reads only get what changed.
+	reg.Service = &structs.NodeService{Service: "web", Port: 80}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &reg, &ignored); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args.Since = out.Index
+	var out2 structs.IndexedNodeDelta
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.NodeDelta", &args, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	delta = out2.NodeDelta
+	if delta.Reset || out2.Index <= out.Index ||
+		len(delta.Services) != 1 || delta.Services[0].ID != "web" {
+		t.Fatalf("bad: %#v", delta)
+	}
+}
+
+func TestCatalogNodeByAddress(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	args := structs.AddressSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedAddressNodes
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.NodeByAddress", &args, &out)
+	if err == nil || err.Error() != "Must provide address" {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.State().EnsureNode(2, &structs.Node{Node: "bar", Address: "127.0.0.3"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.State().EnsureService(3, "bar", &structs.NodeService{ID: "web", Service: "web", Address: "127.0.0.2", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Address = "127.0.0.2"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.NodeByAddress", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != 3 {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(out.Services) != 1 || out.Services[0].Node != "bar" || out.Services[0].ServicePort != 80 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestCatalog_Workload(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for seed := int64(1); seed <= 3; seed++ {
+		w := testutil.NewWorkload("dc1", seed)
+		w.Prefix = fmt.Sprintf("wl%d-", seed)
+		if err := w.Run(s1.RPC, 200); err != nil {
+			t.Fatalf("err: %v\nhistory: %v", err, w.History())
+		}
+	}
+}
+
 // Used to check for a regression against a known bug
 func TestCatalogRegister_FailedCase1(t *testing.T) {
 	dir1, s1 := testServer(t)
@@ -1196,6 +2436,46 @@ func TestCatalog_NodeServices_FilterACL(t *testing.T) {
 	}
 }
 
+func TestCatalog_Dump_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	opt := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedCatalogDump{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Dump", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	found := false
+	for _, sn := range reply.Dump.Services {
+		if sn.ServiceID == "bar" {
+			t.Fatalf("bad: %#v", reply.Dump.Services)
+		}
+		if sn.ServiceID == "foo" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %#v", reply.Dump.Services)
+	}
+	found = false
+	for _, check := range reply.Dump.Checks {
+		if check.CheckID == "service:bar" {
+			t.Fatalf("bad: %#v", reply.Dump.Checks)
+		}
+		if check.CheckID == "service:foo" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %#v", reply.Dump.Checks)
+	}
+}
+
 var testRegisterRules = `
 service "foo" {
 	policy = "write"
@@ -191,6 +191,34 @@ func TestClient_RPC(t *testing.T) {
 	})
 }
 
+func TestClient_RPC_EmptyDatacenter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, c1 := testClient(t)
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, c1.RPC, "dc1")
+
+	// A request without a datacenter should be served by the local one.
+	args := structs.DCSpecificRequest{}
+	var out structs.IndexedNodes
+	if err := c1.RPC("Catalog.ListNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Datacenter != "dc1" {
+		t.Fatalf("bad: %v", out.Datacenter)
+	}
+}
+
 func TestClient_RPC_Pool(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -0,0 +1,147 @@
+// Package clock provides the time source used by the server's timers.
+// Servers use the real clock, but tests and embedders can swap in a
+// Manual clock and advance it themselves instead of sleeping.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the subset of the time package used for timers
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by AfterFunc
+type Timer interface {
+	// Reset changes the timer to expire after the duration, returning
+	// true if it was still active.
+	Reset(d time.Duration) bool
+
+	// Stop prevents the timer from firing, returning true if it was
+	// still active.
+	Stop() bool
+}
+
+// Real is a Clock backed by the time package
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Manual is a Clock that only moves forward when Advance is called. Timers
+// that come due are fired in order on the goroutine calling Advance, so
+// once it returns their effects have happened.
+type Manual struct {
+	now    time.Time
+	timers []*manualTimer
+	lock   sync.Mutex
+}
+
+// manualTimer is a pending timer on a Manual clock
+type manualTimer struct {
+	clock *Manual
+	when  time.Time
+	f     func()
+}
+
+// NewManual returns a Manual clock starting at the given time
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+func (m *Manual) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.now
+}
+
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	m.AfterFunc(d, func() {
+		ch <- m.Now()
+	})
+	return ch
+}
+
+func (m *Manual) AfterFunc(d time.Duration, f func()) Timer {
+	t := &manualTimer{clock: m, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by the given duration, firing any
+// timers that come due along the way.
+func (m *Manual) Advance(d time.Duration) {
+	m.lock.Lock()
+	end := m.now.Add(d)
+	for len(m.timers) > 0 && !m.timers[0].when.After(end) {
+		t := m.timers[0]
+		m.timers = m.timers[1:]
+		m.now = t.when
+
+		// Fire without the lock so the timer can use the clock.
+		m.lock.Unlock()
+		t.f()
+		m.lock.Lock()
+	}
+	m.now = end
+	m.lock.Unlock()
+}
+
+// remove takes the timer out of the pending list, returning true if it
+// was there. The lock must be held.
+func (m *Manual) remove(t *manualTimer) bool {
+	for i, pending := range m.timers {
+		if pending == t {
+			m.timers = append(m.timers[:i], m.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	m := t.clock
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	active := m.remove(t)
+	t.when = m.now.Add(d)
+	m.timers = append(m.timers, t)
+	sort.Stable(byWhen(m.timers))
+	return active
+}
+
+func (t *manualTimer) Stop() bool {
+	m := t.clock
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.remove(t)
+}
+
+// byWhen sorts timers by when they're due
+type byWhen []*manualTimer
+
+func (b byWhen) Len() int           { return len(b) }
+func (b byWhen) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byWhen) Less(i, j int) bool { return b[i].when.Before(b[j].when) }
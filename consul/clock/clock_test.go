@@ -0,0 +1,90 @@
+package clock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManual_AfterFunc(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewManual(start)
+
+	var fired []string
+	m.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	m.AfterFunc(1*time.Second, func() { fired = append(fired, "a") })
+	stopped := m.AfterFunc(1500*time.Millisecond, func() { fired = append(fired, "x") })
+	if !stopped.Stop() {
+		t.Fatalf("should have been active")
+	}
+
+	// Nothing is due yet
+	m.Advance(999 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Fatalf("bad: %v", fired)
+	}
+
+	// Timers should fire in order, and the stopped one not at all
+	m.Advance(5 * time.Second)
+	if !reflect.DeepEqual(fired, []string{"a", "b"}) {
+		t.Fatalf("bad: %v", fired)
+	}
+	if now := m.Now(); !now.Equal(start.Add(5999 * time.Millisecond)) {
+		t.Fatalf("bad: %v", now)
+	}
+	if stopped.Stop() {
+		t.Fatalf("should not be active")
+	}
+}
+
+func TestManual_Reset(t *testing.T) {
+	m := NewManual(time.Unix(1000, 0))
+
+	fired := 0
+	timer := m.AfterFunc(time.Second, func() { fired++ })
+
+	// Pushing the timer back should keep it from firing
+	m.Advance(900 * time.Millisecond)
+	if !timer.Reset(time.Second) {
+		t.Fatalf("should have been active")
+	}
+	m.Advance(900 * time.Millisecond)
+	if fired != 0 {
+		t.Fatalf("bad: %d", fired)
+	}
+	m.Advance(100 * time.Millisecond)
+	if fired != 1 {
+		t.Fatalf("bad: %d", fired)
+	}
+
+	// A fired timer can be reset to fire again
+	if timer.Reset(time.Second) {
+		t.Fatalf("should not be active")
+	}
+	m.Advance(time.Second)
+	if fired != 2 {
+		t.Fatalf("bad: %d", fired)
+	}
+}
+
+func TestManual_After(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewManual(start)
+
+	ch := m.After(time.Second)
+	select {
+	case <-ch:
+		t.Fatalf("should not fire")
+	default:
+	}
+
+	m.Advance(time.Second)
+	select {
+	case now := <-ch:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("bad: %v", now)
+		}
+	default:
+		t.Fatalf("should fire")
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"time"
 
+	"github.com/hashicorp/consul/consul/clock"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
@@ -128,6 +130,14 @@ type Config struct {
 	// provide matches the certificate
 	ServerName string
 
+	// TLSBootstrap has the servers issue their own RPC certificates. A
+	// server in Bootstrap mode creates a certificate authority, and other
+	// servers ask it for a certificate over Serf once they join, which is
+	// encrypted with the gossip key. The files are kept under the DataDir
+	// and fill in for CAFile, CertFile, and KeyFile when those are unset.
+	// A server that is issued a certificate uses it after a restart.
+	TLSBootstrap bool
+
 	// RejoinAfterLeave controls our interaction with Serf.
 	// When set to false (default), a leave causes a Consul to not rejoin
 	// the cluster until an explicit join is received. If this is set to
@@ -196,6 +206,68 @@ type Config struct {
 	// Minimum Session TTL
 	SessionTTLMin time.Duration
 
+	// ReapLockGracePeriod delays reaping a failed node while any of its
+	// sessions hold locks, giving the node a chance to come back before
+	// its locks are released. Once the period is up the node is reaped,
+	// which invalidates its sessions in the same transaction. Zero reaps
+	// such nodes right away.
+	ReapLockGracePeriod time.Duration
+
+	// KVSRecycleRetention is how long trees deleted from the KV store are
+	// kept in the recycle bin so they can be restored. Zero disables the
+	// recycle bin, and deleted trees are gone for good.
+	KVSRecycleRetention time.Duration
+
+	// KVSMaxValueSize is the largest KV value the servers accept. Values
+	// larger than a single Raft entry can carry are split into chunks
+	// that are written one at a time, and the key only changes once the
+	// last one is in.
+	KVSMaxValueSize int
+
+	// KVSCompressThreshold is the size, in bytes, above which KV values
+	// are gzipped before they are written to Raft. They are decompressed
+	// again when read. Zero disables compression.
+	KVSCompressThreshold int
+
+	// KVSEncryptionKey is an AES key used to encrypt the values of keys
+	// under KVSEncryptPrefixes before they are written to Raft, so they
+	// are never stored in the clear on disk. It must be the same on all
+	// servers, and it is only ever held in memory.
+	KVSEncryptionKey []byte
+
+	// KVSEncryptPrefixes are the KV prefixes whose values are encrypted
+	// when KVSEncryptionKey is set.
+	KVSEncryptPrefixes []string
+
+	// KVSQuotas limit what can be written under each top-level KV prefix,
+	// keyed by the prefix. The quota under "*" applies to every prefix
+	// that doesn't have its own.
+	KVSQuotas map[string]structs.KVSQuota
+
+	// KVSEvents maps KV prefixes to the name of a user event the leader
+	// fires for every write under them, with a KVSChangeEvent as the
+	// payload.
+	KVSEvents map[string]string
+
+	// FollowerConsistentReads allows followers to serve RequireConsistent
+	// reads themselves. The follower asks the leader for its read index,
+	// which the leader confirms by verifying its leadership, and then
+	// waits until its own FSM has applied up to that index before running
+	// the query. This spreads consistent reads across the servers at the
+	// cost of an extra round trip to the leader per read.
+	FollowerConsistentReads bool
+
+	// RejectDuplicateServiceIDs makes catalog registrations fail if the
+	// service ID is already registered on a different node. IDs only have
+	// to be unique on each node, but a clash across nodes is usually a
+	// copy-pasted service definition overwriting the wrong entry.
+	RejectDuplicateServiceIDs bool
+
+	// AuthorizationHook, if set, is consulted after every ACL decision
+	// the server makes. See AuthorizationHook for details. It can only
+	// be set by programs embedding the server, not from agent config.
+	AuthorizationHook AuthorizationHook
+
 	// ServerUp callback can be used to trigger a notification that
 	// a Consul server is now up and known about.
 	ServerUp func()
@@ -221,6 +293,27 @@ type Config struct {
 	// are willing to apply in one period. After this limit we will issue a
 	// warning and discard the remaining updates.
 	CoordinateUpdateMaxBatches int
+
+	// AdaptiveCoordinateUpdates scales the coordinate update settings above
+	// with the size of the cluster. Small clusters wait longer between
+	// updates so each Raft transaction carries more coordinates, and large
+	// clusters are allowed enough batches to take an update from every
+	// node in each period.
+	AdaptiveCoordinateUpdates bool
+
+	// ExternalChecker volunteers this agent to run the checks of external
+	// services. It's advertised to the leader with a Serf tag.
+	ExternalChecker bool
+
+	// CapacityThresholds are checked by the leader each time it reconciles.
+	// Crossing one logs a warning and shows up in Operator.CapacityStatus,
+	// giving notice before the state store gets too big for the servers.
+	CapacityThresholds structs.CapacityThresholds
+
+	// Clock is used for the timers behind session TTLs, tombstone GC and
+	// coordinate batching. It defaults to the real clock, and tests can
+	// supply a clock.Manual to advance time without sleeping.
+	Clock clock.Clock
 }
 
 // CheckVersion is used to check if the ProtocolVersion is valid
@@ -275,6 +368,7 @@ func DefaultConfig() *Config {
 		TombstoneTTL:            15 * time.Minute,
 		TombstoneTTLGranularity: 30 * time.Second,
 		SessionTTLMin:           10 * time.Second,
+		KVSMaxValueSize:         512 * 1024,
 		DisableCoordinates:      false,
 
 		// These are tuned to provide a total throughput of 128 updates
@@ -11,6 +11,12 @@ import (
 	"github.com/hashicorp/serf/coordinate"
 )
 
+const (
+	// coordinateMaxStretch caps how many times longer than the configured
+	// period adaptive updates will wait between batches in a small cluster.
+	coordinateMaxStretch = 4
+)
+
 // Coordinate manages queries and updates for network coordinates.
 type Coordinate struct {
 	// srv is a pointer back to the server.
@@ -35,14 +41,18 @@ func NewCoordinate(srv *Server) *Coordinate {
 }
 
 // batchUpdate is a long-running routine that flushes pending coordinates to the
-// Raft log in batches.
+// Raft log in batches. The settings are worked out again at each flush, and
+// the period from them is used to wait for the next one.
 func (c *Coordinate) batchUpdate() {
+	period := c.srv.config.CoordinateUpdatePeriod
 	for {
 		select {
-		case <-time.After(c.srv.config.CoordinateUpdatePeriod):
-			if err := c.batchApplyUpdates(); err != nil {
+		case <-c.srv.config.Clock.After(period):
+			settings := c.updateSettings()
+			if err := c.batchApplyUpdates(settings); err != nil {
 				c.srv.logger.Printf("[WARN] consul.coordinate: Batch update failed: %v", err)
 			}
+			period = settings.Period
 		case <-c.srv.shutdownCh:
 			return
 		}
@@ -51,7 +61,7 @@ func (c *Coordinate) batchUpdate() {
 
 // batchApplyUpdates applies all pending updates to the Raft log in a series of
 // batches.
-func (c *Coordinate) batchApplyUpdates() error {
+func (c *Coordinate) batchApplyUpdates(settings *structs.CoordinateUpdateSettings) error {
 	// Grab the pending updates and release the lock so we can still handle
 	// incoming messages.
 	c.updatesLock.Lock()
@@ -60,7 +70,7 @@ func (c *Coordinate) batchApplyUpdates() error {
 	c.updatesLock.Unlock()
 
 	// Enforce the rate limit.
-	limit := c.srv.config.CoordinateUpdateBatchSize * c.srv.config.CoordinateUpdateMaxBatches
+	limit := settings.BatchSize * settings.MaxBatches
 	size := len(pending)
 	if size > limit {
 		c.srv.logger.Printf("[WARN] consul.coordinate: Discarded %d coordinate updates", size-limit)
@@ -81,8 +91,8 @@ func (c *Coordinate) batchApplyUpdates() error {
 	}
 
 	// Apply the updates to the Raft log in batches.
-	for start := 0; start < size; start += c.srv.config.CoordinateUpdateBatchSize {
-		end := start + c.srv.config.CoordinateUpdateBatchSize
+	for start := 0; start < size; start += settings.BatchSize {
+		end := start + settings.BatchSize
 		if end > size {
 			end = size
 		}
@@ -99,6 +109,59 @@ func (c *Coordinate) batchApplyUpdates() error {
 	return nil
 }
 
+// updateSettings returns the settings to batch updates with, scaled to the
+// current size of the LAN pool if adaptive updates are enabled.
+func (c *Coordinate) updateSettings() *structs.CoordinateUpdateSettings {
+	settings := &structs.CoordinateUpdateSettings{
+		Adaptive:    c.srv.config.AdaptiveCoordinateUpdates,
+		ClusterSize: c.srv.serfLAN.NumNodes(),
+		Period:      c.srv.config.CoordinateUpdatePeriod,
+		BatchSize:   c.srv.config.CoordinateUpdateBatchSize,
+		MaxBatches:  c.srv.config.CoordinateUpdateMaxBatches,
+	}
+	if settings.Adaptive {
+		scaleCoordinateUpdates(settings)
+	}
+	return settings
+}
+
+// scaleCoordinateUpdates adapts the given settings to the cluster size.
+// Pending updates are kept per node, so there are never more than
+// ClusterSize of them. Clusters smaller than a batch stretch the period so
+// each batch is fuller, and larger clusters get enough batches to apply an
+// update from every node without discarding any.
+func scaleCoordinateUpdates(settings *structs.CoordinateUpdateSettings) {
+	n := settings.ClusterSize
+	if n < 1 {
+		n = 1
+	}
+
+	if n < settings.BatchSize {
+		stretch := settings.BatchSize / n
+		if stretch > coordinateMaxStretch {
+			stretch = coordinateMaxStretch
+		}
+		settings.Period *= time.Duration(stretch)
+	}
+
+	batches := (n + settings.BatchSize - 1) / settings.BatchSize
+	if batches > settings.MaxBatches {
+		settings.MaxBatches = batches
+	}
+}
+
+// UpdateSettings returns the settings coordinate updates are being batched
+// with. Updates are batched on the leader, so unless a stale read is
+// allowed these are the leader's settings.
+func (c *Coordinate) UpdateSettings(args *structs.DCSpecificRequest, reply *structs.CoordinateUpdateSettings) error {
+	if done, err := c.srv.forward("Coordinate.UpdateSettings", args, args, reply); done {
+		return err
+	}
+
+	*reply = *c.updateSettings()
+	return nil
+}
+
 // Update inserts or updates the LAN coordinate of a node.
 func (c *Coordinate) Update(args *structs.CoordinateUpdateRequest, reply *struct{}) (err error) {
 	if done, err := c.srv.forward("Coordinate.Update", args, args, reply); done {
@@ -161,7 +224,7 @@ func (c *Coordinate) ListNodes(args *structs.DCSpecificRequest, reply *structs.I
 	state := c.srv.fsm.State()
 	return c.srv.blockingRPC(&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("Coordinates"),
+		queryWatch(state, "Coordinates"),
 		func() error {
 			index, coords, err := state.Coordinates()
 			if err != nil {
@@ -187,6 +187,79 @@ func TestCoordinate_Update(t *testing.T) {
 	}
 }
 
+func TestCoordinate_ScaleUpdates(t *testing.T) {
+	base := structs.CoordinateUpdateSettings{
+		Adaptive:   true,
+		Period:     5 * time.Second,
+		BatchSize:  128,
+		MaxBatches: 5,
+	}
+
+	cases := []struct {
+		size       int
+		period     time.Duration
+		maxBatches int
+	}{
+		// Tiny clusters stretch the period as far as allowed.
+		{0, 20 * time.Second, 5},
+		{3, 20 * time.Second, 5},
+
+		// Smaller than a batch stretches it a little.
+		{50, 10 * time.Second, 5},
+
+		// In between, the configured settings are used as-is.
+		{128, 5 * time.Second, 5},
+		{640, 5 * time.Second, 5},
+
+		// Big clusters get enough batches for every node.
+		{641, 5 * time.Second, 6},
+		{10000, 5 * time.Second, 79},
+	}
+	for _, tc := range cases {
+		settings := base
+		settings.ClusterSize = tc.size
+		scaleCoordinateUpdates(&settings)
+		if settings.Period != tc.period || settings.MaxBatches != tc.maxBatches ||
+			settings.BatchSize != base.BatchSize {
+			t.Fatalf("bad: %d %#v", tc.size, settings)
+		}
+	}
+}
+
+func TestCoordinate_UpdateSettings(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CoordinateUpdatePeriod = 100 * time.Millisecond
+		c.CoordinateUpdateBatchSize = 10
+		c.CoordinateUpdateMaxBatches = 1
+		c.AdaptiveCoordinateUpdates = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A single server is a tiny cluster, so the period should stretch.
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.CoordinateUpdateSettings
+	if err := msgpackrpc.CallWithCodec(codec, "Coordinate.UpdateSettings", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := structs.CoordinateUpdateSettings{
+		Adaptive:    true,
+		ClusterSize: 1,
+		Period:      400 * time.Millisecond,
+		BatchSize:   10,
+		MaxBatches:  1,
+	}
+	if out != expected {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
 func TestCoordinate_ListDatacenters(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
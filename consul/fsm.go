@@ -91,6 +91,28 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 		return c.applyTombstoneOperation(buf[1:], log.Index)
 	case structs.CoordinateBatchUpdateType:
 		return c.applyCoordinateBatchUpdate(buf[1:], log.Index)
+	case structs.KVSRecycleRequestType:
+		return c.applyKVSRecycleOperation(buf[1:], log.Index)
+	case structs.BatchRegisterRequestType:
+		return c.applyBatchRegister(buf[1:], log.Index)
+	case structs.ServiceReapRequestType:
+		return c.applyServiceReap(buf[1:], log.Index)
+	case structs.KVSReapRequestType:
+		return c.applyKVSReap(buf[1:], log.Index)
+	case structs.KVSImportRequestType:
+		return c.applyKVSImport(buf[1:], log.Index)
+	case structs.KVSChunkRequestType:
+		return c.applyKVSChunk(buf[1:], log.Index)
+	case structs.KVSMoveRequestType:
+		return c.applyKVSMove(buf[1:], log.Index)
+	case structs.ServiceDrainRequestType:
+		return c.applyServiceDrain(buf[1:], log.Index)
+	case structs.MaintenanceWindowRequestType:
+		return c.applyMaintenanceWindowOperation(buf[1:], log.Index)
+	case structs.ManagedCheckRequestType:
+		return c.applyManagedCheckOperation(buf[1:], log.Index)
+	case structs.TxnRequestType:
+		return c.applyTxn(buf[1:], log.Index)
 	default:
 		if ignoreUnknown {
 			c.logger.Printf("[WARN] consul.fsm: ignoring unknown message type (%d), upgrade to newer version", msgType)
@@ -116,6 +138,20 @@ func (c *consulFSM) applyRegister(buf []byte, index uint64) interface{} {
 	return nil
 }
 
+func (c *consulFSM) applyBatchRegister(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "batch_register"}, time.Now())
+	var req structs.BatchRegisterRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.EnsureRegistrations(index, req.Registrations); err != nil {
+		c.logger.Printf("[INFO] consul.fsm: EnsureRegistrations failed: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (c *consulFSM) applyDeregister(buf []byte, index uint64) interface{} {
 	defer metrics.MeasureSince([]string{"consul", "fsm", "deregister"}, time.Now())
 	var req structs.DeregisterRequest
@@ -149,6 +185,17 @@ func (c *consulFSM) applyKVSOperation(buf []byte, index uint64) interface{} {
 		panic(fmt.Errorf("failed to decode request: %v", err))
 	}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs", string(req.Op)}, time.Now())
+
+	// Put a chunked value back together. The upload is used up even if
+	// the operation doesn't go through.
+	if req.ChunkID != "" {
+		value, err := c.state.KVSUploadComplete(index, req.ChunkID, req.Chunks)
+		if err != nil {
+			return err
+		}
+		req.DirEnt.Value = value
+	}
+
 	switch req.Op {
 	case structs.KVSSet:
 		return c.state.KVSSet(index, &req.DirEnt)
@@ -163,6 +210,13 @@ func (c *consulFSM) applyKVSOperation(buf []byte, index uint64) interface{} {
 		}
 	case structs.KVSDeleteTree:
 		return c.state.KVSDeleteTree(index, req.DirEnt.Key)
+	case structs.KVSDeleteTreeCAS:
+		act, err := c.state.KVSDeleteTreeCAS(index, req.DirEnt.ModifyIndex, req.DirEnt.Key)
+		if err != nil {
+			return err
+		} else {
+			return act
+		}
 	case structs.KVSCAS:
 		act, err := c.state.KVSSetCAS(index, &req.DirEnt)
 		if err != nil {
@@ -233,6 +287,58 @@ func (c *consulFSM) applyACLOperation(buf []byte, index uint64) interface{} {
 	}
 }
 
+func (c *consulFSM) applyMaintenanceWindowOperation(buf []byte, index uint64) interface{} {
+	var req structs.MaintenanceWindowRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "maintenance_window", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.MaintenanceWindowSet:
+		if err := c.state.MaintenanceWindowSet(index, &req.Window); err != nil {
+			return err
+		}
+		return req.Window.ID
+	case structs.MaintenanceWindowDelete:
+		return c.state.MaintenanceWindowDelete(index, req.Window.ID)
+	case structs.MaintenanceWindowEffect:
+		return c.state.MaintenanceWindowSetInEffect(index, req.Window.ID, req.Window.InEffect)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid maintenance window operation '%s'", req.Op)
+		return fmt.Errorf("Invalid maintenance window operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyManagedCheckOperation(buf []byte, index uint64) interface{} {
+	var req structs.ManagedCheckRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "managed_check", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ManagedCheckSet:
+		if err := c.state.ManagedCheckSet(index, &req.Check); err != nil {
+			return err
+		}
+		return req.Check.ID
+	case structs.ManagedCheckDelete:
+		return c.state.ManagedCheckDelete(index, req.Check.ID)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid managed check operation '%s'", req.Op)
+		return fmt.Errorf("Invalid managed check operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyTxn(buf []byte, index uint64) interface{} {
+	var req structs.TxnRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "txn"}, time.Now())
+	results, errs := c.state.TxnRW(index, req.Ops)
+	return structs.TxnResponse{Results: results, Errors: errs}
+}
+
 func (c *consulFSM) applyTombstoneOperation(buf []byte, index uint64) interface{} {
 	var req structs.TombstoneRequest
 	if err := structs.Decode(buf, &req); err != nil {
@@ -248,6 +354,95 @@ func (c *consulFSM) applyTombstoneOperation(buf []byte, index uint64) interface{
 	}
 }
 
+func (c *consulFSM) applyKVSRecycleOperation(buf []byte, index uint64) interface{} {
+	var req structs.KVSRecycleRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs_recycle", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.KVSRecycleTree:
+		if req.Recycled == nil {
+			return fmt.Errorf("Missing recycled tree")
+		}
+		return c.state.KVSRecycleTree(index, req.Recycled)
+	case structs.KVSRecycleTreeCAS:
+		if req.Recycled == nil {
+			return fmt.Errorf("Missing recycled tree")
+		}
+		act, err := c.state.KVSRecycleTreeCAS(index, req.CheckIndex, req.Recycled)
+		if err != nil {
+			return err
+		}
+		return act
+	case structs.KVSRecycleRestore:
+		return c.state.KVSRecycledRestore(index, req.ID)
+	case structs.KVSRecycleReap:
+		return c.state.KVSRecycledReap(index, req.ReapTime)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid KVS recycle operation '%s'", req.Op)
+		return fmt.Errorf("Invalid KVS recycle operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyServiceReap(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "service_reap"}, time.Now())
+	var req structs.ServiceReapRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	return c.state.ReapExpiredServices(index, req.ReapTime)
+}
+
+func (c *consulFSM) applyKVSReap(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs_reap"}, time.Now())
+	var req structs.KVSReapRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	return c.state.ReapExpiredKeys(index, req.ReapTime)
+}
+
+func (c *consulFSM) applyKVSImport(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs_import"}, time.Now())
+	var req structs.KVSImportRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	return c.state.KVSImport(index, req.Prefix, req.Export.Entries, req.Uploads, req.Recycled)
+}
+
+func (c *consulFSM) applyKVSChunk(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs_chunk"}, time.Now())
+	var req structs.KVSChunkRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	return c.state.KVSUploadChunk(index, req.ID, req.Seq, req.Data, req.Expires)
+}
+
+func (c *consulFSM) applyKVSMove(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs_move"}, time.Now())
+	var req structs.KVSMoveRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	act, err := c.state.KVSMove(index, req.Source, req.Destination, req.Prefix, req.NoOverwrite)
+	if err != nil {
+		return err
+	}
+	return act
+}
+
+func (c *consulFSM) applyServiceDrain(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "service_drain"}, time.Now())
+	var req structs.ServiceDrainRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	return c.state.SetServiceDraining(index, req.Node, req.ServiceID, req.Draining)
+}
+
 // applyCoordinateBatchUpdate processes a batch of coordinate updates and applies
 // them in a single underlying transaction. This interface isn't 1:1 with the outer
 // update interface that the coordinate endpoint exposes, so we made it single
@@ -371,6 +566,78 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 				return err
 			}
 
+		case structs.KVSRecycleRequestType:
+			var req structs.KVSRecycled
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.KVSRecycled(&req); err != nil {
+				return err
+			}
+
+		case structs.KVSChunkRequestType:
+			var req structs.KVSUpload
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.KVSUpload(&req); err != nil {
+				return err
+			}
+
+		case structs.ChangeCountersType:
+			var req structs.ChangeCounter
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ChangeCounter(&req); err != nil {
+				return err
+			}
+
+		case structs.ChangeFeedType:
+			var req structs.ChangeFeedEntry
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ChangeFeedEntry(&req); err != nil {
+				return err
+			}
+
+		case structs.MaintenanceWindowRequestType:
+			var req structs.MaintenanceWindow
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.MaintenanceWindow(&req); err != nil {
+				return err
+			}
+
+		case structs.ManagedCheckRequestType:
+			var req structs.ManagedCheck
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ManagedCheck(&req); err != nil {
+				return err
+			}
+
+		case structs.CheckHistoryType:
+			var req structs.CheckTransition
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.CheckTransition(&req); err != nil {
+				return err
+			}
+
+		case structs.KVSHistoryType:
+			var req structs.DirEntry
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.KVSVersion(&req); err != nil {
+				return err
+			}
+
 		default:
 			return fmt.Errorf("Unrecognized msg type: %v", msgType)
 		}
@@ -410,6 +677,16 @@ func (s *consulSnapshot) Persist(sink raft.SnapshotSink) error {
 		return err
 	}
 
+	if err := s.persistMaintenanceWindows(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistManagedChecks(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
 	if err := s.persistKVs(sink, encoder); err != nil {
 		sink.Cancel()
 		return err
@@ -419,6 +696,38 @@ func (s *consulSnapshot) Persist(sink raft.SnapshotSink) error {
 		sink.Cancel()
 		return err
 	}
+
+	if err := s.persistKVSRecycled(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistKVSUploads(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	// The change counters go last so they overwrite any counts that
+	// pile up while the other tables are being restored.
+	if err := s.persistChangeCounters(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistChangeFeed(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistCheckHistory(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistKVSHistory(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
 	return nil
 }
 
@@ -435,8 +744,11 @@ func (s *consulSnapshot) persistNodes(sink raft.SnapshotSink,
 	for node := nodes.Next(); node != nil; node = nodes.Next() {
 		n := node.(*structs.Node)
 		req := structs.RegisterRequest{
-			Node:    n.Node,
-			Address: n.Address,
+			ID:              n.ID,
+			Node:            n.Node,
+			Address:         n.Address,
+			TaggedAddresses: n.TaggedAddresses,
+			NodeMeta:        n.Meta,
 		}
 
 		// Register the node itself
@@ -565,6 +877,134 @@ func (s *consulSnapshot) persistTombstones(sink raft.SnapshotSink,
 	return nil
 }
 
+func (s *consulSnapshot) persistKVSRecycled(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	trees, err := s.state.KVSRecycled()
+	if err != nil {
+		return err
+	}
+
+	for tree := trees.Next(); tree != nil; tree = trees.Next() {
+		sink.Write([]byte{byte(structs.KVSRecycleRequestType)})
+		if err := encoder.Encode(tree.(*structs.KVSRecycled)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistKVSUploads(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	uploads, err := s.state.KVSUploads()
+	if err != nil {
+		return err
+	}
+
+	for upload := uploads.Next(); upload != nil; upload = uploads.Next() {
+		sink.Write([]byte{byte(structs.KVSChunkRequestType)})
+		if err := encoder.Encode(upload.(*structs.KVSUpload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistChangeCounters(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	counters, err := s.state.ChangeCounters()
+	if err != nil {
+		return err
+	}
+
+	for counter := counters.Next(); counter != nil; counter = counters.Next() {
+		sink.Write([]byte{byte(structs.ChangeCountersType)})
+		if err := encoder.Encode(counter.(*structs.ChangeCounter)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistChangeFeed(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	entries, err := s.state.ChangeFeed()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		sink.Write([]byte{byte(structs.ChangeFeedType)})
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistMaintenanceWindows(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	windows, err := s.state.MaintenanceWindows()
+	if err != nil {
+		return err
+	}
+
+	for window := windows.Next(); window != nil; window = windows.Next() {
+		sink.Write([]byte{byte(structs.MaintenanceWindowRequestType)})
+		if err := encoder.Encode(window.(*structs.MaintenanceWindow)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistManagedChecks(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	checks, err := s.state.ManagedChecks()
+	if err != nil {
+		return err
+	}
+
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		sink.Write([]byte{byte(structs.ManagedCheckRequestType)})
+		if err := encoder.Encode(check.(*structs.ManagedCheck)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistCheckHistory(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	history, err := s.state.CheckHistory()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range history {
+		sink.Write([]byte{byte(structs.CheckHistoryType)})
+		if err := encoder.Encode(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistKVSHistory(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	history, err := s.state.KVSHistory()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range history {
+		sink.Write([]byte{byte(structs.KVSHistoryType)})
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *consulSnapshot) Release() {
 	s.state.Close()
 }
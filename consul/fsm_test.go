@@ -5,6 +5,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
@@ -143,6 +144,101 @@ func TestFSM_RegisterNode_Service(t *testing.T) {
 	}
 }
 
+func TestFSM_BatchRegister(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.BatchRegisterRequest{
+		Datacenter: "dc1",
+		Registrations: []*structs.RegisterRequest{
+			&structs.RegisterRequest{
+				Node:    "foo",
+				Address: "127.0.0.1",
+				Service: &structs.NodeService{ID: "db", Service: "db"},
+			},
+			&structs.RegisterRequest{
+				Node:    "bar",
+				Address: "127.0.0.2",
+				Service: &structs.NodeService{ID: "web", Service: "web"},
+			},
+		},
+	}
+	buf, err := structs.Encode(structs.BatchRegisterRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify both are registered at the same index
+	for _, reg := range req.Registrations {
+		_, services, err := fsm.state.NodeServices(reg.Node)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		svc, ok := services.Services[reg.Service.ID]
+		if !ok {
+			t.Fatalf("not registered!")
+		}
+		if svc.CreateIndex != 1 {
+			t.Fatalf("bad index: %d", svc.CreateIndex)
+		}
+	}
+}
+
+func TestFSM_DrainService(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+			Port:    8000,
+		},
+	}
+	buf, err := structs.Encode(structs.RegisterRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	drain := structs.ServiceDrainRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+		Draining:   true,
+	}
+	buf, err = structs.Encode(structs.ServiceDrainRequestType, drain)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify the service is draining
+	_, services, err := fsm.state.NodeServices("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if svc := services.Services["db"]; svc == nil || !svc.Draining {
+		t.Fatalf("bad: %#v", svc)
+	}
+}
+
 func TestFSM_DeregisterService(t *testing.T) {
 	fsm, err := NewFSM(nil, os.Stderr)
 	if err != nil {
@@ -349,7 +445,7 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 
 	// Add some state
 	fsm.state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
-	fsm.state.EnsureNode(2, &structs.Node{Node: "baz", Address: "127.0.0.2"})
+	fsm.state.EnsureNode(2, &structs.Node{Node: "baz", Address: "127.0.0.2", Meta: map[string]string{"rack": "r1"}})
 	fsm.state.EnsureService(3, "foo", &structs.NodeService{ID: "web", Service: "web", Tags: nil, Address: "127.0.0.1", Port: 80})
 	fsm.state.EnsureService(4, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
 	fsm.state.EnsureService(5, "baz", &structs.NodeService{ID: "web", Service: "web", Tags: nil, Address: "127.0.0.2", Port: 80})
@@ -397,6 +493,48 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
+	fsm.state.KVSSet(14, &structs.DirEntry{
+		Key:   "/trash/me",
+		Value: []byte("foo"),
+	})
+	recycled := &structs.KVSRecycled{
+		ID:      generateUUID(),
+		Prefix:  "/trash",
+		Expires: time.Now().Add(time.Hour),
+	}
+	if err := fsm.state.KVSRecycleTree(15, recycled); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	upload := generateUUID()
+	for i, chunk := range []string{"hello ", "world"} {
+		if err := fsm.state.KVSUploadChunk(15, upload, i, []byte(chunk), time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	window := &structs.MaintenanceWindow{
+		ID:          generateUUID(),
+		ServiceName: "web",
+		Start:       time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC),
+		End:         time.Date(2016, 1, 1, 3, 0, 0, 0, time.UTC),
+		Recurrence:  24 * time.Hour,
+	}
+	if err := fsm.state.MaintenanceWindowSet(16, window); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	managed := &structs.ManagedCheck{
+		ID:          generateUUID(),
+		Name:        "disk space",
+		ServiceName: "web",
+		NodeMeta:    map[string]string{"rack": "r1"},
+		Script:      "check_disk",
+		Interval:    time.Minute,
+	}
+	if err := fsm.state.ManagedCheckSet(17, managed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
 	// Snapshot
 	snap, err := fsm.Snapshot()
 	if err != nil {
@@ -430,6 +568,16 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if len(nodes) != 2 {
 		t.Fatalf("Bad: %v", nodes)
 	}
+	if nodes[0].Node != "baz" || nodes[0].Meta["rack"] != "r1" || nodes[1].Meta != nil {
+		t.Fatalf("Bad: %v", nodes)
+	}
+	_, nodes, err = fsm2.state.NodesByMeta(map[string]string{"rack": "r1"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Node != "baz" {
+		t.Fatalf("Bad: %v", nodes)
+	}
 
 	_, fooSrv, err := fsm2.state.NodeServices("foo")
 	if err != nil {
@@ -501,6 +649,13 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		if stone.Key != "/remove" || stone.Index != 12 {
 			t.Fatalf("bad: %v", stone)
 		}
+		stone = stones.Next().(*state.Tombstone)
+		if stone == nil {
+			t.Fatalf("missing tombstone")
+		}
+		if stone.Key != "/trash/me" || stone.Index != 15 {
+			t.Fatalf("bad: %v", stone)
+		}
 		if stones.Next() != nil {
 			t.Fatalf("unexpected extra tombstones")
 		}
@@ -514,6 +669,91 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if !reflect.DeepEqual(coords, updates) {
 		t.Fatalf("bad: %#v", coords)
 	}
+
+	// Verify the recycle bin is restored
+	_, tree, err := fsm2.state.KVSRecycledGet(recycled.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if tree == nil || tree.Prefix != "/trash" || len(tree.Entries) != 1 {
+		t.Fatalf("bad: %#v", tree)
+	}
+
+	// Verify the key history is restored
+	_, versions, err := fsm2.state.KVSHistory("/test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(versions) != 1 || string(versions[0].Value) != "foo" {
+		t.Fatalf("bad: %#v", versions)
+	}
+
+	// Verify the in-progress upload is restored
+	value, err := fsm2.state.KVSUploadComplete(100, upload, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("bad: %s", value)
+	}
+
+	// Verify the change counters are restored
+	_, counters, err := fsm.state.ChangeCounters()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, counters2, err := fsm2.state.ChangeCounters()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(counters) == 0 || !reflect.DeepEqual(counters2, counters) {
+		t.Fatalf("bad: %#v", counters2)
+	}
+
+	// Verify the change feed is restored
+	_, feed, err := fsm.state.ChangeFeed(0, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, feed2, err := fsm2.state.ChangeFeed(0, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(feed.Entries) == 0 || !reflect.DeepEqual(feed2, feed) {
+		t.Fatalf("bad: %#v", feed2)
+	}
+
+	// Verify the check history is restored
+	_, history, err := fsm.state.CheckHistory("foo", "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, history2, err := fsm2.state.CheckHistory("foo", "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(history) == 0 || !reflect.DeepEqual(history2, history) {
+		t.Fatalf("bad: %#v", history2)
+	}
+
+	// Verify the maintenance window is restored
+	_, window2, err := fsm2.state.MaintenanceWindowGet(window.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if window2 == nil || window2.ServiceName != "web" || !window2.Start.Equal(window.Start) ||
+		!window2.End.Equal(window.End) || window2.Recurrence != window.Recurrence {
+		t.Fatalf("bad: %#v", window2)
+	}
+
+	// Verify the managed check is restored
+	_, managed2, err := fsm2.state.ManagedCheckGet(managed.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(managed2, managed) {
+		t.Fatalf("bad: %#v", managed2)
+	}
 }
 
 func TestFSM_KVSSet(t *testing.T) {
@@ -752,6 +992,186 @@ func TestFSM_KVSCheckAndSet(t *testing.T) {
 	}
 }
 
+func TestFSM_Txn(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSSet,
+					DirEnt: structs.DirEntry{
+						Key:   "/test/path",
+						Value: []byte("test"),
+					},
+				},
+			},
+		},
+	}
+	buf, err := structs.Encode(structs.TxnRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	txnResp, ok := resp.(structs.TxnResponse)
+	if !ok || len(txnResp.Errors) != 0 || len(txnResp.Results) != 1 {
+		t.Fatalf("resp: %#v", resp)
+	}
+
+	// Verify key is set
+	_, d, err := fsm.state.KVSGet("/test/path")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestFSM_KVSImport(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.state.KVSSet(1, &structs.DirEntry{Key: "/test/stale"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.KVSImportRequest{
+		Datacenter: "dc1",
+		Prefix:     "/test/",
+		Export: structs.KVSExport{
+			Prefix: "/test/",
+			Entries: structs.DirEntries{
+				&structs.DirEntry{Key: "/test/path", Value: []byte("test")},
+			},
+		},
+	}
+	buf, err := structs.Encode(structs.KVSImportRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify the tree was replaced
+	_, ents, err := fsm.state.KVSList("/test/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 1 || ents[0].Key != "/test/path" || string(ents[0].Value) != "test" {
+		t.Fatalf("bad: %v", ents)
+	}
+}
+
+func TestFSM_KVSMove(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.state.KVSSet(1, &structs.DirEntry{Key: "/test/path", Value: []byte("test")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.KVSMoveRequest{
+		Datacenter:  "dc1",
+		Source:      "/test/",
+		Destination: "/moved/",
+		Prefix:      true,
+	}
+	buf, err := structs.Encode(structs.KVSMoveRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != true {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify the tree was moved
+	_, ents, err := fsm.state.KVSList("/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 1 || ents[0].Key != "/moved/path" || string(ents[0].Value) != "test" {
+		t.Fatalf("bad: %v", ents)
+	}
+}
+
+func TestFSM_KVSRecycle(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm.state.KVSSet(1, &structs.DirEntry{
+		Key:   "/test/path",
+		Value: []byte("test"),
+	})
+
+	// Recycle the tree
+	req := structs.KVSRecycleRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSRecycleTree,
+		Recycled: &structs.KVSRecycled{
+			ID:      generateUUID(),
+			Prefix:  "/test",
+			Expires: time.Now().Add(time.Hour),
+		},
+	}
+	buf, err := structs.Encode(structs.KVSRecycleRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify key is not set but the tree is in the bin
+	_, d, err := fsm.state.KVSGet("/test/path")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("key present")
+	}
+	_, tree, err := fsm.state.KVSRecycledGet(req.Recycled.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tree == nil || len(tree.Entries) != 1 {
+		t.Fatalf("bad: %#v", tree)
+	}
+
+	// Restore the tree
+	req = structs.KVSRecycleRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSRecycleRestore,
+		ID:         tree.ID,
+	}
+	buf, err = structs.Encode(structs.KVSRecycleRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify key is back
+	_, d, err = fsm.state.KVSGet("/test/path")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
 func TestFSM_CoordinateUpdate(t *testing.T) {
 	fsm, err := NewFSM(nil, os.Stderr)
 	if err != nil {
@@ -1049,6 +1469,138 @@ func TestFSM_ACL_Set_Delete(t *testing.T) {
 	}
 }
 
+func TestFSM_MaintenanceWindow_Set_Delete(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a new window
+	start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+	req := structs.MaintenanceWindowRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceWindowSet,
+		Window: structs.MaintenanceWindow{
+			ID:     generateUUID(),
+			Node:   "foo",
+			Start:  start,
+			End:    start.Add(time.Hour),
+			Reason: "kernel upgrade",
+		},
+	}
+	buf, err := structs.Encode(structs.MaintenanceWindowRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); ok {
+		t.Fatalf("resp: %v", err)
+	}
+
+	// Get the window
+	id := resp.(string)
+	_, window, err := fsm.state.MaintenanceWindowGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if window == nil {
+		t.Fatalf("missing")
+	}
+	if window.ID != id || window.Node != "foo" || window.Reason != "kernel upgrade" {
+		t.Fatalf("bad: %v", *window)
+	}
+
+	// Try to delete
+	destroy := structs.MaintenanceWindowRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceWindowDelete,
+		Window: structs.MaintenanceWindow{
+			ID: id,
+		},
+	}
+	buf, err = structs.Encode(structs.MaintenanceWindowRequestType, destroy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, window, err = fsm.state.MaintenanceWindowGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if window != nil {
+		t.Fatalf("should be deleted")
+	}
+}
+
+func TestFSM_ManagedCheck_Set_Delete(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a new check
+	req := structs.ManagedCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.ManagedCheckSet,
+		Check: structs.ManagedCheck{
+			ID:       generateUUID(),
+			Name:     "disk space",
+			Script:   "check_disk",
+			Interval: time.Minute,
+		},
+	}
+	buf, err := structs.Encode(structs.ManagedCheckRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); ok {
+		t.Fatalf("resp: %v", err)
+	}
+
+	// Get the check
+	id := resp.(string)
+	_, check, err := fsm.state.ManagedCheckGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if check == nil {
+		t.Fatalf("missing")
+	}
+	if check.ID != id || check.Name != "disk space" || check.Interval != time.Minute {
+		t.Fatalf("bad: %v", *check)
+	}
+
+	// Try to delete
+	destroy := structs.ManagedCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.ManagedCheckDelete,
+		Check: structs.ManagedCheck{
+			ID: id,
+		},
+	}
+	buf, err = structs.Encode(structs.ManagedCheckRequestType, destroy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, check, err = fsm.state.ManagedCheckGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if check != nil {
+		t.Fatalf("should be deleted")
+	}
+}
+
 func TestFSM_TombstoneReap(t *testing.T) {
 	fsm, err := NewFSM(nil, os.Stderr)
 	if err != nil {
@@ -2,8 +2,12 @@ package consul
 
 import (
 	"fmt"
+	"strings"
+	"time"
+
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
 )
 
 // Health endpoint is used to query the health information
@@ -18,18 +22,52 @@ func (h *Health) ChecksInState(args *structs.ChecksInStateRequest,
 		return err
 	}
 
-	// Get the state specific checks
+	// Verify the arguments
+	for _, s := range args.States {
+		switch s {
+		case structs.HealthAny, structs.HealthUnknown:
+		default:
+			if !structs.ValidStatus(s) {
+				return fmt.Errorf("Invalid check state %q", s)
+			}
+		}
+	}
+	if args.TagFilter && args.ServiceName == "" {
+		return fmt.Errorf("Must provide service name to filter by tag")
+	}
+
+	// Get the state specific checks. A single state with no other
+	// filters can use the cheaper lookup.
 	state := h.srv.fsm.State()
+	filtered := len(args.States) > 0 || args.ServiceName != ""
+	watch := "ChecksInState"
+	if filtered {
+		watch = "ChecksInStates"
+	}
 	return h.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("ChecksInState"),
+		queryWatch(state, watch),
 		func() error {
-			index, checks, err := state.ChecksInState(args.State)
+			var index uint64
+			var checks structs.HealthChecks
+			var err error
+			if filtered {
+				states := args.States
+				if len(states) == 0 {
+					states = []string{args.State}
+				}
+				index, checks, err = state.ChecksInStates(states, args.ServiceName, args.TagFilter, args.ServiceTag)
+			} else {
+				index, checks, err = state.ChecksInState(args.State)
+			}
 			if err != nil {
 				return err
 			}
-			reply.Index, reply.HealthChecks = index, checks
+
+			// Status changes during a maintenance window shouldn't raise
+			// alerts, so they're left out of state queries.
+			reply.Index, reply.HealthChecks = index, withoutSuppressed(checks)
 			if err := h.srv.filterACL(args.Token, reply); err != nil {
 				return err
 			}
@@ -49,7 +87,7 @@ func (h *Health) NodeChecks(args *structs.NodeSpecificRequest,
 	return h.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("NodeChecks"),
+		queryWatch(state, "NodeChecks"),
 		func() error {
 			index, checks, err := state.NodeChecks(args.Node)
 			if err != nil {
@@ -60,6 +98,34 @@ func (h *Health) NodeChecks(args *structs.NodeSpecificRequest,
 		})
 }
 
+// CheckHistory is used to get the recent transitions of a check
+func (h *Health) CheckHistory(args *structs.CheckHistoryRequest,
+	reply *structs.IndexedCheckHistory) error {
+	if done, err := h.srv.forward("Health.CheckHistory", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" || args.CheckID == "" {
+		return fmt.Errorf("Must provide node and check ID")
+	}
+
+	// Get the check history
+	state := h.srv.fsm.State()
+	return h.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "CheckHistory"),
+		func() error {
+			index, history, err := state.CheckHistory(args.Node, args.CheckID)
+			if err != nil {
+				return err
+			}
+			reply.Index, reply.History = index, history
+			return h.srv.filterACL(args.Token, reply)
+		})
+}
+
 // ServiceChecks is used to get all the checks for a service
 func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 	reply *structs.IndexedHealthChecks) error {
@@ -78,12 +144,15 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 	return h.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("ServiceChecks"),
+		queryWatch(state, "ServiceChecks"),
 		func() error {
 			index, checks, err := state.ServiceChecks(args.ServiceName)
 			if err != nil {
 				return err
 			}
+			if err := filterBySelector(args.Filter, &checks); err != nil {
+				return err
+			}
 			reply.Index, reply.HealthChecks = index, checks
 			if err := h.srv.filterACL(args.Token, reply); err != nil {
 				return err
@@ -92,7 +161,152 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 		})
 }
 
+// ServiceSummary is used to get how many instances of each service are in
+// each health state, without pulling the instances themselves
+func (h *Health) ServiceSummary(args *structs.ServiceSummaryRequest,
+	reply *structs.IndexedServiceSummaries) error {
+	if done, err := h.srv.forward("Health.ServiceSummary", args, args, reply); done {
+		return err
+	}
+
+	// Get the summaries
+	state := h.srv.fsm.State()
+	return h.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ServiceSummaries"),
+		func() error {
+			index, summaries, err := state.ServiceSummaries()
+			if err != nil {
+				return err
+			}
+			if args.Prefix != "" {
+				for name := range summaries {
+					if !strings.HasPrefix(name, args.Prefix) {
+						delete(summaries, name)
+					}
+				}
+			}
+			reply.Index, reply.Summaries = index, summaries
+			return h.srv.filterACL(args.Token, reply)
+		})
+}
+
 // ServiceNodes returns all the nodes registered as part of a service including health info
+// ExternalChecks is used by a checker to get the external checks that are
+// assigned to it
+func (h *Health) ExternalChecks(args *structs.NodeSpecificRequest,
+	reply *structs.IndexedHealthChecks) error {
+	if done, err := h.srv.forward("Health.ExternalChecks", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	state := h.srv.fsm.State()
+	return h.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ExternalChecks"),
+		func() error {
+			index, checks, err := state.ExternalChecks()
+			if err != nil {
+				return err
+			}
+
+			var assigned structs.HealthChecks
+			for _, check := range checks {
+				if check.External.Checker == args.Node {
+					assigned = append(assigned, check)
+				}
+			}
+			reply.Index, reply.HealthChecks = index, assigned
+			return h.srv.filterACL(args.Token, reply)
+		})
+}
+
+// UpdateExternalCheck is used by a checker to report the result of an
+// external check
+func (h *Health) UpdateExternalCheck(args *structs.ExternalCheckUpdateRequest, reply *struct{}) error {
+	if done, err := h.srv.forward("Health.UpdateExternalCheck", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "health", "update_external_check"}, time.Now())
+
+	// Verify the arguments
+	if args.Node == "" || args.CheckID == "" {
+		return fmt.Errorf("Must provide node and check ID")
+	}
+	switch args.Status {
+	case structs.HealthPassing, structs.HealthWarning, structs.HealthCritical:
+	default:
+		return fmt.Errorf("Invalid check status: %q", args.Status)
+	}
+
+	// Look up the check, and make sure it's still assigned to the caller
+	state := h.srv.fsm.State()
+	_, checks, err := state.NodeChecks(args.Node)
+	if err != nil {
+		return err
+	}
+	var check *structs.HealthCheck
+	for _, c := range checks {
+		if c.CheckID == args.CheckID {
+			check = c
+			break
+		}
+	}
+	if check == nil || check.External == nil {
+		return fmt.Errorf("Unknown external check %q on node %q", args.CheckID, args.Node)
+	}
+	if check.External.Checker != args.Checker {
+		h.srv.logger.Printf("[DEBUG] consul.health: Ignoring result of external check '%s' on node '%s' from '%s', which isn't its checker",
+			args.CheckID, args.Node, args.Checker)
+		return nil
+	}
+
+	// Apply the ACL policy if any. Service checks need write access to the
+	// service. There's no policy for nodes, so node checks need a management
+	// token, or the token the agents use, which checkers report with.
+	acl, err := h.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		var allowed bool
+		if check.ServiceName != "" {
+			allowed = acl.ServiceWrite(check.ServiceName)
+		} else {
+			allowed = acl.ACLModify() ||
+				(h.srv.config.ACLToken != "" && args.Token == h.srv.config.ACLToken)
+		}
+		if !allowed {
+			h.srv.logger.Printf("[WARN] consul.health: Update of check '%s' on '%s' denied due to ACLs",
+				args.CheckID, args.Node)
+			return permissionDeniedErr
+		}
+	}
+
+	// Copy the check, since the original belongs to the state store.
+	c := *check
+	c.Status, c.Output = args.Status, args.Output
+	req := structs.RegisterRequest{
+		Datacenter:     args.Datacenter,
+		Node:           args.Node,
+		SkipNodeUpdate: true,
+		Check:          &c,
+		WriteRequest:   args.WriteRequest,
+	}
+	if _, err := h.srv.raftApply(structs.RegisterRequestType, &req); err != nil {
+		h.srv.logger.Printf("[ERR] consul.health: UpdateExternalCheck failed: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *structs.IndexedCheckServiceNodes) error {
 	if done, err := h.srv.forward("Health.ServiceNodes", args, args, reply); done {
 		return err
@@ -102,13 +316,16 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	if args.ServiceName == "" {
 		return fmt.Errorf("Must provide service name")
 	}
+	if args.Deltas {
+		return h.serviceNodeDeltas(args, reply)
+	}
 
 	// Get the nodes
 	state := h.srv.fsm.State()
 	err := h.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("CheckServiceNodes"),
+		queryWatch(state, "CheckServiceNodes"),
 		func() error {
 			var index uint64
 			var nodes structs.CheckServiceNodes
@@ -121,12 +338,34 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 			if err != nil {
 				return err
 			}
+			if err := filterBySelector(args.Filter, &nodes); err != nil {
+				return err
+			}
+
+			_, windows, err := state.MaintenanceWindowList()
+			if err != nil {
+				return err
+			}
+			nodes = withoutExcluded(windows, withoutDraining(nodes))
 
 			reply.Index, reply.Nodes = index, nodes
 			if err := h.srv.filterACL(args.Token, reply); err != nil {
 				return err
 			}
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes)
+
+			// Shuffle before sorting so the stable distance sort keeps
+			// nodes without coordinates in a random order.
+			if args.Shuffle {
+				reply.Nodes.Shuffle()
+			}
+			if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes); err != nil {
+				return err
+			}
+
+			if args.Coordinates {
+				return h.srv.addCoordinates(reply.Nodes)
+			}
+			return nil
 		})
 
 	// Provide some metrics
@@ -141,3 +380,152 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	}
 	return err
 }
+
+// serviceNodeDeltas answers a ServiceNodes query that asked for deltas. The
+// reply only holds the instances that were added, updated, or removed since
+// the MinQueryIndex, so big services can be watched without sending every
+// instance on each change.
+func (h *Health) serviceNodeDeltas(args *structs.ServiceSpecificRequest, reply *structs.IndexedCheckServiceNodes) error {
+	// The deltas hold the full instances, so the token needs to be able
+	// to read the service.
+	if acl, err := h.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ServiceRead(args.ServiceName) {
+		return permissionDeniedErr
+	}
+
+	state := h.srv.fsm.State()
+	return h.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ServiceEvents"),
+		func() error {
+			index, events, err := state.ServiceEventsSinceIndex(args.ServiceName, args.MinQueryIndex)
+			if err != nil {
+				return err
+			}
+			if err := filterServiceEvents(args, events); err != nil {
+				return err
+			}
+
+			// Changes to other services move the index along, so hold it
+			// back to keep blocking until there is something to send.
+			if !events.Reset && len(events.Events) == 0 && args.MinQueryIndex > 0 {
+				index = args.MinQueryIndex
+			}
+
+			reply.Index = index
+			reply.Deltas, reply.Reset = events.Events, events.Reset
+			return nil
+		})
+}
+
+// filterServiceEvents applies a query's tag and filter expression to the
+// instances in a set of deltas. Instances that don't match, or are draining,
+// are outside the query's results, so they're reported as removals, or left
+// out entirely when the deltas are a reset.
+func filterServiceEvents(args *structs.ServiceSpecificRequest, events *structs.IndexedServiceEvents) error {
+	var instances structs.CheckServiceNodes
+	for _, event := range events.Events {
+		if event.Instance != nil {
+			instances = append(instances, *event.Instance)
+		}
+	}
+	if err := filterBySelector(args.Filter, &instances); err != nil {
+		return err
+	}
+
+	type instanceID struct {
+		node, service string
+	}
+	matched := make(map[instanceID]bool, len(instances))
+	for _, instance := range instances {
+		if instance.Service.Draining {
+			continue
+		}
+		if args.TagFilter && !hasTag(instance.Service.Tags, args.ServiceTag) {
+			continue
+		}
+		matched[instanceID{instance.Node.Node, instance.Service.ID}] = true
+	}
+
+	kept := make(structs.ServiceEvents, 0, len(events.Events))
+	for _, event := range events.Events {
+		if event.Instance != nil && !matched[instanceID{event.Node, event.ServiceID}] {
+			if events.Reset {
+				continue
+			}
+			event.Op, event.Instance = structs.ServiceEventRemove, nil
+		}
+		kept = append(kept, event)
+	}
+	events.Events = kept
+	return nil
+}
+
+// withoutDraining returns the instances that aren't draining. Draining
+// instances are still in the catalog, but shouldn't be sent new traffic.
+func withoutDraining(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	kept := nodes[:0]
+	for _, node := range nodes {
+		if node.Service == nil || !node.Service.Draining {
+			kept = append(kept, node)
+		}
+	}
+	return kept
+}
+
+// hasTag reports whether the tags include the given one, ignoring case like
+// the state store's tag filtering does.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeLiveness is used to get the gossip liveness of nodes without
+// touching the catalog. This is answered from the LAN pool, so it's
+// cheap and any server in the datacenter can service it.
+func (h *Health) NodeLiveness(args *structs.NodeLivenessRequest,
+	reply *structs.IndexedNodeLiveness) error {
+	if done, err := h.srv.forward("Health.NodeLiveness", args, args, reply); done {
+		return err
+	}
+
+	// Build a filter if specific nodes were asked for
+	var want map[string]struct{}
+	if len(args.Nodes) > 0 {
+		want = make(map[string]struct{}, len(args.Nodes))
+		for _, node := range args.Nodes {
+			want[node] = struct{}{}
+		}
+	}
+
+	now := time.Now()
+	members := h.srv.serfLAN.Members()
+	reply.Nodes = make(structs.NodeLivenesses, 0, len(members))
+	for _, m := range members {
+		if want != nil {
+			if _, ok := want[m.Name]; !ok {
+				continue
+			}
+		}
+
+		live := &structs.NodeLiveness{
+			Node:    m.Name,
+			Address: m.Addr.String(),
+			Status:  m.Status.String(),
+		}
+		if m.Status == serf.StatusAlive {
+			live.LastSeen = now
+		} else {
+			live.LastSeen = h.srv.lanLastSeenTime(m.Name)
+		}
+		reply.Nodes = append(reply.Nodes, live)
+	}
+	h.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
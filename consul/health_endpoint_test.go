@@ -1,7 +1,9 @@
 package consul
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -56,6 +58,76 @@ func TestHealth_ChecksInState(t *testing.T) {
 	}
 }
 
+func TestHealth_ChecksInState_Filters(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	register := func(node, tag, status string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Tags:    []string{tag},
+			},
+			Check: &structs.HealthCheck{
+				Name:      "db connect",
+				Status:    status,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register("foo", "master", structs.HealthWarning)
+	register("bar", "slave", structs.HealthCritical)
+	register("baz", "slave", structs.HealthPassing)
+
+	// Unknown states are rejected
+	inState := structs.ChecksInStateRequest{
+		Datacenter: "dc1",
+		States:     []string{structs.HealthWarning, "broken"},
+	}
+	var out structs.IndexedHealthChecks
+	err := msgpackrpc.CallWithCodec(codec, "Health.ChecksInState", &inState, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid check state") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Warning and critical checks of db
+	inState.States = []string{structs.HealthWarning, structs.HealthCritical}
+	inState.ServiceName = "db"
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ChecksInState", &inState, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.HealthChecks) != 2 {
+		t.Fatalf("Bad: %v", out.HealthChecks)
+	}
+	for _, check := range out.HealthChecks {
+		if check.Node == "baz" || check.ServiceName != "db" {
+			t.Fatalf("Bad: %v", check)
+		}
+	}
+
+	// Only the slaves
+	inState.TagFilter, inState.ServiceTag = true, "slave"
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ChecksInState", &inState, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.HealthChecks) != 1 || out.HealthChecks[0].Node != "bar" {
+		t.Fatalf("Bad: %v", out.HealthChecks)
+	}
+}
+
 func TestHealth_ChecksInState_DistanceSort(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -391,6 +463,175 @@ func TestHealth_ServiceNodes(t *testing.T) {
 	}
 }
 
+func TestHealth_ServiceSummary(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register instances of two services in different states.
+	register := func(node, service, status string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      service,
+				Service: service,
+			},
+			Check: &structs.HealthCheck{
+				Name:      service + " connect",
+				Status:    status,
+				ServiceID: service,
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register("foo", "db", structs.HealthPassing)
+	register("bar", "db", structs.HealthCritical)
+	register("foo", "web", structs.HealthWarning)
+
+	req := structs.ServiceSummaryRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedServiceSummaries
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceSummary", &req, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 {
+		t.Fatalf("Bad: %v", reply)
+	}
+	db := reply.Summaries["db"]
+	if db == nil || db.Instances != 2 || db.Passing != 1 || db.Critical != 1 {
+		t.Fatalf("Bad: %v", db)
+	}
+	web := reply.Summaries["web"]
+	if web == nil || web.Instances != 1 || web.Warning != 1 {
+		t.Fatalf("Bad: %v", web)
+	}
+
+	// Only the services with the prefix are summarized.
+	req.Prefix = "w"
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceSummary", &req, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Summaries) != 1 || reply.Summaries["web"] == nil {
+		t.Fatalf("Bad: %v", reply.Summaries)
+	}
+}
+
+func TestHealth_ServiceNodes_Deltas(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	register := func(node, tag string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Tags:    []string{tag},
+			},
+		}
+		var out struct{}
+		if err := s1.RPC("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register("foo", "master")
+	register("bar", "slave")
+
+	// The first query gets every matching instance.
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+		ServiceTag:  "master",
+		TagFilter:   true,
+		Deltas:      true,
+	}
+	var out structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Reset || len(out.Nodes) != 0 || len(out.Deltas) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if e := out.Deltas[0]; e.Op != structs.ServiceEventAdd || e.Node != "foo" || e.Instance == nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// A blocking query wakes up with just the new instance.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		register("baz", "master")
+	}()
+	req.MinQueryIndex = out.Index
+	start := time.Now()
+	out = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("too fast: %v", elapsed)
+	}
+	if out.Reset || len(out.Deltas) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if e := out.Deltas[0]; e.Op != structs.ServiceEventAdd || e.Node != "baz" || e.Instance == nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// An instance that no longer matches the tag is removed.
+	register("foo", "slave")
+	req.MinQueryIndex = out.Index
+	out = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Reset || len(out.Deltas) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if e := out.Deltas[0]; e.Op != structs.ServiceEventRemove || e.Node != "foo" || e.Instance != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// So is one that starts draining.
+	drain := structs.ServiceDrainRequest{
+		Datacenter: "dc1",
+		Node:       "baz",
+		ServiceID:  "db",
+		Draining:   true,
+	}
+	var drainOut struct{}
+	if err := s1.RPC("Catalog.Drain", &drain, &drainOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.MinQueryIndex = out.Index
+	out = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Reset || len(out.Deltas) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if e := out.Deltas[0]; e.Op != structs.ServiceEventRemove || e.Node != "baz" || e.Instance != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+}
+
 func TestHealth_ServiceNodes_DistanceSort(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -477,6 +718,518 @@ func TestHealth_ServiceNodes_DistanceSort(t *testing.T) {
 	if nodes[1].Node.Node != "foo" {
 		t.Fatalf("Bad: %v", nodes[1])
 	}
+
+	// Shuffling must not undo the distance sort.
+	req.Shuffle = true
+	for i := 0; i < 10; i++ {
+		if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out2); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		nodes = out2.Nodes
+		if len(nodes) != 2 || nodes[0].Node.Node != "bar" {
+			t.Fatalf("Bad: %v", nodes)
+		}
+	}
+}
+
+func TestHealth_ServiceNodes_Filter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for i, status := range []string{structs.HealthPassing, structs.HealthCritical} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("node%d", i),
+			Address:    fmt.Sprintf("127.0.0.%d", i+1),
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+			Check: &structs.HealthCheck{
+				Name:      "db connect",
+				Status:    status,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+		Filter:      "Checks.Status != critical",
+	}
+	var out structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node.Node != "node0" {
+		t.Fatalf("Bad: %v", out.Nodes)
+	}
+
+	// The checks endpoint filters on check fields
+	req.Filter = "Status == critical"
+	var checks structs.IndexedHealthChecks
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceChecks", &req, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks.HealthChecks) != 1 || checks.HealthChecks[0].Node != "node1" {
+		t.Fatalf("Bad: %v", checks.HealthChecks)
+	}
+}
+
+func TestHealth_ServiceNodes_Shuffle(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for i := 0; i < 10; i++ {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("node%d", i),
+			Address:    fmt.Sprintf("127.0.0.%d", i+1),
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	order := func(shuffle bool) string {
+		req := structs.ServiceSpecificRequest{
+			Datacenter:  "dc1",
+			ServiceName: "db",
+			Shuffle:     shuffle,
+		}
+		var out structs.IndexedCheckServiceNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Nodes) != 10 {
+			t.Fatalf("Bad: %v", out.Nodes)
+		}
+		var names []string
+		for _, node := range out.Nodes {
+			names = append(names, node.Node.Node)
+		}
+		return strings.Join(names, ",")
+	}
+
+	// Without shuffling the order is stable.
+	first := order(false)
+	for i := 0; i < 5; i++ {
+		if got := order(false); got != first {
+			t.Fatalf("order changed: %s != %s", got, first)
+		}
+	}
+
+	// With shuffling we should see different orders.
+	uniques := make(map[string]struct{})
+	for i := 0; i < 20; i++ {
+		uniques[order(true)] = struct{}{}
+	}
+	if len(uniques) < 2 {
+		t.Fatalf("results were not shuffled")
+	}
+}
+
+func TestHealth_ServiceNodes_Coordinates(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only foo has a coordinate.
+	coord := generateCoordinate(1 * time.Millisecond)
+	updates := structs.Coordinates{
+		{"foo", coord},
+	}
+	if err := s1.fsm.State().CoordinateBatchUpdate(10, updates); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Coordinates are left out unless they're asked for.
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 2 {
+		t.Fatalf("bad: %v", out.Nodes)
+	}
+	for _, node := range out.Nodes {
+		if node.Coord != nil {
+			t.Fatalf("bad: %v", node)
+		}
+	}
+
+	req.Coordinates = true
+	out = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 2 {
+		t.Fatalf("bad: %v", out.Nodes)
+	}
+	for _, node := range out.Nodes {
+		switch node.Node.Node {
+		case "foo":
+			verifyCoordinatesEqual(t, node.Coord, coord)
+		case "bar":
+			if node.Coord != nil {
+				t.Fatalf("bad: %v", node.Coord)
+			}
+		}
+	}
+}
+
+func TestHealth_ExternalChecks(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ExternalChecker = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			Name: "ping",
+			External: &structs.ExternalCheck{
+				TCP:      "127.0.0.1:8080",
+				Interval: 10 * time.Second,
+			},
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for the leader to assign the check to us
+	req := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       s1.config.NodeName,
+	}
+	var checks structs.IndexedHealthChecks
+	testutil.WaitForResult(func() (bool, error) {
+		if err := msgpackrpc.CallWithCodec(codec, "Health.ExternalChecks", &req, &checks); err != nil {
+			return false, err
+		}
+		return len(checks.HealthChecks) == 1, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if c := checks.HealthChecks[0]; c.Node != "foo" || c.CheckID != "ping" || c.Status != structs.HealthCritical {
+		t.Fatalf("bad: %v", c)
+	}
+
+	// Other nodes have nothing assigned
+	req.Node = "bar"
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ExternalChecks", &req, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks.HealthChecks) != 0 {
+		t.Fatalf("bad: %v", checks.HealthChecks)
+	}
+
+	// Report a result
+	update := structs.ExternalCheckUpdateRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		CheckID:    "ping",
+		Checker:    s1.config.NodeName,
+		Status:     structs.HealthPassing,
+		Output:     "TCP connect 127.0.0.1:8080: Success",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.UpdateExternalCheck", &update, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	_, nodeChecks, err := state.NodeChecks("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodeChecks) != 1 || nodeChecks[0].Status != structs.HealthPassing ||
+		nodeChecks[0].Output != update.Output || nodeChecks[0].External == nil {
+		t.Fatalf("bad: %v", nodeChecks)
+	}
+
+	// Results from a checker the check isn't assigned to are ignored
+	update.Checker = "bar"
+	update.Status = structs.HealthCritical
+	if err := msgpackrpc.CallWithCodec(codec, "Health.UpdateExternalCheck", &update, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodeChecks, err = state.NodeChecks("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if nodeChecks[0].Status != structs.HealthPassing {
+		t.Fatalf("bad: %v", nodeChecks)
+	}
+
+	// Bad statuses and unknown checks are rejected
+	update.Checker = s1.config.NodeName
+	update.Status = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "Health.UpdateExternalCheck", &update, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid check status") {
+		t.Fatalf("err: %v", err)
+	}
+	update.Status = structs.HealthPassing
+	update.CheckID = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "Health.UpdateExternalCheck", &update, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown external check") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestHealth_UpdateExternalCheck_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.ACLToken = "agent"
+		c.ExternalChecker = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create the token the agents use, and a user token
+	var agentToken, userToken string
+	for _, id := range []*string{&agentToken, &userToken} {
+		arg := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: testRegisterRules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		if id == &agentToken {
+			arg.ACL.ID = "agent"
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, id); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Register a node-level external check
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			Name: "ping",
+			External: &structs.ExternalCheck{
+				TCP:      "127.0.0.1:8080",
+				Interval: 10 * time.Second,
+			},
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, checks, err := state.ExternalChecks()
+		if err != nil {
+			return false, err
+		}
+		return len(checks) == 1 && checks[0].External.Checker == s1.config.NodeName, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// A user token can't report on a node check
+	update := structs.ExternalCheckUpdateRequest{
+		Datacenter:   "dc1",
+		Node:         "foo",
+		CheckID:      "ping",
+		Checker:      s1.config.NodeName,
+		Status:       structs.HealthPassing,
+		WriteRequest: structs.WriteRequest{Token: userToken},
+	}
+	err := msgpackrpc.CallWithCodec(codec, "Health.UpdateExternalCheck", &update, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But the agent token and a management token can
+	for _, token := range []string{agentToken, "root"} {
+		update.Token = token
+		if err := msgpackrpc.CallWithCodec(codec, "Health.UpdateExternalCheck", &update, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	_, nodeChecks, err := state.NodeChecks("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodeChecks) != 1 || nodeChecks[0].Status != structs.HealthPassing {
+		t.Fatalf("bad: %v", nodeChecks)
+	}
+}
+
+func TestHealth_CheckHistory(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a check, then fail it.
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			Name:   "memory utilization",
+			Status: structs.HealthPassing,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Check.Status = structs.HealthCritical
+	arg.Check.Output = "out of memory"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.CheckHistoryRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		CheckID:    "memory utilization",
+	}
+	var reply structs.IndexedCheckHistory
+	if err := msgpackrpc.CallWithCodec(codec, "Health.CheckHistory", &req, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	history := reply.History
+	if len(history) != 2 {
+		t.Fatalf("Bad: %v", history)
+	}
+	if history[0].Status != structs.HealthPassing ||
+		history[1].Status != structs.HealthCritical || history[1].Output != "out of memory" {
+		t.Fatalf("Bad: %v", history)
+	}
+	if reply.Index != history[1].Index {
+		t.Fatalf("Bad: %v", reply)
+	}
+
+	// A check ID is required.
+	req.CheckID = ""
+	err := msgpackrpc.CallWithCodec(codec, "Health.CheckHistory", &req, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Must provide node and check ID") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestHealth_CheckHistory_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	opt := structs.CheckHistoryRequest{
+		Datacenter:   "dc1",
+		Node:         srv.config.NodeName,
+		CheckID:      "service:foo",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedCheckHistory{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.CheckHistory", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(reply.History) != 1 || reply.History[0].ServiceName != "foo" {
+		t.Fatalf("bad: %#v", reply.History)
+	}
+
+	// The token can't read the bar service's check.
+	opt.CheckID = "service:bar"
+	if err := msgpackrpc.CallWithCodec(codec, "Health.CheckHistory", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(reply.History) != 0 {
+		t.Fatalf("bad: %#v", reply.History)
+	}
+}
+
+func TestHealth_ServiceSummary_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	opt := structs.ServiceSummaryRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedServiceSummaries{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceSummary", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := reply.Summaries["foo"]; !ok {
+		t.Fatalf("bad: %#v", reply.Summaries)
+	}
+	if _, ok := reply.Summaries["bar"]; ok {
+		t.Fatalf("bad: %#v", reply.Summaries)
+	}
 }
 
 func TestHealth_NodeChecks_FilterACL(t *testing.T) {
@@ -602,3 +1355,42 @@ func TestHealth_ChecksInState_FilterACL(t *testing.T) {
 		t.Fatalf("missing service 'foo': %#v", reply.HealthChecks)
 	}
 }
+
+func TestHealth_NodeLiveness(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Ask for everything
+	arg := structs.NodeLivenessRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedNodeLiveness
+	if err := msgpackrpc.CallWithCodec(codec, "Health.NodeLiveness", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 {
+		t.Fatalf("bad: %#v", out.Nodes)
+	}
+	live := out.Nodes[0]
+	if live.Node != s1.config.NodeName || live.Status != "alive" {
+		t.Fatalf("bad: %#v", live)
+	}
+	if live.Address != "127.0.0.1" || live.LastSeen.IsZero() {
+		t.Fatalf("bad: %#v", live)
+	}
+
+	// Nodes we don't know about are left out
+	arg.Nodes = []string{"nope"}
+	out = structs.IndexedNodeLiveness{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.NodeLiveness", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 0 {
+		t.Fatalf("bad: %#v", out.Nodes)
+	}
+}
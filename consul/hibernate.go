@@ -0,0 +1,187 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/clock"
+	"github.com/hashicorp/consul/consul/state"
+)
+
+const (
+	// hibernateTick is the granularity of the hibernator's timers. All the
+	// queries with a deadline in the same tick share a single timer.
+	hibernateTick = time.Second
+)
+
+// hibernator parks blocking queries that have been waiting at the same index
+// for a long time. Queries parked on the same table or KV prefix share a
+// single registration with its watch, and their timeouts share one timer per
+// tick, so an idle watch set costs one notify channel no matter how many
+// queries are waiting on it. Parked queries are woken lazily by whichever of them sees
+// the watch fire first.
+type hibernator struct {
+	clock clock.Clock
+
+	l      sync.Mutex
+	groups map[string]*hibernation
+	alarms map[int64]*alarm
+}
+
+// hibernation is the set of queries parked on a single table or KV prefix.
+type hibernation struct {
+	key   string
+	watch state.Watch
+
+	// notifyCh is the one channel registered with the watch.
+	notifyCh chan struct{}
+
+	// wakeCh is closed once the watch has fired.
+	wakeCh chan struct{}
+	woken  bool
+
+	waiters int
+}
+
+// alarm is a timer shared by all the queries with a deadline in the same
+// tick.
+type alarm struct {
+	tick  int64
+	timer clock.Timer
+
+	// firedCh is closed once the alarm goes off.
+	firedCh chan struct{}
+	fired   bool
+
+	waiters int
+}
+
+// newHibernator returns a hibernator with no parked queries, which uses the
+// given clock for its timers.
+func newHibernator(clock clock.Clock) *hibernator {
+	return &hibernator{
+		clock:  clock,
+		groups: make(map[string]*hibernation),
+		alarms: make(map[int64]*alarm),
+	}
+}
+
+// park adds a query to the hibernation for the given key, registering a new
+// one with the watch if needed. The watch should be freshly fetched, since a
+// hibernation only lasts until it fires. Every call must be paired with
+// release.
+func (h *hibernator) park(key string, watch state.Watch) *hibernation {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	g, ok := h.groups[key]
+	if !ok {
+		g = &hibernation{
+			key:      key,
+			watch:    watch,
+			notifyCh: make(chan struct{}, 1),
+			wakeCh:   make(chan struct{}),
+		}
+		h.groups[key] = g
+		watch.Wait(g.notifyCh)
+	}
+	g.waiters++
+	return g
+}
+
+// release removes a query from a hibernation. The last query to leave one
+// that hasn't fired deregisters it from the watch.
+func (h *hibernator) release(g *hibernation) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	g.waiters--
+	if g.waiters > 0 || g.woken {
+		return
+	}
+	g.watch.Clear(g.notifyCh)
+	delete(h.groups, g.key)
+}
+
+// after returns an alarm that goes off once the given duration has elapsed,
+// rounded up to the next tick. Every call must be paired with cancel.
+func (h *hibernator) after(d time.Duration) *alarm {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	now := h.clock.Now()
+	tick := now.Add(d).UnixNano()/int64(hibernateTick) + 1
+	a, ok := h.alarms[tick]
+	if !ok {
+		a = &alarm{
+			tick:    tick,
+			firedCh: make(chan struct{}),
+		}
+		when := time.Unix(0, tick*int64(hibernateTick))
+		a.timer = h.clock.AfterFunc(when.Sub(now), func() {
+			h.fire(a)
+		})
+		h.alarms[tick] = a
+	}
+	a.waiters++
+	return a
+}
+
+// cancel removes a query from an alarm. The last query to leave one that
+// hasn't gone off stops its timer.
+func (h *hibernator) cancel(a *alarm) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	a.waiters--
+	if a.waiters > 0 || a.fired {
+		return
+	}
+	a.timer.Stop()
+	delete(h.alarms, a.tick)
+}
+
+// fire sets off an alarm, waking every query waiting on it.
+func (h *hibernator) fire(a *alarm) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if a.fired {
+		return
+	}
+	a.fired = true
+	close(a.firedCh)
+	if h.alarms[a.tick] == a {
+		delete(h.alarms, a.tick)
+	}
+}
+
+// wait blocks until the hibernation's watch fires, returning true, or until
+// the alarm goes off, returning false.
+func (h *hibernator) wait(g *hibernation, deadline *alarm) bool {
+	select {
+	case <-g.notifyCh:
+		h.wake(g)
+		return true
+	case <-g.wakeCh:
+		return true
+	case <-deadline.firedCh:
+		return false
+	}
+}
+
+// wake wakes every query in a hibernation and retires it, so later queries
+// start a fresh one.
+func (h *hibernator) wake(g *hibernation) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if g.woken {
+		return
+	}
+	g.woken = true
+	close(g.wakeCh)
+	if h.groups[g.key] == g {
+		delete(h.groups, g.key)
+	}
+}
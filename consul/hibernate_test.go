@@ -0,0 +1,171 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/clock"
+	"github.com/hashicorp/consul/consul/state"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestHibernator_SharedWake(t *testing.T) {
+	h := newHibernator(clock.NewManual(time.Unix(1000, 0)))
+	watch := state.NewFullTableWatch()
+	deadline := h.after(time.Minute)
+	defer h.cancel(deadline)
+
+	// Both queries should share a single hibernation.
+	g1 := h.park("foo", watch)
+	g2 := h.park("foo", watch)
+	if g1 != g2 {
+		t.Fatalf("bad: %#v %#v", g1, g2)
+	}
+	if len(h.groups) != 1 {
+		t.Fatalf("bad: %#v", h.groups)
+	}
+
+	// Fire the watch and make sure both wake up.
+	watch.Notify()
+	for _, g := range []*hibernation{g1, g2} {
+		if !h.wait(g, deadline) {
+			t.Fatalf("should have woken")
+		}
+	}
+
+	// The fired hibernation should be retired so new queries get a fresh one.
+	if len(h.groups) != 0 {
+		t.Fatalf("bad: %#v", h.groups)
+	}
+	g3 := h.park("foo", watch)
+	if g3 == g1 {
+		t.Fatalf("should not reuse a fired hibernation")
+	}
+	h.release(g1)
+	h.release(g2)
+	h.release(g3)
+	if len(h.groups) != 0 {
+		t.Fatalf("bad: %#v", h.groups)
+	}
+}
+
+func TestHibernator_SharedByKey(t *testing.T) {
+	h := newHibernator(clock.NewManual(time.Unix(1000, 0)))
+	store, err := state.NewStateStore(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := h.after(time.Minute)
+	defer h.cancel(deadline)
+
+	// Queries on the same prefix share a hibernation.
+	g1 := h.park("kvs:foo/", store.GetKVSWatch("foo/"))
+	g2 := h.park("kvs:foo/", store.GetKVSWatch("foo/"))
+	if g1 != g2 {
+		t.Fatalf("bad: %#v %#v", g1, g2)
+	}
+
+	// A write under the prefix drops its watch. Queries parked after the
+	// hibernation wakes should be registered with the new one, and be
+	// woken by the next write.
+	if err := store.KVSSet(1, &structs.DirEntry{Key: "foo/bar"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !h.wait(g1, deadline) {
+		t.Fatalf("should have woken")
+	}
+	g3 := h.park("kvs:foo/", store.GetKVSWatch("foo/"))
+	if g3 == g1 {
+		t.Fatalf("should not reuse a fired hibernation")
+	}
+	if err := store.KVSSet(2, &structs.DirEntry{Key: "foo/baz"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !h.wait(g3, deadline) {
+		t.Fatalf("should have woken")
+	}
+	h.release(g1)
+	h.release(g2)
+	h.release(g3)
+	if len(h.groups) != 0 {
+		t.Fatalf("bad: %#v", h.groups)
+	}
+}
+
+func TestHibernator_Timeout(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1000, 0))
+	h := newHibernator(clk)
+	watch := state.NewFullTableWatch()
+
+	g := h.park("foo", watch)
+	deadline := h.after(10 * time.Second)
+	clk.Advance(11 * time.Second)
+	if h.wait(g, deadline) {
+		t.Fatalf("should have timed out")
+	}
+	h.cancel(deadline)
+	if len(h.alarms) != 0 {
+		t.Fatalf("bad: %#v", h.alarms)
+	}
+
+	// Releasing the last query should deregister from the watch.
+	h.release(g)
+	if len(h.groups) != 0 {
+		t.Fatalf("bad: %#v", h.groups)
+	}
+	watch.Notify()
+	select {
+	case <-g.notifyCh:
+		t.Fatalf("should not have been notified")
+	default:
+	}
+}
+
+func TestHibernator_SharedAlarms(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1000, 0))
+	h := newHibernator(clk)
+
+	// Deadlines in the same tick should share an alarm.
+	a1 := h.after(10 * time.Second)
+	a2 := h.after(10*time.Second + hibernateTick/2)
+	a3 := h.after(20 * time.Second)
+	if a1 != a2 || a1 == a3 {
+		t.Fatalf("bad: %#v %#v %#v", a1, a2, a3)
+	}
+	if len(h.alarms) != 2 {
+		t.Fatalf("bad: %#v", h.alarms)
+	}
+
+	// Cancelling the last query on an alarm should stop it.
+	h.cancel(a3)
+	if len(h.alarms) != 1 {
+		t.Fatalf("bad: %#v", h.alarms)
+	}
+
+	// The shared alarm shouldn't go off early, and should go off for
+	// every query once it's due.
+	clk.Advance(9 * time.Second)
+	select {
+	case <-a1.firedCh:
+		t.Fatalf("should not have fired")
+	default:
+	}
+	clk.Advance(2*time.Second + hibernateTick)
+	for _, a := range []*alarm{a1, a2} {
+		select {
+		case <-a.firedCh:
+		default:
+			t.Fatalf("should have fired")
+		}
+	}
+	if len(h.alarms) != 0 {
+		t.Fatalf("bad: %#v", h.alarms)
+	}
+	h.cancel(a1)
+	h.cancel(a2)
+	select {
+	case <-a3.firedCh:
+		t.Fatalf("should not have fired")
+	default:
+	}
+}
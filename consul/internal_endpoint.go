@@ -26,7 +26,7 @@ func (m *Internal) NodeInfo(args *structs.NodeSpecificRequest,
 	return m.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("NodeInfo"),
+		queryWatch(state, "NodeInfo"),
 		func() error {
 			index, dump, err := state.NodeInfo(args.Node)
 			if err != nil {
@@ -50,7 +50,7 @@ func (m *Internal) NodeDump(args *structs.DCSpecificRequest,
 	return m.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("NodeDump"),
+		queryWatch(state, "NodeDump"),
 		func() error {
 			index, dump, err := state.NodeDump()
 			if err != nil {
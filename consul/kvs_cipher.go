@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// kvsCipherMagic prefixes every encrypted KV value so they can be told
+// apart from plain values, even if the configured prefixes change.
+var kvsCipherMagic = []byte("\x00consul:kvs:v1:")
+
+// kvsCipher encrypts the values of keys under a set of prefixes using a
+// key that is only ever held in memory. Values are encrypted on the leader
+// before they go into Raft, so neither the Raft log nor snapshots hold
+// them in the clear, and are decrypted again when they are read.
+type kvsCipher struct {
+	aead     cipher.AEAD
+	prefixes []string
+}
+
+// newKVSCipher returns a cipher for the given AES key, which must be 16,
+// 24, or 32 bytes long.
+func newKVSCipher(key []byte, prefixes []string) (*kvsCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KVS cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KVS cipher: %v", err)
+	}
+	return &kvsCipher{aead: aead, prefixes: prefixes}, nil
+}
+
+// shouldEncrypt returns true if the value of the given key is encrypted
+func (c *kvsCipher) shouldEncrypt(key string) bool {
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encrypt seals a value, prepending the magic and a random nonce
+func (c *kvsCipher) encrypt(plain []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	out := make([]byte, 0, len(kvsCipherMagic)+len(nonce)+len(plain)+c.aead.Overhead())
+	out = append(out, kvsCipherMagic...)
+	out = append(out, nonce...)
+	return c.aead.Seal(out, nonce, plain, nil), nil
+}
+
+// decrypt opens a value sealed by encrypt. Values without the magic are
+// returned as they are.
+func (c *kvsCipher) decrypt(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, kvsCipherMagic) {
+		return value, nil
+	}
+	value = value[len(kvsCipherMagic):]
+
+	size := c.aead.NonceSize()
+	if len(value) < size {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+	plain, err := c.aead.Open(nil, value[:size], value[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return plain, nil
+}
+
+// decryptEntries decrypts the values of the given entries in place. The
+// entries are cloned first since they are shared with the state store.
+func (c *kvsCipher) decryptEntries(ents structs.DirEntries) error {
+	for i, ent := range ents {
+		if !bytes.HasPrefix(ent.Value, kvsCipherMagic) {
+			continue
+		}
+		plain, err := c.decrypt(ent.Value)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt key %q: %v", ent.Key, err)
+		}
+		clone := ent.Clone()
+		clone.Value = plain
+		ents[i] = clone
+	}
+	return nil
+}
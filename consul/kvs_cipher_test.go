@@ -0,0 +1,96 @@
+package consul
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestKVSCipher(t *testing.T) {
+	c, err := newKVSCipher([]byte("0123456789abcdef"), []string{"secret/"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !c.shouldEncrypt("secret/foo") || c.shouldEncrypt("public/foo") {
+		t.Fatalf("bad prefix match")
+	}
+
+	// Round trip a value
+	sealed, err := c.encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasPrefix(sealed, kvsCipherMagic) || bytes.Contains(sealed, []byte("hello")) {
+		t.Fatalf("bad: %q", sealed)
+	}
+	plain, err := c.decrypt(sealed)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(plain) != "hello" {
+		t.Fatalf("bad: %q", plain)
+	}
+
+	// Plain values are passed through
+	plain, err = c.decrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(plain) != "hello" {
+		t.Fatalf("bad: %q", plain)
+	}
+
+	// Tampered values are rejected
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := c.decrypt(sealed); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// A different key can't decrypt
+	other, err := newKVSCipher([]byte("fedcba9876543210"), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sealed, err = c.encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := other.decrypt(sealed); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Bad key sizes are rejected
+	if _, err := newKVSCipher([]byte("short"), nil); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestKVSCipher_DecryptEntries(t *testing.T) {
+	c, err := newKVSCipher([]byte("0123456789abcdef"), []string{"secret/"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	sealed, err := c.encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stored := &structs.DirEntry{Key: "secret/foo", Value: sealed}
+	ents := structs.DirEntries{
+		stored,
+		&structs.DirEntry{Key: "public/foo", Value: []byte("world")},
+	}
+	if err := c.decryptEntries(ents); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(ents[0].Value) != "hello" || string(ents[1].Value) != "world" {
+		t.Fatalf("bad: %#v", ents)
+	}
+
+	// The original entry must not be modified
+	if !bytes.Equal(stored.Value, sealed) {
+		t.Fatalf("bad: %q", stored.Value)
+	}
+}
@@ -0,0 +1,113 @@
+package consul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// kvsCompressMagic prefixes every compressed KV value so they can be told
+// apart from plain values, even if compression is later turned off.
+var kvsCompressMagic = []byte("\x00consul:kvs:gzip:")
+
+// compressKVSValue gzips a value that is at least threshold bytes long.
+// The value is returned as it is if it's smaller, if the threshold is zero,
+// or if compressing it doesn't save anything.
+func compressKVSValue(value []byte, threshold int) ([]byte, error) {
+	if threshold <= 0 || len(value) < threshold {
+		return value, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(kvsCompressMagic)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, fmt.Errorf("failed to compress value: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress value: %v", err)
+	}
+	if buf.Len() >= len(value) {
+		return value, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressKVSValue reverses compressKVSValue. Values without the magic
+// are returned as they are. Values that decompress to more than limit
+// bytes are rejected, since no such value could have been written.
+func decompressKVSValue(value []byte, limit int) ([]byte, error) {
+	if !bytes.HasPrefix(value, kvsCompressMagic) {
+		return value, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(value[len(kvsCompressMagic):]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress value: %v", err)
+	}
+	defer r.Close()
+	plain, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress value: %v", err)
+	}
+	if len(plain) > limit {
+		return nil, fmt.Errorf("decompressed value exceeds %d byte limit", limit)
+	}
+	return plain, nil
+}
+
+// decompressKVSEntries decompresses the values of the given entries in
+// place, up to limit bytes each. The entries are cloned first since they
+// are shared with the state store.
+func decompressKVSEntries(ents structs.DirEntries, limit int) error {
+	for i, ent := range ents {
+		if ent == nil || !bytes.HasPrefix(ent.Value, kvsCompressMagic) {
+			continue
+		}
+		plain, err := decompressKVSValue(ent.Value, limit)
+		if err != nil {
+			return fmt.Errorf("failed to decompress key %q: %v", ent.Key, err)
+		}
+		clone := ent.Clone()
+		clone.Value = plain
+		ents[i] = clone
+	}
+	return nil
+}
+
+// encodeKVSValue turns a value into the form it's stored in, compressing
+// it if it's large enough and then encrypting it if the key is under one
+// of the encrypted prefixes. Compression has to come first, since
+// encrypted values don't compress.
+func (s *Server) encodeKVSValue(key string, value []byte) ([]byte, error) {
+	// Values that look compressed or encrypted would be mangled on the
+	// way out.
+	if bytes.HasPrefix(value, kvsCompressMagic) || bytes.HasPrefix(value, kvsCipherMagic) {
+		return nil, fmt.Errorf("Value of '%s' starts with a reserved prefix", key)
+	}
+
+	value, err := compressKVSValue(value, s.config.KVSCompressThreshold)
+	if err != nil {
+		return nil, err
+	}
+	if s.kvsCipher != nil && s.kvsCipher.shouldEncrypt(key) {
+		return s.kvsCipher.encrypt(value)
+	}
+	return value, nil
+}
+
+// decodeKVSEntries turns the stored values of the given entries back into
+// what was written. Entries are replaced with decoded copies, so the state
+// store is not touched.
+func (s *Server) decodeKVSEntries(ents structs.DirEntries) error {
+	if s.kvsCipher != nil {
+		if err := s.kvsCipher.decryptEntries(ents); err != nil {
+			return err
+		}
+	}
+	return decompressKVSEntries(ents, s.config.KVSMaxValueSize)
+}
@@ -0,0 +1,94 @@
+package consul
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestKVSCompress(t *testing.T) {
+	large := bytes.Repeat([]byte("hello world "), 100)
+
+	// Round trip a value
+	packed, err := compressKVSValue(large, 1024)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasPrefix(packed, kvsCompressMagic) || len(packed) >= len(large) {
+		t.Fatalf("bad: %q", packed)
+	}
+	plain, err := decompressKVSValue(packed, len(large))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(plain, large) {
+		t.Fatalf("bad: %q", plain)
+	}
+
+	// Small values, and everything when disabled, are left alone
+	for _, threshold := range []int{0, 4096} {
+		packed, err := compressKVSValue(large, threshold)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(packed, large) {
+			t.Fatalf("bad: %q", packed)
+		}
+	}
+
+	// So are values that don't get any smaller
+	random := []byte("\x8f\x12\x9a\x04\xe7\x55\x31\xc0")
+	packed, err = compressKVSValue(random, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(packed, random) {
+		t.Fatalf("bad: %q", packed)
+	}
+
+	// Plain values are passed through
+	plain, err = decompressKVSValue([]byte("hello"), 1024)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(plain) != "hello" {
+		t.Fatalf("bad: %q", plain)
+	}
+
+	// Corrupt values are rejected
+	if _, err := decompressKVSValue([]byte(string(kvsCompressMagic)+"junk"), 1024); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// So are values that decompress to more than the limit
+	packed, err = compressKVSValue(large, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decompressKVSValue(packed, len(large)-1); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVSCompress_DecompressEntries(t *testing.T) {
+	large := bytes.Repeat([]byte("hello world "), 100)
+	packed, err := compressKVSValue(large, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stored := &structs.DirEntry{Key: "foo", Value: packed}
+	ents := structs.DirEntries{stored, &structs.DirEntry{Key: "bar", Value: []byte("plain")}}
+	if err := decompressKVSEntries(ents, len(large)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(ents[0].Value, large) || string(ents[1].Value) != "plain" {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// The stored entry isn't touched
+	if !bytes.Equal(stored.Value, packed) {
+		t.Fatalf("stored entry was modified")
+	}
+}
@@ -1,13 +1,33 @@
 package consul
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
+const (
+	// kvsChunkSize is the most of a value that goes into a single Raft
+	// entry. Larger values are split into chunks of this size.
+	kvsChunkSize = 512 * 1024
+
+	// kvsUploadTimeout is how long the chunks of a large value are kept
+	// if the write that uses them never makes it, such as when the
+	// leader fails partway through.
+	kvsUploadTimeout = 10 * time.Minute
+
+	// kvsMergeRetries is how many times an append or patch is tried
+	// before giving up, if the key keeps changing underneath it.
+	kvsMergeRetries = 5
+)
+
 // KVS endpoint is used to manipulate the Key-Value store
 type KVS struct {
 	srv *Server
@@ -21,28 +41,249 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 	}
 	defer metrics.MeasureSince([]string{"consul", "kvs", "apply"}, time.Now())
 
+	result, _, err := k.apply(args)
+	if err != nil {
+		return err
+	}
+	*reply = result
+	return nil
+}
+
+// ApplyIndex is like Apply but also returns the Raft index of the write,
+// which clients hand back on later reads to be sure of seeing it
+func (k *KVS) ApplyIndex(args *structs.KVSRequest, reply *structs.KVSApplyResponse) error {
+	if done, err := k.srv.forward("KVS.ApplyIndex", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "apply"}, time.Now())
+
+	result, index, err := k.apply(args)
+	if err != nil {
+		return err
+	}
+	reply.Result = result
+	reply.Index = index
+
+	// Hand back a fence token for a lock we just acquired. We are the
+	// leader, so our FSM has already applied the write.
+	if args.Op == structs.KVSLock && result && index != 0 {
+		_, ent, err := k.srv.fsm.State().KVSGet(args.DirEnt.Key)
+		if err != nil {
+			return err
+		}
+		if reply.Fence, err = k.lockFence(args, ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyEcho is like Apply but also returns the entry as it stands after
+// the write, saving clients a read to learn its new indexes
+func (k *KVS) ApplyEcho(args *structs.KVSRequest, reply *structs.KVSApplyResponse) error {
+	if done, err := k.srv.forward("KVS.ApplyEcho", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "apply"}, time.Now())
+
+	result, index, err := k.apply(args)
+	if err != nil {
+		return err
+	}
+	reply.Result = result
+	reply.Index = index
+
+	// Nothing was written if the lock-delay kicked in.
+	if index == 0 {
+		return nil
+	}
+
+	// We are the leader, so our FSM has already applied the write.
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	_, ent, err := k.srv.fsm.State().KVSGet(args.DirEnt.Key)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.KeyRead(args.DirEnt.Key) {
+		ent = nil
+	}
+	if ent != nil {
+		ents := structs.DirEntries{ent}
+		if err := k.decode(ents); err != nil {
+			return err
+		}
+		ent = ents[0]
+	}
+	reply.DirEnt = ent
+
+	// Hand back a fence token for a lock we just acquired.
+	if args.Op == structs.KVSLock && result {
+		if reply.Fence, err = k.lockFence(args, ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockFence returns the fence token for a lock the request just acquired,
+// or nil if the entry can't be seen or has changed hands since.
+func (k *KVS) lockFence(args *structs.KVSRequest, ent *structs.DirEntry) (*structs.FenceToken, error) {
+	if ent == nil || ent.Session != args.DirEnt.Session {
+		return nil, nil
+	}
+	return k.fence(ent)
+}
+
+// fence returns the fence token for the current holder of the lock on the
+// given entry, or nil if it's not locked.
+func (k *KVS) fence(ent *structs.DirEntry) (*structs.FenceToken, error) {
+	if ent.Session == "" {
+		return nil, nil
+	}
+	_, session, err := k.srv.fsm.State().SessionGet(ent.Session)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, nil
+	}
+	return &structs.FenceToken{
+		Key:          ent.Key,
+		CreateIndex:  ent.CreateIndex,
+		LockIndex:    ent.LockIndex,
+		Session:      ent.Session,
+		SessionIndex: session.CreateIndex,
+	}, nil
+}
+
+// VerifyFence is used to check if a fence token still belongs to the
+// current holder of its lock. External systems can use this to reject
+// writes from a holder that has since lost the lock.
+func (k *KVS) VerifyFence(args *structs.KVSFenceRequest, reply *structs.KVSFenceResponse) error {
+	if done, err := k.srv.forward("KVS.VerifyFence", args, args, reply); done {
+		return err
+	}
+
 	// Verify the args
-	if args.DirEnt.Key == "" && args.Op != structs.KVSDeleteTree {
+	if args.Fence.Key == "" {
 		return fmt.Errorf("Must provide key")
 	}
 
-	// Apply the ACL policy if any
 	acl, err := k.srv.resolveToken(args.Token)
 	if err != nil {
 		return err
+	} else if acl != nil && !acl.KeyRead(args.Fence.Key) {
+		return permissionDeniedErr
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	return k.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		kvsWatch(state, args.Fence.Key),
+		func() error {
+			index, ent, err := state.KVSGet(args.Fence.Key)
+			if err != nil {
+				return err
+			}
+			reply.Current, reply.Valid = nil, false
+			if ent == nil {
+				// Must provide non-zero index to prevent blocking
+				// Index 1 is impossible anyways (due to Raft internals)
+				if index == 0 {
+					reply.Index = 1
+				} else {
+					reply.Index = index
+				}
+				return nil
+			}
+			reply.Index = ent.ModifyIndex
+
+			current, err := k.fence(ent)
+			if err != nil {
+				return err
+			}
+			reply.Current = current
+			reply.Valid = current != nil && current.IsSame(&args.Fence)
+			return nil
+		})
+}
+
+// apply verifies and applies a KVS request, returning the result of the
+// operation and the Raft index it was applied at. The index is zero if
+// the request was rejected without being applied.
+func (k *KVS) apply(args *structs.KVSRequest) (bool, uint64, error) {
+	// Verify the args
+	if args.DirEnt.Key == "" && args.Op != structs.KVSDeleteTree && args.Op != structs.KVSDeleteTreeCAS {
+		return false, 0, fmt.Errorf("Must provide key")
+	}
+
+	// Apply the ACL policy if any
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return false, 0, err
 	} else if acl != nil {
 		switch args.Op {
-		case structs.KVSDeleteTree:
+		case structs.KVSDeleteTree, structs.KVSDeleteTreeCAS:
 			if !acl.KeyWritePrefix(args.DirEnt.Key) {
-				return permissionDeniedErr
+				return false, 0, permissionDeniedErr
 			}
 		default:
 			if !acl.KeyWrite(args.DirEnt.Key) {
-				return permissionDeniedErr
+				return false, 0, permissionDeniedErr
 			}
 		}
 	}
 
+	// Appends and patches are worked out here and written as a
+	// check-and-set, so they go through the same checks as any other
+	// write. The ACL is checked first, so nothing about the current
+	// value is given away.
+	if args.Op == structs.KVSAppend || args.Op == structs.KVSPatch {
+		return k.merge(args)
+	}
+
+	// A rollback is a set of the old version's value and flags, so it
+	// goes through the same checks as any other write.
+	if args.Op == structs.KVSRollback {
+		if err := k.rollback(args); err != nil {
+			return false, 0, err
+		}
+	}
+
+	// Check the size before any encryption, which adds a little to it.
+	// Chunked uploads are only ever set up by us below.
+	args.ChunkID, args.Chunks = "", 0
+	if len(args.DirEnt.Value) > k.srv.config.KVSMaxValueSize {
+		return false, 0, fmt.Errorf("Value exceeds %d byte limit", k.srv.config.KVSMaxValueSize)
+	}
+
+	// Work out when the entry expires. This is done here on the leader so
+	// every server stores the same time.
+	args.DirEnt.ExpiresAt = time.Time{}
+	if args.TTL != "" {
+		var verr structs.ValidationErrors
+		switch args.Op {
+		case structs.KVSSet, structs.KVSCAS, structs.KVSLock, structs.KVSUnlock:
+		default:
+			verr.Add("TTL", "can't be used with a '%s' operation", args.Op)
+		}
+		ttl, err := time.ParseDuration(args.TTL)
+		if err != nil {
+			verr.Add("TTL", "'%s' is not a valid duration: %v", args.TTL, err)
+		} else if ttl <= 0 {
+			verr.Add("TTL", "'%s' must be positive", args.TTL)
+		}
+		if err := verr.ErrorOrNil(); err != nil {
+			return false, 0, err
+		}
+		args.DirEnt.ExpiresAt = k.srv.config.Clock.Now().Add(ttl)
+	}
+
 	// If this is a lock, we must check for a lock-delay. Since lock-delay
 	// is based on wall-time, each peer expire the lock-delay at a slightly
 	// different time. This means the enforcement of lock-delay cannot be done
@@ -55,24 +296,334 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 		if expires.After(time.Now()) {
 			k.srv.logger.Printf("[WARN] consul.kvs: Rejecting lock of %s due to lock-delay until %v",
 				args.DirEnt.Key, expires)
-			*reply = false
-			return nil
+			return false, 0, nil
+		}
+	}
+
+	// Compress and encrypt the value as needed before it goes into Raft.
+	// The quota is checked on the value as it will be stored.
+	switch args.Op {
+	case structs.KVSSet, structs.KVSCAS, structs.KVSLock, structs.KVSUnlock:
+		value, err := k.srv.encodeKVSValue(args.DirEnt.Key, args.DirEnt.Value)
+		if err != nil {
+			return false, 0, err
+		}
+		args.DirEnt.Value = value
+		if err := k.srv.checkKVSQuota(args.DirEnt.Key, args.DirEnt.Value); err != nil {
+			return false, 0, err
+		}
+	}
+
+	// Values too large for a single Raft entry are written in chunks
+	// first, and the final write puts them together.
+	if len(args.DirEnt.Value) > kvsChunkSize {
+		if err := k.upload(args); err != nil {
+			return false, 0, err
+		}
+	}
+
+	// Send deleted trees to the recycle bin if it's enabled.
+	switch args.Op {
+	case structs.KVSDeleteTree, structs.KVSDeleteTreeCAS:
+		if k.srv.config.KVSRecycleRetention > 0 {
+			return k.recycle(args)
 		}
 	}
 
 	// Apply the update
-	resp, err := k.srv.raftApply(structs.KVSRequestType, args)
+	resp, index, err := k.srv.raftApplyIndex(structs.KVSRequestType, args)
 	if err != nil {
 		k.srv.logger.Printf("[ERR] consul.kvs: Apply failed: %v", err)
-		return err
+		return false, 0, err
 	}
 	if respErr, ok := resp.(error); ok {
-		return respErr
+		return false, 0, respErr
 	}
 
 	// Check if the return type is a bool
+	respBool, _ := resp.(bool)
+	return respBool, index, nil
+}
+
+// rollback turns a rollback request into a set of the version of the key
+// that was written at the index given as the entry's ModifyIndex.
+func (k *KVS) rollback(args *structs.KVSRequest) error {
+	_, ent, err := k.srv.fsm.State().KVSGetVersion(args.DirEnt.Key, args.DirEnt.ModifyIndex)
+	if err != nil {
+		return err
+	}
+	if ent == nil {
+		return fmt.Errorf("Unknown version %d of key '%s'", args.DirEnt.ModifyIndex, args.DirEnt.Key)
+	}
+
+	// The value is encoded again below.
+	ents := structs.DirEntries{ent}
+	if err := k.decode(ents); err != nil {
+		return err
+	}
+	args.Op = structs.KVSSet
+	args.DirEnt = structs.DirEntry{
+		Key:   ents[0].Key,
+		Flags: ents[0].Flags,
+		Value: ents[0].Value,
+	}
+	return nil
+}
+
+// merge applies an append or patch by writing the new value as a
+// check-and-set against the current entry, trying again if the key
+// changes before the write goes through.
+func (k *KVS) merge(args *structs.KVSRequest) (bool, uint64, error) {
+	for i := 0; i < kvsMergeRetries; i++ {
+		_, ent, err := k.srv.fsm.State().KVSGet(args.DirEnt.Key)
+		if err != nil {
+			return false, 0, err
+		}
+
+		// Keep the current flags, and lock index so a merge into a
+		// held lock doesn't look like it changed hands.
+		req := *args
+		req.Op = structs.KVSCAS
+		req.DirEnt = structs.DirEntry{Key: args.DirEnt.Key}
+		var current []byte
+		if ent != nil {
+			ents := structs.DirEntries{ent}
+			if err := k.decode(ents); err != nil {
+				return false, 0, err
+			}
+			current = ents[0].Value
+			req.DirEnt.Flags = ent.Flags
+			req.DirEnt.LockIndex = ent.LockIndex
+			req.DirEnt.ModifyIndex = ent.ModifyIndex
+		}
+		req.DirEnt.Value, err = mergeKVSValue(args.Op, current, args.DirEnt.Value)
+		if err != nil {
+			return false, 0, err
+		}
+
+		// A failed check-and-set still makes it into the log, so an
+		// index with no result means the key changed under us.
+		result, index, err := k.apply(&req)
+		if err != nil || result || index == 0 {
+			return result, index, err
+		}
+	}
+	return false, 0, fmt.Errorf("Key '%s' kept changing, gave up after %d tries",
+		args.DirEnt.Key, kvsMergeRetries)
+}
+
+// upload writes the value of a request as a series of chunks, each in its
+// own Raft entry, and points the request at them instead. The chunks are
+// only visible once the request itself is applied.
+func (k *KVS) upload(args *structs.KVSRequest) error {
+	id, chunks, err := k.srv.uploadKVSValue(args.Datacenter, args.WriteRequest, args.DirEnt.Value)
+	if err != nil {
+		return err
+	}
+	args.ChunkID = id
+	args.Chunks = chunks
+	args.DirEnt.Value = nil
+	return nil
+}
+
+// uploadKVSValue writes a value through Raft as a series of chunks,
+// returning the ID of the upload and the number of chunks.
+func (s *Server) uploadKVSValue(dc string, wr structs.WriteRequest, value []byte) (string, int, error) {
+	id := generateUUID()
+	expires := s.config.Clock.Now().Add(kvsUploadTimeout)
+	seq := 0
+	for len(value) > 0 {
+		n := kvsChunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		req := structs.KVSChunkRequest{
+			Datacenter:   dc,
+			ID:           id,
+			Seq:          seq,
+			Data:         value[:n],
+			Expires:      expires,
+			WriteRequest: wr,
+		}
+		resp, err := s.raftApply(structs.KVSChunkRequestType, &req)
+		if err != nil {
+			s.logger.Printf("[ERR] consul.kvs: Chunk upload failed: %v", err)
+			return "", 0, err
+		}
+		if respErr, ok := resp.(error); ok {
+			return "", 0, respErr
+		}
+		value = value[n:]
+		seq++
+	}
+	return id, seq, nil
+}
+
+// decode decrypts and decompresses any encoded values in the given
+// entries. Entries are replaced with decoded copies, so the state store is
+// not touched.
+func (k *KVS) decode(ents structs.DirEntries) error {
+	return k.srv.decodeKVSEntries(ents)
+}
+
+// recycle deletes a tree into the recycle bin rather than purging it. The
+// ID and expiration are set here on the leader so every server agrees.
+// Conditional tree deletes only go ahead if the tree's index matches.
+func (k *KVS) recycle(args *structs.KVSRequest) (bool, uint64, error) {
+	tree, err := k.srv.newKVSRecycled(args.DirEnt.Key)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Apply the update
+	req := structs.KVSRecycleRequest{
+		Datacenter:   args.Datacenter,
+		Op:           structs.KVSRecycleTree,
+		Recycled:     tree,
+		WriteRequest: args.WriteRequest,
+	}
+	if args.Op == structs.KVSDeleteTreeCAS {
+		req.Op = structs.KVSRecycleTreeCAS
+		req.CheckIndex = args.DirEnt.ModifyIndex
+	}
+	resp, index, err := k.srv.raftApplyIndex(structs.KVSRecycleRequestType, &req)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Recycle failed: %v", err)
+		return false, 0, err
+	}
+	if respErr, ok := resp.(error); ok {
+		return false, 0, respErr
+	}
 	if respBool, ok := resp.(bool); ok {
-		*reply = respBool
+		return respBool, index, nil
+	}
+	return true, index, nil
+}
+
+// newKVSRecycled sets up the recycle bin entry for a tree that is about to
+// be deleted, with a new unique ID.
+func (s *Server) newKVSRecycled(prefix string) (*structs.KVSRecycled, error) {
+	state := s.fsm.State()
+	tree := &structs.KVSRecycled{
+		Prefix:  prefix,
+		Expires: s.config.Clock.Now().Add(s.config.KVSRecycleRetention),
+	}
+	for {
+		tree.ID = generateUUID()
+		_, existing, err := state.KVSRecycledGet(tree.ID)
+		if err != nil {
+			s.logger.Printf("[ERR] consul.kvs: Recycled tree lookup failed: %v", err)
+			return nil, err
+		}
+		if existing == nil {
+			return tree, nil
+		}
+	}
+}
+
+// ListRecycled is used to list the trees in the recycle bin. Only trees the
+// token could have deleted are returned.
+func (k *KVS) ListRecycled(args *structs.DCSpecificRequest, reply *structs.IndexedKVSRecycledTrees) error {
+	if done, err := k.srv.forward("KVS.ListRecycled", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	return k.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "KVSRecycledList"),
+		func() error {
+			index, trees, err := state.KVSRecycledList()
+			if err != nil {
+				return err
+			}
+			if acl != nil {
+				var allowed structs.KVSRecycledTrees
+				for _, tree := range trees {
+					if acl.KeyWritePrefix(tree.Prefix) {
+						allowed = append(allowed, tree)
+					}
+				}
+				trees = allowed
+			}
+			// Copy the trees so the stored entries aren't modified
+			for i, tree := range trees {
+				clone := *tree
+				clone.Entries = append(structs.DirEntries(nil), tree.Entries...)
+				if err := k.decode(clone.Entries); err != nil {
+					return err
+				}
+				trees[i] = &clone
+			}
+			reply.Index, reply.Trees = index, trees
+			return nil
+		})
+}
+
+// Restore is used to put a tree from the recycle bin back into the KV
+// store. Keys that have been written since the tree was deleted are left
+// alone.
+func (k *KVS) Restore(args *structs.KVSRecycleRequest, reply *struct{}) error {
+	if done, err := k.srv.forward("KVS.Restore", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "restore"}, time.Now())
+
+	// Verify the args
+	if args.ID == "" {
+		return fmt.Errorf("Must provide recycled tree ID")
+	}
+	args.Op = structs.KVSRecycleRestore
+
+	// Look up the tree
+	state := k.srv.fsm.State()
+	_, tree, err := state.KVSRecycledGet(args.ID)
+	if err != nil {
+		return err
+	}
+	if tree == nil {
+		return fmt.Errorf("Unknown recycled tree %q", args.ID)
+	}
+
+	// Restoring needs the same rights as the delete that recycled it
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.KeyWritePrefix(tree.Prefix) {
+		return permissionDeniedErr
+	}
+
+	// The keys that will be put back count against the quotas like any
+	// other write.
+	quota := k.srv.newKVSQuotaCheck()
+	for _, entry := range tree.Entries {
+		_, existing, err := state.KVSGet(entry.Key)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		if err := quota.set(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+
+	// Apply the update
+	resp, err := k.srv.raftApply(structs.KVSRecycleRequestType, args)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Restore failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
 	}
 	return nil
 }
@@ -93,7 +644,7 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 	return k.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetKVSWatch(args.Key),
+		kvsWatch(state, args.Key),
 		func() error {
 			index, ent, err := state.KVSGet(args.Key)
 			if err != nil {
@@ -115,7 +666,7 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 				reply.Index = ent.ModifyIndex
 				reply.Entries = structs.DirEntries{ent}
 			}
-			return nil
+			return k.decode(reply.Entries)
 		})
 }
 
@@ -132,10 +683,10 @@ func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) e
 
 	// Get the local state
 	state := k.srv.fsm.State()
-	return k.srv.blockingRPC(
+	return k.srv.blockingHashRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetKVSWatch(args.Key),
+		kvsWatch(state, args.Key),
 		func() error {
 			index, ent, err := state.KVSList(args.Key)
 			if err != nil {
@@ -158,11 +709,17 @@ func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) e
 				reply.Index = index
 				reply.Entries = ent
 			}
+			if err := k.decode(reply.Entries); err != nil {
+				return err
+			}
+			reply.Hash = hashDirEntries(reply.Entries)
 			return nil
-		})
+		},
+		func() bool { return args.Hash != "" && args.Hash == reply.Hash })
 }
 
-// ListKeys is used to list all keys with a given prefix to a separator
+// ListKeys is used to list all keys with a given prefix to a separator,
+// a page at a time if a limit is given
 func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyList) error {
 	if done, err := k.srv.forward("KVS.ListKeys", args, args, reply); done {
 		return err
@@ -175,12 +732,12 @@ func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyLi
 
 	// Get the local state
 	state := k.srv.fsm.State()
-	return k.srv.blockingRPC(
+	return k.srv.blockingHashRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetKVSWatch(args.Prefix),
+		kvsWatch(state, args.Prefix),
 		func() error {
-			index, keys, err := state.KVSListKeys(args.Prefix, args.Seperator)
+			index, keys, err := state.KVSListKeysDepth(args.Prefix, args.Seperator, args.Depth)
 			if err != nil {
 				return err
 			}
@@ -196,7 +753,428 @@ func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyLi
 			if acl != nil {
 				keys = FilterKeys(acl, keys)
 			}
+
+			// Page through the keys, which are sorted. The cursor is
+			// part of the hash so a page that gains a next one changes.
+			if args.Cursor != "" {
+				keys = keys[sort.Search(len(keys), func(i int) bool {
+					return keys[i] > args.Cursor
+				}):]
+			}
+			reply.NextCursor = ""
+			if args.Limit > 0 && len(keys) > args.Limit {
+				keys = keys[:args.Limit]
+				reply.NextCursor = keys[len(keys)-1]
+			}
 			reply.Keys = keys
+			reply.Hash = hashKeys(keys)
+			if reply.NextCursor != "" {
+				reply.Hash = hashKeys([]string{reply.Hash, reply.NextCursor})
+			}
+			return nil
+		},
+		func() bool { return args.Hash != "" && args.Hash == reply.Hash })
+}
+
+// Subscribe is used to follow the keys under a prefix. Rather than the
+// whole list, each reply carries only the keys that were set or deleted
+// since the sequence number the subscriber last saw. Blocking subscribers
+// only wake up when something under the prefix changes.
+func (k *KVS) Subscribe(args *structs.KVSSubscribeRequest, reply *structs.IndexedKVSEvents) error {
+	if done, err := k.srv.forward("KVS.Subscribe", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the events
+	state := k.srv.fsm.State()
+	return k.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		kvsWatch(state, args.Prefix),
+		func() error {
+			index, events, err := state.KVSEvents(args.Prefix, args.Since)
+			if err != nil {
+				return err
+			}
+
+			// Only pass on changes to keys the token can read, with
+			// their values decoded.
+			var allowed structs.KVSEvents
+			for _, event := range events.Events {
+				if acl != nil && !acl.KeyRead(event.Key) {
+					continue
+				}
+				if event.Entry != nil {
+					ents := structs.DirEntries{event.Entry}
+					if err := k.decode(ents); err != nil {
+						return err
+					}
+					event = &structs.KVSEvent{Op: event.Op, Key: event.Key, Entry: ents[0]}
+				}
+				allowed = append(allowed, event)
+			}
+
+			// Changes elsewhere move the index along, so hold it back to
+			// keep blocking until there is something to send.
+			if !events.Reset && len(allowed) == 0 && args.MinQueryIndex > 0 {
+				index = args.MinQueryIndex
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				index = 1
+			}
+
+			reply.Index = index
+			reply.Events, reply.LastSeq, reply.Reset = allowed, events.LastSeq, events.Reset
 			return nil
 		})
 }
+
+// History is used to get the retained versions of a key, oldest first
+func (k *KVS) History(args *structs.KeyRequest, reply *structs.IndexedDirEntries) error {
+	if done, err := k.srv.forward("KVS.History", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	return k.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		kvsWatch(state, args.Key),
+		func() error {
+			index, ents, err := state.KVSHistory(args.Key)
+			if err != nil {
+				return err
+			}
+			if acl != nil && !acl.KeyRead(args.Key) {
+				ents = nil
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				reply.Index = 1
+			} else {
+				reply.Index = index
+			}
+			reply.Entries = ents
+			return k.decode(reply.Entries)
+		})
+}
+
+// GetVersion is used to lookup the version of a key written at a given
+// index, if it's still retained
+func (k *KVS) GetVersion(args *structs.KeyVersionRequest, reply *structs.IndexedDirEntries) error {
+	if done, err := k.srv.forward("KVS.GetVersion", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	return k.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		kvsWatch(state, args.Key),
+		func() error {
+			index, ent, err := state.KVSGetVersion(args.Key, args.Version)
+			if err != nil {
+				return err
+			}
+			if acl != nil && !acl.KeyRead(args.Key) {
+				ent = nil
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				reply.Index = 1
+			} else {
+				reply.Index = index
+			}
+			if ent == nil {
+				reply.Entries = nil
+			} else {
+				reply.Entries = structs.DirEntries{ent}
+			}
+			return k.decode(reply.Entries)
+		})
+}
+
+// Export is used to get a consistent copy of every entry under a prefix,
+// which can be handed to Import to restore it later or elsewhere
+func (k *KVS) Export(args *structs.KeyRequest, reply *structs.IndexedKVSExport) error {
+	if done, err := k.srv.forward("KVS.Export", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "export"}, time.Now())
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	return k.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		kvsWatch(state, args.Key),
+		func() error {
+			index, ents, err := state.KVSList(args.Key)
+			if err != nil {
+				return err
+			}
+			if acl != nil {
+				ents = FilterDirEnt(acl, ents)
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				index = 1
+			}
+			reply.Index = index
+			reply.Export = structs.KVSExport{
+				Prefix:  args.Key,
+				Index:   index,
+				Entries: ents,
+			}
+			return k.decode(reply.Export.Entries)
+		})
+}
+
+// Import is used to atomically replace the tree under a prefix with the
+// entries of an export. The reply is the Raft index of the import.
+func (k *KVS) Import(args *structs.KVSImportRequest, reply *uint64) error {
+	if done, err := k.srv.forward("KVS.Import", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "import"}, time.Now())
+
+	// The import deletes whatever is under the prefix, so it needs the
+	// same permission as a tree delete.
+	prefix := args.Prefix
+	if prefix == "" {
+		prefix = args.Export.Prefix
+	}
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.KeyWritePrefix(prefix) {
+		return permissionDeniedErr
+	}
+
+	// Move the entries under the new prefix. This is a copy, so the
+	// caller's export is left alone.
+	entries := make(structs.DirEntries, 0, len(args.Export.Entries))
+	for _, ent := range args.Export.Entries {
+		if ent == nil || !strings.HasPrefix(ent.Key, args.Export.Prefix) {
+			return fmt.Errorf("Exported entries must be under the prefix '%s'", args.Export.Prefix)
+		}
+		entry := ent.Clone()
+		entry.Key = prefix + strings.TrimPrefix(ent.Key, args.Export.Prefix)
+		if entry.Key == "" {
+			return fmt.Errorf("Must provide key")
+		}
+		entry.Session = ""
+		if len(entry.Value) > k.srv.config.KVSMaxValueSize {
+			return fmt.Errorf("Value of '%s' exceeds %d byte limit", entry.Key, k.srv.config.KVSMaxValueSize)
+		}
+
+		// Encode the value for where it lands, which may be under one
+		// of the encrypted prefixes.
+		value, err := k.srv.encodeKVSValue(entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
+		entry.Value = value
+		entries = append(entries, entry)
+	}
+
+	// The quotas are checked on the tree as it will be stored, once the
+	// old one has been cleared out.
+	quota := k.srv.newKVSQuotaCheck()
+	if err := quota.deleteTree(prefix); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := quota.set(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+
+	req := structs.KVSImportRequest{
+		Datacenter: args.Datacenter,
+		Prefix:     prefix,
+		Export: structs.KVSExport{
+			Prefix:  prefix,
+			Index:   args.Export.Index,
+			Entries: entries,
+		},
+		WriteRequest: args.WriteRequest,
+	}
+
+	// Send the replaced tree to the recycle bin if it's enabled.
+	if k.srv.config.KVSRecycleRetention > 0 {
+		tree, err := k.srv.newKVSRecycled(prefix)
+		if err != nil {
+			return err
+		}
+		req.Recycled = tree
+	}
+
+	// Keep the import's Raft entry to a reasonable size, as KVS.Apply
+	// does for single values. Values that would take it past
+	// kvsChunkSize are written ahead of it as chunked uploads.
+	var size int
+	for _, entry := range entries {
+		if size+len(entry.Value) <= kvsChunkSize {
+			size += len(entry.Value)
+			continue
+		}
+		id, chunks, err := k.srv.uploadKVSValue(args.Datacenter, args.WriteRequest, entry.Value)
+		if err != nil {
+			return err
+		}
+		if req.Uploads == nil {
+			req.Uploads = make(map[string]structs.KVSUploadRef)
+		}
+		req.Uploads[entry.Key] = structs.KVSUploadRef{ID: id, Chunks: chunks}
+		entry.Value = nil
+	}
+	resp, index, err := k.srv.raftApplyIndex(structs.KVSImportRequestType, &req)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Import failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	*reply = index
+	return nil
+}
+
+// Move is used to atomically move a key, or a tree of keys, to a new
+// location. The reply is false if there was nothing to move, or if the
+// destination was taken and the request asked not to overwrite it.
+func (k *KVS) Move(args *structs.KVSMoveRequest, reply *bool) error {
+	if done, err := k.srv.forward("KVS.Move", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "move"}, time.Now())
+
+	// Verify the args. An empty source prefix would move everything.
+	if args.Source == "" || (!args.Prefix && args.Destination == "") {
+		return fmt.Errorf("Must provide source and destination keys")
+	}
+
+	// The move deletes the source and writes the destination.
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil {
+		if args.Prefix {
+			if !acl.KeyWritePrefix(args.Source) || !acl.KeyWritePrefix(args.Destination) {
+				return permissionDeniedErr
+			}
+		} else if !acl.KeyWrite(args.Source) || !acl.KeyWrite(args.Destination) {
+			return permissionDeniedErr
+		}
+	}
+
+	// Values are moved as they're stored, so they can't cross into or out
+	// of an encrypted prefix. They count against the destination's quota
+	// as they are, once the sources are deleted.
+	if k.srv.kvsCipher != nil || len(k.srv.config.KVSQuotas) > 0 {
+		_, ents, err := k.srv.fsm.State().KVSList(args.Source)
+		if err != nil {
+			return err
+		}
+		quota := k.srv.newKVSQuotaCheck()
+		var moving structs.DirEntries
+		for _, ent := range ents {
+			if !args.Prefix && ent.Key != args.Source {
+				continue
+			}
+			key := args.Destination + strings.TrimPrefix(ent.Key, args.Source)
+			if k.srv.kvsCipher != nil && k.srv.kvsCipher.shouldEncrypt(ent.Key) != k.srv.kvsCipher.shouldEncrypt(key) {
+				return fmt.Errorf("Can't move '%s' to '%s' across an encrypted prefix", ent.Key, key)
+			}
+			if err := quota.delete(ent.Key); err != nil {
+				return err
+			}
+			moving = append(moving, ent)
+		}
+		for _, ent := range moving {
+			key := args.Destination + strings.TrimPrefix(ent.Key, args.Source)
+			if err := quota.set(key, ent.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Apply the update
+	resp, err := k.srv.raftApply(structs.KVSMoveRequestType, args)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Move failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	// Check if the return type is a bool
+	if respBool, ok := resp.(bool); ok {
+		*reply = respBool
+	}
+	return nil
+}
+
+// hashDirEntries returns a hash of the contents of the given entries. The
+// Raft indexes are left out, so rewriting a key with the same value doesn't
+// change the hash.
+func hashDirEntries(ents structs.DirEntries) string {
+	h := sha256.New()
+	for _, ent := range ents {
+		hashField(h, []byte(ent.Key))
+		hashField(h, ent.Value)
+		hashField(h, []byte(ent.Session))
+		binary.Write(h, binary.BigEndian, ent.Flags)
+		binary.Write(h, binary.BigEndian, ent.LockIndex)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hashKeys returns a hash of the given keys.
+func hashKeys(keys []string) string {
+	h := sha256.New()
+	for _, key := range keys {
+		hashField(h, []byte(key))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hashField writes a length prefixed field to a hash, so that fields can't
+// run into each other.
+func hashField(h hash.Hash, field []byte) {
+	binary.Write(h, binary.BigEndian, uint64(len(field)))
+	h.Write(field)
+}
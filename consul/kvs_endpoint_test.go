@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"bytes"
+	"fmt"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/clock"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
@@ -67,6 +71,1335 @@ func TestKVS_Apply(t *testing.T) {
 	}
 }
 
+func TestKVS_Apply_TTL(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clk
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+		TTL: "1h",
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The expiration is set by the leader, using its clock
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !d.ExpiresAt.Equal(clk.Now().Add(time.Hour)) {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Writing again without a TTL clears it
+	arg.TTL = ""
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err = state.KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !d.ExpiresAt.IsZero() {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Bad TTLs are rejected
+	arg.TTL = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !structs.IsValidationError(err) {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Op = structs.KVSDelete
+	arg.TTL = "-10s"
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	expected := "Invalid request: TTL: can't be used with a 'delete' operation; " +
+		"TTL: '-10s' must be positive"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Apply_Chunked(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSMaxValueSize = 2 * 1024 * 1024
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a value that takes several chunks
+	value := make([]byte, kvsChunkSize*3+10)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "manifest",
+			Value: value,
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It's put back together, and the upload is gone
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("manifest")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || !bytes.Equal(d.Value, value) {
+		t.Fatalf("bad: %v", d)
+	}
+	uploads, err := state.ExpiredUploads(time.Now().Add(time.Hour))
+	if err != nil || len(uploads) != 0 {
+		t.Fatalf("bad: %v (err: %v)", uploads, err)
+	}
+
+	// Values over the limit are rejected
+	arg.DirEnt.Value = make([]byte, 2*1024*1024+1)
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Subscribe(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "app/a",
+			Value: []byte("a"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first reply has everything
+	req := structs.KVSSubscribeRequest{
+		Datacenter: "dc1",
+		Prefix:     "app/",
+	}
+	var events structs.IndexedKVSEvents
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Subscribe", &req, &events); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !events.Reset || len(events.Events) != 1 || events.Events[0].Key != "app/a" {
+		t.Fatalf("bad: %#v", events)
+	}
+
+	// Changes outside the prefix don't wake us up, but changes inside
+	// it do, and only they are sent
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		for _, key := range []string{"other", "app/b"} {
+			arg.DirEnt.Key = key
+			var out bool
+			if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	req.Since = events.LastSeq
+	req.MinQueryIndex = events.Index
+	events = structs.IndexedKVSEvents{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Subscribe", &req, &events); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) < 200*time.Millisecond {
+		t.Fatalf("too fast")
+	}
+	if events.Reset || len(events.Events) != 1 || events.Events[0].Key != "app/b" {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestKVS_Subscribe_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	aclArg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testListRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &aclArg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.KVSSubscribeRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: id},
+	}
+	var events structs.IndexedKVSEvents
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Subscribe", &req, &events); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A write to a key the token can't read is hidden, and a write to one
+	// it can read right after should still wake the subscriber.
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		for _, key := range []string{"bar", "foo"} {
+			arg := structs.KVSRequest{
+				Datacenter: "dc1",
+				Op:         structs.KVSSet,
+				DirEnt: structs.DirEntry{
+					Key:   key,
+					Value: []byte("a"),
+				},
+				WriteRequest: structs.WriteRequest{Token: "root"},
+			}
+			var out bool
+			if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	req.Since = events.LastSeq
+	req.MinQueryIndex = events.Index
+	req.MaxQueryTime = 2 * time.Second
+	events = structs.IndexedKVSEvents{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Subscribe", &req, &events); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 200*time.Millisecond || elapsed >= time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if events.Reset || len(events.Events) != 1 || events.Events[0].Key != "foo" {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestKVS_HistoryRollback(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "config/db",
+			Flags: 1,
+			Value: []byte("good"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Flags = 2
+	arg.DirEnt.Value = []byte("oops")
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Both versions are in the history
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "config/db",
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.History", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 2 {
+		t.Fatalf("bad: %v", dirent)
+	}
+	good := dirent.Entries[0]
+	if string(good.Value) != "good" || string(dirent.Entries[1].Value) != "oops" {
+		t.Fatalf("bad: %v", dirent.Entries)
+	}
+
+	// Look up the good one by its index
+	verR := structs.KeyVersionRequest{
+		Datacenter: "dc1",
+		Key:        "config/db",
+		Version:    good.ModifyIndex,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.GetVersion", &verR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 || string(dirent.Entries[0].Value) != "good" {
+		t.Fatalf("bad: %v", dirent)
+	}
+
+	// Roll back to it
+	arg.Op = structs.KVSRollback
+	arg.DirEnt = structs.DirEntry{
+		Key:       "config/db",
+		RaftIndex: structs.RaftIndex{ModifyIndex: good.ModifyIndex},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("bad: %v", out)
+	}
+	_, d, err := s1.fsm.State().KVSGet("config/db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "good" || d.Flags != 1 || d.ModifyIndex <= good.ModifyIndex {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Versions that aren't kept can't be rolled back to
+	arg.DirEnt.ModifyIndex = 1
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown version") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Move(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, key := range []string{"app/v1/a", "app/v1/b", "app/v2/a"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Flags: 42,
+				Value: []byte(key),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The destination is taken, so this fails
+	arg := structs.KVSMoveRequest{
+		Datacenter:  "dc1",
+		Source:      "app/v1/",
+		Destination: "app/v2/",
+		Prefix:      true,
+		NoOverwrite: true,
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Move", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out {
+		t.Fatalf("should have failed")
+	}
+
+	// Move somewhere free
+	arg.Destination = "app/v3/"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Move", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("bad: %v", out)
+	}
+	state := s1.fsm.State()
+	_, ents, err := state.KVSList("app/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 3 {
+		t.Fatalf("bad: %v", ents)
+	}
+	for i, key := range []string{"app/v2/a", "app/v3/a", "app/v3/b"} {
+		if ents[i].Key != key || ents[i].Flags != 42 {
+			t.Fatalf("bad: %v", ents[i])
+		}
+	}
+
+	// Move a single key
+	arg = structs.KVSMoveRequest{
+		Datacenter:  "dc1",
+		Source:      "app/v3/b",
+		Destination: "app/b",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Move", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err := state.KVSGet("app/b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "app/v1/b" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Moving the whole keyspace isn't allowed
+	arg = structs.KVSMoveRequest{
+		Datacenter:  "dc1",
+		Destination: "backup/",
+		Prefix:      true,
+	}
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Move", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Must provide") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Move_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testListRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writing the destination isn't enough, the source goes away too
+	move := structs.KVSMoveRequest{
+		Datacenter:   "dc1",
+		Source:       "foo/bar",
+		Destination:  "test/bar",
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var out bool
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Move", &move, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Apply_Quota(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSQuotas = map[string]structs.KVSQuota{
+			"*": structs.KVSQuota{MaxBytes: 20, MaxKeys: 2},
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Fill up the prefix's keys
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "app/a",
+			Value: []byte("a"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Key = "app/b"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A third key is over the quota, but other prefixes have their own
+	arg.DirEnt.Key = "app/c"
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "quota of 2 keys") {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Key = "other/c"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Existing keys can be updated within the byte quota
+	arg.DirEnt.Key = "app/a"
+	arg.DirEnt.Value = []byte("aaaaa")
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Value = []byte("aaaaaaaaaaaaaaa")
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "quota of 20 bytes") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Transactions are held to the same quota
+	txn := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSSet,
+					DirEnt: structs.DirEntry{
+						Key:   "app/c",
+						Value: []byte("c"),
+					},
+				},
+			},
+		},
+	}
+	var txnOut structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &txnOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(txnOut.Errors) != 1 || !strings.Contains(txnOut.Errors[0].What, "quota") {
+		t.Fatalf("bad: %#v", txnOut)
+	}
+}
+
+func TestKVS_Quota_WritePaths(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSQuotas = map[string]structs.KVSQuota{
+			"*": structs.KVSQuota{MaxBytes: 200, MaxKeys: 2},
+		}
+		c.KVSCompressThreshold = 100
+		c.KVSRecycleRetention = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Values count as they're stored, so a large value that compresses
+	// well fits.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "big/a",
+			Value: bytes.Repeat([]byte("a"), 1000),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Value = []byte("a")
+	for _, key := range []string{"app/a", "app/b", "other/c"} {
+		arg.DirEnt.Key = key
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Moves count against the destination's quota, after the source is
+	// gone.
+	move := structs.KVSMoveRequest{
+		Datacenter:  "dc1",
+		Source:      "other/c",
+		Destination: "app/c",
+	}
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Move", &move, &out)
+	if err == nil || !strings.Contains(err.Error(), "quota of 2 keys") {
+		t.Fatalf("err: %v", err)
+	}
+	move.Source, move.Destination = "app/a", "app/z"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Move", &move, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Imports count against the quota once the old tree is cleared out.
+	imp := structs.KVSImportRequest{
+		Datacenter: "dc1",
+		Export: structs.KVSExport{
+			Prefix: "app/",
+			Entries: structs.DirEntries{
+				&structs.DirEntry{Key: "app/1", Value: []byte("1")},
+				&structs.DirEntry{Key: "app/2", Value: []byte("2")},
+				&structs.DirEntry{Key: "app/3", Value: []byte("3")},
+			},
+		},
+	}
+	var index uint64
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Import", &imp, &index)
+	if err == nil || !strings.Contains(err.Error(), "quota of 2 keys") {
+		t.Fatalf("err: %v", err)
+	}
+	imp.Export.Entries = imp.Export.Entries[:2]
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &imp, &index); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Restoring a tree from the recycle bin counts the keys it puts back.
+	arg.Op = structs.KVSDeleteTree
+	arg.DirEnt.Key = "app/"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Op = structs.KVSSet
+	arg.DirEnt.Key = "app/x"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	list := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var trees structs.IndexedKVSRecycledTrees
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ListRecycled", &list, &trees); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(trees.Trees) != 1 {
+		t.Fatalf("bad: %v", trees)
+	}
+	restore := structs.KVSRecycleRequest{
+		Datacenter: "dc1",
+		ID:         trees.Trees[0].ID,
+	}
+	var empty struct{}
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Restore", &restore, &empty)
+	if err == nil || !strings.Contains(err.Error(), "quota of 2 keys") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_ApplyEcho(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Flags: 42,
+			Value: []byte("test"),
+		},
+	}
+	var out structs.KVSApplyResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyEcho", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Result || out.Index == 0 || out.DirEnt == nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.DirEnt.Key != "test" || out.DirEnt.Flags != 42 ||
+		out.DirEnt.CreateIndex != out.Index || out.DirEnt.ModifyIndex != out.Index {
+		t.Fatalf("bad: %#v", out.DirEnt)
+	}
+
+	// A failed check and set should echo back the unchanged entry
+	arg.Op = structs.KVSCAS
+	arg.DirEnt.ModifyIndex = out.Index + 1
+	arg.DirEnt.Flags = 43
+	var cas structs.KVSApplyResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyEcho", &arg, &cas); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cas.Result || cas.DirEnt == nil || cas.DirEnt.Flags != 42 ||
+		cas.DirEnt.ModifyIndex != out.Index {
+		t.Fatalf("bad: %#v", cas)
+	}
+
+	// Deletes should echo back no entry
+	arg.Op = structs.KVSDelete
+	var del structs.KVSApplyResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyEcho", &arg, &del); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if del.Index <= out.Index || del.DirEnt != nil {
+		t.Fatalf("bad: %#v", del)
+	}
+}
+
+func TestKVS_ApplyIndex(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var out structs.KVSApplyResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyIndex", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Result || out.Index == 0 || out.DirEnt != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A stale read given the write's index should see it
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+		QueryOptions: structs.QueryOptions{
+			AllowStale:       true,
+			ConsistencyIndex: out.Index,
+		},
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 || dirent.Entries[0].ModifyIndex != out.Index {
+		t.Fatalf("bad: %v", dirent)
+	}
+
+	// An index that's never reached times out
+	getR.ConsistencyIndex = out.Index + 1000
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_VerifyFence(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create a couple of sessions to take turns with the lock
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(2, first); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(3, second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Acquiring the lock should hand back a fence token
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "test",
+			Session: first.ID,
+		},
+	}
+	var out structs.KVSApplyResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyEcho", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Result || out.Fence == nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	fence := *out.Fence
+	expected := structs.FenceToken{
+		Key:          "test",
+		CreateIndex:  out.Index,
+		LockIndex:    1,
+		Session:      first.ID,
+		SessionIndex: 2,
+	}
+	if fence != expected {
+		t.Fatalf("bad: %#v", fence)
+	}
+
+	// The token should be valid while the lock is held
+	verify := structs.KVSFenceRequest{
+		Datacenter: "dc1",
+		Fence:      fence,
+	}
+	var check structs.KVSFenceResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.VerifyFence", &verify, &check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !check.Valid || check.Current == nil || *check.Current != fence {
+		t.Fatalf("bad: %#v", check)
+	}
+
+	// Hand the lock over to the second session
+	arg.Op = structs.KVSUnlock
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyEcho", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Result || out.Fence != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	arg.Op = structs.KVSLock
+	arg.DirEnt.Session = second.ID
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyEcho", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Result || out.Fence == nil || out.Fence.LockIndex != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The old token should now be stale
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.VerifyFence", &verify, &check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if check.Valid || check.Current == nil || *check.Current != *out.Fence {
+		t.Fatalf("bad: %#v", check)
+	}
+
+	// Delete the key and take the lock again with the first session. The
+	// lock index starts over, but the old token still isn't valid.
+	del := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSDelete,
+		DirEnt: structs.DirEntry{
+			Key: "test",
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &del, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Session = first.ID
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ApplyIndex", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Result || out.Fence == nil || out.Fence.LockIndex != 1 ||
+		out.Fence.CreateIndex != out.Index {
+		t.Fatalf("bad: %#v", out)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.VerifyFence", &verify, &check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if check.Valid || check.Current == nil || *check.Current != *out.Fence {
+		t.Fatalf("bad: %#v", check)
+	}
+}
+
+func TestKVS_Apply_Recycle(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clk
+		c.KVSRecycleRetention = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a key and then delete its tree
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo/bar",
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Op = structs.KVSDeleteTree
+	arg.DirEnt.Key = "foo/"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The key should be gone
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("foo/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// The tree should be in the recycle bin
+	list := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var trees structs.IndexedKVSRecycledTrees
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ListRecycled", &list, &trees); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(trees.Trees) != 1 || trees.Trees[0].Prefix != "foo/" {
+		t.Fatalf("bad: %#v", trees)
+	}
+	if !trees.Trees[0].Expires.Equal(clk.Now().Add(time.Hour)) {
+		t.Fatalf("bad: %#v", trees.Trees[0])
+	}
+
+	// Restore it
+	restore := structs.KVSRecycleRequest{
+		Datacenter: "dc1",
+		ID:         trees.Trees[0].ID,
+	}
+	var empty struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Restore", &restore, &empty); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err = state.KVSGet("foo/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// A second restore should fail
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Restore", &restore, &empty)
+	if err == nil || !strings.Contains(err.Error(), "Unknown recycled tree") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete the tree again, and the leader should drop it from the bin
+	// once its clock passes the retention time.
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	clk.Advance(2 * time.Hour)
+	testutil.WaitForResult(func() (bool, error) {
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.ListRecycled", &list, &trees); err != nil {
+			return false, err
+		}
+		return len(trees.Trees) == 0, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestKVS_Apply_RecycleCAS(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSRecycleRetention = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo/bar",
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("foo/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A conditional tree delete with the wrong index does nothing.
+	arg.Op = structs.KVSDeleteTreeCAS
+	arg.DirEnt.Key = "foo/"
+	arg.DirEnt.ModifyIndex = d.ModifyIndex - 1
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out {
+		t.Fatalf("should have failed")
+	}
+
+	// With the right index the tree goes into the recycle bin.
+	arg.DirEnt.ModifyIndex = d.ModifyIndex
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("should have worked")
+	}
+	_, trees, err := state.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(trees) != 1 || trees[0].Prefix != "foo/" {
+		t.Fatalf("bad: %#v", trees)
+	}
+}
+
+func TestKVS_Apply_Encrypted(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSEncryptionKey = []byte("0123456789abcdef")
+		c.KVSEncryptPrefixes = []string{"secret/"}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write an encrypted and a plain key
+	for _, key := range []string{"secret/foo", "public/foo"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the secret should be encrypted in the state store
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("secret/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) == "test" {
+		t.Fatalf("bad: %v", d)
+	}
+	_, d, err = state.KVSGet("public/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Reads should see the plain value
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "secret/",
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 || string(dirent.Entries[0].Value) != "test" {
+		t.Fatalf("bad: %v", dirent)
+	}
+
+	getR.Key = "secret/foo"
+	dirent = structs.IndexedDirEntries{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 || string(dirent.Entries[0].Value) != "test" {
+		t.Fatalf("bad: %v", dirent)
+	}
+
+	// Values that look encrypted can't be written under any prefix, since
+	// reads would try to decrypt them
+	for _, key := range []string{"secret/fake", "public/fake"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte(string(kvsCipherMagic) + "junk"),
+			},
+		}
+		var out bool
+		err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), "reserved prefix") {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestKVS_Apply_Compressed(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSCompressThreshold = 1024
+		c.KVSEncryptionKey = []byte("0123456789abcdef")
+		c.KVSEncryptPrefixes = []string{"secret/"}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a large value, both plain and encrypted, and a small one
+	large := bytes.Repeat([]byte(`{"hello": "world"}`), 1000)
+	for key, value := range map[string][]byte{
+		"public/large": large,
+		"secret/large": large,
+		"public/small": []byte("test"),
+	} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: value,
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the large values should be compressed in the state store
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("public/large")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || !bytes.HasPrefix(d.Value, kvsCompressMagic) || len(d.Value) >= len(large) {
+		t.Fatalf("bad: %v", d)
+	}
+	_, d, err = state.KVSGet("secret/large")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || len(d.Value) >= len(large) {
+		t.Fatalf("bad: %v", d)
+	}
+	_, d, err = state.KVSGet("public/small")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Reads should see the original values
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "",
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 3 {
+		t.Fatalf("bad: %v", dirent)
+	}
+	for _, ent := range dirent.Entries {
+		if ent.Key != "public/small" && !bytes.Equal(ent.Value, large) {
+			t.Fatalf("bad: %v", ent)
+		}
+	}
+
+	// Values that look compressed can't be written, since reads would
+	// try to decompress them
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "public/fake",
+			Value: []byte(string(kvsCompressMagic) + "junk"),
+		},
+	}
+	var out bool
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "reserved prefix") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Apply_AppendPatch(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSCompressThreshold = 16
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Lock the key so we can check the lock is kept
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "log",
+			Flags:   42,
+			Session: session.ID,
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Append some lines, enough for the value to be compressed
+	var expected []byte
+	for i := 0; i < 50; i++ {
+		line := []byte(fmt.Sprintf("line %d\n", i))
+		expected = append(expected, line...)
+		arg = structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSAppend,
+			DirEnt: structs.DirEntry{
+				Key:   "log",
+				Value: line,
+			},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !out {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+
+	_, d, err := state.KVSGet("log")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || !bytes.HasPrefix(d.Value, kvsCompressMagic) {
+		t.Fatalf("bad: %v", d)
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "log",
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 {
+		t.Fatalf("bad: %v", dirent)
+	}
+	d = dirent.Entries[0]
+	if !bytes.Equal(d.Value, expected) || d.Flags != 42 ||
+		d.Session != session.ID || d.LockIndex != 1 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Patch a key into existence, then change it
+	for _, patch := range []string{`{"a": 1, "b": 2}`, `{"b": null, "c": [3]}`} {
+		arg = structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSPatch,
+			DirEnt: structs.DirEntry{
+				Key:   "config",
+				Value: []byte(patch),
+			},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	_, d, err = state.KVSGet("config")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != `{"a":1,"c":[3]}` {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// A patch of a value that isn't JSON fails
+	arg.DirEnt.Key = "log"
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "isn't JSON") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestKVS_Apply_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -127,6 +1460,28 @@ func TestKVS_Apply_ACLDeny(t *testing.T) {
 	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
 		t.Fatalf("err: %v", err)
 	}
+
+	// Try a patch on a key whose value can't be patched. The ACL should
+	// be checked before the current value is looked at.
+	argR = structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo/bar",
+			Value: []byte("not json"),
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &argR, &outR); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	argR.Op = structs.KVSPatch
+	argR.DirEnt.Value = []byte(`{"a": 1}`)
+	argR.Token = id
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &argR, &outR)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
 }
 
 func TestKVS_Get(t *testing.T) {
@@ -387,6 +1742,121 @@ func TestKVSEndpoint_List_Blocking(t *testing.T) {
 	}
 }
 
+func TestKVSEndpoint_List_BlockingHash(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := func(key, value string) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte(value),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	set("/test/key1", "foo")
+	set("/test/key2", "bar")
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "/test",
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dirent.Hash == "" {
+		t.Fatalf("missing hash")
+	}
+
+	// A hash without an index doesn't block.
+	getR.Hash = dirent.Hash
+	var unblocked structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &unblocked); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if unblocked.Index != dirent.Index || unblocked.Hash != dirent.Hash {
+		t.Fatalf("bad: %v", unblocked)
+	}
+
+	// Rewriting a key with the same value bumps the index but shouldn't
+	// wake a query that passed in the hash.
+	getR.MinQueryIndex = dirent.Index
+	getR.Hash = dirent.Hash
+	getR.MaxQueryTime = 300 * time.Millisecond
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		set("/test/key1", "foo")
+	}()
+	start := time.Now()
+	var same structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &same); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) < 300*time.Millisecond {
+		t.Fatalf("too fast")
+	}
+	if same.Index <= dirent.Index || same.Hash != dirent.Hash {
+		t.Fatalf("bad: %v", same)
+	}
+
+	// A real change wakes it up.
+	getR.MinQueryIndex = same.Index
+	getR.MaxQueryTime = time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		set("/test/key1", "baz")
+	}()
+	start = time.Now()
+	var changed structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &changed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) >= time.Second {
+		t.Fatalf("should have woken up")
+	}
+	if changed.Hash == "" || changed.Hash == dirent.Hash {
+		t.Fatalf("bad: %v", changed)
+	}
+	if string(changed.Entries[0].Value) != "baz" {
+		t.Fatalf("bad: %v", changed.Entries[0])
+	}
+
+	// A real change right after one that leaves the hash alone should
+	// still wake the same query up.
+	getR.MinQueryIndex = changed.Index
+	getR.Hash = changed.Hash
+	getR.MaxQueryTime = 2 * time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		set("/test/key1", "baz")
+		time.Sleep(100 * time.Millisecond)
+		set("/test/key2", "qux")
+	}()
+	start = time.Now()
+	var again structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &again); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) >= time.Second {
+		t.Fatalf("should have woken up")
+	}
+	if again.Hash == changed.Hash || string(again.Entries[1].Value) != "qux" {
+		t.Fatalf("bad: %v", again)
+	}
+}
+
 func TestKVSEndpoint_List_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -540,6 +2010,75 @@ func TestKVSEndpoint_ListKeys(t *testing.T) {
 	}
 }
 
+func TestKVSEndpoint_ListKeys_Paged(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	keys := []string{
+		"test/key1",
+		"test/key2",
+		"test/sub/key3",
+		"test/sub/deep/key4",
+		"test/sub/deep/key5",
+	}
+	for _, key := range keys {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key: key,
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Page through two levels of the tree
+	getR := structs.KeyListRequest{
+		Datacenter: "dc1",
+		Prefix:     "test/",
+		Seperator:  "/",
+		Depth:      2,
+		Limit:      2,
+	}
+	var pages [][]string
+	for {
+		var list structs.IndexedKeyList
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.ListKeys", &getR, &list); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		pages = append(pages, list.Keys)
+		if list.NextCursor == "" {
+			break
+		}
+		getR.Cursor = list.NextCursor
+	}
+	expect := [][]string{
+		[]string{"test/key1", "test/key2"},
+		[]string{"test/sub/deep/", "test/sub/key3"},
+	}
+	if !reflect.DeepEqual(pages, expect) {
+		t.Fatalf("bad: %v", pages)
+	}
+
+	// A page past the end is empty
+	getR.Cursor = "test/zzz"
+	var list structs.IndexedKeyList
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ListKeys", &getR, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list.Keys) != 0 || list.NextCursor != "" {
+		t.Fatalf("bad: %v", list)
+	}
+}
+
 func TestKVSEndpoint_ListKeys_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -618,6 +2157,214 @@ func TestKVSEndpoint_ListKeys_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestKVS_ExportImport(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for key, value := range map[string]string{
+		"staging/db/host": "db-staging",
+		"staging/db/port": "5432",
+		"prod/db/host":    "db-prod",
+		"prod/stale":      "stale",
+	} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Flags: 42,
+				Value: []byte(value),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Export the staging tree
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "staging/",
+	}
+	var export structs.IndexedKVSExport
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Export", &getR, &export); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if export.Index == 0 || export.Export.Index != export.Index ||
+		export.Export.Prefix != "staging/" || len(export.Export.Entries) != 2 {
+		t.Fatalf("bad: %v", export)
+	}
+
+	// Promote it to prod
+	arg := structs.KVSImportRequest{
+		Datacenter: "dc1",
+		Prefix:     "prod/",
+		Export:     export.Export,
+	}
+	var index uint64
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &arg, &index); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index <= export.Index {
+		t.Fatalf("bad: %d", index)
+	}
+
+	// Prod matches staging, and staging is untouched
+	state := s1.fsm.State()
+	for _, prefix := range []string{"prod/", "staging/"} {
+		_, ents, err := state.KVSList(prefix)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(ents) != 2 {
+			t.Fatalf("bad: %v", ents)
+		}
+		for i, ent := range ents {
+			orig := export.Export.Entries[i]
+			if ent.Key != prefix+strings.TrimPrefix(orig.Key, "staging/") ||
+				string(ent.Value) != string(orig.Value) || ent.Flags != 42 {
+				t.Fatalf("bad: %v", ent)
+			}
+		}
+	}
+
+	// Entries have to be under the export's prefix
+	arg.Export.Prefix = "staging/db/host"
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &arg, &index)
+	if err == nil || !strings.Contains(err.Error(), "must be under the prefix") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Import_Limits(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSMaxValueSize = 400 * 1024
+		c.KVSRecycleRetention = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "prod/old",
+			Value: []byte("old"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &set, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Values over the limit are rejected.
+	a := bytes.Repeat([]byte("a"), 300*1024)
+	b := bytes.Repeat([]byte("b"), 300*1024)
+	arg := structs.KVSImportRequest{
+		Datacenter: "dc1",
+		Export: structs.KVSExport{
+			Prefix: "prod/",
+			Entries: structs.DirEntries{
+				&structs.DirEntry{Key: "prod/a", Value: make([]byte, 500*1024)},
+			},
+		},
+	}
+	var index uint64
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &arg, &index)
+	if err == nil || !strings.Contains(err.Error(), "byte limit") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Values that don't fit in the import together are chunked.
+	arg.Export.Entries = structs.DirEntries{
+		&structs.DirEntry{Key: "prod/a", Value: a},
+		&structs.DirEntry{Key: "prod/b", Value: b},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &arg, &index); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	_, ents, err := state.KVSList("prod/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 2 || !bytes.Equal(ents[0].Value, a) || !bytes.Equal(ents[1].Value, b) {
+		t.Fatalf("bad: %d", len(ents))
+	}
+
+	// The replaced tree went to the recycle bin.
+	_, trees, err := state.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(trees) != 1 || len(trees[0].Entries) != 1 || trees[0].Entries[0].Key != "prod/old" {
+		t.Fatalf("bad: %#v", trees)
+	}
+}
+
+func TestKVS_Import_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create the ACL
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testListRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := out
+
+	// Importing needs write access to the whole prefix
+	importR := structs.KVSImportRequest{
+		Datacenter: "dc1",
+		Export: structs.KVSExport{
+			Prefix: "foo/",
+			Entries: structs.DirEntries{
+				&structs.DirEntry{Key: "foo/bar", Value: []byte("test")},
+			},
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var index uint64
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &importR, &index)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	importR.Prefix = "test/pub/"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Import", &importR, &index); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestKVS_Apply_LockDelay(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
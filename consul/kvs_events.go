@@ -0,0 +1,168 @@
+package consul
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// kvsEventInterval is the least time between the user events fired for
+	// KV writes. The writes in between are coalesced into the next event.
+	kvsEventInterval = time.Second
+
+	// kvsEventMaxChanges caps the writes held for a single event. Only a
+	// few fit in a user event anyway.
+	kvsEventMaxChanges = 32
+)
+
+// kvsEventNames returns the names of the user events to fire for a change
+// to the given key, once each. A deleted tree fires the events of the
+// prefixes it overlaps.
+func (s *Server) kvsEventNames(op, key string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for prefix, name := range s.config.KVSEvents {
+		if seen[name] {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) ||
+			(op == structs.ChangeFeedDeleteTree && strings.HasPrefix(prefix, key)) {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	return names
+}
+
+// addKVSChange adds a change to the event that's waiting to be fired,
+// dropping the oldest change if the event is full.
+func addKVSChange(event *structs.KVSChangeEvent, entry *structs.ChangeFeedEntry) {
+	if len(event.Changes) == kvsEventMaxChanges {
+		event.Changes = event.Changes[1:]
+		event.Truncated = true
+	}
+	event.Changes = append(event.Changes, &structs.KVSChange{
+		Key:   entry.Key,
+		Op:    entry.Op,
+		Index: entry.Index,
+	})
+	event.Index = entry.Index
+}
+
+// fireKVSEvent fires a user event describing the KV changes since the last
+// one, leaving out the oldest changes if they don't all fit.
+func (s *Server) fireKVSEvent(name string, change *structs.KVSChangeEvent) error {
+	eventName := userEventName(name)
+	for {
+		payload, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+
+		event := structs.UserEvent{
+			ID:      generateUUID(),
+			Name:    name,
+			Payload: payload,
+			Version: structs.UserEventVersion,
+		}
+		buf, err := structs.EncodeUserEvent(&event)
+		if err != nil {
+			return err
+		}
+		if len(eventName)+len(buf) <= serf.UserEventSizeLimit || len(change.Changes) == 0 {
+			return s.serfLAN.UserEvent(eventName, buf, false)
+		}
+		change.Changes = change.Changes[1:]
+		change.Truncated = true
+	}
+}
+
+// fireKVSEvents is a long running goroutine that follows the change feed
+// while we are the leader, and fires user events for the writes under the
+// prefixes in the KVSEvents config. Writes are coalesced so that at most
+// one event with each name is fired per kvsEventInterval. It starts from
+// the newest change, so writes made while no leader was following the feed
+// don't fire events.
+func (s *Server) fireKVSEvents(stopCh chan struct{}) {
+	state := s.fsm.State()
+	watch := state.GetQueryWatch("ChangeFeed")
+	notifyCh := make(chan struct{}, 1)
+	defer watch.Clear(notifyCh)
+
+	// Asking for the changes after the highest possible sequence number
+	// just gets us the newest one.
+	_, feed, err := state.ChangeFeed(^uint64(0), 0)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to read the change feed: %v", err)
+		return
+	}
+	since := feed.LastSeq
+
+	pending := make(map[string]*structs.KVSChangeEvent)
+	var lastFired time.Time
+	var fireCh <-chan time.Time
+	fire := func() {
+		for name, change := range pending {
+			if err := s.fireKVSEvent(name, change); err != nil {
+				s.logger.Printf("[WARN] consul: failed to fire event '%s' for KV writes: %v",
+					name, err)
+			}
+		}
+		pending = make(map[string]*structs.KVSChangeEvent)
+		lastFired = s.config.Clock.Now()
+	}
+
+	for {
+		// Register for changes before looking, so none are missed.
+		watch.Wait(notifyCh)
+
+		_, feed, err := state.ChangeFeed(since, 0)
+		if err != nil {
+			s.logger.Printf("[ERR] consul: failed to read the change feed: %v", err)
+			return
+		}
+		if feed.Truncated {
+			s.logger.Printf("[WARN] consul: KV events fell behind the change feed, some writes were skipped")
+		}
+		for _, entry := range feed.Entries {
+			if entry.Type != structs.ChangeFeedKVS {
+				continue
+			}
+			for _, name := range s.kvsEventNames(entry.Op, entry.Key) {
+				change, ok := pending[name]
+				if !ok {
+					change = &structs.KVSChangeEvent{}
+					pending[name] = change
+				}
+				addKVSChange(change, entry)
+			}
+		}
+		since = feed.LastSeq
+
+		// Fire the pending events now, unless we fired too recently, in
+		// which case they wait out the rest of the interval.
+		if len(pending) > 0 && fireCh == nil {
+			wait := kvsEventInterval - s.config.Clock.Now().Sub(lastFired)
+			if wait > 0 {
+				fireCh = s.config.Clock.After(wait)
+			} else {
+				fire()
+			}
+		}
+
+		select {
+		case <-notifyCh:
+		case <-fireCh:
+			fireCh = nil
+			fire()
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
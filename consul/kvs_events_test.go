@@ -0,0 +1,160 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestServer_KVSEvents(t *testing.T) {
+	events := make(chan serf.UserEvent, 16)
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSEvents = map[string]string{
+			"config/": "config-changed",
+		}
+		c.UserEventHandler = func(e serf.UserEvent) {
+			events <- e
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := func(key string) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(client, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	next := func() *structs.KVSChangeEvent {
+		var e serf.UserEvent
+		select {
+		case e = <-events:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no event fired")
+		}
+		if e.Name != "config-changed" {
+			t.Fatalf("bad: %#v", e)
+		}
+
+		// The payload is a user event in the agents' format, wrapping
+		// the changes themselves.
+		var ue structs.UserEvent
+		if err := structs.DecodeUserEvent(e.Payload, &ue); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ue.ID == "" || ue.Name != "config-changed" || ue.Version != structs.UserEventVersion {
+			t.Fatalf("bad: %#v", ue)
+		}
+		var change structs.KVSChangeEvent
+		if err := json.Unmarshal(ue.Payload, &change); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return &change
+	}
+
+	// Only the write under the registered prefix should fire an event
+	set("other/foo")
+	set("config/db")
+	change := next()
+	_, d, err := s1.fsm.State().KVSGet("config/db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := &structs.KVSChangeEvent{
+		Changes: []*structs.KVSChange{
+			&structs.KVSChange{
+				Key:   "config/db",
+				Op:    structs.ChangeFeedSet,
+				Index: d.ModifyIndex,
+			},
+		},
+		Index: d.ModifyIndex,
+	}
+	if !reflect.DeepEqual(change, expected) {
+		t.Fatalf("bad: %#v", change)
+	}
+
+	// Writes made soon after are coalesced into a single event
+	start := time.Now()
+	set("config/a")
+	set("config/b")
+	change = next()
+	if time.Since(start) > kvsEventInterval+time.Second {
+		t.Fatalf("event took too long")
+	}
+	if len(change.Changes) != 2 || change.Truncated ||
+		change.Changes[0].Key != "config/a" || change.Changes[1].Key != "config/b" ||
+		change.Index != change.Changes[1].Index {
+		t.Fatalf("bad: %#v", change)
+	}
+
+	// Too many writes to fit in an event leave out the oldest ones
+	change = &structs.KVSChangeEvent{}
+	for i := 0; i < 40; i++ {
+		addKVSChange(change, &structs.ChangeFeedEntry{
+			Key:   fmt.Sprintf("config/key%d", i),
+			Op:    structs.ChangeFeedSet,
+			Index: uint64(100 + i),
+		})
+	}
+	if len(change.Changes) != kvsEventMaxChanges || !change.Truncated {
+		t.Fatalf("bad: %#v", change)
+	}
+	if err := s1.fireKVSEvent("config-changed", change); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	change = next()
+	last := change.Changes[len(change.Changes)-1]
+	if !change.Truncated || last.Key != "config/key39" || change.Index != 139 {
+		t.Fatalf("bad: %#v", change)
+	}
+
+	var e serf.UserEvent
+	select {
+	case e = <-events:
+		t.Fatalf("unexpected event: %#v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_kvsEventNames(t *testing.T) {
+	s := &Server{config: &Config{
+		KVSEvents: map[string]string{
+			"config/":    "config-changed",
+			"config/db/": "config-changed",
+			"flags/":     "flags-changed",
+		},
+	}}
+
+	if names := s.kvsEventNames(structs.ChangeFeedSet, "config/db/host"); len(names) != 1 || names[0] != "config-changed" {
+		t.Fatalf("bad: %v", names)
+	}
+	if names := s.kvsEventNames(structs.ChangeFeedSet, "other"); len(names) != 0 {
+		t.Fatalf("bad: %v", names)
+	}
+
+	// A tree delete above both prefixes fires both events
+	if names := s.kvsEventNames(structs.ChangeFeedDeleteTree, ""); len(names) != 2 {
+		t.Fatalf("bad: %v", names)
+	}
+}
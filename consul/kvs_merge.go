@@ -0,0 +1,70 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// mergeKVSValue works out the new value of a key for an append or patch
+// operation, given its current value.
+func mergeKVSValue(op structs.KVSOp, current, change []byte) ([]byte, error) {
+	switch op {
+	case structs.KVSAppend:
+		value := make([]byte, 0, len(current)+len(change))
+		value = append(value, current...)
+		return append(value, change...), nil
+
+	case structs.KVSPatch:
+		var patch interface{}
+		if err := decodeJSONValue(change, &patch); err != nil {
+			var verr structs.ValidationErrors
+			verr.Add("Value", "isn't a valid JSON merge patch: %v", err)
+			return nil, verr
+		}
+
+		// A missing or empty value is patched as if it were null.
+		var target interface{}
+		if len(bytes.TrimSpace(current)) > 0 {
+			if err := decodeJSONValue(current, &target); err != nil {
+				return nil, fmt.Errorf("Current value isn't JSON: %v", err)
+			}
+		}
+		return json.Marshal(jsonMergePatch(target, patch))
+
+	default:
+		return nil, fmt.Errorf("Invalid merge operation '%s'", op)
+	}
+}
+
+// decodeJSONValue decodes a JSON document, keeping numbers as they are
+// written rather than turning them into floats.
+func decodeJSONValue(buf []byte, out interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+// jsonMergePatch applies a JSON merge patch, as described in RFC 7386, to a
+// decoded document. Objects are merged key by key, a null removes a key,
+// and anything else replaces the target outright.
+func jsonMergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = jsonMergePatch(t[key], value)
+		}
+	}
+	return t
+}
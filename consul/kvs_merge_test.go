@@ -0,0 +1,81 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestMergeKVSValue_Append(t *testing.T) {
+	current := []byte("hello")
+	value, err := mergeKVSValue(structs.KVSAppend, current[:3], []byte(" world"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(value) != "hel world" {
+		t.Fatalf("bad: %q", value)
+	}
+
+	// The current value isn't written to
+	if string(current) != "hello" {
+		t.Fatalf("bad: %q", current)
+	}
+
+	// Appending to nothing gives just the change
+	value, err = mergeKVSValue(structs.KVSAppend, nil, []byte("hello"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(value) != "hello" {
+		t.Fatalf("bad: %q", value)
+	}
+}
+
+func TestMergeKVSValue_Patch(t *testing.T) {
+	// Examples from RFC 7386
+	cases := []struct {
+		current string
+		patch   string
+		expect  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+
+		// A missing value is patched as null, and numbers are kept
+		{``, `{"a":1}`, `{"a":1}`},
+		{`{"n":12345678901234567890}`, `{"m":1.50}`, `{"m":1.50,"n":12345678901234567890}`},
+	}
+	for _, tc := range cases {
+		value, err := mergeKVSValue(structs.KVSPatch, []byte(tc.current), []byte(tc.patch))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(value) != tc.expect {
+			t.Fatalf("patch %s on %s: got %s, expected %s", tc.patch, tc.current, value, tc.expect)
+		}
+	}
+
+	// A bad patch is a validation error
+	_, err := mergeKVSValue(structs.KVSPatch, []byte(`{}`), []byte(`{`))
+	if !structs.IsValidationError(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The current value has to be JSON
+	if _, err := mergeKVSValue(structs.KVSPatch, []byte(`nope`), []byte(`{}`)); err == nil {
+		t.Fatalf("should fail")
+	}
+}
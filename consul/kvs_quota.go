@@ -0,0 +1,157 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// kvsQuotaDefault is the name of the quota that applies to top-level
+// prefixes without their own.
+const kvsQuotaDefault = "*"
+
+// kvsQuota returns the quota for the given top-level prefix, or nil if
+// there isn't one.
+func (s *Server) kvsQuota(prefix string) *structs.KVSQuota {
+	if quota, ok := s.config.KVSQuotas[prefix]; ok {
+		return &quota
+	}
+	if quota, ok := s.config.KVSQuotas[kvsQuotaDefault]; ok {
+		return &quota
+	}
+	return nil
+}
+
+// checkKVSQuota returns an error if writing the given value to the given
+// key would take its top-level prefix over its quota. The value is sized
+// as it will be stored, after encoding, like the entries already counted
+// in the usage. Writes that don't add to the usage are always allowed, so
+// a prefix that is already over its quota can still be cleaned up.
+func (s *Server) checkKVSQuota(key string, value []byte) error {
+	return s.newKVSQuotaCheck().set(key, value)
+}
+
+// kvsQuotaCheck checks a series of writes against the quotas, such as the
+// operations of a transaction. Each write is counted on top of the ones
+// before it, so they can't get past a quota together.
+type kvsQuotaCheck struct {
+	srv *Server
+
+	// usage is the usage of each top-level prefix after the writes so far.
+	usage map[string]*structs.KVSUsage
+
+	// sizes is the size of each key after the writes so far, or -1 if it
+	// has been deleted.
+	sizes map[string]int
+}
+
+// newKVSQuotaCheck returns a check that starts from the current usage.
+func (s *Server) newKVSQuotaCheck() *kvsQuotaCheck {
+	return &kvsQuotaCheck{
+		srv:   s,
+		usage: make(map[string]*structs.KVSUsage),
+		sizes: make(map[string]int),
+	}
+}
+
+// set checks a write of the given value to the given key, and counts it
+// if it's allowed.
+func (q *kvsQuotaCheck) set(key string, value []byte) error {
+	if len(q.srv.config.KVSQuotas) == 0 {
+		return nil
+	}
+	usage, size, err := q.current(key)
+	if err != nil {
+		return err
+	}
+	quota := q.srv.kvsQuota(usage.Prefix)
+	if quota == nil {
+		return nil
+	}
+
+	keys, bytes := usage.Keys, usage.Bytes+len(key)+len(value)
+	if size < 0 {
+		keys++
+	} else {
+		bytes -= size
+	}
+	if quota.MaxKeys > 0 && keys > quota.MaxKeys && keys > usage.Keys {
+		return fmt.Errorf("KV prefix '%s' is over its quota of %d keys", usage.Prefix, quota.MaxKeys)
+	}
+	if quota.MaxBytes > 0 && bytes > quota.MaxBytes && bytes > usage.Bytes {
+		return fmt.Errorf("KV prefix '%s' is over its quota of %d bytes", usage.Prefix, quota.MaxBytes)
+	}
+	usage.Keys, usage.Bytes = keys, bytes
+	q.sizes[key] = len(key) + len(value)
+	return nil
+}
+
+// delete counts the removal of the given key.
+func (q *kvsQuotaCheck) delete(key string) error {
+	if len(q.srv.config.KVSQuotas) == 0 {
+		return nil
+	}
+	usage, size, err := q.current(key)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		usage.Keys--
+		usage.Bytes -= size
+		q.sizes[key] = -1
+	}
+	return nil
+}
+
+// deleteTree counts the removal of every key under the given prefix.
+func (q *kvsQuotaCheck) deleteTree(prefix string) error {
+	if len(q.srv.config.KVSQuotas) == 0 {
+		return nil
+	}
+	_, ents, err := q.srv.fsm.State().KVSList(prefix)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if err := q.delete(ent.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// current returns the usage of the key's top-level prefix and the size of
+// the key, or -1 if it doesn't exist, after the writes so far.
+func (q *kvsQuotaCheck) current(key string) (*structs.KVSUsage, int, error) {
+	usage, existing, err := q.srv.fsm.State().KVSPrefixUsage(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if counted, ok := q.usage[usage.Prefix]; ok {
+		usage = counted
+	} else {
+		q.usage[usage.Prefix] = usage
+	}
+
+	size, ok := q.sizes[key]
+	if !ok {
+		size = -1
+		if existing != nil {
+			size = len(existing.Key) + len(existing.Value)
+		}
+	}
+	return usage, size, nil
+}
+
+// kvsUsage returns the usage of every top-level prefix in the local state
+// store, along with its quota.
+func (s *Server) kvsUsage() (uint64, structs.KVSUsages, error) {
+	index, usages, err := s.fsm.State().KVSUsage()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, usage := range usages {
+		usage.Quota = s.kvsQuota(usage.Prefix)
+	}
+	return index, usages, nil
+}
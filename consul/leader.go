@@ -2,6 +2,7 @@ package consul
 
 import (
 	"fmt"
+	"hash/fnv"
 	"net"
 	"strconv"
 	"strings"
@@ -59,6 +60,14 @@ func (s *Server) leaderLoop(stopCh chan struct{}) {
 		s.logger.Printf("[WARN] consul: failed to broadcast new leader event: %v", err)
 	}
 
+	// Turn writes under the configured KV prefixes into user events
+	if len(s.config.KVSEvents) > 0 {
+		go s.fireKVSEvents(stopCh)
+	}
+
+	// Start and end maintenance windows on schedule
+	go s.maintenanceWindowsLoop(stopCh)
+
 	// Reconcile channel is only used once initial reconcile
 	// has succeeded
 	var reconcileCh chan serf.Member
@@ -94,6 +103,21 @@ RECONCILE:
 		goto WAIT
 	}
 
+	// Drop any expired trees from the KV recycle bin
+	go s.reapKVSRecycled()
+
+	// Remove external services that weren't registered again in time
+	go s.reapExpiredServices()
+
+	// Delete KV entries whose TTL has run out
+	go s.reapExpiredKeys()
+
+	// Warn if the state store has grown past any capacity thresholds
+	go s.checkCapacity()
+
+	// Spread the external checks across the checkers that are alive
+	s.assignExternalChecks()
+
 	// Initial reconcile worked, now we can process the channel
 	// updates
 	reconcileCh = s.reconcileCh
@@ -111,6 +135,9 @@ WAIT:
 			goto RECONCILE
 		case member := <-reconcileCh:
 			s.reconcileMember(member)
+			if isExternalChecker(member) {
+				s.assignExternalChecks()
+			}
 		case index := <-s.tombstoneGC.ExpireCh():
 			go s.reapTombstones(index)
 		}
@@ -358,6 +385,11 @@ func (s *Server) shouldHandleMember(member serf.Member) bool {
 // handleAliveMember is used to ensure the node
 // is registered, with a passing health check.
 func (s *Server) handleAliveMember(member serf.Member) error {
+	// A member that came back is no longer waiting to be reaped
+	s.reapDeferredLock.Lock()
+	delete(s.reapDeferred, member.Name)
+	s.reapDeferredLock.Unlock()
+
 	// Register consul service if a server
 	var service *structs.NodeService
 	if valid, parts := isConsulServer(member); valid {
@@ -482,9 +514,52 @@ func (s *Server) handleLeftMember(member serf.Member) error {
 // handleReapMember is used to handle members that have been
 // reaped after a prolonged failure. They are deregistered.
 func (s *Server) handleReapMember(member serf.Member) error {
+	deferred, err := s.deferReap(member)
+	if err != nil || deferred {
+		return err
+	}
 	return s.handleDeregisterMember("reaped", member)
 }
 
+// deferReap returns true if reaping the member should wait because its
+// sessions still hold locks and the ReapLockGracePeriod hasn't run out.
+// Deferred nodes stay in the catalog, so the next reconcile tries again.
+func (s *Server) deferReap(member serf.Member) (bool, error) {
+	grace := s.config.ReapLockGracePeriod
+	if grace == 0 {
+		return false, nil
+	}
+
+	state := s.fsm.State()
+	_, locks, err := state.NodeLocks(member.Name)
+	if err != nil {
+		return false, err
+	}
+
+	s.reapDeferredLock.Lock()
+	defer s.reapDeferredLock.Unlock()
+	if len(locks) == 0 {
+		delete(s.reapDeferred, member.Name)
+		return false, nil
+	}
+
+	first, ok := s.reapDeferred[member.Name]
+	if !ok {
+		first = s.config.Clock.Now()
+		s.reapDeferred[member.Name] = first
+	}
+	if s.config.Clock.Now().Sub(first) < grace {
+		s.logger.Printf("[INFO] consul: member '%s' holds %d lock(s), delaying reap", member.Name, len(locks))
+		metrics.IncrCounter([]string{"consul", "leader", "reap_deferred"}, 1)
+		return true, nil
+	}
+
+	delete(s.reapDeferred, member.Name)
+	s.logger.Printf("[WARN] consul: member '%s' still holds %d lock(s) after %v, reaping and invalidating its sessions",
+		member.Name, len(locks), grace)
+	return false, nil
+}
+
 // handleDeregisterMember is used to deregister a member of a given reason
 func (s *Server) handleDeregisterMember(reason string, member serf.Member) error {
 	// Do not deregister ourself. This can only happen if the current leader
@@ -572,7 +647,7 @@ func (s *Server) removeConsulServer(m serf.Member, port int) error {
 // to clear all tombstones before this index. This must be replicated
 // through Raft to ensure consistency. We do this outside the leader loop
 // to avoid blocking.
-func (s *Server) reapTombstones(index uint64) {
+func (s *Server) reapTombstones(index uint64) error {
 	defer metrics.MeasureSince([]string{"consul", "leader", "reapTombstones"}, time.Now())
 	req := structs.TombstoneRequest{
 		Datacenter:   s.config.Datacenter,
@@ -585,4 +660,275 @@ func (s *Server) reapTombstones(index uint64) {
 		s.logger.Printf("[ERR] consul: failed to reap tombstones up to %d: %v",
 			index, err)
 	}
+	return err
+}
+
+// reapKVSRecycled is invoked by the current leader to drop trees from the
+// KV recycle bin once they expire. Expiration uses the leader's clock, so
+// the reap time is replicated through Raft to keep the servers consistent.
+// We do this outside the leader loop to avoid blocking.
+func (s *Server) reapKVSRecycled() {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapKVSRecycled"}, time.Now())
+
+	// Skip the Raft write unless something has actually expired.
+	now := s.config.Clock.Now()
+	_, trees, err := s.fsm.State().KVSRecycledList()
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to list recycled KV trees: %v", err)
+		return
+	}
+	expired := false
+	for _, tree := range trees {
+		if tree.Expires.Before(now) {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return
+	}
+
+	req := structs.KVSRecycleRequest{
+		Datacenter:   s.config.Datacenter,
+		Op:           structs.KVSRecycleReap,
+		ReapTime:     now,
+		WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+	}
+	_, err = s.raftApply(structs.KVSRecycleRequestType, &req)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to reap recycled KV trees: %v", err)
+	}
+}
+
+// reapExpiredServices is invoked by the current leader to remove services
+// whose registrations have expired. Like reapKVSRecycled, the reap time
+// goes through Raft so the servers all remove the same services.
+func (s *Server) reapExpiredServices() {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapExpiredServices"}, time.Now())
+
+	// Skip the Raft write unless something has actually expired.
+	now := s.config.Clock.Now()
+	expired, err := s.fsm.State().ExpiredServices(now)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to list expired services: %v", err)
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+	for _, sn := range expired {
+		s.logger.Printf("[INFO] consul: service '%s' on node '%s' expired, removing",
+			sn.ServiceID, sn.Node)
+	}
+
+	req := structs.ServiceReapRequest{
+		Datacenter:   s.config.Datacenter,
+		ReapTime:     now,
+		WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+	}
+	if _, err := s.raftApply(structs.ServiceReapRequestType, &req); err != nil {
+		s.logger.Printf("[ERR] consul: failed to reap expired services: %v", err)
+	}
+}
+
+// reapExpiredKeys is invoked by the current leader to delete KV entries
+// whose TTL has run out, and uploads of large values that were never used.
+// Like reapExpiredServices, the reap time goes through Raft so the servers
+// all delete the same keys.
+func (s *Server) reapExpiredKeys() {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapExpiredKeys"}, time.Now())
+
+	// Skip the Raft write unless something has actually expired.
+	now := s.config.Clock.Now()
+	expired, err := s.fsm.State().ExpiredKeys(now)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to list expired keys: %v", err)
+		return
+	}
+	uploads, err := s.fsm.State().ExpiredUploads(now)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to list expired uploads: %v", err)
+		return
+	}
+	if len(expired) == 0 && len(uploads) == 0 {
+		return
+	}
+	s.logger.Printf("[DEBUG] consul: reaping %d expired keys and %d abandoned uploads",
+		len(expired), len(uploads))
+
+	req := structs.KVSReapRequest{
+		Datacenter:   s.config.Datacenter,
+		ReapTime:     now,
+		WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+	}
+	if _, err := s.raftApply(structs.KVSReapRequestType, &req); err != nil {
+		s.logger.Printf("[ERR] consul: failed to reap expired keys: %v", err)
+	}
+}
+
+// maintenanceWindowRetry is how soon the leader tries again to start or
+// end a maintenance window after failing to.
+const maintenanceWindowRetry = 10 * time.Second
+
+// maintenanceWindowsLoop is a long running goroutine that starts and ends
+// the maintenance windows while we are the leader. It wakes up whenever a
+// window is due to start or end, and whenever the windows change.
+func (s *Server) maintenanceWindowsLoop(stopCh chan struct{}) {
+	watch := s.fsm.State().GetQueryWatch("MaintenanceWindowList")
+	notifyCh := make(chan struct{}, 1)
+	defer watch.Clear(notifyCh)
+
+	for {
+		// Register for changes before looking, so none are missed.
+		watch.Wait(notifyCh)
+
+		now := s.config.Clock.Now()
+		var timeout <-chan time.Time
+		if next := s.updateMaintenanceWindows(now); !next.IsZero() {
+			timeout = s.config.Clock.After(next.Sub(now))
+		}
+
+		select {
+		case <-notifyCh:
+		case <-timeout:
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// updateMaintenanceWindows puts the windows that are active at the given
+// time into effect and ends the rest. This goes through Raft, so every
+// server suppresses the same checks. It returns the next time a window
+// starts or ends, or the zero time if none will.
+func (s *Server) updateMaintenanceWindows(now time.Time) time.Time {
+	_, windows, err := s.fsm.State().MaintenanceWindowList()
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to list maintenance windows: %v", err)
+		return now.Add(maintenanceWindowRetry)
+	}
+
+	var next time.Time
+	for _, w := range windows {
+		change := w.NextChange(now)
+		active := w.Active(now)
+		if w.InEffect != active {
+			req := structs.MaintenanceWindowRequest{
+				Datacenter: s.config.Datacenter,
+				Op:         structs.MaintenanceWindowEffect,
+				Window: structs.MaintenanceWindow{
+					ID:       w.ID,
+					InEffect: active,
+				},
+				WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+			}
+			resp, err := s.raftApply(structs.MaintenanceWindowRequestType, &req)
+			if respErr, ok := resp.(error); ok && err == nil {
+				err = respErr
+			}
+			if err != nil {
+				s.logger.Printf("[ERR] consul: failed to update maintenance window '%s': %v", w.ID, err)
+				change = now.Add(maintenanceWindowRetry)
+			} else {
+				s.logger.Printf("[DEBUG] consul: maintenance window '%s' in effect: %v", w.ID, active)
+			}
+		}
+		if !change.IsZero() && (next.IsZero() || change.Before(next)) {
+			next = change
+		}
+	}
+	return next
+}
+
+// assignExternalChecks is invoked by the current leader to assign each
+// external check to one of the alive checkers. It's run on every reconcile
+// and whenever a checker joins or fails, so the checks of a failed checker
+// move to the others. Only checks whose checker changes are written.
+func (s *Server) assignExternalChecks() {
+	defer metrics.MeasureSince([]string{"consul", "leader", "assignExternalChecks"}, time.Now())
+
+	_, checks, err := s.fsm.State().ExternalChecks()
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to list external checks: %v", err)
+		return
+	}
+	if len(checks) == 0 {
+		return
+	}
+
+	var checkers []string
+	for _, m := range s.serfLAN.Members() {
+		if m.Status == serf.StatusAlive && isExternalChecker(m) {
+			checkers = append(checkers, m.Name)
+		}
+	}
+	if len(checkers) == 0 {
+		s.logger.Printf("[WARN] consul: no external checkers are alive to run %d external checks", len(checks))
+	}
+
+	alive := make(map[string]bool)
+	for _, checker := range checkers {
+		alive[checker] = true
+	}
+	for _, check := range checks {
+		checker := pickExternalChecker(checkers, check)
+		previous := check.External.Checker
+
+		// Nothing is running a check without a checker, and the last
+		// result from a checker that has failed can't be trusted, so
+		// those are marked critical until a checker reports.
+		var output string
+		switch {
+		case checker == "":
+			output = "No external checkers are alive to run this check"
+		case previous != "" && !alive[previous]:
+			output = fmt.Sprintf("External checker '%s' failed, waiting for '%s' to run this check",
+				previous, checker)
+		}
+		if previous == checker && (output == "" || check.Status == structs.HealthCritical) {
+			continue
+		}
+
+		// Copy the check, since the original belongs to the state store.
+		c := *check
+		external := *check.External
+		external.Checker = checker
+		c.External = &external
+		if output != "" {
+			c.Status, c.Output = structs.HealthCritical, output
+		}
+
+		req := structs.RegisterRequest{
+			Datacenter:     s.config.Datacenter,
+			Node:           c.Node,
+			SkipNodeUpdate: true,
+			Check:          &c,
+			WriteRequest:   structs.WriteRequest{Token: s.config.ACLToken},
+		}
+		if _, err := s.raftApply(structs.RegisterRequestType, &req); err != nil {
+			s.logger.Printf("[ERR] consul: failed to assign external check '%s' on node '%s': %v",
+				c.CheckID, c.Node, err)
+			continue
+		}
+		s.logger.Printf("[DEBUG] consul: assigned external check '%s' on node '%s' to '%s'",
+			c.CheckID, c.Node, checker)
+	}
+}
+
+// pickExternalChecker chooses the checker for a check using rendezvous
+// hashing, so each check only moves when its own checker comes or goes.
+// It returns an empty string if there are no checkers.
+func pickExternalChecker(checkers []string, check *structs.HealthCheck) string {
+	var best string
+	var bestScore uint64
+	for _, checker := range checkers {
+		h := fnv.New64a()
+		h.Write([]byte(checker + "/" + check.Node + "/" + check.CheckID))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = checker, score
+		}
+	}
+	return best
 }
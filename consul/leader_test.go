@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/clock"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
@@ -277,6 +279,81 @@ func TestLeader_Reconcile_ReapMember(t *testing.T) {
 	}
 }
 
+func TestLeader_Reconcile_ReapMember_LockGrace(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ReapLockGracePeriod = time.Minute
+		c.Clock = clk
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a non-existing member
+	dead := structs.RegisterRequest{
+		Datacenter: s1.config.Datacenter,
+		Node:       "no-longer-around",
+		Address:    "127.1.1.1",
+		Check: &structs.HealthCheck{
+			Node:    "no-longer-around",
+			CheckID: SerfCheckID,
+			Name:    SerfCheckName,
+			Status:  structs.HealthCritical,
+		},
+	}
+	var out struct{}
+	if err := s1.RPC("Catalog.Register", &dead, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Have it hold a lock
+	state := s1.fsm.State()
+	session := &structs.Session{
+		ID:   generateUUID(),
+		Node: "no-longer-around",
+	}
+	if err := state.SessionCreate(100, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, err := state.KVSLock(101, &structs.DirEntry{Key: "lock", Session: session.ID})
+	if !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %v", ok, err)
+	}
+
+	// The first reconcile should leave it alone
+	if err := s1.reconcile(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err := state.GetNode("no-longer-around")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("node should not have been reaped yet")
+	}
+
+	// Once the grace period is up it should be reaped, releasing the lock
+	clk.Advance(time.Minute)
+	if err := s1.reconcile(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err = state.GetNode("no-longer-around")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != nil {
+		t.Fatalf("node should have been reaped")
+	}
+	_, entry, err := state.KVSGet("lock")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry == nil || entry.Session != "" {
+		t.Fatalf("bad: %#v", entry)
+	}
+}
+
 func TestLeader_Reconcile(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -616,3 +693,347 @@ func TestLeader_ReapTombstones(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	})
 }
+
+func TestLeader_ReapExpiredServices(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clk
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register an external service that expires, and one that doesn't
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db1",
+			Service: "db",
+			Source:  structs.ServiceSourceExternal,
+		},
+		ExpiresAfter: "1h",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Service.ID = "db2"
+	arg.ExpiresAfter = ""
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nothing should be reaped until the leader's clock passes the expiry
+	state := s1.fsm.State()
+	time.Sleep(3 * s1.config.ReconcileInterval)
+	_, services, err := state.ServiceNodes("db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("bad: %v", services)
+	}
+
+	// The leader should remove the expired one on its next pass
+	clk.Advance(2 * time.Hour)
+	testutil.WaitForResult(func() (bool, error) {
+		_, services, err := state.ServiceNodes("db")
+		if err != nil {
+			return false, err
+		}
+		return len(services) == 1 && services[0].ServiceID == "db2", nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestLeader_ReapExpiredKeys(t *testing.T) {
+	clk := clock.NewManual(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clk
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a key that expires, and one that doesn't
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "presence/foo",
+			Value: []byte("here"),
+		},
+		TTL: "1h",
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DirEnt.Key = "presence/bar"
+	arg.TTL = ""
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Start an upload that's never used
+	if _, _, err := s1.uploadKVSValue("dc1", structs.WriteRequest{}, []byte("abandoned")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nothing should be reaped until the leader's clock passes the TTL
+	state := s1.fsm.State()
+	time.Sleep(3 * s1.config.ReconcileInterval)
+	_, keys, err := state.KVSListKeys("presence/", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("bad: %v", keys)
+	}
+	far := clk.Now().Add(24 * time.Hour)
+	uploads, err := state.ExpiredUploads(far)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("bad: %v", uploads)
+	}
+
+	// The leader should delete the expired one, and the upload, on its
+	// next pass
+	clk.Advance(2 * time.Hour)
+	testutil.WaitForResult(func() (bool, error) {
+		_, keys, err := state.KVSListKeys("presence/", "")
+		if err != nil {
+			return false, err
+		}
+		uploads, err := state.ExpiredUploads(far)
+		if err != nil {
+			return false, err
+		}
+		return len(keys) == 1 && keys[0] == "presence/bar" && len(uploads) == 0, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestLeader_AssignExternalChecks(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ExternalChecker = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register an external service with an external check
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web",
+			Service: "web",
+			Source:  structs.ServiceSourceExternal,
+		},
+		Check: &structs.HealthCheck{
+			Name:      "web alive",
+			ServiceID: "web",
+			External: &structs.ExternalCheck{
+				HTTP:     "http://127.0.0.1:8080/health",
+				Interval: 10 * time.Second,
+			},
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The leader should assign it to the only checker on its next pass
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, checks, err := state.ExternalChecks()
+		if err != nil {
+			return false, err
+		}
+		return len(checks) == 1 && checks[0].External.Checker == s1.config.NodeName, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Registering the check again keeps its checker
+	arg.Check = &structs.HealthCheck{
+		Name:      "web alive",
+		ServiceID: "web",
+		External: &structs.ExternalCheck{
+			HTTP:     "http://127.0.0.1:8080/health",
+			Interval: 10 * time.Second,
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks, err := state.ExternalChecks()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 1 || checks[0].External.Checker != s1.config.NodeName {
+		t.Fatalf("bad: %v", checks)
+	}
+}
+
+func TestLeader_AssignExternalChecks_Critical(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a passing check that's assigned to a checker that's gone, and
+	// one that was never assigned
+	for _, checker := range []string{"gone", ""} {
+		req := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Check: &structs.HealthCheck{
+				Node:    "foo",
+				CheckID: "ping " + checker,
+				Name:    "ping",
+				Status:  structs.HealthPassing,
+				External: &structs.ExternalCheck{
+					TCP:      "127.0.0.1:8080",
+					Interval: 10 * time.Second,
+					Checker:  checker,
+				},
+			},
+		}
+		if _, err := s1.raftApply(structs.RegisterRequestType, &req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// With no checkers alive, the leader should mark both critical
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, checks, err := state.ExternalChecks()
+		if err != nil {
+			return false, err
+		}
+		for _, check := range checks {
+			if check.Status != structs.HealthCritical || check.External.Checker != "" ||
+				!strings.Contains(check.Output, "No external checkers") {
+				return false, fmt.Errorf("bad: %v", check)
+			}
+		}
+		return len(checks) == 2, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestLeader_AssignExternalChecks_FailedChecker(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ExternalChecker = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a passing check that's assigned to a checker that's gone
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			Node:    "foo",
+			CheckID: "ping",
+			Name:    "ping",
+			Status:  structs.HealthPassing,
+			External: &structs.ExternalCheck{
+				TCP:      "127.0.0.1:8080",
+				Interval: 10 * time.Second,
+				Checker:  "gone",
+			},
+		},
+	}
+	if _, err := s1.raftApply(structs.RegisterRequestType, &req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The leader should move it to us, and mark it critical until we
+	// report on it
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, checks, err := state.ExternalChecks()
+		if err != nil {
+			return false, err
+		}
+		return len(checks) == 1 && checks[0].External.Checker == s1.config.NodeName, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	_, checks, err := state.ExternalChecks()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if checks[0].Status != structs.HealthCritical ||
+		!strings.Contains(checks[0].Output, "External checker 'gone' failed") {
+		t.Fatalf("bad: %v", checks[0])
+	}
+}
+
+func TestLeader_pickExternalChecker(t *testing.T) {
+	check := &structs.HealthCheck{Node: "foo", CheckID: "web"}
+	if checker := pickExternalChecker(nil, check); checker != "" {
+		t.Fatalf("bad: %q", checker)
+	}
+
+	checkers := []string{"a", "b", "c", "d"}
+	checker := pickExternalChecker(checkers, check)
+	if checker == "" {
+		t.Fatalf("should pick a checker")
+	}
+
+	// The choice doesn't depend on the order of the checkers
+	reversed := []string{"d", "c", "b", "a"}
+	if again := pickExternalChecker(reversed, check); again != checker {
+		t.Fatalf("bad: %q != %q", again, checker)
+	}
+
+	// Removing another checker doesn't move the check
+	var others []string
+	for _, c := range checkers {
+		if c != checker {
+			others = append(others, c)
+		}
+	}
+	if again := pickExternalChecker(append(others[1:], checker), check); again != checker {
+		t.Fatalf("bad: %q != %q", again, checker)
+	}
+
+	// Removing its checker moves it to one of the others
+	if moved := pickExternalChecker(others, check); moved == checker || moved == "" {
+		t.Fatalf("bad: %q", moved)
+	}
+
+	// Checks are spread across the checkers
+	picked := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		check := &structs.HealthCheck{Node: fmt.Sprintf("node%d", i), CheckID: "web"}
+		picked[pickExternalChecker(checkers, check)] = struct{}{}
+	}
+	if len(picked) != len(checkers) {
+		t.Fatalf("bad: %v", picked)
+	}
+}
@@ -0,0 +1,185 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Maintenance endpoint is used to schedule maintenance windows
+type Maintenance struct {
+	srv *Server
+}
+
+// canScheduleWindow returns true if the ACL can manage the given window.
+// Windows for a service need write access to it, and anything wider needs
+// a management token.
+func canScheduleWindow(acl acl.ACL, window *structs.MaintenanceWindow) bool {
+	if window.ServiceName != "" {
+		return acl.ServiceWrite(window.ServiceName)
+	}
+	return acl.ACLModify()
+}
+
+// Apply is used to create, update or delete a maintenance window
+func (m *Maintenance) Apply(args *structs.MaintenanceWindowRequest, reply *string) error {
+	if done, err := m.srv.forward("Maintenance.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "maintenance", "apply"}, time.Now())
+
+	acl, err := m.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	state := m.srv.fsm.State()
+	switch args.Op {
+	case structs.MaintenanceWindowSet:
+		if err := args.Window.Validate(); err != nil {
+			return err
+		}
+
+		// If no ID is provided, generate a new ID. This must be done
+		// prior to appending to the raft log, because the ID is not
+		// deterministic.
+		if args.Window.ID == "" {
+			for {
+				args.Window.ID = generateUUID()
+				_, window, err := state.MaintenanceWindowGet(args.Window.ID)
+				if err != nil {
+					m.srv.logger.Printf("[ERR] consul.maintenance: Maintenance window lookup failed: %v", err)
+					return err
+				}
+				if window == nil {
+					break
+				}
+			}
+		}
+
+	case structs.MaintenanceWindowDelete:
+		if args.Window.ID == "" {
+			return fmt.Errorf("Missing maintenance window ID")
+		}
+
+	default:
+		return fmt.Errorf("Invalid maintenance window operation")
+	}
+
+	// Both the new window and any existing one it replaces must be
+	// within the token's reach.
+	if acl != nil {
+		if args.Op == structs.MaintenanceWindowSet && !canScheduleWindow(acl, &args.Window) {
+			m.srv.logger.Printf("[WARN] consul.maintenance: Maintenance window update denied due to ACLs")
+			return permissionDeniedErr
+		}
+		_, existing, err := state.MaintenanceWindowGet(args.Window.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil && !canScheduleWindow(acl, existing) {
+			m.srv.logger.Printf("[WARN] consul.maintenance: Maintenance window update denied due to ACLs")
+			return permissionDeniedErr
+		}
+	}
+
+	// Apply the update
+	resp, err := m.srv.raftApply(structs.MaintenanceWindowRequestType, args)
+	if err != nil {
+		m.srv.logger.Printf("[ERR] consul.maintenance: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	// Check if the return type is a string
+	if respString, ok := resp.(string); ok {
+		*reply = respString
+	}
+	return nil
+}
+
+// Get is used to retrieve a single maintenance window
+func (m *Maintenance) Get(args *structs.MaintenanceWindowSpecificRequest,
+	reply *structs.IndexedMaintenanceWindows) error {
+	if done, err := m.srv.forward("Maintenance.Get", args, args, reply); done {
+		return err
+	}
+
+	state := m.srv.fsm.State()
+	return m.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "MaintenanceWindowGet"),
+		func() error {
+			index, window, err := state.MaintenanceWindowGet(args.WindowID)
+			if err != nil {
+				return err
+			}
+
+			reply.Index = index
+			if window != nil {
+				reply.Windows = structs.MaintenanceWindows{window}
+			} else {
+				reply.Windows = nil
+			}
+			return m.srv.filterACL(args.Token, reply)
+		})
+}
+
+// List is used to list all the maintenance windows
+func (m *Maintenance) List(args *structs.DCSpecificRequest,
+	reply *structs.IndexedMaintenanceWindows) error {
+	if done, err := m.srv.forward("Maintenance.List", args, args, reply); done {
+		return err
+	}
+
+	state := m.srv.fsm.State()
+	return m.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "MaintenanceWindowList"),
+		func() error {
+			index, windows, err := state.MaintenanceWindowList()
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Windows = index, windows
+			return m.srv.filterACL(args.Token, reply)
+		})
+}
+
+// withoutSuppressed returns the checks that aren't suppressed.
+func withoutSuppressed(checks structs.HealthChecks) structs.HealthChecks {
+	kept := checks[:0]
+	for _, check := range checks {
+		if !check.Suppressed {
+			kept = append(kept, check)
+		}
+	}
+	return kept
+}
+
+// withoutExcluded leaves out the service instances that a window in
+// effect excludes from discovery.
+func withoutExcluded(windows structs.MaintenanceWindows, nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	windows = windows.InEffect()
+	if len(windows) == 0 {
+		return nodes
+	}
+	kept := nodes[:0]
+	for _, node := range nodes {
+		if node.Node != nil && node.Service != nil {
+			if w := windows.Covering(node.Node.Node, node.Service.Service); w != nil && w.ExcludeFromDiscovery {
+				continue
+			}
+		}
+		kept = append(kept, node)
+	}
+	return kept
+}
@@ -0,0 +1,359 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/clock"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestMaintenance_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	now := time.Now()
+	arg := structs.MaintenanceWindowRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceWindowSet,
+		Window: structs.MaintenanceWindow{
+			Node:   "foo",
+			Start:  now.Add(-time.Minute),
+			End:    now.Add(time.Hour),
+			Reason: "kernel upgrade",
+		},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := out
+
+	// Verify
+	getArg := structs.MaintenanceWindowSpecificRequest{
+		Datacenter: "dc1",
+		WindowID:   id,
+	}
+	var windows structs.IndexedMaintenanceWindows
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Get", &getArg, &windows); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if windows.Index == 0 || len(windows.Windows) != 1 {
+		t.Fatalf("bad: %v", windows)
+	}
+	if w := windows.Windows[0]; w.ID != id || w.Node != "foo" || w.Reason != "kernel upgrade" {
+		t.Fatalf("bad: %v", w)
+	}
+
+	// List them all
+	listArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.List", &listArg, &windows); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(windows.Windows) != 1 || windows.Windows[0].ID != id {
+		t.Fatalf("bad: %v", windows)
+	}
+
+	// Do a delete
+	arg.Op = structs.MaintenanceWindowDelete
+	arg.Window = structs.MaintenanceWindow{ID: id}
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify
+	_, w, err := s1.fsm.State().MaintenanceWindowGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if w != nil {
+		t.Fatalf("bad: %v", w)
+	}
+}
+
+func TestMaintenance_Apply_Invalid(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A window has to end after it starts
+	now := time.Now()
+	arg := structs.MaintenanceWindowRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceWindowSet,
+		Window: structs.MaintenanceWindow{
+			Node:  "foo",
+			Start: now,
+			End:   now.Add(-time.Hour),
+		},
+	}
+	var out string
+	err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out)
+	if !structs.IsValidationError(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Deletes need an ID
+	arg.Op = structs.MaintenanceWindowDelete
+	arg.Window = structs.MaintenanceWindow{}
+	err = msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Missing maintenance window ID") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMaintenance_Apply_ACLDeny(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	// The token can schedule maintenance for the service it can write.
+	now := time.Now()
+	arg := structs.MaintenanceWindowRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceWindowSet,
+		Window: structs.MaintenanceWindow{
+			ServiceName: "foo",
+			Start:       now,
+			End:         now.Add(time.Hour),
+		},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But not for another service, or the whole node.
+	arg.Window.ServiceName = "bar"
+	err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Window.ServiceName = ""
+	arg.Window.Node = srv.config.NodeName
+	err = msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMaintenance_List_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	now := time.Now()
+	for _, service := range []string{"foo", "bar"} {
+		arg := structs.MaintenanceWindowRequest{
+			Datacenter: "dc1",
+			Op:         structs.MaintenanceWindowSet,
+			Window: structs.MaintenanceWindow{
+				ServiceName: service,
+				Start:       now,
+				End:         now.Add(time.Hour),
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the window for the readable service comes back.
+	opt := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedMaintenanceWindows{}
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.List", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(reply.Windows) != 1 || reply.Windows[0].ServiceName != "foo" {
+		t.Fatalf("bad: %#v", reply.Windows)
+	}
+}
+
+func TestMaintenance_SuppressChecks(t *testing.T) {
+	now := time.Now()
+	clk := clock.NewManual(now)
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clk
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a db instance on two nodes, each with a passing check and
+	// a check that's already failing.
+	register := func(node, checkID, status string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+			Check: &structs.HealthCheck{
+				CheckID:   checkID,
+				Name:      checkID,
+				Status:    status,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, node := range []string{"foo", "bar"} {
+		register(node, "db connect", structs.HealthPassing)
+		register(node, "db disk", structs.HealthCritical)
+	}
+
+	// Schedule maintenance for the instance on foo, and wait for the
+	// leader to put it into effect once it starts.
+	arg := structs.MaintenanceWindowRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceWindowSet,
+		Window: structs.MaintenanceWindow{
+			Node:        "foo",
+			ServiceName: "db",
+			Start:       now.Add(time.Minute),
+			End:         now.Add(24 * time.Hour),
+		},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inEffect := func() bool {
+		_, window, err := s1.fsm.State().MaintenanceWindowGet(id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return window.InEffect
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		clk.Advance(time.Minute)
+		return inEffect(), nil
+	}, func(err error) {
+		t.Fatalf("window should be in effect")
+	})
+
+	// The status changes made during the window are suppressed, and
+	// left out of state queries.
+	for _, node := range []string{"foo", "bar"} {
+		register(node, "db connect", structs.HealthCritical)
+	}
+	var checks structs.IndexedHealthChecks
+	inState := structs.ChecksInStateRequest{
+		Datacenter: "dc1",
+		State:      structs.HealthCritical,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ChecksInState", &inState, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks.HealthChecks) != 3 {
+		t.Fatalf("bad: %v", checks.HealthChecks)
+	}
+	for _, check := range checks.HealthChecks {
+		if check.Node == "foo" && check.CheckID != "db disk" {
+			t.Fatalf("bad: %v", check)
+		}
+	}
+
+	// But they're still shown, and marked, for the node.
+	nodeReq := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.NodeChecks", &nodeReq, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks.HealthChecks) != 2 {
+		t.Fatalf("bad: %v", checks.HealthChecks)
+	}
+	for _, check := range checks.HealthChecks {
+		if check.Suppressed != (check.CheckID == "db connect") {
+			t.Fatalf("bad: %v", check)
+		}
+	}
+
+	// Discovery still returns both instances by default.
+	var nodes structs.IndexedCheckServiceNodes
+	svcReq := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &svcReq, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 2 {
+		t.Fatalf("bad: %v", nodes.Nodes)
+	}
+
+	// Unless the window takes them out of it.
+	arg.Window.ID = id
+	arg.Window.ExcludeFromDiscovery = true
+	if err := msgpackrpc.CallWithCodec(codec, "Maintenance.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &svcReq, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0].Node.Node != "bar" {
+		t.Fatalf("bad: %v", nodes.Nodes)
+	}
+
+	// The end of the window wakes up a blocking state query, which then
+	// has all of the failing checks.
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ChecksInState", &inState, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inState.MinQueryIndex = checks.Index
+	inState.MaxQueryTime = 5 * time.Second
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		testutil.WaitForResult(func() (bool, error) {
+			clk.Advance(24 * time.Hour)
+			return !inEffect(), nil
+		}, func(err error) {
+			t.Fatalf("window should have ended")
+		})
+	}()
+	start := time.Now()
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ChecksInState", &inState, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	<-doneCh
+	if time.Since(start) > 4*time.Second {
+		t.Fatalf("query should have been woken up")
+	}
+	if len(checks.HealthChecks) != 4 {
+		t.Fatalf("bad: %v", checks.HealthChecks)
+	}
+}
@@ -0,0 +1,159 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// ManagedCheck endpoint is used to manage the check definitions that the
+// servers hand out to agents
+type ManagedCheck struct {
+	srv *Server
+}
+
+// Apply is used to create, update or delete a managed check
+func (m *ManagedCheck) Apply(args *structs.ManagedCheckRequest, reply *string) error {
+	if done, err := m.srv.forward("ManagedCheck.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "managed_check", "apply"}, time.Now())
+
+	// Managed checks run on every matching agent, so only management
+	// tokens may change them.
+	if acl, err := m.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	state := m.srv.fsm.State()
+	switch args.Op {
+	case structs.ManagedCheckSet:
+		if err := args.Check.Validate(); err != nil {
+			return err
+		}
+
+		// If no ID is provided, generate a new ID. This must be done
+		// prior to appending to the raft log, because the ID is not
+		// deterministic.
+		if args.Check.ID == "" {
+			for {
+				args.Check.ID = generateUUID()
+				_, check, err := state.ManagedCheckGet(args.Check.ID)
+				if err != nil {
+					m.srv.logger.Printf("[ERR] consul.managed_check: Managed check lookup failed: %v", err)
+					return err
+				}
+				if check == nil {
+					break
+				}
+			}
+		}
+
+	case structs.ManagedCheckDelete:
+		if args.Check.ID == "" {
+			return fmt.Errorf("Missing managed check ID")
+		}
+
+	default:
+		return fmt.Errorf("Invalid managed check operation")
+	}
+
+	// Apply the update
+	resp, err := m.srv.raftApply(structs.ManagedCheckRequestType, args)
+	if err != nil {
+		m.srv.logger.Printf("[ERR] consul.managed_check: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	// Check if the return type is a string
+	if respString, ok := resp.(string); ok {
+		*reply = respString
+	}
+	return nil
+}
+
+// Get is used to retrieve a single managed check
+func (m *ManagedCheck) Get(args *structs.ManagedCheckSpecificRequest,
+	reply *structs.IndexedManagedChecks) error {
+	if done, err := m.srv.forward("ManagedCheck.Get", args, args, reply); done {
+		return err
+	}
+
+	state := m.srv.fsm.State()
+	return m.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ManagedCheckGet"),
+		func() error {
+			index, check, err := state.ManagedCheckGet(args.CheckID)
+			if err != nil {
+				return err
+			}
+
+			reply.Index = index
+			if check != nil {
+				reply.Checks = structs.ManagedChecks{check}
+			} else {
+				reply.Checks = nil
+			}
+			return m.srv.filterACL(args.Token, reply)
+		})
+}
+
+// List is used to list all the managed checks
+func (m *ManagedCheck) List(args *structs.DCSpecificRequest,
+	reply *structs.IndexedManagedChecks) error {
+	if done, err := m.srv.forward("ManagedCheck.List", args, args, reply); done {
+		return err
+	}
+
+	state := m.srv.fsm.State()
+	return m.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ManagedCheckList"),
+		func() error {
+			index, checks, err := state.ManagedCheckList()
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Checks = index, checks
+			return m.srv.filterACL(args.Token, reply)
+		})
+}
+
+// ForNode is used by agents to get the managed checks they should run
+func (m *ManagedCheck) ForNode(args *structs.NodeSpecificRequest,
+	reply *structs.IndexedManagedChecks) error {
+	if done, err := m.srv.forward("ManagedCheck.ForNode", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	state := m.srv.fsm.State()
+	return m.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ManagedChecksForNode"),
+		func() error {
+			index, checks, err := state.ManagedChecksForNode(args.Node)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Checks = index, checks
+			return m.srv.filterACL(args.Token, reply)
+		})
+}
@@ -0,0 +1,260 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestManagedCheck_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.ManagedCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.ManagedCheckSet,
+		Check: structs.ManagedCheck{
+			Name:     "disk space",
+			Script:   "/usr/local/bin/check_disk",
+			Interval: time.Minute,
+		},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := out
+
+	// Verify
+	getArg := structs.ManagedCheckSpecificRequest{
+		Datacenter: "dc1",
+		CheckID:    id,
+	}
+	var checks structs.IndexedManagedChecks
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Get", &getArg, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if checks.Index == 0 || len(checks.Checks) != 1 {
+		t.Fatalf("bad: %v", checks)
+	}
+	if c := checks.Checks[0]; c.ID != id || c.Name != "disk space" || c.Interval != time.Minute {
+		t.Fatalf("bad: %v", c)
+	}
+
+	// List them all
+	listArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.List", &listArg, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks.Checks) != 1 || checks.Checks[0].ID != id {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Do a delete
+	arg.Op = structs.ManagedCheckDelete
+	arg.Check = structs.ManagedCheck{ID: id}
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify
+	_, c, err := s1.fsm.State().ManagedCheckGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c != nil {
+		t.Fatalf("bad: %v", c)
+	}
+}
+
+func TestManagedCheck_Apply_Invalid(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A check needs something to run
+	arg := structs.ManagedCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.ManagedCheckSet,
+		Check: structs.ManagedCheck{
+			Name:     "disk space",
+			Interval: time.Minute,
+		},
+	}
+	var out string
+	err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out)
+	if !structs.IsValidationError(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Deletes need an ID
+	arg.Op = structs.ManagedCheckDelete
+	arg.Check = structs.ManagedCheck{}
+	err = msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Missing managed check ID") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestManagedCheck_Apply_ACLDeny(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	// Even a token that can write the service can't push checks to it.
+	arg := structs.ManagedCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.ManagedCheckSet,
+		Check: structs.ManagedCheck{
+			Name:        "foo ping",
+			ServiceName: "foo",
+			TCP:         "localhost:8000",
+			Interval:    time.Minute,
+		},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	var out string
+	err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A management token can.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestManagedCheck_List_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	for _, service := range []string{"foo", "bar"} {
+		arg := structs.ManagedCheckRequest{
+			Datacenter: "dc1",
+			Op:         structs.ManagedCheckSet,
+			Check: structs.ManagedCheck{
+				Name:        service + " ping",
+				ServiceName: service,
+				TCP:         "localhost:8000",
+				Interval:    time.Minute,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the check for the readable service comes back.
+	opt := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedManagedChecks{}
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.List", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(reply.Checks) != 1 || reply.Checks[0].ServiceName != "foo" {
+		t.Fatalf("bad: %#v", reply.Checks)
+	}
+}
+
+func TestManagedCheck_ForNode(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register two nodes in different racks.
+	for node, rack := range map[string]string{"foo": "r1", "bar": "r2"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"rack": rack},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// One check for every node, and one for a single rack.
+	for _, check := range []structs.ManagedCheck{
+		structs.ManagedCheck{
+			ID:       "disk",
+			Name:     "disk space",
+			Script:   "check_disk",
+			Interval: time.Minute,
+		},
+		structs.ManagedCheck{
+			ID:       "ups",
+			Name:     "rack power",
+			NodeMeta: map[string]string{"rack": "r1"},
+			HTTP:     "http://localhost:3000/ups",
+			Interval: time.Minute,
+		},
+	} {
+		arg := structs.ManagedCheckRequest{
+			Datacenter: "dc1",
+			Op:         structs.ManagedCheckSet,
+			Check:      check,
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	var checks structs.IndexedManagedChecks
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.ForNode", &req, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if checks.Index == 0 || len(checks.Checks) != 2 {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	req.Node = "bar"
+	if err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.ForNode", &req, &checks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks.Checks) != 1 || checks.Checks[0].ID != "disk" {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// A node is required
+	req.Node = ""
+	err := msgpackrpc.CallWithCodec(codec, "ManagedCheck.ForNode", &req, &checks)
+	if err == nil || !strings.Contains(err.Error(), "Must provide node") {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Operator endpoint is used to query information that is useful for
+// running a cluster, as opposed to the data stored in it.
+type Operator struct {
+	srv *Server
+}
+
+// ChangeCounters is used to get the cumulative number of creates, updates,
+// and deletes applied to each type of object, for tracking growth over time.
+func (o *Operator) ChangeCounters(args *structs.DCSpecificRequest,
+	reply *structs.IndexedChangeCounters) error {
+	if done, err := o.srv.forward("Operator.ChangeCounters", args, args, reply); done {
+		return err
+	}
+
+	// The counters cover ACLs, so hold them to the same permission as
+	// listing ACLs.
+	if acl, err := o.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	// Get the counters
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ChangeCounters"),
+		func() error {
+			index, counters, err := state.ChangeCounters()
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Counters = index, counters
+			return nil
+		})
+}
+
+// ChangeFeed is used to read the changes made to the catalog and KV store
+// after a given sequence number, so that other systems can mirror them
+// without repeatedly reading everything.
+func (o *Operator) ChangeFeed(args *structs.ChangeFeedRequest,
+	reply *structs.IndexedChangeFeed) error {
+	if done, err := o.srv.forward("Operator.ChangeFeed", args, args, reply); done {
+		return err
+	}
+
+	// The feed names every key and service without filtering, so hold it
+	// to the same permission as the change counters.
+	if acl, err := o.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	// Get the changes
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		queryWatch(state, "ChangeFeed"),
+		func() error {
+			index, feed, err := state.ChangeFeed(args.Since, args.MaxEntries)
+			if err != nil {
+				return err
+			}
+
+			reply.Index = index
+			reply.Entries, reply.LastSeq, reply.Truncated = feed.Entries, feed.LastSeq, feed.Truncated
+			return nil
+		})
+}
+
+// CapacityStatus is used to check the size of the state store against the
+// configured capacity thresholds.
+func (o *Operator) CapacityStatus(args *structs.DCSpecificRequest,
+	reply *structs.CapacityStatus) error {
+	if done, err := o.srv.forward("Operator.CapacityStatus", args, args, reply); done {
+		return err
+	}
+
+	// The usage includes every service name, so hold it to the same
+	// permission as the change counters.
+	if acl, err := o.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	index, status, err := o.srv.capacityStatus()
+	if err != nil {
+		return err
+	}
+	*reply = *status
+	reply.Index = index
+	o.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// KVSUsage is used to get how much is stored under each top-level KV
+// prefix, along with its quota. Only the prefixes the token can read are
+// returned.
+func (o *Operator) KVSUsage(args *structs.DCSpecificRequest,
+	reply *structs.IndexedKVSUsage) error {
+	if done, err := o.srv.forward("Operator.KVSUsage", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	index, usages, err := o.srv.kvsUsage()
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		var allowed structs.KVSUsages
+		for _, usage := range usages {
+			if acl.KeyRead(usage.Prefix) {
+				allowed = append(allowed, usage)
+			}
+		}
+		usages = allowed
+	}
+	reply.Index, reply.Usage = index, usages
+	o.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// TombstoneGC is used to change the leader's tombstone GC settings and to
+// run a GC pass on demand, so delete-heavy workloads don't have to wait for
+// the timers to free their tombstones. New settings only apply to keys
+// deleted after the change. The settings are not replicated, so they only
+// last until the next leader election.
+func (o *Operator) TombstoneGC(args *structs.TombstoneGCRequest,
+	reply *structs.TombstoneGCStatus) error {
+	if done, err := o.srv.forward("Operator.TombstoneGC", args, args, reply); done {
+		return err
+	}
+
+	if acl, err := o.srv.resolveToken(args.Token); err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	gc := o.srv.tombstoneGC
+	if args.TTL != 0 || args.Granularity != 0 {
+		ttl, granularity := gc.TTL()
+		if args.TTL != 0 {
+			ttl = args.TTL
+		}
+		if args.Granularity != 0 {
+			granularity = args.Granularity
+		}
+		if err := gc.SetTTL(ttl, granularity); err != nil {
+			return err
+		}
+		o.srv.logger.Printf("[INFO] consul: tombstone TTL set to %v with a granularity of %v",
+			ttl, granularity)
+	}
+
+	state := o.srv.fsm.State()
+	if args.Reap {
+		before, _, err := state.TombstoneCounts()
+		if err != nil {
+			return err
+		}
+		if index := gc.ExpireNow(); index > 0 {
+			if err := o.srv.reapTombstones(index); err != nil {
+				return err
+			}
+		}
+		after, _, err := state.TombstoneCounts()
+		if err != nil {
+			return err
+		}
+		reply.Reaped = before - after
+	}
+
+	total, byPrefix, err := state.TombstoneCounts()
+	if err != nil {
+		return err
+	}
+	reply.TTL, reply.Granularity = gc.TTL()
+	reply.Tombstones, reply.ByPrefix = total, byPrefix
+	return nil
+}
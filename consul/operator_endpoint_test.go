@@ -0,0 +1,399 @@
+package consul
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_ChangeCounters(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write the same key twice and then delete it.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	for i := 0; i < 2; i++ {
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	arg.Op = structs.KVSDelete
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Check the counters.
+	getR := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var counters structs.IndexedChangeCounters
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ChangeCounters", &getR, &counters); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if counters.Index == 0 {
+		t.Fatalf("bad: %v", counters)
+	}
+	var kvs *structs.ChangeCounter
+	for _, counter := range counters.Counters {
+		if counter.Type == structs.ChangeCounterKVS {
+			kvs = counter
+		}
+	}
+	if kvs == nil || kvs.Creates != 1 || kvs.Updates != 1 || kvs.Deletes != 1 {
+		t.Fatalf("bad: %#v", kvs)
+	}
+}
+
+func TestOperator_ChangeCounters_Denied(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The anonymous token can't see the counters.
+	getR := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var counters structs.IndexedChangeCounters
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ChangeCounters", &getR, &counters)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can.
+	getR.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ChangeCounters", &getR, &counters); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(counters.Counters) == 0 {
+		t.Fatalf("bad: %v", counters)
+	}
+}
+
+func TestOperator_ChangeFeed(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a key and then delete it.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Op = structs.KVSDelete
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Read the whole feed, which also has the server's own registration.
+	getR := structs.ChangeFeedRequest{
+		Datacenter: "dc1",
+	}
+	var feed structs.IndexedChangeFeed
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ChangeFeed", &getR, &feed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if feed.Index == 0 || feed.LastSeq == 0 || feed.Truncated {
+		t.Fatalf("bad: %v", feed)
+	}
+	var kvs structs.ChangeFeedEntries
+	for _, entry := range feed.Entries {
+		if entry.Type == structs.ChangeFeedKVS {
+			kvs = append(kvs, entry)
+		}
+	}
+	if len(kvs) != 2 || kvs[0].Op != structs.ChangeFeedSet || kvs[1].Op != structs.ChangeFeedDelete ||
+		kvs[0].Key != "test" || kvs[1].Seq != kvs[0].Seq+1 {
+		t.Fatalf("bad: %#v", kvs)
+	}
+
+	// Block for the next change.
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		arg.Op = structs.KVSSet
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}()
+	getR.Since = feed.LastSeq
+	getR.MinQueryIndex = feed.Index
+	var next structs.IndexedChangeFeed
+	codec2 := rpcClient(t, s1)
+	defer codec2.Close()
+	if err := msgpackrpc.CallWithCodec(codec2, "Operator.ChangeFeed", &getR, &next); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) < 100*time.Millisecond {
+		t.Fatalf("too fast")
+	}
+	if len(next.Entries) != 1 || next.Entries[0].Seq != feed.LastSeq+1 || next.Entries[0].Key != "test" {
+		t.Fatalf("bad: %#v", next.Entries)
+	}
+}
+
+func TestOperator_ChangeFeed_Denied(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The anonymous token can't read the feed.
+	getR := structs.ChangeFeedRequest{
+		Datacenter: "dc1",
+	}
+	var feed structs.IndexedChangeFeed
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ChangeFeed", &getR, &feed)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can.
+	getR.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ChangeFeed", &getR, &feed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_CapacityStatus(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CapacityThresholds = structs.CapacityThresholds{
+			ServiceInstances: 1,
+			Services:         10,
+			KVSKeys:          1,
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register the same service on two nodes.
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Write a single key.
+	kvArg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var kvOut bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kvArg, &kvOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the service instances should be over.
+	getR := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var status structs.CapacityStatus
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.CapacityStatus", &getR, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.Index == 0 || !status.KnownLeader {
+		t.Fatalf("bad: %v", status)
+	}
+	if status.Usage.ServiceInstances["db"] != 2 || status.Usage.KVSKeys != 1 {
+		t.Fatalf("bad: %#v", status.Usage)
+	}
+	if status.Thresholds != s1.config.CapacityThresholds {
+		t.Fatalf("bad: %#v", status.Thresholds)
+	}
+	if !reflect.DeepEqual(status.Exceeded, []string{structs.CapacityServiceInstances}) {
+		t.Fatalf("bad: %v", status.Exceeded)
+	}
+}
+
+func TestOperator_KVSUsage(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSQuotas = map[string]structs.KVSQuota{
+			"*":      structs.KVSQuota{MaxKeys: 100},
+			"team-a": structs.KVSQuota{MaxBytes: 1024},
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, key := range []string{"team-a/db", "team-b/db", "team-b/web"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getR := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedKVSUsage
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVSUsage", &getR, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 {
+		t.Fatalf("bad: %v", reply)
+	}
+	expected := structs.KVSUsages{
+		&structs.KVSUsage{
+			Prefix: "team-a",
+			Keys:   1,
+			Bytes:  13,
+			Quota:  &structs.KVSQuota{MaxBytes: 1024},
+		},
+		&structs.KVSUsage{
+			Prefix: "team-b",
+			Keys:   2,
+			Bytes:  27,
+			Quota:  &structs.KVSQuota{MaxKeys: 100},
+		},
+	}
+	if !reflect.DeepEqual(reply.Usage, expected) {
+		t.Fatalf("bad: %#v", reply.Usage)
+	}
+}
+
+func TestOperator_TombstoneGC(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a key and delete it to leave a tombstone.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo/bar",
+			Value: []byte("test"),
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Op = structs.KVSDelete
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The anonymous token can't touch the GC.
+	req := structs.TombstoneGCRequest{
+		Datacenter: "dc1",
+	}
+	var status structs.TombstoneGCStatus
+	err := msgpackrpc.CallWithCodec(codec, "Operator.TombstoneGC", &req, &status)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Just report the status.
+	req.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TombstoneGC", &req, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.Tombstones != 1 || status.ByPrefix["foo"] != 1 || status.Reaped != 0 {
+		t.Fatalf("bad: %#v", status)
+	}
+
+	// Tune the TTL, leaving the granularity alone.
+	_, granularity := s1.tombstoneGC.TTL()
+	req.TTL = time.Hour
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TombstoneGC", &req, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.TTL != time.Hour || status.Granularity != granularity {
+		t.Fatalf("bad: %#v", status)
+	}
+
+	// Run a GC pass.
+	req.TTL = 0
+	req.Reap = true
+	status = structs.TombstoneGCStatus{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TombstoneGC", &req, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.Reaped != 1 || status.Tombstones != 0 || len(status.ByPrefix) != 0 {
+		t.Fatalf("bad: %#v", status)
+	}
+	if s1.tombstoneGC.PendingExpiration() {
+		t.Fatalf("should not be pending")
+	}
+}
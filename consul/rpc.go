@@ -6,6 +6,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,6 +50,19 @@ const (
 	// value is ever reached. However, it prevents us from blocking
 	// the requesting goroutine forever.
 	enqueueLimit = 30 * time.Second
+
+	// hibernateIdle is how long a blocking query may wait at the same
+	// index before it is handed off to the hibernator.
+	hibernateIdle = 30 * time.Second
+
+	// readIndexTimeout bounds how long a server will wait for its FSM
+	// to catch up to the leader's read index, or to a client's
+	// consistency index, before failing the read.
+	readIndexTimeout = 5 * time.Second
+
+	// readIndexPollInterval is how often a follower checks its applied
+	// index while waiting to reach a read index.
+	readIndexPollInterval = 5 * time.Millisecond
 )
 
 // listen is used to listen for incoming RPC connections
@@ -181,9 +195,11 @@ func (s *Server) handleConsulConn(conn net.Conn) {
 // forward is used to forward to a remote DC or to forward to the local leader
 // Returns a bool of if forwarding was performed, as well as any error
 func (s *Server) forward(method string, info structs.RPCInfo, args interface{}, reply interface{}) (bool, error) {
-	// Handle DC forwarding
+	// Handle DC forwarding. A request that doesn't name a datacenter is
+	// for this one, which is also the datacenter of any client agent that
+	// sent it, since clients only talk to their local servers.
 	dc := info.RequestDatacenter()
-	if dc != s.config.Datacenter {
+	if dc != "" && dc != s.config.Datacenter {
 		err := s.forwardDC(method, dc, args, reply)
 		return true, err
 	}
@@ -193,6 +209,12 @@ func (s *Server) forward(method string, info structs.RPCInfo, args interface{},
 		return false, nil
 	}
 
+	// Followers may serve consistent reads themselves if configured to,
+	// see consistentRead for how they are kept consistent.
+	if info.IsRead() && info.RequireConsistentRead() && s.config.FollowerConsistentReads {
+		return false, nil
+	}
+
 	// Handle leader forwarding
 	if !s.IsLeader() {
 		err := s.forwardLeader(method, args, reply)
@@ -279,9 +301,16 @@ func (s *Server) globalRPC(method string, args interface{},
 // raftApply is used to encode a message, run it through raft, and return
 // the FSM response along with any errors
 func (s *Server) raftApply(t structs.MessageType, msg interface{}) (interface{}, error) {
+	resp, _, err := s.raftApplyIndex(t, msg)
+	return resp, err
+}
+
+// raftApplyIndex is like raftApply but also returns the Raft index the
+// message was applied at
+func (s *Server) raftApplyIndex(t structs.MessageType, msg interface{}) (interface{}, uint64, error) {
 	buf, err := structs.Encode(t, msg)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to encode request: %v", err)
+		return nil, 0, fmt.Errorf("Failed to encode request: %v", err)
 	}
 
 	// Warn if the command is very large
@@ -291,18 +320,73 @@ func (s *Server) raftApply(t structs.MessageType, msg interface{}) (interface{},
 
 	future := s.raft.Apply(buf, enqueueLimit)
 	if err := future.Error(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return future.Response(), nil
+	return future.Response(), future.Index(), nil
+}
+
+// blockingWatch is the watch a blocking query waits on.
+type blockingWatch struct {
+	// key names what's being watched. Parked queries with the same key
+	// share a hibernation.
+	key string
+
+	// get fetches the watch. It's called each time the query waits, since a
+	// KV prefix's watch is dropped once it fires.
+	get func() state.Watch
+}
+
+// queryWatch returns the watch for the given query method, for use with
+// blockingRPC.
+func queryWatch(store *state.StateStore, method string) *blockingWatch {
+	return &blockingWatch{
+		key: "query:" + method,
+		get: func() state.Watch {
+			return store.GetQueryWatch(method)
+		},
+	}
+}
+
+// kvsWatch returns the watch for the given KV prefix, for use with
+// blockingRPC.
+func kvsWatch(store *state.StateStore, prefix string) *blockingWatch {
+	return &blockingWatch{
+		key: "kvs:" + prefix,
+		get: func() state.Watch {
+			return store.GetKVSWatch(prefix)
+		},
+	}
 }
 
 // blockingRPC is used for queries that need to wait for a minimum index. This
-// is used to block and wait for changes.
+// is used to block and wait for changes. The watch is fetched again each time
+// the query waits.
 func (s *Server) blockingRPC(queryOpts *structs.QueryOptions, queryMeta *structs.QueryMeta,
-	watch state.Watch, run func() error) error {
+	watch *blockingWatch, run func() error) error {
+	return s.blockingHashRPC(queryOpts, queryMeta, watch, run, nil)
+}
+
+// blockingHashRPC is like blockingRPC, but also keeps waiting past the
+// minimum index while unchanged returns true. Queries use this to compare a
+// hash of their results with the one the client already has, so changes
+// that leave the results the same don't wake the client.
+func (s *Server) blockingHashRPC(queryOpts *structs.QueryOptions, queryMeta *structs.QueryMeta,
+	watch *blockingWatch, run func() error, unchanged func() bool) error {
 	var timeout *time.Timer
+	var registered state.Watch
+	var start time.Time
 	var notifyCh chan struct{}
+	var idle, deadline *alarm
+	var parked *hibernation
+
+	// Wait for the write the client wants to see to be applied, so a
+	// stale read still reads the client's own writes.
+	if queryOpts.ConsistencyIndex > 0 {
+		if err := s.waitForAppliedIndex(queryOpts.ConsistencyIndex); err != nil {
+			return err
+		}
+	}
 
 	// Fast path right to the non-blocking query.
 	if queryOpts.MinQueryIndex == 0 {
@@ -326,20 +410,48 @@ func (s *Server) blockingRPC(queryOpts *structs.QueryOptions, queryMeta *structs
 
 	// Setup a query timeout.
 	timeout = time.NewTimer(queryOpts.MaxQueryTime)
+	start = time.Now()
 
 	// Setup the notify channel.
 	notifyCh = make(chan struct{}, 1)
 
+	// Setup an alarm for handing the query off to the hibernator if it
+	// stays idle.
+	idle = s.hibernator.after(hibernateIdle)
+
 	// Ensure we tear down any watches on return.
 	defer func() {
 		timeout.Stop()
-		watch.Clear(notifyCh)
+		if registered != nil {
+			registered.Clear(notifyCh)
+		}
+		s.hibernator.cancel(idle)
+		if deadline != nil {
+			s.hibernator.cancel(deadline)
+		}
+		if parked != nil {
+			s.hibernator.release(parked)
+		}
 	}()
 
 REGISTER_NOTIFY:
 	// Register the notification channel. This may be done multiple times if
-	// we haven't reached the target wait index.
-	watch.Wait(notifyCh)
+	// we haven't reached the target wait index. Once a query has been idle
+	// for a while, it's parked with the hibernator instead, which shares
+	// one registration per table or KV prefix. The watch is fetched each
+	// time, since one that has fired may no longer be notified.
+	if deadline == nil {
+		if registered != nil {
+			registered.Clear(notifyCh)
+		}
+		registered = watch.get()
+		registered.Wait(notifyCh)
+	} else {
+		if parked != nil {
+			s.hibernator.release(parked)
+		}
+		parked = s.hibernator.park(watch.key, watch.get())
+	}
 
 RUN_QUERY:
 	// Update the query metadata.
@@ -356,11 +468,31 @@ RUN_QUERY:
 	metrics.IncrCounter([]string{"consul", "rpc", "query"}, 1)
 	err := run()
 
-	// Check for minimum query time.
-	if err == nil && queryMeta.Index > 0 && queryMeta.Index <= queryOpts.MinQueryIndex {
+	// Check for minimum query time. Without a minimum index the query
+	// never blocks, even if the client gave a hash.
+	if err == nil && queryOpts.MinQueryIndex > 0 && queryMeta.Index > 0 &&
+		(queryMeta.Index <= queryOpts.MinQueryIndex || (unchanged != nil && unchanged())) {
+		if parked != nil {
+			if s.hibernator.wait(parked, deadline) {
+				goto REGISTER_NOTIFY
+			}
+			return err
+		}
+
 		select {
 		case <-notifyCh:
 			goto REGISTER_NOTIFY
+		case <-idle.firedCh:
+			// Trade the query's own timer and registration for shared
+			// ones. The query is run again once it's parked, in case the
+			// watch fired in the meantime.
+			registered.Clear(notifyCh)
+			registered = nil
+			if !timeout.Stop() {
+				return err
+			}
+			deadline = s.hibernator.after(queryOpts.MaxQueryTime - time.Since(start))
+			goto REGISTER_NOTIFY
 		case <-timeout.C:
 		}
 	}
@@ -369,6 +501,7 @@ RUN_QUERY:
 
 // setQueryMeta is used to populate the QueryMeta data for an RPC call
 func (s *Server) setQueryMeta(m *structs.QueryMeta) {
+	m.Datacenter = s.config.Datacenter
 	if s.IsLeader() {
 		m.LastContact = 0
 		m.KnownLeader = true
@@ -379,9 +512,47 @@ func (s *Server) setQueryMeta(m *structs.QueryMeta) {
 }
 
 // consistentRead is used to ensure we do not perform a stale
-// read. This is done by verifying leadership before the read.
+// read. This is done by verifying leadership before the read, or on a
+// follower by waiting until we've applied the leader's read index.
 func (s *Server) consistentRead() error {
 	defer metrics.MeasureSince([]string{"consul", "rpc", "consistentRead"}, time.Now())
+	if s.config.FollowerConsistentReads && !s.IsLeader() {
+		return s.readIndex()
+	}
 	future := s.raft.VerifyLeader()
 	return future.Error()
 }
+
+// readIndex asks the leader for its read index and then waits for our
+// FSM to apply up to it. Anything committed before the read was started
+// is then visible locally, so the read is as consistent as one served by
+// the leader.
+func (s *Server) readIndex() error {
+	var index uint64
+	if err := s.forwardLeader("Status.ReadIndex", struct{}{}, &index); err != nil {
+		return err
+	}
+	return s.waitForAppliedIndex(index)
+}
+
+// waitForAppliedIndex waits for our FSM to apply up to the given index,
+// failing if it takes longer than readIndexTimeout.
+func (s *Server) waitForAppliedIndex(index uint64) error {
+	timeout := time.After(readIndexTimeout)
+	for s.appliedIndex() < index {
+		select {
+		case <-time.After(readIndexPollInterval):
+		case <-timeout:
+			return fmt.Errorf("timed out waiting to apply index %d", index)
+		case <-s.shutdownCh:
+			return fmt.Errorf("server shutting down")
+		}
+	}
+	return nil
+}
+
+// appliedIndex returns the index of the last Raft entry applied to our FSM
+func (s *Server) appliedIndex() uint64 {
+	index, _ := strconv.ParseUint(s.raft.Stats()["applied_index"], 10, 64)
+	return index
+}
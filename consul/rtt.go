@@ -234,6 +234,28 @@ func (s *Server) sortNodesByDistanceFrom(source structs.QuerySource, subj interf
 	return nil
 }
 
+// addCoordinates fills in the network coordinate of each node that has one.
+// Coordinates change too often to be watched, so a blocking query only
+// returns new ones along with some other change.
+func (s *Server) addCoordinates(nodes structs.CheckServiceNodes) error {
+	if s.config.DisableCoordinates {
+		return nil
+	}
+
+	state := s.fsm.State()
+	for i := range nodes {
+		if nodes[i].Node == nil {
+			continue
+		}
+		coord, err := state.CoordinateGetRaw(nodes[i].Node.Node)
+		if err != nil {
+			return err
+		}
+		nodes[i].Coord = coord
+	}
+	return nil
+}
+
 // serfer provides the coordinate information we need from the Server in an
 // interface that's easy to mock out for testing. Without this, we'd have to
 // do some really painful setup to get good unit test coverage of all the cases.
@@ -0,0 +1,319 @@
+package consul
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// selectorOp is a comparison used in a filter expression.
+type selectorOp int
+
+const (
+	selectorEqual selectorOp = iota
+	selectorNotEqual
+	selectorContains
+	selectorNotContains
+)
+
+// selectorCond is one "<field> <op> <value>" clause of a filter. The path
+// is the field names (or map key) to follow from the filtered item.
+type selectorCond struct {
+	path  []string
+	op    selectorOp
+	value string
+}
+
+// selector is a parsed filter expression. It's a list of conditions that
+// must all match, such as:
+//
+//	Service.Service == redis and Checks.Status != critical
+//
+// Fields are named by their Go field names, joined with dots. A field that
+// passes through a list, like Checks.Status, matches if any item does for
+// == and contains, and if no item does for != and not contains. Maps are
+// indexed by key, as in NodeMeta.rack. Values may be double quoted.
+type selector struct {
+	conds []selectorCond
+}
+
+// parseSelector parses a filter expression, checking its fields against
+// the type of item it will be applied to.
+func parseSelector(expr string, item reflect.Type) (*selector, error) {
+	tokens, err := tokenizeSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &selector{}
+	for len(tokens) > 0 {
+		if len(sel.conds) > 0 {
+			if tokens[0] != "and" {
+				return nil, fmt.Errorf("expected 'and' but found %q", tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+
+		var cond selectorCond
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete condition")
+		}
+		cond.path = strings.Split(tokens[0], ".")
+		switch tokens[1] {
+		case "==":
+			cond.op = selectorEqual
+		case "!=":
+			cond.op = selectorNotEqual
+		case "contains":
+			cond.op = selectorContains
+		case "not":
+			if tokens[2] != "contains" || len(tokens) < 4 {
+				return nil, fmt.Errorf("expected 'not contains'")
+			}
+			cond.op = selectorNotContains
+			tokens = tokens[1:]
+		default:
+			return nil, fmt.Errorf("unknown operator %q", tokens[1])
+		}
+		cond.value = tokens[2]
+		tokens = tokens[3:]
+
+		if err := checkSelectorPath(item, cond.path, cond.op); err != nil {
+			return nil, err
+		}
+		sel.conds = append(sel.conds, cond)
+	}
+	if len(sel.conds) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+	return sel, nil
+}
+
+// tokenizeSelector splits a filter expression into words, operators, and
+// unquoted strings.
+func tokenizeSelector(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s: %v", expr[i:end+1], err)
+			}
+			tokens = append(tokens, value)
+			i = end + 1
+
+		case c == '=' || c == '!':
+			if i+1 >= len(expr) || expr[i+1] != '=' {
+				return nil, fmt.Errorf("unknown operator at %q", expr[i:])
+			}
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+
+		default:
+			end := i
+			for ; end < len(expr); end++ {
+				r := rune(expr[end])
+				if unicode.IsSpace(r) || r == '"' || r == '=' || r == '!' {
+					break
+				}
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// checkSelectorPath makes sure the path names a field of the item type that
+// the operator can be used with.
+func checkSelectorPath(t reflect.Type, path []string, op selectorOp) error {
+	field := strings.Join(path, ".")
+	for _, name := range path {
+		t = selectorElem(t)
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := t.FieldByName(name)
+			if !ok || f.PkgPath != "" {
+				return fmt.Errorf("unknown field %q", field)
+			}
+			t = f.Type
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	// Lists along the way are walked, but the last one is what the
+	// contains operators look in.
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch op {
+	case selectorEqual, selectorNotEqual:
+		if !selectorScalar(selectorElem(t)) || t.Kind() == reflect.Slice {
+			return fmt.Errorf("field %q can't be compared, use contains", field)
+		}
+	case selectorContains, selectorNotContains:
+		if t.Kind() == reflect.Map {
+			if t.Key().Kind() != reflect.String {
+				return fmt.Errorf("field %q can't be searched", field)
+			}
+		} else if t.Kind() != reflect.Slice || !selectorScalar(selectorElem(t.Elem())) {
+			return fmt.Errorf("field %q is not a list or map", field)
+		}
+	}
+	return nil
+}
+
+// selectorElem strips pointers and slices off a type, which the selector
+// walks through.
+func selectorElem(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t
+}
+
+// selectorScalar returns true if values of the type can be compared to the
+// string in a condition.
+func selectorScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// Match returns true if the item satisfies every condition.
+func (s *selector) Match(item interface{}) bool {
+	for _, cond := range s.conds {
+		if !cond.match(reflect.ValueOf(item)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *selectorCond) match(item reflect.Value) bool {
+	var found bool
+	for _, v := range selectorValues(item, c.path) {
+		switch c.op {
+		case selectorEqual, selectorNotEqual:
+			found = selectorString(v) == c.value
+		case selectorContains, selectorNotContains:
+			found = selectorHas(v, c.value)
+		}
+		if found {
+			break
+		}
+	}
+	if c.op == selectorNotEqual || c.op == selectorNotContains {
+		return !found
+	}
+	return found
+}
+
+// selectorValues follows the path from v, walking into every item of any
+// list along the way, and returns the values at the end of it.
+func selectorValues(v reflect.Value, path []string) []reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if len(path) == 0 {
+		return []reflect.Value{v}
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		var out []reflect.Value
+		for i := 0; i < v.Len(); i++ {
+			out = append(out, selectorValues(v.Index(i), path)...)
+		}
+		return out
+	case reflect.Struct:
+		return selectorValues(v.FieldByName(path[0]), path[1:])
+	case reflect.Map:
+		entry := v.MapIndex(reflect.ValueOf(path[0]))
+		if !entry.IsValid() {
+			return nil
+		}
+		return selectorValues(entry, path[1:])
+	}
+	return nil
+}
+
+// selectorHas returns true if the list or map holds the value.
+func selectorHas(v reflect.Value, value string) bool {
+	switch v.Kind() {
+	case reflect.Map:
+		return v.MapIndex(reflect.ValueOf(value)).IsValid()
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			for elem.Kind() == reflect.Ptr && !elem.IsNil() {
+				elem = elem.Elem()
+			}
+			if selectorString(elem) == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectorString formats a scalar value for comparison.
+func selectorString(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// filterBySelector drops the items of the list pointed to by subj that
+// don't match the filter expression. An empty expression keeps everything.
+func filterBySelector(expr string, subj interface{}) error {
+	if expr == "" {
+		return nil
+	}
+
+	list := reflect.ValueOf(subj).Elem()
+	sel, err := parseSelector(expr, list.Type().Elem())
+	if err != nil {
+		var verr structs.ValidationErrors
+		verr.Add("Filter", "%v", err)
+		return verr
+	}
+
+	kept := reflect.MakeSlice(list.Type(), 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		if sel.Match(list.Index(i).Interface()) {
+			kept = reflect.Append(kept, list.Index(i))
+		}
+	}
+	list.Set(kept)
+	return nil
+}
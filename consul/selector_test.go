@@ -0,0 +1,127 @@
+package consul
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestSelector_Parse(t *testing.T) {
+	typ := reflect.TypeOf(structs.CheckServiceNode{})
+	cases := []struct {
+		expr string
+		err  string
+	}{
+		{"Node.Node == foo", ""},
+		{`Service.Service=="redis" and Service.Port != 8000`, ""},
+		{"Service.Tags contains master and Checks.Status != critical", ""},
+		{"Service.Tags not contains master", ""},
+		{"Node.Meta.rack == r1", ""},
+		{"Node.Meta contains rack", ""},
+		{"", "empty filter"},
+		{"Node.Node", "incomplete condition"},
+		{"Node.Node == foo bar", "expected 'and'"},
+		{"Node.Node ~= foo", "unknown operator"},
+		{"Node.Node >= foo", "unknown operator"},
+		{"Node.Nope == foo", "unknown field"},
+		{"Service.Tags == master", "can't be compared"},
+		{"Node.Node contains foo", "is not a list or map"},
+		{"Checks contains foo", "is not a list or map"},
+		{"Node.Node not foo", "expected 'not contains'"},
+		{`Node.Node == "foo`, "unterminated string"},
+	}
+	for _, c := range cases {
+		_, err := parseSelector(c.expr, typ)
+		if c.err == "" && err != nil {
+			t.Fatalf("%q: err: %v", c.expr, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%q: expected %q, got %v", c.expr, c.err, err)
+		}
+	}
+}
+
+func TestSelector_Match(t *testing.T) {
+	node := structs.CheckServiceNode{
+		Node: &structs.Node{
+			Node:    "foo",
+			Address: "127.0.0.1",
+			Meta:    map[string]string{"rack": "r1"},
+		},
+		Service: &structs.NodeService{
+			ID:      "redis1",
+			Service: "redis",
+			Tags:    []string{"master", "v1"},
+			Port:    8000,
+		},
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{CheckID: "serfHealth", Status: structs.HealthPassing},
+			&structs.HealthCheck{CheckID: "redis", Status: structs.HealthWarning},
+		},
+	}
+
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{"Node.Node == foo", true},
+		{"Node.Node == bar", false},
+		{"Node.Node != bar", true},
+		{"Service.Port == 8000", true},
+		{`Service.Service == "redis" and Service.Port == 8000`, true},
+		{"Service.Service == redis and Service.Port == 9000", false},
+		{"Service.Tags contains master", true},
+		{"Service.Tags contains slave", false},
+		{"Service.Tags not contains slave", true},
+		{"Node.Meta.rack == r1", true},
+		{"Node.Meta.rack != r1", false},
+		{"Node.Meta.zone == z1", false},
+		{"Node.Meta.zone != z1", true},
+		{"Node.Meta contains rack", true},
+		{"Node.Meta not contains rack", false},
+		{"Checks.Status == warning", true},
+		{"Checks.Status != critical", true},
+		{"Checks.Status != warning", false},
+		{"Service.EnableTagOverride == false", true},
+	}
+	for _, c := range cases {
+		sel, err := parseSelector(c.expr, reflect.TypeOf(node))
+		if err != nil {
+			t.Fatalf("%q: err: %v", c.expr, err)
+		}
+		if sel.Match(node) != c.match {
+			t.Fatalf("%q: expected %v", c.expr, c.match)
+		}
+	}
+}
+
+func TestSelector_FilterBySelector(t *testing.T) {
+	nodes := structs.Nodes{
+		&structs.Node{Node: "foo", Address: "127.0.0.1"},
+		&structs.Node{Node: "bar", Address: "127.0.0.2"},
+		&structs.Node{Node: "baz", Address: "127.0.0.3"},
+	}
+
+	// An empty filter keeps everything
+	if err := filterBySelector("", &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	if err := filterBySelector("Node != bar", &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].Node != "foo" || nodes[1].Node != "baz" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Bad filters are reported as validation errors
+	err := filterBySelector("Nope == foo", &nodes)
+	if !structs.IsValidationError(err) || !strings.Contains(err.Error(), "Filter: unknown field") {
+		t.Fatalf("err: %v", err)
+	}
+}
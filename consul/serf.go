@@ -3,6 +3,7 @@ package consul
 import (
 	"net"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/serf/serf"
 )
@@ -39,18 +40,22 @@ func (s *Server) lanEventHandler() {
 			switch e.EventType() {
 			case serf.EventMemberJoin:
 				s.lanNodeJoin(e.(serf.MemberEvent))
+				s.lanTrackLastSeen(e.(serf.MemberEvent))
 				s.localMemberEvent(e.(serf.MemberEvent))
 
 			case serf.EventMemberLeave, serf.EventMemberFailed:
 				s.lanNodeFailed(e.(serf.MemberEvent))
+				s.lanTrackLastSeen(e.(serf.MemberEvent))
 				s.localMemberEvent(e.(serf.MemberEvent))
 
 			case serf.EventMemberReap:
+				s.lanTrackLastSeen(e.(serf.MemberEvent))
 				s.localMemberEvent(e.(serf.MemberEvent))
 			case serf.EventUser:
 				s.localEvent(e.(serf.UserEvent))
 			case serf.EventMemberUpdate: // Ignore
-			case serf.EventQuery: // Ignore
+			case serf.EventQuery:
+				s.localQuery(e.(*serf.Query))
 			default:
 				s.logger.Printf("[WARN] consul: unhandled LAN Serf Event: %#v", e)
 			}
@@ -85,6 +90,31 @@ func (s *Server) wanEventHandler() {
 	}
 }
 
+// lanTrackLastSeen records when LAN members stop being alive. Alive
+// members are seen continuously, so they don't need an entry.
+func (s *Server) lanTrackLastSeen(me serf.MemberEvent) {
+	s.lanLastSeenLock.Lock()
+	defer s.lanLastSeenLock.Unlock()
+
+	now := time.Now()
+	for _, m := range me.Members {
+		switch me.EventType() {
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			s.lanLastSeen[m.Name] = now
+		default:
+			delete(s.lanLastSeen, m.Name)
+		}
+	}
+}
+
+// lanLastSeenTime returns when a LAN member that is no longer alive was
+// last seen, or the zero time if we don't know.
+func (s *Server) lanLastSeenTime(node string) time.Time {
+	s.lanLastSeenLock.Lock()
+	defer s.lanLastSeenLock.Unlock()
+	return s.lanLastSeen[node]
+}
+
 // localMemberEvent is used to reconcile Serf events with the strongly
 // consistent store if we are the current leader
 func (s *Server) localMemberEvent(me serf.MemberEvent) {
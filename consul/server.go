@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/clock"
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/raft"
@@ -92,6 +93,11 @@ type Server struct {
 	// strong consistency.
 	fsm *consulFSM
 
+	// hibernator parks blocking queries that have been idle for a
+	// while. It uses the real clock, like the query timeouts it takes
+	// over.
+	hibernator *hibernator
+
 	// Have we attempted to leave the cluster
 	left bool
 
@@ -111,6 +117,25 @@ type Server struct {
 	raftStore     *raftboltdb.BoltStore
 	raftTransport *raft.NetworkTransport
 
+	// kvsCipher encrypts KV values under the configured prefixes. It is
+	// nil if KV encryption is not enabled.
+	kvsCipher *kvsCipher
+
+	// tlsCA is the bootstrapped certificate authority used to sign the
+	// certificates of other servers. It is nil unless TLSBootstrap is set
+	// and this server created the authority.
+	tlsCA *tlsBootstrapCA
+
+	// lanLastSeen tracks when LAN members that are no longer alive
+	// were last seen alive, for answering liveness queries.
+	lanLastSeen     map[string]time.Time
+	lanLastSeenLock sync.Mutex
+
+	// reapDeferred tracks when the leader first put off reaping a failed
+	// node because it was holding locks.
+	reapDeferred     map[string]time.Time
+	reapDeferredLock sync.Mutex
+
 	// reconcileCh is used to pass events from the serf handler
 	// into the leader manager, so that the strong state can be
 	// updated
@@ -139,7 +164,7 @@ type Server struct {
 	// sessionTimers track the expiration time of each Session that has
 	// a TTL. On expiration, a SessionDestroy event will occur, and
 	// destroy the session via standard session destroy processing
-	sessionTimers     map[string]*time.Timer
+	sessionTimers     map[string]clock.Timer
 	sessionTimersLock sync.Mutex
 
 	// tombstoneGC is used to track the pending GC invocations
@@ -153,14 +178,18 @@ type Server struct {
 
 // Holds the RPC endpoints
 type endpoints struct {
-	Catalog    *Catalog
-	Health     *Health
-	Status     *Status
-	KVS        *KVS
-	Session    *Session
-	Internal   *Internal
-	ACL        *ACL
-	Coordinate *Coordinate
+	Catalog      *Catalog
+	Health       *Health
+	Status       *Status
+	KVS          *KVS
+	Session      *Session
+	Internal     *Internal
+	ACL          *ACL
+	Coordinate   *Coordinate
+	Operator     *Operator
+	Maintenance  *Maintenance
+	ManagedCheck *ManagedCheck
+	Txn          *Txn
 }
 
 // NewServer is used to construct a new Consul server from the
@@ -186,6 +215,23 @@ func NewServer(config *Config) (*Server, error) {
 		config.LogOutput = os.Stderr
 	}
 
+	// Ensure we have a clock
+	if config.Clock == nil {
+		config.Clock = clock.Real{}
+	}
+
+	// Create a logger
+	logger := log.New(config.LogOutput, "", log.LstdFlags)
+
+	// Set up any bootstrapped TLS files before the TLS config is built.
+	var tlsCA *tlsBootstrapCA
+	if config.TLSBootstrap {
+		var err error
+		if tlsCA, err = setupTLSBootstrap(config, logger); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create the tls wrapper for outgoing connections
 	tlsConf := config.tlsConfig()
 	tlsWrap, err := tlsConf.OutgoingTLSWrapper()
@@ -199,27 +245,38 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
-	// Create a logger
-	logger := log.New(config.LogOutput, "", log.LstdFlags)
-
 	// Create the tombstone GC
-	gc, err := state.NewTombstoneGC(config.TombstoneTTL, config.TombstoneTTLGranularity)
+	gc, err := state.NewTombstoneGC(config.TombstoneTTL, config.TombstoneTTLGranularity, config.Clock)
 	if err != nil {
 		return nil, err
 	}
 
+	// Create the KVS cipher, if encryption is configured
+	var kvsEnc *kvsCipher
+	if len(config.KVSEncryptionKey) > 0 {
+		kvsEnc, err = newKVSCipher(config.KVSEncryptionKey, config.KVSEncryptPrefixes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create server
 	s := &Server{
 		config:        config,
 		connPool:      NewPool(config.LogOutput, serverRPCCache, serverMaxStreams, tlsWrap),
 		eventChLAN:    make(chan serf.Event, 256),
 		eventChWAN:    make(chan serf.Event, 256),
+		hibernator:    newHibernator(clock.Real{}),
+		kvsCipher:     kvsEnc,
+		lanLastSeen:   make(map[string]time.Time),
 		localConsuls:  make(map[string]*serverParts),
 		logger:        logger,
+		reapDeferred:  make(map[string]time.Time),
 		reconcileCh:   make(chan serf.Member, 32),
 		remoteConsuls: make(map[string][]*serverParts),
 		rpcServer:     rpc.NewServer(),
 		rpcTLS:        incomingTLS,
+		tlsCA:         tlsCA,
 		tombstoneGC:   gc,
 		shutdownCh:    make(chan struct{}),
 	}
@@ -258,6 +315,11 @@ func NewServer(config *Config) (*Server, error) {
 	}
 	go s.lanEventHandler()
 
+	// Ask for a certificate if we need one.
+	if config.TLSBootstrap && tlsCA == nil && config.CertFile == "" {
+		go s.requestTLSCert()
+	}
+
 	// Initialize the wan Serf
 	s.serfWAN, err = s.setupSerf(config.SerfWANConfig,
 		s.eventChWAN, serfWANSnapshot, true)
@@ -290,6 +352,9 @@ func (s *Server) setupSerf(conf *serf.Config, ch chan serf.Event, path string, w
 	conf.Tags["vsn_min"] = fmt.Sprintf("%d", ProtocolVersionMin)
 	conf.Tags["vsn_max"] = fmt.Sprintf("%d", ProtocolVersionMax)
 	conf.Tags["build"] = s.config.Build
+	if s.config.ExternalChecker && !wan {
+		conf.Tags["ext_checker"] = "1"
+	}
 	conf.Tags["port"] = fmt.Sprintf("%d", addr.Port)
 	if s.config.Bootstrap {
 		conf.Tags["bootstrap"] = "1"
@@ -411,6 +476,10 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.endpoints.Internal = &Internal{s}
 	s.endpoints.ACL = &ACL{s}
 	s.endpoints.Coordinate = NewCoordinate(s)
+	s.endpoints.Operator = &Operator{s}
+	s.endpoints.Maintenance = &Maintenance{s}
+	s.endpoints.ManagedCheck = &ManagedCheck{s}
+	s.endpoints.Txn = &Txn{s}
 
 	// Register the handlers
 	s.rpcServer.Register(s.endpoints.Status)
@@ -421,6 +490,10 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.rpcServer.Register(s.endpoints.Internal)
 	s.rpcServer.Register(s.endpoints.ACL)
 	s.rpcServer.Register(s.endpoints.Coordinate)
+	s.rpcServer.Register(s.endpoints.Operator)
+	s.rpcServer.Register(s.endpoints.Maintenance)
+	s.rpcServer.Register(s.endpoints.ManagedCheck)
+	s.rpcServer.Register(s.endpoints.Txn)
 
 	list, err := net.ListenTCP("tcp", s.config.RPCAddr)
 	if err != nil {
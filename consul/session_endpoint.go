@@ -1,7 +1,6 @@
 package consul
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -21,12 +20,13 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 	}
 	defer metrics.MeasureSince([]string{"consul", "session", "apply"}, time.Now())
 
-	// Verify the args
+	// Verify the args, collecting every problem
+	var verr structs.ValidationErrors
 	if args.Session.ID == "" && args.Op == structs.SessionDestroy {
-		return fmt.Errorf("Must provide ID")
+		verr.Add("Session.ID", "must be provided")
 	}
 	if args.Session.Node == "" && args.Op == structs.SessionCreate {
-		return fmt.Errorf("Must provide Node")
+		verr.Add("Session.Node", "must be provided")
 	}
 
 	// Ensure that the specified behavior is allowed
@@ -37,21 +37,22 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 	case structs.SessionKeysRelease:
 	case structs.SessionKeysDelete:
 	default:
-		return fmt.Errorf("Invalid Behavior setting '%s'", args.Session.Behavior)
+		verr.Add("Session.Behavior", "'%s' is not a valid behavior", args.Session.Behavior)
 	}
 
 	// Ensure the Session TTL is valid if provided
 	if args.Session.TTL != "" {
 		ttl, err := time.ParseDuration(args.Session.TTL)
 		if err != nil {
-			return fmt.Errorf("Session TTL '%s' invalid: %v", args.Session.TTL, err)
-		}
-
-		if ttl != 0 && (ttl < s.srv.config.SessionTTLMin || ttl > structs.SessionTTLMax) {
-			return fmt.Errorf("Invalid Session TTL '%d', must be between [%v=%v]",
-				ttl, s.srv.config.SessionTTLMin, structs.SessionTTLMax)
+			verr.Add("Session.TTL", "'%s' is not a valid duration: %v", args.Session.TTL, err)
+		} else if ttl != 0 && (ttl < s.srv.config.SessionTTLMin || ttl > structs.SessionTTLMax) {
+			verr.Add("Session.TTL", "'%s' must be between %v and %v",
+				args.Session.TTL, s.srv.config.SessionTTLMin, structs.SessionTTLMax)
 		}
 	}
+	if err := verr.ErrorOrNil(); err != nil {
+		return err
+	}
 
 	// If this is a create, we must generate the Session ID. This must
 	// be done prior to appending to the raft log, because the ID is not
@@ -112,7 +113,7 @@ func (s *Session) Get(args *structs.SessionSpecificRequest,
 	return s.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("SessionGet"),
+		queryWatch(state, "SessionGet"),
 		func() error {
 			index, session, err := state.SessionGet(args.Session)
 			if err != nil {
@@ -141,7 +142,7 @@ func (s *Session) List(args *structs.DCSpecificRequest,
 	return s.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("SessionList"),
+		queryWatch(state, "SessionList"),
 		func() error {
 			index, sessions, err := state.SessionList()
 			if err != nil {
@@ -165,7 +166,7 @@ func (s *Session) NodeSessions(args *structs.NodeSpecificRequest,
 	return s.srv.blockingRPC(
 		&args.QueryOptions,
 		&reply.QueryMeta,
-		state.GetQueryWatch("NodeSessions"),
+		queryWatch(state, "NodeSessions"),
 		func() error {
 			index, sessions, err := state.NodeSessions(args.Node)
 			if err != nil {
@@ -2,6 +2,7 @@ package consul
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -511,7 +512,7 @@ func TestSessionEndpoint_Apply_BadTTL(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error")
 	}
-	if err.Error() != "Session TTL '10z' invalid: time: unknown unit z in duration 10z" {
+	if err.Error() != "Invalid request: Session.TTL: '10z' is not a valid duration: time: unknown unit z in duration 10z" {
 		t.Fatalf("incorrect error message: %s", err.Error())
 	}
 
@@ -522,7 +523,7 @@ func TestSessionEndpoint_Apply_BadTTL(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error")
 	}
-	if err.Error() != "Invalid Session TTL '5000000000', must be between [10s=1h0m0s]" {
+	if err.Error() != "Invalid request: Session.TTL: '5s' must be between 10s and 1h0m0s" {
 		t.Fatalf("incorrect error message: %s", err.Error())
 	}
 
@@ -533,7 +534,37 @@ func TestSessionEndpoint_Apply_BadTTL(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error")
 	}
-	if err.Error() != "Invalid Session TTL '4000000000000', must be between [10s=1h0m0s]" {
+	if err.Error() != "Invalid request: Session.TTL: '4000s' must be between 10s and 1h0m0s" {
 		t.Fatalf("incorrect error message: %s", err.Error())
 	}
 }
+
+func TestSessionEndpoint_Apply_Validation(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Every problem should be reported at once
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Behavior: "bogus",
+			TTL:      "10z",
+		},
+	}
+	var out string
+	err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, field := range []string{"Session.Node:", "Session.Behavior:", "Session.TTL:"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Fatalf("missing %s: %v", field, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/clock"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
@@ -70,7 +71,7 @@ func (s *Server) resetSessionTimer(id string, session *structs.Session) error {
 func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
 	// Ensure a timer map exists
 	if s.sessionTimers == nil {
-		s.sessionTimers = make(map[string]*time.Timer)
+		s.sessionTimers = make(map[string]clock.Timer)
 	}
 
 	// Adjust the given TTL by the TTL multiplier. This is done
@@ -87,7 +88,7 @@ func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
 	}
 
 	// Create a new timer to track expiration of thi ssession
-	timer := time.AfterFunc(ttl, func() {
+	timer := s.config.Clock.AfterFunc(ttl, func() {
 		s.invalidateSession(id)
 	})
 	s.sessionTimers[id] = timer
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/clock"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
@@ -159,43 +160,46 @@ func TestResetSessionTimerLocked(t *testing.T) {
 }
 
 func TestResetSessionTimerLocked_Renew(t *testing.T) {
-	dir1, s1 := testServer(t)
+	clk := clock.NewManual(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clk
+	})
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	s1.sessionTimersLock.Lock()
-	s1.resetSessionTimerLocked("foo", 5*time.Millisecond)
+	s1.resetSessionTimerLocked("foo", 5*time.Second)
 	s1.sessionTimersLock.Unlock()
 
 	if _, ok := s1.sessionTimers["foo"]; !ok {
 		t.Fatalf("missing timer")
 	}
 
-	time.Sleep(5 * time.Millisecond)
+	clk.Advance(5 * time.Second)
 
 	// Renew the session
 	s1.sessionTimersLock.Lock()
-	renew := time.Now()
-	s1.resetSessionTimerLocked("foo", 5*time.Millisecond)
+	s1.resetSessionTimerLocked("foo", 5*time.Second)
 	s1.sessionTimersLock.Unlock()
 
-	// Watch for invalidation
-	for time.Now().Sub(renew) < 20*time.Millisecond {
-		s1.sessionTimersLock.Lock()
-		_, ok := s1.sessionTimers["foo"]
-		s1.sessionTimersLock.Unlock()
-		if !ok {
-			end := time.Now()
-			if end.Sub(renew) < 5*time.Millisecond {
-				t.Fatalf("early invalidate")
-			}
-			return
-		}
-		time.Sleep(time.Millisecond)
+	// It shouldn't expire until the full TTL has passed since the renewal
+	clk.Advance(5*time.Second*structs.SessionTTLMultiplier - time.Millisecond)
+	s1.sessionTimersLock.Lock()
+	_, ok := s1.sessionTimers["foo"]
+	s1.sessionTimersLock.Unlock()
+	if !ok {
+		t.Fatalf("early invalidate")
+	}
+
+	clk.Advance(time.Millisecond)
+	s1.sessionTimersLock.Lock()
+	_, ok = s1.sessionTimers["foo"]
+	s1.sessionTimersLock.Unlock()
+	if ok {
+		t.Fatalf("should have expired")
 	}
-	t.Fatalf("should have expired")
 }
 
 func TestInvalidateSession(t *testing.T) {
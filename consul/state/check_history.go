@@ -0,0 +1,171 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// checkHistoryRetain is the number of the most recent transitions kept for
+// each health check.
+const checkHistoryRetain = 10
+
+// checkTransition is the internal type used to store a check's history. ID
+// orders the transitions of one check by the index they happened at.
+type checkTransition struct {
+	ID         string
+	Node       string
+	CheckID    string
+	Transition *structs.CheckTransition
+}
+
+// checkTransitionID returns the ID of the transition made at the given index.
+func checkTransitionID(idx uint64) string {
+	return fmt.Sprintf("%020d", idx)
+}
+
+// insertCheckTransitionTxn stores a transition, dropping the oldest one for
+// the check once it has more than it retains.
+func (s *StateStore) insertCheckTransitionTxn(tx *memdb.Txn, t *structs.CheckTransition) error {
+	entry := &checkTransition{
+		ID:         checkTransitionID(t.Index),
+		Node:       t.Node,
+		CheckID:    t.CheckID,
+		Transition: t,
+	}
+	if err := tx.Insert("check_history", entry); err != nil {
+		return fmt.Errorf("failed inserting check transition: %s", err)
+	}
+
+	iter, err := tx.Get("check_history", "check", t.Node, t.CheckID)
+	if err != nil {
+		return fmt.Errorf("failed check history lookup: %s", err)
+	}
+	var history []interface{}
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		history = append(history, entry)
+	}
+	for len(history) > checkHistoryRetain {
+		if err := tx.Delete("check_history", history[0]); err != nil {
+			return fmt.Errorf("failed pruning check history: %s", err)
+		}
+		history = history[1:]
+	}
+	return nil
+}
+
+// recordCheckTransitionTxn adds a transition to a check's history if the
+// check is new or its status changed, within an existing transaction. The
+// check's output is taken in its stored form.
+func (s *StateStore) recordCheckTransitionTxn(tx *memdb.Txn, idx uint64, existing, hc *structs.HealthCheck) error {
+	// Rebuilding the tables during a restore isn't a transition.
+	if s.restoring {
+		return nil
+	}
+	if existing != nil && existing.Status == hc.Status {
+		return nil
+	}
+
+	t := &structs.CheckTransition{
+		Node:        hc.Node,
+		CheckID:     hc.CheckID,
+		ServiceID:   hc.ServiceID,
+		ServiceName: hc.ServiceName,
+		Status:      hc.Status,
+		Output:      hc.Output,
+		Index:       idx,
+	}
+	if err := s.insertCheckTransitionTxn(tx, t); err != nil {
+		return err
+	}
+	if err := tx.Insert("index", &IndexEntry{"check_history", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["check_history"].Notify() })
+	return nil
+}
+
+// deleteCheckHistoryTxn removes the history of a check that's being
+// deleted, within an existing transaction.
+func (s *StateStore) deleteCheckHistoryTxn(tx *memdb.Txn, idx uint64, node, checkID string) error {
+	iter, err := tx.Get("check_history", "check", node, checkID)
+	if err != nil {
+		return fmt.Errorf("failed check history lookup: %s", err)
+	}
+	var history []interface{}
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		history = append(history, entry)
+	}
+	if len(history) == 0 {
+		return nil
+	}
+
+	// Do the delete in a separate loop so we don't trash the iterator.
+	for _, entry := range history {
+		if err := tx.Delete("check_history", entry); err != nil {
+			return fmt.Errorf("failed removing check history: %s", err)
+		}
+	}
+	if err := tx.Insert("index", &IndexEntry{"check_history", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["check_history"].Notify() })
+	return nil
+}
+
+// CheckHistory returns the recent transitions of the given health check,
+// oldest first.
+func (s *StateStore) CheckHistory(node, checkID string) (uint64, structs.CheckTransitions, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("CheckHistory")...)
+
+	iter, err := tx.Get("check_history", "check", node, checkID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed check history lookup: %s", err)
+	}
+	var history structs.CheckTransitions
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		t := *entry.(*checkTransition).Transition
+		output, err := decodeCheckOutput(t.Output)
+		if err != nil {
+			return 0, nil, err
+		}
+		t.Output = output
+		history = append(history, &t)
+	}
+	return idx, history, nil
+}
+
+// CheckHistory is used to pull every check's retained transitions from the
+// snapshot. Their output is left in its stored form.
+func (s *StateSnapshot) CheckHistory() (structs.CheckTransitions, error) {
+	iter, err := s.tx.Get("check_history", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var history structs.CheckTransitions
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		history = append(history, entry.(*checkTransition).Transition)
+	}
+	return history, nil
+}
+
+// CheckTransition is used when restoring from a snapshot.
+func (s *StateRestore) CheckTransition(t *structs.CheckTransition) error {
+	if err := s.store.insertCheckTransitionTxn(s.tx, t); err != nil {
+		return fmt.Errorf("failed restoring check transition: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, t.Index, "check_history"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("check_history")
+	return nil
+}
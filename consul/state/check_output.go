@@ -0,0 +1,165 @@
+package state
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+const (
+	// checkOutputCompressMin is the smallest check output we'll try to
+	// compress. Shorter output rarely gets any smaller.
+	checkOutputCompressMin = 256
+
+	// checkOutputMarker starts every encoded check output. Raw output
+	// that happens to start with it is escaped.
+	checkOutputMarker = '\x00'
+
+	// checkOutputRaw and checkOutputDeflate follow the marker to say how
+	// the rest of the stored output is encoded.
+	checkOutputRaw     = '\x00'
+	checkOutputDeflate = '\x01'
+)
+
+// checkOutput is the internal type used to intern stored check output.
+type checkOutput struct {
+	ID     string
+	Output string
+	Refs   int
+}
+
+// encodeCheckOutput returns the form of the given check output that's kept
+// in the state store and in snapshots. Long output is compressed when that
+// saves space, and anything else is kept as-is unless it needs escaping.
+func encodeCheckOutput(output string) string {
+	if len(output) >= checkOutputCompressMin {
+		var buf bytes.Buffer
+		buf.WriteByte(checkOutputMarker)
+		buf.WriteByte(checkOutputDeflate)
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err == nil {
+			if _, err := w.Write([]byte(output)); err == nil && w.Close() == nil {
+				if buf.Len() < len(output) {
+					return buf.String()
+				}
+			}
+		}
+	}
+
+	if len(output) > 0 && output[0] == checkOutputMarker {
+		return string([]byte{checkOutputMarker, checkOutputRaw}) + output
+	}
+	return output
+}
+
+// decodeCheckOutput returns the original check output for a stored one.
+func decodeCheckOutput(stored string) (string, error) {
+	if len(stored) < 2 || stored[0] != checkOutputMarker {
+		return stored, nil
+	}
+
+	switch stored[1] {
+	case checkOutputRaw:
+		return stored[2:], nil
+
+	case checkOutputDeflate:
+		r := flate.NewReader(bytes.NewReader([]byte(stored[2:])))
+		defer r.Close()
+		output, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("failed decompressing check output: %s", err)
+		}
+		return string(output), nil
+
+	default:
+		return "", fmt.Errorf("unknown check output encoding %d", stored[1])
+	}
+}
+
+// exportCheck returns a stored health check the way callers expect to see
+// it, with its output decoded. Checks with plain output are returned as-is.
+func exportCheck(hc *structs.HealthCheck) (*structs.HealthCheck, error) {
+	if len(hc.Output) == 0 || hc.Output[0] != checkOutputMarker {
+		return hc, nil
+	}
+
+	output, err := decodeCheckOutput(hc.Output)
+	if err != nil {
+		return nil, err
+	}
+	check := *hc
+	check.Output = output
+	return &check, nil
+}
+
+// checkOutputID returns the key used to intern a stored check output.
+func checkOutputID(stored string) string {
+	sum := sha1.Sum([]byte(stored))
+	return hex.EncodeToString(sum[:])
+}
+
+// internCheckOutputTxn takes a reference on the given stored check output
+// and returns the shared copy of it that should be kept in the check.
+func (s *StateStore) internCheckOutputTxn(tx *memdb.Txn, stored string) (string, error) {
+	if stored == "" {
+		return stored, nil
+	}
+
+	id := checkOutputID(stored)
+	existing, err := tx.First("check_outputs", "id", id)
+	if err != nil {
+		return "", fmt.Errorf("failed check output lookup: %s", err)
+	}
+
+	entry := &checkOutput{ID: id, Output: stored, Refs: 1}
+	if existing != nil {
+		shared := existing.(*checkOutput)
+		if shared.Output != stored {
+			// Don't share on a hash collision.
+			return stored, nil
+		}
+		entry.Output = shared.Output
+		entry.Refs = shared.Refs + 1
+	}
+	if err := tx.Insert("check_outputs", entry); err != nil {
+		return "", fmt.Errorf("failed inserting check output: %s", err)
+	}
+	return entry.Output, nil
+}
+
+// releaseCheckOutputTxn drops a reference on the given stored check output,
+// removing it once no checks use it.
+func (s *StateStore) releaseCheckOutputTxn(tx *memdb.Txn, stored string) error {
+	if stored == "" {
+		return nil
+	}
+
+	existing, err := tx.First("check_outputs", "id", checkOutputID(stored))
+	if err != nil {
+		return fmt.Errorf("failed check output lookup: %s", err)
+	}
+	if existing == nil || existing.(*checkOutput).Output != stored {
+		return nil
+	}
+
+	shared := existing.(*checkOutput)
+	if shared.Refs <= 1 {
+		if err := tx.Delete("check_outputs", shared); err != nil {
+			return fmt.Errorf("failed removing check output: %s", err)
+		}
+		return nil
+	}
+
+	entry := *shared
+	entry.Refs--
+	if err := tx.Insert("check_outputs", &entry); err != nil {
+		return fmt.Errorf("failed inserting check output: %s", err)
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/consul/consul/clock"
 )
 
 func TestGraveyard_Lifecycle(t *testing.T) {
@@ -104,7 +106,7 @@ func TestGraveyard_Lifecycle(t *testing.T) {
 func TestGraveyard_GC_Trigger(t *testing.T) {
 	// Set up a fast-expiring GC.
 	ttl, granularity := 100*time.Millisecond, 20*time.Millisecond
-	gc, err := NewTombstoneGC(ttl, granularity)
+	gc, err := NewTombstoneGC(ttl, granularity, clock.Real{})
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
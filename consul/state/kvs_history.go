@@ -0,0 +1,180 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// kvsHistoryRetain is the number of the most recent versions kept for each
+// key.
+const kvsHistoryRetain = 10
+
+// kvsVersion is the internal type used to store a key's history. ID orders
+// the versions of one key by the index they were written at.
+type kvsVersion struct {
+	ID    string
+	Key   string
+	Entry *structs.DirEntry
+}
+
+// kvsVersionID returns the ID of the version written at the given index.
+func kvsVersionID(idx uint64) string {
+	return fmt.Sprintf("%020d", idx)
+}
+
+// insertKVSVersionTxn stores a version of a key, dropping the oldest one
+// once the key has more than it retains.
+func (s *StateStore) insertKVSVersionTxn(tx *memdb.Txn, entry *structs.DirEntry) error {
+	version := &kvsVersion{
+		ID:    kvsVersionID(entry.ModifyIndex),
+		Key:   entry.Key,
+		Entry: entry,
+	}
+	if err := tx.Insert("kvs_history", version); err != nil {
+		return fmt.Errorf("failed inserting kvs version: %s", err)
+	}
+
+	iter, err := tx.Get("kvs_history", "key", entry.Key)
+	if err != nil {
+		return fmt.Errorf("failed kvs history lookup: %s", err)
+	}
+	var history []interface{}
+	for v := iter.Next(); v != nil; v = iter.Next() {
+		history = append(history, v)
+	}
+	for len(history) > kvsHistoryRetain {
+		if err := tx.Delete("kvs_history", history[0]); err != nil {
+			return fmt.Errorf("failed pruning kvs history: %s", err)
+		}
+		history = history[1:]
+	}
+	return nil
+}
+
+// recordKVSVersionTxn adds an entry that was just written to its key's
+// history, within an existing transaction.
+func (s *StateStore) recordKVSVersionTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntry) error {
+	// Rebuilding the tables during a restore isn't a new version.
+	if s.restoring {
+		return nil
+	}
+	if err := s.insertKVSVersionTxn(tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Insert("index", &IndexEntry{"kvs_history", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
+
+// pruneKVSHistoryTxn removes the history of keys that are gone for good,
+// meaning they have neither an entry nor a tombstone, within an existing
+// transaction. This does a full table scan, but like tombstone reaping it
+// is only done infrequently.
+func (s *StateStore) pruneKVSHistoryTxn(tx *memdb.Txn, idx uint64) error {
+	iter, err := tx.Get("kvs_history", "id")
+	if err != nil {
+		return fmt.Errorf("failed kvs history lookup: %s", err)
+	}
+
+	var gone []interface{}
+	live := make(map[string]bool)
+	for v := iter.Next(); v != nil; v = iter.Next() {
+		key := v.(*kvsVersion).Key
+		if _, ok := live[key]; !ok {
+			entry, err := tx.First("kvs", "id", key)
+			if err != nil {
+				return fmt.Errorf("failed kvs lookup: %s", err)
+			}
+			stone, err := tx.First("tombstones", "id", key)
+			if err != nil {
+				return fmt.Errorf("failed tombstone lookup: %s", err)
+			}
+			live[key] = entry != nil || stone != nil
+		}
+		if !live[key] {
+			gone = append(gone, v)
+		}
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+
+	// Do the delete in a separate loop so we don't trash the iterator.
+	for _, v := range gone {
+		if err := tx.Delete("kvs_history", v); err != nil {
+			return fmt.Errorf("failed pruning kvs history: %s", err)
+		}
+	}
+	if err := tx.Insert("index", &IndexEntry{"kvs_history", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
+
+// KVSHistory returns the retained versions of the given key, oldest first.
+// A deleted key keeps its history until its tombstone is reaped.
+func (s *StateStore) KVSHistory(key string) (uint64, structs.DirEntries, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "kvs", "tombstones")
+
+	iter, err := tx.Get("kvs_history", "key", key)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed kvs history lookup: %s", err)
+	}
+	var history structs.DirEntries
+	for v := iter.Next(); v != nil; v = iter.Next() {
+		history = append(history, v.(*kvsVersion).Entry)
+	}
+	return idx, history, nil
+}
+
+// KVSGetVersion returns the version of the given key that was written at
+// the given index, if it's still retained.
+func (s *StateStore) KVSGetVersion(key string, version uint64) (uint64, *structs.DirEntry, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "kvs", "tombstones")
+
+	v, err := tx.First("kvs_history", "id", key, kvsVersionID(version))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed kvs history lookup: %s", err)
+	}
+	if v != nil {
+		return idx, v.(*kvsVersion).Entry, nil
+	}
+	return idx, nil, nil
+}
+
+// KVSHistory is used to pull every key's retained versions from the
+// snapshot.
+func (s *StateSnapshot) KVSHistory() (structs.DirEntries, error) {
+	iter, err := s.tx.Get("kvs_history", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var history structs.DirEntries
+	for v := iter.Next(); v != nil; v = iter.Next() {
+		history = append(history, v.(*kvsVersion).Entry)
+	}
+	return history, nil
+}
+
+// KVSVersion is used when restoring from a snapshot.
+func (s *StateRestore) KVSVersion(entry *structs.DirEntry) error {
+	if err := s.store.insertKVSVersionTxn(s.tx, entry); err != nil {
+		return fmt.Errorf("failed restoring kvs version: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, entry.ModifyIndex, "kvs_history"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// kvsTopLevelPrefix returns the top-level prefix a key is stored under,
+// which is everything before its first slash.
+func kvsTopLevelPrefix(key string) string {
+	if i := strings.Index(key, "/"); i != -1 {
+		return key[:i]
+	}
+	return key
+}
+
+// kvsEntrySize is how much an entry counts towards its prefix's usage.
+// Values are counted as they're stored, after any compression and
+// encryption.
+func kvsEntrySize(entry *structs.DirEntry) int {
+	return len(entry.Key) + len(entry.Value)
+}
+
+// kvsUsageEntry is how the usage of a top-level prefix is kept in the
+// kvs_usage table. The ID is the prefix with a slash on the end, since the
+// prefix of a key that starts with a slash is empty and can't be indexed.
+type kvsUsageEntry struct {
+	ID    string
+	Usage structs.KVSUsage
+}
+
+// kvsUsageTxn adds the given number of keys and bytes, either of which may
+// be negative, to the usage of the top-level prefix the key falls under.
+// The usage is kept up to date by every write so it never has to be added
+// up from the KV store.
+func (s *StateStore) kvsUsageTxn(tx *memdb.Txn, key string, keys, bytes int) error {
+	prefix := kvsTopLevelPrefix(key)
+	existing, err := tx.First("kvs_usage", "id", prefix+"/")
+	if err != nil {
+		return fmt.Errorf("failed kvs usage lookup: %s", err)
+	}
+
+	// Copy the existing usage, if any, since we can't modify objects
+	// that are in the state store.
+	var entry kvsUsageEntry
+	if existing != nil {
+		entry = *existing.(*kvsUsageEntry)
+	} else {
+		entry.ID = prefix + "/"
+		entry.Usage.Prefix = prefix
+	}
+	entry.Usage.Keys += keys
+	entry.Usage.Bytes += bytes
+
+	// Drop prefixes once their last key is gone.
+	if entry.Usage.Keys <= 0 {
+		if existing != nil {
+			if err := tx.Delete("kvs_usage", existing); err != nil {
+				return fmt.Errorf("failed deleting kvs usage: %s", err)
+			}
+		}
+		return nil
+	}
+	if err := tx.Insert("kvs_usage", &entry); err != nil {
+		return fmt.Errorf("failed inserting kvs usage: %s", err)
+	}
+	return nil
+}
+
+// KVSUsage returns how much is stored under each top-level KV prefix,
+// sorted by prefix.
+func (s *StateStore) KVSUsage() (uint64, structs.KVSUsages, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "kvs", "tombstones")
+
+	entries, err := tx.Get("kvs_usage", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed kvs usage lookup: %s", err)
+	}
+	byPrefix := make(map[string]*structs.KVSUsage)
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		usage := entry.(*kvsUsageEntry).Usage
+		byPrefix[usage.Prefix] = &usage
+	}
+
+	// The IDs have a slash on the end, which sorts differently from the
+	// prefixes themselves.
+	prefixes := make([]string, 0, len(byPrefix))
+	for prefix := range byPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	results := make(structs.KVSUsages, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		results = append(results, byPrefix[prefix])
+	}
+	return idx, results, nil
+}
+
+// KVSPrefixUsage returns how much is stored under the top-level prefix
+// that the given key falls under, along with the key's own entry, if it
+// exists, so callers can work out the usage after a write to it.
+func (s *StateStore) KVSPrefixUsage(key string) (*structs.KVSUsage, *structs.DirEntry, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	prefix := kvsTopLevelPrefix(key)
+	usage := &structs.KVSUsage{Prefix: prefix}
+	counted, err := tx.First("kvs_usage", "id", prefix+"/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed kvs usage lookup: %s", err)
+	}
+	if counted != nil {
+		*usage = counted.(*kvsUsageEntry).Usage
+	}
+
+	existing, err := tx.First("kvs", "id", key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed kvs lookup: %s", err)
+	}
+	if existing != nil {
+		return usage, existing.(*structs.DirEntry), nil
+	}
+	return usage, nil, nil
+}
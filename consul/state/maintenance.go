@@ -0,0 +1,270 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+var (
+	// ErrMissingMaintenanceWindowID is returned when a maintenance window
+	// set is called without an ID.
+	ErrMissingMaintenanceWindowID = errors.New("Missing maintenance window ID")
+)
+
+// MaintenanceWindows is used to pull all the maintenance windows from the
+// snapshot.
+func (s *StateSnapshot) MaintenanceWindows() (memdb.ResultIterator, error) {
+	iter, err := s.tx.Get("maintenance_windows", "id")
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// MaintenanceWindow is used when restoring from a snapshot. For general
+// inserts, use MaintenanceWindowSet.
+func (s *StateRestore) MaintenanceWindow(window *structs.MaintenanceWindow) error {
+	if err := s.tx.Insert("maintenance_windows", window); err != nil {
+		return fmt.Errorf("failed restoring maintenance window: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, window.ModifyIndex, "maintenance_windows"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("maintenance_windows")
+	return nil
+}
+
+// MaintenanceWindowSet is used to insert or update a maintenance window.
+func (s *StateStore) MaintenanceWindowSet(idx uint64, window *structs.MaintenanceWindow) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Check that the ID is set
+	if window.ID == "" {
+		return ErrMissingMaintenanceWindowID
+	}
+
+	// Check for an existing window
+	existing, err := tx.First("maintenance_windows", "id", window.ID)
+	if err != nil {
+		return fmt.Errorf("failed maintenance window lookup: %s", err)
+	}
+
+	// Set the indexes. Only the leader puts windows into effect, so that
+	// is kept as it was.
+	if existing != nil {
+		window.CreateIndex = existing.(*structs.MaintenanceWindow).CreateIndex
+		window.ModifyIndex = idx
+		window.InEffect = existing.(*structs.MaintenanceWindow).InEffect
+	} else {
+		window.CreateIndex = idx
+		window.ModifyIndex = idx
+		window.InEffect = false
+	}
+
+	// Insert the window
+	if err := tx.Insert("maintenance_windows", window); err != nil {
+		return fmt.Errorf("failed inserting maintenance window: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"maintenance_windows", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	// The window may no longer cover checks it suppressed.
+	if err := s.unsuppressChecksTxn(tx, idx); err != nil {
+		return err
+	}
+
+	tx.Defer(func() { s.tableWatches["maintenance_windows"].Notify() })
+	tx.Commit()
+	return nil
+}
+
+// MaintenanceWindowGet is used to look up a maintenance window by ID.
+func (s *StateStore) MaintenanceWindowGet(windowID string) (uint64, *structs.MaintenanceWindow, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("MaintenanceWindowGet")...)
+
+	// Query for the existing window
+	window, err := tx.First("maintenance_windows", "id", windowID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed maintenance window lookup: %s", err)
+	}
+	if window != nil {
+		return idx, window.(*structs.MaintenanceWindow), nil
+	}
+	return idx, nil, nil
+}
+
+// MaintenanceWindowList is used to list all of the maintenance windows.
+func (s *StateStore) MaintenanceWindowList() (uint64, structs.MaintenanceWindows, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("MaintenanceWindowList")...)
+
+	windows, err := tx.Get("maintenance_windows", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed maintenance window lookup: %s", err)
+	}
+	var result structs.MaintenanceWindows
+	for window := windows.Next(); window != nil; window = windows.Next() {
+		result = append(result, window.(*structs.MaintenanceWindow))
+	}
+	return idx, result, nil
+}
+
+// MaintenanceWindowDelete is used to remove a maintenance window. If the
+// window does not exist this is a no-op and no error is returned.
+func (s *StateStore) MaintenanceWindowDelete(idx uint64, windowID string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Look up the existing window
+	window, err := tx.First("maintenance_windows", "id", windowID)
+	if err != nil {
+		return fmt.Errorf("failed maintenance window lookup: %s", err)
+	}
+	if window == nil {
+		return nil
+	}
+
+	// Delete the window and update the index
+	if err := tx.Delete("maintenance_windows", window); err != nil {
+		return fmt.Errorf("failed deleting maintenance window: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"maintenance_windows", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	if err := s.unsuppressChecksTxn(tx, idx); err != nil {
+		return err
+	}
+
+	tx.Defer(func() { s.tableWatches["maintenance_windows"].Notify() })
+	tx.Commit()
+	return nil
+}
+
+// MaintenanceWindowSetInEffect is used by the leader to start or end a
+// maintenance window. Ending a window clears the suppression of the checks
+// it covered, unless another window in effect still covers them. If the
+// window does not exist this is a no-op and no error is returned.
+func (s *StateStore) MaintenanceWindowSetInEffect(idx uint64, windowID string, inEffect bool) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Look up the existing window
+	existing, err := tx.First("maintenance_windows", "id", windowID)
+	if err != nil {
+		return fmt.Errorf("failed maintenance window lookup: %s", err)
+	}
+	if existing == nil {
+		return nil
+	}
+
+	// Copy the window, since we can't modify objects that are in the
+	// state store.
+	window := *existing.(*structs.MaintenanceWindow)
+	window.InEffect = inEffect
+	window.ModifyIndex = idx
+	if err := tx.Insert("maintenance_windows", &window); err != nil {
+		return fmt.Errorf("failed inserting maintenance window: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"maintenance_windows", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	if !inEffect {
+		if err := s.unsuppressChecksTxn(tx, idx); err != nil {
+			return err
+		}
+	}
+
+	tx.Defer(func() { s.tableWatches["maintenance_windows"].Notify() })
+	tx.Commit()
+	return nil
+}
+
+// maintenanceWindowsInEffectTxn returns the windows the leader has put
+// into effect, within an existing transaction.
+func (s *StateStore) maintenanceWindowsInEffectTxn(tx *memdb.Txn) (structs.MaintenanceWindows, error) {
+	windows, err := tx.Get("maintenance_windows", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed maintenance window lookup: %s", err)
+	}
+	var result structs.MaintenanceWindows
+	for window := windows.Next(); window != nil; window = windows.Next() {
+		if w := window.(*structs.MaintenanceWindow); w.InEffect {
+			result = append(result, w)
+		}
+	}
+	return result, nil
+}
+
+// suppressCheckTxn works out whether a check being registered is
+// suppressed. A change to a non-passing status is suppressed if a window in
+// effect covers the check, and the mark stays until the check passes again
+// or the window ends.
+func (s *StateStore) suppressCheckTxn(tx *memdb.Txn, existing, hc *structs.HealthCheck) error {
+	switch {
+	case hc.Status == structs.HealthPassing:
+		hc.Suppressed = false
+	case existing != nil && existing.Status == hc.Status:
+		hc.Suppressed = existing.Suppressed
+	default:
+		windows, err := s.maintenanceWindowsInEffectTxn(tx)
+		if err != nil {
+			return err
+		}
+		hc.Suppressed = windows.Covering(hc.Node, hc.ServiceName) != nil
+	}
+	return nil
+}
+
+// unsuppressChecksTxn clears the suppression of every check that is no
+// longer covered by a window in effect, within an existing transaction.
+func (s *StateStore) unsuppressChecksTxn(tx *memdb.Txn, idx uint64) error {
+	windows, err := s.maintenanceWindowsInEffectTxn(tx)
+	if err != nil {
+		return err
+	}
+	checks, err := tx.Get("checks", "id")
+	if err != nil {
+		return fmt.Errorf("failed health check lookup: %s", err)
+	}
+	var cleared []*structs.HealthCheck
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		hc := check.(*structs.HealthCheck)
+		if hc.Suppressed && windows.Covering(hc.Node, hc.ServiceName) == nil {
+			cleared = append(cleared, hc)
+		}
+	}
+	if len(cleared) == 0 {
+		return nil
+	}
+
+	// Update the checks in a separate loop so we don't trash the
+	// iterator. The stored output is carried over as it is.
+	for _, hc := range cleared {
+		check := *hc
+		check.Suppressed = false
+		check.ModifyIndex = idx
+		if err := tx.Insert("checks", &check); err != nil {
+			return fmt.Errorf("failed inserting check: %s", err)
+		}
+	}
+	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["checks"].Notify() })
+	return nil
+}
@@ -0,0 +1,176 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+var (
+	// ErrMissingManagedCheckID is returned when a managed check set is
+	// called without an ID.
+	ErrMissingManagedCheckID = errors.New("Missing managed check ID")
+)
+
+// ManagedChecks is used to pull all the managed checks from the snapshot.
+func (s *StateSnapshot) ManagedChecks() (memdb.ResultIterator, error) {
+	iter, err := s.tx.Get("managed_checks", "id")
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// ManagedCheck is used when restoring from a snapshot. For general
+// inserts, use ManagedCheckSet.
+func (s *StateRestore) ManagedCheck(check *structs.ManagedCheck) error {
+	if err := s.tx.Insert("managed_checks", check); err != nil {
+		return fmt.Errorf("failed restoring managed check: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, check.ModifyIndex, "managed_checks"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("managed_checks")
+	return nil
+}
+
+// ManagedCheckSet is used to insert or update a managed check.
+func (s *StateStore) ManagedCheckSet(idx uint64, check *structs.ManagedCheck) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Check that the ID is set
+	if check.ID == "" {
+		return ErrMissingManagedCheckID
+	}
+
+	// Check for an existing check
+	existing, err := tx.First("managed_checks", "id", check.ID)
+	if err != nil {
+		return fmt.Errorf("failed managed check lookup: %s", err)
+	}
+
+	// Set the indexes
+	if existing != nil {
+		check.CreateIndex = existing.(*structs.ManagedCheck).CreateIndex
+		check.ModifyIndex = idx
+	} else {
+		check.CreateIndex = idx
+		check.ModifyIndex = idx
+	}
+
+	// Insert the check
+	if err := tx.Insert("managed_checks", check); err != nil {
+		return fmt.Errorf("failed inserting managed check: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"managed_checks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["managed_checks"].Notify() })
+	tx.Commit()
+	return nil
+}
+
+// ManagedCheckGet is used to look up a managed check by ID.
+func (s *StateStore) ManagedCheckGet(checkID string) (uint64, *structs.ManagedCheck, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ManagedCheckGet")...)
+
+	// Query for the existing check
+	check, err := tx.First("managed_checks", "id", checkID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed managed check lookup: %s", err)
+	}
+	if check != nil {
+		return idx, check.(*structs.ManagedCheck), nil
+	}
+	return idx, nil, nil
+}
+
+// ManagedCheckList is used to list all of the managed checks.
+func (s *StateStore) ManagedCheckList() (uint64, structs.ManagedChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ManagedCheckList")...)
+
+	checks, err := tx.Get("managed_checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed managed check lookup: %s", err)
+	}
+	var result structs.ManagedChecks
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		result = append(result, check.(*structs.ManagedCheck))
+	}
+	return idx, result, nil
+}
+
+// ManagedChecksForNode returns the managed checks that match the given
+// node's metadata. A node that isn't registered only matches the checks
+// without a selector.
+func (s *StateStore) ManagedChecksForNode(nodeID string) (uint64, structs.ManagedChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ManagedChecksForNode")...)
+
+	// Look up the node's metadata
+	var meta map[string]string
+	node, err := tx.First("nodes", "id", nodeID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node lookup: %s", err)
+	}
+	if node != nil {
+		meta = node.(*structs.Node).Meta
+	}
+
+	checks, err := tx.Get("managed_checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed managed check lookup: %s", err)
+	}
+	var result structs.ManagedChecks
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		if c := check.(*structs.ManagedCheck); c.Matches(meta) {
+			result = append(result, c)
+		}
+	}
+	return idx, result, nil
+}
+
+// ManagedCheckDelete is used to remove a managed check. If the check does
+// not exist this is a no-op and no error is returned.
+func (s *StateStore) ManagedCheckDelete(idx uint64, checkID string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Look up the existing check
+	check, err := tx.First("managed_checks", "id", checkID)
+	if err != nil {
+		return fmt.Errorf("failed managed check lookup: %s", err)
+	}
+	if check == nil {
+		return nil
+	}
+
+	// Delete the check and update the index
+	if err := tx.Delete("managed_checks", check); err != nil {
+		return fmt.Errorf("failed deleting managed check: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"managed_checks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["managed_checks"].Notify() })
+	tx.Commit()
+	return nil
+}
@@ -22,14 +22,25 @@ func stateStoreSchema() *memdb.DBSchema {
 	schemas := []schemaFn{
 		indexTableSchema,
 		nodesTableSchema,
+		nodeMetaTableSchema,
 		servicesTableSchema,
 		checksTableSchema,
+		checkOutputsTableSchema,
+		checkHistoryTableSchema,
 		kvsTableSchema,
 		tombstonesTableSchema,
+		kvsRecycleTableSchema,
+		kvsUploadsTableSchema,
+		kvsHistoryTableSchema,
+		kvsUsageTableSchema,
 		sessionsTableSchema,
 		sessionChecksTableSchema,
 		aclsTableSchema,
+		maintenanceWindowsTableSchema,
+		managedChecksTableSchema,
 		coordinatesTableSchema,
+		changeCountersTableSchema,
+		changeFeedTableSchema,
 	}
 
 	// Add the tables to the root schema
@@ -77,6 +88,78 @@ func nodesTableSchema() *memdb.TableSchema {
 					Lowercase: true,
 				},
 			},
+			"uuid": &memdb.IndexSchema{
+				Name:         "uuid",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ID",
+					Lowercase: true,
+				},
+			},
+			"address": &memdb.IndexSchema{
+				Name:         "address",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Address",
+					Lowercase: true,
+				},
+			},
+		},
+	}
+}
+
+// nodeMetaTableSchema returns a new table schema used to look up
+// nodes by their metadata. Each row maps one key/value pair back to
+// the node that has it.
+func nodeMetaTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "node_meta",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{
+							Field:     "Node",
+							Lowercase: true,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "Key",
+							Lowercase: false,
+						},
+					},
+				},
+			},
+			"node": &memdb.IndexSchema{
+				Name:         "node",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Node",
+					Lowercase: true,
+				},
+			},
+			"key_value": &memdb.IndexSchema{
+				Name:         "key_value",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{
+							Field:     "Key",
+							Lowercase: false,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "Value",
+							Lowercase: false,
+						},
+					},
+				},
+			},
 		},
 	}
 }
@@ -122,6 +205,24 @@ func servicesTableSchema() *memdb.TableSchema {
 					Lowercase: true,
 				},
 			},
+			"service_id": &memdb.IndexSchema{
+				Name:         "service_id",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ServiceID",
+					Lowercase: true,
+				},
+			},
+			"address": &memdb.IndexSchema{
+				Name:         "address",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ServiceAddress",
+					Lowercase: true,
+				},
+			},
 		},
 	}
 }
@@ -199,6 +300,74 @@ func checksTableSchema() *memdb.TableSchema {
 	}
 }
 
+// checkOutputsTableSchema returns a new table schema used for
+// interning health check output. Identical output from many
+// checks is kept once here, keyed by a hash of the stored form.
+func checkOutputsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "check_outputs",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ID",
+					Lowercase: false,
+				},
+			},
+		},
+	}
+}
+
+// checkHistoryTableSchema returns a new table schema used for keeping the
+// most recent status transitions of each health check.
+func checkHistoryTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "check_history",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{
+							Field:     "Node",
+							Lowercase: true,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "CheckID",
+							Lowercase: true,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "ID",
+							Lowercase: false,
+						},
+					},
+				},
+			},
+			"check": &memdb.IndexSchema{
+				Name:         "check",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{
+							Field:     "Node",
+							Lowercase: true,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "CheckID",
+							Lowercase: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
 // kvsTableSchema returns a new table schema used for storing
 // key/value data from consul's kv store.
 func kvsTableSchema() *memdb.TableSchema {
@@ -246,6 +415,97 @@ func tombstonesTableSchema() *memdb.TableSchema {
 	}
 }
 
+// kvsRecycleTableSchema returns a new table schema used for holding
+// deleted KV trees in the recycle bin until they expire.
+func kvsRecycleTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "kvs_recycle",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.UUIDFieldIndex{
+					Field: "ID",
+				},
+			},
+		},
+	}
+}
+
+// kvsUploadsTableSchema returns a new table schema used for holding the
+// chunks of large KV values until they are written.
+func kvsUploadsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "kvs_uploads",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.UUIDFieldIndex{
+					Field: "ID",
+				},
+			},
+		},
+	}
+}
+
+// kvsHistoryTableSchema returns a new table schema used for keeping the
+// most recent versions of each key.
+func kvsHistoryTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "kvs_history",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{
+							Field:     "Key",
+							Lowercase: false,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "ID",
+							Lowercase: false,
+						},
+					},
+				},
+			},
+			"key": &memdb.IndexSchema{
+				Name:         "key",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Key",
+					Lowercase: false,
+				},
+			},
+		},
+	}
+}
+
+// kvsUsageTableSchema returns a new table schema used to keep count of
+// how much is stored under each top-level KV prefix.
+func kvsUsageTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "kvs_usage",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ID",
+					Lowercase: false,
+				},
+			},
+		},
+	}
+}
+
 // sessionsTableSchema returns a new TableSchema used for
 // storing session information.
 func sessionsTableSchema() *memdb.TableSchema {
@@ -347,6 +607,44 @@ func aclsTableSchema() *memdb.TableSchema {
 	}
 }
 
+// maintenanceWindowsTableSchema returns a new table schema used to store
+// scheduled maintenance windows.
+func maintenanceWindowsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "maintenance_windows",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ID",
+					Lowercase: false,
+				},
+			},
+		},
+	}
+}
+
+// managedChecksTableSchema returns a new table schema used to store the
+// check definitions the servers hand out to agents.
+func managedChecksTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "managed_checks",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ID",
+					Lowercase: false,
+				},
+			},
+		},
+	}
+}
+
 // coordinatesTableSchema returns a new table schema used for storing
 // network coordinates.
 func coordinatesTableSchema() *memdb.TableSchema {
@@ -365,3 +663,41 @@ func coordinatesTableSchema() *memdb.TableSchema {
 		},
 	}
 }
+
+// changeCountersTableSchema returns a new table schema used for tracking
+// the cumulative number of changes made to each type of object.
+func changeCountersTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "change_counters",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Type",
+					Lowercase: true,
+				},
+			},
+		},
+	}
+}
+
+// changeFeedTableSchema returns a new table schema used to hold the most
+// recent changes to the catalog and KV store, in the order they were made.
+func changeFeedTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "change_feed",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ID",
+					Lowercase: false,
+				},
+			},
+		},
+	}
+}
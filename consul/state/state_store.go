@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
@@ -27,6 +28,14 @@ var (
 	// ErrMissingACLID is returned when a session set is called on
 	// a session with an empty ID.
 	ErrMissingACLID = errors.New("Missing ACL ID")
+
+	// ErrMissingRecycledID is returned when a tree is put in the recycle
+	// bin with an empty ID.
+	ErrMissingRecycledID = errors.New("Missing recycled tree ID")
+
+	// ErrMissingRecycledTree is returned when trying to restore a tree
+	// that isn't in the recycle bin.
+	ErrMissingRecycledTree = errors.New("Recycled tree not found")
 )
 
 // StateStore is where we store all of Consul's state, including
@@ -40,6 +49,11 @@ type StateStore struct {
 	// tableWatches holds all the full table watches, indexed by table name.
 	tableWatches map[string]*FullTableWatch
 
+	// queryWatches caches the watch for each query method, so that every
+	// query for a method is handed the same watch.
+	queryWatches     map[string]Watch
+	queryWatchesLock sync.Mutex
+
 	// kvsWatch holds the special prefix watch for the key value store.
 	kvsWatch *PrefixWatch
 
@@ -48,6 +62,11 @@ type StateStore struct {
 
 	// lockDelay holds expiration times for locks associated with keys.
 	lockDelay *Delay
+
+	// restoring is set while a restore holds the write transaction, so
+	// that rebuilding the tables doesn't add to the change feed. The feed
+	// itself is restored from the snapshot.
+	restoring bool
 }
 
 // StateSnapshot is used to provide a point-in-time snapshot. It
@@ -82,6 +101,34 @@ type sessionCheck struct {
 	Session string
 }
 
+// nodeMeta is used to create a many-to-one table such that each
+// metadata pair on a node can be used to look the node up. This is
+// only used internally in the state store and thus it is not exported.
+type nodeMeta struct {
+	Node  string
+	Key   string
+	Value string
+}
+
+// changeFeedEntry is used to key the change feed by sequence number. The
+// ID is the zero-padded sequence number so that the entries sort in the
+// order they were made. This is only used internally in the state store
+// and thus it is not exported.
+type changeFeedEntry struct {
+	ID    string
+	Entry *structs.ChangeFeedEntry
+}
+
+// changeFeedRetain is the number of the most recent changes kept in the
+// change feed. Readers that fall further behind than this must resync.
+const changeFeedRetain = 4096
+
+// changeFeedID returns the ID of the change feed entry with the given
+// sequence number.
+func changeFeedID(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
 // NewStateStore creates a new in-memory state storage layer.
 func NewStateStore(gc *TombstoneGC) (*StateStore, error) {
 	// Create the in-memory DB.
@@ -106,6 +153,7 @@ func NewStateStore(gc *TombstoneGC) (*StateStore, error) {
 		schema:       schema,
 		db:           db,
 		tableWatches: tableWatches,
+		queryWatches: make(map[string]Watch),
 		kvsWatch:     NewPrefixWatch(),
 		kvsGraveyard: NewGraveyard(gc),
 		lockDelay:    NewDelay(),
@@ -206,11 +254,56 @@ func (s *StateSnapshot) Coordinates() (memdb.ResultIterator, error) {
 	return iter, nil
 }
 
+// KVSRecycled is used to pull all the trees in the KV recycle bin from the
+// snapshot.
+func (s *StateSnapshot) KVSRecycled() (memdb.ResultIterator, error) {
+	iter, err := s.tx.Get("kvs_recycle", "id")
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// KVSUploads is used to pull all the in-progress KV uploads from the
+// snapshot.
+func (s *StateSnapshot) KVSUploads() (memdb.ResultIterator, error) {
+	iter, err := s.tx.Get("kvs_uploads", "id")
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// ChangeCounters is used to pull all the change counters from the snapshot.
+func (s *StateSnapshot) ChangeCounters() (memdb.ResultIterator, error) {
+	iter, err := s.tx.Get("change_counters", "id")
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// ChangeFeed is used to pull the retained change feed entries, oldest
+// first, from the snapshot.
+func (s *StateSnapshot) ChangeFeed() (structs.ChangeFeedEntries, error) {
+	iter, err := s.tx.Get("change_feed", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries structs.ChangeFeedEntries
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		entries = append(entries, entry.(*changeFeedEntry).Entry)
+	}
+	return entries, nil
+}
+
 // Restore is used to efficiently manage restoring a large amount of data into
 // the state store. It works by doing all the restores inside of a single
 // transaction.
 func (s *StateStore) Restore() *StateRestore {
 	tx := s.db.Txn(true)
+	s.restoring = true
 	watches := NewDumbWatchManager(s.tableWatches)
 	return &StateRestore{s, tx, watches}
 }
@@ -218,6 +311,7 @@ func (s *StateStore) Restore() *StateRestore {
 // Abort abandons the changes made by a restore. This or Commit should always be
 // called.
 func (s *StateRestore) Abort() {
+	s.store.restoring = false
 	s.tx.Abort()
 }
 
@@ -229,6 +323,7 @@ func (s *StateRestore) Commit() {
 	s.tx.Defer(func() { s.store.kvsWatch.Notify("", true) })
 	s.tx.Defer(func() { s.watches.Notify() })
 
+	s.store.restoring = false
 	s.tx.Commit()
 }
 
@@ -247,6 +342,9 @@ func (s *StateRestore) KVS(entry *structs.DirEntry) error {
 	if err := s.tx.Insert("kvs", entry); err != nil {
 		return fmt.Errorf("failed inserting kvs entry: %s", err)
 	}
+	if err := s.store.kvsUsageTxn(s.tx, entry.Key, 1, kvsEntrySize(entry)); err != nil {
+		return err
+	}
 
 	if err := indexUpdateMaxTxn(s.tx, entry.ModifyIndex, "kvs"); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
@@ -309,6 +407,36 @@ func (s *StateRestore) ACL(acl *structs.ACL) error {
 	return nil
 }
 
+// KVSRecycled is used when restoring from a snapshot. For general inserts,
+// use KVSRecycleTree.
+func (s *StateRestore) KVSRecycled(tree *structs.KVSRecycled) error {
+	if err := s.tx.Insert("kvs_recycle", tree); err != nil {
+		return fmt.Errorf("failed restoring recycled tree: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, tree.ModifyIndex, "kvs_recycle"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("kvs_recycle")
+	return nil
+}
+
+// KVSUpload is used when restoring from a snapshot. For general inserts,
+// use KVSUploadChunk.
+func (s *StateRestore) KVSUpload(upload *structs.KVSUpload) error {
+	if err := s.tx.Insert("kvs_uploads", upload); err != nil {
+		return fmt.Errorf("failed restoring upload: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, upload.ModifyIndex, "kvs_uploads"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("kvs_uploads")
+	return nil
+}
+
 // Coordinates is used when restoring from a snapshot. For general inserts, use
 // CoordinateBatchUpdate. We do less vetting of the updates here because they
 // already got checked on the way in during a batch update.
@@ -327,6 +455,40 @@ func (s *StateRestore) Coordinates(idx uint64, updates structs.Coordinates) erro
 	return nil
 }
 
+// ChangeCounter is used when restoring from a snapshot. This replaces any
+// counts that were built up while restoring the other tables, since the
+// snapshot holds the true cumulative values.
+func (s *StateRestore) ChangeCounter(counter *structs.ChangeCounter) error {
+	if err := s.tx.Insert("change_counters", counter); err != nil {
+		return fmt.Errorf("failed restoring change counter: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, counter.ModifyIndex, "change_counters"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("change_counters")
+	return nil
+}
+
+// ChangeFeedEntry is used when restoring from a snapshot. The feed carries
+// on from the newest restored sequence number.
+func (s *StateRestore) ChangeFeedEntry(entry *structs.ChangeFeedEntry) error {
+	if err := s.tx.Insert("change_feed", &changeFeedEntry{changeFeedID(entry.Seq), entry}); err != nil {
+		return fmt.Errorf("failed restoring change feed entry: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, entry.Index, "change_feed"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, entry.Seq, "change_feed_seq"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	s.watches.Arm("change_feed")
+	return nil
+}
+
 // maxIndex is a helper used to retrieve the highest known index
 // amongst a set of tables in the db.
 func (s *StateStore) maxIndex(tables ...string) uint64 {
@@ -383,11 +545,33 @@ func (s *StateStore) ReapTombstones(index uint64) error {
 	if err := s.kvsGraveyard.ReapTxn(tx, index); err != nil {
 		return fmt.Errorf("failed to reap kvs tombstones: %s", err)
 	}
+	if err := s.pruneKVSHistoryTxn(tx, index); err != nil {
+		return err
+	}
 
 	tx.Commit()
 	return nil
 }
 
+// TombstoneCounts returns how many tombstones are being held, in total and
+// by top-level KV prefix.
+func (s *StateStore) TombstoneCounts() (int, map[string]int, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	stones, err := tx.Get("tombstones", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	var total int
+	byPrefix := make(map[string]int)
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		total++
+		byPrefix[kvsTopLevelPrefix(stone.(*Tombstone).Key)]++
+	}
+	return total, byPrefix, nil
+}
+
 // getWatchTables returns the list of tables that should be watched and used for
 // max index calculations for the given query method. This is used for all
 // methods except for KVS. This will panic if the method is unknown.
@@ -397,11 +581,15 @@ func (s *StateStore) getWatchTables(method string) []string {
 		return []string{"nodes"}
 	case "Services":
 		return []string{"services"}
-	case "ServiceNodes", "NodeServices":
+	case "ServiceNodes", "NodeServices", "AddressNodes":
 		return []string{"nodes", "services"}
-	case "NodeChecks", "ServiceChecks", "ChecksInState":
+	case "NodeChecks", "ServiceChecks", "ChecksInState", "ExternalChecks":
 		return []string{"checks"}
-	case "CheckServiceNodes", "NodeInfo", "NodeDump":
+	case "ChecksInStates":
+		return []string{"checks", "services"}
+	case "CheckServiceNodes":
+		return []string{"nodes", "services", "checks", "maintenance_windows"}
+	case "NodeInfo", "NodeDump", "ServiceSummaries", "CatalogDump":
 		return []string{"nodes", "services", "checks"}
 	case "SessionGet", "SessionList", "NodeSessions":
 		return []string{"sessions"}
@@ -409,6 +597,22 @@ func (s *StateStore) getWatchTables(method string) []string {
 		return []string{"acls"}
 	case "Coordinates":
 		return []string{"coordinates"}
+	case "KVSRecycledGet", "KVSRecycledList":
+		return []string{"kvs_recycle"}
+	case "ChangeCounters":
+		return []string{"change_counters"}
+	case "ChangeFeed":
+		return []string{"change_feed"}
+	case "CheckHistory":
+		return []string{"check_history"}
+	case "MaintenanceWindowGet", "MaintenanceWindowList":
+		return []string{"maintenance_windows"}
+	case "ManagedCheckGet", "ManagedCheckList":
+		return []string{"managed_checks"}
+	case "ManagedChecksForNode":
+		return []string{"nodes", "managed_checks"}
+	case "ServiceEvents", "NodeChanges":
+		return []string{"nodes", "services", "checks", "change_feed"}
 	}
 
 	panic(fmt.Sprintf("Unknown method %s", method))
@@ -426,18 +630,30 @@ func (s *StateStore) getTableWatch(table string) Watch {
 
 // GetQueryWatch returns a watch for the given query method. This is
 // used for all methods except for KV; you should call GetKVSWatch instead.
-// This will panic if the method is unknown.
+// This will panic if the method is unknown. The same watch is returned for
+// every call with a given method, so callers can use it to tell whether two
+// queries are waiting on the same set of tables.
 func (s *StateStore) GetQueryWatch(method string) Watch {
-	tables := s.getWatchTables(method)
-	if len(tables) == 1 {
-		return s.getTableWatch(tables[0])
+	s.queryWatchesLock.Lock()
+	defer s.queryWatchesLock.Unlock()
+
+	if watch, ok := s.queryWatches[method]; ok {
+		return watch
 	}
 
-	var watches []Watch
-	for _, table := range tables {
-		watches = append(watches, s.getTableWatch(table))
+	var watch Watch
+	tables := s.getWatchTables(method)
+	if len(tables) == 1 {
+		watch = s.getTableWatch(tables[0])
+	} else {
+		var watches []Watch
+		for _, table := range tables {
+			watches = append(watches, s.getTableWatch(table))
+		}
+		watch = NewMultiWatch(watches...)
 	}
-	return NewMultiWatch(watches...)
+	s.queryWatches[method] = watch
+	return watch
 }
 
 // GetKVSWatch returns a watch for the given prefix in the key value store.
@@ -462,15 +678,55 @@ func (s *StateStore) EnsureRegistration(idx uint64, req *structs.RegisterRequest
 	return nil
 }
 
+// EnsureRegistrations applies a batch of registrations in a single
+// transaction, so either all of them take effect or none do.
+func (s *StateStore) EnsureRegistrations(idx uint64, reqs []*structs.RegisterRequest) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	watches := NewDumbWatchManager(s.tableWatches)
+	for _, req := range reqs {
+		if err := s.ensureRegistrationTxn(tx, idx, watches, req); err != nil {
+			return err
+		}
+	}
+
+	tx.Defer(func() { watches.Notify() })
+	tx.Commit()
+	return nil
+}
+
 // ensureRegistrationTxn is used to make sure a node, service, and check
 // registration is performed within a single transaction to avoid race
 // conditions on state updates.
 func (s *StateStore) ensureRegistrationTxn(tx *memdb.Txn, idx uint64, watches *DumbWatchManager,
 	req *structs.RegisterRequest) error {
-	// Add the node.
-	node := &structs.Node{Node: req.Node, Address: req.Address}
-	if err := s.ensureNodeTxn(tx, idx, watches, node); err != nil {
-		return fmt.Errorf("failed inserting node: %s", err)
+	// Add the node. If the request doesn't carry any metadata or tagged
+	// addresses, the node keeps what it already has. Requests that skip
+	// the node update leave an existing node untouched.
+	existing, err := tx.First("nodes", "id", req.Node)
+	if err != nil {
+		return fmt.Errorf("node lookup failed: %s", err)
+	}
+	if existing == nil || !req.SkipNodeUpdate {
+		node := &structs.Node{
+			ID:              req.ID,
+			Node:            req.Node,
+			Address:         req.Address,
+			TaggedAddresses: req.TaggedAddresses,
+			Meta:            req.NodeMeta,
+		}
+		if existing != nil {
+			if req.NodeMeta == nil {
+				node.Meta = existing.(*structs.Node).Meta
+			}
+			if req.TaggedAddresses == nil {
+				node.TaggedAddresses = existing.(*structs.Node).TaggedAddresses
+			}
+		}
+		if err := s.ensureNodeTxn(tx, idx, watches, node); err != nil {
+			return fmt.Errorf("failed inserting node: %s", err)
+		}
 	}
 
 	// Add the service, if any.
@@ -522,15 +778,58 @@ func (s *StateStore) ensureNodeTxn(tx *memdb.Txn, idx uint64, watches *DumbWatch
 		return fmt.Errorf("node lookup failed: %s", err)
 	}
 
+	// Registrations that don't give a node ID keep the one the node has.
+	// A name can't be claimed by a node with a different ID, but a node
+	// without an ID yet takes on the first one it's registered with.
+	if existing != nil {
+		existingID := existing.(*structs.Node).ID
+		if node.ID == "" {
+			node.ID = existingID
+		} else if existingID != "" && !strings.EqualFold(existingID, node.ID) {
+			return fmt.Errorf("node name %q is in use by node ID %q", node.Node, existingID)
+		}
+	}
+
+	// If the ID belongs to a node with another name, the node is being
+	// renamed. It keeps its metadata and addresses unless new ones are
+	// given.
+	var renamed *structs.Node
+	if node.ID != "" {
+		other, err := tx.First("nodes", "uuid", node.ID)
+		if err != nil {
+			return fmt.Errorf("node lookup failed: %s", err)
+		}
+		if other != nil && !strings.EqualFold(other.(*structs.Node).Node, node.Node) {
+			renamed = other.(*structs.Node)
+			if node.Meta == nil {
+				node.Meta = renamed.Meta
+			}
+			if node.TaggedAddresses == nil {
+				node.TaggedAddresses = renamed.TaggedAddresses
+			}
+		}
+	}
+
 	// Get the indexes
 	if existing != nil {
 		node.CreateIndex = existing.(*structs.Node).CreateIndex
 		node.ModifyIndex = idx
+	} else if renamed != nil {
+		node.CreateIndex = renamed.CreateIndex
+		node.ModifyIndex = idx
 	} else {
 		node.CreateIndex = idx
 		node.ModifyIndex = idx
 	}
 
+	// Move the old name's registrations over before the new entry takes
+	// its ID.
+	if renamed != nil {
+		if err := s.renameNodeTxn(tx, idx, watches, renamed, node); err != nil {
+			return err
+		}
+	}
+
 	// Insert the node and update the index
 	if err := tx.Insert("nodes", node); err != nil {
 		return fmt.Errorf("failed inserting node: %s", err)
@@ -539,10 +838,95 @@ func (s *StateStore) ensureNodeTxn(tx *memdb.Txn, idx uint64, watches *DumbWatch
 		return fmt.Errorf("failed updating index: %s", err)
 	}
 
+	// Replace the metadata mappings.
+	if err := s.deleteNodeMetaTxn(tx, node.Node); err != nil {
+		return err
+	}
+	for key, value := range node.Meta {
+		mapping := &nodeMeta{
+			Node:  node.Node,
+			Key:   key,
+			Value: value,
+		}
+		if err := tx.Insert("node_meta", mapping); err != nil {
+			return fmt.Errorf("failed inserting node meta mapping: %s", err)
+		}
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedNodes, structs.ChangeFeedSet, "", node.Node, ""); err != nil {
+		return err
+	}
+
 	watches.Arm("nodes")
 	return nil
 }
 
+// renameNodeTxn moves the services and checks registered under a node's old
+// name over to its new one, and then removes the old name. Anything already
+// registered under the new name is kept as-is. Sessions held under the old
+// name are invalidated, as they are when a node is deregistered.
+func (s *StateStore) renameNodeTxn(tx *memdb.Txn, idx uint64, watches *DumbWatchManager,
+	from, to *structs.Node) error {
+	// Register the new name first so there's somewhere to move things to.
+	// It gets the ID once the old name is gone.
+	entry := *to
+	entry.ID = ""
+	if err := tx.Insert("nodes", &entry); err != nil {
+		return fmt.Errorf("failed inserting node: %s", err)
+	}
+
+	// Gather up the services and checks before we change anything.
+	services, err := tx.Get("services", "node", from.Node)
+	if err != nil {
+		return fmt.Errorf("failed service lookup: %s", err)
+	}
+	var moveServices []*structs.NodeService
+	for service := services.Next(); service != nil; service = services.Next() {
+		moveServices = append(moveServices, service.(*structs.ServiceNode).ToNodeService())
+	}
+	checks, err := tx.Get("checks", "node", from.Node)
+	if err != nil {
+		return fmt.Errorf("failed check lookup: %s", err)
+	}
+	var moveChecks []*structs.HealthCheck
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		hc, err := exportCheck(check.(*structs.HealthCheck))
+		if err != nil {
+			return err
+		}
+		moveChecks = append(moveChecks, hc)
+	}
+
+	for _, svc := range moveServices {
+		existing, err := tx.First("services", "id", to.Node, svc.ID)
+		if err != nil {
+			return fmt.Errorf("failed service lookup: %s", err)
+		}
+		if existing != nil {
+			continue
+		}
+		if err := s.ensureServiceTxn(tx, idx, watches, to.Node, svc); err != nil {
+			return err
+		}
+	}
+	for _, hc := range moveChecks {
+		existing, err := tx.First("checks", "id", to.Node, hc.CheckID)
+		if err != nil {
+			return fmt.Errorf("failed health check lookup: %s", err)
+		}
+		if existing != nil {
+			continue
+		}
+		check := *hc
+		check.Node = to.Node
+		if err := s.ensureCheckTxn(tx, idx, watches, &check); err != nil {
+			return err
+		}
+	}
+
+	// Clean up what's left under the old name.
+	return s.deleteNodeTxn(tx, idx, from.Node)
+}
+
 // GetNode is used to retrieve a node registration by node ID.
 func (s *StateStore) GetNode(id string) (uint64, *structs.Node, error) {
 	tx := s.db.Txn(false)
@@ -562,6 +946,25 @@ func (s *StateStore) GetNode(id string) (uint64, *structs.Node, error) {
 	return idx, nil, nil
 }
 
+// GetNodeID is used to retrieve a node registration by its stable ID.
+func (s *StateStore) GetNodeID(id string) (uint64, *structs.Node, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("GetNode")...)
+
+	// Retrieve the node from the state store
+	node, err := tx.First("nodes", "uuid", id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("node lookup failed: %s", err)
+	}
+	if node != nil {
+		return idx, node.(*structs.Node), nil
+	}
+	return idx, nil, nil
+}
+
 // Nodes is used to return all of the known nodes.
 func (s *StateStore) Nodes() (uint64, structs.Nodes, error) {
 	tx := s.db.Txn(false)
@@ -671,6 +1074,12 @@ func (s *StateStore) deleteNodeTxn(tx *memdb.Txn, idx uint64, nodeID string) err
 	if err := tx.Insert("index", &IndexEntry{"nodes", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.deleteNodeMetaTxn(tx, nodeID); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedNodes, structs.ChangeFeedDelete, "", nodeID, ""); err != nil {
+		return err
+	}
 
 	// Invalidate any sessions for this node.
 	sessions, err := tx.Get("sessions", "node", nodeID)
@@ -694,6 +1103,67 @@ func (s *StateStore) deleteNodeTxn(tx *memdb.Txn, idx uint64, nodeID string) err
 	return nil
 }
 
+// deleteNodeMetaTxn removes all of the metadata mappings for the given
+// node within an existing transaction.
+func (s *StateStore) deleteNodeMetaTxn(tx *memdb.Txn, nodeID string) error {
+	mappings, err := tx.Get("node_meta", "node", nodeID)
+	if err != nil {
+		return fmt.Errorf("failed node meta lookup: %s", err)
+	}
+	var objs []interface{}
+	for mapping := mappings.Next(); mapping != nil; mapping = mappings.Next() {
+		objs = append(objs, mapping)
+	}
+
+	// Do the delete in a separate loop so we don't trash the iterator.
+	for _, obj := range objs {
+		if err := tx.Delete("node_meta", obj); err != nil {
+			return fmt.Errorf("failed deleting node meta mapping: %s", err)
+		}
+	}
+	return nil
+}
+
+// NodesByMeta is used to return the nodes whose metadata has every one
+// of the given key/value pairs.
+func (s *StateStore) NodesByMeta(filters map[string]string) (uint64, structs.Nodes, error) {
+	if len(filters) == 0 {
+		return s.Nodes()
+	}
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("Nodes")...)
+
+	// Use the index to find the nodes with one of the pairs, and then
+	// check the rest of them against each node.
+	var key, value string
+	for key, value = range filters {
+		break
+	}
+	mappings, err := tx.Get("node_meta", "key_value", key, value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node meta lookup: %s", err)
+	}
+	var results structs.Nodes
+	for mapping := mappings.Next(); mapping != nil; mapping = mappings.Next() {
+		node, err := tx.First("nodes", "id", mapping.(*nodeMeta).Node)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed node lookup: %s", err)
+		}
+		if node == nil {
+			continue
+		}
+		n := node.(*structs.Node)
+		if structs.SatisfiesMetaFilters(n.Meta, filters) {
+			results = append(results, n)
+		}
+	}
+	return idx, results, nil
+}
+
 // EnsureService is called to upsert creation of a given NodeService.
 func (s *StateStore) EnsureService(idx uint64, node string, svc *structs.NodeService) error {
 	tx := s.db.Txn(true)
@@ -726,6 +1196,11 @@ func (s *StateStore) ensureServiceTxn(tx *memdb.Txn, idx uint64, watches *DumbWa
 	if existing != nil {
 		entry.CreateIndex = existing.(*structs.ServiceNode).CreateIndex
 		entry.ModifyIndex = idx
+
+		// Keep the time the instance was first registered across updates.
+		if registered := existing.(*structs.ServiceNode).ServiceRegisteredAt; !registered.IsZero() {
+			entry.ServiceRegisteredAt = registered
+		}
 	} else {
 		entry.CreateIndex = idx
 		entry.ModifyIndex = idx
@@ -747,23 +1222,74 @@ func (s *StateStore) ensureServiceTxn(tx *memdb.Txn, idx uint64, watches *DumbWa
 	if err := tx.Insert("index", &IndexEntry{"services", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	op := changeCreate
+	if existing != nil {
+		op = changeUpdate
+	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterServices, op, 1); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedServices, structs.ChangeFeedSet, node, svc.ID, svc.Service); err != nil {
+		return err
+	}
 
 	watches.Arm("services")
 	return nil
 }
 
-// Services returns all services along with a list of associated tags.
-func (s *StateStore) Services() (uint64, structs.Services, error) {
-	tx := s.db.Txn(false)
+// SetServiceDraining marks a service instance as draining, or puts it back
+// into service. The rest of the registration is left alone.
+func (s *StateStore) SetServiceDraining(idx uint64, node, serviceID string, draining bool) error {
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	// Get the table index.
-	idx := maxIndexTxn(tx, s.getWatchTables("Services")...)
-
-	// List all the services.
-	services, err := tx.Get("services", "id")
+	existing, err := tx.First("services", "id", node, serviceID)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed querying services: %s", err)
+		return fmt.Errorf("failed service lookup: %s", err)
+	}
+	if existing == nil {
+		return ErrMissingService
+	}
+
+	entry := existing.(*structs.ServiceNode).Clone()
+	if entry.ServiceDraining == draining {
+		return nil
+	}
+	entry.ServiceDraining = draining
+	entry.ModifyIndex = idx
+
+	watches := NewDumbWatchManager(s.tableWatches)
+	if err := tx.Insert("services", entry); err != nil {
+		return fmt.Errorf("failed inserting service: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"services", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterServices, changeUpdate, 1); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedServices, structs.ChangeFeedSet, node, serviceID, entry.ServiceName); err != nil {
+		return err
+	}
+	watches.Arm("services")
+
+	tx.Defer(func() { watches.Notify() })
+	tx.Commit()
+	return nil
+}
+
+// Services returns all services along with a list of associated tags.
+func (s *StateStore) Services() (uint64, structs.Services, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("Services")...)
+
+	// List all the services.
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed querying services: %s", err)
 	}
 
 	// Rip through the services and enumerate them and their unique set of
@@ -792,6 +1318,152 @@ func (s *StateStore) Services() (uint64, structs.Services, error) {
 	return idx, results, nil
 }
 
+// ServiceIDNodes returns the instances registered with the given service ID
+// on any node.
+func (s *StateStore) ServiceIDNodes(serviceID string) (uint64, structs.ServiceNodes, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ServiceNodes")...)
+
+	// List the instances with the ID.
+	services, err := tx.Get("services", "service_id", serviceID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+	var results structs.ServiceNodes
+	for service := services.Next(); service != nil; service = services.Next() {
+		results = append(results, service.(*structs.ServiceNode))
+	}
+	return idx, results, nil
+}
+
+// AddressNodes returns the nodes registered with the given address, and
+// the service instances that advertise it as their own service address.
+func (s *StateStore) AddressNodes(addr string) (uint64, structs.Nodes, structs.ServiceNodes, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("AddressNodes")...)
+
+	// Find the nodes at the address.
+	nodes, err := tx.Get("nodes", "address", addr)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed nodes lookup: %s", err)
+	}
+	var results structs.Nodes
+	for node := nodes.Next(); node != nil; node = nodes.Next() {
+		results = append(results, node.(*structs.Node))
+	}
+
+	// Find the services at the address.
+	services, err := tx.Get("services", "address", addr)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+	var serviceNodes structs.ServiceNodes
+	for service := services.Next(); service != nil; service = services.Next() {
+		serviceNodes = append(serviceNodes, service.(*structs.ServiceNode))
+	}
+	serviceNodes, err = s.parseServiceNodes(tx, serviceNodes)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return idx, results, serviceNodes, nil
+}
+
+// ServiceSummaries returns a summary of each registered service, with its
+// tags and how many of its instances are in each health state. An instance's
+// state is the worst of its node's checks and its own checks.
+func (s *StateStore) ServiceSummaries() (uint64, structs.ServiceSummaries, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ServiceSummaries")...)
+
+	// Work out the worst check status for each node and for each service
+	// instance up front, so we only make one pass over the checks.
+	checks, err := tx.Get("checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	nodeStatus := make(map[string]string)
+	serviceStatus := make(map[string]map[string]string)
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		hc := check.(*structs.HealthCheck)
+		if hc.ServiceID == "" {
+			nodeStatus[hc.Node] = worseHealth(nodeStatus[hc.Node], hc.Status)
+			continue
+		}
+		statuses, ok := serviceStatus[hc.Node]
+		if !ok {
+			statuses = make(map[string]string)
+			serviceStatus[hc.Node] = statuses
+		}
+		statuses[hc.ServiceID] = worseHealth(statuses[hc.ServiceID], hc.Status)
+	}
+
+	// Rip through the services and tally up their instances.
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed querying services: %s", err)
+	}
+	results := make(structs.ServiceSummaries)
+	tags := make(map[string]map[string]struct{})
+	for service := services.Next(); service != nil; service = services.Next() {
+		svc := service.(*structs.ServiceNode)
+		summary, ok := results[svc.ServiceName]
+		if !ok {
+			summary = &structs.ServiceSummary{Tags: make([]string, 0)}
+			results[svc.ServiceName] = summary
+			tags[svc.ServiceName] = make(map[string]struct{})
+		}
+		for _, tag := range svc.ServiceTags {
+			if _, ok := tags[svc.ServiceName][tag]; !ok {
+				tags[svc.ServiceName][tag] = struct{}{}
+				summary.Tags = append(summary.Tags, tag)
+			}
+		}
+
+		summary.Instances++
+		status := worseHealth(nodeStatus[svc.Node], serviceStatus[svc.Node][svc.ServiceID])
+		switch status {
+		case "", structs.HealthPassing:
+			summary.Passing++
+		case structs.HealthWarning:
+			summary.Warning++
+		default:
+			summary.Critical++
+		}
+	}
+	return idx, results, nil
+}
+
+// worseHealth returns whichever of the given check statuses is worse. An
+// empty status means there's nothing to go on, and anything we don't know
+// about counts as critical.
+func worseHealth(a, b string) string {
+	rank := func(status string) int {
+		switch status {
+		case "":
+			return 0
+		case structs.HealthPassing:
+			return 1
+		case structs.HealthWarning:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
 // ServiceNodes returns the nodes associated with a given service name.
 func (s *StateStore) ServiceNodes(serviceName string) (uint64, structs.ServiceNodes, error) {
 	tx := s.db.Txn(false)
@@ -876,12 +1548,15 @@ func (s *StateStore) parseServiceNodes(tx *memdb.Txn, services structs.ServiceNo
 		// which is what we are referencing.
 		s := sn.Clone()
 
-		// Fill in the address of the node.
+		// Fill in the addresses and metadata of the node.
 		n, err := tx.First("nodes", "id", sn.Node)
 		if err != nil {
 			return nil, fmt.Errorf("failed node lookup: %s", err)
 		}
-		s.Address = n.(*structs.Node).Address
+		node := n.(*structs.Node)
+		s.Address = node.Address
+		s.TaggedAddresses = node.TaggedAddresses
+		s.NodeMeta = node.Meta
 		results = append(results, s)
 	}
 	return results, nil
@@ -984,11 +1659,68 @@ func (s *StateStore) deleteServiceTxn(tx *memdb.Txn, idx uint64, watches *DumbWa
 	if err := tx.Insert("index", &IndexEntry{"services", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterServices, changeDelete, 1); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedServices, structs.ChangeFeedDelete, nodeID, serviceID,
+		service.(*structs.ServiceNode).ServiceName); err != nil {
+		return err
+	}
 
 	watches.Arm("services")
 	return nil
 }
 
+// ExpiredServices returns the services whose registrations expired before
+// the given time.
+func (s *StateStore) ExpiredServices(now time.Time) (structs.ServiceNodes, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	return s.expiredServicesTxn(tx, now)
+}
+
+// expiredServicesTxn returns the expired services within an existing
+// transaction.
+func (s *StateStore) expiredServicesTxn(tx *memdb.Txn, now time.Time) (structs.ServiceNodes, error) {
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+
+	var result structs.ServiceNodes
+	for service := services.Next(); service != nil; service = services.Next() {
+		sn := service.(*structs.ServiceNode)
+		if !sn.ServiceExpiresAt.IsZero() && sn.ServiceExpiresAt.Before(now) {
+			result = append(result, sn)
+		}
+	}
+	return result, nil
+}
+
+// ReapExpiredServices deletes every service, along with its checks, whose
+// registration expired before the reap time.
+func (s *StateStore) ReapExpiredServices(idx uint64, reapTime time.Time) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Find the expired services first so we don't trash the iterator.
+	expired, err := s.expiredServicesTxn(tx, reapTime)
+	if err != nil {
+		return err
+	}
+	watches := NewDumbWatchManager(s.tableWatches)
+	for _, sn := range expired {
+		if err := s.deleteServiceTxn(tx, idx, watches, sn.Node, sn.ServiceID); err != nil {
+			return err
+		}
+	}
+
+	tx.Defer(func() { watches.Notify() })
+	tx.Commit()
+	return nil
+}
+
 // EnsureCheck is used to store a check registration in the db.
 func (s *StateStore) EnsureCheck(idx uint64, hc *structs.HealthCheck) error {
 	tx := s.db.Txn(true)
@@ -1054,6 +1786,18 @@ func (s *StateStore) ensureCheckTxn(tx *memdb.Txn, idx uint64, watches *DumbWatc
 		hc.ServiceName = service.(*structs.ServiceNode).ServiceName
 	}
 
+	// Work out if the check is suppressed by a maintenance window.
+	// Snapshots already carry it, so it's kept as-is during a restore.
+	var prev *structs.HealthCheck
+	if existing != nil {
+		prev = existing.(*structs.HealthCheck)
+	}
+	if !s.restoring {
+		if err := s.suppressCheckTxn(tx, prev, hc); err != nil {
+			return err
+		}
+	}
+
 	// Delete any sessions for this check if the health is critical.
 	if hc.Status == structs.HealthCritical {
 		mappings, err := tx.Get("session_checks", "node_check", hc.Node, hc.CheckID)
@@ -1077,13 +1821,38 @@ func (s *StateStore) ensureCheckTxn(tx *memdb.Txn, idx uint64, watches *DumbWatc
 		tx.Defer(func() { watches.Notify() })
 	}
 
+	// Store the output compressed and interned, so verbose output that
+	// many checks share is only held once. Snapshots already carry the
+	// stored form, so it's kept as-is during a restore.
+	stored := hc.Output
+	if !s.restoring {
+		stored = encodeCheckOutput(hc.Output)
+	}
+	stored, err = s.internCheckOutputTxn(tx, stored)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if err := s.releaseCheckOutputTxn(tx, existing.(*structs.HealthCheck).Output); err != nil {
+			return err
+		}
+	}
+
 	// Persist the check registration in the db.
-	if err := tx.Insert("checks", hc); err != nil {
+	check := *hc
+	check.Output = stored
+	if err := tx.Insert("checks", &check); err != nil {
 		return fmt.Errorf("failed inserting check: %s", err)
 	}
 	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedChecks, structs.ChangeFeedSet, hc.Node, hc.CheckID, hc.ServiceName); err != nil {
+		return err
+	}
+	if err := s.recordCheckTransitionTxn(tx, idx, prev, &check); err != nil {
+		return err
+	}
 
 	watches.Arm("checks")
 	return nil
@@ -1150,13 +1919,111 @@ func (s *StateStore) ChecksInState(state string) (uint64, structs.HealthChecks,
 	return s.parseChecks(idx, checks)
 }
 
+// ChecksInStates returns the checks in any of the given states. If a
+// service name is given, only that service's checks are returned, and if
+// tagFilter is set, only those of its instances that have the given tag.
+func (s *StateStore) ChecksInStates(states []string, serviceName string,
+	tagFilter bool, tag string) (uint64, structs.HealthChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ChecksInStates")...)
+
+	wanted := make(map[string]bool, len(states))
+	for _, state := range states {
+		wanted[state] = true
+	}
+
+	// Walk the service's checks when there is one, otherwise walk the
+	// checks in each state using the status index.
+	var iters []memdb.ResultIterator
+	switch {
+	case serviceName != "":
+		iter, err := tx.Get("checks", "service", serviceName)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+		}
+		iters = append(iters, iter)
+	case wanted[structs.HealthAny]:
+		iter, err := tx.Get("checks", "status")
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+		}
+		iters = append(iters, iter)
+	default:
+		seen := make(map[string]bool, len(states))
+		for _, state := range states {
+			if seen[state] {
+				continue
+			}
+			seen[state] = true
+			iter, err := tx.Get("checks", "status", state)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+			}
+			iters = append(iters, iter)
+		}
+	}
+
+	var results structs.HealthChecks
+	for _, iter := range iters {
+		for check := iter.Next(); check != nil; check = iter.Next() {
+			hc := check.(*structs.HealthCheck)
+			if serviceName != "" && !wanted[structs.HealthAny] && !wanted[hc.Status] {
+				continue
+			}
+			if tagFilter {
+				service, err := tx.First("services", "id", hc.Node, hc.ServiceID)
+				if err != nil {
+					return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+				}
+				if service == nil || serviceTagFilter(service.(*structs.ServiceNode), tag) {
+					continue
+				}
+			}
+			exported, err := exportCheck(hc)
+			if err != nil {
+				return 0, nil, err
+			}
+			results = append(results, exported)
+		}
+	}
+	return idx, results, nil
+}
+
+// ExternalChecks returns all the checks with an external check definition.
+func (s *StateStore) ExternalChecks() (uint64, structs.HealthChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ExternalChecks")...)
+
+	checks, err := tx.Get("checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	var results structs.HealthChecks
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		if c := check.(*structs.HealthCheck); c.External != nil {
+			results = append(results, c)
+		}
+	}
+	return idx, results, nil
+}
+
 // parseChecks is a helper function used to deduplicate some
 // repetitive code for returning health checks.
 func (s *StateStore) parseChecks(idx uint64, iter memdb.ResultIterator) (uint64, structs.HealthChecks, error) {
 	// Gather the health checks and return them properly type casted.
 	var results structs.HealthChecks
 	for check := iter.Next(); check != nil; check = iter.Next() {
-		results = append(results, check.(*structs.HealthCheck))
+		hc, err := exportCheck(check.(*structs.HealthCheck))
+		if err != nil {
+			return 0, nil, err
+		}
+		results = append(results, hc)
 	}
 	return idx, results, nil
 }
@@ -1193,9 +2060,19 @@ func (s *StateStore) deleteCheckTxn(tx *memdb.Txn, idx uint64, watches *DumbWatc
 	if err := tx.Delete("checks", hc); err != nil {
 		return fmt.Errorf("failed removing check: %s", err)
 	}
+	if err := s.releaseCheckOutputTxn(tx, hc.(*structs.HealthCheck).Output); err != nil {
+		return err
+	}
 	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedChecks, structs.ChangeFeedDelete, node, id,
+		hc.(*structs.HealthCheck).ServiceName); err != nil {
+		return err
+	}
+	if err := s.deleteCheckHistoryTxn(tx, idx, node, id); err != nil {
+		return err
+	}
 
 	// Delete any sessions for this check.
 	mappings, err := tx.Get("session_checks", "node_check", node, id)
@@ -1305,6 +2182,10 @@ func (s *StateStore) parseCheckServiceNodes(
 		for check := iter.Next(); check != nil; check = iter.Next() {
 			hc := check.(*structs.HealthCheck)
 			if hc.ServiceID == "" || hc.ServiceID == sn.ServiceID {
+				hc, err := exportCheck(hc)
+				if err != nil {
+					return 0, nil, err
+				}
 				checks = append(checks, hc)
 			}
 		}
@@ -1355,6 +2236,47 @@ func (s *StateStore) NodeDump() (uint64, structs.NodeDump, error) {
 	return s.parseNodes(tx, idx, nodes)
 }
 
+// CatalogDump returns every node, service instance, and health check in
+// the catalog, all read in the same transaction so they are consistent
+// with each other and with the returned index.
+func (s *StateStore) CatalogDump() (uint64, *structs.CatalogDump, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("CatalogDump")...)
+
+	dump := &structs.CatalogDump{}
+	nodes, err := tx.Get("nodes", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node lookup: %s", err)
+	}
+	for node := nodes.Next(); node != nil; node = nodes.Next() {
+		dump.Nodes = append(dump.Nodes, node.(*structs.Node))
+	}
+
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed services lookup: %s", err)
+	}
+	var results structs.ServiceNodes
+	for service := services.Next(); service != nil; service = services.Next() {
+		results = append(results, service.(*structs.ServiceNode))
+	}
+	if dump.Services, err = s.parseServiceNodes(tx, results); err != nil {
+		return 0, nil, err
+	}
+
+	checks, err := tx.Get("checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	if _, dump.Checks, err = s.parseChecks(idx, checks); err != nil {
+		return 0, nil, err
+	}
+	return idx, dump, nil
+}
+
 // parseNodes takes an iterator over a set of nodes and returns a struct
 // containing the nodes along with all of their associated services
 // and/or health checks.
@@ -1387,7 +2309,10 @@ func (s *StateStore) parseNodes(tx *memdb.Txn, idx uint64,
 			return 0, nil, fmt.Errorf("failed node lookup: %s", err)
 		}
 		for check := checks.Next(); check != nil; check = checks.Next() {
-			hc := check.(*structs.HealthCheck)
+			hc, err := exportCheck(check.(*structs.HealthCheck))
+			if err != nil {
+				return 0, nil, err
+			}
 			dump.Checks = append(dump.Checks, hc)
 		}
 
@@ -1441,6 +2366,15 @@ func (s *StateStore) kvsSetTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntr
 		}
 	}
 
+	// Count the change in size towards the usage of the key's prefix.
+	keys, bytes := 1, kvsEntrySize(entry)
+	if existing != nil {
+		keys, bytes = 0, bytes-kvsEntrySize(existing.(*structs.DirEntry))
+	}
+	if err := s.kvsUsageTxn(tx, entry.Key, keys, bytes); err != nil {
+		return err
+	}
+
 	// Store the kv pair in the state store and update the index.
 	if err := tx.Insert("kvs", entry); err != nil {
 		return fmt.Errorf("failed inserting kvs entry: %s", err)
@@ -1448,7 +2382,20 @@ func (s *StateStore) kvsSetTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntr
 	if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
-
+	op := changeCreate
+	if existing != nil {
+		op = changeUpdate
+	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterKVS, op, 1); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedKVS, structs.ChangeFeedSet, "", entry.Key, ""); err != nil {
+		return err
+	}
+	if err := s.recordKVSVersionTxn(tx, idx, entry); err != nil {
+		return err
+	}
+
 	tx.Defer(func() { s.kvsWatch.Notify(entry.Key, false) })
 	return nil
 }
@@ -1522,11 +2469,49 @@ func (s *StateStore) KVSList(prefix string) (uint64, structs.DirEntries, error)
 	return idx, ents, nil
 }
 
+// kvsTreeIndexTxn returns the index of the tree under the given prefix,
+// which is the highest ModifyIndex of the keys under it, counting deleted
+// keys whose tombstones haven't been reaped. It's zero if there's nothing
+// under the prefix, and otherwise matches the index of a list of the
+// prefix.
+func (s *StateStore) kvsTreeIndexTxn(tx *memdb.Txn, prefix string) (uint64, error) {
+	// The whole store's index is just the table index.
+	if prefix == "" {
+		return maxIndexTxn(tx, "kvs", "tombstones"), nil
+	}
+
+	entries, err := tx.Get("kvs", "id_prefix", prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed kvs lookup: %s", err)
+	}
+	var lindex uint64
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		if e := entry.(*structs.DirEntry); e.ModifyIndex > lindex {
+			lindex = e.ModifyIndex
+		}
+	}
+	gindex, err := s.kvsGraveyard.GetMaxIndexTxn(tx, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed graveyard lookup: %s", err)
+	}
+	if gindex > lindex {
+		lindex = gindex
+	}
+	return lindex, nil
+}
+
 // KVSListKeys is used to query the KV store for keys matching the given prefix.
 // An optional separator may be specified, which can be used to slice off a part
 // of the response so that only a subset of the prefix is returned. In this
 // mode, the keys which are omitted are still counted in the returned index.
 func (s *StateStore) KVSListKeys(prefix, sep string) (uint64, []string, error) {
+	return s.KVSListKeysDepth(prefix, sep, 1)
+}
+
+// KVSListKeysDepth is like KVSListKeys, but keys are only sliced off at the
+// depth'th separator after the prefix, so that many levels of the tree are
+// returned. A depth of zero is the same as one.
+func (s *StateStore) KVSListKeysDepth(prefix, sep string, depth int) (uint64, []string, error) {
 	tx := s.db.Txn(false)
 	defer tx.Abort()
 
@@ -1541,6 +2526,9 @@ func (s *StateStore) KVSListKeys(prefix, sep string) (uint64, []string, error) {
 
 	prefixLen := len(prefix)
 	sepLen := len(sep)
+	if depth < 1 {
+		depth = 1
+	}
 
 	var keys []string
 	var lindex uint64
@@ -1562,9 +2550,17 @@ func (s *StateStore) KVSListKeys(prefix, sep string) (uint64, []string, error) {
 		// Parse and de-duplicate the returned keys based on the
 		// key separator, if provided.
 		after := e.Key[prefixLen:]
-		sepIdx := strings.Index(after, sep)
-		if sepIdx > -1 {
-			key := e.Key[:prefixLen+sepIdx+sepLen]
+		end := 0
+		for n := 0; n < depth; n++ {
+			sepIdx := strings.Index(after[end:], sep)
+			if sepIdx == -1 {
+				end = -1
+				break
+			}
+			end += sepIdx + sepLen
+		}
+		if end > -1 {
+			key := e.Key[:prefixLen+end]
 			if key != last {
 				keys = append(keys, key)
 				last = key
@@ -1632,9 +2628,18 @@ func (s *StateStore) kvsDeleteTxn(tx *memdb.Txn, idx uint64, key string) error {
 	if err := tx.Delete("kvs", entry); err != nil {
 		return fmt.Errorf("failed deleting kvs entry: %s", err)
 	}
+	if err := s.kvsUsageTxn(tx, key, -1, -kvsEntrySize(entry.(*structs.DirEntry))); err != nil {
+		return err
+	}
 	if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterKVS, changeDelete, 1); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedKVS, structs.ChangeFeedDelete, "", key, ""); err != nil {
+		return err
+	}
 
 	tx.Defer(func() { s.kvsWatch.Notify(key, false) })
 	return nil
@@ -1648,6 +2653,18 @@ func (s *StateStore) KVSDeleteCAS(idx, cidx uint64, key string) (bool, error) {
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
+	set, err := s.kvsDeleteCASTxn(tx, idx, cidx, key)
+	if err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return set, nil
+}
+
+// kvsDeleteCASTxn is the inner method that does a CAS delete within an
+// existing transaction.
+func (s *StateStore) kvsDeleteCASTxn(tx *memdb.Txn, idx, cidx uint64, key string) (bool, error) {
 	// Retrieve the existing kvs entry, if any exists.
 	entry, err := tx.First("kvs", "id", key)
 	if err != nil {
@@ -1666,8 +2683,6 @@ func (s *StateStore) KVSDeleteCAS(idx, cidx uint64, key string) (bool, error) {
 	if err := s.kvsDeleteTxn(tx, idx, key); err != nil {
 		return false, err
 	}
-
-	tx.Commit()
 	return true, nil
 }
 
@@ -1679,6 +2694,18 @@ func (s *StateStore) KVSSetCAS(idx uint64, entry *structs.DirEntry) (bool, error
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
+	set, err := s.kvsSetCASTxn(tx, idx, entry)
+	if err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return set, nil
+}
+
+// kvsSetCASTxn is the inner method used to do a CAS inside an existing
+// transaction.
+func (s *StateStore) kvsSetCASTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntry) (bool, error) {
 	// Retrieve the existing entry.
 	existing, err := tx.First("kvs", "id", entry.Key)
 	if err != nil {
@@ -1702,8 +2729,6 @@ func (s *StateStore) KVSSetCAS(idx uint64, entry *structs.DirEntry) (bool, error
 	if err := s.kvsSetTxn(tx, idx, entry, false); err != nil {
 		return false, err
 	}
-
-	tx.Commit()
 	return true, nil
 }
 
@@ -1714,46 +2739,601 @@ func (s *StateStore) KVSDeleteTree(idx uint64, prefix string) error {
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
+	// Perform the actual delete
+	if _, err := s.kvsDeleteTreeTxn(tx, idx, prefix); err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// KVSDeleteTreeCAS is used to do a recursive delete on a key prefix, but
+// only if the index of the tree under it is still the given index, so
+// nothing under it has changed since it was read. Returns a bool
+// indicating if the delete happened.
+func (s *StateStore) KVSDeleteTreeCAS(idx, cidx uint64, prefix string) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	set, err := s.kvsDeleteTreeCASTxn(tx, idx, cidx, prefix)
+	if !set || err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return true, nil
+}
+
+// kvsDeleteTreeCASTxn is the inner method that does a tree delete with
+// check-and-set within an existing transaction.
+func (s *StateStore) kvsDeleteTreeCASTxn(tx *memdb.Txn, idx, cidx uint64, prefix string) (bool, error) {
+	tindex, err := s.kvsTreeIndexTxn(tx, prefix)
+	if err != nil {
+		return false, err
+	}
+	if tindex != cidx {
+		return false, nil
+	}
+
+	if _, err := s.kvsDeleteTreeTxn(tx, idx, prefix); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// kvsDeleteTreeTxn is the inner method used to do a recursive delete on
+// a key prefix within an existing transaction. It returns the entries that
+// were deleted.
+func (s *StateStore) kvsDeleteTreeTxn(tx *memdb.Txn, idx uint64, prefix string) (structs.DirEntries, error) {
 	// Get an iterator over all of the keys with the given prefix.
 	entries, err := tx.Get("kvs", "id_prefix", prefix)
 	if err != nil {
-		return fmt.Errorf("failed kvs lookup: %s", err)
+		return nil, fmt.Errorf("failed kvs lookup: %s", err)
 	}
 
 	// Go over all of the keys and remove them. We call the delete
 	// directly so that we only update the index once. We also add
 	// tombstones as we go.
-	var modified bool
-	var objs []interface{}
+	var deleted structs.DirEntries
 	for entry := entries.Next(); entry != nil; entry = entries.Next() {
 		e := entry.(*structs.DirEntry)
 		if err := s.kvsGraveyard.InsertTxn(tx, e.Key, idx); err != nil {
-			return fmt.Errorf("failed adding to graveyard: %s", err)
+			return nil, fmt.Errorf("failed adding to graveyard: %s", err)
 		}
-		objs = append(objs, entry)
-		modified = true
+		deleted = append(deleted, e)
 	}
 
 	// Do the actual deletes in a separate loop so we don't trash the
 	// iterator as we go.
-	for _, obj := range objs {
-		if err := tx.Delete("kvs", obj); err != nil {
-			return fmt.Errorf("failed deleting kvs entry: %s", err)
+	for _, e := range deleted {
+		if err := tx.Delete("kvs", e); err != nil {
+			return nil, fmt.Errorf("failed deleting kvs entry: %s", err)
+		}
+		if err := s.kvsUsageTxn(tx, e.Key, -1, -kvsEntrySize(e)); err != nil {
+			return nil, err
 		}
 	}
 
 	// Update the index
-	if modified {
+	if len(deleted) > 0 {
 		tx.Defer(func() { s.kvsWatch.Notify(prefix, true) })
 		if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
+			return nil, fmt.Errorf("failed updating index: %s", err)
+		}
+		n := uint64(len(deleted))
+		if err := s.countChangesTxn(tx, idx, structs.ChangeCounterKVS, changeDelete, n); err != nil {
+			return nil, err
+		}
+		if err := s.recordChangeTxn(tx, idx, structs.ChangeFeedKVS, structs.ChangeFeedDeleteTree, "", prefix, ""); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// KVSImport is used to atomically replace the tree under the given prefix
+// with the given entries. Their keys are expected to be under the prefix
+// already. Sessions aren't carried over, so imported keys are unlocked.
+// Entries listed in uploads get their values from those chunked uploads.
+// If a recycled tree is given, the old tree is held in the recycle bin
+// under it rather than purged.
+func (s *StateStore) KVSImport(idx uint64, prefix string, entries structs.DirEntries,
+	uploads map[string]structs.KVSUploadRef, tree *structs.KVSRecycled) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Clear out the old tree, then write the new one.
+	if tree != nil {
+		tree.Prefix = prefix
+		if err := s.kvsRecycleTreeTxn(tx, idx, tree); err != nil {
+			return err
+		}
+	} else if _, err := s.kvsDeleteTreeTxn(tx, idx, prefix); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if upload, ok := uploads[entry.Key]; ok {
+			value, err := s.kvsUploadCompleteTxn(tx, idx, upload.ID, upload.Chunks)
+			if err != nil {
+				return err
+			}
+			entry.Value = value
+		}
+		if err := s.kvsSetTxn(tx, idx, entry, false); err != nil {
+			return err
+		}
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// KVSMove is used to atomically move a key, or every key under a prefix if
+// prefix is set, so that src is replaced by dst. Flags, values and
+// expirations are kept. Returns false without changing anything if there's
+// nothing to move, if any of the keys to move is locked, or if noOverwrite
+// is set and a destination key already exists.
+func (s *StateStore) KVSMove(idx uint64, src, dst string, prefix, noOverwrite bool) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Find the entries to move.
+	var entries structs.DirEntries
+	if prefix {
+		iter, err := tx.Get("kvs", "id_prefix", src)
+		if err != nil {
+			return false, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		for entry := iter.Next(); entry != nil; entry = iter.Next() {
+			entries = append(entries, entry.(*structs.DirEntry))
+		}
+	} else {
+		entry, err := tx.First("kvs", "id", src)
+		if err != nil {
+			return false, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		if entry != nil {
+			entries = append(entries, entry.(*structs.DirEntry))
+		}
+	}
+	if len(entries) == 0 {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
+	}
+
+	// Work out the new entries, checking the destination is free if the
+	// caller asked for that. Locked keys can't be moved out from under
+	// their holders.
+	moved := make(structs.DirEntries, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Session != "" {
+			return false, nil
+		}
+		e := entry.Clone()
+		e.Key = dst + strings.TrimPrefix(entry.Key, src)
+		e.LockIndex = 0
+		if noOverwrite {
+			existing, err := tx.First("kvs", "id", e.Key)
+			if err != nil {
+				return false, fmt.Errorf("failed kvs lookup: %s", err)
+			}
+			if existing != nil {
+				return false, nil
+			}
+		}
+		moved = append(moved, e)
+	}
+
+	// Delete everything first, since the source and destination may
+	// overlap.
+	for _, entry := range entries {
+		if err := s.kvsDeleteTxn(tx, idx, entry.Key); err != nil {
+			return false, err
+		}
+	}
+	for _, entry := range moved {
+		if err := s.kvsSetTxn(tx, idx, entry, false); err != nil {
+			return false, err
+		}
+	}
+
+	tx.Commit()
+	return true, nil
+}
+
+// KVSRecycleTree is used to do a recursive delete on a key prefix, holding
+// the deleted entries in the recycle bin so they can be restored until the
+// given tree expires. If no keys are deleted, nothing goes into the bin.
+func (s *StateStore) KVSRecycleTree(idx uint64, tree *structs.KVSRecycled) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if err := s.kvsRecycleTreeTxn(tx, idx, tree); err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// KVSRecycleTreeCAS is like KVSRecycleTree, but only deletes the tree if
+// its index matches the given index, as with KVSDeleteTreeCAS.
+func (s *StateStore) KVSRecycleTreeCAS(idx, cidx uint64, tree *structs.KVSRecycled) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	set, err := s.kvsRecycleTreeCASTxn(tx, idx, cidx, tree)
+	if !set || err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return true, nil
+}
+
+// kvsRecycleTreeCASTxn is the inner method that recycles a tree with
+// check-and-set within an existing transaction.
+func (s *StateStore) kvsRecycleTreeCASTxn(tx *memdb.Txn, idx, cidx uint64, tree *structs.KVSRecycled) (bool, error) {
+	tindex, err := s.kvsTreeIndexTxn(tx, tree.Prefix)
+	if err != nil {
+		return false, err
+	}
+	if tindex != cidx {
+		return false, nil
+	}
+	if err := s.kvsRecycleTreeTxn(tx, idx, tree); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// kvsRecycleTreeTxn is the inner method used to delete a tree into the
+// recycle bin within an existing transaction.
+func (s *StateStore) kvsRecycleTreeTxn(tx *memdb.Txn, idx uint64, tree *structs.KVSRecycled) error {
+	// Check that the ID is set
+	if tree.ID == "" {
+		return ErrMissingRecycledID
+	}
+
+	// Delete the tree, keeping hold of the entries.
+	deleted, err := s.kvsDeleteTreeTxn(tx, idx, tree.Prefix)
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	// Put the entries in the bin and update the index.
+	tree.Entries = deleted
+	tree.CreateIndex = idx
+	tree.ModifyIndex = idx
+	if err := tx.Insert("kvs_recycle", tree); err != nil {
+		return fmt.Errorf("failed inserting recycled tree: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"kvs_recycle", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["kvs_recycle"].Notify() })
+	return nil
+}
+
+// KVSRecycledGet is used to look up a tree in the recycle bin by ID.
+func (s *StateStore) KVSRecycledGet(id string) (uint64, *structs.KVSRecycled, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("KVSRecycledGet")...)
+
+	// Look up the tree.
+	tree, err := tx.First("kvs_recycle", "id", id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed recycled tree lookup: %s", err)
+	}
+	if tree != nil {
+		return idx, tree.(*structs.KVSRecycled), nil
+	}
+	return idx, nil, nil
+}
+
+// KVSRecycledList is used to list all the trees in the recycle bin.
+func (s *StateStore) KVSRecycledList() (uint64, structs.KVSRecycledTrees, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("KVSRecycledList")...)
+
+	// Query all of the trees in the bin.
+	trees, err := s.kvsRecycledListTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx, trees, nil
+}
+
+// kvsRecycledListTxn is used to list out all of the trees in the recycle
+// bin within an existing transaction.
+func (s *StateStore) kvsRecycledListTxn(tx *memdb.Txn) (structs.KVSRecycledTrees, error) {
+	trees, err := tx.Get("kvs_recycle", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed recycled tree lookup: %s", err)
+	}
+
+	var result structs.KVSRecycledTrees
+	for tree := trees.Next(); tree != nil; tree = trees.Next() {
+		result = append(result, tree.(*structs.KVSRecycled))
+	}
+	return result, nil
+}
+
+// KVSRecycledRestore is used to put a tree from the recycle bin back into
+// the KV store and remove it from the bin. Keys that have been written
+// since the tree was deleted are left alone. Sessions are not restored,
+// so any locks that were held are released.
+func (s *StateStore) KVSRecycledRestore(idx uint64, id string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Look up the tree.
+	tree, err := tx.First("kvs_recycle", "id", id)
+	if err != nil {
+		return fmt.Errorf("failed recycled tree lookup: %s", err)
+	}
+	if tree == nil {
+		return ErrMissingRecycledTree
+	}
+
+	// Put back any keys that haven't been written since.
+	for _, entry := range tree.(*structs.KVSRecycled).Entries {
+		existing, err := tx.First("kvs", "id", entry.Key)
+		if err != nil {
+			return fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		if existing != nil {
+			continue
+		}
+		if err := s.kvsSetTxn(tx, idx, entry.Clone(), false); err != nil {
+			return err
+		}
+	}
+
+	// Take the tree out of the bin and update the index.
+	if err := tx.Delete("kvs_recycle", tree); err != nil {
+		return fmt.Errorf("failed deleting recycled tree: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"kvs_recycle", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["kvs_recycle"].Notify() })
+	tx.Commit()
+	return nil
+}
+
+// KVSRecycledReap is used to drop every tree in the recycle bin that
+// expired before the given time. The time comes from the leader so that
+// all servers reap the same trees.
+func (s *StateStore) KVSRecycledReap(idx uint64, reapTime time.Time) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Find the expired trees.
+	trees, err := s.kvsRecycledListTxn(tx)
+	if err != nil {
+		return err
+	}
+	var modified bool
+	for _, tree := range trees {
+		if !tree.Expires.Before(reapTime) {
+			continue
+		}
+		if err := tx.Delete("kvs_recycle", tree); err != nil {
+			return fmt.Errorf("failed deleting recycled tree: %s", err)
+		}
+		modified = true
+	}
+
+	// Update the index
+	if modified {
+		if err := tx.Insert("index", &IndexEntry{"kvs_recycle", idx}); err != nil {
 			return fmt.Errorf("failed updating index: %s", err)
 		}
+		tx.Defer(func() { s.tableWatches["kvs_recycle"].Notify() })
 	}
 
 	tx.Commit()
 	return nil
 }
 
+// ExpiredKeys returns the KV entries whose TTL expired before the given
+// time.
+func (s *StateStore) ExpiredKeys(now time.Time) (structs.DirEntries, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	return s.expiredKeysTxn(tx, now)
+}
+
+// expiredKeysTxn returns the expired KV entries within an existing
+// transaction.
+func (s *StateStore) expiredKeysTxn(tx *memdb.Txn, now time.Time) (structs.DirEntries, error) {
+	entries, err := tx.Get("kvs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed kvs lookup: %s", err)
+	}
+
+	var result structs.DirEntries
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		e := entry.(*structs.DirEntry)
+		if !e.ExpiresAt.IsZero() && e.ExpiresAt.Before(now) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// ReapExpiredKeys deletes every KV entry whose TTL expired before the reap
+// time. Like any other delete, this leaves tombstones so blocking queries
+// see the index move. Uploads that expired unused are dropped as well.
+func (s *StateStore) ReapExpiredKeys(idx uint64, reapTime time.Time) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Find the expired keys first so we don't trash the iterator.
+	expired, err := s.expiredKeysTxn(tx, reapTime)
+	if err != nil {
+		return err
+	}
+	for _, e := range expired {
+		if err := s.kvsDeleteTxn(tx, idx, e.Key); err != nil {
+			return err
+		}
+	}
+
+	uploads, err := s.expiredUploadsTxn(tx, reapTime)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := tx.Delete("kvs_uploads", upload); err != nil {
+			return fmt.Errorf("failed deleting upload: %s", err)
+		}
+	}
+	if len(uploads) > 0 {
+		if err := tx.Insert("index", &IndexEntry{"kvs_uploads", idx}); err != nil {
+			return fmt.Errorf("failed updating index: %s", err)
+		}
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ExpiredUploads returns the KV uploads that expired before the given time
+// without being used.
+func (s *StateStore) ExpiredUploads(now time.Time) (structs.KVSUploads, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	return s.expiredUploadsTxn(tx, now)
+}
+
+// expiredUploadsTxn returns the expired uploads within an existing
+// transaction.
+func (s *StateStore) expiredUploadsTxn(tx *memdb.Txn, now time.Time) (structs.KVSUploads, error) {
+	uploads, err := tx.Get("kvs_uploads", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed upload lookup: %s", err)
+	}
+
+	var result structs.KVSUploads
+	for upload := uploads.Next(); upload != nil; upload = uploads.Next() {
+		u := upload.(*structs.KVSUpload)
+		if u.Expires.Before(now) {
+			result = append(result, u)
+		}
+	}
+	return result, nil
+}
+
+// KVSUploadChunk adds the chunk with the given sequence number to an
+// upload, creating the upload for the first chunk. Chunks have to arrive
+// in order.
+func (s *StateStore) KVSUploadChunk(idx uint64, id string, seq int, data []byte, expires time.Time) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	existing, err := tx.First("kvs_uploads", "id", id)
+	if err != nil {
+		return fmt.Errorf("failed upload lookup: %s", err)
+	}
+
+	// Build a new upload rather than appending to the one in the state
+	// store, which readers of older snapshots may still hold.
+	upload := &structs.KVSUpload{
+		ID:      id,
+		Expires: expires,
+	}
+	if existing != nil {
+		e := existing.(*structs.KVSUpload)
+		upload.Chunks = append(upload.Chunks, e.Chunks...)
+		upload.CreateIndex = e.CreateIndex
+	} else {
+		upload.CreateIndex = idx
+	}
+	if seq != len(upload.Chunks) {
+		return fmt.Errorf("chunk %d of upload '%s' is out of order, expected chunk %d",
+			seq, id, len(upload.Chunks))
+	}
+	upload.Chunks = append(upload.Chunks, data)
+	upload.ModifyIndex = idx
+
+	if err := tx.Insert("kvs_uploads", upload); err != nil {
+		return fmt.Errorf("failed inserting upload: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"kvs_uploads", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// KVSUploadComplete removes an upload that should hold the given number of
+// chunks, returning the value they make up.
+func (s *StateStore) KVSUploadComplete(idx uint64, id string, chunks int) ([]byte, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	value, err := s.kvsUploadCompleteTxn(tx, idx, id, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.Commit()
+	return value, nil
+}
+
+// kvsUploadCompleteTxn is the inner method used to use up an upload within
+// an existing transaction.
+func (s *StateStore) kvsUploadCompleteTxn(tx *memdb.Txn, idx uint64, id string, chunks int) ([]byte, error) {
+	existing, err := tx.First("kvs_uploads", "id", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed upload lookup: %s", err)
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("upload '%s' not found", id)
+	}
+	upload := existing.(*structs.KVSUpload)
+	if len(upload.Chunks) != chunks {
+		return nil, fmt.Errorf("upload '%s' has %d chunks, expected %d",
+			id, len(upload.Chunks), chunks)
+	}
+
+	var size int
+	for _, chunk := range upload.Chunks {
+		size += len(chunk)
+	}
+	value := make([]byte, 0, size)
+	for _, chunk := range upload.Chunks {
+		value = append(value, chunk...)
+	}
+
+	if err := tx.Delete("kvs_uploads", upload); err != nil {
+		return nil, fmt.Errorf("failed deleting upload: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"kvs_uploads", idx}); err != nil {
+		return nil, fmt.Errorf("failed updating index: %s", err)
+	}
+	return value, nil
+}
+
 // KVSLockDelay returns the expiration time for any lock delay associated with
 // the given key.
 func (s *StateStore) KVSLockDelay(key string) time.Time {
@@ -1766,6 +3346,18 @@ func (s *StateStore) KVSLock(idx uint64, entry *structs.DirEntry) (bool, error)
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
+	locked, err := s.kvsLockTxn(tx, idx, entry)
+	if err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return locked, nil
+}
+
+// kvsLockTxn is the inner method that does a lock inside an existing
+// transaction.
+func (s *StateStore) kvsLockTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntry) (bool, error) {
 	// Verify that a session is present.
 	if entry.Session == "" {
 		return false, fmt.Errorf("missing session")
@@ -1811,8 +3403,6 @@ func (s *StateStore) KVSLock(idx uint64, entry *structs.DirEntry) (bool, error)
 	if err := s.kvsSetTxn(tx, idx, entry, true); err != nil {
 		return false, err
 	}
-
-	tx.Commit()
 	return true, nil
 }
 
@@ -1822,6 +3412,18 @@ func (s *StateStore) KVSUnlock(idx uint64, entry *structs.DirEntry) (bool, error
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
+	unlocked, err := s.kvsUnlockTxn(tx, idx, entry)
+	if err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return unlocked, nil
+}
+
+// kvsUnlockTxn is the inner method that does an unlock inside an existing
+// transaction.
+func (s *StateStore) kvsUnlockTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntry) (bool, error) {
 	// Verify that a session is present.
 	if entry.Session == "" {
 		return false, fmt.Errorf("missing session")
@@ -1854,8 +3456,6 @@ func (s *StateStore) KVSUnlock(idx uint64, entry *structs.DirEntry) (bool, error
 	if err := s.kvsSetTxn(tx, idx, entry, true); err != nil {
 		return false, err
 	}
-
-	tx.Commit()
 	return true, nil
 }
 
@@ -1952,6 +3552,9 @@ func (s *StateStore) sessionCreateTxn(tx *memdb.Txn, idx uint64, sess *structs.S
 	if err := tx.Insert("index", &IndexEntry{"sessions", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterSessions, changeCreate, 1); err != nil {
+		return err
+	}
 
 	tx.Defer(func() { s.tableWatches["sessions"].Notify() })
 	return nil
@@ -2017,7 +3620,34 @@ func (s *StateStore) NodeSessions(nodeID string) (uint64, structs.Sessions, erro
 	// Go over all of the sessions and return them as a slice
 	var result structs.Sessions
 	for session := sessions.Next(); session != nil; session = sessions.Next() {
-		result = append(result, session.(*structs.Session))
+		result = append(result, session.(*structs.Session))
+	}
+	return idx, result, nil
+}
+
+// NodeLocks returns the keys currently locked by any of the sessions
+// associated with the given node ID.
+func (s *StateStore) NodeLocks(nodeID string) (uint64, structs.DirEntries, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "sessions", "kvs")
+
+	// Collect the keys held by each of the node's sessions.
+	sessions, err := tx.Get("sessions", "node", nodeID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed session lookup: %s", err)
+	}
+	var result structs.DirEntries
+	for session := sessions.Next(); session != nil; session = sessions.Next() {
+		entries, err := tx.Get("kvs", "session", session.(*structs.Session).ID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		for entry := entries.Next(); entry != nil; entry = entries.Next() {
+			result = append(result, entry.(*structs.DirEntry))
+		}
 	}
 	return idx, result, nil
 }
@@ -2059,6 +3689,9 @@ func (s *StateStore) deleteSessionTxn(tx *memdb.Txn, idx uint64, watches *DumbWa
 	if err := tx.Insert("index", &IndexEntry{"sessions", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterSessions, changeDelete, 1); err != nil {
+		return err
+	}
 
 	// Enforce the max lock delay.
 	session := sess.(*structs.Session)
@@ -2180,6 +3813,13 @@ func (s *StateStore) aclSetTxn(tx *memdb.Txn, idx uint64, acl *structs.ACL) erro
 	if err := tx.Insert("index", &IndexEntry{"acls", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	op := changeCreate
+	if existing != nil {
+		op = changeUpdate
+	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterACLs, op, 1); err != nil {
+		return err
+	}
 
 	tx.Defer(func() { s.tableWatches["acls"].Notify() })
 	return nil
@@ -2272,6 +3912,9 @@ func (s *StateStore) aclDeleteTxn(tx *memdb.Txn, idx uint64, aclID string) error
 	if err := tx.Insert("index", &IndexEntry{"acls", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.countChangesTxn(tx, idx, structs.ChangeCounterACLs, changeDelete, 1); err != nil {
+		return err
+	}
 
 	tx.Defer(func() { s.tableWatches["acls"].Notify() })
 	return nil
@@ -2357,3 +4000,613 @@ func (s *StateStore) CoordinateBatchUpdate(idx uint64, updates structs.Coordinat
 	tx.Commit()
 	return nil
 }
+
+// changeOp is the kind of change being recorded against a change counter.
+type changeOp int
+
+const (
+	changeCreate changeOp = iota
+	changeUpdate
+	changeDelete
+)
+
+// countChangesTxn adds n changes of the given kind to the counter for the
+// given type of object, within an existing transaction.
+func (s *StateStore) countChangesTxn(tx *memdb.Txn, idx uint64, kind string, op changeOp, n uint64) error {
+	// Copy the existing counter, if any, since we can't modify objects
+	// that are in the state store.
+	existing, err := tx.First("change_counters", "id", kind)
+	if err != nil {
+		return fmt.Errorf("failed change counter lookup: %s", err)
+	}
+	var counter structs.ChangeCounter
+	if existing != nil {
+		counter = *existing.(*structs.ChangeCounter)
+	} else {
+		counter.Type = kind
+		counter.CreateIndex = idx
+	}
+	counter.ModifyIndex = idx
+
+	switch op {
+	case changeCreate:
+		counter.Creates += n
+	case changeUpdate:
+		counter.Updates += n
+	case changeDelete:
+		counter.Deletes += n
+	default:
+		return fmt.Errorf("unknown change op %d", op)
+	}
+
+	// Store the counter and update the index.
+	if err := tx.Insert("change_counters", &counter); err != nil {
+		return fmt.Errorf("failed inserting change counter: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"change_counters", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["change_counters"].Notify() })
+	return nil
+}
+
+// ChangeCounters returns the cumulative change counts for every type of
+// object that has been changed.
+func (s *StateStore) ChangeCounters() (uint64, structs.ChangeCounters, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ChangeCounters")...)
+
+	// Pull all the counters.
+	counters, err := tx.Get("change_counters", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed change counter lookup: %s", err)
+	}
+	var results structs.ChangeCounters
+	for counter := counters.Next(); counter != nil; counter = counters.Next() {
+		results = append(results, counter.(*structs.ChangeCounter))
+	}
+	return idx, results, nil
+}
+
+// recordChangeTxn adds a change to the end of the change feed, dropping
+// the oldest entry once the feed is full, within an existing transaction.
+func (s *StateStore) recordChangeTxn(tx *memdb.Txn, idx uint64, kind, op, node, key, service string) error {
+	// Rebuilding the tables during a restore isn't a change.
+	if s.restoring {
+		return nil
+	}
+
+	// Number the change after the last one.
+	seq := maxIndexTxn(tx, "change_feed_seq") + 1
+	entry := &structs.ChangeFeedEntry{
+		Seq:     seq,
+		Index:   idx,
+		Type:    kind,
+		Op:      op,
+		Node:    node,
+		Key:     key,
+		Service: service,
+	}
+	if err := tx.Insert("change_feed", &changeFeedEntry{changeFeedID(seq), entry}); err != nil {
+		return fmt.Errorf("failed inserting change feed entry: %s", err)
+	}
+
+	// Drop the entry that just fell out of the retained window.
+	if seq > changeFeedRetain {
+		old, err := tx.First("change_feed", "id", changeFeedID(seq-changeFeedRetain))
+		if err != nil {
+			return fmt.Errorf("failed change feed lookup: %s", err)
+		}
+		if old != nil {
+			if err := tx.Delete("change_feed", old); err != nil {
+				return fmt.Errorf("failed pruning change feed: %s", err)
+			}
+		}
+	}
+
+	// Update the indexes.
+	if err := tx.Insert("index", &IndexEntry{"change_feed_seq", seq}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"change_feed", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Defer(func() { s.tableWatches["change_feed"].Notify() })
+	return nil
+}
+
+// ChangeFeed returns up to max of the changes made after the given
+// sequence number, oldest first, along with the newest sequence number. A
+// max of zero returns everything that is retained. If changes after since
+// have already been dropped from the feed, this returns the oldest ones
+// that are left and sets truncated.
+func (s *StateStore) ChangeFeed(since uint64, max int) (uint64, *structs.IndexedChangeFeed, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ChangeFeed")...)
+
+	reply := &structs.IndexedChangeFeed{
+		LastSeq: maxIndexTxn(tx, "change_feed_seq"),
+	}
+	if since >= reply.LastSeq {
+		return idx, reply, nil
+	}
+
+	// The sequence numbers have no gaps, so if the next one is missing the
+	// reader has fallen behind and we start from the oldest one we have.
+	next := since + 1
+	first, err := tx.First("change_feed", "id", changeFeedID(next))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+	}
+	if first == nil {
+		oldest, err := tx.First("change_feed", "id")
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+		reply.Truncated = true
+		if oldest == nil {
+			return idx, reply, nil
+		}
+		next = oldest.(*changeFeedEntry).Entry.Seq
+	}
+
+	// Walk forward from there.
+	for seq := next; seq <= reply.LastSeq; seq++ {
+		if max > 0 && len(reply.Entries) >= max {
+			break
+		}
+		entry, err := tx.First("change_feed", "id", changeFeedID(seq))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+		if entry == nil {
+			break
+		}
+		reply.Entries = append(reply.Entries, entry.(*changeFeedEntry).Entry)
+	}
+	return idx, reply, nil
+}
+
+// ServiceEvents returns the changes to the instances of the given service
+// made after the given change feed sequence number, with one event per
+// changed instance. Changes to an instance's node or health checks count
+// as updates. If since is zero, or the changes after it have already been
+// dropped from the feed, this returns every current instance instead and
+// sets Reset. Removals may name instances that were added and removed
+// again since the subscriber last looked.
+func (s *StateStore) ServiceEvents(serviceName string, since uint64) (uint64, *structs.IndexedServiceEvents, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("ServiceEvents")...)
+
+	reply := &structs.IndexedServiceEvents{
+		LastSeq: maxIndexTxn(tx, "change_feed_seq"),
+	}
+	if since != 0 && since == reply.LastSeq {
+		return idx, reply, nil
+	}
+
+	// See if we can catch the subscriber up from the feed.
+	var first interface{}
+	if since != 0 && since < reply.LastSeq {
+		var err error
+		first, err = tx.First("change_feed", "id", changeFeedID(since+1))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+	}
+	if first == nil {
+		services, err := tx.Get("services", "service", serviceName)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+		}
+		var sns structs.ServiceNodes
+		for service := services.Next(); service != nil; service = services.Next() {
+			sns = append(sns, service.(*structs.ServiceNode))
+		}
+		_, instances, err := s.parseCheckServiceNodes(tx, idx, sns, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := range instances {
+			reply.Events = append(reply.Events, &structs.ServiceEvent{
+				Op:        structs.ServiceEventAdd,
+				Node:      instances[i].Node.Node,
+				ServiceID: instances[i].Service.ID,
+				Instance:  &instances[i],
+			})
+		}
+		reply.Reset = true
+		return idx, reply, nil
+	}
+
+	// Work out which instances were touched, in the order they were first
+	// changed. Node and node-level check changes touch every instance of
+	// the service on that node.
+	type instanceID struct {
+		node, service string
+	}
+	var touched []instanceID
+	seen := make(map[instanceID]bool)
+	touch := func(id instanceID) {
+		if !seen[id] {
+			seen[id] = true
+			touched = append(touched, id)
+		}
+	}
+	for seq := since + 1; seq <= reply.LastSeq; seq++ {
+		raw, err := tx.First("change_feed", "id", changeFeedID(seq))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+		if raw == nil {
+			break
+		}
+		entry := raw.(*changeFeedEntry).Entry
+
+		switch entry.Type {
+		case structs.ChangeFeedServices:
+			if entry.Service == serviceName {
+				touch(instanceID{entry.Node, entry.Key})
+			}
+		case structs.ChangeFeedNodes, structs.ChangeFeedChecks:
+			if entry.Service != "" && entry.Service != serviceName {
+				continue
+			}
+			services, err := tx.Get("services", "node", entry.Node)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+			}
+			for service := services.Next(); service != nil; service = services.Next() {
+				sn := service.(*structs.ServiceNode)
+				if sn.ServiceName == serviceName {
+					touch(instanceID{sn.Node, sn.ServiceID})
+				}
+			}
+		}
+	}
+
+	// Build an event from the current state of each instance. Anything
+	// created after the subscriber last looked is an add.
+	sinceIndex := first.(*changeFeedEntry).Entry.Index
+	for _, id := range touched {
+		event := &structs.ServiceEvent{
+			Op:        structs.ServiceEventRemove,
+			Node:      id.node,
+			ServiceID: id.service,
+		}
+		service, err := tx.First("services", "id", id.node, id.service)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+		}
+		if service != nil && service.(*structs.ServiceNode).ServiceName == serviceName {
+			sn := service.(*structs.ServiceNode)
+			_, instances, err := s.parseCheckServiceNodes(tx, idx, structs.ServiceNodes{sn}, nil)
+			if err != nil {
+				return 0, nil, err
+			}
+			event.Instance = &instances[0]
+			if sn.CreateIndex >= sinceIndex {
+				event.Op = structs.ServiceEventAdd
+			} else {
+				event.Op = structs.ServiceEventUpdate
+			}
+		}
+		reply.Events = append(reply.Events, event)
+	}
+	return idx, reply, nil
+}
+
+// ServiceEventsSinceIndex is like ServiceEvents, but returns the changes
+// made after the given Raft index instead of a change feed sequence number,
+// so blocking queries can ask for what changed since the index they last
+// saw. A zero index, or one older than the changes still in the feed,
+// returns every current instance and sets Reset.
+func (s *StateStore) ServiceEventsSinceIndex(serviceName string, index uint64) (uint64, *structs.IndexedServiceEvents, error) {
+	since, err := s.changeFeedSeqAt(index)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.ServiceEvents(serviceName, since)
+}
+
+// KVSEvents returns the changes to the keys under the given prefix made
+// after the given change feed sequence number. Each changed key gets one
+// event holding its current entry, or a delete if it's gone, ordered by
+// when it was last changed. Tree deletes that reach under the prefix are
+// passed on as they are, with the key clipped to the prefix. If since is
+// zero, or the changes after it have already been dropped from the feed,
+// this returns a set for every current key instead and sets Reset.
+func (s *StateStore) KVSEvents(prefix string, since uint64) (uint64, *structs.IndexedKVSEvents, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "kvs", "tombstones")
+
+	reply := &structs.IndexedKVSEvents{
+		LastSeq: maxIndexTxn(tx, "change_feed_seq"),
+	}
+	if since != 0 && since == reply.LastSeq {
+		return idx, reply, nil
+	}
+
+	// See if we can catch the subscriber up from the feed.
+	var first interface{}
+	if since != 0 && since < reply.LastSeq {
+		var err error
+		first, err = tx.First("change_feed", "id", changeFeedID(since+1))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+	}
+	if first == nil {
+		entries, err := tx.Get("kvs", "id_prefix", prefix)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		for entry := entries.Next(); entry != nil; entry = entries.Next() {
+			e := entry.(*structs.DirEntry)
+			reply.Events = append(reply.Events, &structs.KVSEvent{
+				Op:    structs.ChangeFeedSet,
+				Key:   e.Key,
+				Entry: e,
+			})
+		}
+		reply.Reset = true
+		return idx, reply, nil
+	}
+
+	// Walk the feed backwards so each key is placed by its last change,
+	// which keeps it after any tree delete that came before it.
+	seen := make(map[string]bool)
+	var events structs.KVSEvents
+	for seq := reply.LastSeq; seq > since; seq-- {
+		raw, err := tx.First("change_feed", "id", changeFeedID(seq))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+		if raw == nil {
+			continue
+		}
+		entry := raw.(*changeFeedEntry).Entry
+		if entry.Type != structs.ChangeFeedKVS {
+			continue
+		}
+
+		if entry.Op == structs.ChangeFeedDeleteTree {
+			key := entry.Key
+			if strings.HasPrefix(prefix, key) {
+				key = prefix
+			} else if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			events = append(events, &structs.KVSEvent{
+				Op:  structs.ChangeFeedDeleteTree,
+				Key: key,
+			})
+			continue
+		}
+		if !strings.HasPrefix(entry.Key, prefix) || seen[entry.Key] {
+			continue
+		}
+		seen[entry.Key] = true
+
+		event := &structs.KVSEvent{
+			Op:  structs.ChangeFeedDelete,
+			Key: entry.Key,
+		}
+		existing, err := tx.First("kvs", "id", entry.Key)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		if existing != nil {
+			event.Op = structs.ChangeFeedSet
+			event.Entry = existing.(*structs.DirEntry)
+		}
+		events = append(events, event)
+	}
+
+	// Put the events back in order.
+	for i := len(events) - 1; i >= 0; i-- {
+		reply.Events = append(reply.Events, events[i])
+	}
+	return idx, reply, nil
+}
+
+// NodeChangesSinceIndex returns the services and checks registered on the
+// given node that changed after the given Raft index, along with the node
+// itself, so an agent can keep its view of the catalog up to date without
+// reading all of its registrations on every sync. A zero index, or one
+// older than the changes still in the feed, returns everything registered
+// on the node and sets Reset.
+func (s *StateStore) NodeChangesSinceIndex(node string, index uint64) (uint64, *structs.NodeDelta, error) {
+	since, err := s.changeFeedSeqAt(index)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, s.getWatchTables("NodeChanges")...)
+
+	delta := &structs.NodeDelta{}
+	n, err := tx.First("nodes", "id", node)
+	if err != nil {
+		return 0, nil, fmt.Errorf("node lookup failed: %s", err)
+	}
+	if n != nil {
+		delta.Node = n.(*structs.Node)
+	}
+
+	// Work out which services and checks were touched, or fall back to
+	// everything on the node if the feed doesn't go back far enough.
+	var serviceIDs, checkIDs []string
+	last := maxIndexTxn(tx, "change_feed_seq")
+	var first interface{}
+	if since != 0 && since < last {
+		first, err = tx.First("change_feed", "id", changeFeedID(since+1))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+	}
+	if since == 0 || (since < last && first == nil) {
+		delta.Reset = true
+		services, err := tx.Get("services", "node", node)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+		}
+		for service := services.Next(); service != nil; service = services.Next() {
+			serviceIDs = append(serviceIDs, service.(*structs.ServiceNode).ServiceID)
+		}
+		checks, err := tx.Get("checks", "node", node)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+		}
+		for check := checks.Next(); check != nil; check = checks.Next() {
+			checkIDs = append(checkIDs, check.(*structs.HealthCheck).CheckID)
+		}
+	} else {
+		seenServices := make(map[string]bool)
+		seenChecks := make(map[string]bool)
+		for seq := since + 1; seq <= last; seq++ {
+			raw, err := tx.First("change_feed", "id", changeFeedID(seq))
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed change feed lookup: %s", err)
+			}
+			if raw == nil {
+				break
+			}
+			entry := raw.(*changeFeedEntry).Entry
+			if !strings.EqualFold(entry.Node, node) {
+				continue
+			}
+			switch entry.Type {
+			case structs.ChangeFeedServices:
+				if !seenServices[entry.Key] {
+					seenServices[entry.Key] = true
+					serviceIDs = append(serviceIDs, entry.Key)
+				}
+			case structs.ChangeFeedChecks:
+				if !seenChecks[entry.Key] {
+					seenChecks[entry.Key] = true
+					checkIDs = append(checkIDs, entry.Key)
+				}
+			}
+		}
+	}
+
+	// Report the current state of each one.
+	for _, id := range serviceIDs {
+		service, err := tx.First("services", "id", node, id)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+		}
+		if service == nil {
+			delta.DeletedServices = append(delta.DeletedServices, id)
+			continue
+		}
+		delta.Services = append(delta.Services, service.(*structs.ServiceNode).ToNodeService())
+	}
+	for _, id := range checkIDs {
+		check, err := tx.First("checks", "id", node, id)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed health check lookup: %s", err)
+		}
+		if check == nil {
+			delta.DeletedChecks = append(delta.DeletedChecks, id)
+			continue
+		}
+		hc, err := exportCheck(check.(*structs.HealthCheck))
+		if err != nil {
+			return 0, nil, err
+		}
+		delta.Checks = append(delta.Checks, hc)
+	}
+	return idx, delta, nil
+}
+
+// changeFeedSeqAt returns the sequence number of the last change made at
+// or before the given Raft index, or zero if the feed no longer goes back
+// that far.
+func (s *StateStore) changeFeedSeqAt(index uint64) (uint64, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	if index == 0 {
+		return 0, nil
+	}
+	last := maxIndexTxn(tx, "change_feed_seq")
+	oldest, err := tx.First("change_feed", "id")
+	if err != nil {
+		return 0, fmt.Errorf("failed change feed lookup: %s", err)
+	}
+	if oldest == nil || oldest.(*changeFeedEntry).Entry.Index > index {
+		return 0, nil
+	}
+
+	// The feed is in index order, so binary search it for the last change
+	// that isn't newer than the index.
+	lo, hi := oldest.(*changeFeedEntry).Entry.Seq, last
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		entry, err := tx.First("change_feed", "id", changeFeedID(mid))
+		if err != nil {
+			return 0, fmt.Errorf("failed change feed lookup: %s", err)
+		}
+		if entry == nil {
+			return 0, nil
+		}
+		if entry.(*changeFeedEntry).Entry.Index <= index {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// CapacityUsage counts the services, service instances, and keys in the
+// state store so they can be checked against capacity thresholds.
+func (s *StateStore) CapacityUsage() (uint64, *structs.CapacityUsage, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "services", "kvs", "tombstones")
+
+	// Count the instances of each service.
+	usage := &structs.CapacityUsage{
+		ServiceInstances: make(map[string]int),
+	}
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed querying services: %s", err)
+	}
+	for service := services.Next(); service != nil; service = services.Next() {
+		usage.ServiceInstances[service.(*structs.ServiceNode).ServiceName]++
+	}
+	usage.Services = len(usage.ServiceInstances)
+
+	// Count the keys.
+	entries, err := tx.Get("kvs", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed kvs lookup: %s", err)
+	}
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		usage.KVSKeys++
+	}
+	return idx, usage, nil
+}
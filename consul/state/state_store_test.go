@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/clock"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/serf/coordinate"
 )
@@ -186,7 +187,7 @@ func TestStateStore_GC(t *testing.T) {
 	// Build up a fast GC.
 	ttl := 10 * time.Millisecond
 	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
+	gc, err := NewTombstoneGC(ttl, gran, clock.Real{})
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
@@ -342,6 +343,44 @@ func TestStateStore_ReapTombstones(t *testing.T) {
 	}
 }
 
+func TestStateStore_TombstoneCounts(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "foo/bar", "bar")
+	testSetKey(t, s, 2, "foo/baz", "bar")
+	testSetKey(t, s, 3, "zip", "zap")
+	if err := s.KVSDelete(4, "foo/bar"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.KVSDelete(5, "foo/baz"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.KVSDelete(6, "zip"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	total, byPrefix, err := s.TombstoneCounts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := map[string]int{"foo": 2, "zip": 1}
+	if total != 3 || !reflect.DeepEqual(byPrefix, expected) {
+		t.Fatalf("bad: %d %v", total, byPrefix)
+	}
+
+	// Reaped tombstones aren't counted.
+	if err := s.ReapTombstones(5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	total, byPrefix, err = s.TombstoneCounts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if total != 1 || byPrefix["zip"] != 1 || len(byPrefix) != 1 {
+		t.Fatalf("bad: %d %v", total, byPrefix)
+	}
+}
+
 func TestStateStore_GetWatches(t *testing.T) {
 	s := testStateStore(t)
 
@@ -381,9 +420,15 @@ func TestStateStore_GetWatches(t *testing.T) {
 	if w := s.GetQueryWatch("Nodes"); w == nil {
 		t.Fatalf("didn't get a watch")
 	}
-	if w := s.GetQueryWatch("NodeDump"); w == nil {
+	w := s.GetQueryWatch("NodeDump")
+	if w == nil {
 		t.Fatalf("didn't get a watch")
 	}
+
+	// Multi-table watches should be shared between queries.
+	if w2 := s.GetQueryWatch("NodeDump"); w2 != w {
+		t.Fatalf("bad: %#v %#v", w, w2)
+	}
 	if w := s.GetKVSWatch("/dogs"); w == nil {
 		t.Fatalf("didn't get a watch")
 	}
@@ -745,6 +790,66 @@ func TestStateStore_EnsureRegistration_Watches(t *testing.T) {
 	})
 }
 
+func TestStateStore_EnsureRegistrations(t *testing.T) {
+	s := testStateStore(t)
+
+	reqs := []*structs.RegisterRequest{
+		&structs.RegisterRequest{
+			Node:    "node1",
+			Address: "1.2.3.4",
+			Service: &structs.NodeService{ID: "redis1", Service: "redis"},
+		},
+		&structs.RegisterRequest{
+			Node:    "node2",
+			Address: "1.2.3.5",
+			Service: &structs.NodeService{ID: "redis1", Service: "redis"},
+		},
+	}
+
+	// The whole batch should fire the watches once.
+	verifyWatch(t, s.getTableWatch("nodes"), func() {
+		verifyWatch(t, s.getTableWatch("services"), func() {
+			if err := s.EnsureRegistrations(1, reqs); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		})
+	})
+	idx, nodes, err := s.ServiceNodes("redis")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || len(nodes) != 2 {
+		t.Fatalf("bad: %d %v", idx, nodes)
+	}
+
+	// A failure anywhere in the batch should roll back all of it.
+	bad := []*structs.RegisterRequest{
+		&structs.RegisterRequest{
+			Node:    "node3",
+			Address: "1.2.3.6",
+		},
+		&structs.RegisterRequest{
+			Node:    "node4",
+			Address: "1.2.3.7",
+			Check: &structs.HealthCheck{
+				Node:      "node4",
+				CheckID:   "check1",
+				ServiceID: "nope",
+			},
+		},
+	}
+	if err := s.EnsureRegistrations(2, bad); err == nil {
+		t.Fatalf("expected error")
+	}
+	idx, all, err := s.Nodes()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || len(all) != 2 {
+		t.Fatalf("bad: %d %v", idx, all)
+	}
+}
+
 func TestStateStore_EnsureNode(t *testing.T) {
 	s := testStateStore(t)
 
@@ -819,6 +924,87 @@ func TestStateStore_EnsureNode(t *testing.T) {
 	}
 }
 
+func TestStateStore_EnsureNode_Rename(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a node with an ID, a service, and some checks.
+	node := &structs.Node{
+		ID:      "a1b2c3",
+		Node:    "node1",
+		Address: "1.1.1.1",
+		Meta:    map[string]string{"rack": "r1"},
+	}
+	if err := s.EnsureNode(1, node); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterCheck(t, s, 3, "node1", "", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 4, "node1", "service1", "check2", structs.HealthWarning)
+
+	// Registering without an ID keeps the one the node has.
+	if err := s.EnsureNode(5, &structs.Node{Node: "node1", Address: "1.1.1.1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, out, err := s.GetNode("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if out.ID != "a1b2c3" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Come back under a new name with the same ID.
+	if err := s.EnsureNode(6, &structs.Node{ID: "a1b2c3", Node: "node2", Address: "1.1.1.2"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, out, err = s.GetNode("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	_, out, err = s.GetNodeID("A1B2C3")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if out == nil || out.Node != "node2" || out.Address != "1.1.1.2" ||
+		out.Meta["rack"] != "r1" || out.CreateIndex != 1 || out.ModifyIndex != 6 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The services and checks came along.
+	_, services, err := s.NodeServices("node2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(services.Services) != 1 || services.Services["service1"] == nil {
+		t.Fatalf("bad: %#v", services)
+	}
+	_, checks, err := s.NodeChecks("node2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 2 || checks[0].CheckID != "check1" || checks[0].Status != structs.HealthPassing ||
+		checks[1].CheckID != "check2" || checks[1].ServiceID != "service1" ||
+		checks[1].Status != structs.HealthWarning {
+		t.Fatalf("bad: %#v", checks)
+	}
+	_, checks, err = s.NodeChecks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 0 {
+		t.Fatalf("bad: %#v", checks)
+	}
+
+	// A name can't be taken over by a node with a different ID.
+	err = s.EnsureNode(7, &structs.Node{ID: "d4e5f6", Node: "node2", Address: "1.1.1.3"})
+	if err == nil || !strings.Contains(err.Error(), "in use by node ID") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestStateStore_GetNodes(t *testing.T) {
 	s := testStateStore(t)
 
@@ -861,6 +1047,178 @@ func TestStateStore_GetNodes(t *testing.T) {
 	}
 }
 
+func TestStateStore_NodesByMeta(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register some nodes with metadata.
+	nodes := []*structs.Node{
+		&structs.Node{Node: "node0", Meta: map[string]string{"rack": "r1", "class": "ssd"}},
+		&structs.Node{Node: "node1", Meta: map[string]string{"rack": "r1", "class": "hdd"}},
+		&structs.Node{Node: "node2", Meta: map[string]string{"rack": "r2", "class": "ssd"}},
+		&structs.Node{Node: "node3"},
+	}
+	for i, node := range nodes {
+		if err := s.EnsureNode(uint64(i), node); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	checkNodes := func(filters map[string]string, expected ...string) {
+		idx, res, err := s.NodesByMeta(filters)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != s.maxIndex("nodes") {
+			t.Fatalf("bad index: %d", idx)
+		}
+		var names []string
+		for _, node := range res {
+			names = append(names, node.Node)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("filters %v: got %v, expected %v", filters, names, expected)
+		}
+	}
+	checkNodes(map[string]string{"rack": "r1"}, "node0", "node1")
+	checkNodes(map[string]string{"rack": "r1", "class": "ssd"}, "node0")
+	checkNodes(map[string]string{"class": "ssd"}, "node0", "node2")
+	checkNodes(map[string]string{"rack": "r3"})
+	checkNodes(nil, "node0", "node1", "node2", "node3")
+
+	// Registering a service without metadata leaves the node's alone.
+	req := &structs.RegisterRequest{
+		Node:    "node0",
+		Service: &structs.NodeService{ID: "db", Service: "db"},
+	}
+	if err := s.EnsureRegistration(4, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkNodes(map[string]string{"rack": "r1", "class": "ssd"}, "node0")
+
+	// The metadata comes out with the service.
+	_, services, err := s.ServiceNodes("db")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(services) != 1 || !reflect.DeepEqual(services[0].NodeMeta, nodes[0].Meta) {
+		t.Fatalf("bad: %#v", services)
+	}
+
+	// Replacing the metadata drops the old mappings.
+	req.NodeMeta = map[string]string{"rack": "r2"}
+	if err := s.EnsureRegistration(5, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkNodes(map[string]string{"rack": "r1"}, "node1")
+	checkNodes(map[string]string{"rack": "r2"}, "node0", "node2")
+	checkNodes(map[string]string{"class": "ssd"}, "node2")
+
+	// Deleting the node drops its mappings.
+	if err := s.DeleteNode(6, "node2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkNodes(map[string]string{"rack": "r2"}, "node0")
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	mapping, err := tx.First("node_meta", "node", "node2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if mapping != nil {
+		t.Fatalf("bad: %#v", mapping)
+	}
+}
+
+func TestStateStore_EnsureRegistration_TaggedAddresses(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a node with tagged addresses and a service with its own.
+	tagged := map[string]string{"lan": "10.0.0.1", "wan": "198.18.0.1"}
+	req := &structs.RegisterRequest{
+		Node:            "node1",
+		Address:         "10.0.0.1",
+		TaggedAddresses: tagged,
+		Service: &structs.NodeService{
+			ID:              "web",
+			Service:         "web",
+			Address:         "10.0.0.2",
+			TaggedAddresses: map[string]string{"wan": "198.18.0.2"},
+		},
+	}
+	if err := s.EnsureRegistration(1, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Registering again without them leaves the node's alone.
+	req.TaggedAddresses = nil
+	if err := s.EnsureRegistration(2, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, node, err := s.GetNode("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(node.TaggedAddresses, tagged) {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// Both sets come out with the service.
+	_, services, err := s.ServiceNodes("web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(services) != 1 || !reflect.DeepEqual(services[0].TaggedAddresses, tagged) ||
+		services[0].ServiceTaggedAddresses["wan"] != "198.18.0.2" {
+		t.Fatalf("bad: %#v", services)
+	}
+}
+
+func TestStateStore_EnsureRegistration_SkipNodeUpdate(t *testing.T) {
+	s := testStateStore(t)
+
+	// A node that isn't there yet still gets added.
+	req := &structs.RegisterRequest{
+		Node:           "node1",
+		Address:        "10.0.0.1",
+		SkipNodeUpdate: true,
+		Service: &structs.NodeService{
+			ID:      "web",
+			Service: "web",
+		},
+	}
+	if err := s.EnsureRegistration(1, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, node, err := s.GetNode("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if node == nil || node.Address != "10.0.0.1" || node.ModifyIndex != 1 {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// After that the node is left alone.
+	req.Address = "10.0.0.2"
+	req.Service.Port = 80
+	if err := s.EnsureRegistration(2, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, node, err := s.GetNode("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || node.Address != "10.0.0.1" || node.ModifyIndex != 1 {
+		t.Fatalf("bad: %d %#v", idx, node)
+	}
+	_, services, err := s.NodeServices("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if services.Services["web"].Port != 80 {
+		t.Fatalf("bad: %#v", services)
+	}
+}
+
 func BenchmarkGetNodes(b *testing.B) {
 	s, err := NewStateStore(nil)
 	if err != nil {
@@ -1137,6 +1495,65 @@ func TestStateStore_EnsureService(t *testing.T) {
 	}
 }
 
+func TestStateStore_SetServiceDraining(t *testing.T) {
+	s := testStateStore(t)
+
+	// Draining a missing service is an error.
+	if err := s.SetServiceDraining(1, "node1", "redis", true); err != ErrMissingService {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingService, err)
+	}
+
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "redis")
+
+	// Mark the instance as draining.
+	if err := s.SetServiceDraining(3, "node1", "redis", true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, out, err := s.NodeServices("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	svc := out.Services["redis"]
+	if !svc.Draining || svc.CreateIndex != 2 || svc.ModifyIndex != 3 ||
+		svc.Address != "1.1.1.1" || svc.Port != 1111 {
+		t.Fatalf("bad: %#v", svc)
+	}
+
+	// Setting the same state again is a no-op.
+	if err := s.SetServiceDraining(4, "node1", "redis", true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("services"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// The change shows up in the service's events.
+	_, events, err := s.ServiceEventsSinceIndex("redis", 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events.Events) != 1 || events.Events[0].Instance == nil ||
+		!events.Events[0].Instance.Service.Draining {
+		t.Fatalf("bad: %#v", events)
+	}
+
+	// Put it back into service.
+	if err := s.SetServiceDraining(5, "node1", "redis", false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, out, err = s.NodeServices("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if svc := out.Services["redis"]; svc.Draining || svc.ModifyIndex != 5 {
+		t.Fatalf("bad: %#v", svc)
+	}
+}
+
 func TestStateStore_Services(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1189,22 +1606,164 @@ func TestStateStore_Services(t *testing.T) {
 	}
 }
 
-// strContains checks if a list contains a string
-func strContains(l []string, s string) bool {
-	for _, v := range l {
-		if v == s {
-			return true
-		}
-	}
-	return false
-}
-
-func TestStateStore_ServiceNodes(t *testing.T) {
+func TestStateStore_ServiceIDNodes(t *testing.T) {
 	s := testStateStore(t)
 
-	if err := s.EnsureNode(10, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
-	}
+	// Register the same service ID on a couple of nodes.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterService(t, s, 3, "node1", "service1")
+	testRegisterService(t, s, 4, "node2", "service1")
+	testRegisterService(t, s, 5, "node2", "service2")
+
+	idx, nodes, err := s.ServiceIDNodes("SERVICE1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(nodes) != 2 || nodes[0].Node != "node1" || nodes[1].Node != "node2" {
+		t.Fatalf("bad: %#v", nodes)
+	}
+
+	_, nodes, err = s.ServiceIDNodes("nope")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %#v", nodes)
+	}
+}
+
+func TestStateStore_AddressNodes(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a couple of nodes sharing an address, and services with
+	// and without their own address.
+	for i, node := range []string{"node1", "node2", "node3"} {
+		addr := "10.0.0.1"
+		if node == "node3" {
+			addr = "10.0.0.3"
+		}
+		if err := s.EnsureNode(uint64(i+1), &structs.Node{Node: node, Address: addr}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := s.EnsureService(4, "node3", &structs.NodeService{ID: "web", Service: "web", Address: "10.0.0.1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.EnsureService(5, "node1", &structs.NodeService{ID: "db", Service: "db"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	idx, nodes, services, err := s.AddressNodes("10.0.0.1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(nodes) != 2 || nodes[0].Node != "node1" || nodes[1].Node != "node2" {
+		t.Fatalf("bad: %#v", nodes)
+	}
+	if len(services) != 1 || services[0].ServiceID != "web" ||
+		services[0].Node != "node3" || services[0].Address != "10.0.0.3" {
+		t.Fatalf("bad: %#v", services)
+	}
+
+	// Moving a node updates the index.
+	if err := s.EnsureNode(6, &structs.Node{Node: "node2", Address: "10.0.0.2"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, nodes, _, err = s.AddressNodes("10.0.0.1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Node != "node1" {
+		t.Fatalf("bad: %#v", nodes)
+	}
+
+	_, nodes, services, err = s.AddressNodes("10.0.0.9")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 0 || len(services) != 0 {
+		t.Fatalf("bad: %#v %#v", nodes, services)
+	}
+}
+
+func TestStateStore_ServiceSummaries(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a few instances of a service in different states.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterNode(t, s, 3, "node3")
+	for i, node := range []string{"node1", "node2", "node3"} {
+		ns := &structs.NodeService{
+			ID:      "redis",
+			Service: "redis",
+			Tags:    []string{"prod", node},
+		}
+		if err := s.EnsureService(uint64(i+4), node, ns); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	testRegisterService(t, s, 7, "node1", "dogs")
+
+	// A node check counts against all the node's services, and a service
+	// check only against its own.
+	testRegisterCheck(t, s, 8, "node1", "redis", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 9, "node2", "", "check2", structs.HealthCritical)
+	testRegisterCheck(t, s, 10, "node3", "redis", "check3", structs.HealthWarning)
+	testRegisterCheck(t, s, 11, "node3", "redis", "check4", structs.HealthPassing)
+
+	idx, summaries, err := s.ServiceSummaries()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 11 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	for _, summary := range summaries {
+		sort.Strings(summary.Tags)
+	}
+	expected := structs.ServiceSummaries{
+		"redis": &structs.ServiceSummary{
+			Tags:      []string{"node1", "node2", "node3", "prod"},
+			Instances: 3,
+			Passing:   1,
+			Warning:   1,
+			Critical:  1,
+		},
+		"dogs": &structs.ServiceSummary{
+			Tags:      []string{},
+			Instances: 1,
+			Passing:   1,
+		},
+	}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Fatalf("bad: %#v", summaries)
+	}
+}
+
+// strContains checks if a list contains a string
+func strContains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStateStore_ServiceNodes(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(10, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 
 	if err := s.EnsureNode(11, &structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
@@ -1463,6 +2022,62 @@ func TestStateStore_DeleteService(t *testing.T) {
 	}
 }
 
+func TestStateStore_ReapExpiredServices(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a service that never expires, one that expires soon, and
+	// one that expires later.
+	now := time.Now()
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	for i, expires := range []time.Time{now, now.Add(time.Hour)} {
+		svc := &structs.NodeService{
+			ID:        fmt.Sprintf("external%d", i+1),
+			Service:   "external",
+			ExpiresAt: expires,
+		}
+		if err := s.EnsureService(uint64(3+i), "node1", svc); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	testRegisterCheck(t, s, 5, "node1", "external1", "check1", structs.HealthPassing)
+
+	// Nothing has expired yet.
+	expired, err := s.ExpiredServices(now)
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("bad: %#v (err: %v)", expired, err)
+	}
+	if err := s.ReapExpiredServices(6, now); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("services"); idx != 4 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Reap just the first external service, along with its check.
+	expired, err = s.ExpiredServices(now.Add(time.Minute))
+	if err != nil || len(expired) != 1 || expired[0].ServiceID != "external1" {
+		t.Fatalf("bad: %#v (err: %v)", expired, err)
+	}
+	if err := s.ReapExpiredServices(7, now.Add(time.Minute)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, ns, err := s.NodeServices("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(ns.Services) != 2 || ns.Services["service1"] == nil || ns.Services["external2"] == nil {
+		t.Fatalf("bad: %#v", ns.Services)
+	}
+	_, checks, err := s.NodeChecks("node1")
+	if err != nil || len(checks) != 0 {
+		t.Fatalf("bad: %#v (err: %v)", checks, err)
+	}
+	if idx := s.maxIndex("services"); idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
 func TestStateStore_Service_Snapshot(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1672,6 +2287,131 @@ func TestStateStore_EnsureCheck_defaultStatus(t *testing.T) {
 	}
 }
 
+func TestStateStore_EnsureCheck_Output(t *testing.T) {
+	s := testStateStore(t)
+	testRegisterNode(t, s, 1, "node1")
+
+	// Register two checks with the same verbose output.
+	output := strings.Repeat("all systems go\n", 100)
+	for i, id := range []string{"check1", "check2"} {
+		check := &structs.HealthCheck{
+			Node:    "node1",
+			CheckID: id,
+			Status:  structs.HealthPassing,
+			Output:  output,
+		}
+		if err := s.EnsureCheck(uint64(i+2), check); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Reads get the original output back.
+	_, checks, err := s.NodeChecks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 2 || checks[0].Output != output || checks[1].Output != output {
+		t.Fatalf("bad: %#v", checks)
+	}
+	_, dump, err := s.NodeDump()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(dump) != 1 || len(dump[0].Checks) != 2 || dump[0].Checks[0].Output != output {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// The stored output is compressed and held once.
+	verifyShared := func(refs int) string {
+		tx := s.db.Txn(false)
+		defer tx.Abort()
+
+		stored, err := tx.First("checks", "id", "node1", "check1")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		out := stored.(*structs.HealthCheck).Output
+		if len(out) >= len(output) {
+			t.Fatalf("output not compressed: %d bytes", len(out))
+		}
+		iter, err := tx.Get("check_outputs", "id")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		shared := iter.Next()
+		if shared == nil || shared.(*checkOutput).Output != out || shared.(*checkOutput).Refs != refs {
+			t.Fatalf("bad: %#v", shared)
+		}
+		if iter.Next() != nil {
+			t.Fatalf("unexpected extra outputs")
+		}
+		return out
+	}
+	stored := verifyShared(2)
+
+	// Dropping one of the checks releases its reference.
+	if err := s.DeleteCheck(4, "node1", "check2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	verifyShared(1)
+
+	// Snapshots carry the compressed output, and restoring them keeps it.
+	snap := s.Snapshot()
+	defer snap.Close()
+	iter, err := snap.Checks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check := iter.Next().(*structs.HealthCheck)
+	if check.Output != stored {
+		t.Fatalf("bad: %#v", check)
+	}
+
+	s = testStateStore(t)
+	restore := s.Restore()
+	if err := restore.Registration(5, &structs.RegisterRequest{
+		Node:    "node1",
+		Address: "127.0.0.1",
+		Check:   check,
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+	if verifyShared(1) != stored {
+		t.Fatalf("output changed on restore")
+	}
+	_, checks, err = s.NodeChecks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 1 || checks[0].Output != output {
+		t.Fatalf("bad: %#v", checks)
+	}
+
+	// Updating the output lets go of the old one.
+	check = checks[0]
+	check.Output = "\x00short"
+	if err := s.EnsureCheck(6, check); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, checks, err = s.NodeChecks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 1 || checks[0].Output != "\x00short" {
+		t.Fatalf("bad: %#v", checks)
+	}
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	shared, err := tx.First("check_outputs", "id", checkOutputID(stored))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if shared != nil {
+		t.Fatalf("bad: %#v", shared)
+	}
+}
+
 func TestStateStore_NodeChecks(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1777,6 +2517,97 @@ func TestStateStore_ChecksInState(t *testing.T) {
 	}
 }
 
+func TestStateStore_ExternalChecks(t *testing.T) {
+	s := testStateStore(t)
+
+	// Querying with no results returns nil
+	idx, res, err := s.ExternalChecks()
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Register a normal check and an external one
+	testRegisterNode(t, s, 0, "node1")
+	testRegisterCheck(t, s, 1, "node1", "", "check1", structs.HealthPassing)
+	check := &structs.HealthCheck{
+		Node:    "node1",
+		CheckID: "check2",
+		External: &structs.ExternalCheck{
+			TCP:      "127.0.0.1:8080",
+			Interval: time.Minute,
+			Checker:  "node2",
+		},
+	}
+	if err := s.EnsureCheck(2, check); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the external check is returned
+	idx, checks, err := s.ExternalChecks()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || len(checks) != 1 || !reflect.DeepEqual(checks[0], check) {
+		t.Fatalf("bad: %d %#v", idx, checks)
+	}
+}
+
+func TestStateStore_ChecksInStates(t *testing.T) {
+	s := testStateStore(t)
+
+	// Querying with no results returns nil
+	idx, res, err := s.ChecksInStates([]string{structs.HealthPassing}, "", false, "")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Register a node check and a tagged and untagged instance of redis
+	testRegisterNode(t, s, 0, "node1")
+	testRegisterNode(t, s, 1, "node2")
+	testRegisterCheck(t, s, 2, "node1", "", "check1", structs.HealthCritical)
+	if err := s.EnsureService(3, "node1", &structs.NodeService{ID: "redis", Service: "redis", Tags: []string{"Master"}}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testRegisterService(t, s, 4, "node2", "redis")
+	testRegisterCheck(t, s, 5, "node1", "redis", "check2", structs.HealthWarning)
+	testRegisterCheck(t, s, 6, "node2", "redis", "check3", structs.HealthCritical)
+	testRegisterCheck(t, s, 7, "node2", "redis", "check4", structs.HealthPassing)
+
+	checkIDs := func(checks structs.HealthChecks) []string {
+		var ids []string
+		for _, check := range checks {
+			ids = append(ids, check.CheckID)
+		}
+		return ids
+	}
+	cases := []struct {
+		states    []string
+		service   string
+		tagFilter bool
+		tag       string
+		expect    []string
+	}{
+		{[]string{structs.HealthWarning, structs.HealthCritical}, "", false, "", []string{"check2", "check1", "check3"}},
+		{[]string{structs.HealthCritical, structs.HealthCritical}, "", false, "", []string{"check1", "check3"}},
+		{[]string{structs.HealthAny}, "", false, "", []string{"check1", "check3", "check4", "check2"}},
+		{[]string{structs.HealthWarning, structs.HealthCritical}, "redis", false, "", []string{"check2", "check3"}},
+		{[]string{structs.HealthAny}, "redis", true, "master", []string{"check2"}},
+		{[]string{structs.HealthCritical}, "redis", true, "master", nil},
+	}
+	for i, tc := range cases {
+		idx, checks, err := s.ChecksInStates(tc.states, tc.service, tc.tagFilter, tc.tag)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 7 {
+			t.Fatalf("%d: bad index: %d", i, idx)
+		}
+		if ids := checkIDs(checks); !reflect.DeepEqual(ids, tc.expect) {
+			t.Fatalf("%d: bad: %v", i, ids)
+		}
+	}
+}
+
 func TestStateStore_DeleteCheck(t *testing.T) {
 	s := testStateStore(t)
 
@@ -2234,25 +3065,78 @@ func TestStateStore_NodeInfo_NodeDump(t *testing.T) {
 	}
 }
 
-func TestStateStore_KVSSet_KVSGet(t *testing.T) {
+func TestStateStore_CatalogDump(t *testing.T) {
 	s := testStateStore(t)
 
-	// Get on an nonexistent key returns nil.
-	idx, result, err := s.KVSGet("foo")
-	if result != nil || err != nil || idx != 0 {
-		t.Fatalf("expected (0, nil, nil), got : (%#v, %#v, %#v)", idx, result, err)
+	// An empty catalog dumps nothing.
+	idx, dump, err := s.CatalogDump()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Write a new K/V entry to the store.
-	entry := &structs.DirEntry{
-		Key:   "foo",
-		Value: []byte("bar"),
+	if idx != 0 || len(dump.Nodes) != 0 || len(dump.Services) != 0 || len(dump.Checks) != 0 {
+		t.Fatalf("bad: %d %#v", idx, dump)
 	}
-	if err := s.KVSSet(1, entry); err != nil {
+
+	if err := s.EnsureNode(1, &structs.Node{Node: "node1", Address: "1.2.3.4"}); err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterService(t, s, 3, "node1", "service1")
+	testRegisterService(t, s, 4, "node2", "service2")
+	testRegisterCheck(t, s, 5, "node1", "service1", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 6, "node2", "", "check2", structs.HealthCritical)
 
-	// Retrieve the K/V entry again.
+	idx, dump, err = s.CatalogDump()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(dump.Nodes) != 2 || dump.Nodes[0].Node != "node1" || dump.Nodes[1].Node != "node2" {
+		t.Fatalf("bad: %#v", dump.Nodes)
+	}
+	if len(dump.Services) != 2 ||
+		dump.Services[0].ServiceID != "service1" || dump.Services[0].Address != "1.2.3.4" ||
+		dump.Services[1].ServiceID != "service2" {
+		t.Fatalf("bad: %#v", dump.Services)
+	}
+	if len(dump.Checks) != 2 ||
+		dump.Checks[0].CheckID != "check1" || dump.Checks[1].CheckID != "check2" {
+		t.Fatalf("bad: %#v", dump.Checks)
+	}
+
+	// The dump holds copies, so the stored services keep a blank address.
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	service, err := tx.First("services", "id", "node1", "service1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if addr := service.(*structs.ServiceNode).Address; addr != "" {
+		t.Fatalf("bad: %s", addr)
+	}
+}
+
+func TestStateStore_KVSSet_KVSGet(t *testing.T) {
+	s := testStateStore(t)
+
+	// Get on an nonexistent key returns nil.
+	idx, result, err := s.KVSGet("foo")
+	if result != nil || err != nil || idx != 0 {
+		t.Fatalf("expected (0, nil, nil), got : (%#v, %#v, %#v)", idx, result, err)
+	}
+
+	// Write a new K/V entry to the store.
+	entry := &structs.DirEntry{
+		Key:   "foo",
+		Value: []byte("bar"),
+	}
+	if err := s.KVSSet(1, entry); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Retrieve the K/V entry again.
 	idx, result, err = s.KVSGet("foo")
 	if err != nil {
 		t.Fatalf("err: %s", err)
@@ -2538,6 +3422,28 @@ func TestStateStore_KVSListKeys(t *testing.T) {
 		t.Fatalf("bad keys: %#v", keys)
 	}
 
+	// A depth cuts keys off further down the tree.
+	idx, keys, err = s.KVSListKeysDepth("foo/", "/", 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	expect = []string{"foo/bar", "foo/bar/baz", "foo/bar/zip", "foo/bar/zip/"}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad keys: %#v", keys)
+	}
+	_, keys, err = s.KVSListKeysDepth("foo/", "/", 3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expect = []string{"foo/bar", "foo/bar/baz", "foo/bar/zip",
+		"foo/bar/zip/zam", "foo/bar/zip/zorp"}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad keys: %#v", keys)
+	}
+
 	// Listing keys with no separator returns everything.
 	idx, keys, err = s.KVSListKeys("foo", "")
 	if err != nil {
@@ -2952,6 +3858,57 @@ func TestStateStore_KVSSetCAS(t *testing.T) {
 	}
 }
 
+func TestStateStore_KVSDeleteTreeCAS(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "foo/bar", "bar")
+	testSetKey(t, s, 2, "foo/baz", "baz")
+	testSetKey(t, s, 3, "zip", "zip")
+
+	// The tree's index is the list index, which doesn't move for writes
+	// outside the tree.
+	idx, _, err := s.KVSList("foo/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// A stale index doesn't delete anything.
+	ok, err := s.KVSDeleteTreeCAS(4, 1, "foo/")
+	if ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	if _, ents, err := s.KVSList("foo/"); err != nil || len(ents) != 2 {
+		t.Fatalf("bad: %v (err: %v)", ents, err)
+	}
+
+	// Deleting a key in the tree moves its index, even though the key
+	// is gone.
+	if err := s.KVSDelete(5, "foo/baz"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ok, err := s.KVSDeleteTreeCAS(6, 2, "foo/"); ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+
+	// The current index deletes the tree.
+	if ok, err := s.KVSDeleteTreeCAS(7, 5, "foo/"); !ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	_, ents, err := s.KVSList("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(ents) != 1 || ents[0].Key != "zip" {
+		t.Fatalf("bad: %v", ents)
+	}
+	if idx := s.maxIndex("kvs"); idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
 func TestStateStore_KVSDeleteTree(t *testing.T) {
 	s := testStateStore(t)
 
@@ -3025,325 +3982,563 @@ func TestStateStore_KVSDeleteTree(t *testing.T) {
 	}
 }
 
-func TestStateStore_KVSLockDelay(t *testing.T) {
+func TestStateStore_KVSRecycleTree(t *testing.T) {
 	s := testStateStore(t)
 
-	// KVSLockDelay is exercised in the lock/unlock and session invalidation
-	// cases below, so we just do a basic check on a nonexistent key here.
-	expires := s.KVSLockDelay("/not/there")
-	if expires.After(time.Now()) {
-		t.Fatalf("bad: %v", expires)
-	}
-}
-
-func TestStateStore_KVSLock(t *testing.T) {
-	s := testStateStore(t)
+	// Create kvs entries in the state store
+	testSetKey(t, s, 1, "foo/bar", "bar")
+	testSetKey(t, s, 2, "foo/baz", "baz")
+	testSetKey(t, s, 3, "zip", "zip")
 
-	// Lock with no session should fail.
-	ok, err := s.KVSLock(0, &structs.DirEntry{Key: "foo", Value: []byte("foo")})
-	if ok || err == nil || !strings.Contains(err.Error(), "missing session") {
-		t.Fatalf("didn't detect missing session: %v %s", ok, err)
+	// Recycling a tree that matches nothing doesn't create a bin entry.
+	empty := &structs.KVSRecycled{ID: testUUID(), Prefix: "nope"}
+	if err := s.KVSRecycleTree(4, empty); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Now try with a bogus session.
-	ok, err = s.KVSLock(1, &structs.DirEntry{Key: "foo", Value: []byte("foo"), Session: testUUID()})
-	if ok || err == nil || !strings.Contains(err.Error(), "invalid session") {
-		t.Fatalf("didn't detect invalid session: %v %s", ok, err)
+	if idx := s.maxIndex("kvs_recycle"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Make a real session.
-	testRegisterNode(t, s, 2, "node1")
-	session1 := testUUID()
-	if err := s.SessionCreate(3, &structs.Session{ID: session1, Node: "node1"}); err != nil {
+	// Recycle the foo tree.
+	tree := &structs.KVSRecycled{
+		ID:      testUUID(),
+		Prefix:  "foo/",
+		Expires: time.Now().Add(time.Hour),
+	}
+	if err := s.KVSRecycleTree(5, tree); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Lock and make the key at the same time.
-	ok, err = s.KVSLock(4, &structs.DirEntry{Key: "foo", Value: []byte("foo"), Session: session1})
-	if !ok || err != nil {
-		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	_, entries, err := s.KVSList("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "zip" {
+		t.Fatalf("bad: %#v", entries)
 	}
 
-	// Make sure the indexes got set properly.
-	idx, result, err := s.KVSGet("foo")
+	// The tree should be in the bin.
+	idx, trees, err := s.KVSRecycledList()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 4 ||
-		string(result.Value) != "foo" {
-		t.Fatalf("bad entry: %#v", result)
+	if idx != 5 || len(trees) != 1 {
+		t.Fatalf("bad: %d %#v", idx, trees)
 	}
-	if idx != 4 {
-		t.Fatalf("bad index: %d", idx)
+	if trees[0].ID != tree.ID || trees[0].CreateIndex != 5 || len(trees[0].Entries) != 2 {
+		t.Fatalf("bad: %#v", trees[0])
 	}
 
-	// Re-locking with the same session should update the value and report
-	// success.
-	ok, err = s.KVSLock(5, &structs.DirEntry{Key: "foo", Value: []byte("bar"), Session: session1})
-	if !ok || err != nil {
-		t.Fatalf("didn't handle locking an already-locked key: %v %s", ok, err)
+	// Write one of the keys again, then restore the tree.
+	testSetKey(t, s, 6, "foo/baz", "newer")
+	if err := s.KVSRecycledRestore(7, tree.ID); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Make sure the indexes got set properly, note that the lock index
-	// won't go up since we didn't lock it again.
-	idx, result, err = s.KVSGet("foo")
+	// The deleted key comes back but the newer write is left alone.
+	_, e, err := s.KVSGet("foo/bar")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 5 ||
-		string(result.Value) != "bar" {
-		t.Fatalf("bad entry: %#v", result)
+	if e == nil || string(e.Value) != "bar" || e.ModifyIndex != 7 {
+		t.Fatalf("bad: %#v", e)
 	}
-	if idx != 5 {
-		t.Fatalf("bad index: %d", idx)
+	_, e, err = s.KVSGet("foo/baz")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if e == nil || string(e.Value) != "newer" || e.ModifyIndex != 6 {
+		t.Fatalf("bad: %#v", e)
 	}
 
-	// Unlock and the re-lock.
-	ok, err = s.KVSUnlock(6, &structs.DirEntry{Key: "foo", Value: []byte("baz"), Session: session1})
-	if !ok || err != nil {
-		t.Fatalf("didn't handle unlocking a locked key: %v %s", ok, err)
+	// The tree should be gone from the bin.
+	idx, trees, err = s.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	ok, err = s.KVSLock(7, &structs.DirEntry{Key: "foo", Value: []byte("zoo"), Session: session1})
-	if !ok || err != nil {
-		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	if idx != 7 || len(trees) != 0 {
+		t.Fatalf("bad: %d %#v", idx, trees)
 	}
 
-	// Make sure the indexes got set properly.
-	idx, result, err = s.KVSGet("foo")
+	// Restoring it again should fail.
+	if err := s.KVSRecycledRestore(8, tree.ID); err != ErrMissingRecycledTree {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestStateStore_KVSRecycleTreeCAS(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "foo/bar", "bar")
+	testSetKey(t, s, 2, "foo/baz", "baz")
+
+	// A stale index leaves the tree alone.
+	tree := &structs.KVSRecycled{ID: testUUID(), Prefix: "foo/"}
+	ok, err := s.KVSRecycleTreeCAS(3, 1, tree)
+	if ok || err != nil {
+		t.Fatalf("expected (false, nil), got: (%v, %#v)", ok, err)
+	}
+	_, entries, err := s.KVSList("foo/")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 2 || result.CreateIndex != 4 || result.ModifyIndex != 7 ||
-		string(result.Value) != "zoo" {
-		t.Fatalf("bad entry: %#v", result)
+	if len(entries) != 2 {
+		t.Fatalf("bad: %#v", entries)
 	}
-	if idx != 7 {
+	if idx := s.maxIndex("kvs_recycle"); idx != 0 {
 		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Lock an existing key.
-	testSetKey(t, s, 8, "bar", "bar")
-	ok, err = s.KVSLock(9, &structs.DirEntry{Key: "bar", Value: []byte("xxx"), Session: session1})
+	// The current index recycles it.
+	ok, err = s.KVSRecycleTreeCAS(3, 2, tree)
 	if !ok || err != nil {
-		t.Fatalf("didn't get the lock: %v %s", ok, err)
+		t.Fatalf("expected (true, nil), got: (%v, %#v)", ok, err)
 	}
-
-	// Make sure the indexes got set properly.
-	idx, result, err = s.KVSGet("bar")
+	_, trees, err := s.KVSRecycledList()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 8 || result.ModifyIndex != 9 ||
-		string(result.Value) != "xxx" {
-		t.Fatalf("bad entry: %#v", result)
-	}
-	if idx != 9 {
-		t.Fatalf("bad index: %d", idx)
+	if len(trees) != 1 || len(trees[0].Entries) != 2 {
+		t.Fatalf("bad: %#v", trees)
 	}
+}
 
-	// Attempting a re-lock with a different session should also fail.
-	session2 := testUUID()
-	if err := s.SessionCreate(10, &structs.Session{ID: session2, Node: "node1"}); err != nil {
+func TestStateStore_KVSRecycledReap(t *testing.T) {
+	s := testStateStore(t)
+
+	// Recycle two trees with different expiration times.
+	now := time.Now()
+	testSetKey(t, s, 1, "foo", "foo")
+	testSetKey(t, s, 2, "bar", "bar")
+	old := &structs.KVSRecycled{ID: testUUID(), Prefix: "foo", Expires: now}
+	if err := s.KVSRecycleTree(3, old); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fresh := &structs.KVSRecycled{ID: testUUID(), Prefix: "bar", Expires: now.Add(time.Hour)}
+	if err := s.KVSRecycleTree(4, fresh); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Re-locking should not return an error, but will report that it didn't
-	// get the lock.
-	ok, err = s.KVSLock(11, &structs.DirEntry{Key: "bar", Value: []byte("nope"), Session: session2})
-	if ok || err != nil {
-		t.Fatalf("didn't handle locking an already-locked key: %v %s", ok, err)
+	// Reaping before anything expires is a no-op.
+	if err := s.KVSRecycledReap(5, now); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("kvs_recycle"); idx != 4 {
+		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Make sure the indexes didn't update.
-	idx, result, err = s.KVSGet("bar")
-	if err != nil {
+	// Reap just the older tree.
+	if err := s.KVSRecycledReap(6, now.Add(time.Minute)); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 8 || result.ModifyIndex != 9 ||
-		string(result.Value) != "xxx" {
-		t.Fatalf("bad entry: %#v", result)
+	idx, trees, err := s.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if idx != 9 {
-		t.Fatalf("bad index: %d", idx)
+	if idx != 6 || len(trees) != 1 || trees[0].ID != fresh.ID {
+		t.Fatalf("bad: %d %#v", idx, trees)
 	}
 }
 
-func TestStateStore_KVSUnlock(t *testing.T) {
+func TestStateStore_ReapExpiredKeys(t *testing.T) {
 	s := testStateStore(t)
 
-	// Unlock with no session should fail.
-	ok, err := s.KVSUnlock(0, &structs.DirEntry{Key: "foo", Value: []byte("bar")})
-	if ok || err == nil || !strings.Contains(err.Error(), "missing session") {
-		t.Fatalf("didn't detect missing session: %v %s", ok, err)
+	// Write a key that never expires, one that expires soon, and one that
+	// expires later.
+	now := time.Now()
+	testSetKey(t, s, 1, "foo/forever", "forever")
+	for i, expires := range []time.Time{now, now.Add(time.Hour)} {
+		entry := &structs.DirEntry{
+			Key:       fmt.Sprintf("foo/expires%d", i+1),
+			Value:     []byte("ephemeral"),
+			ExpiresAt: expires,
+		}
+		if err := s.KVSSet(uint64(2+i), entry); err != nil {
+			t.Fatalf("err: %s", err)
+		}
 	}
 
-	// Make a real session.
-	testRegisterNode(t, s, 1, "node1")
-	session1 := testUUID()
-	if err := s.SessionCreate(2, &structs.Session{ID: session1, Node: "node1"}); err != nil {
+	// Nothing has expired yet.
+	expired, err := s.ExpiredKeys(now)
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("bad: %#v (err: %v)", expired, err)
+	}
+	if err := s.ReapExpiredKeys(4, now); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Unlock with a real session but no key should not return an error, but
-	// will report it didn't unlock anything.
-	ok, err = s.KVSUnlock(3, &structs.DirEntry{Key: "foo", Value: []byte("bar"), Session: session1})
-	if ok || err != nil {
-		t.Fatalf("didn't handle unlocking a missing key: %v %s", ok, err)
+	if idx := s.maxIndex("kvs"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Make a key and unlock it, without it being locked.
-	testSetKey(t, s, 4, "foo", "bar")
-	ok, err = s.KVSUnlock(5, &structs.DirEntry{Key: "foo", Value: []byte("baz"), Session: session1})
-	if ok || err != nil {
-		t.Fatalf("didn't handle unlocking a non-locked key: %v %s", ok, err)
+	// Reap just the first expiring key.
+	expired, err = s.ExpiredKeys(now.Add(time.Minute))
+	if err != nil || len(expired) != 1 || expired[0].Key != "foo/expires1" {
+		t.Fatalf("bad: %#v (err: %v)", expired, err)
 	}
-
-	// Make sure the indexes didn't update.
-	idx, result, err := s.KVSGet("foo")
-	if err != nil {
+	if err := s.ReapExpiredKeys(5, now.Add(time.Minute)); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 0 || result.CreateIndex != 4 || result.ModifyIndex != 4 ||
-		string(result.Value) != "bar" {
-		t.Fatalf("bad entry: %#v", result)
+	idx, keys, err := s.KVSListKeys("foo/", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if idx != 4 {
-		t.Fatalf("bad index: %d", idx)
+	if idx != 5 || !reflect.DeepEqual(keys, []string{"foo/expires2", "foo/forever"}) {
+		t.Fatalf("bad: %d %v", idx, keys)
 	}
+}
 
-	// Lock it with the first session.
-	ok, err = s.KVSLock(6, &structs.DirEntry{Key: "foo", Value: []byte("bar"), Session: session1})
-	if !ok || err != nil {
-		t.Fatalf("didn't get the lock: %v %s", ok, err)
+func TestStateStore_KVSImport(t *testing.T) {
+	s := testStateStore(t)
+
+	// Start with a tree that has a locked key and a key the import
+	// doesn't have.
+	testSetKey(t, s, 1, "prod/a", "old")
+	testSetKey(t, s, 2, "prod/stale", "stale")
+	testSetKey(t, s, 3, "staging/a", "staging")
+	testRegisterNode(t, s, 4, "node1")
+	session := testUUID()
+	if err := s.SessionCreate(5, &structs.Session{ID: session, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ok, err := s.KVSLock(6, &structs.DirEntry{Key: "prod/a", Session: session}); !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
 	}
 
-	// Attempt an unlock with another session.
-	session2 := testUUID()
-	if err := s.SessionCreate(7, &structs.Session{ID: session2, Node: "node1"}); err != nil {
+	entries := structs.DirEntries{
+		&structs.DirEntry{Key: "prod/a", Value: []byte("new"), Flags: 42},
+		&structs.DirEntry{Key: "prod/b/c", Value: []byte("nested")},
+	}
+	if err := s.KVSImport(7, "prod/", entries, nil, nil); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	ok, err = s.KVSUnlock(8, &structs.DirEntry{Key: "foo", Value: []byte("zoo"), Session: session2})
+
+	// The tree was replaced, and nothing outside it was touched.
+	idx, ents, err := s.KVSList("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 7 || len(ents) != 3 {
+		t.Fatalf("bad: %d %v", idx, ents)
+	}
+	a, c, staging := ents[0], ents[1], ents[2]
+	if a.Key != "prod/a" || string(a.Value) != "new" || a.Flags != 42 ||
+		a.Session != "" || a.CreateIndex != 7 || a.ModifyIndex != 7 {
+		t.Fatalf("bad: %#v", a)
+	}
+	if c.Key != "prod/b/c" || string(c.Value) != "nested" {
+		t.Fatalf("bad: %#v", c)
+	}
+	if staging.Key != "staging/a" || staging.ModifyIndex != 3 {
+		t.Fatalf("bad: %#v", staging)
+	}
+}
+
+func TestStateStore_KVSImport_ChunksRecycle(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "prod/a", "old")
+	upload := testUUID()
+	expires := time.Now().Add(time.Hour)
+	if err := s.KVSUploadChunk(2, upload, 0, []byte("big "), expires); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.KVSUploadChunk(3, upload, 1, []byte("value"), expires); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entries := structs.DirEntries{
+		&structs.DirEntry{Key: "prod/b"},
+	}
+	uploads := map[string]structs.KVSUploadRef{
+		"prod/b": structs.KVSUploadRef{ID: upload, Chunks: 2},
+	}
+	tree := &structs.KVSRecycled{ID: testUUID(), Expires: expires}
+	if err := s.KVSImport(4, "prod/", entries, uploads, tree); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The chunked value was put together.
+	_, ents, err := s.KVSList("prod/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(ents) != 1 || ents[0].Key != "prod/b" || string(ents[0].Value) != "big value" {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// The old tree is in the recycle bin.
+	_, trees, err := s.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(trees) != 1 || trees[0].ID != tree.ID || trees[0].Prefix != "prod/" ||
+		len(trees[0].Entries) != 1 || trees[0].Entries[0].Key != "prod/a" {
+		t.Fatalf("bad: %#v", trees)
+	}
+}
+
+func TestStateStore_KVSMove(t *testing.T) {
+	s := testStateStore(t)
+
+	// Nothing to move.
+	ok, err := s.KVSMove(1, "foo", "bar", false, false)
 	if ok || err != nil {
-		t.Fatalf("didn't handle unlocking with the wrong session: %v %s", ok, err)
+		t.Fatalf("bad: %v %s", ok, err)
 	}
 
-	// Make sure the indexes didn't update.
-	idx, result, err = s.KVSGet("foo")
+	// Move a single key, keeping its flags.
+	if err := s.KVSSet(2, &structs.DirEntry{Key: "foo", Value: []byte("foo"), Flags: 42}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testSetKey(t, s, 3, "foo/bar", "bar")
+	if ok, err := s.KVSMove(4, "foo", "baz", false, false); !ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	_, e, err := s.KVSGet("baz")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 6 ||
-		string(result.Value) != "bar" {
-		t.Fatalf("bad entry: %#v", result)
+	if e == nil || string(e.Value) != "foo" || e.Flags != 42 || e.CreateIndex != 4 {
+		t.Fatalf("bad: %#v", e)
 	}
-	if idx != 6 {
+	_, e, err = s.KVSGet("foo")
+	if err != nil || e != nil {
+		t.Fatalf("bad: %#v (err: %v)", e, err)
+	}
+
+	// The old key got a tombstone.
+	if idx := s.maxIndex("tombstones"); idx != 4 {
 		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Now do the unlock with the correct session.
-	ok, err = s.KVSUnlock(9, &structs.DirEntry{Key: "foo", Value: []byte("zoo"), Session: session1})
-	if !ok || err != nil {
-		t.Fatalf("didn't handle unlocking with the correct session: %v %s", ok, err)
+	// An existing destination is left alone when asked.
+	testSetKey(t, s, 5, "new/bar", "taken")
+	if ok, err := s.KVSMove(6, "foo/", "new/", true, true); ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	_, e, err = s.KVSGet("foo/bar")
+	if err != nil || e == nil {
+		t.Fatalf("bad: %#v (err: %v)", e, err)
 	}
 
-	// Make sure the indexes got set properly.
-	idx, result, err = s.KVSGet("foo")
+	// Otherwise it's overwritten.
+	if ok, err := s.KVSMove(7, "foo/", "new/", true, false); !ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	idx, ents, err := s.KVSList("")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 9 ||
-		string(result.Value) != "zoo" {
-		t.Fatalf("bad entry: %#v", result)
+	if idx != 7 || len(ents) != 2 {
+		t.Fatalf("bad: %d %v", idx, ents)
 	}
-	if idx != 9 {
-		t.Fatalf("bad index: %d", idx)
+	if ents[0].Key != "baz" || ents[1].Key != "new/bar" || string(ents[1].Value) != "bar" {
+		t.Fatalf("bad: %v", ents)
 	}
 
-	// Unlocking again should fail and not change anything.
-	ok, err = s.KVSUnlock(10, &structs.DirEntry{Key: "foo", Value: []byte("nope"), Session: session1})
-	if ok || err != nil {
-		t.Fatalf("didn't handle unlocking with the previous session: %v %s", ok, err)
+	// Locked keys aren't moved, on their own or with a prefix.
+	testRegisterNode(t, s, 8, "node1")
+	session := testUUID()
+	if err := s.SessionCreate(9, &structs.Session{ID: session, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ok, err := s.KVSLock(10, &structs.DirEntry{Key: "new/lock", Session: session}); !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+	if ok, err := s.KVSMove(11, "new/lock", "lock", false, false); ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	if ok, err := s.KVSMove(12, "new/", "old/", true, false); ok || err != nil {
+		t.Fatalf("bad: %v %s", ok, err)
+	}
+	_, e, err = s.KVSGet("new/lock")
+	if err != nil || e == nil || e.Session != session {
+		t.Fatalf("bad: %#v (err: %v)", e, err)
+	}
+	_, e, err = s.KVSGet("new/bar")
+	if err != nil || e == nil {
+		t.Fatalf("bad: %#v (err: %v)", e, err)
 	}
+}
 
-	// Make sure the indexes didn't update.
-	idx, result, err = s.KVSGet("foo")
+func TestStateStore_KVSUpload(t *testing.T) {
+	s := testStateStore(t)
+
+	// Chunks have to come in order.
+	id := testUUID()
+	expires := time.Now().Add(time.Hour)
+	if err := s.KVSUploadChunk(1, id, 1, []byte("world"), expires); err == nil {
+		t.Fatalf("should have failed")
+	}
+	for i, chunk := range []string{"hello ", "world"} {
+		if err := s.KVSUploadChunk(uint64(2+i), id, i, []byte(chunk), expires); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if idx := s.maxIndex("kvs_uploads"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// The chunk count has to match.
+	if _, err := s.KVSUploadComplete(4, id, 3); err == nil {
+		t.Fatalf("should have failed")
+	}
+	value, err := s.KVSUploadComplete(5, id, 2)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 9 ||
-		string(result.Value) != "zoo" {
-		t.Fatalf("bad entry: %#v", result)
+	if string(value) != "hello world" {
+		t.Fatalf("bad: %s", value)
 	}
-	if idx != 9 {
+
+	// The upload is used up.
+	if _, err := s.KVSUploadComplete(6, id, 2); err == nil {
+		t.Fatalf("should have failed")
+	}
+	if idx := s.maxIndex("kvs_uploads"); idx != 5 {
 		t.Fatalf("bad index: %d", idx)
 	}
+
+	// Abandoned uploads are reaped with the expired keys.
+	now := time.Now()
+	if err := s.KVSUploadChunk(7, id, 0, []byte("abandoned"), now); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	uploads, err := s.ExpiredUploads(now.Add(time.Minute))
+	if err != nil || len(uploads) != 1 || uploads[0].ID != id {
+		t.Fatalf("bad: %#v (err: %v)", uploads, err)
+	}
+	if err := s.ReapExpiredKeys(8, now.Add(time.Minute)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	uploads, err = s.ExpiredUploads(now.Add(time.Minute))
+	if err != nil || len(uploads) != 0 {
+		t.Fatalf("bad: %#v (err: %v)", uploads, err)
+	}
 }
 
-func TestStateStore_KVS_Snapshot_Restore(t *testing.T) {
+func TestStateStore_KVSHistory(t *testing.T) {
 	s := testStateStore(t)
 
-	// Build up some entries to seed.
-	entries := structs.DirEntries{
-		&structs.DirEntry{
-			Key:   "aaa",
-			Flags: 23,
-			Value: []byte("hello"),
-		},
-		&structs.DirEntry{
-			Key:   "bar/a",
-			Value: []byte("one"),
-		},
-		&structs.DirEntry{
-			Key:   "bar/b",
-			Value: []byte("two"),
-		},
-		&structs.DirEntry{
-			Key:   "bar/c",
-			Value: []byte("three"),
-		},
+	// Write more versions than are kept.
+	for i := 1; i <= kvsHistoryRetain+2; i++ {
+		testSetKey(t, s, uint64(i), "foo", fmt.Sprintf("v%d", i))
 	}
-	for i, entry := range entries {
-		if err := s.KVSSet(uint64(i+1), entry); err != nil {
+	testSetKey(t, s, 20, "foo/bar", "bar")
+
+	// Only the newest ones are left, oldest first.
+	idx, history, err := s.KVSHistory("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 20 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(history) != kvsHistoryRetain {
+		t.Fatalf("bad: %#v", history)
+	}
+	if string(history[0].Value) != "v3" || history[0].ModifyIndex != 3 {
+		t.Fatalf("bad: %#v", history[0])
+	}
+	if last := history[len(history)-1]; string(last.Value) != "v12" {
+		t.Fatalf("bad: %#v", last)
+	}
+
+	// Versions can be looked up by the index they were written at.
+	_, ent, err := s.KVSGetVersion("foo", 5)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ent == nil || string(ent.Value) != "v5" {
+		t.Fatalf("bad: %#v", ent)
+	}
+	_, ent, err = s.KVSGetVersion("foo", 1)
+	if err != nil || ent != nil {
+		t.Fatalf("bad: %#v (err: %v)", ent, err)
+	}
+
+	// The history outlives a delete until the tombstone is reaped.
+	if err := s.KVSDelete(21, "foo"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, history, err = s.KVSHistory("foo")
+	if err != nil || len(history) != kvsHistoryRetain {
+		t.Fatalf("bad: %#v (err: %v)", history, err)
+	}
+	if err := s.ReapTombstones(21); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, history, err = s.KVSHistory("foo")
+	if err != nil || len(history) != 0 {
+		t.Fatalf("bad: %#v (err: %v)", history, err)
+	}
+	_, history, err = s.KVSHistory("foo/bar")
+	if err != nil || len(history) != 1 {
+		t.Fatalf("bad: %#v (err: %v)", history, err)
+	}
+
+	// Snapshot and restore the history.
+	snap := s.Snapshot()
+	defer snap.Close()
+	dump, err := snap.KVSHistory()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(dump) != 1 || dump[0].Key != "foo/bar" {
+		t.Fatalf("bad: %#v", dump)
+	}
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	for _, entry := range dump {
+		if err := restore.KVSVersion(entry); err != nil {
 			t.Fatalf("err: %s", err)
 		}
 	}
-
-	// Make a node and session so we can test a locked key.
-	testRegisterNode(t, s, 5, "node1")
-	session := testUUID()
-	if err := s.SessionCreate(6, &structs.Session{ID: session, Node: "node1"}); err != nil {
+	restore.Commit()
+	_, ent, err = s2.KVSGetVersion("foo/bar", 20)
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	entries[3].Session = session
-	if ok, err := s.KVSLock(7, entries[3]); !ok || err != nil {
-		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	if ent == nil || string(ent.Value) != "bar" {
+		t.Fatalf("bad: %#v", ent)
+	}
+	if idx := s2.maxIndex("kvs_history"); idx != 20 {
+		t.Fatalf("bad index: %d", idx)
 	}
+}
 
-	// This is required for the compare later.
-	entries[3].LockIndex = 1
+func TestStateStore_KVSRecycled_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
 
-	// Snapshot the keys.
+	// Recycle a tree.
+	testSetKey(t, s, 1, "foo/bar", "bar")
+	tree := &structs.KVSRecycled{
+		ID:      testUUID(),
+		Prefix:  "foo/",
+		Expires: time.Now().Add(time.Hour),
+	}
+	if err := s.KVSRecycleTree(2, tree); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Snapshot the bin.
 	snap := s.Snapshot()
 	defer snap.Close()
 
 	// Alter the real state store.
-	if err := s.KVSSet(8, &structs.DirEntry{Key: "aaa", Value: []byte("nope")}); err != nil {
+	if err := s.KVSRecycledRestore(3, tree.ID); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
 	// Verify the snapshot.
-	if idx := snap.LastIndex(); idx != 7 {
-		t.Fatalf("bad index: %d", idx)
-	}
-	iter, err := snap.KVs()
+	iter, err := snap.KVSRecycled()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	var dump structs.DirEntries
-	for entry := iter.Next(); entry != nil; entry = iter.Next() {
-		dump = append(dump, entry.(*structs.DirEntry))
+	var dump structs.KVSRecycledTrees
+	for tree := iter.Next(); tree != nil; tree = iter.Next() {
+		dump = append(dump, tree.(*structs.KVSRecycled))
 	}
-	if !reflect.DeepEqual(dump, entries) {
+	if len(dump) != 1 || dump[0].ID != tree.ID {
 		t.Fatalf("bad: %#v", dump)
 	}
 
@@ -3351,1674 +4546,3788 @@ func TestStateStore_KVS_Snapshot_Restore(t *testing.T) {
 	func() {
 		s := testStateStore(t)
 		restore := s.Restore()
-		for _, entry := range dump {
-			if err := restore.KVS(entry); err != nil {
+		for _, tree := range dump {
+			if err := restore.KVSRecycled(tree); err != nil {
 				t.Fatalf("err: %s", err)
 			}
 		}
 		restore.Commit()
 
-		// Read the restored keys back out and verify they match.
-		idx, res, err := s.KVSList("")
+		// Read the restored bin back out and verify it matches.
+		idx, res, err := s.KVSRecycledList()
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if idx != 7 {
+		if idx != 2 {
 			t.Fatalf("bad index: %d", idx)
 		}
-		if !reflect.DeepEqual(res, entries) {
+		if !reflect.DeepEqual(res, dump) {
 			t.Fatalf("bad: %#v", res)
 		}
-
-		// Check that the index was updated.
-		if idx := s.maxIndex("kvs"); idx != 7 {
-			t.Fatalf("bad index: %d", idx)
-		}
 	}()
 }
 
-func TestStateStore_KVS_Watches(t *testing.T) {
+func TestStateStore_KVSLockDelay(t *testing.T) {
 	s := testStateStore(t)
 
-	// This is used when locking down below.
-	testRegisterNode(t, s, 1, "node1")
-	session := testUUID()
-	if err := s.SessionCreate(2, &structs.Session{ID: session, Node: "node1"}); err != nil {
-		t.Fatalf("err: %s", err)
+	// KVSLockDelay is exercised in the lock/unlock and session invalidation
+	// cases below, so we just do a basic check on a nonexistent key here.
+	expires := s.KVSLockDelay("/not/there")
+	if expires.After(time.Now()) {
+		t.Fatalf("bad: %v", expires)
 	}
+}
 
-	// An empty prefix watch should hit on all KVS ops, and some other
-	// prefix should not be affected ever. We also add a positive prefix
-	// match.
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if err := s.KVSSet(1, &structs.DirEntry{Key: "aaa"}); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-			})
-		})
-	})
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if err := s.KVSSet(2, &structs.DirEntry{Key: "aaa"}); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-			})
-		})
-	})
+func TestStateStore_KVSLock(t *testing.T) {
+	s := testStateStore(t)
 
-	// Restore just fires off a top-level watch, so we should get hits on
-	// any prefix, including ones for keys that aren't in there.
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("b"), func() {
-			verifyWatch(t, s.GetKVSWatch("/nope"), func() {
-				restore := s.Restore()
-				if err := restore.KVS(&structs.DirEntry{Key: "bbb"}); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-				restore.Commit()
+	// Lock with no session should fail.
+	ok, err := s.KVSLock(0, &structs.DirEntry{Key: "foo", Value: []byte("foo")})
+	if ok || err == nil || !strings.Contains(err.Error(), "missing session") {
+		t.Fatalf("didn't detect missing session: %v %s", ok, err)
+	}
+
+	// Now try with a bogus session.
+	ok, err = s.KVSLock(1, &structs.DirEntry{Key: "foo", Value: []byte("foo"), Session: testUUID()})
+	if ok || err == nil || !strings.Contains(err.Error(), "invalid session") {
+		t.Fatalf("didn't detect invalid session: %v %s", ok, err)
+	}
+
+	// Make a real session.
+	testRegisterNode(t, s, 2, "node1")
+	session1 := testUUID()
+	if err := s.SessionCreate(3, &structs.Session{ID: session1, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Lock and make the key at the same time.
+	ok, err = s.KVSLock(4, &structs.DirEntry{Key: "foo", Value: []byte("foo"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+
+	// Make sure the indexes got set properly.
+	idx, result, err := s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 4 ||
+		string(result.Value) != "foo" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 4 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Re-locking with the same session should update the value and report
+	// success.
+	ok, err = s.KVSLock(5, &structs.DirEntry{Key: "foo", Value: []byte("bar"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't handle locking an already-locked key: %v %s", ok, err)
+	}
+
+	// Make sure the indexes got set properly, note that the lock index
+	// won't go up since we didn't lock it again.
+	idx, result, err = s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 5 ||
+		string(result.Value) != "bar" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 5 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Unlock and the re-lock.
+	ok, err = s.KVSUnlock(6, &structs.DirEntry{Key: "foo", Value: []byte("baz"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't handle unlocking a locked key: %v %s", ok, err)
+	}
+	ok, err = s.KVSLock(7, &structs.DirEntry{Key: "foo", Value: []byte("zoo"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+
+	// Make sure the indexes got set properly.
+	idx, result, err = s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 2 || result.CreateIndex != 4 || result.ModifyIndex != 7 ||
+		string(result.Value) != "zoo" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Lock an existing key.
+	testSetKey(t, s, 8, "bar", "bar")
+	ok, err = s.KVSLock(9, &structs.DirEntry{Key: "bar", Value: []byte("xxx"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+
+	// Make sure the indexes got set properly.
+	idx, result, err = s.KVSGet("bar")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 8 || result.ModifyIndex != 9 ||
+		string(result.Value) != "xxx" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 9 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Attempting a re-lock with a different session should also fail.
+	session2 := testUUID()
+	if err := s.SessionCreate(10, &structs.Session{ID: session2, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Re-locking should not return an error, but will report that it didn't
+	// get the lock.
+	ok, err = s.KVSLock(11, &structs.DirEntry{Key: "bar", Value: []byte("nope"), Session: session2})
+	if ok || err != nil {
+		t.Fatalf("didn't handle locking an already-locked key: %v %s", ok, err)
+	}
+
+	// Make sure the indexes didn't update.
+	idx, result, err = s.KVSGet("bar")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 8 || result.ModifyIndex != 9 ||
+		string(result.Value) != "xxx" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 9 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_KVSUnlock(t *testing.T) {
+	s := testStateStore(t)
+
+	// Unlock with no session should fail.
+	ok, err := s.KVSUnlock(0, &structs.DirEntry{Key: "foo", Value: []byte("bar")})
+	if ok || err == nil || !strings.Contains(err.Error(), "missing session") {
+		t.Fatalf("didn't detect missing session: %v %s", ok, err)
+	}
+
+	// Make a real session.
+	testRegisterNode(t, s, 1, "node1")
+	session1 := testUUID()
+	if err := s.SessionCreate(2, &structs.Session{ID: session1, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Unlock with a real session but no key should not return an error, but
+	// will report it didn't unlock anything.
+	ok, err = s.KVSUnlock(3, &structs.DirEntry{Key: "foo", Value: []byte("bar"), Session: session1})
+	if ok || err != nil {
+		t.Fatalf("didn't handle unlocking a missing key: %v %s", ok, err)
+	}
+
+	// Make a key and unlock it, without it being locked.
+	testSetKey(t, s, 4, "foo", "bar")
+	ok, err = s.KVSUnlock(5, &structs.DirEntry{Key: "foo", Value: []byte("baz"), Session: session1})
+	if ok || err != nil {
+		t.Fatalf("didn't handle unlocking a non-locked key: %v %s", ok, err)
+	}
+
+	// Make sure the indexes didn't update.
+	idx, result, err := s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 0 || result.CreateIndex != 4 || result.ModifyIndex != 4 ||
+		string(result.Value) != "bar" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 4 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Lock it with the first session.
+	ok, err = s.KVSLock(6, &structs.DirEntry{Key: "foo", Value: []byte("bar"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+
+	// Attempt an unlock with another session.
+	session2 := testUUID()
+	if err := s.SessionCreate(7, &structs.Session{ID: session2, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ok, err = s.KVSUnlock(8, &structs.DirEntry{Key: "foo", Value: []byte("zoo"), Session: session2})
+	if ok || err != nil {
+		t.Fatalf("didn't handle unlocking with the wrong session: %v %s", ok, err)
+	}
+
+	// Make sure the indexes didn't update.
+	idx, result, err = s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 6 ||
+		string(result.Value) != "bar" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Now do the unlock with the correct session.
+	ok, err = s.KVSUnlock(9, &structs.DirEntry{Key: "foo", Value: []byte("zoo"), Session: session1})
+	if !ok || err != nil {
+		t.Fatalf("didn't handle unlocking with the correct session: %v %s", ok, err)
+	}
+
+	// Make sure the indexes got set properly.
+	idx, result, err = s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 9 ||
+		string(result.Value) != "zoo" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 9 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Unlocking again should fail and not change anything.
+	ok, err = s.KVSUnlock(10, &structs.DirEntry{Key: "foo", Value: []byte("nope"), Session: session1})
+	if ok || err != nil {
+		t.Fatalf("didn't handle unlocking with the previous session: %v %s", ok, err)
+	}
+
+	// Make sure the indexes didn't update.
+	idx, result, err = s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.LockIndex != 1 || result.CreateIndex != 4 || result.ModifyIndex != 9 ||
+		string(result.Value) != "zoo" {
+		t.Fatalf("bad entry: %#v", result)
+	}
+	if idx != 9 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_TxnRW(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "foo/a", "1")
+	testSetKey(t, s, 2, "foo/b", "2")
+
+	// Make a session to lock with.
+	testRegisterNode(t, s, 3, "node1")
+	session := testUUID()
+	if err := s.SessionCreate(4, &structs.Session{ID: session, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ops := structs.TxnOps{
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSGet,
+				DirEnt: structs.DirEntry{Key: "foo/a"},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: structs.KVSCAS,
+				DirEnt: structs.DirEntry{
+					Key:       "foo/b",
+					Value:     []byte("new"),
+					RaftIndex: structs.RaftIndex{ModifyIndex: 2},
+				},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSDelete,
+				DirEnt: structs.DirEntry{Key: "foo/a"},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSLock,
+				DirEnt: structs.DirEntry{Key: "foo/lock", Session: session},
+			},
+		},
+	}
+	results, errors := s.TxnRW(5, ops)
+	if len(errors) != 0 {
+		t.Fatalf("err: %v", errors)
+	}
+	if len(results) != 4 {
+		t.Fatalf("bad: %v", results)
+	}
+	if kv := results[0].KV; kv.Key != "foo/a" || string(kv.Value) != "1" || kv.ModifyIndex != 1 {
+		t.Fatalf("bad: %v", kv)
+	}
+	if kv := results[1].KV; kv.Key != "foo/b" || kv.Value != nil || kv.ModifyIndex != 5 {
+		t.Fatalf("bad: %v", kv)
+	}
+	if results[2].KV != nil {
+		t.Fatalf("bad: %v", results[2].KV)
+	}
+	if kv := results[3].KV; kv.Session != session || kv.LockIndex != 1 {
+		t.Fatalf("bad: %v", kv)
+	}
+
+	// Everything was applied.
+	idx, entries, err := s.KVSList("foo/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(entries) != 2 ||
+		entries[0].Key != "foo/b" || string(entries[0].Value) != "new" ||
+		entries[1].Key != "foo/lock" {
+		t.Fatalf("bad: %d %v", idx, entries)
+	}
+
+	// A stale CAS rolls back the whole transaction, and a get of a
+	// missing key fails too.
+	ops = structs.TxnOps{
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSSet,
+				DirEnt: structs.DirEntry{Key: "foo/c", Value: []byte("3")},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: structs.KVSCAS,
+				DirEnt: structs.DirEntry{
+					Key:       "foo/b",
+					Value:     []byte("newer"),
+					RaftIndex: structs.RaftIndex{ModifyIndex: 2},
+				},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSGet,
+				DirEnt: structs.DirEntry{Key: "foo/a"},
+			},
+		},
+	}
+	results, errors = s.TxnRW(6, ops)
+	if results != nil {
+		t.Fatalf("bad: %v", results)
+	}
+	if len(errors) != 2 || errors[0].OpIndex != 1 || errors[1].OpIndex != 2 ||
+		!strings.Contains(errors[0].What, "index is stale") ||
+		!strings.Contains(errors[1].What, "doesn't exist") {
+		t.Fatalf("bad: %v", errors)
+	}
+
+	// Nothing was applied.
+	idx, entries, err = s.KVSList("foo/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(entries) != 2 || string(entries[0].Value) != "new" {
+		t.Fatalf("bad: %d %v", idx, entries)
+	}
+}
+
+func TestStateStore_TxnRW_ChunksRecycle(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "foo/a", "1")
+	upload := testUUID()
+	expires := time.Now().Add(time.Hour)
+	if err := s.KVSUploadChunk(2, upload, 0, []byte("hello "), expires); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.KVSUploadChunk(3, upload, 1, []byte("world"), expires); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	tree := &structs.KVSRecycled{ID: testUUID(), Prefix: "foo/", Expires: expires}
+	ops := structs.TxnOps{
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:     structs.KVSDeleteTree,
+				DirEnt:   structs.DirEntry{Key: "foo/"},
+				Recycled: tree,
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:    structs.KVSSet,
+				DirEnt:  structs.DirEntry{Key: "bar"},
+				ChunkID: upload,
+				Chunks:  2,
+			},
+		},
+	}
+	if _, errors := s.TxnRW(4, ops); len(errors) != 0 {
+		t.Fatalf("err: %v", errors)
+	}
+
+	// The chunked value is put together and the upload used up.
+	_, e, err := s.KVSGet("bar")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if e == nil || string(e.Value) != "hello world" {
+		t.Fatalf("bad: %#v", e)
+	}
+	if _, err := s.KVSUploadComplete(5, upload, 2); err == nil {
+		t.Fatalf("upload should be gone")
+	}
+
+	// The deleted tree is in the recycle bin.
+	_, trees, err := s.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(trees) != 1 || trees[0].ID != tree.ID || len(trees[0].Entries) != 1 {
+		t.Fatalf("bad: %#v", trees)
+	}
+}
+
+func TestStateStore_KVS_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	// Build up some entries to seed.
+	entries := structs.DirEntries{
+		&structs.DirEntry{
+			Key:   "aaa",
+			Flags: 23,
+			Value: []byte("hello"),
+		},
+		&structs.DirEntry{
+			Key:   "bar/a",
+			Value: []byte("one"),
+		},
+		&structs.DirEntry{
+			Key:   "bar/b",
+			Value: []byte("two"),
+		},
+		&structs.DirEntry{
+			Key:   "bar/c",
+			Value: []byte("three"),
+		},
+	}
+	for i, entry := range entries {
+		if err := s.KVSSet(uint64(i+1), entry); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Make a node and session so we can test a locked key.
+	testRegisterNode(t, s, 5, "node1")
+	session := testUUID()
+	if err := s.SessionCreate(6, &structs.Session{ID: session, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	entries[3].Session = session
+	if ok, err := s.KVSLock(7, entries[3]); !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+
+	// This is required for the compare later.
+	entries[3].LockIndex = 1
+
+	// Snapshot the keys.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.KVSSet(8, &structs.DirEntry{Key: "aaa", Value: []byte("nope")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	if idx := snap.LastIndex(); idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	iter, err := snap.KVs()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var dump structs.DirEntries
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		dump = append(dump, entry.(*structs.DirEntry))
+	}
+	if !reflect.DeepEqual(dump, entries) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, entry := range dump {
+			if err := restore.KVS(entry); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		// Read the restored keys back out and verify they match.
+		idx, res, err := s.KVSList("")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 7 {
+			t.Fatalf("bad index: %d", idx)
+		}
+		if !reflect.DeepEqual(res, entries) {
+			t.Fatalf("bad: %#v", res)
+		}
+
+		// Check that the index was updated.
+		if idx := s.maxIndex("kvs"); idx != 7 {
+			t.Fatalf("bad index: %d", idx)
+		}
+	}()
+}
+
+func TestStateStore_KVS_Watches(t *testing.T) {
+	s := testStateStore(t)
+
+	// This is used when locking down below.
+	testRegisterNode(t, s, 1, "node1")
+	session := testUUID()
+	if err := s.SessionCreate(2, &structs.Session{ID: session, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// An empty prefix watch should hit on all KVS ops, and some other
+	// prefix should not be affected ever. We also add a positive prefix
+	// match.
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if err := s.KVSSet(1, &structs.DirEntry{Key: "aaa"}); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			})
+		})
+	})
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if err := s.KVSSet(2, &structs.DirEntry{Key: "aaa"}); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			})
+		})
+	})
+
+	// Restore just fires off a top-level watch, so we should get hits on
+	// any prefix, including ones for keys that aren't in there.
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("b"), func() {
+			verifyWatch(t, s.GetKVSWatch("/nope"), func() {
+				restore := s.Restore()
+				if err := restore.KVS(&structs.DirEntry{Key: "bbb"}); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				restore.Commit()
+			})
+		})
+	})
+
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if err := s.KVSDelete(3, "aaa"); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			})
+		})
+	})
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if ok, err := s.KVSSetCAS(4, &structs.DirEntry{Key: "aaa"}); !ok || err != nil {
+					t.Fatalf("ok: %v err: %s", ok, err)
+				}
+			})
+		})
+	})
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if ok, err := s.KVSLock(5, &structs.DirEntry{Key: "aaa", Session: session}); !ok || err != nil {
+					t.Fatalf("ok: %v err: %s", ok, err)
+				}
+			})
+		})
+	})
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if ok, err := s.KVSUnlock(6, &structs.DirEntry{Key: "aaa", Session: session}); !ok || err != nil {
+					t.Fatalf("ok: %v err: %s", ok, err)
+				}
+			})
+		})
+	})
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
+				if err := s.KVSDeleteTree(7, "aaa"); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			})
+		})
+	})
+
+	// A delete tree operation at the top level will notify all the watches.
+	verifyWatch(t, s.GetKVSWatch(""), func() {
+		verifyWatch(t, s.GetKVSWatch("a"), func() {
+			verifyWatch(t, s.GetKVSWatch("/nope"), func() {
+				if err := s.KVSDeleteTree(8, ""); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			})
+		})
+	})
+
+	// Create a more interesting tree.
+	testSetKey(t, s, 9, "foo/bar", "bar")
+	testSetKey(t, s, 10, "foo/bar/baz", "baz")
+	testSetKey(t, s, 11, "foo/bar/zip", "zip")
+	testSetKey(t, s, 12, "foo/zorp", "zorp")
+
+	// Deleting just the foo/bar key should not trigger watches on the
+	// children.
+	verifyWatch(t, s.GetKVSWatch("foo/bar"), func() {
+		verifyNoWatch(t, s.GetKVSWatch("foo/bar/baz"), func() {
+			verifyNoWatch(t, s.GetKVSWatch("foo/bar/zip"), func() {
+				if err := s.KVSDelete(13, "foo/bar"); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			})
+		})
+	})
+
+	// But a delete tree from that point should notify the whole subtree,
+	// even for keys that don't exist.
+	verifyWatch(t, s.GetKVSWatch("foo/bar"), func() {
+		verifyWatch(t, s.GetKVSWatch("foo/bar/baz"), func() {
+			verifyWatch(t, s.GetKVSWatch("foo/bar/zip"), func() {
+				verifyWatch(t, s.GetKVSWatch("foo/bar/uh/nope"), func() {
+					if err := s.KVSDeleteTree(14, "foo/bar"); err != nil {
+						t.Fatalf("err: %s", err)
+					}
+				})
+			})
+		})
+	})
+}
+
+func TestStateStore_Tombstone_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	// Insert a key and then delete it to create a tombstone.
+	testSetKey(t, s, 1, "foo/bar", "bar")
+	testSetKey(t, s, 2, "foo/bar/baz", "bar")
+	testSetKey(t, s, 3, "foo/bar/zoo", "bar")
+	if err := s.KVSDelete(4, "foo/bar"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Snapshot the Tombstones.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ReapTombstones(4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, _, err := s.KVSList("foo/bar")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Verify the snapshot.
+	stones, err := snap.Tombstones()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var dump []*Tombstone
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		dump = append(dump, stone.(*Tombstone))
+	}
+	if len(dump) != 1 {
+		t.Fatalf("bad %#v", dump)
+	}
+	stone := dump[0]
+	if stone.Key != "foo/bar" || stone.Index != 4 {
+		t.Fatalf("bad: %#v", stone)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, stone := range dump {
+			if err := restore.Tombstone(stone); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		// See if the stone works properly in a list query.
+		idx, _, err := s.KVSList("foo/bar")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 4 {
+			t.Fatalf("bad index: %d", idx)
+		}
+
+		// Make sure it reaps correctly. We should still get a 4 for
+		// the index here because it will be using the last index from
+		// the tombstone table.
+		if err := s.ReapTombstones(4); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		idx, _, err = s.KVSList("foo/bar")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 4 {
+			t.Fatalf("bad index: %d", idx)
+		}
+
+		// But make sure the tombstone is actually gone.
+		snap := s.Snapshot()
+		defer snap.Close()
+		stones, err := snap.Tombstones()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if stones.Next() != nil {
+			t.Fatalf("unexpected extra tombstones")
+		}
+	}()
+}
+
+func TestStateStore_SessionCreate_SessionGet(t *testing.T) {
+	s := testStateStore(t)
+
+	// SessionGet returns nil if the session doesn't exist
+	idx, session, err := s.SessionGet(testUUID())
+	if session != nil || err != nil {
+		t.Fatalf("expected (nil, nil), got: (%#v, %#v)", session, err)
+	}
+	if idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Registering without a session ID is disallowed
+	err = s.SessionCreate(1, &structs.Session{})
+	if err != ErrMissingSessionID {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingSessionID, err)
+	}
+
+	// Invalid session behavior throws error
+	sess := &structs.Session{
+		ID:       testUUID(),
+		Behavior: "nope",
+	}
+	err = s.SessionCreate(1, sess)
+	if err == nil || !strings.Contains(err.Error(), "session behavior") {
+		t.Fatalf("expected session behavior error, got: %#v", err)
+	}
+
+	// Registering with an unknown node is disallowed
+	sess = &structs.Session{ID: testUUID()}
+	if err := s.SessionCreate(1, sess); err != ErrMissingNode {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingNode, err)
+	}
+
+	// None of the errored operations modified the index
+	if idx := s.maxIndex("sessions"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Valid session is able to register
+	testRegisterNode(t, s, 1, "node1")
+	sess = &structs.Session{
+		ID:   testUUID(),
+		Node: "node1",
+	}
+	if err := s.SessionCreate(2, sess); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("sessions"); idx != 2 {
+		t.Fatalf("bad index: %s", err)
+	}
+
+	// Retrieve the session again
+	idx, session, err = s.SessionGet(sess.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Ensure the session looks correct and was assigned the
+	// proper default value for session behavior.
+	expect := &structs.Session{
+		ID:       sess.ID,
+		Behavior: structs.SessionKeysRelease,
+		Node:     "node1",
+		RaftIndex: structs.RaftIndex{
+			CreateIndex: 2,
+			ModifyIndex: 2,
+		},
+	}
+	if !reflect.DeepEqual(expect, session) {
+		t.Fatalf("bad session: %#v", session)
+	}
+
+	// Registering with a non-existent check is disallowed
+	sess = &structs.Session{
+		ID:     testUUID(),
+		Node:   "node1",
+		Checks: []string{"check1"},
+	}
+	err = s.SessionCreate(3, sess)
+	if err == nil || !strings.Contains(err.Error(), "Missing check") {
+		t.Fatalf("expected missing check error, got: %#v", err)
+	}
+
+	// Registering with a critical check is disallowed
+	testRegisterCheck(t, s, 3, "node1", "", "check1", structs.HealthCritical)
+	err = s.SessionCreate(4, sess)
+	if err == nil || !strings.Contains(err.Error(), structs.HealthCritical) {
+		t.Fatalf("expected critical state error, got: %#v", err)
+	}
+
+	// Registering with a healthy check succeeds
+	testRegisterCheck(t, s, 4, "node1", "", "check1", structs.HealthPassing)
+	if err := s.SessionCreate(5, sess); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Register a session against two checks.
+	testRegisterCheck(t, s, 5, "node1", "", "check2", structs.HealthPassing)
+	sess2 := &structs.Session{
+		ID:     testUUID(),
+		Node:   "node1",
+		Checks: []string{"check1", "check2"},
+	}
+	if err := s.SessionCreate(6, sess2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Check mappings were inserted
+	{
+		check, err := tx.First("session_checks", "session", sess.ID)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if check == nil {
+			t.Fatalf("missing session check")
+		}
+		expectCheck := &sessionCheck{
+			Node:    "node1",
+			CheckID: "check1",
+			Session: sess.ID,
+		}
+		if actual := check.(*sessionCheck); !reflect.DeepEqual(actual, expectCheck) {
+			t.Fatalf("expected %#v, got: %#v", expectCheck, actual)
+		}
+	}
+	checks, err := tx.Get("session_checks", "session", sess2.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i, check := 0, checks.Next(); check != nil; i, check = i+1, checks.Next() {
+		expectCheck := &sessionCheck{
+			Node:    "node1",
+			CheckID: fmt.Sprintf("check%d", i+1),
+			Session: sess2.ID,
+		}
+		if actual := check.(*sessionCheck); !reflect.DeepEqual(actual, expectCheck) {
+			t.Fatalf("expected %#v, got: %#v", expectCheck, actual)
+		}
+	}
+
+	// Pulling a nonexistent session gives the table index.
+	idx, session, err = s.SessionGet(testUUID())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if session != nil {
+		t.Fatalf("expected not to get a session: %v", session)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TegstStateStore_SessionList(t *testing.T) {
+	s := testStateStore(t)
+
+	// Listing when no sessions exist returns nil
+	idx, res, err := s.SessionList()
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Register some nodes
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterNode(t, s, 3, "node3")
+
+	// Create some sessions in the state store
+	sessions := structs.Sessions{
+		&structs.Session{
+			ID:       testUUID(),
+			Node:     "node1",
+			Behavior: structs.SessionKeysDelete,
+		},
+		&structs.Session{
+			ID:       testUUID(),
+			Node:     "node2",
+			Behavior: structs.SessionKeysRelease,
+		},
+		&structs.Session{
+			ID:       testUUID(),
+			Node:     "node3",
+			Behavior: structs.SessionKeysDelete,
+		},
+	}
+	for i, session := range sessions {
+		if err := s.SessionCreate(uint64(4+i), session); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// List out all of the sessions
+	idx, sessionList, err := s.SessionList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if !reflect.DeepEqual(sessionList, sessions) {
+		t.Fatalf("bad: %#v", sessions)
+	}
+}
+
+func TestStateStore_NodeSessions(t *testing.T) {
+	s := testStateStore(t)
+
+	// Listing sessions with no results returns nil
+	idx, res, err := s.NodeSessions("node1")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Create the nodes
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+
+	// Register some sessions with the nodes
+	sessions1 := structs.Sessions{
+		&structs.Session{
+			ID:   testUUID(),
+			Node: "node1",
+		},
+		&structs.Session{
+			ID:   testUUID(),
+			Node: "node1",
+		},
+	}
+	sessions2 := []*structs.Session{
+		&structs.Session{
+			ID:   testUUID(),
+			Node: "node2",
+		},
+		&structs.Session{
+			ID:   testUUID(),
+			Node: "node2",
+		},
+	}
+	for i, sess := range append(sessions1, sessions2...) {
+		if err := s.SessionCreate(uint64(3+i), sess); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Query all of the sessions associated with a specific
+	// node in the state store.
+	idx, res, err = s.NodeSessions("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res) != len(sessions1) {
+		t.Fatalf("bad: %#v", res)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	idx, res, err = s.NodeSessions("node2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res) != len(sessions2) {
+		t.Fatalf("bad: %#v", res)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_NodeLocks(t *testing.T) {
+	s := testStateStore(t)
+
+	// No locks to start with
+	idx, res, err := s.NodeLocks("node1")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Give each node a session
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	sess1 := &structs.Session{ID: testUUID(), Node: "node1"}
+	if err := s.SessionCreate(3, sess1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sess2 := &structs.Session{ID: testUUID(), Node: "node2"}
+	if err := s.SessionCreate(4, sess2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A session without locks holds nothing
+	idx, res, err = s.NodeLocks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 4 || len(res) != 0 {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+
+	// Take some locks
+	for i, lock := range []struct {
+		key, session string
+	}{
+		{"foo", sess1.ID},
+		{"bar", sess1.ID},
+		{"baz", sess2.ID},
+	} {
+		ok, err := s.KVSLock(uint64(5+i), &structs.DirEntry{Key: lock.key, Session: lock.session})
+		if !ok || err != nil {
+			t.Fatalf("didn't get the lock: %v %s", ok, err)
+		}
+	}
+
+	// Only node1's locks come back
+	idx, res, err = s.NodeLocks("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 7 || len(res) != 2 {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+	for _, entry := range res {
+		if entry.Session != sess1.ID {
+			t.Fatalf("bad: %#v", entry)
+		}
+	}
+}
+
+func TestStateStore_SessionDestroy(t *testing.T) {
+	s := testStateStore(t)
+
+	// Session destroy is idempotent and returns no error
+	// if the session doesn't exist.
+	if err := s.SessionDestroy(1, testUUID()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure the index was not updated if nothing was destroyed.
+	if idx := s.maxIndex("sessions"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Register a node.
+	testRegisterNode(t, s, 1, "node1")
+
+	// Register a new session
+	sess := &structs.Session{
+		ID:   testUUID(),
+		Node: "node1",
+	}
+	if err := s.SessionCreate(2, sess); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Destroy the session.
+	if err := s.SessionDestroy(3, sess.ID); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Check that the index was updated
+	if idx := s.maxIndex("sessions"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Make sure the session is really gone.
+	tx := s.db.Txn(false)
+	sessions, err := tx.Get("sessions", "id")
+	if err != nil || sessions.Next() != nil {
+		t.Fatalf("session should not exist")
+	}
+	tx.Abort()
+}
+
+func TestStateStore_Session_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register some nodes and checks.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterNode(t, s, 3, "node3")
+	testRegisterCheck(t, s, 4, "node1", "", "check1", structs.HealthPassing)
+
+	// Create some sessions in the state store.
+	session1 := testUUID()
+	sessions := structs.Sessions{
+		&structs.Session{
+			ID:       session1,
+			Node:     "node1",
+			Behavior: structs.SessionKeysDelete,
+			Checks:   []string{"check1"},
+		},
+		&structs.Session{
+			ID:        testUUID(),
+			Node:      "node2",
+			Behavior:  structs.SessionKeysRelease,
+			LockDelay: 10 * time.Second,
+		},
+		&structs.Session{
+			ID:       testUUID(),
+			Node:     "node3",
+			Behavior: structs.SessionKeysDelete,
+			TTL:      "1.5s",
+		},
+	}
+	for i, session := range sessions {
+		if err := s.SessionCreate(uint64(5+i), session); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the sessions.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.SessionDestroy(8, session1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	if idx := snap.LastIndex(); idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	iter, err := snap.Sessions()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var dump structs.Sessions
+	for session := iter.Next(); session != nil; session = iter.Next() {
+		sess := session.(*structs.Session)
+		dump = append(dump, sess)
+
+		found := false
+		for i, _ := range sessions {
+			if sess.ID == sessions[i].ID {
+				if !reflect.DeepEqual(sess, sessions[i]) {
+					t.Fatalf("bad: %#v", sess)
+				}
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("bad: %#v", sess)
+		}
+	}
+
+	// Restore the sessions into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, session := range dump {
+			if err := restore.Session(session); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		// Read the restored sessions back out and verify that they
+		// match.
+		idx, res, err := s.SessionList()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 7 {
+			t.Fatalf("bad index: %d", idx)
+		}
+		for _, sess := range res {
+			found := false
+			for i, _ := range sessions {
+				if sess.ID == sessions[i].ID {
+					if !reflect.DeepEqual(sess, sessions[i]) {
+						t.Fatalf("bad: %#v", sess)
+					}
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("bad: %#v", sess)
+			}
+		}
+
+		// Check that the index was updated.
+		if idx := s.maxIndex("sessions"); idx != 7 {
+			t.Fatalf("bad index: %d", idx)
+		}
+
+		// Manually verify that the session check mapping got restored.
+		tx := s.db.Txn(false)
+		defer tx.Abort()
+
+		check, err := tx.First("session_checks", "session", session1)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if check == nil {
+			t.Fatalf("missing session check")
+		}
+		expectCheck := &sessionCheck{
+			Node:    "node1",
+			CheckID: "check1",
+			Session: session1,
+		}
+		if actual := check.(*sessionCheck); !reflect.DeepEqual(actual, expectCheck) {
+			t.Fatalf("expected %#v, got: %#v", expectCheck, actual)
+		}
+	}()
+}
+
+func TestStateStore_Session_Watches(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a test node.
+	testRegisterNode(t, s, 1, "node1")
+
+	// This just covers the basics. The session invalidation tests above
+	// cover the more nuanced multiple table watches.
+	session := testUUID()
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		sess := &structs.Session{
+			ID:       session,
+			Node:     "node1",
+			Behavior: structs.SessionKeysDelete,
+		}
+		if err := s.SessionCreate(2, sess); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		if err := s.SessionDestroy(3, session); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		restore := s.Restore()
+		sess := &structs.Session{
+			ID:       session,
+			Node:     "node1",
+			Behavior: structs.SessionKeysDelete,
+		}
+		if err := restore.Session(sess); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		restore.Commit()
+	})
+}
+
+func TestStateStore_Session_Invalidate_DeleteNode(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up our test environment.
+	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:   testUUID(),
+		Node: "foo",
+	}
+	if err := s.SessionCreate(14, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete the node and make sure the watches fire.
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		verifyWatch(t, s.getTableWatch("nodes"), func() {
+			if err := s.DeleteNode(15, "foo"); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	})
+
+	// Lookup by ID, should be nil.
+	idx, s2, err := s.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 15 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_Session_Invalidate_DeleteService(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up our test environment.
+	if err := s.EnsureNode(11, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Tags: nil, Address: "", Port: 5000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:      "foo",
+		CheckID:   "api",
+		Name:      "Can connect",
+		Status:    structs.HealthPassing,
+		ServiceID: "api",
+	}
+	if err := s.EnsureCheck(13, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:     testUUID(),
+		Node:   "foo",
+		Checks: []string{"api"},
+	}
+	if err := s.SessionCreate(14, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete the service and make sure the watches fire.
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		verifyWatch(t, s.getTableWatch("services"), func() {
+			verifyWatch(t, s.getTableWatch("checks"), func() {
+				if err := s.DeleteService(15, "foo", "api"); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			})
+		})
+	})
+
+	// Lookup by ID, should be nil.
+	idx, s2, err := s.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 15 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_Session_Invalidate_Critical_Check(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up our test environment.
+	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "bar",
+		Status:  structs.HealthPassing,
+	}
+	if err := s.EnsureCheck(13, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:     testUUID(),
+		Node:   "foo",
+		Checks: []string{"bar"},
+	}
+	if err := s.SessionCreate(14, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Invalidate the check and make sure the watches fire.
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		verifyWatch(t, s.getTableWatch("checks"), func() {
+			check.Status = structs.HealthCritical
+			if err := s.EnsureCheck(15, check); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	})
+
+	// Lookup by ID, should be nil.
+	idx, s2, err := s.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 15 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_Session_Invalidate_DeleteCheck(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up our test environment.
+	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "bar",
+		Status:  structs.HealthPassing,
+	}
+	if err := s.EnsureCheck(13, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:     testUUID(),
+		Node:   "foo",
+		Checks: []string{"bar"},
+	}
+	if err := s.SessionCreate(14, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete the check and make sure the watches fire.
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		verifyWatch(t, s.getTableWatch("checks"), func() {
+			if err := s.DeleteCheck(15, "foo", "bar"); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	})
+
+	// Lookup by ID, should be nil.
+	idx, s2, err := s.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 15 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Manually make sure the session checks mapping is clear.
+	tx := s.db.Txn(false)
+	mapping, err := tx.First("session_checks", "session", session.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if mapping != nil {
+		t.Fatalf("unexpected session check")
+	}
+	tx.Abort()
+}
+
+func TestStateStore_Session_Invalidate_Key_Unlock_Behavior(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up our test environment.
+	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:        testUUID(),
+		Node:      "foo",
+		LockDelay: 50 * time.Millisecond,
+	}
+	if err := s.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Lock a key with the session.
+	d := &structs.DirEntry{
+		Key:     "/foo",
+		Flags:   42,
+		Value:   []byte("test"),
+		Session: session.ID,
+	}
+	ok, err := s.KVSLock(5, d)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("unexpected fail")
+	}
+
+	// Delete the node and make sure the watches fire.
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		verifyWatch(t, s.getTableWatch("nodes"), func() {
+			verifyWatch(t, s.GetKVSWatch("/f"), func() {
+				if err := s.DeleteNode(6, "foo"); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			})
+		})
+	})
+
+	// Lookup by ID, should be nil.
+	idx, s2, err := s.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Key should be unlocked.
+	idx, d2, err := s.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d2.ModifyIndex != 6 {
+		t.Fatalf("bad index: %v", d2.ModifyIndex)
+	}
+	if d2.LockIndex != 1 {
+		t.Fatalf("bad: %v", *d2)
+	}
+	if d2.Session != "" {
+		t.Fatalf("bad: %v", *d2)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Key should have a lock delay.
+	expires := s.KVSLockDelay("/foo")
+	if expires.Before(time.Now().Add(30 * time.Millisecond)) {
+		t.Fatalf("Bad: %v", expires)
+	}
+}
+
+func TestStateStore_Session_Invalidate_Key_Delete_Behavior(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up our test environment.
+	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:        testUUID(),
+		Node:      "foo",
+		LockDelay: 50 * time.Millisecond,
+		Behavior:  structs.SessionKeysDelete,
+	}
+	if err := s.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Lock a key with the session.
+	d := &structs.DirEntry{
+		Key:     "/bar",
+		Flags:   42,
+		Value:   []byte("test"),
+		Session: session.ID,
+	}
+	ok, err := s.KVSLock(5, d)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("unexpected fail")
+	}
+
+	// Delete the node and make sure the watches fire.
+	verifyWatch(t, s.getTableWatch("sessions"), func() {
+		verifyWatch(t, s.getTableWatch("nodes"), func() {
+			verifyWatch(t, s.GetKVSWatch("/b"), func() {
+				if err := s.DeleteNode(6, "foo"); err != nil {
+					t.Fatalf("err: %v", err)
+				}
 			})
 		})
 	})
 
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if err := s.KVSDelete(3, "aaa"); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-			})
-		})
-	})
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if ok, err := s.KVSSetCAS(4, &structs.DirEntry{Key: "aaa"}); !ok || err != nil {
-					t.Fatalf("ok: %v err: %s", ok, err)
-				}
-			})
-		})
-	})
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if ok, err := s.KVSLock(5, &structs.DirEntry{Key: "aaa", Session: session}); !ok || err != nil {
-					t.Fatalf("ok: %v err: %s", ok, err)
-				}
-			})
-		})
-	})
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if ok, err := s.KVSUnlock(6, &structs.DirEntry{Key: "aaa", Session: session}); !ok || err != nil {
-					t.Fatalf("ok: %v err: %s", ok, err)
-				}
-			})
-		})
-	})
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("/nope"), func() {
-				if err := s.KVSDeleteTree(7, "aaa"); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-			})
-		})
-	})
+	// Lookup by ID, should be nil.
+	idx, s2, err := s.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Key should be deleted.
+	idx, d2, err := s.KVSGet("/bar")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d2 != nil {
+		t.Fatalf("unexpected deleted key")
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Key should have a lock delay.
+	expires := s.KVSLockDelay("/bar")
+	if expires.Before(time.Now().Add(30 * time.Millisecond)) {
+		t.Fatalf("Bad: %v", expires)
+	}
+}
+
+func TestStateStore_ACLSet_ACLGet(t *testing.T) {
+	s := testStateStore(t)
+
+	// Querying ACLs with no results returns nil
+	idx, res, err := s.ACLGet("nope")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Inserting an ACL with empty ID is disallowed
+	if err := s.ACLSet(1, &structs.ACL{}); err == nil {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingACLID, err)
+	}
+
+	// Index is not updated if nothing is saved
+	if idx := s.maxIndex("acls"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Inserting valid ACL works
+	acl := &structs.ACL{
+		ID:    "acl1",
+		Name:  "First ACL",
+		Type:  structs.ACLTypeClient,
+		Rules: "rules1",
+	}
+	if err := s.ACLSet(1, acl); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Check that the index was updated
+	if idx := s.maxIndex("acls"); idx != 1 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Retrieve the ACL again
+	idx, result, err := s.ACLGet("acl1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Check that the ACL matches the result
+	expect := &structs.ACL{
+		ID:    "acl1",
+		Name:  "First ACL",
+		Type:  structs.ACLTypeClient,
+		Rules: "rules1",
+		RaftIndex: structs.RaftIndex{
+			CreateIndex: 1,
+			ModifyIndex: 1,
+		},
+	}
+	if !reflect.DeepEqual(result, expect) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Update the ACL
+	acl = &structs.ACL{
+		ID:    "acl1",
+		Name:  "First ACL",
+		Type:  structs.ACLTypeClient,
+		Rules: "rules2",
+	}
+	if err := s.ACLSet(2, acl); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Index was updated
+	if idx := s.maxIndex("acls"); idx != 2 {
+		t.Fatalf("bad: %d", idx)
+	}
+
+	// ACL was updated and matches expected value
+	expect = &structs.ACL{
+		ID:    "acl1",
+		Name:  "First ACL",
+		Type:  structs.ACLTypeClient,
+		Rules: "rules2",
+		RaftIndex: structs.RaftIndex{
+			CreateIndex: 1,
+			ModifyIndex: 2,
+		},
+	}
+	if !reflect.DeepEqual(acl, expect) {
+		t.Fatalf("bad: %#v", acl)
+	}
+}
+
+func TestStateStore_ACLList(t *testing.T) {
+	s := testStateStore(t)
+
+	// Listing when no ACLs exist returns nil
+	idx, res, err := s.ACLList()
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Insert some ACLs
+	acls := structs.ACLs{
+		&structs.ACL{
+			ID:    "acl1",
+			Type:  structs.ACLTypeClient,
+			Rules: "rules1",
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 1,
+				ModifyIndex: 1,
+			},
+		},
+		&structs.ACL{
+			ID:    "acl2",
+			Type:  structs.ACLTypeClient,
+			Rules: "rules2",
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 2,
+				ModifyIndex: 2,
+			},
+		},
+	}
+	for _, acl := range acls {
+		if err := s.ACLSet(acl.ModifyIndex, acl); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Query the ACLs
+	idx, res, err = s.ACLList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Check that the result matches
+	if !reflect.DeepEqual(res, acls) {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestStateStore_ACLDelete(t *testing.T) {
+	s := testStateStore(t)
+
+	// Calling delete on an ACL which doesn't exist returns nil
+	if err := s.ACLDelete(1, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Index isn't updated if nothing is deleted
+	if idx := s.maxIndex("acls"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Insert an ACL
+	if err := s.ACLSet(1, &structs.ACL{ID: "acl1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Delete the ACL and check that the index was updated
+	if err := s.ACLDelete(2, "acl1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("acls"); idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Check that the ACL was really deleted
+	result, err := tx.First("acls", "id", "acl1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != nil {
+		t.Fatalf("expected nil, got: %#v", result)
+	}
+}
+
+func TestStateStore_ACL_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	// Insert some ACLs.
+	acls := structs.ACLs{
+		&structs.ACL{
+			ID:    "acl1",
+			Type:  structs.ACLTypeClient,
+			Rules: "rules1",
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 1,
+				ModifyIndex: 1,
+			},
+		},
+		&structs.ACL{
+			ID:    "acl2",
+			Type:  structs.ACLTypeClient,
+			Rules: "rules2",
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 2,
+				ModifyIndex: 2,
+			},
+		},
+	}
+	for _, acl := range acls {
+		if err := s.ACLSet(acl.ModifyIndex, acl); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the ACLs.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ACLDelete(3, "acl1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	if idx := snap.LastIndex(); idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	iter, err := snap.ACLs()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var dump structs.ACLs
+	for acl := iter.Next(); acl != nil; acl = iter.Next() {
+		dump = append(dump, acl.(*structs.ACL))
+	}
+	if !reflect.DeepEqual(dump, acls) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, acl := range dump {
+			if err := restore.ACL(acl); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
 
-	// A delete tree operation at the top level will notify all the watches.
-	verifyWatch(t, s.GetKVSWatch(""), func() {
-		verifyWatch(t, s.GetKVSWatch("a"), func() {
-			verifyWatch(t, s.GetKVSWatch("/nope"), func() {
-				if err := s.KVSDeleteTree(8, ""); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-			})
-		})
-	})
+		// Read the restored ACLs back out and verify that they match.
+		idx, res, err := s.ACLList()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 {
+			t.Fatalf("bad index: %d", idx)
+		}
+		if !reflect.DeepEqual(res, acls) {
+			t.Fatalf("bad: %#v", res)
+		}
 
-	// Create a more interesting tree.
-	testSetKey(t, s, 9, "foo/bar", "bar")
-	testSetKey(t, s, 10, "foo/bar/baz", "baz")
-	testSetKey(t, s, 11, "foo/bar/zip", "zip")
-	testSetKey(t, s, 12, "foo/zorp", "zorp")
+		// Check that the index was updated.
+		if idx := s.maxIndex("acls"); idx != 2 {
+			t.Fatalf("bad index: %d", idx)
+		}
+	}()
+}
 
-	// Deleting just the foo/bar key should not trigger watches on the
-	// children.
-	verifyWatch(t, s.GetKVSWatch("foo/bar"), func() {
-		verifyNoWatch(t, s.GetKVSWatch("foo/bar/baz"), func() {
-			verifyNoWatch(t, s.GetKVSWatch("foo/bar/zip"), func() {
-				if err := s.KVSDelete(13, "foo/bar"); err != nil {
-					t.Fatalf("err: %s", err)
-				}
-			})
-		})
-	})
+func TestStateStore_ACL_Watches(t *testing.T) {
+	s := testStateStore(t)
 
-	// But a delete tree from that point should notify the whole subtree,
-	// even for keys that don't exist.
-	verifyWatch(t, s.GetKVSWatch("foo/bar"), func() {
-		verifyWatch(t, s.GetKVSWatch("foo/bar/baz"), func() {
-			verifyWatch(t, s.GetKVSWatch("foo/bar/zip"), func() {
-				verifyWatch(t, s.GetKVSWatch("foo/bar/uh/nope"), func() {
-					if err := s.KVSDeleteTree(14, "foo/bar"); err != nil {
-						t.Fatalf("err: %s", err)
-					}
-				})
-			})
-		})
+	// Call functions that update the acls table and make sure a watch fires
+	// each time.
+	verifyWatch(t, s.getTableWatch("acls"), func() {
+		if err := s.ACLSet(1, &structs.ACL{ID: "acl1"}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+	verifyWatch(t, s.getTableWatch("acls"), func() {
+		if err := s.ACLDelete(2, "acl1"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+	verifyWatch(t, s.getTableWatch("acls"), func() {
+		restore := s.Restore()
+		if err := restore.ACL(&structs.ACL{ID: "acl1"}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		restore.Commit()
 	})
 }
 
-func TestStateStore_Tombstone_Snapshot_Restore(t *testing.T) {
+func TestStateStore_MaintenanceWindows(t *testing.T) {
 	s := testStateStore(t)
 
-	// Insert a key and then delete it to create a tombstone.
-	testSetKey(t, s, 1, "foo/bar", "bar")
-	testSetKey(t, s, 2, "foo/bar/baz", "bar")
-	testSetKey(t, s, 3, "foo/bar/zoo", "bar")
-	if err := s.KVSDelete(4, "foo/bar"); err != nil {
-		t.Fatalf("err: %s", err)
+	// Querying with no results returns nil
+	idx, res, err := s.MaintenanceWindowGet("nope")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
 	}
 
-	// Snapshot the Tombstones.
-	snap := s.Snapshot()
-	defer snap.Close()
+	// Inserting a window with an empty ID is disallowed
+	if err := s.MaintenanceWindowSet(1, &structs.MaintenanceWindow{}); err != ErrMissingMaintenanceWindowID {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingMaintenanceWindowID, err)
+	}
+	if idx := s.maxIndex("maintenance_windows"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
 
-	// Alter the real state store.
-	if err := s.ReapTombstones(4); err != nil {
+	start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+	window := &structs.MaintenanceWindow{
+		ID:     "window1",
+		Node:   "node1",
+		Start:  start,
+		End:    start.Add(time.Hour),
+		Reason: "kernel upgrade",
+	}
+	if err := s.MaintenanceWindowSet(1, window); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	idx, _, err := s.KVSList("foo/bar")
+	idx, res, err = s.MaintenanceWindowGet("window1")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 3 {
+	if idx != 1 || res.CreateIndex != 1 || res.ModifyIndex != 1 || res.Reason != "kernel upgrade" {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+
+	// Updating keeps the create index
+	window = &structs.MaintenanceWindow{
+		ID:          "window1",
+		Node:        "node1",
+		ServiceName: "redis",
+		Start:       start,
+		End:         start.Add(time.Hour),
+	}
+	if err := s.MaintenanceWindowSet(2, window); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.MaintenanceWindowSet(3, &structs.MaintenanceWindow{ID: "window2", ServiceName: "web"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, windows, err := s.MaintenanceWindowList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(windows) != 2 {
+		t.Fatalf("bad: %d %#v", idx, windows)
+	}
+	if w := windows[0]; w.ID != "window1" || w.ServiceName != "redis" || w.CreateIndex != 1 || w.ModifyIndex != 2 {
+		t.Fatalf("bad: %#v", w)
+	}
+	if windows[1].ID != "window2" {
+		t.Fatalf("bad: %#v", windows[1])
+	}
+
+	// Deleting a missing window is a no-op
+	if err := s.MaintenanceWindowDelete(4, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("maintenance_windows"); idx != 3 {
 		t.Fatalf("bad index: %d", idx)
 	}
 
+	// Delete a window
+	if err := s.MaintenanceWindowDelete(5, "window1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, res, err = s.MaintenanceWindowGet("window1")
+	if idx != 5 || res != nil || err != nil {
+		t.Fatalf("expected (5, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+}
+
+func TestStateStore_MaintenanceWindow_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	// Insert some windows.
+	start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+	windows := structs.MaintenanceWindows{
+		&structs.MaintenanceWindow{
+			ID:    "window1",
+			Node:  "node1",
+			Start: start,
+			End:   start.Add(time.Hour),
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 1,
+				ModifyIndex: 1,
+			},
+		},
+		&structs.MaintenanceWindow{
+			ID:                   "window2",
+			ServiceName:          "redis",
+			Start:                start,
+			End:                  start.Add(time.Hour),
+			Recurrence:           24 * time.Hour,
+			ExcludeFromDiscovery: true,
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 2,
+				ModifyIndex: 2,
+			},
+		},
+	}
+	for _, window := range windows {
+		if err := s.MaintenanceWindowSet(window.ModifyIndex, window); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the windows.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.MaintenanceWindowDelete(3, "window1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
 	// Verify the snapshot.
-	stones, err := snap.Tombstones()
+	if idx := snap.LastIndex(); idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	iter, err := snap.MaintenanceWindows()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	var dump []*Tombstone
-	for stone := stones.Next(); stone != nil; stone = stones.Next() {
-		dump = append(dump, stone.(*Tombstone))
-	}
-	if len(dump) != 1 {
-		t.Fatalf("bad %#v", dump)
+	var dump structs.MaintenanceWindows
+	for window := iter.Next(); window != nil; window = iter.Next() {
+		dump = append(dump, window.(*structs.MaintenanceWindow))
 	}
-	stone := dump[0]
-	if stone.Key != "foo/bar" || stone.Index != 4 {
-		t.Fatalf("bad: %#v", stone)
+	if !reflect.DeepEqual(dump, windows) {
+		t.Fatalf("bad: %#v", dump)
 	}
 
 	// Restore the values into a new state store.
 	func() {
 		s := testStateStore(t)
 		restore := s.Restore()
-		for _, stone := range dump {
-			if err := restore.Tombstone(stone); err != nil {
+		for _, window := range dump {
+			if err := restore.MaintenanceWindow(window); err != nil {
 				t.Fatalf("err: %s", err)
 			}
 		}
 		restore.Commit()
 
-		// See if the stone works properly in a list query.
-		idx, _, err := s.KVSList("foo/bar")
+		// Read the restored windows back out and verify that they match.
+		idx, res, err := s.MaintenanceWindowList()
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if idx != 4 {
+		if idx != 2 {
 			t.Fatalf("bad index: %d", idx)
 		}
+		if !reflect.DeepEqual(res, windows) {
+			t.Fatalf("bad: %#v", res)
+		}
+	}()
+}
 
-		// Make sure it reaps correctly. We should still get a 4 for
-		// the index here because it will be using the last index from
-		// the tombstone table.
-		if err := s.ReapTombstones(4); err != nil {
+func TestStateStore_MaintenanceWindow_Watches(t *testing.T) {
+	s := testStateStore(t)
+
+	// Call functions that update the maintenance_windows table and make
+	// sure a watch fires each time.
+	verifyWatch(t, s.getTableWatch("maintenance_windows"), func() {
+		if err := s.MaintenanceWindowSet(1, &structs.MaintenanceWindow{ID: "window1"}); err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		idx, _, err = s.KVSList("foo/bar")
-		if err != nil {
+	})
+	verifyWatch(t, s.getTableWatch("maintenance_windows"), func() {
+		if err := s.MaintenanceWindowSetInEffect(2, "window1", true); err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if idx != 4 {
-			t.Fatalf("bad index: %d", idx)
+	})
+	verifyWatch(t, s.getTableWatch("maintenance_windows"), func() {
+		if err := s.MaintenanceWindowDelete(3, "window1"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+	verifyWatch(t, s.getTableWatch("maintenance_windows"), func() {
+		restore := s.Restore()
+		if err := restore.MaintenanceWindow(&structs.MaintenanceWindow{ID: "window1"}); err != nil {
+			t.Fatalf("err: %s", err)
 		}
+		restore.Commit()
+	})
+}
 
-		// But make sure the tombstone is actually gone.
-		snap := s.Snapshot()
-		defer snap.Close()
-		stones, err := snap.Tombstones()
+func TestStateStore_MaintenanceWindow_Suppress(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "db")
+	testRegisterCheck(t, s, 3, "node1", "db", "db", structs.HealthPassing)
+	testRegisterCheck(t, s, 4, "node1", "db", "disk", structs.HealthCritical)
+	window := &structs.MaintenanceWindow{ID: "window1", Node: "node1"}
+	if err := s.MaintenanceWindowSet(5, window); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	getCheck := func(id string) *structs.HealthCheck {
+		_, checks, err := s.NodeChecks("node1")
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if stones.Next() != nil {
-			t.Fatalf("unexpected extra tombstones")
+		for _, check := range checks {
+			if check.CheckID == id {
+				return check
+			}
 		}
-	}()
+		t.Fatalf("missing check %q", id)
+		return nil
+	}
+
+	// Windows aren't in effect until the leader says so.
+	testRegisterCheck(t, s, 6, "node1", "db", "db", structs.HealthWarning)
+	if getCheck("db").Suppressed {
+		t.Fatalf("bad: %#v", getCheck("db"))
+	}
+
+	// Status changes while the window is in effect are suppressed, but
+	// checks that were already failing aren't.
+	if err := s.MaintenanceWindowSetInEffect(7, "window1", true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testRegisterCheck(t, s, 8, "node1", "db", "db", structs.HealthCritical)
+	testRegisterCheck(t, s, 9, "node1", "db", "disk", structs.HealthCritical)
+	if !getCheck("db").Suppressed || getCheck("disk").Suppressed {
+		t.Fatalf("bad: %#v %#v", getCheck("db"), getCheck("disk"))
+	}
+
+	// The mark sticks while the status stays the same, even though
+	// registrations don't carry it.
+	testRegisterCheck(t, s, 10, "node1", "db", "db", structs.HealthCritical)
+	if !getCheck("db").Suppressed {
+		t.Fatalf("bad: %#v", getCheck("db"))
+	}
+
+	// Users can't put a window into effect by updating it.
+	window = &structs.MaintenanceWindow{ID: "window1", Node: "node1", InEffect: false}
+	if err := s.MaintenanceWindowSet(11, window); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, res, err := s.MaintenanceWindowGet("window1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !res.InEffect || !getCheck("db").Suppressed {
+		t.Fatalf("bad: %#v %#v", res, getCheck("db"))
+	}
+
+	// Ending the window clears the mark and bumps the index.
+	if err := s.MaintenanceWindowSetInEffect(12, "window1", false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if check := getCheck("db"); check.Suppressed || check.ModifyIndex != 12 {
+		t.Fatalf("bad: %#v", check)
+	}
+	if idx := s.maxIndex("checks"); idx != 12 {
+		t.Fatalf("bad index: %d", idx)
+	}
 }
 
-func TestStateStore_SessionCreate_SessionGet(t *testing.T) {
+func TestStateStore_ManagedChecks(t *testing.T) {
 	s := testStateStore(t)
 
-	// SessionGet returns nil if the session doesn't exist
-	idx, session, err := s.SessionGet(testUUID())
-	if session != nil || err != nil {
-		t.Fatalf("expected (nil, nil), got: (%#v, %#v)", session, err)
+	// Querying with no results returns nil
+	idx, res, err := s.ManagedCheckGet("nope")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
 	}
-	if idx != 0 {
+
+	// Inserting a check with an empty ID is disallowed
+	if err := s.ManagedCheckSet(1, &structs.ManagedCheck{}); err != ErrMissingManagedCheckID {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingManagedCheckID, err)
+	}
+	if idx := s.maxIndex("managed_checks"); idx != 0 {
 		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Registering without a session ID is disallowed
-	err = s.SessionCreate(1, &structs.Session{})
-	if err != ErrMissingSessionID {
-		t.Fatalf("expected %#v, got: %#v", ErrMissingSessionID, err)
+	check := &structs.ManagedCheck{
+		ID:       "disk",
+		Name:     "disk space",
+		Script:   "check_disk",
+		Interval: time.Minute,
+	}
+	if err := s.ManagedCheckSet(1, check); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, res, err = s.ManagedCheckGet("disk")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || res.CreateIndex != 1 || res.ModifyIndex != 1 || res.Script != "check_disk" {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+
+	// Updating keeps the create index
+	check = &structs.ManagedCheck{
+		ID:       "disk",
+		Name:     "disk space",
+		Script:   "check_disk -w 90",
+		Interval: time.Minute,
+	}
+	if err := s.ManagedCheckSet(2, check); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check = &structs.ManagedCheck{
+		ID:       "redis",
+		Name:     "redis ping",
+		NodeMeta: map[string]string{"rack": "r1"},
+		TCP:      "localhost:6379",
+		Interval: time.Minute,
+	}
+	if err := s.ManagedCheckSet(3, check); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, checks, err := s.ManagedCheckList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Invalid session behavior throws error
-	sess := &structs.Session{
-		ID:       testUUID(),
-		Behavior: "nope",
+	if idx != 3 || len(checks) != 2 {
+		t.Fatalf("bad: %d %#v", idx, checks)
 	}
-	err = s.SessionCreate(1, sess)
-	if err == nil || !strings.Contains(err.Error(), "session behavior") {
-		t.Fatalf("expected session behavior error, got: %#v", err)
+	if c := checks[0]; c.ID != "disk" || c.Script != "check_disk -w 90" || c.CreateIndex != 1 || c.ModifyIndex != 2 {
+		t.Fatalf("bad: %#v", c)
 	}
 
-	// Registering with an unknown node is disallowed
-	sess = &structs.Session{ID: testUUID()}
-	if err := s.SessionCreate(1, sess); err != ErrMissingNode {
-		t.Fatalf("expected %#v, got: %#v", ErrMissingNode, err)
+	// Only the checks matching a node's metadata apply to it
+	testRegisterNode(t, s, 4, "node1")
+	if err := s.EnsureNode(5, &structs.Node{Node: "node2", Meta: map[string]string{"rack": "r1"}}); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// None of the errored operations modified the index
-	if idx := s.maxIndex("sessions"); idx != 0 {
-		t.Fatalf("bad index: %d", idx)
+	idx, checks, err = s.ManagedChecksForNode("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Valid session is able to register
-	testRegisterNode(t, s, 1, "node1")
-	sess = &structs.Session{
-		ID:   testUUID(),
-		Node: "node1",
+	if idx != 5 || len(checks) != 1 || checks[0].ID != "disk" {
+		t.Fatalf("bad: %d %#v", idx, checks)
 	}
-	if err := s.SessionCreate(2, sess); err != nil {
+	_, checks, err = s.ManagedChecksForNode("node2")
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx := s.maxIndex("sessions"); idx != 2 {
-		t.Fatalf("bad index: %s", err)
+	if len(checks) != 2 {
+		t.Fatalf("bad: %#v", checks)
 	}
-
-	// Retrieve the session again
-	idx, session, err = s.SessionGet(sess.ID)
+	_, checks, err = s.ManagedChecksForNode("nope")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 2 {
-		t.Fatalf("bad index: %d", idx)
+	if len(checks) != 1 || checks[0].ID != "disk" {
+		t.Fatalf("bad: %#v", checks)
 	}
 
-	// Ensure the session looks correct and was assigned the
-	// proper default value for session behavior.
-	expect := &structs.Session{
-		ID:       sess.ID,
-		Behavior: structs.SessionKeysRelease,
-		Node:     "node1",
-		RaftIndex: structs.RaftIndex{
-			CreateIndex: 2,
-			ModifyIndex: 2,
-		},
+	// Deleting a missing check is a no-op
+	if err := s.ManagedCheckDelete(6, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if !reflect.DeepEqual(expect, session) {
-		t.Fatalf("bad session: %#v", session)
+	if idx := s.maxIndex("managed_checks"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
 	}
 
-	// Registering with a non-existent check is disallowed
-	sess = &structs.Session{
-		ID:     testUUID(),
-		Node:   "node1",
-		Checks: []string{"check1"},
+	// Delete a check
+	if err := s.ManagedCheckDelete(7, "disk"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	err = s.SessionCreate(3, sess)
-	if err == nil || !strings.Contains(err.Error(), "Missing check") {
-		t.Fatalf("expected missing check error, got: %#v", err)
+	idx, res, err = s.ManagedCheckGet("disk")
+	if idx != 7 || res != nil || err != nil {
+		t.Fatalf("expected (7, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
 	}
+}
 
-	// Registering with a critical check is disallowed
-	testRegisterCheck(t, s, 3, "node1", "", "check1", structs.HealthCritical)
-	err = s.SessionCreate(4, sess)
-	if err == nil || !strings.Contains(err.Error(), structs.HealthCritical) {
-		t.Fatalf("expected critical state error, got: %#v", err)
+func TestStateStore_ManagedCheck_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	// Insert some checks.
+	checks := structs.ManagedChecks{
+		&structs.ManagedCheck{
+			ID:       "disk",
+			Name:     "disk space",
+			Script:   "check_disk",
+			Interval: time.Minute,
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 1,
+				ModifyIndex: 1,
+			},
+		},
+		&structs.ManagedCheck{
+			ID:          "redis",
+			Name:        "redis ping",
+			ServiceName: "redis",
+			NodeMeta:    map[string]string{"rack": "r1"},
+			TCP:         "localhost:6379",
+			Interval:    time.Minute,
+			Timeout:     time.Second,
+			RaftIndex: structs.RaftIndex{
+				CreateIndex: 2,
+				ModifyIndex: 2,
+			},
+		},
+	}
+	for _, check := range checks {
+		if err := s.ManagedCheckSet(check.ModifyIndex, check); err != nil {
+			t.Fatalf("err: %s", err)
+		}
 	}
 
-	// Registering with a healthy check succeeds
-	testRegisterCheck(t, s, 4, "node1", "", "check1", structs.HealthPassing)
-	if err := s.SessionCreate(5, sess); err != nil {
+	// Snapshot the checks.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ManagedCheckDelete(3, "disk"); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Register a session against two checks.
-	testRegisterCheck(t, s, 5, "node1", "", "check2", structs.HealthPassing)
-	sess2 := &structs.Session{
-		ID:     testUUID(),
-		Node:   "node1",
-		Checks: []string{"check1", "check2"},
+	// Verify the snapshot.
+	if idx := snap.LastIndex(); idx != 2 {
+		t.Fatalf("bad index: %d", idx)
 	}
-	if err := s.SessionCreate(6, sess2); err != nil {
+	iter, err := snap.ManagedChecks()
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	var dump structs.ManagedChecks
+	for check := iter.Next(); check != nil; check = iter.Next() {
+		dump = append(dump, check.(*structs.ManagedCheck))
+	}
+	if !reflect.DeepEqual(dump, checks) {
+		t.Fatalf("bad: %#v", dump)
+	}
 
-	tx := s.db.Txn(false)
-	defer tx.Abort()
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, check := range dump {
+			if err := restore.ManagedCheck(check); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
 
-	// Check mappings were inserted
-	{
-		check, err := tx.First("session_checks", "session", sess.ID)
+		// Read the restored checks back out and verify that they match.
+		idx, res, err := s.ManagedCheckList()
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if check == nil {
-			t.Fatalf("missing session check")
+		if idx != 2 {
+			t.Fatalf("bad index: %d", idx)
 		}
-		expectCheck := &sessionCheck{
-			Node:    "node1",
-			CheckID: "check1",
-			Session: sess.ID,
+		if !reflect.DeepEqual(res, checks) {
+			t.Fatalf("bad: %#v", res)
 		}
-		if actual := check.(*sessionCheck); !reflect.DeepEqual(actual, expectCheck) {
-			t.Fatalf("expected %#v, got: %#v", expectCheck, actual)
+	}()
+}
+
+func TestStateStore_ManagedCheck_Watches(t *testing.T) {
+	s := testStateStore(t)
+
+	// Call functions that update the managed_checks table and make sure a
+	// watch fires each time.
+	verifyWatch(t, s.getTableWatch("managed_checks"), func() {
+		if err := s.ManagedCheckSet(1, &structs.ManagedCheck{ID: "disk"}); err != nil {
+			t.Fatalf("err: %s", err)
 		}
-	}
-	checks, err := tx.Get("session_checks", "session", sess2.ID)
-	if err != nil {
-		t.Fatalf("err: %s", err)
-	}
-	for i, check := 0, checks.Next(); check != nil; i, check = i+1, checks.Next() {
-		expectCheck := &sessionCheck{
-			Node:    "node1",
-			CheckID: fmt.Sprintf("check%d", i+1),
-			Session: sess2.ID,
+	})
+	verifyWatch(t, s.getTableWatch("managed_checks"), func() {
+		if err := s.ManagedCheckDelete(2, "disk"); err != nil {
+			t.Fatalf("err: %s", err)
 		}
-		if actual := check.(*sessionCheck); !reflect.DeepEqual(actual, expectCheck) {
-			t.Fatalf("expected %#v, got: %#v", expectCheck, actual)
+	})
+	verifyWatch(t, s.getTableWatch("managed_checks"), func() {
+		restore := s.Restore()
+		if err := restore.ManagedCheck(&structs.ManagedCheck{ID: "disk"}); err != nil {
+			t.Fatalf("err: %s", err)
 		}
-	}
+		restore.Commit()
+	})
+}
 
-	// Pulling a nonexistent session gives the table index.
-	idx, session, err = s.SessionGet(testUUID())
-	if err != nil {
-		t.Fatalf("err: %s", err)
-	}
-	if session != nil {
-		t.Fatalf("expected not to get a session: %v", session)
-	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
+// generateRandomCoordinate creates a random coordinate. This mucks with the
+// underlying structure directly, so it's not really useful for any particular
+// position in the network, but it's a good payload to send through to make
+// sure things come out the other side or get stored correctly.
+func generateRandomCoordinate() *coordinate.Coordinate {
+	config := coordinate.DefaultConfig()
+	coord := coordinate.NewCoordinate(config)
+	for i := range coord.Vec {
+		coord.Vec[i] = rand.NormFloat64()
 	}
+	coord.Error = rand.NormFloat64()
+	coord.Adjustment = rand.NormFloat64()
+	return coord
 }
 
-func TegstStateStore_SessionList(t *testing.T) {
+func TestStateStore_Coordinate_Updates(t *testing.T) {
 	s := testStateStore(t)
 
-	// Listing when no sessions exist returns nil
-	idx, res, err := s.SessionList()
-	if idx != 0 || res != nil || err != nil {
-		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	// Make sure the coordinates list starts out empty, and that a query for
+	// a raw coordinate for a nonexistent node doesn't do anything bad.
+	idx, coords, err := s.Coordinates()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Register some nodes
-	testRegisterNode(t, s, 1, "node1")
-	testRegisterNode(t, s, 2, "node2")
-	testRegisterNode(t, s, 3, "node3")
-
-	// Create some sessions in the state store
-	sessions := structs.Sessions{
-		&structs.Session{
-			ID:       testUUID(),
-			Node:     "node1",
-			Behavior: structs.SessionKeysDelete,
-		},
-		&structs.Session{
-			ID:       testUUID(),
-			Node:     "node2",
-			Behavior: structs.SessionKeysRelease,
-		},
-		&structs.Session{
-			ID:       testUUID(),
-			Node:     "node3",
-			Behavior: structs.SessionKeysDelete,
-		},
+	if idx != 0 {
+		t.Fatalf("bad index: %d", idx)
 	}
-	for i, session := range sessions {
-		if err := s.SessionCreate(uint64(4+i), session); err != nil {
-			t.Fatalf("err: %s", err)
-		}
+	if coords != nil {
+		t.Fatalf("bad: %#v", coords)
 	}
-
-	// List out all of the sessions
-	idx, sessionList, err := s.SessionList()
+	coord, err := s.CoordinateGetRaw("nope")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
-	}
-	if !reflect.DeepEqual(sessionList, sessions) {
-		t.Fatalf("bad: %#v", sessions)
+	if coord != nil {
+		t.Fatalf("bad: %#v", coord)
 	}
-}
 
-func TestStateStore_NodeSessions(t *testing.T) {
-	s := testStateStore(t)
+	// Make an update for nodes that don't exist and make sure they get
+	// ignored.
+	updates := structs.Coordinates{
+		&structs.Coordinate{
+			Node:  "node1",
+			Coord: generateRandomCoordinate(),
+		},
+		&structs.Coordinate{
+			Node:  "node2",
+			Coord: generateRandomCoordinate(),
+		},
+	}
+	if err := s.CoordinateBatchUpdate(1, updates); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-	// Listing sessions with no results returns nil
-	idx, res, err := s.NodeSessions("node1")
-	if idx != 0 || res != nil || err != nil {
-		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	// Should still be empty, though applying an empty batch does bump
+	// the table index.
+	idx, coords, err = s.Coordinates()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if coords != nil {
+		t.Fatalf("bad: %#v", coords)
 	}
 
-	// Create the nodes
+	// Register the nodes then do the update again.
 	testRegisterNode(t, s, 1, "node1")
 	testRegisterNode(t, s, 2, "node2")
+	if err := s.CoordinateBatchUpdate(3, updates); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-	// Register some sessions with the nodes
-	sessions1 := structs.Sessions{
-		&structs.Session{
-			ID:   testUUID(),
-			Node: "node1",
-		},
-		&structs.Session{
-			ID:   testUUID(),
-			Node: "node1",
-		},
+	// Should go through now.
+	idx, coords, err = s.Coordinates()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	sessions2 := []*structs.Session{
-		&structs.Session{
-			ID:   testUUID(),
-			Node: "node2",
-		},
-		&structs.Session{
-			ID:   testUUID(),
-			Node: "node2",
-		},
+	if idx != 3 {
+		t.Fatalf("bad index: %d", idx)
 	}
-	for i, sess := range append(sessions1, sessions2...) {
-		if err := s.SessionCreate(uint64(3+i), sess); err != nil {
+	if !reflect.DeepEqual(coords, updates) {
+		t.Fatalf("bad: %#v", coords)
+	}
+
+	// Also verify the raw coordinate interface.
+	for _, update := range updates {
+		coord, err := s.CoordinateGetRaw(update.Node)
+		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
+		if !reflect.DeepEqual(coord, update.Coord) {
+			t.Fatalf("bad: %#v", coord)
+		}
 	}
 
-	// Query all of the sessions associated with a specific
-	// node in the state store.
-	idx, res, err = s.NodeSessions("node1")
-	if err != nil {
+	// Update the coordinate for one of the nodes.
+	updates[1].Coord = generateRandomCoordinate()
+	if err := s.CoordinateBatchUpdate(4, updates); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if len(res) != len(sessions1) {
-		t.Fatalf("bad: %#v", res)
-	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
-	}
 
-	idx, res, err = s.NodeSessions("node2")
+	// Verify it got applied.
+	idx, coords, err = s.Coordinates()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if len(res) != len(sessions2) {
-		t.Fatalf("bad: %#v", res)
-	}
-	if idx != 6 {
+	if idx != 4 {
 		t.Fatalf("bad index: %d", idx)
 	}
+	if !reflect.DeepEqual(coords, updates) {
+		t.Fatalf("bad: %#v", coords)
+	}
+
+	// And check the raw coordinate version of the same thing.
+	for _, update := range updates {
+		coord, err := s.CoordinateGetRaw(update.Node)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(coord, update.Coord) {
+			t.Fatalf("bad: %#v", coord)
+		}
+	}
 }
 
-func TestStateStore_SessionDestroy(t *testing.T) {
+func TestStateStore_Coordinate_Cleanup(t *testing.T) {
 	s := testStateStore(t)
 
-	// Session destroy is idempotent and returns no error
-	// if the session doesn't exist.
-	if err := s.SessionDestroy(1, testUUID()); err != nil {
+	// Register a node and update its coordinate.
+	testRegisterNode(t, s, 1, "node1")
+	updates := structs.Coordinates{
+		&structs.Coordinate{
+			Node:  "node1",
+			Coord: generateRandomCoordinate(),
+		},
+	}
+	if err := s.CoordinateBatchUpdate(2, updates); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Ensure the index was not updated if nothing was destroyed.
-	if idx := s.maxIndex("sessions"); idx != 0 {
-		t.Fatalf("bad index: %d", idx)
+	// Make sure it's in there.
+	coord, err := s.CoordinateGetRaw("node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Register a node.
-	testRegisterNode(t, s, 1, "node1")
-
-	// Register a new session
-	sess := &structs.Session{
-		ID:   testUUID(),
-		Node: "node1",
+	if !reflect.DeepEqual(coord, updates[0].Coord) {
+		t.Fatalf("bad: %#v", coord)
 	}
-	if err := s.SessionCreate(2, sess); err != nil {
+
+	// Now delete the node.
+	if err := s.DeleteNode(3, "node1"); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Destroy the session.
-	if err := s.SessionDestroy(3, sess.ID); err != nil {
+	// Make sure the coordinate is gone.
+	coord, err = s.CoordinateGetRaw("node1")
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	if coord != nil {
+		t.Fatalf("bad: %#v", coord)
+	}
 
-	// Check that the index was updated
-	if idx := s.maxIndex("sessions"); idx != 3 {
+	// Make sure the index got updated.
+	idx, coords, err := s.Coordinates()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 {
 		t.Fatalf("bad index: %d", idx)
 	}
-
-	// Make sure the session is really gone.
-	tx := s.db.Txn(false)
-	sessions, err := tx.Get("sessions", "id")
-	if err != nil || sessions.Next() != nil {
-		t.Fatalf("session should not exist")
+	if coords != nil {
+		t.Fatalf("bad: %#v", coords)
 	}
-	tx.Abort()
 }
 
-func TestStateStore_Session_Snapshot_Restore(t *testing.T) {
+func TestStateStore_Coordinate_Snapshot_Restore(t *testing.T) {
 	s := testStateStore(t)
 
-	// Register some nodes and checks.
+	// Register two nodes and update their coordinates.
 	testRegisterNode(t, s, 1, "node1")
 	testRegisterNode(t, s, 2, "node2")
-	testRegisterNode(t, s, 3, "node3")
-	testRegisterCheck(t, s, 4, "node1", "", "check1", structs.HealthPassing)
-
-	// Create some sessions in the state store.
-	session1 := testUUID()
-	sessions := structs.Sessions{
-		&structs.Session{
-			ID:       session1,
-			Node:     "node1",
-			Behavior: structs.SessionKeysDelete,
-			Checks:   []string{"check1"},
-		},
-		&structs.Session{
-			ID:        testUUID(),
-			Node:      "node2",
-			Behavior:  structs.SessionKeysRelease,
-			LockDelay: 10 * time.Second,
+	updates := structs.Coordinates{
+		&structs.Coordinate{
+			Node:  "node1",
+			Coord: generateRandomCoordinate(),
 		},
-		&structs.Session{
-			ID:       testUUID(),
-			Node:     "node3",
-			Behavior: structs.SessionKeysDelete,
-			TTL:      "1.5s",
+		&structs.Coordinate{
+			Node:  "node2",
+			Coord: generateRandomCoordinate(),
 		},
 	}
-	for i, session := range sessions {
-		if err := s.SessionCreate(uint64(5+i), session); err != nil {
-			t.Fatalf("err: %s", err)
-		}
+	if err := s.CoordinateBatchUpdate(3, updates); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Snapshot the sessions.
+	// Snapshot the coordinates.
 	snap := s.Snapshot()
 	defer snap.Close()
 
 	// Alter the real state store.
-	if err := s.SessionDestroy(8, session1); err != nil {
+	trash := structs.Coordinates{
+		&structs.Coordinate{
+			Node:  "node1",
+			Coord: generateRandomCoordinate(),
+		},
+		&structs.Coordinate{
+			Node:  "node2",
+			Coord: generateRandomCoordinate(),
+		},
+	}
+	if err := s.CoordinateBatchUpdate(4, trash); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
 	// Verify the snapshot.
-	if idx := snap.LastIndex(); idx != 7 {
+	if idx := snap.LastIndex(); idx != 3 {
 		t.Fatalf("bad index: %d", idx)
 	}
-	iter, err := snap.Sessions()
+	iter, err := snap.Coordinates()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	var dump structs.Sessions
-	for session := iter.Next(); session != nil; session = iter.Next() {
-		sess := session.(*structs.Session)
-		dump = append(dump, sess)
-
-		found := false
-		for i, _ := range sessions {
-			if sess.ID == sessions[i].ID {
-				if !reflect.DeepEqual(sess, sessions[i]) {
-					t.Fatalf("bad: %#v", sess)
-				}
-				found = true
-			}
-		}
-		if !found {
-			t.Fatalf("bad: %#v", sess)
-		}
-	}
-
-	// Restore the sessions into a new state store.
-	func() {
-		s := testStateStore(t)
-		restore := s.Restore()
-		for _, session := range dump {
-			if err := restore.Session(session); err != nil {
-				t.Fatalf("err: %s", err)
-			}
-		}
-		restore.Commit()
-
-		// Read the restored sessions back out and verify that they
-		// match.
-		idx, res, err := s.SessionList()
-		if err != nil {
-			t.Fatalf("err: %s", err)
-		}
-		if idx != 7 {
-			t.Fatalf("bad index: %d", idx)
-		}
-		for _, sess := range res {
-			found := false
-			for i, _ := range sessions {
-				if sess.ID == sessions[i].ID {
-					if !reflect.DeepEqual(sess, sessions[i]) {
-						t.Fatalf("bad: %#v", sess)
-					}
-					found = true
-				}
-			}
-			if !found {
-				t.Fatalf("bad: %#v", sess)
-			}
-		}
+	var dump structs.Coordinates
+	for coord := iter.Next(); coord != nil; coord = iter.Next() {
+		dump = append(dump, coord.(*structs.Coordinate))
+	}
+	if !reflect.DeepEqual(dump, updates) {
+		t.Fatalf("bad: %#v", dump)
+	}
 
-		// Check that the index was updated.
-		if idx := s.maxIndex("sessions"); idx != 7 {
-			t.Fatalf("bad index: %d", idx)
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		if err := restore.Coordinates(5, dump); err != nil {
+			t.Fatalf("err: %s", err)
 		}
+		restore.Commit()
 
-		// Manually verify that the session check mapping got restored.
-		tx := s.db.Txn(false)
-		defer tx.Abort()
-
-		check, err := tx.First("session_checks", "session", session1)
+		// Read the restored coordinates back out and verify that they match.
+		idx, res, err := s.Coordinates()
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if check == nil {
-			t.Fatalf("missing session check")
+		if idx != 5 {
+			t.Fatalf("bad index: %d", idx)
 		}
-		expectCheck := &sessionCheck{
-			Node:    "node1",
-			CheckID: "check1",
-			Session: session1,
+		if !reflect.DeepEqual(res, updates) {
+			t.Fatalf("bad: %#v", res)
 		}
-		if actual := check.(*sessionCheck); !reflect.DeepEqual(actual, expectCheck) {
-			t.Fatalf("expected %#v, got: %#v", expectCheck, actual)
+
+		// Check that the index was updated (note that it got passed
+		// in during the restore).
+		if idx := s.maxIndex("coordinates"); idx != 5 {
+			t.Fatalf("bad index: %d", idx)
 		}
 	}()
+
 }
 
-func TestStateStore_Session_Watches(t *testing.T) {
+func TestStateStore_Coordinate_Watches(t *testing.T) {
 	s := testStateStore(t)
 
-	// Register a test node.
 	testRegisterNode(t, s, 1, "node1")
 
-	// This just covers the basics. The session invalidation tests above
-	// cover the more nuanced multiple table watches.
-	session := testUUID()
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		sess := &structs.Session{
-			ID:       session,
-			Node:     "node1",
-			Behavior: structs.SessionKeysDelete,
-		}
-		if err := s.SessionCreate(2, sess); err != nil {
-			t.Fatalf("err: %s", err)
+	// Call functions that update the coordinates table and make sure a watch fires
+	// each time.
+	verifyWatch(t, s.getTableWatch("coordinates"), func() {
+		updates := structs.Coordinates{
+			&structs.Coordinate{
+				Node:  "node1",
+				Coord: generateRandomCoordinate(),
+			},
 		}
-	})
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		if err := s.SessionDestroy(3, session); err != nil {
+		if err := s.CoordinateBatchUpdate(2, updates); err != nil {
 			t.Fatalf("err: %s", err)
 		}
 	})
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		restore := s.Restore()
-		sess := &structs.Session{
-			ID:       session,
-			Node:     "node1",
-			Behavior: structs.SessionKeysDelete,
-		}
-		if err := restore.Session(sess); err != nil {
+	verifyWatch(t, s.getTableWatch("coordinates"), func() {
+		if err := s.DeleteNode(3, "node1"); err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		restore.Commit()
 	})
 }
 
-func TestStateStore_Session_Invalidate_DeleteNode(t *testing.T) {
+func TestStateStore_ChangeCounters(t *testing.T) {
 	s := testStateStore(t)
 
-	// Set up our test environment.
-	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	session := &structs.Session{
-		ID:   testUUID(),
-		Node: "foo",
+	// Start with no counters.
+	idx, counters, err := s.ChangeCounters()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.SessionCreate(14, session); err != nil {
-		t.Fatalf("err: %v", err)
+	if idx != 0 || counters != nil {
+		t.Fatalf("bad: %d %#v", idx, counters)
 	}
 
-	// Delete the node and make sure the watches fire.
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		verifyWatch(t, s.getTableWatch("nodes"), func() {
-			if err := s.DeleteNode(15, "foo"); err != nil {
-				t.Fatalf("err: %v", err)
-			}
-		})
-	})
-
-	// Lookup by ID, should be nil.
-	idx, s2, err := s.SessionGet(session.ID)
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	// Create, update, and delete a service.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterService(t, s, 3, "node1", "service1")
+	testRegisterService(t, s, 4, "node1", "service2")
+	if err := s.DeleteService(5, "node1", "service1"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if s2 != nil {
-		t.Fatalf("session should be invalidated")
+
+	// Write some keys, including a tree delete.
+	testSetKey(t, s, 6, "foo", "bar")
+	testSetKey(t, s, 7, "foo", "baz")
+	testSetKey(t, s, 8, "foo/a", "a")
+	testSetKey(t, s, 9, "foo/b", "b")
+	if err := s.KVSDeleteTree(10, "foo/"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if idx != 15 {
-		t.Fatalf("bad index: %d", idx)
+	if err := s.KVSDelete(11, "foo"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-}
 
-func TestStateStore_Session_Invalidate_DeleteService(t *testing.T) {
-	s := testStateStore(t)
-
-	// Set up our test environment.
-	if err := s.EnsureNode(11, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
+	// Deleting things that don't exist shouldn't count.
+	if err := s.KVSDelete(12, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Tags: nil, Address: "", Port: 5000}); err != nil {
-		t.Fatalf("err: %v", err)
+	if err := s.DeleteService(12, "node1", "nope"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	check := &structs.HealthCheck{
-		Node:      "foo",
-		CheckID:   "api",
-		Name:      "Can connect",
-		Status:    structs.HealthPassing,
-		ServiceID: "api",
+
+	// Create and destroy a session.
+	sess := &structs.Session{ID: testUUID(), Node: "node1"}
+	if err := s.SessionCreate(13, sess); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.EnsureCheck(13, check); err != nil {
-		t.Fatalf("err: %v", err)
+	if err := s.SessionDestroy(14, sess.ID); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	session := &structs.Session{
-		ID:     testUUID(),
-		Node:   "foo",
-		Checks: []string{"api"},
+
+	// Create, update, and delete an ACL.
+	if err := s.ACLSet(15, &structs.ACL{ID: "acl1"}); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.SessionCreate(14, session); err != nil {
-		t.Fatalf("err: %v", err)
+	if err := s.ACLSet(16, &structs.ACL{ID: "acl1", Name: "updated"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.ACLDelete(17, "acl1"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Delete the service and make sure the watches fire.
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		verifyWatch(t, s.getTableWatch("services"), func() {
-			verifyWatch(t, s.getTableWatch("checks"), func() {
-				if err := s.DeleteService(15, "foo", "api"); err != nil {
-					t.Fatalf("err: %v", err)
-				}
-			})
-		})
-	})
+	// Deleting the node takes the remaining service with it.
+	if err := s.DeleteNode(18, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-	// Lookup by ID, should be nil.
-	idx, s2, err := s.SessionGet(session.ID)
+	// Check the totals.
+	idx, counters, err = s.ChangeCounters()
 	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if s2 != nil {
-		t.Fatalf("session should be invalidated")
+		t.Fatalf("err: %s", err)
 	}
-	if idx != 15 {
+	if idx != 18 {
 		t.Fatalf("bad index: %d", idx)
 	}
+	expected := structs.ChangeCounters{
+		&structs.ChangeCounter{
+			Type:      structs.ChangeCounterACLs,
+			Creates:   1,
+			Updates:   1,
+			Deletes:   1,
+			RaftIndex: structs.RaftIndex{CreateIndex: 15, ModifyIndex: 17},
+		},
+		&structs.ChangeCounter{
+			Type:      structs.ChangeCounterKVS,
+			Creates:   3,
+			Updates:   1,
+			Deletes:   3,
+			RaftIndex: structs.RaftIndex{CreateIndex: 6, ModifyIndex: 11},
+		},
+		&structs.ChangeCounter{
+			Type:      structs.ChangeCounterServices,
+			Creates:   2,
+			Updates:   1,
+			Deletes:   2,
+			RaftIndex: structs.RaftIndex{CreateIndex: 2, ModifyIndex: 18},
+		},
+		&structs.ChangeCounter{
+			Type:      structs.ChangeCounterSessions,
+			Creates:   1,
+			Deletes:   1,
+			RaftIndex: structs.RaftIndex{CreateIndex: 13, ModifyIndex: 14},
+		},
+	}
+	if !reflect.DeepEqual(counters, expected) {
+		for _, c := range counters {
+			t.Logf("%#v", c)
+		}
+		t.Fatalf("bad: %#v", counters)
+	}
 }
 
-func TestStateStore_Session_Invalidate_Critical_Check(t *testing.T) {
+func TestStateStore_ChangeCounters_Snapshot_Restore(t *testing.T) {
 	s := testStateStore(t)
 
-	// Set up our test environment.
-	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
+	// Make some changes.
+	testSetKey(t, s, 1, "foo", "bar")
+	testSetKey(t, s, 2, "foo", "baz")
+	testRegisterNode(t, s, 3, "node1")
+	testRegisterService(t, s, 4, "node1", "service1")
+
+	// Snapshot the counters.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	testSetKey(t, s, 5, "foo", "zip")
+
+	// Verify the snapshot.
+	if idx := snap.LastIndex(); idx != 4 {
+		t.Fatalf("bad index: %d", idx)
 	}
-	check := &structs.HealthCheck{
-		Node:    "foo",
-		CheckID: "bar",
-		Status:  structs.HealthPassing,
+	iter, err := snap.ChangeCounters()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.EnsureCheck(13, check); err != nil {
-		t.Fatalf("err: %v", err)
+	var dump structs.ChangeCounters
+	for counter := iter.Next(); counter != nil; counter = iter.Next() {
+		dump = append(dump, counter.(*structs.ChangeCounter))
 	}
-	session := &structs.Session{
-		ID:     testUUID(),
-		Node:   "foo",
-		Checks: []string{"bar"},
+	if len(dump) != 2 {
+		t.Fatalf("bad: %#v", dump)
 	}
-	if err := s.SessionCreate(14, session); err != nil {
-		t.Fatalf("err: %v", err)
+	if c := dump[0]; c.Type != structs.ChangeCounterKVS || c.Creates != 1 || c.Updates != 1 {
+		t.Fatalf("bad: %#v", c)
+	}
+	if c := dump[1]; c.Type != structs.ChangeCounterServices || c.Creates != 1 {
+		t.Fatalf("bad: %#v", c)
 	}
 
-	// Invalidate the check and make sure the watches fire.
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		verifyWatch(t, s.getTableWatch("checks"), func() {
-			check.Status = structs.HealthCritical
-			if err := s.EnsureCheck(15, check); err != nil {
-				t.Fatalf("err: %v", err)
+	// Restore the values into a new state store. The service registration
+	// counts as a create on the way in, but the restored counters should
+	// replace that.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		req := &structs.RegisterRequest{
+			Node:    "node1",
+			Service: &structs.NodeService{ID: "service1"},
+		}
+		if err := restore.Registration(4, req); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, counter := range dump {
+			if err := restore.ChangeCounter(counter); err != nil {
+				t.Fatalf("err: %s", err)
 			}
-		})
-	})
+		}
+		restore.Commit()
 
-	// Lookup by ID, should be nil.
-	idx, s2, err := s.SessionGet(session.ID)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if s2 != nil {
-		t.Fatalf("session should be invalidated")
-	}
-	if idx != 15 {
-		t.Fatalf("bad index: %d", idx)
-	}
+		// Read the restored counters back out and verify that they match.
+		idx, res, err := s.ChangeCounters()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 4 {
+			t.Fatalf("bad index: %d", idx)
+		}
+		if !reflect.DeepEqual(res, dump) {
+			t.Fatalf("bad: %#v", res)
+		}
+	}()
+}
+
+func TestStateStore_ChangeCounters_Watches(t *testing.T) {
+	s := testStateStore(t)
+
+	// Call functions that update the change counters and make sure a watch
+	// fires each time.
+	verifyWatch(t, s.getTableWatch("change_counters"), func() {
+		testSetKey(t, s, 1, "foo", "bar")
+	})
+	verifyWatch(t, s.getTableWatch("change_counters"), func() {
+		if err := s.ACLSet(2, &structs.ACL{ID: "acl1"}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+	verifyWatch(t, s.getTableWatch("change_counters"), func() {
+		restore := s.Restore()
+		counter := &structs.ChangeCounter{Type: structs.ChangeCounterKVS, Creates: 5}
+		if err := restore.ChangeCounter(counter); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		restore.Commit()
+	})
 }
 
-func TestStateStore_Session_Invalidate_DeleteCheck(t *testing.T) {
+func TestStateStore_ChangeFeed(t *testing.T) {
 	s := testStateStore(t)
 
-	// Set up our test environment.
-	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
+	// Start out empty.
+	idx, feed, err := s.ChangeFeed(0, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	check := &structs.HealthCheck{
-		Node:    "foo",
-		CheckID: "bar",
-		Status:  structs.HealthPassing,
+	if idx != 0 || feed.LastSeq != 0 || feed.Truncated || len(feed.Entries) != 0 {
+		t.Fatalf("bad: %d %#v", idx, feed)
 	}
-	if err := s.EnsureCheck(13, check); err != nil {
-		t.Fatalf("err: %v", err)
+
+	// Make some changes, including a delete that cascades.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterCheck(t, s, 3, "node1", "service1", "check1", structs.HealthPassing)
+	testSetKey(t, s, 4, "foo/a", "bar")
+	testSetKey(t, s, 4, "foo/b", "bar")
+	if err := s.KVSDelete(5, "foo/a"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	session := &structs.Session{
-		ID:     testUUID(),
-		Node:   "foo",
-		Checks: []string{"bar"},
+	if err := s.KVSDeleteTree(6, "foo"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.SessionCreate(14, session); err != nil {
-		t.Fatalf("err: %v", err)
+	if err := s.DeleteService(7, "node1", "service1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.DeleteNode(8, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Delete the check and make sure the watches fire.
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		verifyWatch(t, s.getTableWatch("checks"), func() {
-			if err := s.DeleteCheck(15, "foo", "bar"); err != nil {
-				t.Fatalf("err: %v", err)
-			}
-		})
-	})
-
-	// Lookup by ID, should be nil.
-	idx, s2, err := s.SessionGet(session.ID)
+	// Everything comes back in order.
+	idx, feed, err = s.ChangeFeed(0, 0)
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatalf("err: %s", err)
 	}
-	if s2 != nil {
-		t.Fatalf("session should be invalidated")
+	if idx != 8 || feed.LastSeq != 10 || feed.Truncated {
+		t.Fatalf("bad: %d %#v", idx, feed)
+	}
+	expected := structs.ChangeFeedEntries{
+		&structs.ChangeFeedEntry{Seq: 1, Index: 1, Type: structs.ChangeFeedNodes, Op: structs.ChangeFeedSet, Node: "", Key: "node1"},
+		&structs.ChangeFeedEntry{Seq: 2, Index: 2, Type: structs.ChangeFeedServices, Op: structs.ChangeFeedSet, Node: "node1", Key: "service1", Service: "service1"},
+		&structs.ChangeFeedEntry{Seq: 3, Index: 3, Type: structs.ChangeFeedChecks, Op: structs.ChangeFeedSet, Node: "node1", Key: "check1", Service: "service1"},
+		&structs.ChangeFeedEntry{Seq: 4, Index: 4, Type: structs.ChangeFeedKVS, Op: structs.ChangeFeedSet, Node: "", Key: "foo/a"},
+		&structs.ChangeFeedEntry{Seq: 5, Index: 4, Type: structs.ChangeFeedKVS, Op: structs.ChangeFeedSet, Node: "", Key: "foo/b"},
+		&structs.ChangeFeedEntry{Seq: 6, Index: 5, Type: structs.ChangeFeedKVS, Op: structs.ChangeFeedDelete, Node: "", Key: "foo/a"},
+		&structs.ChangeFeedEntry{Seq: 7, Index: 6, Type: structs.ChangeFeedKVS, Op: structs.ChangeFeedDeleteTree, Node: "", Key: "foo"},
+		&structs.ChangeFeedEntry{Seq: 8, Index: 7, Type: structs.ChangeFeedChecks, Op: structs.ChangeFeedDelete, Node: "node1", Key: "check1", Service: "service1"},
+		&structs.ChangeFeedEntry{Seq: 9, Index: 7, Type: structs.ChangeFeedServices, Op: structs.ChangeFeedDelete, Node: "node1", Key: "service1", Service: "service1"},
+		&structs.ChangeFeedEntry{Seq: 10, Index: 8, Type: structs.ChangeFeedNodes, Op: structs.ChangeFeedDelete, Node: "", Key: "node1"},
+	}
+	if !reflect.DeepEqual(feed.Entries, expected) {
+		for _, e := range feed.Entries {
+			t.Logf("%#v", e)
+		}
+		t.Fatalf("bad")
 	}
-	if idx != 15 {
-		t.Fatalf("bad index: %d", idx)
+
+	// Read from the middle with a limit.
+	_, feed, err = s.ChangeFeed(3, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(feed.Entries, expected[3:5]) || feed.LastSeq != 10 {
+		t.Fatalf("bad: %#v", feed)
 	}
 
-	// Manually make sure the session checks mapping is clear.
-	tx := s.db.Txn(false)
-	mapping, err := tx.First("session_checks", "session", session.ID)
+	// Reading from the end returns nothing.
+	_, feed, err = s.ChangeFeed(10, 0)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if mapping != nil {
-		t.Fatalf("unexpected session check")
+	if len(feed.Entries) != 0 || feed.Truncated {
+		t.Fatalf("bad: %#v", feed)
 	}
-	tx.Abort()
 }
 
-func TestStateStore_Session_Invalidate_Key_Unlock_Behavior(t *testing.T) {
+func TestStateStore_ChangeFeed_Truncated(t *testing.T) {
 	s := testStateStore(t)
 
-	// Set up our test environment.
-	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	session := &structs.Session{
-		ID:        testUUID(),
-		Node:      "foo",
-		LockDelay: 50 * time.Millisecond,
-	}
-	if err := s.SessionCreate(4, session); err != nil {
-		t.Fatalf("err: %v", err)
+	// Push the first few changes out of the feed.
+	for i := uint64(1); i <= changeFeedRetain+5; i++ {
+		testSetKey(t, s, i, "foo", "bar")
 	}
 
-	// Lock a key with the session.
-	d := &structs.DirEntry{
-		Key:     "/foo",
-		Flags:   42,
-		Value:   []byte("test"),
-		Session: session.ID,
-	}
-	ok, err := s.KVSLock(5, d)
+	// A reader that's fallen behind is told so, and picks up from the
+	// oldest change that's left.
+	_, feed, err := s.ChangeFeed(3, 2)
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatalf("err: %s", err)
 	}
-	if !ok {
-		t.Fatalf("unexpected fail")
+	if !feed.Truncated || len(feed.Entries) != 2 || feed.Entries[0].Seq != 6 || feed.Entries[1].Seq != 7 {
+		t.Fatalf("bad: %#v", feed)
 	}
 
-	// Delete the node and make sure the watches fire.
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		verifyWatch(t, s.getTableWatch("nodes"), func() {
-			verifyWatch(t, s.GetKVSWatch("/f"), func() {
-				if err := s.DeleteNode(6, "foo"); err != nil {
-					t.Fatalf("err: %v", err)
-				}
-			})
-		})
-	})
-
-	// Lookup by ID, should be nil.
-	idx, s2, err := s.SessionGet(session.ID)
+	// A reader that's kept up is fine.
+	_, feed, err = s.ChangeFeed(5, 1)
 	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if s2 != nil {
-		t.Fatalf("session should be invalidated")
+		t.Fatalf("err: %s", err)
 	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
+	if feed.Truncated || len(feed.Entries) != 1 || feed.Entries[0].Seq != 6 {
+		t.Fatalf("bad: %#v", feed)
 	}
-
-	// Key should be unlocked.
-	idx, d2, err := s.KVSGet("/foo")
+	_, feed, err = s.ChangeFeed(0, 0)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if d2.ModifyIndex != 6 {
-		t.Fatalf("bad index: %v", d2.ModifyIndex)
-	}
-	if d2.LockIndex != 1 {
-		t.Fatalf("bad: %v", *d2)
-	}
-	if d2.Session != "" {
-		t.Fatalf("bad: %v", *d2)
-	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
-	}
-
-	// Key should have a lock delay.
-	expires := s.KVSLockDelay("/foo")
-	if expires.Before(time.Now().Add(30 * time.Millisecond)) {
-		t.Fatalf("Bad: %v", expires)
+	if len(feed.Entries) != changeFeedRetain || feed.LastSeq != changeFeedRetain+5 {
+		t.Fatalf("bad: %d %d", len(feed.Entries), feed.LastSeq)
 	}
 }
 
-func TestStateStore_Session_Invalidate_Key_Delete_Behavior(t *testing.T) {
+func TestStateStore_ChangeFeed_Snapshot_Restore(t *testing.T) {
 	s := testStateStore(t)
 
-	// Set up our test environment.
-	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	session := &structs.Session{
-		ID:        testUUID(),
-		Node:      "foo",
-		LockDelay: 50 * time.Millisecond,
-		Behavior:  structs.SessionKeysDelete,
-	}
-	if err := s.SessionCreate(4, session); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-
-	// Lock a key with the session.
-	d := &structs.DirEntry{
-		Key:     "/bar",
-		Flags:   42,
-		Value:   []byte("test"),
-		Session: session.ID,
-	}
-	ok, err := s.KVSLock(5, d)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if !ok {
-		t.Fatalf("unexpected fail")
-	}
+	// Make some changes.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testSetKey(t, s, 3, "foo", "bar")
 
-	// Delete the node and make sure the watches fire.
-	verifyWatch(t, s.getTableWatch("sessions"), func() {
-		verifyWatch(t, s.getTableWatch("nodes"), func() {
-			verifyWatch(t, s.GetKVSWatch("/b"), func() {
-				if err := s.DeleteNode(6, "foo"); err != nil {
-					t.Fatalf("err: %v", err)
-				}
-			})
-		})
-	})
+	// Snapshot the feed.
+	snap := s.Snapshot()
+	defer snap.Close()
 
-	// Lookup by ID, should be nil.
-	idx, s2, err := s.SessionGet(session.ID)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if s2 != nil {
-		t.Fatalf("session should be invalidated")
-	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
-	}
+	// Alter the real state store.
+	testSetKey(t, s, 4, "foo", "zip")
 
-	// Key should be deleted.
-	idx, d2, err := s.KVSGet("/bar")
+	// Verify the snapshot.
+	dump, err := snap.ChangeFeed()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if d2 != nil {
-		t.Fatalf("unexpected deleted key")
-	}
-	if idx != 6 {
-		t.Fatalf("bad index: %d", idx)
+	if len(dump) != 3 || dump[2].Seq != 3 || dump[2].Key != "foo" {
+		t.Fatalf("bad: %#v", dump)
 	}
 
-	// Key should have a lock delay.
-	expires := s.KVSLockDelay("/bar")
-	if expires.Before(time.Now().Add(30 * time.Millisecond)) {
-		t.Fatalf("Bad: %v", expires)
-	}
+	// Restore the values into a new state store. Rebuilding the catalog
+	// shouldn't add to the feed.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		req := &structs.RegisterRequest{
+			Node:    "node1",
+			Service: &structs.NodeService{ID: "service1"},
+		}
+		if err := restore.Registration(2, req); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, entry := range dump {
+			if err := restore.ChangeFeedEntry(entry); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		// Read the restored feed back out and verify that it matches.
+		idx, feed, err := s.ChangeFeed(0, 0)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 3 || feed.LastSeq != 3 {
+			t.Fatalf("bad: %d %#v", idx, feed)
+		}
+		if !reflect.DeepEqual(feed.Entries, dump) {
+			t.Fatalf("bad: %#v", feed.Entries)
+		}
+
+		// New changes carry on from the restored sequence number.
+		testSetKey(t, s, 5, "foo", "baz")
+		_, feed, err = s.ChangeFeed(3, 0)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if len(feed.Entries) != 1 || feed.Entries[0].Seq != 4 {
+			t.Fatalf("bad: %#v", feed.Entries)
+		}
+	}()
 }
 
-func TestStateStore_ACLSet_ACLGet(t *testing.T) {
+func TestStateStore_ChangeFeed_Watches(t *testing.T) {
 	s := testStateStore(t)
 
-	// Querying ACLs with no results returns nil
-	idx, res, err := s.ACLGet("nope")
-	if idx != 0 || res != nil || err != nil {
-		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
-	}
-
-	// Inserting an ACL with empty ID is disallowed
-	if err := s.ACLSet(1, &structs.ACL{}); err == nil {
-		t.Fatalf("expected %#v, got: %#v", ErrMissingACLID, err)
-	}
+	// Call functions that add to the change feed and make sure a watch
+	// fires each time.
+	verifyWatch(t, s.getTableWatch("change_feed"), func() {
+		testRegisterNode(t, s, 1, "node1")
+	})
+	verifyWatch(t, s.getTableWatch("change_feed"), func() {
+		testSetKey(t, s, 2, "foo", "bar")
+	})
+	verifyWatch(t, s.getTableWatch("change_feed"), func() {
+		restore := s.Restore()
+		entry := &structs.ChangeFeedEntry{Seq: 5, Index: 3, Type: structs.ChangeFeedKVS}
+		if err := restore.ChangeFeedEntry(entry); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		restore.Commit()
+	})
+}
 
-	// Index is not updated if nothing is saved
-	if idx := s.maxIndex("acls"); idx != 0 {
-		t.Fatalf("bad index: %d", idx)
-	}
+func TestStateStore_CheckHistory(t *testing.T) {
+	s := testStateStore(t)
 
-	// Inserting valid ACL works
-	acl := &structs.ACL{
-		ID:    "acl1",
-		Name:  "First ACL",
-		Type:  structs.ACLTypeClient,
-		Rules: "rules1",
-	}
-	if err := s.ACLSet(1, acl); err != nil {
+	// Unknown checks have no history.
+	idx, history, err := s.CheckHistory("node1", "check1")
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Check that the index was updated
-	if idx := s.maxIndex("acls"); idx != 1 {
-		t.Fatalf("bad index: %d", idx)
+	if idx != 0 || len(history) != 0 {
+		t.Fatalf("bad: %d %#v", idx, history)
 	}
 
-	// Retrieve the ACL again
-	idx, result, err := s.ACLGet("acl1")
+	// Registering a check records its first status.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterCheck(t, s, 3, "node1", "service1", "check1", structs.HealthPassing)
+	idx, history, err = s.CheckHistory("node1", "check1")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 1 {
-		t.Fatalf("bad index: %d", idx)
+	if idx != 3 || len(history) != 1 {
+		t.Fatalf("bad: %d %#v", idx, history)
 	}
-
-	// Check that the ACL matches the result
-	expect := &structs.ACL{
-		ID:    "acl1",
-		Name:  "First ACL",
-		Type:  structs.ACLTypeClient,
-		Rules: "rules1",
-		RaftIndex: structs.RaftIndex{
-			CreateIndex: 1,
-			ModifyIndex: 1,
-		},
+	expected := &structs.CheckTransition{
+		Node:        "node1",
+		CheckID:     "check1",
+		ServiceID:   "service1",
+		ServiceName: "service1",
+		Status:      structs.HealthPassing,
+		Index:       3,
 	}
-	if !reflect.DeepEqual(result, expect) {
-		t.Fatalf("bad: %#v", result)
+	if !reflect.DeepEqual(history[0], expected) {
+		t.Fatalf("bad: %#v", history[0])
 	}
 
-	// Update the ACL
-	acl = &structs.ACL{
-		ID:    "acl1",
-		Name:  "First ACL",
-		Type:  structs.ACLTypeClient,
-		Rules: "rules2",
+	// Updates that keep the same status aren't transitions.
+	check := &structs.HealthCheck{
+		Node:      "node1",
+		CheckID:   "check1",
+		ServiceID: "service1",
+		Status:    structs.HealthPassing,
+		Output:    "still fine",
 	}
-	if err := s.ACLSet(2, acl); err != nil {
+	if err := s.EnsureCheck(4, check); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Index was updated
-	if idx := s.maxIndex("acls"); idx != 2 {
-		t.Fatalf("bad: %d", idx)
+	// A status change is recorded with its output, which comes back out
+	// decoded even when it was stored compressed.
+	check.Status = structs.HealthCritical
+	check.Output = strings.Repeat("connection refused\n", 100)
+	if err := s.EnsureCheck(5, check); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// ACL was updated and matches expected value
-	expect = &structs.ACL{
-		ID:    "acl1",
-		Name:  "First ACL",
-		Type:  structs.ACLTypeClient,
-		Rules: "rules2",
-		RaftIndex: structs.RaftIndex{
-			CreateIndex: 1,
-			ModifyIndex: 2,
-		},
+	idx, history, err = s.CheckHistory("node1", "check1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if !reflect.DeepEqual(acl, expect) {
-		t.Fatalf("bad: %#v", acl)
+	if idx != 5 || len(history) != 2 {
+		t.Fatalf("bad: %d %#v", idx, history)
 	}
-}
-
-func TestStateStore_ACLList(t *testing.T) {
-	s := testStateStore(t)
-
-	// Listing when no ACLs exist returns nil
-	idx, res, err := s.ACLList()
-	if idx != 0 || res != nil || err != nil {
-		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	if history[1].Status != structs.HealthCritical || history[1].Output != check.Output ||
+		history[1].Index != 5 {
+		t.Fatalf("bad: %#v", history[1])
 	}
 
-	// Insert some ACLs
-	acls := structs.ACLs{
-		&structs.ACL{
-			ID:    "acl1",
-			Type:  structs.ACLTypeClient,
-			Rules: "rules1",
-			RaftIndex: structs.RaftIndex{
-				CreateIndex: 1,
-				ModifyIndex: 1,
-			},
-		},
-		&structs.ACL{
-			ID:    "acl2",
-			Type:  structs.ACLTypeClient,
-			Rules: "rules2",
-			RaftIndex: structs.RaftIndex{
-				CreateIndex: 2,
-				ModifyIndex: 2,
-			},
-		},
-	}
-	for _, acl := range acls {
-		if err := s.ACLSet(acl.ModifyIndex, acl); err != nil {
+	// Only the most recent transitions are kept, oldest first.
+	for i := 0; i < checkHistoryRetain; i++ {
+		if check.Status == structs.HealthCritical {
+			check.Status = structs.HealthPassing
+		} else {
+			check.Status = structs.HealthCritical
+		}
+		if err := s.EnsureCheck(uint64(6+i), check); err != nil {
 			t.Fatalf("err: %s", err)
 		}
 	}
-
-	// Query the ACLs
-	idx, res, err = s.ACLList()
+	_, history, err = s.CheckHistory("node1", "check1")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 2 {
-		t.Fatalf("bad index: %d", idx)
+	if len(history) != checkHistoryRetain {
+		t.Fatalf("bad: %#v", history)
 	}
-
-	// Check that the result matches
-	if !reflect.DeepEqual(res, acls) {
-		t.Fatalf("bad: %#v", res)
+	for i, t2 := range history {
+		if t2.Index != uint64(6+i) {
+			t.Fatalf("bad: %#v", t2)
+		}
 	}
-}
-
-func TestStateStore_ACLDelete(t *testing.T) {
-	s := testStateStore(t)
 
-	// Calling delete on an ACL which doesn't exist returns nil
-	if err := s.ACLDelete(1, "nope"); err != nil {
+	// Other checks' history is kept separately.
+	testRegisterCheck(t, s, 20, "node1", "", "check2", structs.HealthWarning)
+	_, history, err = s.CheckHistory("node1", "check2")
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Index isn't updated if nothing is deleted
-	if idx := s.maxIndex("acls"); idx != 0 {
-		t.Fatalf("bad index: %d", idx)
-	}
-
-	// Insert an ACL
-	if err := s.ACLSet(1, &structs.ACL{ID: "acl1"}); err != nil {
-		t.Fatalf("err: %s", err)
+	if len(history) != 1 || history[0].Status != structs.HealthWarning {
+		t.Fatalf("bad: %#v", history)
 	}
 
-	// Delete the ACL and check that the index was updated
-	if err := s.ACLDelete(2, "acl1"); err != nil {
+	// Deleting a check removes its history.
+	if err := s.DeleteCheck(21, "node1", "check1"); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx := s.maxIndex("acls"); idx != 2 {
-		t.Fatalf("bad index: %d", idx)
-	}
-
-	tx := s.db.Txn(false)
-	defer tx.Abort()
-
-	// Check that the ACL was really deleted
-	result, err := tx.First("acls", "id", "acl1")
+	idx, history, err = s.CheckHistory("node1", "check1")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if result != nil {
-		t.Fatalf("expected nil, got: %#v", result)
+	if idx != 21 || len(history) != 0 {
+		t.Fatalf("bad: %d %#v", idx, history)
 	}
 }
 
-func TestStateStore_ACL_Snapshot_Restore(t *testing.T) {
+func TestStateStore_CheckHistory_Snapshot_Restore(t *testing.T) {
 	s := testStateStore(t)
 
-	// Insert some ACLs.
-	acls := structs.ACLs{
-		&structs.ACL{
-			ID:    "acl1",
-			Type:  structs.ACLTypeClient,
-			Rules: "rules1",
-			RaftIndex: structs.RaftIndex{
-				CreateIndex: 1,
-				ModifyIndex: 1,
-			},
-		},
-		&structs.ACL{
-			ID:    "acl2",
-			Type:  structs.ACLTypeClient,
-			Rules: "rules2",
-			RaftIndex: structs.RaftIndex{
-				CreateIndex: 2,
-				ModifyIndex: 2,
-			},
-		},
-	}
-	for _, acl := range acls {
-		if err := s.ACLSet(acl.ModifyIndex, acl); err != nil {
-			t.Fatalf("err: %s", err)
-		}
-	}
+	// Make a check flip a couple of times.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterCheck(t, s, 2, "node1", "", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 3, "node1", "", "check1", structs.HealthCritical)
 
-	// Snapshot the ACLs.
+	// Snapshot the history.
 	snap := s.Snapshot()
 	defer snap.Close()
 
 	// Alter the real state store.
-	if err := s.ACLDelete(3, "acl1"); err != nil {
-		t.Fatalf("err: %s", err)
-	}
+	testRegisterCheck(t, s, 4, "node1", "", "check1", structs.HealthPassing)
 
 	// Verify the snapshot.
-	if idx := snap.LastIndex(); idx != 2 {
-		t.Fatalf("bad index: %d", idx)
-	}
-	iter, err := snap.ACLs()
+	dump, err := snap.CheckHistory()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	var dump structs.ACLs
-	for acl := iter.Next(); acl != nil; acl = iter.Next() {
-		dump = append(dump, acl.(*structs.ACL))
-	}
-	if !reflect.DeepEqual(dump, acls) {
+	if len(dump) != 2 || dump[1].Index != 3 || dump[1].Status != structs.HealthCritical {
 		t.Fatalf("bad: %#v", dump)
 	}
 
-	// Restore the values into a new state store.
+	// Restore the values into a new state store. Rebuilding the checks
+	// shouldn't add to the history.
 	func() {
 		s := testStateStore(t)
 		restore := s.Restore()
-		for _, acl := range dump {
-			if err := restore.ACL(acl); err != nil {
+		req := &structs.RegisterRequest{
+			Node:  "node1",
+			Check: &structs.HealthCheck{Node: "node1", CheckID: "check1", Status: structs.HealthCritical},
+		}
+		if err := restore.Registration(3, req); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, t2 := range dump {
+			if err := restore.CheckTransition(t2); err != nil {
 				t.Fatalf("err: %s", err)
 			}
 		}
 		restore.Commit()
 
-		// Read the restored ACLs back out and verify that they match.
-		idx, res, err := s.ACLList()
+		// Read the restored history back out and verify that it matches.
+		idx, history, err := s.CheckHistory("node1", "check1")
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		if idx != 2 {
-			t.Fatalf("bad index: %d", idx)
-		}
-		if !reflect.DeepEqual(res, acls) {
-			t.Fatalf("bad: %#v", res)
-		}
-
-		// Check that the index was updated.
-		if idx := s.maxIndex("acls"); idx != 2 {
-			t.Fatalf("bad index: %d", idx)
+		if idx != 3 || !reflect.DeepEqual(history, dump) {
+			t.Fatalf("bad: %d %#v", idx, history)
 		}
 	}()
 }
 
-func TestStateStore_ACL_Watches(t *testing.T) {
+func TestStateStore_CheckHistory_Watches(t *testing.T) {
 	s := testStateStore(t)
 
-	// Call functions that update the acls table and make sure a watch fires
-	// each time.
-	verifyWatch(t, s.getTableWatch("acls"), func() {
-		if err := s.ACLSet(1, &structs.ACL{ID: "acl1"}); err != nil {
-			t.Fatalf("err: %s", err)
-		}
+	testRegisterNode(t, s, 1, "node1")
+	verifyWatch(t, s.getTableWatch("check_history"), func() {
+		testRegisterCheck(t, s, 2, "node1", "", "check1", structs.HealthPassing)
 	})
-	verifyWatch(t, s.getTableWatch("acls"), func() {
-		if err := s.ACLDelete(2, "acl1"); err != nil {
+	verifyWatch(t, s.getTableWatch("check_history"), func() {
+		testRegisterCheck(t, s, 3, "node1", "", "check1", structs.HealthCritical)
+	})
+	verifyNoWatch(t, s.getTableWatch("check_history"), func() {
+		testRegisterCheck(t, s, 4, "node1", "", "check1", structs.HealthCritical)
+	})
+	verifyWatch(t, s.getTableWatch("check_history"), func() {
+		if err := s.DeleteCheck(5, "node1", "check1"); err != nil {
 			t.Fatalf("err: %s", err)
 		}
 	})
-	verifyWatch(t, s.getTableWatch("acls"), func() {
+	verifyWatch(t, s.getTableWatch("check_history"), func() {
 		restore := s.Restore()
-		if err := restore.ACL(&structs.ACL{ID: "acl1"}); err != nil {
+		t2 := &structs.CheckTransition{Node: "node1", CheckID: "check1", Index: 6}
+		if err := restore.CheckTransition(t2); err != nil {
 			t.Fatalf("err: %s", err)
 		}
 		restore.Commit()
 	})
 }
 
-// generateRandomCoordinate creates a random coordinate. This mucks with the
-// underlying structure directly, so it's not really useful for any particular
-// position in the network, but it's a good payload to send through to make
-// sure things come out the other side or get stored correctly.
-func generateRandomCoordinate() *coordinate.Coordinate {
-	config := coordinate.DefaultConfig()
-	coord := coordinate.NewCoordinate(config)
-	for i := range coord.Vec {
-		coord.Vec[i] = rand.NormFloat64()
-	}
-	coord.Error = rand.NormFloat64()
-	coord.Adjustment = rand.NormFloat64()
-	return coord
-}
-
-func TestStateStore_Coordinate_Updates(t *testing.T) {
+func TestStateStore_ServiceEvents(t *testing.T) {
 	s := testStateStore(t)
 
-	// Make sure the coordinates list starts out empty, and that a query for
-	// a raw coordinate for a nonexistent node doesn't do anything bad.
-	idx, coords, err := s.Coordinates()
+	// Register a couple of instances, plus one of another service.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterService(t, s, 3, "node1", "service1")
+	testRegisterService(t, s, 4, "node2", "service1")
+	testRegisterService(t, s, 5, "node2", "service2")
+
+	// The first request gets everything.
+	idx, events, err := s.ServiceEvents("service1", 0)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 0 {
-		t.Fatalf("bad index: %d", idx)
+	if idx != 5 || !events.Reset || events.LastSeq != 5 || len(events.Events) != 2 {
+		t.Fatalf("bad: %d %#v", idx, events)
 	}
-	if coords != nil {
-		t.Fatalf("bad: %#v", coords)
+	for i, node := range []string{"node1", "node2"} {
+		e := events.Events[i]
+		if e.Op != structs.ServiceEventAdd || e.Node != node || e.ServiceID != "service1" ||
+			e.Instance == nil || e.Instance.Node.Node != node || e.Instance.Service.ID != "service1" {
+			t.Fatalf("bad: %#v", e)
+		}
 	}
-	coord, err := s.CoordinateGetRaw("nope")
+	since := events.LastSeq
+
+	// Nothing has changed yet.
+	_, events, err = s.ServiceEvents("service1", since)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if coord != nil {
-		t.Fatalf("bad: %#v", coord)
+	if events.Reset || len(events.Events) != 0 {
+		t.Fatalf("bad: %#v", events)
 	}
 
-	// Make an update for nodes that don't exist and make sure they get
-	// ignored.
-	updates := structs.Coordinates{
-		&structs.Coordinate{
-			Node:  "node1",
-			Coord: generateRandomCoordinate(),
-		},
-		&structs.Coordinate{
-			Node:  "node2",
-			Coord: generateRandomCoordinate(),
-		},
+	// Changes to other services don't show up.
+	testRegisterCheck(t, s, 6, "node2", "service2", "check2", structs.HealthCritical)
+	_, events, err = s.ServiceEvents("service1", since)
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.CoordinateBatchUpdate(1, updates); err != nil {
+	if events.Reset || len(events.Events) != 0 || events.LastSeq != 6 {
+		t.Fatalf("bad: %#v", events)
+	}
+
+	// Fail a node-level check, add an instance, and remove one.
+	testRegisterCheck(t, s, 7, "node1", "", "check1", structs.HealthCritical)
+	testRegisterNode(t, s, 8, "node3")
+	testRegisterService(t, s, 9, "node3", "service1")
+	if err := s.DeleteService(10, "node2", "service1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, events, err = s.ServiceEvents("service1", since)
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	if idx != 10 || events.Reset || len(events.Events) != 3 {
+		t.Fatalf("bad: %d %#v", idx, events)
+	}
+	if e := events.Events[0]; e.Op != structs.ServiceEventUpdate || e.Node != "node1" ||
+		e.Instance == nil || len(e.Instance.Checks) != 1 || e.Instance.Checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := events.Events[1]; e.Op != structs.ServiceEventAdd || e.Node != "node3" || e.Instance == nil {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := events.Events[2]; e.Op != structs.ServiceEventRemove || e.Node != "node2" ||
+		e.ServiceID != "service1" || e.Instance != nil {
+		t.Fatalf("bad: %#v", e)
+	}
 
-	// Should still be empty, though applying an empty batch does bump
-	// the table index.
-	idx, coords, err = s.Coordinates()
+	// A subscriber that's fallen behind the feed starts over.
+	for i := uint64(11); i <= changeFeedRetain+11; i++ {
+		testSetKey(t, s, i, "foo", "bar")
+	}
+	_, events, err = s.ServiceEvents("service1", since)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 1 {
-		t.Fatalf("bad index: %d", idx)
-	}
-	if coords != nil {
-		t.Fatalf("bad: %#v", coords)
+	if !events.Reset || len(events.Events) != 2 {
+		t.Fatalf("bad: %#v", events)
 	}
+}
+
+func TestStateStore_ServiceEventsSinceIndex(t *testing.T) {
+	s := testStateStore(t)
 
-	// Register the nodes then do the update again.
 	testRegisterNode(t, s, 1, "node1")
 	testRegisterNode(t, s, 2, "node2")
-	if err := s.CoordinateBatchUpdate(3, updates); err != nil {
+	testRegisterService(t, s, 3, "node1", "service1")
+
+	// A zero index gets everything.
+	idx, events, err := s.ServiceEventsSinceIndex("service1", 0)
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	if idx != 3 || !events.Reset || len(events.Events) != 1 {
+		t.Fatalf("bad: %d %#v", idx, events)
+	}
 
-	// Should go through now.
-	idx, coords, err = s.Coordinates()
+	// Nothing has changed since the last index.
+	_, events, err = s.ServiceEventsSinceIndex("service1", idx)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 3 {
-		t.Fatalf("bad index: %d", idx)
-	}
-	if !reflect.DeepEqual(coords, updates) {
-		t.Fatalf("bad: %#v", coords)
+	if events.Reset || len(events.Events) != 0 {
+		t.Fatalf("bad: %#v", events)
 	}
 
-	// Also verify the raw coordinate interface.
-	for _, update := range updates {
-		coord, err := s.CoordinateGetRaw(update.Node)
-		if err != nil {
-			t.Fatalf("err: %s", err)
-		}
-		if !reflect.DeepEqual(coord, update.Coord) {
-			t.Fatalf("bad: %#v", coord)
-		}
+	// Only the changes after the index are returned.
+	testRegisterService(t, s, 4, "node2", "service1")
+	testRegisterCheck(t, s, 5, "node2", "service1", "check1", structs.HealthCritical)
+	if err := s.DeleteService(6, "node1", "service1"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-
-	// Update the coordinate for one of the nodes.
-	updates[1].Coord = generateRandomCoordinate()
-	if err := s.CoordinateBatchUpdate(4, updates); err != nil {
+	_, events, err = s.ServiceEventsSinceIndex("service1", 5)
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Verify it got applied.
-	idx, coords, err = s.Coordinates()
+	if events.Reset || len(events.Events) != 1 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if e := events.Events[0]; e.Op != structs.ServiceEventRemove || e.Node != "node1" {
+		t.Fatalf("bad: %#v", e)
+	}
+	idx, events, err = s.ServiceEventsSinceIndex("service1", 3)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 4 {
-		t.Fatalf("bad index: %d", idx)
+	if idx != 6 || events.Reset || len(events.Events) != 2 {
+		t.Fatalf("bad: %d %#v", idx, events)
 	}
-	if !reflect.DeepEqual(coords, updates) {
-		t.Fatalf("bad: %#v", coords)
+	if e := events.Events[0]; e.Op != structs.ServiceEventAdd || e.Node != "node2" ||
+		e.Instance == nil || len(e.Instance.Checks) != 1 {
+		t.Fatalf("bad: %#v", e)
 	}
 
-	// And check the raw coordinate version of the same thing.
-	for _, update := range updates {
-		coord, err := s.CoordinateGetRaw(update.Node)
-		if err != nil {
-			t.Fatalf("err: %s", err)
-		}
-		if !reflect.DeepEqual(coord, update.Coord) {
-			t.Fatalf("bad: %#v", coord)
-		}
+	// An index the feed no longer covers starts over.
+	for i := uint64(7); i <= changeFeedRetain+7; i++ {
+		testSetKey(t, s, i, "foo", "bar")
+	}
+	_, events, err = s.ServiceEventsSinceIndex("service1", 3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !events.Reset || len(events.Events) != 1 || events.Events[0].Node != "node2" {
+		t.Fatalf("bad: %#v", events)
 	}
 }
 
-func TestStateStore_Coordinate_Cleanup(t *testing.T) {
+func TestStateStore_NodeChangesSinceIndex(t *testing.T) {
 	s := testStateStore(t)
 
-	// Register a node and update its coordinate.
 	testRegisterNode(t, s, 1, "node1")
-	updates := structs.Coordinates{
-		&structs.Coordinate{
-			Node:  "node1",
-			Coord: generateRandomCoordinate(),
-		},
-	}
-	if err := s.CoordinateBatchUpdate(2, updates); err != nil {
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterService(t, s, 3, "node1", "service1")
+	testRegisterCheck(t, s, 4, "node1", "service1", "check1", structs.HealthPassing)
+
+	// A zero index gets everything.
+	idx, delta, err := s.NodeChangesSinceIndex("node1", 0)
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	if idx != 4 || !delta.Reset || delta.Node == nil ||
+		len(delta.Services) != 1 || len(delta.Checks) != 1 {
+		t.Fatalf("bad: %d %#v", idx, delta)
+	}
 
-	// Make sure it's in there.
-	coord, err := s.CoordinateGetRaw("node1")
+	// Nothing has changed since the last index.
+	_, delta, err = s.NodeChangesSinceIndex("node1", idx)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if !reflect.DeepEqual(coord, updates[0].Coord) {
-		t.Fatalf("bad: %#v", coord)
+	if delta.Reset || delta.Node == nil || len(delta.Services) != 0 || len(delta.Checks) != 0 ||
+		len(delta.DeletedServices) != 0 || len(delta.DeletedChecks) != 0 {
+		t.Fatalf("bad: %#v", delta)
 	}
 
-	// Now delete the node.
-	if err := s.DeleteNode(3, "node1"); err != nil {
+	// Only this node's changes after the index are returned.
+	testRegisterService(t, s, 5, "node1", "service2")
+	testRegisterService(t, s, 6, "node2", "service1")
+	testRegisterCheck(t, s, 7, "node1", "service1", "check1", structs.HealthCritical)
+	if err := s.DeleteService(8, "node1", "service2"); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Make sure the coordinate is gone.
-	coord, err = s.CoordinateGetRaw("node1")
+	testRegisterService(t, s, 9, "node1", "service3")
+	idx, delta, err = s.NodeChangesSinceIndex("node1", 4)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if coord != nil {
-		t.Fatalf("bad: %#v", coord)
+	if idx != 9 || delta.Reset {
+		t.Fatalf("bad: %d %#v", idx, delta)
+	}
+	if len(delta.Services) != 1 || delta.Services[0].ID != "service3" {
+		t.Fatalf("bad: %#v", delta.Services)
+	}
+	if !reflect.DeepEqual(delta.DeletedServices, []string{"service2"}) {
+		t.Fatalf("bad: %#v", delta.DeletedServices)
+	}
+	if len(delta.Checks) != 1 || delta.Checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %#v", delta.Checks)
 	}
 
-	// Make sure the index got updated.
-	idx, coords, err := s.Coordinates()
+	// Deleting a service takes its checks with it.
+	if err := s.DeleteService(10, "node1", "service1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, delta, err = s.NodeChangesSinceIndex("node1", 9)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 3 {
-		t.Fatalf("bad index: %d", idx)
+	if !reflect.DeepEqual(delta.DeletedServices, []string{"service1"}) ||
+		!reflect.DeepEqual(delta.DeletedChecks, []string{"check1"}) {
+		t.Fatalf("bad: %#v", delta)
 	}
-	if coords != nil {
-		t.Fatalf("bad: %#v", coords)
+
+	// An index the feed no longer covers starts over.
+	for i := uint64(11); i <= changeFeedRetain+11; i++ {
+		testSetKey(t, s, i, "foo", "bar")
+	}
+	_, delta, err = s.NodeChangesSinceIndex("node1", 9)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !delta.Reset || len(delta.Services) != 1 || delta.Services[0].ID != "service3" ||
+		len(delta.Checks) != 0 {
+		t.Fatalf("bad: %#v", delta)
 	}
 }
 
-func TestStateStore_Coordinate_Snapshot_Restore(t *testing.T) {
+func TestStateStore_CapacityUsage(t *testing.T) {
 	s := testStateStore(t)
 
-	// Register two nodes and update their coordinates.
+	// Start out empty.
+	idx, usage, err := s.CapacityUsage()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || usage.Services != 0 || usage.KVSKeys != 0 ||
+		len(usage.ServiceInstances) != 0 {
+		t.Fatalf("bad: %d %#v", idx, usage)
+	}
+
+	// Register the same service on two nodes, plus another one.
 	testRegisterNode(t, s, 1, "node1")
 	testRegisterNode(t, s, 2, "node2")
-	updates := structs.Coordinates{
-		&structs.Coordinate{
-			Node:  "node1",
-			Coord: generateRandomCoordinate(),
-		},
-		&structs.Coordinate{
-			Node:  "node2",
-			Coord: generateRandomCoordinate(),
+	testRegisterService(t, s, 3, "node1", "redis")
+	testRegisterService(t, s, 4, "node2", "redis")
+	testRegisterService(t, s, 5, "node1", "web")
+	testSetKey(t, s, 6, "foo", "bar")
+	testSetKey(t, s, 7, "foo/bar", "baz")
+
+	idx, usage, err = s.CapacityUsage()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	expected := &structs.CapacityUsage{
+		Services: 2,
+		ServiceInstances: map[string]int{
+			"redis": 2,
+			"web":   1,
 		},
+		KVSKeys: 2,
 	}
-	if err := s.CoordinateBatchUpdate(3, updates); err != nil {
-		t.Fatalf("err: %s", err)
+	if !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("bad: %#v", usage)
 	}
+}
 
-	// Snapshot the coordinates.
-	snap := s.Snapshot()
-	defer snap.Close()
+func TestStateStore_KVSUsage(t *testing.T) {
+	s := testStateStore(t)
 
-	// Alter the real state store.
-	trash := structs.Coordinates{
-		&structs.Coordinate{
-			Node:  "node1",
-			Coord: generateRandomCoordinate(),
-		},
-		&structs.Coordinate{
-			Node:  "node2",
-			Coord: generateRandomCoordinate(),
-		},
+	testSetKey(t, s, 1, "foo", "bar")
+	testSetKey(t, s, 2, "foo/bar", "baz")
+	testSetKey(t, s, 3, "foo-b", "b")
+	testSetKey(t, s, 4, "zip/zap", "zop")
+
+	// Usage is grouped by the part of the key before the first slash.
+	idx, usages, err := s.KVSUsage()
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := s.CoordinateBatchUpdate(4, trash); err != nil {
+	if idx != 4 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	expected := structs.KVSUsages{
+		&structs.KVSUsage{Prefix: "foo", Keys: 2, Bytes: 16},
+		&structs.KVSUsage{Prefix: "foo-b", Keys: 1, Bytes: 6},
+		&structs.KVSUsage{Prefix: "zip", Keys: 1, Bytes: 10},
+	}
+	if !reflect.DeepEqual(usages, expected) {
+		t.Fatalf("bad: %#v", usages)
+	}
+
+	// The usage for a key comes with its existing entry.
+	usage, existing, err := s.KVSPrefixUsage("foo/new")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(usage, expected[0]) || existing != nil {
+		t.Fatalf("bad: %#v %#v", usage, existing)
+	}
+	usage, existing, err = s.KVSPrefixUsage("foo/bar")
+	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	if !reflect.DeepEqual(usage, expected[0]) || existing == nil || string(existing.Value) != "baz" {
+		t.Fatalf("bad: %#v %#v", usage, existing)
+	}
 
-	// Verify the snapshot.
-	if idx := snap.LastIndex(); idx != 3 {
-		t.Fatalf("bad index: %d", idx)
+	// Updates and deletes are counted as they happen, and a prefix goes
+	// away with its last key.
+	testSetKey(t, s, 5, "foo/bar", "bazbaz")
+	if err := s.KVSDelete(6, "foo"); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	iter, err := snap.Coordinates()
+	if err := s.KVSDeleteTree(7, "zip/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, usages, err = s.KVSUsage()
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	var dump structs.Coordinates
-	for coord := iter.Next(); coord != nil; coord = iter.Next() {
-		dump = append(dump, coord.(*structs.Coordinate))
+	expected = structs.KVSUsages{
+		&structs.KVSUsage{Prefix: "foo", Keys: 1, Bytes: 13},
+		&structs.KVSUsage{Prefix: "foo-b", Keys: 1, Bytes: 6},
 	}
-	if !reflect.DeepEqual(dump, updates) {
-		t.Fatalf("bad: %#v", dump)
+	if !reflect.DeepEqual(usages, expected) {
+		t.Fatalf("bad: %#v", usages)
 	}
 
-	// Restore the values into a new state store.
-	func() {
-		s := testStateStore(t)
-		restore := s.Restore()
-		if err := restore.Coordinates(5, dump); err != nil {
+	// Restoring from a snapshot counts the restored entries.
+	_, ents, err := s.KVSList("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	for _, ent := range ents {
+		if err := restore.KVS(ent); err != nil {
 			t.Fatalf("err: %s", err)
 		}
-		restore.Commit()
+	}
+	restore.Commit()
+	_, usages, err = s2.KVSUsage()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(usages, expected) {
+		t.Fatalf("bad: %#v", usages)
+	}
+}
 
-		// Read the restored coordinates back out and verify that they match.
-		idx, res, err := s.Coordinates()
-		if err != nil {
-			t.Fatalf("err: %s", err)
-		}
-		if idx != 5 {
-			t.Fatalf("bad index: %d", idx)
-		}
-		if !reflect.DeepEqual(res, updates) {
-			t.Fatalf("bad: %#v", res)
-		}
+func TestStateStore_KVSEvents(t *testing.T) {
+	s := testStateStore(t)
 
-		// Check that the index was updated (note that it got passed
-		// in during the restore).
-		if idx := s.maxIndex("coordinates"); idx != 5 {
-			t.Fatalf("bad index: %d", idx)
-		}
-	}()
+	testSetKey(t, s, 1, "foo/a", "a")
+	testSetKey(t, s, 2, "foo/b", "b")
+	testSetKey(t, s, 3, "bar", "bar")
 
-}
+	// The first request gets every key under the prefix.
+	idx, events, err := s.KVSEvents("foo/", 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || !events.Reset || events.LastSeq != 3 || len(events.Events) != 2 {
+		t.Fatalf("bad: %d %#v", idx, events)
+	}
+	if e := events.Events[0]; e.Op != structs.ChangeFeedSet || e.Key != "foo/a" || string(e.Entry.Value) != "a" {
+		t.Fatalf("bad: %#v", e)
+	}
 
-func TestStateStore_Coordinate_Watches(t *testing.T) {
-	s := testStateStore(t)
+	// Later requests only get what changed under the prefix, once per
+	// key, in the order the keys were last changed.
+	testSetKey(t, s, 4, "foo/a", "a2")
+	if err := s.KVSDelete(5, "foo/b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testSetKey(t, s, 6, "bar", "bar2")
+	testSetKey(t, s, 7, "foo/c", "c")
+	testSetKey(t, s, 8, "foo/a", "a3")
+	_, events, err = s.KVSEvents("foo/", events.LastSeq)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if events.Reset || events.LastSeq != 8 || len(events.Events) != 3 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if e := events.Events[0]; e.Op != structs.ChangeFeedDelete || e.Key != "foo/b" || e.Entry != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := events.Events[1]; e.Op != structs.ChangeFeedSet || e.Key != "foo/c" {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := events.Events[2]; e.Op != structs.ChangeFeedSet || string(e.Entry.Value) != "a3" {
+		t.Fatalf("bad: %#v", e)
+	}
 
-	testRegisterNode(t, s, 1, "node1")
+	// Nothing new.
+	_, events, err = s.KVSEvents("foo/", 8)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if events.Reset || len(events.Events) != 0 {
+		t.Fatalf("bad: %#v", events)
+	}
 
-	// Call functions that update the coordinates table and make sure a watch fires
-	// each time.
-	verifyWatch(t, s.getTableWatch("coordinates"), func() {
-		updates := structs.Coordinates{
-			&structs.Coordinate{
-				Node:  "node1",
-				Coord: generateRandomCoordinate(),
-			},
-		}
-		if err := s.CoordinateBatchUpdate(2, updates); err != nil {
-			t.Fatalf("err: %s", err)
-		}
-	})
-	verifyWatch(t, s.getTableWatch("coordinates"), func() {
-		if err := s.DeleteNode(3, "node1"); err != nil {
-			t.Fatalf("err: %s", err)
-		}
-	})
+	// Tree deletes are passed on, clipped to the prefix, and keys set
+	// after them come after them.
+	if err := s.KVSDeleteTree(9, "foo/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testSetKey(t, s, 10, "foo/a", "a4")
+	_, events, err = s.KVSEvents("foo/", 8)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events.Events) != 2 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if e := events.Events[0]; e.Op != structs.ChangeFeedDeleteTree || e.Key != "foo/" {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := events.Events[1]; e.Op != structs.ChangeFeedSet || string(e.Entry.Value) != "a4" {
+		t.Fatalf("bad: %#v", e)
+	}
+	_, events, err = s.KVSEvents("foo/c", 8)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events.Events) != 1 || events.Events[0].Key != "foo/c" ||
+		events.Events[0].Op != structs.ChangeFeedDeleteTree {
+		t.Fatalf("bad: %#v", events)
+	}
 }
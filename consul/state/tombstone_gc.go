@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/hashicorp/consul/consul/clock"
 )
 
 // TombstoneGC is used to track creation of tombstones
@@ -23,6 +25,9 @@ type TombstoneGC struct {
 	ttl         time.Duration
 	granularity time.Duration
 
+	// clock is used for the expiration timers.
+	clock clock.Clock
+
 	// enabled controls if we actually setup any timers.
 	enabled bool
 
@@ -41,15 +46,16 @@ type TombstoneGC struct {
 // to expire in a given interval with a timer
 type expireInterval struct {
 	maxIndex uint64
-	timer    *time.Timer
+	timer    clock.Timer
 }
 
 // NewTombstoneGC is used to construct a new TombstoneGC given
 // a TTL for tombstones and a tracking granularity. Longer TTLs
 // ensure correct behavior for more time, but use more storage.
 // A shorter granularity increases the number of Raft transactions
-// and reduce how far past the TTL we perform GC.
-func NewTombstoneGC(ttl, granularity time.Duration) (*TombstoneGC, error) {
+// and reduce how far past the TTL we perform GC. Timers are run
+// off of the given clock.
+func NewTombstoneGC(ttl, granularity time.Duration, clk clock.Clock) (*TombstoneGC, error) {
 	// Sanity check the inputs
 	if ttl <= 0 || granularity <= 0 {
 		return nil, fmt.Errorf("Tombstone TTL and granularity must be positive")
@@ -58,6 +64,7 @@ func NewTombstoneGC(ttl, granularity time.Duration) (*TombstoneGC, error) {
 	t := &TombstoneGC{
 		ttl:         ttl,
 		granularity: granularity,
+		clock:       clk,
 		enabled:     false,
 		expires:     make(map[time.Time]*expireInterval),
 		expireCh:    make(chan uint64, 1),
@@ -65,6 +72,45 @@ func NewTombstoneGC(ttl, granularity time.Duration) (*TombstoneGC, error) {
 	return t, nil
 }
 
+// SetTTL is used to change the TTL and granularity at runtime. Only
+// tombstones hinted after this use the new values; pending expirations
+// keep their timers.
+func (t *TombstoneGC) SetTTL(ttl, granularity time.Duration) error {
+	if ttl <= 0 || granularity <= 0 {
+		return fmt.Errorf("Tombstone TTL and granularity must be positive")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ttl, t.granularity = ttl, granularity
+	return nil
+}
+
+// TTL returns the current TTL and granularity
+func (t *TombstoneGC) TTL() (time.Duration, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.ttl, t.granularity
+}
+
+// ExpireNow stops all the pending expiration timers and returns the
+// highest index they would have expired, or zero if none were pending.
+// The caller is responsible for reaping up to that index.
+func (t *TombstoneGC) ExpireNow() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var maxIndex uint64
+	for _, exp := range t.expires {
+		exp.timer.Stop()
+		if exp.maxIndex > maxIndex {
+			maxIndex = exp.maxIndex
+		}
+	}
+	t.expires = make(map[time.Time]*expireInterval)
+	return maxIndex
+}
+
 // ExpireCh is used to return a channel that streams the next index
 // that should be expired
 func (t *TombstoneGC) ExpireCh() <-chan uint64 {
@@ -95,13 +141,12 @@ func (t *TombstoneGC) SetEnabled(enabled bool) {
 // Hint is used to indicate that keys at the given index have been
 // deleted, and that their GC should be scheduled.
 func (t *TombstoneGC) Hint(index uint64) {
-	expires := t.nextExpires()
-
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	if !t.enabled {
 		return
 	}
+	expires := t.nextExpires()
 
 	// Check for an existing expiration timer
 	exp, ok := t.expires[expires]
@@ -116,7 +161,7 @@ func (t *TombstoneGC) Hint(index uint64) {
 	// Create new expiration time
 	t.expires[expires] = &expireInterval{
 		maxIndex: index,
-		timer: time.AfterFunc(expires.Sub(time.Now()), func() {
+		timer: t.clock.AfterFunc(expires.Sub(t.clock.Now()), func() {
 			t.expireTime(expires)
 		}),
 	}
@@ -129,9 +174,10 @@ func (t *TombstoneGC) PendingExpiration() bool {
 	return len(t.expires) > 0
 }
 
-// nextExpires is used to calculate the next expiration time
+// nextExpires is used to calculate the next expiration time. The
+// lock must be held.
 func (t *TombstoneGC) nextExpires() time.Time {
-	expires := time.Now().Add(t.ttl)
+	expires := t.clock.Now().Add(t.ttl)
 	remain := expires.UnixNano() % int64(t.granularity)
 	adj := expires.Add(t.granularity - time.Duration(remain))
 	return adj
@@ -141,10 +187,15 @@ func (t *TombstoneGC) nextExpires() time.Time {
 func (t *TombstoneGC) expireTime(expires time.Time) {
 	// Get the maximum index and clear the entry
 	t.lock.Lock()
-	exp := t.expires[expires]
+	exp, ok := t.expires[expires]
 	delete(t.expires, expires)
 	t.lock.Unlock()
 
+	// The timer may have fired just as it was being stopped
+	if !ok {
+		return
+	}
+
 	// Notify the expires channel
 	t.expireCh <- exp.maxIndex
 }
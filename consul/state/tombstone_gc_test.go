@@ -3,29 +3,32 @@ package state
 import (
 	"testing"
 	"time"
+
+	"github.com/hashicorp/consul/consul/clock"
 )
 
 func TestTombstoneGC_invalid(t *testing.T) {
-	_, err := NewTombstoneGC(0, 0)
+	_, err := NewTombstoneGC(0, 0, clock.Real{})
 	if err == nil {
 		t.Fatalf("should fail")
 	}
 
-	_, err = NewTombstoneGC(time.Second, 0)
+	_, err = NewTombstoneGC(time.Second, 0, clock.Real{})
 	if err == nil {
 		t.Fatalf("should fail")
 	}
 
-	_, err = NewTombstoneGC(0, time.Second)
+	_, err = NewTombstoneGC(0, time.Second, clock.Real{})
 	if err == nil {
 		t.Fatalf("should fail")
 	}
 }
 
 func TestTombstoneGC(t *testing.T) {
-	ttl := 20 * time.Millisecond
-	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
+	ttl := 20 * time.Second
+	gran := 5 * time.Second
+	clk := clock.NewManual(time.Unix(1000, 0))
+	gc, err := NewTombstoneGC(ttl, gran, clk)
 	if err != nil {
 		t.Fatalf("should fail")
 	}
@@ -35,11 +38,11 @@ func TestTombstoneGC(t *testing.T) {
 		t.Fatalf("should not be pending")
 	}
 
-	start := time.Now()
+	// The clock starts on a granularity boundary, so this expires a full
+	// granularity past the TTL.
 	gc.Hint(100)
 
-	time.Sleep(2 * gran)
-	start2 := time.Now()
+	clk.Advance(2 * gran)
 	gc.Hint(120)
 	gc.Hint(125)
 
@@ -47,39 +50,44 @@ func TestTombstoneGC(t *testing.T) {
 		t.Fatalf("should be pending")
 	}
 
+	// Nothing should expire before the TTL.
+	clk.Advance(ttl - 2*gran)
+	select {
+	case <-gc.ExpireCh():
+		t.Fatalf("expired early")
+	default:
+	}
+
+	clk.Advance(gran)
 	select {
 	case index := <-gc.ExpireCh():
-		end := time.Now()
-		if end.Sub(start) < ttl {
-			t.Fatalf("expired early")
-		}
 		if index != 100 {
 			t.Fatalf("bad index: %d", index)
 		}
-
-	case <-time.After(ttl * 2):
+	default:
 		t.Fatalf("should get expiration")
 	}
 
+	clk.Advance(2 * gran)
 	select {
 	case index := <-gc.ExpireCh():
-		end := time.Now()
-		if end.Sub(start2) < ttl {
-			t.Fatalf("expired early")
-		}
 		if index != 125 {
 			t.Fatalf("bad index: %d", index)
 		}
-
-	case <-time.After(ttl * 2):
+	default:
 		t.Fatalf("should get expiration")
 	}
+
+	if gc.PendingExpiration() {
+		t.Fatalf("should not be pending")
+	}
 }
 
 func TestTombstoneGC_Expire(t *testing.T) {
-	ttl := 10 * time.Millisecond
-	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
+	ttl := 10 * time.Second
+	gran := 5 * time.Second
+	clk := clock.NewManual(time.Unix(1000, 0))
+	gc, err := NewTombstoneGC(ttl, gran, clk)
 	if err != nil {
 		t.Fatalf("should fail")
 	}
@@ -96,9 +104,77 @@ func TestTombstoneGC_Expire(t *testing.T) {
 		t.Fatalf("should not be pending")
 	}
 
+	clk.Advance(2 * ttl)
 	select {
 	case <-gc.ExpireCh():
 		t.Fatalf("should be reset")
-	case <-time.After(20 * time.Millisecond):
+	default:
+	}
+}
+
+func TestTombstoneGC_SetTTL(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1000, 0))
+	gc, err := NewTombstoneGC(20*time.Second, 5*time.Second, clk)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	gc.SetEnabled(true)
+
+	if err := gc.SetTTL(0, time.Second); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := gc.SetTTL(time.Second, 0); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	if err := gc.SetTTL(2*time.Second, time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ttl, gran := gc.TTL(); ttl != 2*time.Second || gran != time.Second {
+		t.Fatalf("bad: %v %v", ttl, gran)
+	}
+
+	// New hints use the shorter TTL.
+	gc.Hint(100)
+	clk.Advance(3 * time.Second)
+	select {
+	case index := <-gc.ExpireCh():
+		if index != 100 {
+			t.Fatalf("bad index: %d", index)
+		}
+	default:
+		t.Fatalf("should get expiration")
+	}
+}
+
+func TestTombstoneGC_ExpireNow(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1000, 0))
+	gc, err := NewTombstoneGC(20*time.Second, 5*time.Second, clk)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	gc.SetEnabled(true)
+
+	if index := gc.ExpireNow(); index != 0 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	gc.Hint(100)
+	clk.Advance(10 * time.Second)
+	gc.Hint(120)
+
+	if index := gc.ExpireNow(); index != 120 {
+		t.Fatalf("bad index: %d", index)
+	}
+	if gc.PendingExpiration() {
+		t.Fatalf("should not be pending")
+	}
+
+	// The stopped timers shouldn't fire.
+	clk.Advance(time.Minute)
+	select {
+	case <-gc.ExpireCh():
+		t.Fatalf("should not expire")
+	default:
 	}
 }
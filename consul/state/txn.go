@@ -0,0 +1,146 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// txnKVS applies a single KV operation inside a transaction, returning the
+// entry as it stands afterwards, or nil if it was deleted. Writes return the
+// entry without its value since the caller already has it.
+func (s *StateStore) txnKVS(tx *memdb.Txn, idx uint64, op *structs.TxnKVOp) (*structs.DirEntry, error) {
+	var entry *structs.DirEntry
+	var ok bool
+	var err error
+
+	// Put a chunked value back together.
+	if op.ChunkID != "" {
+		value, err := s.kvsUploadCompleteTxn(tx, idx, op.ChunkID, op.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		op.DirEnt.Value = value
+	}
+
+	key := op.DirEnt.Key
+	switch op.Verb {
+	case structs.KVSSet:
+		entry = &op.DirEnt
+		err = s.kvsSetTxn(tx, idx, entry, false)
+
+	case structs.KVSDelete:
+		err = s.kvsDeleteTxn(tx, idx, key)
+
+	case structs.KVSDeleteCAS:
+		ok, err = s.kvsDeleteCASTxn(tx, idx, op.DirEnt.ModifyIndex, key)
+		if !ok && err == nil {
+			err = fmt.Errorf("failed to delete key %q, index is stale", key)
+		}
+
+	case structs.KVSCAS:
+		entry = &op.DirEnt
+		ok, err = s.kvsSetCASTxn(tx, idx, entry)
+		if !ok && err == nil {
+			err = fmt.Errorf("failed to set key %q, index is stale", key)
+		}
+
+	case structs.KVSLock:
+		entry = &op.DirEnt
+		ok, err = s.kvsLockTxn(tx, idx, entry)
+		if !ok && err == nil {
+			err = fmt.Errorf("failed to lock key %q, lock is already held", key)
+		}
+
+	case structs.KVSUnlock:
+		entry = &op.DirEnt
+		ok, err = s.kvsUnlockTxn(tx, idx, entry)
+		if !ok && err == nil {
+			err = fmt.Errorf("failed to unlock key %q, lock isn't held by the session", key)
+		}
+
+	case structs.KVSDeleteTree:
+		if op.Recycled != nil {
+			err = s.kvsRecycleTreeTxn(tx, idx, op.Recycled)
+		} else {
+			_, err = s.kvsDeleteTreeTxn(tx, idx, key)
+		}
+
+	case structs.KVSDeleteTreeCAS:
+		if op.Recycled != nil {
+			ok, err = s.kvsRecycleTreeCASTxn(tx, idx, op.DirEnt.ModifyIndex, op.Recycled)
+		} else {
+			ok, err = s.kvsDeleteTreeCASTxn(tx, idx, op.DirEnt.ModifyIndex, key)
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("failed to delete tree %q, index is stale", key)
+		}
+
+	case structs.KVSCheckTree:
+		tindex, err := s.kvsTreeIndexTxn(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		if tindex != op.DirEnt.ModifyIndex {
+			return nil, fmt.Errorf("tree %q has been modified since index %d", key, op.DirEnt.ModifyIndex)
+		}
+		return nil, nil
+
+	case structs.KVSGet:
+		existing, err := tx.First("kvs", "id", key)
+		if err != nil {
+			return nil, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		if existing == nil {
+			return nil, fmt.Errorf("key %q doesn't exist", key)
+		}
+		e := existing.(*structs.DirEntry)
+		if op.DirEnt.ModifyIndex != 0 && op.DirEnt.ModifyIndex != e.ModifyIndex {
+			return nil, fmt.Errorf("key %q has been modified since index %d", key, op.DirEnt.ModifyIndex)
+		}
+		return e.Clone(), nil
+
+	default:
+		err = fmt.Errorf("unknown KV verb %q", op.Verb)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The entry is now owned by the state store, so hand back a copy.
+	if entry != nil {
+		entry = entry.Clone()
+		entry.Value = nil
+	}
+	return entry, nil
+}
+
+// TxnRW applies the given operations inside a single transaction. If any of
+// them fail, nothing is applied and errors are returned for the ones that
+// failed. Otherwise there is one result per operation.
+func (s *StateStore) TxnRW(idx uint64, ops structs.TxnOps) (structs.TxnResults, structs.TxnErrors) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	var results structs.TxnResults
+	var errs structs.TxnErrors
+	for i, op := range ops {
+		if op.KV == nil {
+			errs = append(errs, &structs.TxnError{OpIndex: i, What: "unknown operation"})
+			continue
+		}
+		entry, err := s.txnKVS(tx, idx, op.KV)
+		if err != nil {
+			errs = append(errs, &structs.TxnError{OpIndex: i, What: err.Error()})
+			continue
+		}
+		results = append(results, &structs.TxnResult{KV: entry})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	tx.Commit()
+	return results, nil
+}
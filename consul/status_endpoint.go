@@ -1,5 +1,23 @@
 package consul
 
+import (
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// readinessMaxIndexLag is the number of committed but not yet applied
+	// Raft entries a server may have before it is considered lagging.
+	readinessMaxIndexLag = 64
+
+	// readinessMaxLastContact is the longest a follower may go without
+	// hearing from the leader before it is considered lagging.
+	readinessMaxLastContact = 5 * time.Second
+)
+
 // Status endpoint is used to check on server status
 type Status struct {
 	server *Server
@@ -31,3 +49,57 @@ func (s *Status) Peers(args struct{}, reply *[]string) error {
 	*reply = peers
 	return nil
 }
+
+// ReadIndex is used by followers serving consistent reads. The index is
+// taken before leadership is verified, so once a follower has applied up
+// to it, it has seen every write committed before its read started.
+func (s *Status) ReadIndex(args struct{}, reply *uint64) error {
+	index := s.server.raft.LastIndex()
+	if err := s.server.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	*reply = index
+	return nil
+}
+
+// Readiness is used to report whether this server is caught up with the
+// leader and healthy enough to service requests.
+func (s *Status) Readiness(args struct{}, reply *structs.ServerReadiness) error {
+	srv := s.server
+
+	// Check on Raft. The commit index on a follower tracks what the leader
+	// has told it, so the gap to the applied index is how far behind we are.
+	reply.KnownLeader = srv.raft.Leader() != ""
+	if !srv.IsLeader() {
+		reply.LastContact = time.Now().Sub(srv.raft.LastContact())
+	}
+	stats := srv.raft.Stats()
+	reply.CommitIndex, _ = strconv.ParseUint(stats["commit_index"], 10, 64)
+	reply.AppliedIndex, _ = strconv.ParseUint(stats["applied_index"], 10, 64)
+
+	// Check on both of our gossip pools.
+	reply.SerfHealthy = srv.serfLAN.State() == serf.SerfAlive &&
+		srv.serfWAN.State() == serf.SerfAlive
+
+	// Resolving the anonymous token faults it into the cache if needed,
+	// so this also warms a cold cache on a fresh server.
+	_, err := srv.resolveToken("")
+	reply.ACLCacheWarm = err == nil
+
+	// Report the first thing that's wrong, if any.
+	switch {
+	case !reply.KnownLeader:
+		reply.Status = structs.ReadinessNoLeader
+	case reply.LastContact > readinessMaxLastContact,
+		reply.CommitIndex > reply.AppliedIndex+readinessMaxIndexLag:
+		reply.Status = structs.ReadinessRaftLagging
+	case !reply.SerfHealthy:
+		reply.Status = structs.ReadinessSerfUnhealthy
+	case !reply.ACLCacheWarm:
+		reply.Status = structs.ReadinessACLCold
+	default:
+		reply.Status = structs.ReadinessReady
+		reply.Ready = true
+	}
+	return nil
+}
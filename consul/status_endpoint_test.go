@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
 )
@@ -65,3 +66,58 @@ func TestStatusPeers(t *testing.T) {
 		t.Fatalf("no peers: %v", peers)
 	}
 }
+
+func TestStatusReadiness(t *testing.T) {
+	// A server that isn't bootstrapped never elects a leader.
+	dir1, s1 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec1 := rpcClient(t, s1)
+	defer codec1.Close()
+
+	arg := struct{}{}
+	var out structs.ServerReadiness
+	if err := msgpackrpc.CallWithCodec(codec1, "Status.Readiness", arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Ready || out.Status != structs.ReadinessNoLeader {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	dir2, s2 := testServer(t)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	codec := rpcClient(t, s2)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	if err := msgpackrpc.CallWithCodec(codec, "Status.Readiness", arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Ready || out.Status != structs.ReadinessReady {
+		t.Fatalf("bad: %#v", out)
+	}
+	if !out.KnownLeader || !out.SerfHealthy || !out.ACLCacheWarm {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStatusReadIndex(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := struct{}{}
+	var index uint64
+	if err := msgpackrpc.CallWithCodec(codec, "Status.ReadIndex", arg, &index); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index == 0 || index < s1.appliedIndex() {
+		t.Fatalf("bad: %d", index)
+	}
+}
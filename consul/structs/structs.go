@@ -3,7 +3,9 @@ package structs
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/consul/acl"
@@ -34,6 +36,21 @@ const (
 	ACLRequestType
 	TombstoneRequestType
 	CoordinateBatchUpdateType
+	KVSRecycleRequestType
+	ChangeCountersType
+	BatchRegisterRequestType
+	ChangeFeedType
+	ServiceReapRequestType
+	ServiceDrainRequestType
+	CheckHistoryType
+	MaintenanceWindowRequestType
+	ManagedCheckRequestType
+	TxnRequestType
+	KVSReapRequestType
+	KVSImportRequestType
+	KVSChunkRequestType
+	KVSHistoryType
+	KVSMoveRequestType
 )
 
 const (
@@ -81,6 +98,7 @@ type RPCInfo interface {
 	RequestDatacenter() string
 	IsRead() bool
 	AllowStaleRead() bool
+	RequireConsistentRead() bool
 	ACLToken() string
 }
 
@@ -104,6 +122,12 @@ type QueryOptions struct {
 	// If set, the leader must verify leadership prior to
 	// servicing the request. Prevents a stale read.
 	RequireConsistent bool
+
+	// If set, the server waits until it has applied at least this
+	// index before servicing the request. Clients take it from an
+	// earlier write so they read their own writes, even when the
+	// read is stale.
+	ConsistencyIndex uint64
 }
 
 // QueryOption only applies to reads, so always true
@@ -115,6 +139,10 @@ func (q QueryOptions) AllowStaleRead() bool {
 	return q.AllowStale
 }
 
+func (q QueryOptions) RequireConsistentRead() bool {
+	return q.RequireConsistent
+}
+
 func (q QueryOptions) ACLToken() string {
 	return q.Token
 }
@@ -134,6 +162,10 @@ func (w WriteRequest) AllowStaleRead() bool {
 	return false
 }
 
+func (w WriteRequest) RequireConsistentRead() bool {
+	return false
+}
+
 func (w WriteRequest) ACLToken() string {
 	return w.Token
 }
@@ -151,6 +183,10 @@ type QueryMeta struct {
 
 	// Used to indicate if there is a known leader node
 	KnownLeader bool
+
+	// Datacenter is the datacenter that served the read. This is mostly
+	// useful for debugging requests that left their datacenter empty.
+	Datacenter string
 }
 
 // RegisterRequest is used for the Catalog.Register endpoint
@@ -163,6 +199,31 @@ type RegisterRequest struct {
 	Service    *NodeService
 	Check      *HealthCheck
 	Checks     HealthChecks
+
+	// NodeMeta replaces the node's metadata. If it's nil the node keeps
+	// whatever metadata it has, so registering a service or check doesn't
+	// need to repeat it. Send an empty map to clear it.
+	NodeMeta map[string]string
+
+	// TaggedAddresses replaces the node's named addresses, such as "lan"
+	// and "wan". Like NodeMeta, leaving it nil keeps what the node has.
+	TaggedAddresses map[string]string
+
+	// ExpiresAfter is an optional duration, such as "90s", after which
+	// the service is removed unless it has been registered again. It's
+	// meant for services without an agent to sync them.
+	ExpiresAfter string
+
+	// ID is the node's stable ID. If another node name is registered with
+	// the same ID, the node is renamed, keeping its services and checks.
+	// Leaving it empty keeps whatever ID the node has.
+	ID string
+
+	// SkipNodeUpdate leaves an existing node as it is, so registering a
+	// service or check doesn't rewrite the node too. A node that isn't
+	// registered yet is still added.
+	SkipNodeUpdate bool
+
 	WriteRequest
 }
 
@@ -170,6 +231,41 @@ func (r *RegisterRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// BatchRegisterRequest is used for the Catalog.BatchRegister endpoint to
+// apply many registrations in a single Raft entry, such as when importing
+// a large number of external services.
+type BatchRegisterRequest struct {
+	Datacenter    string
+	Registrations []*RegisterRequest
+	WriteRequest
+}
+
+func (r *BatchRegisterRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// RegisterResponse is returned by Catalog.RegisterEcho. Index is the Raft
+// index of the write and the services and checks are those of the node as
+// they stand afterwards.
+type RegisterResponse struct {
+	Index        uint64
+	NodeServices *NodeServices
+	HealthChecks HealthChecks
+}
+
+// ChecksUpdateRequest is used for the Catalog.UpdateChecks endpoint to
+// write many of a node's checks at once, in a single Raft entry.
+type ChecksUpdateRequest struct {
+	Datacenter string
+	Node       string
+	Checks     HealthChecks
+	WriteRequest
+}
+
+func (r *ChecksUpdateRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // DeregisterRequest is used for the Catalog.Deregister endpoint
 // to deregister a node as providing a service. If no service is
 // provided the entire node is deregistered.
@@ -195,8 +291,11 @@ type QuerySource struct {
 
 // DCSpecificRequest is used to query about a specific DC
 type DCSpecificRequest struct {
-	Datacenter string
-	Source     QuerySource
+	Datacenter      string
+	NodeMetaFilters map[string]string
+	Filter          string // Filter expression evaluated on the servers
+	Summaries       bool   // Adds a summary of each service to service listings
+	Source          QuerySource
 	QueryOptions
 }
 
@@ -206,11 +305,16 @@ func (r *DCSpecificRequest) RequestDatacenter() string {
 
 // ServiceSpecificRequest is used to query about a specific service
 type ServiceSpecificRequest struct {
-	Datacenter  string
-	ServiceName string
-	ServiceTag  string
-	TagFilter   bool // Controls tag filtering
-	Source      QuerySource
+	Datacenter      string
+	NodeMetaFilters map[string]string
+	ServiceName     string
+	ServiceTag      string
+	TagFilter       bool   // Controls tag filtering
+	Filter          string // Filter expression evaluated on the servers
+	Shuffle         bool   // Randomizes the order before any distance sort
+	Deltas          bool   // Only returns the instances changed since MinQueryIndex
+	Coordinates     bool   // Includes each node's network coordinate
+	Source          QuerySource
 	QueryOptions
 }
 
@@ -218,6 +322,25 @@ func (r *ServiceSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// MultiDCServiceRequest is used to query a service in several datacenters
+// at once. Datacenter is where the query is fanned out from, and the rest
+// of the fields are applied in each of Datacenters. If Datacenters is empty,
+// every known datacenter is queried.
+type MultiDCServiceRequest struct {
+	Datacenter      string
+	Datacenters     []string
+	NodeMetaFilters map[string]string
+	ServiceName     string
+	ServiceTag      string
+	TagFilter       bool
+	Filter          string
+	QueryOptions
+}
+
+func (r *MultiDCServiceRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // NodeSpecificRequest is used to request the information about a single node
 type NodeSpecificRequest struct {
 	Datacenter string
@@ -229,11 +352,64 @@ func (r *NodeSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// NodeDeltaRequest is used by agents to fetch the changes to their node's
+// registrations made after Since, the index returned by their last sync.
+type NodeDeltaRequest struct {
+	Datacenter string
+	Node       string
+	Since      uint64
+	QueryOptions
+}
+
+func (r *NodeDeltaRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AddressSpecificRequest is used to look up what's registered at an
+// address.
+type AddressSpecificRequest struct {
+	Datacenter string
+	Address    string
+	QueryOptions
+}
+
+func (r *AddressSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// NodeLivenessRequest is used to query the gossip liveness of a set of
+// nodes. If Nodes is empty, every member of the LAN pool is returned.
+type NodeLivenessRequest struct {
+	Datacenter string
+	Nodes      []string
+	QueryOptions
+}
+
+func (r *NodeLivenessRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AllowStaleRead is always true since liveness comes from gossip and
+// not from Raft, so any server in the datacenter can answer.
+func (r *NodeLivenessRequest) AllowStaleRead() bool {
+	return true
+}
+
 // ChecksInStateRequest is used to query for nodes in a state
 type ChecksInStateRequest struct {
 	Datacenter string
 	State      string
 	Source     QuerySource
+
+	// States, if given, is used instead of State to return the checks in
+	// any of several states. ServiceName limits the results to the checks
+	// of one service, and TagFilter further to its instances with the
+	// ServiceTag.
+	States      []string
+	ServiceName string
+	ServiceTag  string
+	TagFilter   bool
+
 	QueryOptions
 }
 
@@ -241,19 +417,108 @@ func (r *ChecksInStateRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// ExternalCheckUpdateRequest is used by a checker to report the result of
+// an external check. It's ignored unless the check is still assigned to
+// Checker, so a checker that lost the check can't overwrite the new one.
+type ExternalCheckUpdateRequest struct {
+	Datacenter string
+	Node       string
+	CheckID    string
+	Checker    string
+	Status     string
+	Output     string
+	WriteRequest
+}
+
+func (r *ExternalCheckUpdateRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// CheckHistoryRequest is used to get the recent transitions of a single
+// health check.
+type CheckHistoryRequest struct {
+	Datacenter string
+	Node       string
+	CheckID    string
+	QueryOptions
+}
+
+func (r *CheckHistoryRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ServiceSummaryRequest is used to summarize the health of every service,
+// or of just the services whose names start with Prefix.
+type ServiceSummaryRequest struct {
+	Datacenter string
+	Prefix     string
+	QueryOptions
+}
+
+func (r *ServiceSummaryRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // Used to return information about a node
 type Node struct {
-	Node    string
-	Address string
+	ID              string
+	Node            string
+	Address         string
+	TaggedAddresses map[string]string
+	Meta            map[string]string
 
 	RaftIndex
 }
 type Nodes []*Node
 
+const (
+	// TaggedAddressLAN and TaggedAddressWAN name the addresses a node or
+	// service can be reached at from inside and outside its datacenter.
+	// Other names, such as "public" or "ipv6", can be used as needed.
+	TaggedAddressLAN = "lan"
+	TaggedAddressWAN = "wan"
+)
+
+const (
+	// MetaMaxKeyPairs is the most metadata pairs a node or service can have.
+	MetaMaxKeyPairs = 64
+
+	// MetaKeyMaxLength is the longest a metadata key can be.
+	MetaKeyMaxLength = 128
+
+	// MetaValueMaxLength is the longest a metadata value can be.
+	MetaValueMaxLength = 512
+)
+
+// SatisfiesMetaFilters returns true if the metadata has every one of the
+// key/value pairs in filters.
+func SatisfiesMetaFilters(meta map[string]string, filters map[string]string) bool {
+	for key, value := range filters {
+		if v, ok := meta[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
 // Used to return information about a provided services.
 // Maps service name to available tags
 type Services map[string][]string
 
+// ServiceSummary describes the instances of a service and their health.
+// A service's summary is only returned from the services listing when it's
+// asked for.
+type ServiceSummary struct {
+	Tags      []string
+	Instances int
+	Passing   int
+	Warning   int
+	Critical  int
+}
+
+// ServiceSummaries maps service names to their summaries.
+type ServiceSummaries map[string]*ServiceSummary
+
 // ServiceNode represents a node that is part of a service
 type ServiceNode struct {
 	Node                     string
@@ -264,6 +529,20 @@ type ServiceNode struct {
 	ServiceAddress           string
 	ServicePort              int
 	ServiceEnableTagOverride bool
+	ServiceCacheMaxAge       int
+	ServiceDNSTTL            int
+	ServiceWeights           *Weights
+	ServiceMeta              map[string]string
+	ServiceTaggedAddresses   map[string]string
+	ServiceSource            string
+	ServiceRegisteredAt      time.Time
+	ServiceExpiresAt         time.Time
+	ServiceDraining          bool
+
+	// TaggedAddresses and NodeMeta are filled in from the node on the
+	// way out of the state store, like Address.
+	TaggedAddresses map[string]string
+	NodeMeta        map[string]string
 
 	RaftIndex
 }
@@ -282,6 +561,17 @@ func (s *ServiceNode) Clone() *ServiceNode {
 		ServiceAddress:           s.ServiceAddress,
 		ServicePort:              s.ServicePort,
 		ServiceEnableTagOverride: s.ServiceEnableTagOverride,
+		ServiceCacheMaxAge:       s.ServiceCacheMaxAge,
+		ServiceDNSTTL:            s.ServiceDNSTTL,
+		ServiceWeights:           s.ServiceWeights.Clone(),
+		ServiceMeta:              cloneStringMap(s.ServiceMeta),
+		ServiceTaggedAddresses:   cloneStringMap(s.ServiceTaggedAddresses),
+		ServiceSource:            s.ServiceSource,
+		ServiceRegisteredAt:      s.ServiceRegisteredAt,
+		ServiceExpiresAt:         s.ServiceExpiresAt,
+		ServiceDraining:          s.ServiceDraining,
+		TaggedAddresses:          cloneStringMap(s.TaggedAddresses),
+		NodeMeta:                 cloneStringMap(s.NodeMeta),
 		RaftIndex: RaftIndex{
 			CreateIndex: s.CreateIndex,
 			ModifyIndex: s.ModifyIndex,
@@ -289,6 +579,18 @@ func (s *ServiceNode) Clone() *ServiceNode {
 	}
 }
 
+// cloneStringMap returns a copy of the map, keeping nil maps nil.
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
 // ToNodeService converts the given service node to a node service.
 func (s *ServiceNode) ToNodeService() *NodeService {
 	return &NodeService{
@@ -298,6 +600,15 @@ func (s *ServiceNode) ToNodeService() *NodeService {
 		Address:           s.ServiceAddress,
 		Port:              s.ServicePort,
 		EnableTagOverride: s.ServiceEnableTagOverride,
+		CacheMaxAge:       s.ServiceCacheMaxAge,
+		DNSTTL:            s.ServiceDNSTTL,
+		Weights:           s.ServiceWeights,
+		Meta:              s.ServiceMeta,
+		TaggedAddresses:   s.ServiceTaggedAddresses,
+		Source:            s.ServiceSource,
+		RegisteredAt:      s.ServiceRegisteredAt,
+		ExpiresAt:         s.ServiceExpiresAt,
+		Draining:          s.ServiceDraining,
 		RaftIndex: RaftIndex{
 			CreateIndex: s.CreateIndex,
 			ModifyIndex: s.ModifyIndex,
@@ -307,6 +618,27 @@ func (s *ServiceNode) ToNodeService() *NodeService {
 
 type ServiceNodes []*ServiceNode
 
+// Weights are the weights of a service instance in DNS SRV answers. Passing
+// is used when all of the instance's checks are passing, and Warning when
+// any of them is warning, so degraded instances get less traffic instead of
+// none.
+type Weights struct {
+	Passing int
+	Warning int
+}
+
+// DefaultWeights are used for instances registered without weights.
+var DefaultWeights = Weights{Passing: 1, Warning: 1}
+
+// Clone returns a copy of the weights, keeping nil weights nil.
+func (w *Weights) Clone() *Weights {
+	if w == nil {
+		return nil
+	}
+	clone := *w
+	return &clone
+}
+
 // NodeService is a service provided by a node
 type NodeService struct {
 	ID                string
@@ -316,9 +648,57 @@ type NodeService struct {
 	Port              int
 	EnableTagOverride bool
 
+	// CacheMaxAge is a hint, in seconds, for how long clients may cache
+	// query results for this service. Zero means no hint is given.
+	CacheMaxAge int
+
+	// DNSTTL is the TTL, in seconds, for DNS answers about this service.
+	// Zero means the agent's configured service TTL is used.
+	DNSTTL int
+
+	// Weights are the relative weights given to this instance in DNS SRV
+	// answers, depending on its health. Nil means the default weights.
+	Weights *Weights
+
+	// Meta holds arbitrary key/value pairs describing the service, such
+	// as its version. It has the same limits as node metadata.
+	Meta map[string]string
+
+	// TaggedAddresses holds other named addresses for the service, such
+	// as "wan", alongside Address.
+	TaggedAddresses map[string]string
+
+	// Source records what registered the service, one of the
+	// ServiceSource constants. RegisteredAt is when the catalog first saw
+	// this instance. ExpiresAt is when the leader will remove it, if it
+	// was registered with an ExpiresAfter. These are kept by the servers,
+	// so they are ignored by IsSame.
+	Source       string
+	RegisteredAt time.Time
+	ExpiresAt    time.Time
+
+	// Draining marks an instance that is being taken out of service. It
+	// stays in the catalog, but health queries and DNS leave it out so
+	// load balancers can bleed off its connections before it goes away.
+	Draining bool
+
 	RaftIndex
 }
 
+const (
+	// ServiceSourceAgent marks services synced by a node's own agent.
+	ServiceSourceAgent = "agent"
+
+	// ServiceSourceCatalog marks services written directly through the
+	// catalog API. It's the default when no source is given.
+	ServiceSourceCatalog = "catalog"
+
+	// ServiceSourceExternal marks services registered on behalf of
+	// another node by an external tool, such as a registrator for
+	// agent-less hosts.
+	ServiceSourceExternal = "external"
+)
+
 // IsSame checks if one NodeService is the same as another, without looking
 // at the Raft information (that's why we didn't call it IsEqual). This is
 // useful for seeing if an update would be idempotent for all the functional
@@ -329,7 +709,13 @@ func (s *NodeService) IsSame(other *NodeService) bool {
 		!reflect.DeepEqual(s.Tags, other.Tags) ||
 		s.Address != other.Address ||
 		s.Port != other.Port ||
-		s.EnableTagOverride != other.EnableTagOverride {
+		s.EnableTagOverride != other.EnableTagOverride ||
+		s.CacheMaxAge != other.CacheMaxAge ||
+		s.DNSTTL != other.DNSTTL ||
+		!reflect.DeepEqual(s.Weights, other.Weights) ||
+		!reflect.DeepEqual(s.Meta, other.Meta) ||
+		!reflect.DeepEqual(s.TaggedAddresses, other.TaggedAddresses) ||
+		s.Draining != other.Draining {
 		return false
 	}
 
@@ -347,6 +733,15 @@ func (s *NodeService) ToServiceNode(node, address string) *ServiceNode {
 		ServiceAddress:           s.Address,
 		ServicePort:              s.Port,
 		ServiceEnableTagOverride: s.EnableTagOverride,
+		ServiceCacheMaxAge:       s.CacheMaxAge,
+		ServiceDNSTTL:            s.DNSTTL,
+		ServiceWeights:           s.Weights,
+		ServiceMeta:              s.Meta,
+		ServiceTaggedAddresses:   s.TaggedAddresses,
+		ServiceSource:            s.Source,
+		ServiceRegisteredAt:      s.RegisteredAt,
+		ServiceExpiresAt:         s.ExpiresAt,
+		ServiceDraining:          s.Draining,
 		RaftIndex: RaftIndex{
 			CreateIndex: s.CreateIndex,
 			ModifyIndex: s.ModifyIndex,
@@ -370,9 +765,46 @@ type HealthCheck struct {
 	ServiceID   string // optional associated service
 	ServiceName string // optional service name
 
+	// Informational checks are reported in the catalog but never
+	// affect the aggregated health of the node or service.
+	Informational bool
+
+	// Suppressed is set by the servers when the check changed to a
+	// non-passing status while a maintenance window covering it was in
+	// effect. It's cleared when the check passes again or the window
+	// ends, and is ignored on registration.
+	Suppressed bool
+
+	// External is set for checks of external services, which are run by
+	// a pool of checker agents instead of an agent on the node.
+	External *ExternalCheck `json:",omitempty"`
+
 	RaftIndex
 }
 
+// ExternalCheck defines a check that's run by one of the agents in the
+// external checker pool. The leader assigns each check to a checker,
+// spreading them across the pool and moving them off checkers that fail.
+type ExternalCheck struct {
+	HTTP     string
+	TCP      string
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Checker is the node the check is assigned to. It's set by the
+	// leader, and is empty while there are no checkers.
+	Checker string
+}
+
+// IsSame checks if the definitions are the same, treating nil as no
+// definition.
+func (e *ExternalCheck) IsSame(other *ExternalCheck) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	return *e == *other
+}
+
 // IsSame checks if one HealthCheck is the same as another, without looking
 // at the Raft information (that's why we didn't call it IsEqual). This is
 // useful for seeing if an update would be idempotent for all the functional
@@ -385,7 +817,9 @@ func (c *HealthCheck) IsSame(other *HealthCheck) bool {
 		c.Notes != other.Notes ||
 		c.Output != other.Output ||
 		c.ServiceID != other.ServiceID ||
-		c.ServiceName != other.ServiceName {
+		c.ServiceName != other.ServiceName ||
+		c.Informational != other.Informational ||
+		!c.External.IsSame(other.External) {
 		return false
 	}
 
@@ -400,9 +834,21 @@ type CheckServiceNode struct {
 	Node    *Node
 	Service *NodeService
 	Checks  HealthChecks
+
+	// Coord is the node's network coordinate. It's only filled in when
+	// the request asks for coordinates.
+	Coord *coordinate.Coordinate `json:",omitempty"`
 }
 type CheckServiceNodes []CheckServiceNode
 
+// Shuffle does an in-place random shuffle using the Fisher-Yates algorithm.
+func (nodes CheckServiceNodes) Shuffle() {
+	for i := len(nodes) - 1; i > 0; i-- {
+		j := rand.Int31() % int32(i+1)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+}
+
 // NodeInfo is used to dump all associated information about
 // a node. This is currently used for the UI only, as it is
 // rather expensive to generate.
@@ -424,7 +870,8 @@ type IndexedNodes struct {
 }
 
 type IndexedServices struct {
-	Services Services
+	Services  Services
+	Summaries ServiceSummaries
 	QueryMeta
 }
 
@@ -433,18 +880,102 @@ type IndexedServiceNodes struct {
 	QueryMeta
 }
 
+// DatacenterServiceNode is a service node along with the datacenter it was
+// found in.
+type DatacenterServiceNode struct {
+	Datacenter string
+	ServiceNode
+}
+
+// DatacenterQueryResult describes how a multi-datacenter query went in one
+// datacenter. Error is set if the datacenter couldn't be queried.
+type DatacenterQueryResult struct {
+	Datacenter  string
+	Index       uint64
+	KnownLeader bool
+	Error       string
+}
+
+// IndexedMultiDCServiceNodes holds the merged results of a service query
+// run in several datacenters, in the order the datacenters were queried.
+type IndexedMultiDCServiceNodes struct {
+	ServiceNodes []*DatacenterServiceNode
+	Datacenters  []*DatacenterQueryResult
+	QueryMeta
+}
+
 type IndexedNodeServices struct {
 	NodeServices *NodeServices
 	QueryMeta
 }
 
+// NodeDelta holds the services and checks on a node that changed since a
+// given index, with their current definitions, and the IDs of the ones
+// that were removed. Node is the node's current registration, or nil if
+// it isn't registered. If Reset is set, the changes couldn't be worked
+// out and Services and Checks hold everything registered on the node.
+type NodeDelta struct {
+	Node            *Node
+	Services        []*NodeService
+	DeletedServices []string
+	Checks          HealthChecks
+	DeletedChecks   []string
+	Reset           bool
+}
+
+type IndexedNodeDelta struct {
+	NodeDelta *NodeDelta
+	QueryMeta
+}
+
+// IndexedAddressNodes holds the nodes registered with an address, and the
+// service instances that advertise it as their service address.
+type IndexedAddressNodes struct {
+	Nodes    Nodes
+	Services ServiceNodes
+	QueryMeta
+}
+
 type IndexedHealthChecks struct {
 	HealthChecks HealthChecks
 	QueryMeta
 }
 
+// CheckTransition records a health check changing status, along with the
+// output it had at the time. Index is the Raft index of the change.
+type CheckTransition struct {
+	Node        string
+	CheckID     string
+	ServiceID   string
+	ServiceName string
+	Status      string
+	Output      string
+	Index       uint64
+}
+type CheckTransitions []*CheckTransition
+
+// IndexedServiceSummaries is used to return the health summary of each
+// service.
+type IndexedServiceSummaries struct {
+	Summaries ServiceSummaries
+	QueryMeta
+}
+
+// IndexedCheckHistory is used to return a check's transitions, oldest
+// first.
+type IndexedCheckHistory struct {
+	History CheckTransitions
+	QueryMeta
+}
+
+// IndexedCheckServiceNodes is used to return the instances of a service
+// with their health. For a query that asked for deltas, Deltas holds the
+// changed instances instead of Nodes, and Reset is set as it would be for
+// IndexedServiceEvents.
 type IndexedCheckServiceNodes struct {
-	Nodes CheckServiceNodes
+	Nodes  CheckServiceNodes
+	Deltas ServiceEvents
+	Reset  bool
 	QueryMeta
 }
 
@@ -453,6 +984,35 @@ type IndexedNodeDump struct {
 	QueryMeta
 }
 
+// CatalogDump holds every node, service instance, and health check in a
+// datacenter, as of a single index.
+type CatalogDump struct {
+	Nodes    Nodes
+	Services ServiceNodes
+	Checks   HealthChecks
+}
+
+type IndexedCatalogDump struct {
+	Dump *CatalogDump
+	QueryMeta
+}
+
+// NodeLiveness is the gossip view of a single node, with no catalog
+// data. Status is the Serf member status. LastSeen is when the node was
+// last known to be alive, and is zero if this server never saw it alive.
+type NodeLiveness struct {
+	Node     string
+	Address  string
+	Status   string
+	LastSeen time.Time
+}
+type NodeLivenesses []*NodeLiveness
+
+type IndexedNodeLiveness struct {
+	Nodes NodeLivenesses
+	QueryMeta
+}
+
 // DirEntry is used to represent a directory entry. This is
 // used for values in our Key-Value store.
 type DirEntry struct {
@@ -462,6 +1022,10 @@ type DirEntry struct {
 	Value     []byte
 	Session   string `json:",omitempty"`
 
+	// ExpiresAt is when the leader will delete the entry, if it was
+	// written with a TTL.
+	ExpiresAt time.Time
+
 	RaftIndex
 }
 
@@ -473,6 +1037,7 @@ func (d *DirEntry) Clone() *DirEntry {
 		Flags:     d.Flags,
 		Value:     d.Value,
 		Session:   d.Session,
+		ExpiresAt: d.ExpiresAt,
 		RaftIndex: RaftIndex{
 			CreateIndex: d.CreateIndex,
 			ModifyIndex: d.ModifyIndex,
@@ -485,13 +1050,19 @@ type DirEntries []*DirEntry
 type KVSOp string
 
 const (
-	KVSSet        KVSOp = "set"
-	KVSDelete           = "delete"
-	KVSDeleteCAS        = "delete-cas" // Delete with check-and-set
-	KVSDeleteTree       = "delete-tree"
-	KVSCAS              = "cas"    // Check-and-set
-	KVSLock             = "lock"   // Lock a key
-	KVSUnlock           = "unlock" // Unlock a key
+	KVSSet           KVSOp = "set"
+	KVSDelete              = "delete"
+	KVSDeleteCAS           = "delete-cas" // Delete with check-and-set
+	KVSDeleteTree          = "delete-tree"
+	KVSDeleteTreeCAS       = "delete-tree-cas" // Delete a tree with check-and-set on its index
+	KVSCAS                 = "cas"             // Check-and-set
+	KVSLock                = "lock"            // Lock a key
+	KVSUnlock              = "unlock"          // Unlock a key
+	KVSRollback            = "rollback"        // Restore an earlier version of a key
+	KVSAppend              = "append"          // Append to a key's value
+	KVSPatch               = "patch"           // JSON merge patch a key's value
+	KVSGet                 = "get"             // Read a key, only valid in a transaction
+	KVSCheckTree           = "check-tree"      // Check a tree's index, only valid in a transaction
 )
 
 // KVSRequest is used to operate on the Key-Value store
@@ -499,6 +1070,19 @@ type KVSRequest struct {
 	Datacenter string
 	Op         KVSOp    // Which operation are we performing
 	DirEnt     DirEntry // Which directory entry
+
+	// TTL is an optional duration, such as "30s", after which the key
+	// is deleted unless it has been written again. Writes without one
+	// clear any earlier expiration.
+	TTL string
+
+	// ChunkID is set by the leader when a value was too large for a
+	// single Raft entry. The value was written as Chunks chunks of the
+	// upload with this ID, and is put back together when the request is
+	// applied.
+	ChunkID string
+	Chunks  int
+
 	WriteRequest
 }
 
@@ -506,10 +1090,137 @@ func (r *KVSRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
-// KeyRequest is used to request a key, or key prefix
+// KVSApplyResponse is returned by KVS.ApplyEcho and KVS.ApplyIndex. Index is
+// the Raft index of the write and DirEnt is the entry as it stands
+// afterwards, which is nil if the key was deleted. Fence is set when a lock
+// was acquired. ApplyIndex fills in everything but DirEnt.
+type KVSApplyResponse struct {
+	Result bool
+	Index  uint64
+	DirEnt *DirEntry
+	Fence  *FenceToken
+}
+
+// FenceToken identifies one holding of a lock. LockIndex counts the times
+// the key has been locked since it was created, so it starts over if the key
+// is deleted and written again, but CreateIndex is the key's CreateIndex and
+// tells the two apart. SessionIndex is the CreateIndex of the holding session,
+// so a token can't be mistaken for a later holding of the same lock. It's
+// handed to external systems so they can reject writes from stale holders.
+type FenceToken struct {
+	Key          string
+	CreateIndex  uint64
+	LockIndex    uint64
+	Session      string
+	SessionIndex uint64
+}
+
+// IsSame checks if two fence tokens refer to the same holding of a lock
+func (f *FenceToken) IsSame(other *FenceToken) bool {
+	return f.Key == other.Key &&
+		f.CreateIndex == other.CreateIndex &&
+		f.LockIndex == other.LockIndex &&
+		f.Session == other.Session &&
+		f.SessionIndex == other.SessionIndex
+}
+
+// KVSFenceRequest is used to check a fence token against the current
+// holder of its lock
+type KVSFenceRequest struct {
+	Datacenter string
+	Fence      FenceToken
+	QueryOptions
+}
+
+func (r *KVSFenceRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KVSFenceResponse reports whether a fence token is still valid. Current
+// is the token of the lock's current holder, or nil if it's not held.
+type KVSFenceResponse struct {
+	Valid   bool
+	Current *FenceToken
+	QueryMeta
+}
+
+// TxnKVOp is a single KV operation inside a transaction. The verbs are
+// the same as for KVSRequest, plus get and check-tree. A get returns the
+// key and fails the transaction if the key doesn't exist or, when
+// DirEnt.ModifyIndex is set, if the key has been modified since then. A
+// check-tree fails the transaction if the index of the tree under the key
+// isn't DirEnt.ModifyIndex.
+type TxnKVOp struct {
+	Verb   KVSOp
+	DirEnt DirEntry
+
+	// ChunkID and Chunks are set by the leader when the value was written
+	// ahead of the transaction as a chunked upload, as for KVSRequest.
+	ChunkID string
+	Chunks  int
+
+	// Recycled is set by the leader for tree deletes when the recycle bin
+	// is enabled, and is the tree the deleted entries are held in.
+	Recycled *KVSRecycled
+}
+
+// TxnOp is a single operation inside a transaction. Only KV operations
+// are supported for now.
+type TxnOp struct {
+	KV *TxnKVOp
+}
+
+type TxnOps []*TxnOp
+
+// TxnRequest is used to apply a list of operations atomically. Either all
+// of them are applied, or none are.
+type TxnRequest struct {
+	Datacenter string
+	Ops        TxnOps
+	WriteRequest
+}
+
+func (r *TxnRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// TxnError says why the operation at OpIndex caused a transaction to
+// be rolled back.
+type TxnError struct {
+	OpIndex int
+	What    string
+}
+
+func (e TxnError) Error() string {
+	return fmt.Sprintf("op %d: %s", e.OpIndex, e.What)
+}
+
+type TxnErrors []*TxnError
+
+// TxnResult is the result of a single operation inside a transaction. KV
+// holds the entry as it stands after the operation, which is nil for
+// deletes.
+type TxnResult struct {
+	KV *DirEntry
+}
+
+type TxnResults []*TxnResult
+
+// TxnResponse is the result of a transaction. Results has one entry per
+// operation if it was applied. Otherwise Errors says why it wasn't.
+type TxnResponse struct {
+	Results TxnResults
+	Errors  TxnErrors
+	Index   uint64
+}
+
+// KeyRequest is used to request a key, or key prefix. When listing a
+// prefix, a blocking query given the Hash of the last results keeps
+// waiting until the entries differ from them, not just their indexes.
 type KeyRequest struct {
 	Datacenter string
 	Key        string
+	Hash       string
 	QueryOptions
 }
 
@@ -517,11 +1228,33 @@ func (r *KeyRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
-// KeyListRequest is used to list keys
+// KeyVersionRequest is used to request the version of a key that was
+// written at the given index.
+type KeyVersionRequest struct {
+	Datacenter string
+	Key        string
+	Version    uint64
+	QueryOptions
+}
+
+func (r *KeyVersionRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KeyListRequest is used to list keys. A blocking query given the Hash of
+// the last results keeps waiting until the keys differ from them.
+//
+// With a Seperator, Depth is how many separators after the prefix a key
+// is cut off at, and zero is the same as one. A non-zero Limit caps the
+// number of keys returned, and the next page starts after the Cursor.
 type KeyListRequest struct {
 	Datacenter string
 	Prefix     string
 	Seperator  string
+	Depth      int
+	Limit      int
+	Cursor     string
+	Hash       string
 	QueryOptions
 }
 
@@ -529,36 +1262,217 @@ func (r *KeyListRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// IndexedDirEntries is the result of a KV query. Hash is set for prefix
+// lists, and only changes when the entries' contents do.
 type IndexedDirEntries struct {
 	Entries DirEntries
+	Hash    string
 	QueryMeta
 }
 
+// IndexedKeyList is the result of a key list query. Hash only changes when
+// the keys do. NextCursor is set when the keys were cut off by the limit,
+// and is the cursor for the next page.
 type IndexedKeyList struct {
-	Keys []string
+	Keys       []string
+	NextCursor string
+	Hash       string
 	QueryMeta
 }
 
-type SessionBehavior string
+// KVSUpload holds the chunks of a large KV value while they are being
+// written, until the write that uses them is applied. Uploads that are
+// never used are reaped once they expire.
+type KVSUpload struct {
+	ID      string
+	Chunks  [][]byte
+	Expires time.Time
 
-const (
-	SessionKeysRelease SessionBehavior = "release"
-	SessionKeysDelete                  = "delete"
-)
+	RaftIndex
+}
 
-const (
-	SessionTTLMax        = 3600 * time.Second
-	SessionTTLMultiplier = 2
-)
+type KVSUploads []*KVSUpload
 
-// Session is used to represent an open session in the KV store.
-// This issued to associate node checks with acquired locks.
-type Session struct {
-	ID        string
-	Name      string
-	Node      string
-	Checks    []string
-	LockDelay time.Duration
+// KVSChunkRequest is used by the leader to add the next chunk to an
+// upload, creating it for the first chunk.
+type KVSChunkRequest struct {
+	Datacenter string
+	ID         string
+	Seq        int
+	Data       []byte
+	Expires    time.Time
+	WriteRequest
+}
+
+func (r *KVSChunkRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KVSExport is a consistent copy of every entry under Prefix as of Index.
+// It can be imported under the same or another prefix, in this cluster or
+// another one.
+type KVSExport struct {
+	Prefix  string
+	Index   uint64
+	Entries DirEntries
+}
+
+// IndexedKVSExport is the result of a KV export.
+type IndexedKVSExport struct {
+	Export KVSExport
+	QueryMeta
+}
+
+// KVSImportRequest is used to replace the tree under Prefix with the
+// entries of an export. Leaving Prefix empty imports under the export's
+// own prefix.
+type KVSImportRequest struct {
+	Datacenter string
+	Prefix     string
+	Export     KVSExport
+
+	// Uploads is set by the leader for entries whose values were written
+	// ahead of the import as chunked uploads, as for KVSRequest. It's
+	// keyed by the entry's key.
+	Uploads map[string]KVSUploadRef
+
+	// Recycled is set by the leader when the recycle bin is enabled, and
+	// is the tree the replaced entries are held in.
+	Recycled *KVSRecycled
+
+	WriteRequest
+}
+
+// KVSUploadRef refers to a finished chunked upload holding a value.
+type KVSUploadRef struct {
+	ID     string
+	Chunks int
+}
+
+func (r *KVSImportRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KVSMoveRequest is used to atomically move Source to Destination. If
+// Prefix is set, every key under Source is moved under Destination instead
+// of a single key. NoOverwrite makes the move fail if any destination key
+// already exists.
+type KVSMoveRequest struct {
+	Datacenter  string
+	Source      string
+	Destination string
+	Prefix      bool
+	NoOverwrite bool
+	WriteRequest
+}
+
+func (r *KVSMoveRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KVSRecycled is a KV tree that was deleted while the recycle bin was
+// enabled. It is kept until Expires so it can be restored.
+type KVSRecycled struct {
+	ID      string
+	Prefix  string
+	Entries DirEntries
+	Expires time.Time
+
+	RaftIndex
+}
+
+type KVSRecycledTrees []*KVSRecycled
+
+type KVSRecycleOp string
+
+const (
+	KVSRecycleTree    KVSRecycleOp = "recycle"
+	KVSRecycleTreeCAS              = "recycle-cas"
+	KVSRecycleRestore              = "restore"
+	KVSRecycleReap                 = "reap"
+)
+
+// KVSRecycleRequest is used to operate on the KV recycle bin. Recycle
+// deletes a tree into the bin, and RecycleCAS does so only if the tree's
+// index matches CheckIndex. Restore puts the tree with the given ID back,
+// and Reap drops every tree that expired before ReapTime.
+type KVSRecycleRequest struct {
+	Datacenter string
+	Op         KVSRecycleOp
+	Recycled   *KVSRecycled
+	CheckIndex uint64
+	ID         string
+	ReapTime   time.Time
+	WriteRequest
+}
+
+func (r *KVSRecycleRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ServiceReapRequest is used by the leader to remove every service whose
+// registration expired before ReapTime.
+type ServiceReapRequest struct {
+	Datacenter string
+	ReapTime   time.Time
+	WriteRequest
+}
+
+func (r *ServiceReapRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KVSReapRequest is used by the leader to delete every key that expired
+// before ReapTime, along with any abandoned uploads.
+type KVSReapRequest struct {
+	Datacenter string
+	ReapTime   time.Time
+	WriteRequest
+}
+
+func (r *KVSReapRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ServiceDrainRequest is used to mark a service instance as draining, or
+// to put it back into service.
+type ServiceDrainRequest struct {
+	Datacenter string
+	Node       string
+	ServiceID  string
+	Draining   bool
+	WriteRequest
+}
+
+func (r *ServiceDrainRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedKVSRecycledTrees struct {
+	Trees KVSRecycledTrees
+	QueryMeta
+}
+
+type SessionBehavior string
+
+const (
+	SessionKeysRelease SessionBehavior = "release"
+	SessionKeysDelete                  = "delete"
+)
+
+const (
+	SessionTTLMax        = 3600 * time.Second
+	SessionTTLMultiplier = 2
+)
+
+// Session is used to represent an open session in the KV store.
+// This issued to associate node checks with acquired locks.
+type Session struct {
+	ID        string
+	Name      string
+	Node      string
+	Checks    []string
+	LockDelay time.Duration
 	Behavior  SessionBehavior // What to do when session is invalidated
 	TTL       string
 
@@ -698,6 +1612,40 @@ type DatacenterMap struct {
 	Coordinates Coordinates
 }
 
+// DatacenterInfo describes a datacenter as it's seen from the WAN gossip
+// pool, for monitoring a set of federated datacenters.
+type DatacenterInfo struct {
+	Datacenter string
+
+	// Servers is the number of servers known in the datacenter.
+	Servers int
+
+	// ProtocolMin and ProtocolMax are the lowest and highest protocol
+	// versions spoken by those servers.
+	ProtocolMin int
+	ProtocolMax int
+
+	// Coordinates are the WAN network coordinates of the servers, where
+	// they are known.
+	Coordinates Coordinates
+
+	// RTT is the estimated median round trip time from the local
+	// datacenter to the servers. It's zero for the local datacenter, and
+	// when there aren't any coordinates to estimate from.
+	RTT time.Duration
+}
+
+// CoordinateUpdateSettings holds the settings a server is batching
+// coordinate updates with. If Adaptive is set these have been scaled from
+// the configured values for a cluster of ClusterSize nodes.
+type CoordinateUpdateSettings struct {
+	Adaptive    bool
+	ClusterSize int
+	Period      time.Duration
+	BatchSize   int
+	MaxBatches  int
+}
+
 // CoordinateUpdateRequest is used to update the network coordinate of a given
 // node.
 type CoordinateUpdateRequest struct {
@@ -735,6 +1683,293 @@ type EventFireResponse struct {
 	QueryMeta
 }
 
+// UserEventVersion is the version of the UserEvent format
+const UserEventVersion = 1
+
+// UserEvent is the payload of a user event as it's gossiped through Serf.
+// Agents fire and decode these, and the leader fires them for KV writes.
+type UserEvent struct {
+	// ID of the user event. Automatically generated.
+	ID string
+
+	// Name of the event
+	Name string `codec:"n"`
+
+	// Optional payload
+	Payload []byte `codec:"p,omitempty"`
+
+	// NodeFilter is a regular expression to filter on nodes
+	NodeFilter string `codec:"nf,omitempty"`
+
+	// ServiceFilter is a regular expression to filter on services
+	ServiceFilter string `codec:"sf,omitempty"`
+
+	// TagFilter is a regular expression to filter on tags of a service,
+	// must be provided with ServiceFilter
+	TagFilter string `codec:"tf,omitempty"`
+
+	// Version of the user event. Automatically generated.
+	Version int `codec:"v"`
+
+	// LTime is the lamport time. Automatically generated.
+	LTime uint64 `codec:"-"`
+}
+
+// userEventHandle is the handle agents have always encoded user events
+// with, which differs from msgpackHandle.
+var userEventHandle = &codec.MsgpackHandle{
+	RawToString: true,
+	WriteExt:    true,
+}
+
+// EncodeUserEvent encodes a user event for gossip
+func EncodeUserEvent(event *UserEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, userEventHandle).Encode(event)
+	return buf.Bytes(), err
+}
+
+// DecodeUserEvent decodes a gossiped user event
+func DecodeUserEvent(buf []byte, event *UserEvent) error {
+	return codec.NewDecoder(bytes.NewReader(buf), userEventHandle).Decode(event)
+}
+
+const (
+	ChangeCounterServices = "services"
+	ChangeCounterKVS      = "kvs"
+	ChangeCounterSessions = "sessions"
+	ChangeCounterACLs     = "acls"
+)
+
+// ChangeCounter holds the cumulative number of creates, updates, and
+// deletes applied to one type of object. These are kept in the FSM so
+// they survive restarts and snapshots.
+type ChangeCounter struct {
+	Type    string
+	Creates uint64
+	Updates uint64
+	Deletes uint64
+	RaftIndex
+}
+type ChangeCounters []*ChangeCounter
+
+// IndexedChangeCounters is used to return the change counters for all
+// the object types that have seen changes.
+type IndexedChangeCounters struct {
+	Counters ChangeCounters
+	QueryMeta
+}
+
+const (
+	ChangeFeedNodes    = "nodes"
+	ChangeFeedServices = "services"
+	ChangeFeedChecks   = "checks"
+	ChangeFeedKVS      = "kvs"
+)
+
+const (
+	ChangeFeedSet        = "set"
+	ChangeFeedDelete     = "delete"
+	ChangeFeedDeleteTree = "delete-tree"
+)
+
+// ChangeFeedEntry records a single committed change to the catalog or the
+// KV store. Seq numbers every change in the order it was applied, with no
+// gaps, so several entries may share the same Raft Index. Key is the node
+// name, service or check ID, or KV key (the prefix for a tree delete). Node
+// is set for services and checks, and Service holds the name of the service
+// they belong to.
+type ChangeFeedEntry struct {
+	Seq     uint64
+	Index   uint64
+	Type    string
+	Op      string
+	Node    string
+	Key     string
+	Service string
+}
+type ChangeFeedEntries []*ChangeFeedEntry
+
+// ChangeFeedRequest is used to read the change feed after a given sequence
+// number. MaxEntries limits the size of the reply, with zero meaning no
+// limit beyond what the servers retain.
+type ChangeFeedRequest struct {
+	Datacenter string
+	Since      uint64
+	MaxEntries int
+	QueryOptions
+}
+
+func (r *ChangeFeedRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// IndexedChangeFeed is used to return entries from the change feed. LastSeq
+// is the newest sequence number the servers know about. Truncated is set if
+// entries after Since have already been dropped, in which case the caller
+// has missed changes and must resync from a full read of the state.
+type IndexedChangeFeed struct {
+	Entries   ChangeFeedEntries
+	LastSeq   uint64
+	Truncated bool
+	QueryMeta
+}
+
+const (
+	ServiceEventAdd    = "add"
+	ServiceEventUpdate = "update"
+	ServiceEventRemove = "remove"
+)
+
+// ServiceEvent describes a change to one instance of a service. Instance
+// holds the current state of the instance, with its health checks, and is
+// nil for removals. Several changes to the same instance are folded into
+// a single event.
+type ServiceEvent struct {
+	Op        string
+	Node      string
+	ServiceID string
+	Instance  *CheckServiceNode
+}
+type ServiceEvents []*ServiceEvent
+
+// ServiceSubscribeRequest is used to follow the changes to the instances of
+// a service. Since is the LastSeq from the previous reply, or zero to start
+// with the full list of instances.
+type ServiceSubscribeRequest struct {
+	Datacenter  string
+	ServiceName string
+	Since       uint64
+	QueryOptions
+}
+
+func (r *ServiceSubscribeRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// IndexedServiceEvents is used to return the changes to a service. If Reset
+// is set, the events add every current instance and the subscriber should
+// drop any instances it already had. This happens on the first request and
+// whenever the subscriber falls too far behind the change feed.
+type IndexedServiceEvents struct {
+	Events  ServiceEvents
+	LastSeq uint64
+	Reset   bool
+	QueryMeta
+}
+
+// KVSEvent describes a change to a key, or a tree of keys. Op is one of
+// the ChangeFeed operations, and Key is the prefix for a tree delete.
+// Entry holds the current entry for a set, and is nil otherwise. Several
+// changes to the same key are folded into a single event.
+type KVSEvent struct {
+	Op    string
+	Key   string
+	Entry *DirEntry
+}
+type KVSEvents []*KVSEvent
+
+// KVSSubscribeRequest is used to follow the changes to the keys under a
+// prefix. Since is the LastSeq from the previous reply, or zero to start
+// with every current key.
+type KVSSubscribeRequest struct {
+	Datacenter string
+	Prefix     string
+	Since      uint64
+	QueryOptions
+}
+
+func (r *KVSSubscribeRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// IndexedKVSEvents is used to return the changes under a prefix. If Reset
+// is set, the events set every current key and the subscriber should drop
+// any keys it already had. This happens on the first request and whenever
+// the subscriber falls too far behind the change feed.
+type IndexedKVSEvents struct {
+	Events  KVSEvents
+	LastSeq uint64
+	Reset   bool
+	QueryMeta
+}
+
+// KVSChangeEvent is the payload, encoded as JSON, of the user events the
+// leader fires for writes under the prefixes in its KVSEvents config. The
+// writes since the last event are coalesced into one, and Changes lists
+// them in order. If they don't all fit in a user event, the oldest are left
+// out and Truncated is set. Index is the Raft index of the newest write.
+type KVSChangeEvent struct {
+	Changes   []*KVSChange
+	Truncated bool
+	Index     uint64
+}
+
+// KVSChange is a single write in a KVSChangeEvent. Op is one of the
+// ChangeFeed ops, and Index is the Raft index of the write.
+type KVSChange struct {
+	Key   string
+	Op    string
+	Index uint64
+}
+
+const (
+	CapacityServiceInstances = "service_instances"
+	CapacityServices         = "services"
+	CapacityKVSKeys          = "kv_keys"
+)
+
+// CapacityThresholds are the sizes at which the leader starts warning that
+// the state store is getting large. A zero threshold is never crossed.
+type CapacityThresholds struct {
+	ServiceInstances int
+	Services         int
+	KVSKeys          int
+}
+
+// CapacityUsage is how much of the state store is in use, counted in the
+// same terms as the CapacityThresholds.
+type CapacityUsage struct {
+	Services         int
+	ServiceInstances map[string]int
+	KVSKeys          int
+}
+
+// CapacityStatus compares the current usage against the configured
+// thresholds. Exceeded holds one of the Capacity constants for each
+// threshold that has been crossed.
+type CapacityStatus struct {
+	Thresholds CapacityThresholds
+	Usage      CapacityUsage
+	Exceeded   []string
+	QueryMeta
+}
+
+// KVSQuota limits what can be stored under one top-level KV prefix. A zero
+// limit is never reached.
+type KVSQuota struct {
+	MaxBytes int
+	MaxKeys  int
+}
+
+// KVSUsage is how much is stored under one top-level KV prefix, which is
+// everything before a key's first slash. Bytes counts both keys and
+// values. Quota is the quota that applies to the prefix, if any.
+type KVSUsage struct {
+	Prefix string
+	Keys   int
+	Bytes  int
+	Quota  *KVSQuota
+}
+
+type KVSUsages []*KVSUsage
+
+// IndexedKVSUsage is the usage of every top-level KV prefix.
+type IndexedKVSUsage struct {
+	Usage KVSUsages
+	QueryMeta
+}
+
 type TombstoneOp string
 
 const (
@@ -753,6 +1988,32 @@ func (r *TombstoneRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// TombstoneGCRequest is used to tune the leader's tombstone GC, and to
+// trigger a GC pass without waiting for the pending timers. A zero TTL or
+// Granularity leaves that setting as it is.
+type TombstoneGCRequest struct {
+	Datacenter  string
+	TTL         time.Duration
+	Granularity time.Duration
+	Reap        bool
+	WriteRequest
+}
+
+func (r *TombstoneGCRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// TombstoneGCStatus reports the leader's tombstone GC settings and how many
+// tombstones are being held, in total and by top-level KV prefix. Reaped
+// is how many were removed by the GC pass, if one was requested.
+type TombstoneGCStatus struct {
+	TTL         time.Duration
+	Granularity time.Duration
+	Tombstones  int
+	ByPrefix    map[string]int
+	Reaped      int
+}
+
 // msgpackHandle is a shared handle for encoding/decoding of structs
 var msgpackHandle = &codec.MsgpackHandle{}
 
@@ -831,3 +2092,324 @@ func (r *KeyringResponses) Add(v interface{}) {
 func (r *KeyringResponses) New() interface{} {
 	return new(KeyringResponses)
 }
+
+const (
+	ReadinessReady         = "ready"
+	ReadinessNoLeader      = "no-leader"
+	ReadinessRaftLagging   = "raft-lagging"
+	ReadinessSerfUnhealthy = "serf-unhealthy"
+	ReadinessACLCold       = "acl-cold"
+)
+
+// ServerReadiness reports whether a server is caught up and healthy
+// enough to service requests. Status holds one of the Readiness
+// constants, naming the first condition that failed.
+type ServerReadiness struct {
+	Ready        bool
+	Status       string
+	KnownLeader  bool
+	LastContact  time.Duration
+	CommitIndex  uint64
+	AppliedIndex uint64
+	SerfHealthy  bool
+	ACLCacheWarm bool
+}
+
+// ValidationErrorPrefix starts the message of every ValidationErrors. Only
+// the message makes it across an RPC, so this is how callers on the other
+// side can tell a bad request apart from a server failure.
+const ValidationErrorPrefix = "Invalid request: "
+
+// FieldError is a problem with a single field of a request. Field is the
+// path to the field, such as "Service.ID" or "Session.TTL".
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationErrors collects all the problems found with a request so they
+// can be reported at once, instead of failing on the first one.
+type ValidationErrors []FieldError
+
+// Add records a problem with the given field
+func (v *ValidationErrors) Add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// ErrorOrNil returns the errors as an error, or nil if there are none
+func (v ValidationErrors) ErrorOrNil() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func (v ValidationErrors) Error() string {
+	parts := make([]string, 0, len(v))
+	for _, e := range v {
+		parts = append(parts, e.Field+": "+e.Message)
+	}
+	return ValidationErrorPrefix + strings.Join(parts, "; ")
+}
+
+// IsValidationError returns true if the error message came from a
+// ValidationErrors, possibly on the other side of an RPC.
+func IsValidationError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), ValidationErrorPrefix)
+}
+
+// MaintenanceWindow is a scheduled period of maintenance. A window with only
+// a Node covers the node and all of its services, one with only a
+// ServiceName covers every instance of that service, and one with both
+// covers the service's instances on that node. Checks keep running during a
+// window, but status changes made while it's in effect are marked as
+// suppressed. A non-zero Recurrence repeats the window that often after
+// Start.
+type MaintenanceWindow struct {
+	ID          string
+	Node        string
+	ServiceName string
+	Start       time.Time
+	End         time.Time
+	Recurrence  time.Duration
+	Reason      string
+
+	// ExcludeFromDiscovery also takes the covered service instances out
+	// of health-aware discovery, such as DNS, while the window is active.
+	ExcludeFromDiscovery bool
+
+	// InEffect is set by the leader while the window is active. Windows
+	// start and end through Raft, so every server agrees on which checks
+	// are suppressed.
+	InEffect bool
+
+	RaftIndex
+}
+type MaintenanceWindows []*MaintenanceWindow
+
+// Active returns true if the window is in effect at the given time.
+func (w *MaintenanceWindow) Active(now time.Time) bool {
+	if now.Before(w.Start) {
+		return false
+	}
+	since := now.Sub(w.Start)
+	if w.Recurrence > 0 {
+		since = since % w.Recurrence
+	}
+	return since < w.End.Sub(w.Start)
+}
+
+// NextChange returns the first time after the given time that the window
+// starts or ends, or the zero time if it never will again.
+func (w *MaintenanceWindow) NextChange(now time.Time) time.Time {
+	if now.Before(w.Start) {
+		return w.Start
+	}
+	start := w.Start
+	if w.Recurrence > 0 {
+		start = start.Add(now.Sub(w.Start) / w.Recurrence * w.Recurrence)
+	}
+	if end := start.Add(w.End.Sub(w.Start)); now.Before(end) {
+		return end
+	}
+	if w.Recurrence > 0 {
+		return start.Add(w.Recurrence)
+	}
+	return time.Time{}
+}
+
+// Covers returns true if the window applies to checks for the given node
+// and service name. Node-level checks have no service name.
+func (w *MaintenanceWindow) Covers(node, service string) bool {
+	if w.Node != "" && w.Node != node {
+		return false
+	}
+	if w.ServiceName != "" && w.ServiceName != service {
+		return false
+	}
+	return true
+}
+
+// Validate checks that the window describes a usable schedule.
+func (w *MaintenanceWindow) Validate() error {
+	var verr ValidationErrors
+	if w.Node == "" && w.ServiceName == "" {
+		verr.Add("Window", "must cover a node, a service, or both")
+	}
+	if w.Start.IsZero() {
+		verr.Add("Window.Start", "is required")
+	}
+	if !w.End.After(w.Start) {
+		verr.Add("Window.End", "must be after the start")
+	}
+	if w.Recurrence < 0 {
+		verr.Add("Window.Recurrence", "must not be negative")
+	} else if w.Recurrence > 0 && w.End.Sub(w.Start) >= w.Recurrence {
+		verr.Add("Window.Recurrence", "must be longer than the window")
+	}
+	return verr.ErrorOrNil()
+}
+
+// Active returns the windows that are in effect at the given time.
+func (ws MaintenanceWindows) Active(now time.Time) MaintenanceWindows {
+	var active MaintenanceWindows
+	for _, w := range ws {
+		if w.Active(now) {
+			active = append(active, w)
+		}
+	}
+	return active
+}
+
+// InEffect returns the windows that the leader has put into effect.
+func (ws MaintenanceWindows) InEffect() MaintenanceWindows {
+	var active MaintenanceWindows
+	for _, w := range ws {
+		if w.InEffect {
+			active = append(active, w)
+		}
+	}
+	return active
+}
+
+// Covering returns the first of the windows that applies to the given node
+// and service name, or nil if none do.
+func (ws MaintenanceWindows) Covering(node, service string) *MaintenanceWindow {
+	for _, w := range ws {
+		if w.Covers(node, service) {
+			return w
+		}
+	}
+	return nil
+}
+
+type MaintenanceWindowOp string
+
+const (
+	MaintenanceWindowSet    MaintenanceWindowOp = "set"
+	MaintenanceWindowDelete                     = "delete"
+
+	// MaintenanceWindowEffect is used by the leader to start or end a
+	// window, as given by the window's InEffect.
+	MaintenanceWindowEffect = "effect"
+)
+
+// MaintenanceWindowRequest is used to create, update or delete a
+// maintenance window
+type MaintenanceWindowRequest struct {
+	Datacenter string
+	Op         MaintenanceWindowOp
+	Window     MaintenanceWindow
+	WriteRequest
+}
+
+func (r *MaintenanceWindowRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// MaintenanceWindowSpecificRequest is used to request a maintenance window
+// by ID
+type MaintenanceWindowSpecificRequest struct {
+	Datacenter string
+	WindowID   string
+	QueryOptions
+}
+
+func (r *MaintenanceWindowSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// IndexedMaintenanceWindows is used to return maintenance windows
+type IndexedMaintenanceWindows struct {
+	Windows MaintenanceWindows
+	QueryMeta
+}
+
+// ManagedCheck is a check definition kept by the servers and run by every
+// agent it matches, so a check can be rolled out across many nodes at once.
+// A check with a ServiceName is added to each instance of that service on
+// the matching nodes, and one without is added to the nodes themselves.
+// NodeMeta limits the check to the nodes whose metadata has all of the
+// given pairs.
+type ManagedCheck struct {
+	ID          string
+	Name        string
+	Notes       string
+	ServiceName string
+	NodeMeta    map[string]string
+
+	Script   string
+	HTTP     string
+	TCP      string
+	Interval time.Duration
+	Timeout  time.Duration
+
+	RaftIndex
+}
+type ManagedChecks []*ManagedCheck
+
+// Matches returns true if the check should run on a node with the given
+// metadata.
+func (c *ManagedCheck) Matches(meta map[string]string) bool {
+	return SatisfiesMetaFilters(meta, c.NodeMeta)
+}
+
+// Validate checks that the definition describes a check agents can run.
+func (c *ManagedCheck) Validate() error {
+	var verr ValidationErrors
+	if c.Name == "" {
+		verr.Add("Check.Name", "must be provided")
+	}
+	kinds := 0
+	for _, target := range []string{c.Script, c.HTTP, c.TCP} {
+		if target != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		verr.Add("Check", "must have exactly one of Script, HTTP or TCP")
+	}
+	if c.Interval <= 0 {
+		verr.Add("Check.Interval", "must be positive")
+	}
+	if c.Timeout < 0 {
+		verr.Add("Check.Timeout", "must not be negative")
+	}
+	return verr.ErrorOrNil()
+}
+
+type ManagedCheckOp string
+
+const (
+	ManagedCheckSet    ManagedCheckOp = "set"
+	ManagedCheckDelete                = "delete"
+)
+
+// ManagedCheckRequest is used to create, update or delete a managed check
+type ManagedCheckRequest struct {
+	Datacenter string
+	Op         ManagedCheckOp
+	Check      ManagedCheck
+	WriteRequest
+}
+
+func (r *ManagedCheckRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ManagedCheckSpecificRequest is used to request a managed check by ID
+type ManagedCheckSpecificRequest struct {
+	Datacenter string
+	CheckID    string
+	QueryOptions
+}
+
+func (r *ManagedCheckSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// IndexedManagedChecks is used to return managed checks
+type IndexedManagedChecks struct {
+	Checks ManagedChecks
+	QueryMeta
+}
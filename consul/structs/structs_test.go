@@ -1,8 +1,11 @@
 package structs
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -42,6 +45,7 @@ func TestStructs_Implements(t *testing.T) {
 		_ RPCInfo          = &ServiceSpecificRequest{}
 		_ RPCInfo          = &NodeSpecificRequest{}
 		_ RPCInfo          = &ChecksInStateRequest{}
+		_ RPCInfo          = &ServiceSummaryRequest{}
 		_ RPCInfo          = &KVSRequest{}
 		_ RPCInfo          = &KeyRequest{}
 		_ RPCInfo          = &KeyListRequest{}
@@ -49,6 +53,11 @@ func TestStructs_Implements(t *testing.T) {
 		_ RPCInfo          = &SessionSpecificRequest{}
 		_ RPCInfo          = &EventFireRequest{}
 		_ RPCInfo          = &ACLPolicyRequest{}
+		_ RPCInfo          = &MaintenanceWindowRequest{}
+		_ RPCInfo          = &MaintenanceWindowSpecificRequest{}
+		_ RPCInfo          = &ManagedCheckRequest{}
+		_ RPCInfo          = &ManagedCheckSpecificRequest{}
+		_ RPCInfo          = &ExternalCheckUpdateRequest{}
 		_ RPCInfo          = &KeyringRequest{}
 		_ CompoundResponse = &KeyringResponses{}
 	)
@@ -65,6 +74,13 @@ func testServiceNode() *ServiceNode {
 		ServiceAddress:           "127.0.0.2",
 		ServicePort:              8080,
 		ServiceEnableTagOverride: true,
+		ServiceCacheMaxAge:       30,
+		ServiceDNSTTL:            10,
+		ServiceWeights:           &Weights{Passing: 3, Warning: 1},
+		ServiceMeta:              map[string]string{"version": "1.2.3"},
+		ServiceSource:            ServiceSourceExternal,
+		ServiceRegisteredAt:      time.Unix(1500000000, 0),
+		ServiceDraining:          true,
 		RaftIndex: RaftIndex{
 			CreateIndex: 1,
 			ModifyIndex: 2,
@@ -84,6 +100,81 @@ func TestStructs_ServiceNode_Clone(t *testing.T) {
 	if reflect.DeepEqual(sn, clone) {
 		t.Fatalf("clone wasn't independent of the original")
 	}
+
+	sn = testServiceNode()
+	clone = sn.Clone()
+	sn.ServiceMeta["version"] = "2.0.0"
+	if reflect.DeepEqual(sn, clone) {
+		t.Fatalf("clone wasn't independent of the original")
+	}
+
+	sn = testServiceNode()
+	sn.NodeMeta = map[string]string{"rack": "r1"}
+	clone = sn.Clone()
+	if !reflect.DeepEqual(sn, clone) {
+		t.Fatalf("bad: %v", clone)
+	}
+
+	sn.NodeMeta["rack"] = "r2"
+	if reflect.DeepEqual(sn, clone) {
+		t.Fatalf("clone wasn't independent of the original")
+	}
+}
+
+func TestStructs_SatisfiesMetaFilters(t *testing.T) {
+	meta := map[string]string{"rack": "r1", "az": "us-east-1a"}
+
+	if !SatisfiesMetaFilters(meta, nil) {
+		t.Fatalf("should match with no filters")
+	}
+	if !SatisfiesMetaFilters(meta, map[string]string{"rack": "r1"}) {
+		t.Fatalf("should match")
+	}
+	if !SatisfiesMetaFilters(meta, map[string]string{"rack": "r1", "az": "us-east-1a"}) {
+		t.Fatalf("should match")
+	}
+	if SatisfiesMetaFilters(meta, map[string]string{"rack": "r2"}) {
+		t.Fatalf("should not match")
+	}
+	if SatisfiesMetaFilters(meta, map[string]string{"rack": "r1", "class": "ssd"}) {
+		t.Fatalf("should not match")
+	}
+	if SatisfiesMetaFilters(nil, map[string]string{"rack": "r1"}) {
+		t.Fatalf("should not match")
+	}
+}
+
+func TestStructs_CheckServiceNodes_Shuffle(t *testing.T) {
+	// Make a huge list of nodes.
+	var nodes CheckServiceNodes
+	for i := 0; i < 100; i++ {
+		nodes = append(nodes, CheckServiceNode{
+			Node: &Node{
+				Node:    fmt.Sprintf("node%d", i),
+				Address: fmt.Sprintf("127.0.0.%d", i),
+			},
+		})
+	}
+
+	// Keep track of how many unique shuffles we get.
+	uniques := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		nodes.Shuffle()
+
+		var names []string
+		for _, node := range nodes {
+			names = append(names, node.Node.Node)
+		}
+		key := strings.Join(names, "|")
+		uniques[key] = struct{}{}
+	}
+
+	// We have to allow for the fact that there won't always be a unique
+	// shuffle each pass, so we just look for smell here without the test
+	// being flaky.
+	if len(uniques) < 50 {
+		t.Fatalf("unique shuffle ratio too low: %d/100", len(uniques))
+	}
 }
 
 func TestStructs_ServiceNode_Conversions(t *testing.T) {
@@ -103,6 +194,9 @@ func TestStructs_NodeService_IsSame(t *testing.T) {
 		Address:           "127.0.0.1",
 		Port:              1234,
 		EnableTagOverride: true,
+		CacheMaxAge:       30,
+		DNSTTL:            10,
+		Meta:              map[string]string{"version": "1.2.3"},
 	}
 	if !ns.IsSame(ns) {
 		t.Fatalf("should be equal to itself")
@@ -115,13 +209,18 @@ func TestStructs_NodeService_IsSame(t *testing.T) {
 		Address:           "127.0.0.1",
 		Port:              1234,
 		EnableTagOverride: true,
+		CacheMaxAge:       30,
+		DNSTTL:            10,
+		Meta:              map[string]string{"version": "1.2.3"},
+		Source:            ServiceSourceCatalog,
+		RegisteredAt:      time.Now(),
 		RaftIndex: RaftIndex{
 			CreateIndex: 1,
 			ModifyIndex: 2,
 		},
 	}
 	if !ns.IsSame(other) || !other.IsSame(ns) {
-		t.Fatalf("should not care about Raft fields")
+		t.Fatalf("should not care about Raft or registration fields")
 	}
 
 	check := func(twiddle, restore func()) {
@@ -147,6 +246,12 @@ func TestStructs_NodeService_IsSame(t *testing.T) {
 	check(func() { other.Address = "XXX" }, func() { other.Address = "127.0.0.1" })
 	check(func() { other.Port = 9999 }, func() { other.Port = 1234 })
 	check(func() { other.EnableTagOverride = false }, func() { other.EnableTagOverride = true })
+	check(func() { other.CacheMaxAge = 0 }, func() { other.CacheMaxAge = 30 })
+	check(func() { other.DNSTTL = 0 }, func() { other.DNSTTL = 10 })
+	check(func() { other.Weights = &Weights{Passing: 3, Warning: 1} }, func() { other.Weights = nil })
+	check(func() { other.Meta = nil }, func() { other.Meta = map[string]string{"version": "1.2.3"} })
+	check(func() { other.Meta = map[string]string{"version": "2.0.0"} }, func() { other.Meta = map[string]string{"version": "1.2.3"} })
+	check(func() { other.Draining = true }, func() { other.Draining = false })
 }
 
 func TestStructs_HealthCheck_IsSame(t *testing.T) {
@@ -207,6 +312,25 @@ func TestStructs_HealthCheck_IsSame(t *testing.T) {
 	check(&other.Output)
 	check(&other.ServiceID)
 	check(&other.ServiceName)
+
+	other.Informational = true
+	if hc.IsSame(other) || other.IsSame(hc) {
+		t.Fatalf("should not be the same")
+	}
+	other.Informational = false
+
+	other.External = &ExternalCheck{HTTP: "http://example.com"}
+	if hc.IsSame(other) || other.IsSame(hc) {
+		t.Fatalf("should not be the same")
+	}
+	hc.External = &ExternalCheck{HTTP: "http://example.com"}
+	if !hc.IsSame(other) || !other.IsSame(hc) {
+		t.Fatalf("should be the same")
+	}
+	other.External.Checker = "node2"
+	if hc.IsSame(other) || other.IsSame(hc) {
+		t.Fatalf("should not be the same")
+	}
 }
 
 func TestStructs_DirEntry_Clone(t *testing.T) {
@@ -232,3 +356,200 @@ func TestStructs_DirEntry_Clone(t *testing.T) {
 		t.Fatalf("clone wasn't independent of the original")
 	}
 }
+
+func TestStructs_ValidationErrors(t *testing.T) {
+	var verr ValidationErrors
+	if err := verr.ErrorOrNil(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	verr.Add("Node", "must be provided")
+	verr.Add("Checks[1].Status", "'%s' is not a valid status", "bogus")
+	err := verr.ErrorOrNil()
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+	expected := "Invalid request: Node: must be provided; Checks[1].Status: 'bogus' is not a valid status"
+	if err.Error() != expected {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Should be recognized from just the message
+	if !IsValidationError(fmt.Errorf(err.Error())) {
+		t.Fatalf("should be a validation error")
+	}
+	if IsValidationError(fmt.Errorf("No cluster leader")) || IsValidationError(nil) {
+		t.Fatalf("should not be a validation error")
+	}
+}
+
+func TestStructs_MaintenanceWindow_Active(t *testing.T) {
+	start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+	w := &MaintenanceWindow{
+		Start: start,
+		End:   start.Add(time.Hour),
+	}
+	cases := []struct {
+		now    time.Time
+		active bool
+	}{
+		{start.Add(-time.Minute), false},
+		{start, true},
+		{start.Add(59 * time.Minute), true},
+		{start.Add(time.Hour), false},
+		{start.Add(25 * time.Hour), false},
+	}
+	for _, c := range cases {
+		if active := w.Active(c.now); active != c.active {
+			t.Fatalf("bad: %v %v", c.now, active)
+		}
+	}
+
+	// A recurring window comes back around
+	w.Recurrence = 24 * time.Hour
+	cases = []struct {
+		now    time.Time
+		active bool
+	}{
+		{start.Add(-time.Minute), false},
+		{start.Add(24*time.Hour + 30*time.Minute), true},
+		{start.Add(25 * time.Hour), false},
+		{start.Add(30*24*time.Hour + time.Second), true},
+	}
+	for _, c := range cases {
+		if active := w.Active(c.now); active != c.active {
+			t.Fatalf("bad: %v %v", c.now, active)
+		}
+	}
+}
+
+func TestStructs_MaintenanceWindow_NextChange(t *testing.T) {
+	start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+	w := &MaintenanceWindow{
+		Start: start,
+		End:   start.Add(time.Hour),
+	}
+	cases := []struct {
+		now  time.Time
+		next time.Time
+	}{
+		{start.Add(-time.Minute), start},
+		{start, start.Add(time.Hour)},
+		{start.Add(59 * time.Minute), start.Add(time.Hour)},
+		{start.Add(time.Hour), time.Time{}},
+	}
+	for _, c := range cases {
+		if next := w.NextChange(c.now); !next.Equal(c.next) {
+			t.Fatalf("bad: %v %v", c.now, next)
+		}
+	}
+
+	// A recurring window starts again after it ends
+	w.Recurrence = 24 * time.Hour
+	cases = []struct {
+		now  time.Time
+		next time.Time
+	}{
+		{start.Add(time.Hour), start.Add(24 * time.Hour)},
+		{start.Add(24*time.Hour + 30*time.Minute), start.Add(25 * time.Hour)},
+		{start.Add(30 * time.Hour), start.Add(48 * time.Hour)},
+	}
+	for _, c := range cases {
+		if next := w.NextChange(c.now); !next.Equal(c.next) {
+			t.Fatalf("bad: %v %v", c.now, next)
+		}
+	}
+}
+
+func TestStructs_MaintenanceWindow_Covers(t *testing.T) {
+	windows := MaintenanceWindows{
+		&MaintenanceWindow{ID: "node", Node: "node1"},
+		&MaintenanceWindow{ID: "service", ServiceName: "redis"},
+		&MaintenanceWindow{ID: "instance", Node: "node2", ServiceName: "web"},
+	}
+	cases := []struct {
+		node, service string
+		covering      string
+	}{
+		{"node1", "", "node"},
+		{"node1", "web", "node"},
+		{"node2", "", ""},
+		{"node2", "redis", "service"},
+		{"node2", "web", "instance"},
+		{"node3", "web", ""},
+	}
+	for _, c := range cases {
+		var covering string
+		if w := windows.Covering(c.node, c.service); w != nil {
+			covering = w.ID
+		}
+		if covering != c.covering {
+			t.Fatalf("bad: %s/%s covered by %q", c.node, c.service, covering)
+		}
+	}
+}
+
+func TestStructs_MaintenanceWindow_Validate(t *testing.T) {
+	start := time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)
+	w := &MaintenanceWindow{
+		Node:       "node1",
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Recurrence: 24 * time.Hour,
+	}
+	if err := w.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	bad := []*MaintenanceWindow{
+		&MaintenanceWindow{Start: start, End: start.Add(time.Hour)},
+		&MaintenanceWindow{Node: "node1", End: start},
+		&MaintenanceWindow{Node: "node1", Start: start, End: start},
+		&MaintenanceWindow{Node: "node1", Start: start, End: start.Add(time.Hour), Recurrence: -time.Hour},
+		&MaintenanceWindow{Node: "node1", Start: start, End: start.Add(time.Hour), Recurrence: time.Hour},
+	}
+	for _, w := range bad {
+		if err := w.Validate(); !IsValidationError(err) {
+			t.Fatalf("expected validation error for %#v, got: %v", w, err)
+		}
+	}
+}
+
+func TestStructs_ManagedCheck_Matches(t *testing.T) {
+	c := &ManagedCheck{}
+	if !c.Matches(nil) || !c.Matches(map[string]string{"rack": "r1"}) {
+		t.Fatalf("should match every node")
+	}
+
+	c.NodeMeta = map[string]string{"rack": "r1"}
+	if c.Matches(nil) || c.Matches(map[string]string{"rack": "r2"}) {
+		t.Fatalf("should not match")
+	}
+	if !c.Matches(map[string]string{"rack": "r1", "os": "linux"}) {
+		t.Fatalf("should match")
+	}
+}
+
+func TestStructs_ManagedCheck_Validate(t *testing.T) {
+	c := &ManagedCheck{
+		Name:     "disk space",
+		Script:   "/usr/local/bin/check_disk",
+		Interval: time.Minute,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	bad := []*ManagedCheck{
+		&ManagedCheck{Script: "check_disk", Interval: time.Minute},
+		&ManagedCheck{Name: "disk space", Interval: time.Minute},
+		&ManagedCheck{Name: "disk space", Script: "check_disk", HTTP: "http://localhost", Interval: time.Minute},
+		&ManagedCheck{Name: "disk space", Script: "check_disk"},
+		&ManagedCheck{Name: "disk space", Script: "check_disk", Interval: time.Minute, Timeout: -time.Second},
+	}
+	for _, c := range bad {
+		if err := c.Validate(); !IsValidationError(err) {
+			t.Fatalf("expected validation error for %#v, got: %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package consul
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// tlsBootstrapPath is the directory under the data dir that holds the
+	// bootstrapped TLS files.
+	tlsBootstrapPath = "tls"
+
+	// These are the names of the bootstrapped TLS files.
+	tlsCAFile      = "ca.pem"
+	tlsCAKeyFile   = "ca-key.pem"
+	tlsCertFile    = "server.pem"
+	tlsCertKeyFile = "server-key.pem"
+
+	// tlsQueryCA is the Serf query used to fetch the certificate authority,
+	// and tlsQuerySign is the one used to have a certificate signed.
+	tlsQueryCA   = "consul:tls:ca"
+	tlsQuerySign = "consul:tls:sign"
+
+	// tlsCertValidity is how long bootstrapped certificates are valid for.
+	tlsCertValidity = 10 * 365 * 24 * time.Hour
+
+	// tlsRequestInterval is how often a server without a certificate asks
+	// the other servers for one.
+	tlsRequestInterval = 10 * time.Second
+)
+
+// tlsBootstrapCA is a certificate authority created by a server for
+// signing the certificates of the servers in its datacenter.
+type tlsBootstrapCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// tlsSignRequest is the payload of a tlsQuerySign query. The public key
+// is in PKIX form.
+type tlsSignRequest struct {
+	Node      string
+	PublicKey []byte
+}
+
+// setupTLSBootstrap loads the bootstrapped TLS files, creating the
+// certificate authority if this server is in bootstrap mode, and issuing
+// our own certificate if we hold the authority. The files fill in any TLS
+// files that aren't configured. Until this server has a certificate, TLS
+// verification is turned off; the other servers won't talk to it anyway.
+// This returns the certificate authority if we hold it.
+func setupTLSBootstrap(config *Config, logger *log.Logger) (*tlsBootstrapCA, error) {
+	dir := filepath.Join(config.DataDir, tlsBootstrapPath)
+	if err := ensurePath(dir, true); err != nil {
+		return nil, err
+	}
+
+	// Load the certificate authority, or create it if we're the first
+	// server.
+	ca, err := loadTLSCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil && config.Bootstrap {
+		if ca, err = newTLSCA(dir); err != nil {
+			return nil, err
+		}
+		logger.Printf("[INFO] consul: created TLS certificate authority in %s", dir)
+	}
+
+	// Issue our own certificate if we can.
+	certPath := filepath.Join(dir, tlsCertFile)
+	if ca != nil && !fileExists(certPath) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate TLS key: %v", err)
+		}
+		cert, err := ca.sign(config.NodeName, tlsServerName(config), &key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeTLSCert(dir, ca.cert.Raw, cert, key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Use the files for anything that isn't configured.
+	if fileExists(certPath) {
+		if config.CAFile == "" {
+			config.CAFile = filepath.Join(dir, tlsCAFile)
+		}
+		if config.CertFile == "" && config.KeyFile == "" {
+			config.CertFile = certPath
+			config.KeyFile = filepath.Join(dir, tlsCertKeyFile)
+		}
+	} else if config.CertFile == "" {
+		if config.VerifyIncoming || config.VerifyOutgoing || config.VerifyServerHostname {
+			logger.Printf("[WARN] consul: no TLS certificate has been issued yet, TLS verification is off until one is issued and the server restarts")
+		}
+		config.VerifyIncoming = false
+		config.VerifyOutgoing = false
+		config.VerifyServerHostname = false
+	}
+	return ca, nil
+}
+
+// tlsServerName returns the name that server certificates are issued for,
+// which is what is checked when VerifyServerHostname is set.
+func tlsServerName(config *Config) string {
+	return "server." + config.Datacenter + "." + strings.TrimSuffix(config.Domain, ".")
+}
+
+// loadTLSCA loads the certificate authority from the given directory. This
+// returns nil if we don't have the authority's key.
+func loadTLSCA(dir string) (*tlsBootstrapCA, error) {
+	keyPath := filepath.Join(dir, tlsCAKeyFile)
+	if !fileExists(keyPath) {
+		return nil, nil
+	}
+
+	certDER, err := readPEMFile(filepath.Join(dir, tlsCAFile))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS CA certificate: %v", err)
+	}
+	keyDER, err := readPEMFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS CA key: %v", err)
+	}
+	return &tlsBootstrapCA{cert, key}, nil
+}
+
+// newTLSCA creates a new certificate authority and writes it to the given
+// directory.
+func newTLSCA(dir string) (*tlsBootstrapCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TLS CA key: %v", err)
+	}
+	serial, err := tlsSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Consul CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(tlsCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS CA certificate: %v", err)
+	}
+
+	// Write the key last, since its presence means the authority is there.
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode TLS CA key: %v", err)
+	}
+	if err := writePEMFile(filepath.Join(dir, tlsCAFile), "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+	if err := writePEMFile(filepath.Join(dir, tlsCAKeyFile), "EC PRIVATE KEY", keyDER); err != nil {
+		return nil, err
+	}
+	return &tlsBootstrapCA{cert, key}, nil
+}
+
+// sign issues a server certificate for the given node, good for both
+// serving and making RPC connections.
+func (ca *tlsBootstrapCA) sign(node, serverName string, pub *ecdsa.PublicKey) ([]byte, error) {
+	serial, err := tlsSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: node},
+		DNSNames:     []string{serverName},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(tlsCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS certificate: %v", err)
+	}
+	return der, nil
+}
+
+// tlsSerial returns a random certificate serial number.
+func tlsSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
+
+// writeTLSCert writes out an issued certificate along with its key and the
+// authority's certificate. The certificate is written last, since its
+// presence means the rest are there.
+func writeTLSCert(dir string, caDER, certDER []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode TLS key: %v", err)
+	}
+	if err := writePEMFile(filepath.Join(dir, tlsCAFile), "CERTIFICATE", caDER); err != nil {
+		return err
+	}
+	if err := writePEMFile(filepath.Join(dir, tlsCertKeyFile), "EC PRIVATE KEY", keyDER); err != nil {
+		return err
+	}
+	return writePEMFile(filepath.Join(dir, tlsCertFile), "CERTIFICATE", certDER)
+}
+
+// readPEMFile returns the contents of the first block in a PEM file.
+func readPEMFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block.Bytes, nil
+}
+
+// writePEMFile writes a single PEM block to a file that only we can read.
+func writePEMFile(path, kind string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// fileExists returns true if there is a file at the given path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// localQuery is used to answer Serf queries from the LAN. Queries are only
+// used for bootstrapping TLS, and only the server holding the certificate
+// authority answers them. Gossip encryption is what proves the asker is a
+// member of the cluster, so nothing is answered without it.
+func (s *Server) localQuery(q *serf.Query) {
+	if s.tlsCA == nil || !s.serfLAN.EncryptionEnabled() {
+		return
+	}
+
+	var resp []byte
+	switch q.Name {
+	case tlsQueryCA:
+		resp = s.tlsCA.cert.Raw
+
+	case tlsQuerySign:
+		var err error
+		if resp, err = s.signTLSRequest(q.SourceNode(), q.Payload); err != nil {
+			s.logger.Printf("[WARN] consul: failed to sign TLS certificate: %v", err)
+			return
+		}
+
+	default:
+		return
+	}
+
+	if err := q.Respond(resp); err != nil {
+		s.logger.Printf("[WARN] consul: failed to respond to %s query: %v", q.Name, err)
+	}
+}
+
+// signTLSRequest issues a certificate for a tlsQuerySign query, as long as
+// it comes from the server it's for, in our datacenter.
+func (s *Server) signTLSRequest(source string, payload []byte) ([]byte, error) {
+	var req tlsSignRequest
+	if err := codec.NewDecoder(bytes.NewReader(payload), msgpackHandle).Decode(&req); err != nil {
+		return nil, fmt.Errorf("failed to decode request: %v", err)
+	}
+	if req.Node != source {
+		return nil, fmt.Errorf("request for %q was sent by %q", req.Node, source)
+	}
+	if !s.isLANServer(req.Node) {
+		return nil, fmt.Errorf("%q is not a server in this datacenter", req.Node)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(req.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not ECDSA")
+	}
+
+	cert, err := s.tlsCA.sign(req.Node, tlsServerName(s.config), ecPub)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Printf("[INFO] consul: issued TLS certificate for %s", req.Node)
+	return cert, nil
+}
+
+// requestTLSCert keeps asking the other servers for a certificate until one
+// is issued. The certificate is only used after the server restarts.
+func (s *Server) requestTLSCert() {
+	for {
+		select {
+		case <-time.After(tlsRequestInterval):
+		case <-s.shutdownCh:
+			return
+		}
+
+		if err := s.fetchTLSCert(); err != nil {
+			s.logger.Printf("[DEBUG] consul: TLS certificate request failed: %v", err)
+			continue
+		}
+		s.logger.Printf("[INFO] consul: TLS certificate issued, restart the server to start using it")
+		return
+	}
+}
+
+// fetchTLSCert gets the certificate authority and has a new key signed by
+// it, writing the results to the data dir.
+func (s *Server) fetchTLSCert() error {
+	answers, err := s.askTLSQuery(tlsQueryCA, nil)
+	if err != nil {
+		return err
+	}
+
+	// Every server that answers has to agree on the authority, so one
+	// rogue answer can't get a different one trusted.
+	caDER := answers[0]
+	for _, answer := range answers[1:] {
+		if !bytes.Equal(answer, caDER) {
+			return fmt.Errorf("servers disagree on the TLS CA certificate")
+		}
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS CA certificate: %v", err)
+	}
+	if !ca.IsCA {
+		return fmt.Errorf("TLS CA certificate is not for a certificate authority")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode TLS public key: %v", err)
+	}
+	var buf bytes.Buffer
+	req := tlsSignRequest{Node: s.config.NodeName, PublicKey: pub}
+	if err := codec.NewEncoder(&buf, msgpackHandle).Encode(&req); err != nil {
+		return err
+	}
+	answers, err = s.askTLSQuery(tlsQuerySign, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Use the first certificate we got back for our key, signed by the
+	// authority.
+	for _, certDER := range answers {
+		if err = checkTLSCert(certDER, ca, pub); err == nil {
+			dir := filepath.Join(s.config.DataDir, tlsBootstrapPath)
+			return writeTLSCert(dir, caDER, certDER, key)
+		}
+	}
+	return err
+}
+
+// checkTLSCert makes sure a certificate is for the given public key and is
+// signed by the authority.
+func checkTLSCert(certDER []byte, ca *x509.Certificate, pub []byte) error {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS certificate: %v", err)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		return fmt.Errorf("TLS certificate isn't signed by the CA: %v", err)
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil || !bytes.Equal(certPub, pub) {
+		return fmt.Errorf("TLS certificate is for a different key")
+	}
+	return nil
+}
+
+// isLANServer returns true if the named node is an alive server in our
+// datacenter, as far as the LAN pool knows.
+func (s *Server) isLANServer(name string) bool {
+	for _, m := range s.serfLAN.Members() {
+		if m.Name != name || m.Status != serf.StatusAlive {
+			continue
+		}
+		if ok, parts := isConsulServer(m); ok && parts.Datacenter == s.config.Datacenter {
+			return true
+		}
+	}
+	return false
+}
+
+// askTLSQuery sends a TLS bootstrap query to the servers in our datacenter
+// and returns the answers from the nodes we know to be servers.
+func (s *Server) askTLSQuery(name string, payload []byte) ([][]byte, error) {
+	params := &serf.QueryParam{
+		FilterTags: map[string]string{
+			"role": "consul",
+			"dc":   s.config.Datacenter,
+		},
+	}
+	resp, err := s.serfLAN.Query(name, payload, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s query: %v", name, err)
+	}
+
+	// Read until the query times out so the responses don't back up.
+	var answers [][]byte
+	for r := range resp.ResponseCh() {
+		if len(r.Payload) > 0 && s.isLANServer(r.From) {
+			answers = append(answers, r.Payload)
+		}
+	}
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("no server answered the %s query", name)
+	}
+	return answers, nil
+}
@@ -0,0 +1,169 @@
+package consul
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// verifyTLSBootstrapCert checks that the server's bootstrapped certificate
+// loads and was issued by the given authority.
+func verifyTLSBootstrapCert(t *testing.T, dir string, ca *x509.Certificate) {
+	tlsDir := filepath.Join(dir, tlsBootstrapPath)
+	if _, err := tls.LoadX509KeyPair(filepath.Join(tlsDir, tlsCertFile), filepath.Join(tlsDir, tlsCertKeyFile)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	der, err := readPEMFile(filepath.Join(tlsDir, tlsCertFile))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	opts := x509.VerifyOptions{
+		DNSName:   "server.dc1.consul",
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTLSBootstrap_Setup(t *testing.T) {
+	dir := tmpDir(t)
+	defer os.RemoveAll(dir)
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	// The bootstrap server creates the authority and its own certificate.
+	config := DefaultConfig()
+	config.NodeName = "node1"
+	config.Datacenter = "dc1"
+	config.Domain = "consul."
+	config.DataDir = dir
+	config.Bootstrap = true
+	ca, err := setupTLSBootstrap(config, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ca == nil || !ca.cert.IsCA {
+		t.Fatalf("bad: %v", ca)
+	}
+	tlsDir := filepath.Join(dir, tlsBootstrapPath)
+	if config.CAFile != filepath.Join(tlsDir, tlsCAFile) ||
+		config.CertFile != filepath.Join(tlsDir, tlsCertFile) ||
+		config.KeyFile != filepath.Join(tlsDir, tlsCertKeyFile) {
+		t.Fatalf("bad: %#v", config)
+	}
+	verifyTLSBootstrapCert(t, dir, ca.cert)
+
+	// It picks the same authority back up after a restart.
+	config.CAFile, config.CertFile, config.KeyFile = "", "", ""
+	ca2, err := setupTLSBootstrap(config, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ca2 == nil || !ca2.cert.Equal(ca.cert) {
+		t.Fatalf("bad: %v", ca2)
+	}
+
+	// Configured files win.
+	config.CAFile, config.CertFile, config.KeyFile = "my/ca.pem", "my/cert.pem", "my/key.pem"
+	if _, err := setupTLSBootstrap(config, logger); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if config.CAFile != "my/ca.pem" || config.CertFile != "my/cert.pem" || config.KeyFile != "my/key.pem" {
+		t.Fatalf("bad: %#v", config)
+	}
+}
+
+func TestTLSBootstrap_Setup_NoCert(t *testing.T) {
+	dir := tmpDir(t)
+	defer os.RemoveAll(dir)
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	// Other servers have nothing until they ask, so they can't verify.
+	config := DefaultConfig()
+	config.DataDir = dir
+	config.VerifyIncoming = true
+	config.VerifyOutgoing = true
+	ca, err := setupTLSBootstrap(config, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ca != nil {
+		t.Fatalf("bad: %v", ca)
+	}
+	if config.CertFile != "" || config.VerifyIncoming || config.VerifyOutgoing {
+		t.Fatalf("bad: %#v", config)
+	}
+}
+
+func TestServer_TLSBootstrap(t *testing.T) {
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Domain = "consul."
+		c.TLSBootstrap = true
+		c.SerfLANConfig.MemberlistConfig.SecretKey = key
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.Domain = "consul."
+		c.TLSBootstrap = true
+		c.SerfLANConfig.MemberlistConfig.SecretKey = key
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	if s1.tlsCA == nil || s2.tlsCA != nil {
+		t.Fatalf("bad: %v %v", s1.tlsCA, s2.tlsCA)
+	}
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		return len(s1.LANMembers()) == 2, nil
+	}, func(err error) {
+		t.Fatalf("bad len")
+	})
+
+	// The second server gets a certificate from the first.
+	testutil.WaitForResult(func() (bool, error) {
+		err := s2.fetchTLSCert()
+		return err == nil, err
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	verifyTLSBootstrapCert(t, dir2, s1.tlsCA.cert)
+
+	// A request for the second server sent by anyone else is refused.
+	var buf bytes.Buffer
+	req := tlsSignRequest{Node: s2.config.NodeName}
+	if err := codec.NewEncoder(&buf, msgpackHandle).Encode(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err := s1.signTLSRequest("rogue", buf.Bytes())
+	if err == nil || !strings.Contains(err.Error(), "was sent by") {
+		t.Fatalf("err: %v", err)
+	}
+}
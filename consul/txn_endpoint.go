@@ -0,0 +1,187 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Txn endpoint is used to apply several operations atomically
+type Txn struct {
+	srv *Server
+}
+
+// preCheck verifies the operations of a transaction and applies the ACL
+// policy before it goes into Raft, returning errors for any operations that
+// can't be applied. The same limits apply as for KVS.Apply, and values are
+// encoded here in the same way. The quotas are checked against the usage
+// after all of the transaction's writes.
+func (t *Txn) preCheck(acl acl.ACL, ops structs.TxnOps) structs.TxnErrors {
+	var errs structs.TxnErrors
+	quota := t.srv.newKVSQuotaCheck()
+	for i, op := range ops {
+		if op.KV == nil {
+			errs = append(errs, &structs.TxnError{OpIndex: i, What: "unknown operation"})
+			continue
+		}
+		if err := t.preCheckKV(acl, quota, op.KV); err != nil {
+			errs = append(errs, &structs.TxnError{OpIndex: i, What: err.Error()})
+		}
+	}
+	return errs
+}
+
+// preCheckKV verifies a single KV operation.
+func (t *Txn) preCheckKV(acl acl.ACL, quota *kvsQuotaCheck, op *structs.TxnKVOp) error {
+	key := op.DirEnt.Key
+	if key == "" {
+		return fmt.Errorf("Must provide key")
+	}
+
+	switch op.Verb {
+	case structs.KVSGet, structs.KVSCheckTree:
+		if acl != nil && !acl.KeyRead(key) {
+			return permissionDeniedErr
+		}
+	case structs.KVSDeleteTree, structs.KVSDeleteTreeCAS:
+		if acl != nil && !acl.KeyWritePrefix(key) {
+			return permissionDeniedErr
+		}
+	case structs.KVSSet, structs.KVSDelete, structs.KVSDeleteCAS,
+		structs.KVSCAS, structs.KVSLock, structs.KVSUnlock:
+		if acl != nil && !acl.KeyWrite(key) {
+			return permissionDeniedErr
+		}
+	default:
+		return fmt.Errorf("Invalid KV verb %q", op.Verb)
+	}
+
+	// Transactions don't take TTLs, so like any other write without one
+	// they clear the entry's expiration. Chunked uploads and recycled
+	// trees are only ever set up by us.
+	op.DirEnt.ExpiresAt = time.Time{}
+	op.ChunkID, op.Chunks, op.Recycled = "", 0, nil
+
+	switch op.Verb {
+	case structs.KVSSet, structs.KVSCAS, structs.KVSLock, structs.KVSUnlock:
+		if len(op.DirEnt.Value) > t.srv.config.KVSMaxValueSize {
+			return fmt.Errorf("Value exceeds %d byte limit", t.srv.config.KVSMaxValueSize)
+		}
+	}
+
+	// Send deleted trees to the recycle bin if it's enabled.
+	switch op.Verb {
+	case structs.KVSDeleteTree, structs.KVSDeleteTreeCAS:
+		if t.srv.config.KVSRecycleRetention > 0 {
+			tree, err := t.srv.newKVSRecycled(key)
+			if err != nil {
+				return err
+			}
+			op.Recycled = tree
+		}
+	}
+
+	// The lock-delay has to be enforced before commit, see KVS.apply.
+	if op.Verb == structs.KVSLock {
+		expires := t.srv.fsm.State().KVSLockDelay(key)
+		if expires.After(time.Now()) {
+			return fmt.Errorf("key %q is in lock-delay until %v", key, expires)
+		}
+	}
+
+	// Values are counted against the quotas as they will be stored. Tree
+	// deletes aren't counted, which only makes the check stricter.
+	switch op.Verb {
+	case structs.KVSSet, structs.KVSCAS, structs.KVSLock, structs.KVSUnlock:
+		value, err := t.srv.encodeKVSValue(key, op.DirEnt.Value)
+		if err != nil {
+			return err
+		}
+		op.DirEnt.Value = value
+		if err := quota.set(key, op.DirEnt.Value); err != nil {
+			return err
+		}
+	case structs.KVSDelete, structs.KVSDeleteCAS:
+		if err := quota.delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunk keeps the transaction's Raft entry to a reasonable size, as
+// KVS.Apply does for single values. Values that would take it past
+// kvsChunkSize are written ahead of it as chunked uploads.
+func (t *Txn) chunk(args *structs.TxnRequest) error {
+	var size int
+	for _, op := range args.Ops {
+		value := op.KV.DirEnt.Value
+		if size+len(value) <= kvsChunkSize {
+			size += len(value)
+			continue
+		}
+		id, chunks, err := t.srv.uploadKVSValue(args.Datacenter, args.WriteRequest, value)
+		if err != nil {
+			return err
+		}
+		op.KV.ChunkID, op.KV.Chunks, op.KV.DirEnt.Value = id, chunks, nil
+	}
+	return nil
+}
+
+// Apply is used to apply a list of operations atomically. If the
+// transaction can't be applied, the reply's Errors say why and nothing
+// is written.
+func (t *Txn) Apply(args *structs.TxnRequest, reply *structs.TxnResponse) error {
+	if done, err := t.srv.forward("Txn.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "txn", "apply"}, time.Now())
+
+	acl, err := t.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	reply.Errors = t.preCheck(acl, args.Ops)
+	if len(reply.Errors) > 0 {
+		return nil
+	}
+	if err := t.chunk(args); err != nil {
+		return err
+	}
+
+	// Apply the update
+	resp, index, err := t.srv.raftApplyIndex(structs.TxnRequestType, args)
+	if err != nil {
+		t.srv.logger.Printf("[ERR] consul.txn: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	txnResp, ok := resp.(structs.TxnResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response type %T", resp)
+	}
+	reply.Results, reply.Errors = txnResp.Results, txnResp.Errors
+	if len(reply.Errors) > 0 {
+		return nil
+	}
+	reply.Index = index
+
+	// Decode the values of any keys we read.
+	for _, result := range reply.Results {
+		if result.KV == nil {
+			continue
+		}
+		ents := structs.DirEntries{result.KV}
+		if err := t.srv.decodeKVSEntries(ents); err != nil {
+			return err
+		}
+		result.KV = ents[0]
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+package consul
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestTxn_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSSet,
+					DirEnt: structs.DirEntry{
+						Key:   "test/a",
+						Flags: 42,
+						Value: []byte("test"),
+					},
+				},
+			},
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSCAS,
+					DirEnt: structs.DirEntry{
+						Key:   "test/b",
+						Value: []byte("test"),
+					},
+				},
+			},
+		},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 || len(out.Results) != 2 || out.Index == 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if kv := out.Results[0].KV; kv.Key != "test/a" || kv.Flags != 42 || kv.ModifyIndex != out.Index {
+		t.Fatalf("bad: %v", kv)
+	}
+
+	// Verify
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("test/b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.ModifyIndex != out.Index {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Running the same transaction again fails on the CAS, so the first
+	// set doesn't happen either.
+	arg.Ops[0].KV.DirEnt.Value = []byte("changed")
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Results) != 0 || len(out.Errors) != 1 || out.Errors[0].OpIndex != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	_, d, err = state.KVSGet("test/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestTxn_Apply_CheckTree(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, key := range []string{"config/a", "config/b"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("old"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	state := s1.fsm.State()
+	index, _, err := state.KVSList("config/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Someone else changes the tree after we read it
+	change := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "config/b",
+			Value: []byte("theirs"),
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &change, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So replacing the tree as of our read fails
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSCheckTree,
+					DirEnt: structs.DirEntry{
+						Key:       "config/",
+						RaftIndex: structs.RaftIndex{ModifyIndex: index},
+					},
+				},
+			},
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb:   structs.KVSDeleteTree,
+					DirEnt: structs.DirEntry{Key: "config/"},
+				},
+			},
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSSet,
+					DirEnt: structs.DirEntry{
+						Key:   "config/c",
+						Value: []byte("new"),
+					},
+				},
+			},
+		},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || out.Errors[0].OpIndex != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// It goes through against the current index
+	index, _, err = state.KVSList("config/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Ops[0].KV.DirEnt.ModifyIndex = index
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	_, ents, err := state.KVSList("config/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 1 || ents[0].Key != "config/c" {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// The same goes for a conditional tree delete
+	kvArg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSDeleteTreeCAS,
+		DirEnt: structs.DirEntry{
+			Key:       "config/",
+			RaftIndex: structs.RaftIndex{ModifyIndex: index},
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kvArg, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("should have failed")
+	}
+	kvArg.DirEnt.ModifyIndex = out.Index
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kvArg, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("bad: %v", ok)
+	}
+}
+
+func TestTxn_Apply_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create the ACL
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testListRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The write under "test" is allowed, but not the one under "foo", so
+	// nothing is written.
+	txn := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb:   structs.KVSSet,
+					DirEnt: structs.DirEntry{Key: "test/a", Value: []byte("test")},
+				},
+			},
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb:   structs.KVSSet,
+					DirEnt: structs.DirEntry{Key: "foo/a", Value: []byte("test")},
+				},
+			},
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || out.Errors[0].OpIndex != 1 ||
+		!strings.Contains(out.Errors[0].What, permissionDenied) {
+		t.Fatalf("bad: %#v", out)
+	}
+	_, d, err := s1.fsm.State().KVSGet("test/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestTxn_Apply_Limits(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSMaxValueSize = 400 * 1024
+		c.KVSQuotas = map[string]structs.KVSQuota{
+			"*": structs.KVSQuota{MaxKeys: 2},
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := func(key string, value []byte) *structs.TxnOp {
+		return &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: structs.KVSSet,
+				DirEnt: structs.DirEntry{
+					Key:   key,
+					Value: value,
+				},
+			},
+		}
+	}
+
+	// Values over the limit are rejected.
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			set("test/a", make([]byte, 500*1024)),
+		},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || !strings.Contains(out.Errors[0].What, "byte limit") {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The sets are counted together against the quota.
+	arg.Ops = structs.TxnOps{
+		set("test/a", []byte("a")),
+		set("test/b", []byte("b")),
+		set("test/c", []byte("c")),
+	}
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || out.Errors[0].OpIndex != 2 ||
+		!strings.Contains(out.Errors[0].What, "quota") {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Values too big to share a Raft entry are chunked.
+	big := bytes.Repeat([]byte("x"), 300*1024)
+	arg.Ops = structs.TxnOps{
+		set("test/a", big),
+		set("test/b", big),
+	}
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	state := s1.fsm.State()
+	for _, key := range []string{"test/a", "test/b"} {
+		_, d, err := state.KVSGet(key)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d == nil || !bytes.Equal(d.Value, big) {
+			t.Fatalf("bad value for %q", key)
+		}
+	}
+}
+
+func TestTxn_Apply_Recycle(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSRecycleRetention = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test/a",
+			Value: []byte("test"),
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Tree deletes in a transaction go into the recycle bin.
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSDeleteTree,
+					DirEnt: structs.DirEntry{
+						Key: "test/",
+					},
+				},
+			},
+		},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("test/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+	_, trees, err := state.KVSRecycledList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(trees) != 1 || trees[0].Prefix != "test/" || len(trees[0].Entries) != 1 {
+		t.Fatalf("bad: %#v", trees)
+	}
+}
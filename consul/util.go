@@ -179,6 +179,12 @@ func isConsulNode(m serf.Member) (bool, string) {
 	return true, m.Tags["dc"]
 }
 
+// isExternalChecker returns if a member has volunteered to run external
+// checks.
+func isExternalChecker(m serf.Member) bool {
+	return m.Tags["ext_checker"] == "1"
+}
+
 // Returns if the given IP is in a private block
 func isPrivateIP(ip_str string) bool {
 	ip := net.ParseIP(ip_str)
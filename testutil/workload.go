@@ -0,0 +1,506 @@
+package testutil
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Workload drives a Consul server with a random but repeatable series of
+// catalog writes: service and check registrations, health flaps, and
+// deregistrations. After every write it queries the catalog and health
+// endpoints and checks the results against a simple model of what the
+// catalog should hold, so a regression in filtering or index handling shows
+// up as a failing step along with the seed needed to replay it.
+//
+// Everything the workload registers is named with its Prefix, and anything
+// else in the catalog is ignored, so it can run against a server that has
+// registered itself.
+type Workload struct {
+	// Datacenter is where the workload runs.
+	Datacenter string
+
+	// Prefix starts every node, service, and check name the workload
+	// uses. Give workloads sharing a server different prefixes.
+	Prefix string
+
+	// Nodes and Services are how many distinct node and service names the
+	// workload picks from. Keeping them small makes updates to existing
+	// entries more likely.
+	Nodes    int
+	Services int
+
+	// Tags are the tags services are registered with.
+	Tags []string
+
+	seed    int64
+	rng     *rand.Rand
+	step    int
+	index   uint64
+	nodes   map[string]*workloadNode
+	history []string
+}
+
+// workloadNode is the model of a registered node.
+type workloadNode struct {
+	Address  string
+	Services map[string]*workloadService
+	Checks   map[string]*workloadCheck
+}
+
+// workloadService is the model of a registered service instance.
+type workloadService struct {
+	Name string
+	Tags []string
+}
+
+// workloadCheck is the model of a registered health check.
+type workloadCheck struct {
+	ServiceID string
+	Status    string
+}
+
+// NewWorkload returns a workload for the given datacenter whose operations
+// are picked using the given seed.
+func NewWorkload(dc string, seed int64) *Workload {
+	return &Workload{
+		Datacenter: dc,
+		Prefix:     "wl-",
+		Nodes:      5,
+		Services:   3,
+		Tags:       []string{"primary", "secondary", "canary"},
+		seed:       seed,
+		rng:        rand.New(rand.NewSource(seed)),
+		nodes:      make(map[string]*workloadNode),
+	}
+}
+
+// History returns a description of each operation run so far.
+func (w *Workload) History() []string {
+	return w.history
+}
+
+// Run runs the given number of steps, stopping at the first failure.
+func (w *Workload) Run(rpc rpcFn, steps int) error {
+	for i := 0; i < steps; i++ {
+		if err := w.Step(rpc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Step runs a single random write and then checks the catalog against the
+// model.
+func (w *Workload) Step(rpc rpcFn) error {
+	w.step++
+	op, err := w.apply(rpc)
+	w.history = append(w.history, op)
+	if err == nil {
+		err = w.verify(rpc)
+	}
+	if err != nil {
+		return fmt.Errorf("workload seed %d, step %d (%s): %v", w.seed, w.step, op, err)
+	}
+	return nil
+}
+
+// apply picks a write, sends it to the server, and updates the model.
+func (w *Workload) apply(rpc rpcFn) (string, error) {
+	switch n := w.rng.Intn(10); {
+	case n < 4:
+		return w.registerService(rpc)
+	case n < 6:
+		return w.flapCheck(rpc)
+	case n < 7:
+		return w.registerNodeCheck(rpc)
+	case n < 8:
+		return w.deregisterService(rpc)
+	case n < 9:
+		return w.deregisterNodeCheck(rpc)
+	default:
+		return w.deregisterNode(rpc)
+	}
+}
+
+func (w *Workload) registerService(rpc rpcFn) (string, error) {
+	idx := w.rng.Intn(w.Nodes)
+	node := fmt.Sprintf("%snode-%d", w.Prefix, idx)
+	address := fmt.Sprintf("10.0.%d.%d", w.rng.Intn(2), idx+1)
+	name := fmt.Sprintf("%sservice-%d", w.Prefix, w.rng.Intn(w.Services))
+	id := fmt.Sprintf("%s-%d", name, w.rng.Intn(2))
+	var tags []string
+	for _, tag := range w.Tags {
+		if w.rng.Intn(2) == 0 {
+			tags = append(tags, tag)
+		}
+	}
+	check := &structs.HealthCheck{
+		Node:      node,
+		CheckID:   id + "-check",
+		Name:      id + "-check",
+		ServiceID: id,
+		Status:    w.status(),
+	}
+
+	op := fmt.Sprintf("register service %q (%s) on %q at %s with tags %v, check %s",
+		id, name, node, address, tags, check.Status)
+	req := structs.RegisterRequest{
+		Datacenter: w.Datacenter,
+		Node:       node,
+		Address:    address,
+		Service: &structs.NodeService{
+			ID:      id,
+			Service: name,
+			Tags:    tags,
+		},
+		Check: check,
+	}
+	var out struct{}
+	if err := rpc("Catalog.Register", &req, &out); err != nil {
+		return op, err
+	}
+
+	n := w.node(node)
+	n.Address = address
+	n.Services[id] = &workloadService{Name: name, Tags: tags}
+	n.Checks[check.CheckID] = &workloadCheck{ServiceID: id, Status: check.Status}
+	return op, nil
+}
+
+func (w *Workload) flapCheck(rpc rpcFn) (string, error) {
+	var candidates [][2]string
+	for _, node := range w.sortedNodes() {
+		for _, id := range sortedKeys(w.nodes[node].Checks) {
+			if w.nodes[node].Checks[id].ServiceID != "" {
+				candidates = append(candidates, [2]string{node, id})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return w.registerService(rpc)
+	}
+	pick := candidates[w.rng.Intn(len(candidates))]
+	node, id := pick[0], pick[1]
+	check := w.nodes[node].Checks[id]
+	status := w.status()
+
+	op := fmt.Sprintf("set check %q on %q to %s", id, node, status)
+	req := structs.RegisterRequest{
+		Datacenter: w.Datacenter,
+		Node:       node,
+		Address:    w.nodes[node].Address,
+		Check: &structs.HealthCheck{
+			Node:      node,
+			CheckID:   id,
+			Name:      id,
+			ServiceID: check.ServiceID,
+			Status:    status,
+		},
+	}
+	var out struct{}
+	if err := rpc("Catalog.Register", &req, &out); err != nil {
+		return op, err
+	}
+	check.Status = status
+	return op, nil
+}
+
+func (w *Workload) registerNodeCheck(rpc rpcFn) (string, error) {
+	nodes := w.sortedNodes()
+	if len(nodes) == 0 {
+		return w.registerService(rpc)
+	}
+	node := nodes[w.rng.Intn(len(nodes))]
+	id := w.Prefix + "node-check"
+	status := w.status()
+
+	op := fmt.Sprintf("set node check on %q to %s", node, status)
+	req := structs.RegisterRequest{
+		Datacenter: w.Datacenter,
+		Node:       node,
+		Address:    w.nodes[node].Address,
+		Check: &structs.HealthCheck{
+			Node:    node,
+			CheckID: id,
+			Name:    id,
+			Status:  status,
+		},
+	}
+	var out struct{}
+	if err := rpc("Catalog.Register", &req, &out); err != nil {
+		return op, err
+	}
+	w.nodes[node].Checks[id] = &workloadCheck{Status: status}
+	return op, nil
+}
+
+func (w *Workload) deregisterService(rpc rpcFn) (string, error) {
+	var candidates [][2]string
+	for _, node := range w.sortedNodes() {
+		for _, id := range sortedKeys(w.nodes[node].Services) {
+			candidates = append(candidates, [2]string{node, id})
+		}
+	}
+	if len(candidates) == 0 {
+		return w.registerService(rpc)
+	}
+	pick := candidates[w.rng.Intn(len(candidates))]
+	node, id := pick[0], pick[1]
+
+	op := fmt.Sprintf("deregister service %q on %q", id, node)
+	req := structs.DeregisterRequest{
+		Datacenter: w.Datacenter,
+		Node:       node,
+		ServiceID:  id,
+	}
+	var out struct{}
+	if err := rpc("Catalog.Deregister", &req, &out); err != nil {
+		return op, err
+	}
+
+	// The service's checks go with it.
+	n := w.nodes[node]
+	delete(n.Services, id)
+	for checkID, check := range n.Checks {
+		if check.ServiceID == id {
+			delete(n.Checks, checkID)
+		}
+	}
+	return op, nil
+}
+
+func (w *Workload) deregisterNodeCheck(rpc rpcFn) (string, error) {
+	id := w.Prefix + "node-check"
+	var candidates []string
+	for _, node := range w.sortedNodes() {
+		if _, ok := w.nodes[node].Checks[id]; ok {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		return w.registerNodeCheck(rpc)
+	}
+	node := candidates[w.rng.Intn(len(candidates))]
+
+	op := fmt.Sprintf("deregister node check on %q", node)
+	req := structs.DeregisterRequest{
+		Datacenter: w.Datacenter,
+		Node:       node,
+		CheckID:    id,
+	}
+	var out struct{}
+	if err := rpc("Catalog.Deregister", &req, &out); err != nil {
+		return op, err
+	}
+	delete(w.nodes[node].Checks, id)
+	return op, nil
+}
+
+func (w *Workload) deregisterNode(rpc rpcFn) (string, error) {
+	nodes := w.sortedNodes()
+	if len(nodes) == 0 {
+		return w.registerService(rpc)
+	}
+	node := nodes[w.rng.Intn(len(nodes))]
+
+	op := fmt.Sprintf("deregister node %q", node)
+	req := structs.DeregisterRequest{
+		Datacenter: w.Datacenter,
+		Node:       node,
+	}
+	var out struct{}
+	if err := rpc("Catalog.Deregister", &req, &out); err != nil {
+		return op, err
+	}
+	delete(w.nodes, node)
+	return op, nil
+}
+
+// verify checks the catalog and health endpoints against the model.
+func (w *Workload) verify(rpc rpcFn) error {
+	// Every write touches the nodes, services, or checks table, so the
+	// combined index the health endpoints report must have moved on.
+	var index uint64
+
+	// The node list has every node, with its latest address.
+	args := structs.DCSpecificRequest{Datacenter: w.Datacenter}
+	var nodes structs.IndexedNodes
+	if err := rpc("Catalog.ListNodes", &args, &nodes); err != nil {
+		return err
+	}
+	got := make(map[string]string)
+	for _, n := range nodes.Nodes {
+		if strings.HasPrefix(n.Node, w.Prefix) {
+			got[n.Node] = n.Address
+		}
+	}
+	expected := make(map[string]string)
+	for name, n := range w.nodes {
+		expected[name] = n.Address
+	}
+	if !reflect.DeepEqual(got, expected) {
+		return fmt.Errorf("Catalog.ListNodes: got %v, expected %v", got, expected)
+	}
+
+	for i := 0; i < w.Services; i++ {
+		name := fmt.Sprintf("%sservice-%d", w.Prefix, i)
+
+		// The catalog has every instance, with and without a tag filter.
+		if err := w.verifyServiceNodes(rpc, name, ""); err != nil {
+			return err
+		}
+		tag := w.Tags[w.rng.Intn(len(w.Tags))]
+		if err := w.verifyServiceNodes(rpc, name, tag); err != nil {
+			return err
+		}
+
+		// Health results carry the node's checks and the instance's own.
+		req := structs.ServiceSpecificRequest{
+			Datacenter:  w.Datacenter,
+			ServiceName: name,
+		}
+		var out structs.IndexedCheckServiceNodes
+		if err := rpc("Health.ServiceNodes", &req, &out); err != nil {
+			return err
+		}
+		got := make(map[string]map[string]string)
+		for _, csn := range out.Nodes {
+			checks := make(map[string]string)
+			for _, check := range csn.Checks {
+				checks[check.CheckID] = check.Status
+			}
+			got[csn.Node.Node+"/"+csn.Service.ID] = checks
+		}
+		expected := make(map[string]map[string]string)
+		for node, n := range w.nodes {
+			for id, service := range n.Services {
+				if service.Name != name {
+					continue
+				}
+				checks := make(map[string]string)
+				for checkID, check := range n.Checks {
+					if check.ServiceID == "" || check.ServiceID == id {
+						checks[checkID] = check.Status
+					}
+				}
+				expected[node+"/"+id] = checks
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			return fmt.Errorf("Health.ServiceNodes %q: got %v, expected %v", name, got, expected)
+		}
+		if out.Index > index {
+			index = out.Index
+		}
+	}
+
+	if index <= w.index {
+		return fmt.Errorf("index went from %d to %d after a write", w.index, index)
+	}
+	w.index = index
+	return nil
+}
+
+// verifyServiceNodes checks the instances of a service the catalog returns,
+// optionally filtered by a tag.
+func (w *Workload) verifyServiceNodes(rpc rpcFn, name, tag string) error {
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  w.Datacenter,
+		ServiceName: name,
+		ServiceTag:  tag,
+		TagFilter:   tag != "",
+	}
+	var out structs.IndexedServiceNodes
+	if err := rpc("Catalog.ServiceNodes", &req, &out); err != nil {
+		return err
+	}
+	got := make(map[string][]string)
+	for _, sn := range out.ServiceNodes {
+		got[sn.Node+"/"+sn.ServiceID] = sortedTags(sn.ServiceTags)
+	}
+	expected := make(map[string][]string)
+	for node, n := range w.nodes {
+		for id, service := range n.Services {
+			if service.Name != name {
+				continue
+			}
+			if tag != "" && !containsTag(service.Tags, tag) {
+				continue
+			}
+			expected[node+"/"+id] = sortedTags(service.Tags)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		return fmt.Errorf("Catalog.ServiceNodes %q tag %q: got %v, expected %v", name, tag, got, expected)
+	}
+	return nil
+}
+
+// node returns the model of the given node, adding it if needed.
+func (w *Workload) node(name string) *workloadNode {
+	n, ok := w.nodes[name]
+	if !ok {
+		n = &workloadNode{
+			Services: make(map[string]*workloadService),
+			Checks:   make(map[string]*workloadCheck),
+		}
+		w.nodes[name] = n
+	}
+	return n
+}
+
+// sortedNodes returns the modelled node names in a stable order, so runs
+// with the same seed pick the same things.
+func (w *Workload) sortedNodes() []string {
+	var names []string
+	for name := range w.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// status returns a random check status.
+func (w *Workload) status() string {
+	statuses := []string{structs.HealthPassing, structs.HealthWarning, structs.HealthCritical}
+	return statuses[w.rng.Intn(len(statuses))]
+}
+
+// sortedKeys returns the keys of a map of services or checks in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]*workloadService:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*workloadCheck:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedTags returns a sorted copy of the given tags, with no tags as an
+// empty list so it compares equal to a nil one.
+func sortedTags(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}